@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Files of the certificate and key the app serves HTTPS with.
+const (
+	appCertFile = "tls.crt"
+	appKeyFile  = "tls.key"
+)
+
+// writeAppCertificate generates a CA and a certificate signed by it for
+// hosts, valid for a day, and writes the certificate and its key to dir. It
+// returns the PEM encoded certificate of the CA, which the clients of the app
+// trust.
+func writeAppCertificate(dir string, hosts ...string) ([]byte, error) {
+	now := time.Now()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"testcontainers-dapr-example"}, CommonName: "app CA"},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	ca, err = x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{Organization: []string{"testcontainers-dapr-example"}, CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{
+		appCertFile: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		appKeyFile:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0o644); err != nil {
+			return nil, err
+		}
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), nil
+}
+
+// appTLSConfig returns the configuration of the clients of the app serving
+// the certificate of host signed by caPEM, whatever the address they dial.
+func appTLSConfig(caPEM []byte, host string) *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	return &tls.Config{RootCAs: roots, ServerName: host}
+}
+
+func TestWriteAppCertificate(t *testing.T) {
+	dir := t.TempDir()
+
+	caPEM, err := writeAppCertificate(dir, "app", "app-2")
+	if err != nil {
+		t.Fatalf("couldn't write certificate: %s", err)
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, appCertFile), filepath.Join(dir, appKeyFile))
+	if err != nil {
+		t.Fatalf("couldn't load certificate: %s", err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	defer server.Close()
+
+	for _, host := range []string{"app", "app-2"} {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: appTLSConfig(caPEM, host)}}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("expected the certificate to be trusted for %s. Got %s.", host, err)
+		}
+		resp.Body.Close()
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: appTLSConfig(caPEM, "subscriber")}}
+	if resp, err := client.Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected the certificate not to be trusted for another host")
+	}
+}
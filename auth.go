@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// ErrUnauthenticated is returned by an Authenticator when the request doesn't
+// carry valid credentials.
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Authenticator verifies the credentials of an incoming request.
+type Authenticator interface {
+	Authenticate(r *http.Request) error
+}
+
+// AuthConfig holds the credentials accepted by the API. Authentication is
+// disabled when neither API keys nor a JWT secret are configured.
+type AuthConfig struct {
+	APIKeys     []Secret
+	JWTSecret   Secret
+	JWTIssuer   string
+	JWTAudience string
+	// AdminAPIKeys are the only credentials the admin routes accept when
+	// set, rather than those of the API.
+	AdminAPIKeys []Secret
+}
+
+// Enabled reports whether at least one authentication method is configured.
+func (c AuthConfig) Enabled() bool {
+	return len(c.APIKeys) > 0 || c.JWTSecret != ""
+}
+
+// AdminEnabled reports whether the admin routes require authentication.
+func (c AuthConfig) AdminEnabled() bool {
+	return len(c.AdminAPIKeys) > 0 || c.Enabled()
+}
+
+// NewAdminAuthenticator builds the Authenticator of the admin routes, which
+// accepts the admin API keys if any, and otherwise the credentials of the
+// API.
+func NewAdminAuthenticator(config AuthConfig) Authenticator {
+	if len(config.AdminAPIKeys) > 0 {
+		return &APIKeyAuthenticator{Keys: config.AdminAPIKeys}
+	}
+	return NewAuthenticator(config)
+}
+
+// NewAuthenticator builds an Authenticator accepting any of the configured
+// authentication methods.
+func NewAuthenticator(config AuthConfig) Authenticator {
+	var authenticators anyAuthenticator
+	if len(config.APIKeys) > 0 {
+		authenticators = append(authenticators, &APIKeyAuthenticator{Keys: config.APIKeys})
+	}
+	if config.JWTSecret != "" {
+		authenticators = append(authenticators, &JWTAuthenticator{
+			Secret:   []byte(config.JWTSecret),
+			Issuer:   config.JWTIssuer,
+			Audience: config.JWTAudience,
+		})
+	}
+	return authenticators
+}
+
+// APIKeyAuthenticator accepts requests with one of Keys in the X-API-Key
+// header.
+type APIKeyAuthenticator struct {
+	Keys []Secret
+}
+
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) error {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return fmt.Errorf("%w: missing API key", ErrUnauthenticated)
+	}
+	for _, k := range a.Keys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: invalid API key", ErrUnauthenticated)
+}
+
+// JWTAuthenticator accepts requests with an HMAC signed JWT in the
+// Authorization bearer header. Issuer and Audience are only checked when set.
+type JWTAuthenticator struct {
+	Secret   []byte
+	Issuer   string
+	Audience string
+}
+
+func (a *JWTAuthenticator) Authenticate(r *http.Request) error {
+	header := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || token == "" {
+		return fmt.Errorf("%w: missing bearer token", ErrUnauthenticated)
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"}),
+		jwt.WithExpirationRequired(),
+	}
+	if a.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(a.Issuer))
+	}
+	if a.Audience != "" {
+		opts = append(opts, jwt.WithAudience(a.Audience))
+	}
+
+	_, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
+		return a.Secret, nil
+	}, opts...)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnauthenticated, err)
+	}
+	return nil
+}
+
+// anyAuthenticator accepts a request as soon as one of its authenticators
+// does.
+type anyAuthenticator []Authenticator
+
+func (a anyAuthenticator) Authenticate(r *http.Request) error {
+	err := fmt.Errorf("%w: no authentication method configured", ErrUnauthenticated)
+	for _, authenticator := range a {
+		if err = authenticator.Authenticate(r); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// RequireAuth rejects requests that are not accepted by authenticator with a
+// 401 status code.
+func RequireAuth(authenticator Authenticator) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := authenticator.Authenticate(r); err != nil {
+				slog.WarnContext(r.Context(), "rejected unauthenticated request", "path", r.URL.Path, "error", err)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="orders"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprintf(w, "Unauthorized")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+const testJWTSecret = "test-secret"
+
+func signTestToken(t *testing.T, method jwt.SigningMethod, secret string, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatalf("couldn't sign token: %s", err)
+	}
+	return token
+}
+
+func TestRequireAuth(t *testing.T) {
+	config := AuthConfig{
+		APIKeys:     []Secret{"key-1", "key-2"},
+		JWTSecret:   testJWTSecret,
+		JWTIssuer:   "orders-test",
+		JWTAudience: "orders",
+	}
+
+	validClaims := jwt.MapClaims{
+		"iss": "orders-test",
+		"aud": "orders",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		headers  map[string]string
+		expected int
+	}{
+		{
+			name:     "health is open",
+			path:     "/health",
+			expected: http.StatusOK,
+		},
+		{
+			name:     "missing credentials",
+			path:     "/orders/order-1234",
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "valid API key",
+			path:     "/orders/order-1234",
+			headers:  map[string]string{"X-API-Key": "key-2"},
+			expected: http.StatusOK,
+		},
+		{
+			name:     "invalid API key",
+			path:     "/orders/order-1234",
+			headers:  map[string]string{"X-API-Key": "key-3"},
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "valid bearer token",
+			path:     "/orders/order-1234",
+			headers:  map[string]string{"Authorization": "Bearer " + signTestToken(t, jwt.SigningMethodHS256, testJWTSecret, validClaims)},
+			expected: http.StatusOK,
+		},
+		{
+			name:     "bearer token signed with another secret",
+			path:     "/orders/order-1234",
+			headers:  map[string]string{"Authorization": "Bearer " + signTestToken(t, jwt.SigningMethodHS256, "other-secret", validClaims)},
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name: "expired bearer token",
+			path: "/orders/order-1234",
+			headers: map[string]string{"Authorization": "Bearer " + signTestToken(t, jwt.SigningMethodHS256, testJWTSecret, jwt.MapClaims{
+				"iss": "orders-test",
+				"aud": "orders",
+				"exp": time.Now().Add(-time.Hour).Unix(),
+			})},
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name: "bearer token without expiration",
+			path: "/orders/order-1234",
+			headers: map[string]string{"Authorization": "Bearer " + signTestToken(t, jwt.SigningMethodHS256, testJWTSecret, jwt.MapClaims{
+				"iss": "orders-test",
+				"aud": "orders",
+			})},
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name: "bearer token for another audience",
+			path: "/orders/order-1234",
+			headers: map[string]string{"Authorization": "Bearer " + signTestToken(t, jwt.SigningMethodHS256, testJWTSecret, jwt.MapClaims{
+				"iss": "orders-test",
+				"aud": "payments",
+				"exp": time.Now().Add(time.Hour).Unix(),
+			})},
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "malformed authorization header",
+			path:     "/orders/order-1234",
+			headers:  map[string]string{"Authorization": "Basic dXNlcjpwYXNz"},
+			expected: http.StatusUnauthorized,
+		},
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	router := mux.NewRouter()
+	router.Handle("/health", ok)
+	orders := router.PathPrefix("/orders").Subrouter()
+	orders.Use(RequireAuth(NewAuthenticator(config)))
+	orders.Handle("/{id}", ok)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, tt.path, nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.expected {
+				t.Fatalf("expected status code %d. Got %d.", tt.expected, rec.Code)
+			}
+		})
+	}
+}
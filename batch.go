@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// maxBatchSize bounds the number of orders of a batch update.
+const maxBatchSize = 1000
+
+// BatchUpdate is an item of a batch update.
+type BatchUpdate struct {
+	ID string
+	OrderUpdate
+}
+
+// BatchResult is the outcome of an item of a batch update. Status is the HTTP
+// status code the item would have been answered with on its own.
+type BatchResult struct {
+	ID         string           `json:"id"`
+	Status     int              `json:"status"`
+	Message    string           `json:"message"`
+	ETag       string           `json:"etag,omitempty"`
+	Transition *TransitionError `json:"transition,omitempty"`
+}
+
+// decodeBatch reads the JSON array of the body of r into v.
+func decodeBatch(r *http.Request, v any) error {
+	mediaType, err := requestMediaType(r)
+	if err != nil {
+		return err
+	}
+	if mediaType != contentTypeJSON {
+		return fmt.Errorf("%w: batches are %s only", ErrUnsupportedMediaType, contentTypeJSON)
+	}
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+// handleOrdersBatchPut applies the updates of a JSON array of orders, and
+// answers with the result of each in the same order. Orders are updated
+// concurrently by at most BatchWorkers workers.
+func (h *AppHandler) handleOrdersBatchPut(m OrderMapper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		updates, err := m.DecodeBatch(r)
+		if err != nil {
+			writeCodecError(w, err)
+			return
+		}
+		if err := validateBatch(updates); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Bad request: %s", err)
+			return
+		}
+		// the header expedites every update of the batch
+		expedited, err := expeditedHeader(r)
+		if err != nil {
+			writePriorityError(w, err)
+			return
+		}
+		for i := range updates {
+			updates[i].Expedited = updates[i].Expedited || expedited
+		}
+
+		results := h.updateOrders(r.Context(), updates)
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		if err := json.NewEncoder(w).Encode(results); err != nil {
+			slog.ErrorContext(r.Context(), "couldn't encode batch results", "error", err)
+		}
+	}
+}
+
+// validateBatch rejects empty and oversized batches, and those updating an
+// order more than once, which would conflict with each other.
+func validateBatch(updates []BatchUpdate) error {
+	if len(updates) == 0 {
+		return fmt.Errorf("empty batch")
+	}
+	if len(updates) > maxBatchSize {
+		return fmt.Errorf("more than %d orders", maxBatchSize)
+	}
+	seen := map[string]bool{}
+	for _, update := range updates {
+		if seen[update.ID] {
+			return fmt.Errorf("order %s updated more than once", update.ID)
+		}
+		seen[update.ID] = true
+	}
+	return nil
+}
+
+func (h *AppHandler) updateOrders(ctx context.Context, updates []BatchUpdate) []BatchResult {
+	results := make([]BatchResult, len(updates))
+	jobs := make(chan int)
+
+	workers := min(max(h.config.BatchWorkers, 1), len(updates))
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results[j] = h.updateBatchItem(ctx, updates[j])
+			}
+		}()
+	}
+	for i := range updates {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+func (h *AppHandler) updateBatchItem(ctx context.Context, update BatchUpdate) BatchResult {
+	result := BatchResult{ID: update.ID, Status: http.StatusBadRequest}
+	if err := validateOrderIDs([]string{update.ID}); err != nil {
+		result.Message = fmt.Sprintf("Bad request: %s", err)
+		return result
+	}
+	if err := validateUpdate(update.OrderUpdate); err != nil {
+		result.Message = fmt.Sprintf("Bad request: %s", err)
+		return result
+	}
+
+	res := h.updateOrder(ctx, update.ID, update.OrderUpdate, "")
+	result.Status = res.Code
+	result.Message = res.Message
+	result.ETag = res.ETag
+	result.Transition = res.Transition
+	return result
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestOrdersBatchPut(t *testing.T) {
+	server := newOrdersServer(t)
+
+	doRequest(t, http.MethodPut, server.URL+"/orders/order-0003", contentTypeJSON, "", []byte(`{"status":"PAID"}`))
+
+	body := []byte(`[
+		{"id":"order-0001","status":"PENDING"},
+		{"id":"order-0002","status":"PAID"},
+		{"id":"order-0003","status":"PENDING"},
+		{"id":"order-1","status":"PAID"}
+	]`)
+	resp, data := doRequest(t, http.MethodPut, server.URL+"/orders", contentTypeJSON, "", body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d: %s.", http.StatusOK, resp.StatusCode, data)
+	}
+
+	var results []BatchResult
+	if err := json.Unmarshal(data, &results); err != nil {
+		t.Fatalf("couldn't decode results: %s", err)
+	}
+	expected := []struct {
+		id     string
+		status int
+	}{
+		{"order-0001", http.StatusOK},
+		{"order-0002", http.StatusOK},
+		{"order-0003", http.StatusConflict},
+		{"order-1", http.StatusBadRequest},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results. Got %v.", len(expected), results)
+	}
+	for i, want := range expected {
+		if results[i].ID != want.id || results[i].Status != want.status {
+			t.Fatalf("expected %s to be answered with %d. Got %+v.", want.id, want.status, results[i])
+		}
+	}
+	if results[2].Transition == nil || results[2].Transition.From != OrderStatusPaid {
+		t.Fatalf("expected the rejected transition of order-0003. Got %+v.", results[2])
+	}
+
+	_, data = doRequest(t, http.MethodGet, server.URL+"/orders/order-0002", "", "", nil)
+	if expected := `{"id":"order-0002","status":"PAID"}` + "\n"; string(data) != expected {
+		t.Fatalf("expected body %s. Got %s.", expected, data)
+	}
+}
+
+func TestOrdersBatchPutRejectsInvalidBatches(t *testing.T) {
+	server := newOrdersServer(t)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"empty", contentTypeJSON, `[]`, http.StatusBadRequest},
+		{"duplicate", contentTypeJSON, `[{"id":"order-0001","status":"PAID"},{"id":"order-0001","status":"PENDING"}]`, http.StatusBadRequest},
+		{"not an array", contentTypeJSON, `{"id":"order-0001","status":"PAID"}`, http.StatusBadRequest},
+		{"protobuf", contentTypeProtobuf, ``, http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, _ := doRequest(t, http.MethodPut, server.URL+"/orders", tt.contentType, "", []byte(tt.body))
+			if resp.StatusCode != tt.want {
+				t.Fatalf("expected status code %d. Got %d.", tt.want, resp.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// bodyTooLargeError is the answer to requests whose body exceeds the limit.
+type bodyTooLargeError struct {
+	Error string `json:"error"`
+	// Limit is the size of the largest body accepted, in bytes.
+	Limit int64 `json:"limit"`
+}
+
+// mutatingMethods are the methods of the requests whose body is limited.
+var mutatingMethods = map[string]bool{
+	http.MethodPost:   true,
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// LimitBodySize answers 413 Request Entity Too Large to the mutating requests
+// whose body exceeds limit bytes, maxBodySize if zero, before their handler
+// runs, so that an oversized payload is neither held in memory nor forwarded
+// to the sidecar. Bodies of unknown length are read up to the limit to tell.
+func LimitBodySize(limit int64) mux.MiddlewareFunc {
+	if limit <= 0 {
+		limit = maxBodySize
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !mutatingMethods[r.Method] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.ContentLength > limit {
+				writeBodyTooLarge(w, limit)
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				writeBodyTooLarge(w, limit)
+				return
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "Bad request")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func writeBodyTooLarge(w http.ResponseWriter, limit int64) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	// the rest of the body isn't read, the connection can't be reused
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	body := bodyTooLargeError{Error: fmt.Sprintf("request body exceeds %d bytes", limit), Limit: limit}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Error("couldn't encode body size error", "error", err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitBodySize(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		// chunked hides the length of the body, which is then read to
+		// tell whether it is too large
+		chunked  bool
+		expected int
+	}{
+		{name: "small body", method: http.MethodPut, body: `{"status":"PAID"}`, expected: http.StatusOK},
+		{name: "body at the limit", method: http.MethodPost, body: strings.Repeat("a", 32), expected: http.StatusOK},
+		{name: "large body", method: http.MethodPut, body: strings.Repeat("a", 33), expected: http.StatusRequestEntityTooLarge},
+		{name: "large chunked body", method: http.MethodPatch, body: strings.Repeat("a", 33), chunked: true, expected: http.StatusRequestEntityTooLarge},
+		{name: "not a mutation", method: http.MethodGet, body: strings.Repeat("a", 33), expected: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var read string
+			handler := LimitBodySize(32)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Fatalf("couldn't read body: %s", err)
+				}
+				read = string(body)
+			}))
+
+			req := httptest.NewRequest(tt.method, "/orders/order-1234", strings.NewReader(tt.body))
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.expected {
+				t.Fatalf("expected status code %d. Got %d.", tt.expected, rec.Code)
+			}
+			if rec.Code == http.StatusOK && read != tt.body {
+				t.Fatalf("expected the handler to read the body. Got %q.", read)
+			}
+			if rec.Code != http.StatusRequestEntityTooLarge {
+				return
+			}
+			var answer bodyTooLargeError
+			if err := json.NewDecoder(rec.Body).Decode(&answer); err != nil || answer.Limit != 32 || answer.Error == "" {
+				t.Fatalf("expected a JSON error with limit 32. Got %+v: %v", answer, err)
+			}
+			if read != "" {
+				t.Fatalf("expected the handler not to run. Got body %q.", read)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// handleOrdersCancel cancels the order, if its status allows it, and
+// publishes an OrderCancelled event. The cancellation is based on the version
+// If-Match if set.
+func (h *AppHandler) handleOrdersCancel(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["id"]
+	h.writeUpdateResult(w, h.cancelOrder(r.Context(), orderID, r.Header.Get("If-Match")))
+}
+
+// cancelOrder cancels the order orderID like updateOrder changes its status,
+// a cancellation whose event couldn't be published being reverted.
+func (h *AppHandler) cancelOrder(ctx context.Context, orderID, ifMatch string) updateResult {
+	current, cancelled, etag, res, ok := h.claimStatus(ctx, orderID, ifMatch, OrderStatusCancelled)
+	if !ok {
+		return res
+	}
+
+	event := OrderCancelled{Order: cancelled, PreviousStatus: current.Status, CancelledAt: time.Now().UTC()}
+	if err := h.publisher.Publish(WithEventKey(ctx, orderEventKey(ctx, orderID, etag)), handlerOrdersCancel, topicOrders, event); err != nil {
+		slog.ErrorContext(ctx, "couldn't publish event", "error", err)
+		if err := RevertOrder(context.WithoutCancel(ctx), h.store, cancelled, current, true); err != nil {
+			slog.ErrorContext(ctx, "couldn't revert order", "order", orderID, "error", err)
+		}
+		if permanentPublishError(err) {
+			return updateResult{Code: http.StatusInternalServerError, Message: "Internal server error"}
+		}
+		return updateResult{Code: http.StatusServiceUnavailable, Message: "Service unavailable"}
+	}
+
+	slog.InfoContext(ctx, "sent order cancellation to orders topic", "data", cancelled)
+	if h.inventory != nil {
+		h.updateReservation(ctx, current.Status, cancelled)
+	}
+	h.metrics.OrderUpdates.WithLabelValues(h.config.Tenants.MetricLabel(cancelled.Tenant)).Inc()
+	h.notifier.Notify(cancelled)
+	return updateResult{Code: http.StatusOK, Message: "Order cancelled"}
+}
+
+// claimStatus moves the existing order orderID to status, based on the
+// version ifMatch if set, and returns the order before and after the change,
+// along with the version etag it was changed from. Unless ok, the change was
+// rejected with res.
+func (h *AppHandler) claimStatus(ctx context.Context, orderID, ifMatch string, status OrderStatus) (current, changed Order, etag string, res updateResult, ok bool) {
+	current, etag, err := h.store.Get(ctx, orderID)
+	if errors.Is(err, ErrOrderNotFound) {
+		return current, changed, etag, updateResult{Code: http.StatusNotFound, Message: "Order not found"}, false
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't get order", "error", err)
+		return current, changed, etag, updateResult{Code: http.StatusServiceUnavailable, Message: "Service unavailable"}, false
+	}
+	if ifMatch != "" && parseETag(ifMatch) != etag {
+		return current, changed, etag, conflictResult(etag), false
+	}
+	if err := orderTransitions.Check(current.Status, status); err != nil {
+		return current, changed, etag, transitionResult(err), false
+	}
+
+	changed = current
+	changed.Status = status
+	if err := h.store.Save(ctx, changed, etag); err != nil {
+		if errors.Is(err, ErrETagMismatch) {
+			_, etag, _ = h.store.Get(ctx, orderID)
+			return current, changed, etag, conflictResult(etag), false
+		}
+		slog.ErrorContext(ctx, "couldn't save order", "error", err)
+		return current, changed, etag, updateResult{Code: http.StatusServiceUnavailable, Message: "Service unavailable"}, false
+	}
+	return current, changed, etag, updateResult{}, true
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestCancelOrder(t *testing.T) {
+	errUnavailable := errors.New("unavailable")
+
+	tests := []struct {
+		name string
+		// existing is stored beforehand if set
+		existing  *Order
+		ifMatch   string
+		storeErrs map[string]error
+		publisher *mockPublisher
+		// expected is the answer, stored the order stored afterwards if any,
+		// and published whether an OrderCancelled event was published
+		expected  updateResult
+		stored    *Order
+		published bool
+		calls     []string
+	}{
+		{
+			name:      "pending order",
+			existing:  &Order{ID: "order-1234", Status: OrderStatusPending, LineItems: []LineItem{{SKU: "sku-1", Quantity: 2}}},
+			expected:  updateResult{Code: http.StatusOK, Message: "Order cancelled"},
+			stored:    &Order{ID: "order-1234", Status: OrderStatusCancelled, LineItems: []LineItem{{SKU: "sku-1", Quantity: 2}}},
+			published: true,
+			calls:     []string{"Get", "Save"},
+		},
+		{
+			name:     "unknown order",
+			expected: updateResult{Code: http.StatusNotFound, Message: "Order not found"},
+			calls:    []string{"Get"},
+		},
+		{
+			name:     "paid order",
+			existing: &Order{ID: "order-1234", Status: OrderStatusPaid},
+			expected: updateResult{
+				Code:       http.StatusConflict,
+				Message:    `order status can't change from "PAID" to "CANCELLED"`,
+				Transition: &TransitionError{From: OrderStatusPaid, To: OrderStatusCancelled, Reason: TransitionReasonInvalid},
+			},
+			stored: &Order{ID: "order-1234", Status: OrderStatusPaid},
+			calls:  []string{"Get"},
+		},
+		{
+			name:     "cancelled order",
+			existing: &Order{ID: "order-1234", Status: OrderStatusCancelled},
+			expected: updateResult{
+				Code:       http.StatusConflict,
+				Message:    `order status can't change from "CANCELLED" to "CANCELLED"`,
+				Transition: &TransitionError{From: OrderStatusCancelled, To: OrderStatusCancelled, Reason: TransitionReasonInvalid},
+			},
+			stored: &Order{ID: "order-1234", Status: OrderStatusCancelled},
+			calls:  []string{"Get"},
+		},
+		{
+			name:     "stale If-Match",
+			existing: &Order{ID: "order-1234", Status: OrderStatusPending},
+			ifMatch:  `"0"`,
+			expected: conflictResult("1"),
+			stored:   &Order{ID: "order-1234", Status: OrderStatusPending},
+			calls:    []string{"Get"},
+		},
+		{
+			name:      "concurrent write",
+			existing:  &Order{ID: "order-1234", Status: OrderStatusPending},
+			storeErrs: map[string]error{"Save": ErrETagMismatch},
+			expected:  conflictResult("1"),
+			stored:    &Order{ID: "order-1234", Status: OrderStatusPending},
+			calls:     []string{"Get", "Save", "Get"},
+		},
+		{
+			name:      "unavailable broker reverts the cancellation",
+			existing:  &Order{ID: "order-1234", Status: OrderStatusPending},
+			publisher: &mockPublisher{err: errUnavailable},
+			expected:  updateResult{Code: http.StatusServiceUnavailable, Message: "Service unavailable"},
+			stored:    &Order{ID: "order-1234", Status: OrderStatusPending},
+			calls:     []string{"Get", "Save", "Get", "Save"},
+		},
+		{
+			name:      "incompatible schema reverts the cancellation for good",
+			existing:  &Order{ID: "order-1234", Status: OrderStatusPending},
+			publisher: &mockPublisher{err: fmt.Errorf("%w with the latest version of subject orders-value", ErrIncompatibleSchema)},
+			expected:  updateResult{Code: http.StatusInternalServerError, Message: "Internal server error"},
+			stored:    &Order{ID: "order-1234", Status: OrderStatusPending},
+			calls:     []string{"Get", "Save", "Get", "Save"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMockOrderRepository()
+			if tt.existing != nil {
+				store.save(*tt.existing)
+			}
+			store.errs = tt.storeErrs
+			publisher := tt.publisher
+			if publisher == nil {
+				publisher = &mockPublisher{}
+			}
+
+			h := newMockHandler(publisher, store)
+			res := h.cancelOrder(context.Background(), "order-1234", tt.ifMatch)
+			if !reflect.DeepEqual(res, tt.expected) {
+				t.Fatalf("expected result %+v. Got %+v.", tt.expected, res)
+			}
+
+			stored, ok := store.orders["order-1234"]
+			if (tt.stored == nil && ok) || (tt.stored != nil && !reflect.DeepEqual(stored, *tt.stored)) {
+				t.Fatalf("expected stored order %v. Got %v (%t).", tt.stored, stored, ok)
+			}
+			if !slices.Equal(store.calls, tt.calls) {
+				t.Fatalf("expected calls %v. Got %v.", tt.calls, store.calls)
+			}
+
+			if !tt.published {
+				if len(publisher.events) != 0 {
+					t.Fatalf("expected no event. Got %v.", publisher.events)
+				}
+				return
+			}
+			if len(publisher.events) != 1 {
+				t.Fatalf("expected one event. Got %v.", publisher.events)
+			}
+			e := publisher.events[0]
+			event, ok := e.data.(OrderCancelled)
+			if e.handler != handlerOrdersCancel || e.topic != topicOrders || !ok {
+				t.Fatalf("expected an OrderCancelled event of %s on %s. Got %+v.", handlerOrdersCancel, topicOrders, e)
+			}
+			if !reflect.DeepEqual(event.Order, *tt.stored) || event.PreviousStatus != tt.existing.Status || event.CancelledAt.IsZero() {
+				t.Fatalf("expected the event to carry the cancelled order and its previous status. Got %+v.", event)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	b := NewCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 2, OpenTimeout: time.Minute})
+	b.now = func() time.Time { return now }
+
+	var transitions []CircuitState
+	b.OnStateChange = func(state CircuitState) {
+		transitions = append(transitions, state)
+	}
+
+	errSidecar := errors.New("sidecar unavailable")
+	fail := func() error { return errSidecar }
+	succeed := func() error { return nil }
+
+	for i := 0; i < 2; i++ {
+		if err := b.Execute(fail); !errors.Is(err, errSidecar) {
+			t.Fatalf("expected error %q. Got %v.", errSidecar, err)
+		}
+	}
+	if b.State() != CircuitOpen {
+		t.Fatalf("expected circuit to be %s. Got %s.", CircuitOpen, b.State())
+	}
+
+	called := false
+	if err := b.Execute(func() error { called = true; return nil }); err != ErrCircuitOpen {
+		t.Fatalf("expected error %q. Got %v.", ErrCircuitOpen, err)
+	}
+	if called {
+		t.Fatal("expected call to be rejected while the circuit is open")
+	}
+
+	// a failed trial call opens the circuit again
+	now = now.Add(time.Minute)
+	if b.State() != CircuitHalfOpen {
+		t.Fatalf("expected circuit to be %s. Got %s.", CircuitHalfOpen, b.State())
+	}
+	if err := b.Execute(fail); !errors.Is(err, errSidecar) {
+		t.Fatalf("expected error %q. Got %v.", errSidecar, err)
+	}
+	if b.State() != CircuitOpen {
+		t.Fatalf("expected circuit to be %s. Got %s.", CircuitOpen, b.State())
+	}
+
+	// a successful trial call closes it
+	now = now.Add(time.Minute)
+	if err := b.Execute(succeed); err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+	if b.State() != CircuitClosed {
+		t.Fatalf("expected circuit to be %s. Got %s.", CircuitClosed, b.State())
+	}
+
+	expected := []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitOpen, CircuitHalfOpen, CircuitClosed}
+	if len(transitions) != len(expected) {
+		t.Fatalf("expected transitions %v. Got %v.", expected, transitions)
+	}
+	for i := range expected {
+		if transitions[i] != expected[i] {
+			t.Fatalf("expected transitions %v. Got %v.", expected, transitions)
+		}
+	}
+}
+
+func TestCircuitBreakerSingleTrialCall(t *testing.T) {
+	now := time.Now()
+	b := NewCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute})
+	b.now = func() time.Time { return now }
+
+	_ = b.Execute(func() error { return errors.New("boom") })
+	now = now.Add(time.Minute)
+
+	err := b.Execute(func() error {
+		// a concurrent call while the trial is in flight is rejected
+		if err := b.Execute(func() error { return nil }); err != ErrCircuitOpen {
+			t.Errorf("expected error %q. Got %v.", ErrCircuitOpen, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/testcontainers/testcontainers-go"
+)
+
+// Labels of the containers and networks of the stacks. labelSession
+// identifies the test run which started them, labelStack their stack.
+const (
+	labelPrefix  = "com.github.etiennetremel.testcontainers-dapr-example"
+	labelSession = labelPrefix + ".session"
+	labelStack   = labelPrefix + ".stack"
+)
+
+// imageRepo is the repository of the images the stacks build, tagged with
+// the session which built them.
+const imageRepo = "testcontainers-dapr-example"
+
+var cleanupFlag = flag.Duration("cleanup", 0, "remove the containers, networks and images left by test runs started longer than the duration ago, 0 to keep them")
+
+// sessionID identifies this test run.
+var sessionID = func() string {
+	id, err := newStackID()
+	if err != nil {
+		panic(err)
+	}
+	return id
+}()
+
+// sessionLabels returns the labels of the containers and networks of the
+// stack id.
+func sessionLabels(id string) map[string]string {
+	return map[string]string{
+		labelSession: sessionID,
+		labelStack:   id,
+	}
+}
+
+// builtImageRepo returns the repository of the image of service built by the
+// stacks, tagged with sessionID.
+func builtImageRepo(service string) string {
+	return imageRepo + "/" + service
+}
+
+// stale reports whether a resource labelled with labels and created at
+// created was left by a test run older than cutoff.
+func stale(labels map[string]string, created, cutoff time.Time) bool {
+	session, ok := labels[labelSession]
+	return ok && session != sessionID && created.Before(cutoff)
+}
+
+// cleanupStragglers removes the containers, networks and images of the test
+// runs started before cutoff, such as those of aborted runs whose containers
+// were never terminated.
+func cleanupStragglers(ctx context.Context, cutoff time.Time) error {
+	cli, err := testcontainers.NewDockerClientWithOpts(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to docker: %w", err)
+	}
+	defer cli.Close()
+
+	var errs []error
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", labelSession)),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't list containers: %w", err)
+	}
+	for _, c := range containers {
+		if !stale(c.Labels, time.Unix(c.Created, 0), cutoff) {
+			continue
+		}
+		if err := cli.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{Force: true, RemoveVolumes: true}); err != nil {
+			errs = append(errs, fmt.Errorf("couldn't remove container %s: %w", strings.Join(c.Names, ","), err))
+			continue
+		}
+		log.Printf("removed container %s", strings.Join(c.Names, ","))
+	}
+
+	networks, err := cli.NetworkList(ctx, types.NetworkListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", labelSession)),
+	})
+	if err != nil {
+		return errors.Join(append(errs, fmt.Errorf("couldn't list networks: %w", err))...)
+	}
+	for _, n := range networks {
+		if !stale(n.Labels, n.Created, cutoff) {
+			continue
+		}
+		if err := cli.NetworkRemove(ctx, n.ID); err != nil {
+			errs = append(errs, fmt.Errorf("couldn't remove network %s: %w", n.Name, err))
+			continue
+		}
+		log.Printf("removed network %s", n.Name)
+	}
+
+	// built images carry no label, their session is their tag
+	images, err := cli.ImageList(ctx, types.ImageListOptions{
+		Filters: filters.NewArgs(filters.Arg("reference", imageRepo+"/*")),
+	})
+	if err != nil {
+		return errors.Join(append(errs, fmt.Errorf("couldn't list images: %w", err))...)
+	}
+	for _, image := range images {
+		for _, ref := range image.RepoTags {
+			_, tag, _ := strings.Cut(ref, ":")
+			if !stale(map[string]string{labelSession: tag}, time.Unix(image.Created, 0), cutoff) {
+				continue
+			}
+			if _, err := cli.ImageRemove(ctx, ref, types.ImageRemoveOptions{PruneChildren: true}); err != nil {
+				errs = append(errs, fmt.Errorf("couldn't remove image %s: %w", ref, err))
+				continue
+			}
+			log.Printf("removed image %s", ref)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func TestStale(t *testing.T) {
+	cutoff := time.Now().Add(-time.Hour)
+	old := cutoff.Add(-time.Minute)
+
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		created time.Time
+		stale   bool
+	}{
+		{"previous session", map[string]string{labelSession: "0badc0de"}, old, true},
+		{"recent session", map[string]string{labelSession: "0badc0de"}, time.Now(), false},
+		{"current session", sessionLabels("0badc0de"), old, false},
+		{"unlabelled", map[string]string{"other": "label"}, old, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stale(tt.labels, tt.created, cutoff); got != tt.stale {
+				t.Fatalf("expected stale to be %t. Got %t", tt.stale, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/etiennetremel/testcontainers-dapr-example/orderspb"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	contentTypeJSON     = "application/json"
+	contentTypeProtobuf = "application/x-protobuf"
+
+	// maxBodySize bounds the bodies of the requests of the sidecar read into
+	// memory, and is the default limit of the others, see LimitBodySize.
+	maxBodySize = 1 << 20
+)
+
+var (
+	// ErrUnsupportedMediaType is returned when a request body is in a format
+	// the API doesn't read.
+	ErrUnsupportedMediaType = errors.New("unsupported media type")
+	// ErrNotAcceptable is returned when none of the formats accepted by the
+	// client is one the API writes.
+	ErrNotAcceptable = errors.New("not acceptable")
+)
+
+// mediaTypeAliases maps the accepted spellings of a media type to the one
+// the API answers with.
+var mediaTypeAliases = map[string]string{
+	contentTypeJSON:        contentTypeJSON,
+	contentTypeProtobuf:    contentTypeProtobuf,
+	"application/protobuf": contentTypeProtobuf,
+}
+
+// negotiate returns the media type to answer r with, according to its Accept
+// header. JSON is preferred when the client accepts both equally.
+func negotiate(r *http.Request) (string, error) {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return contentTypeJSON, nil
+	}
+
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		var candidate string
+		switch mediaType {
+		case "*/*", "application/*":
+			candidate = contentTypeJSON
+		default:
+			candidate = mediaTypeAliases[mediaType]
+		}
+		if candidate == "" || q <= 0 {
+			continue
+		}
+		if q > bestQ || (q == bestQ && candidate == contentTypeJSON) {
+			best, bestQ = candidate, q
+		}
+	}
+
+	if best == "" {
+		return "", fmt.Errorf("%w: %s", ErrNotAcceptable, accept)
+	}
+	return best, nil
+}
+
+// requestMediaType returns the media type of the body of r. Bodies without a
+// Content-Type are read as JSON.
+func requestMediaType(r *http.Request) (string, error) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return contentTypeJSON, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedMediaType, err)
+	}
+	if alias, ok := mediaTypeAliases[mediaType]; ok {
+		return alias, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnsupportedMediaType, mediaType)
+}
+
+// decodeBody reads the body of r into v, or into msg when it is protobuf
+// encoded. The body is bounded by LimitBodySize.
+func decodeBody(r *http.Request, v any, msg proto.Message) (string, error) {
+	mediaType, err := requestMediaType(r)
+	if err != nil {
+		return "", err
+	}
+
+	if mediaType == contentTypeProtobuf {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return "", err
+		}
+		return mediaType, proto.Unmarshal(data, msg)
+	}
+	return mediaType, json.NewDecoder(r.Body).Decode(v)
+}
+
+// writeBody writes v, or msg when mediaType is protobuf, as the response.
+func writeBody(w http.ResponseWriter, mediaType string, v any, msg proto.Message) error {
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Add("Vary", "Accept")
+
+	if mediaType == contentTypeProtobuf {
+		data, err := proto.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	return json.NewEncoder(w).Encode(v)
+}
+
+// writeCodecError answers a request whose body or Accept header can't be
+// handled.
+func writeCodecError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrUnsupportedMediaType):
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		fmt.Fprintf(w, "Unsupported media type: expected %s or %s", contentTypeJSON, contentTypeProtobuf)
+	case errors.Is(err, ErrNotAcceptable):
+		w.WriteHeader(http.StatusNotAcceptable)
+		fmt.Fprintf(w, "Not acceptable: expected %s or %s", contentTypeJSON, contentTypeProtobuf)
+	case errors.Is(err, ErrInvalidOrder):
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad request: %s", err)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad request")
+	}
+}
+
+var orderStatusToProto = map[OrderStatus]orderspb.OrderStatus{
+	OrderStatusPending:   orderspb.OrderStatus_ORDER_STATUS_PENDING,
+	OrderStatusPaid:      orderspb.OrderStatus_ORDER_STATUS_PAID,
+	OrderStatusUnknown:   orderspb.OrderStatus_ORDER_STATUS_UNKNOWN,
+	OrderStatusCancelled: orderspb.OrderStatus_ORDER_STATUS_CANCELLED,
+	OrderStatusRefunded:  orderspb.OrderStatus_ORDER_STATUS_REFUNDED,
+}
+
+// statusToProto maps status to its protobuf enum value, unknown statuses
+// being unspecified.
+func statusToProto(status OrderStatus) orderspb.OrderStatus {
+	return orderStatusToProto[status]
+}
+
+// statusFromProto maps a protobuf enum value to its status. Unspecified and
+// unknown values map to the empty status, which the lifecycle rejects.
+func statusFromProto(status orderspb.OrderStatus) OrderStatus {
+	for s, p := range orderStatusToProto {
+		if p == status {
+			return s
+		}
+	}
+	return ""
+}
+
+func orderToProto(order Order) *orderspb.Order {
+	msg := &orderspb.Order{
+		Id:         order.ID,
+		Status:     statusToProto(order.Status),
+		Tenant:     order.Tenant,
+		Amount:     order.Amount,
+		Currency:   order.Currency,
+		CustomerId: order.CustomerID,
+	}
+	for _, item := range order.LineItems {
+		msg.LineItems = append(msg.LineItems, &orderspb.LineItem{Sku: item.SKU, Quantity: int32(item.Quantity), UnitPrice: item.UnitPrice})
+	}
+	return msg
+}
+
+func orderFromProto(msg *orderspb.Order) Order {
+	return Order{
+		ID:         msg.Id,
+		Status:     statusFromProto(msg.Status),
+		Tenant:     msg.Tenant,
+		LineItems:  lineItemsFromProto(msg.LineItems),
+		Amount:     msg.Amount,
+		Currency:   msg.Currency,
+		CustomerID: msg.CustomerId,
+	}
+}
+
+func lineItemsFromProto(msgs []*orderspb.LineItem) []LineItem {
+	var items []LineItem
+	for _, msg := range msgs {
+		items = append(items, LineItem{SKU: msg.Sku, Quantity: int(msg.Quantity), UnitPrice: msg.UnitPrice})
+	}
+	return items
+}
+
+// orderListToProto maps list, mapping its orders with toProto.
+func orderListToProto(list *OrderList, toProto func(Order) *orderspb.Order) *orderspb.OrderList {
+	msg := &orderspb.OrderList{
+		Items:  make([]*orderspb.Order, 0, len(list.Items)),
+		Limit:  int32(list.Limit),
+		Offset: int32(list.Offset),
+	}
+	for _, order := range list.Items {
+		msg.Items = append(msg.Items, toProto(order))
+	}
+	if list.NextOffset != nil {
+		next := int32(*list.NextOffset)
+		msg.NextOffset = &next
+	}
+	return msg
+}
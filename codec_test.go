@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/etiennetremel/testcontainers-dapr-example/orderspb"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept  string
+		want    string
+		wantErr error
+	}{
+		{"", contentTypeJSON, nil},
+		{"*/*", contentTypeJSON, nil},
+		{"application/json", contentTypeJSON, nil},
+		{"application/x-protobuf", contentTypeProtobuf, nil},
+		{"application/protobuf", contentTypeProtobuf, nil},
+		{"application/x-protobuf, application/json", contentTypeJSON, nil},
+		{"application/json;q=0.5, application/x-protobuf", contentTypeProtobuf, nil},
+		{"application/x-protobuf;q=0, */*;q=0.1", contentTypeJSON, nil},
+		{"text/html", "", ErrNotAcceptable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+			req.Header.Set("Accept", tt.accept)
+
+			got, err := negotiate(req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v. Got %v.", tt.wantErr, err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected media type %q. Got %q.", tt.want, got)
+			}
+		})
+	}
+}
+
+func newOrdersServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	return newOrdersServerWith(t, &fakeDaprClient{})
+}
+
+// newOrdersServerWith serves the routes of an app talking to client.
+func newOrdersServerWith(t *testing.T, client *fakeDaprClient) *httptest.Server {
+	t.Helper()
+
+	config := &Config{TopicAllowlist: defaultTopicAllowlist(), PublishRetry: RetryPolicy{MaxAttempts: 1}}
+	metrics := NewMetrics()
+	webhooks := NewWebhookStore(client)
+	h := NewAppHandler(config, metrics, NewPublisher(client, config, metrics), NewOrderStore(client))
+	h.webhooks = webhooks
+	h.notifier = NewWebhookDispatcher(webhooks, WebhookConfig{QueueSize: 10}, metrics)
+	h.health = NewHealthChecker(client, pubsubName)
+	h.shipments = NewShipmentStore(client)
+	h.customers = NewCustomerStore(client)
+	h.stats = NewStatsStore(client)
+	h.quarantined = NewQuarantineStore(client)
+	h.logLevel = new(slog.LevelVar)
+	h.RegisterRoutes()
+
+	server := httptest.NewServer(h.router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func doRequest(t *testing.T, method, url, contentType, accept string, body []byte) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("couldn't create request: %s", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("couldn't do request: %s", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("couldn't read response: %s", err)
+	}
+	return resp, data
+}
+
+func TestOrdersProtobuf(t *testing.T) {
+	server := newOrdersServer(t)
+
+	body, err := proto.Marshal(&orderspb.UpdateOrder{Status: orderspb.OrderStatus_ORDER_STATUS_PAID})
+	if err != nil {
+		t.Fatalf("couldn't marshal update: %s", err)
+	}
+	resp, _ := doRequest(t, http.MethodPut, server.URL+"/orders/order-1234", contentTypeProtobuf, "", body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	resp, data := doRequest(t, http.MethodGet, server.URL+"/orders/order-1234", "", contentTypeProtobuf, nil)
+	if ct := resp.Header.Get("Content-Type"); ct != contentTypeProtobuf {
+		t.Fatalf("expected content type %s. Got %s.", contentTypeProtobuf, ct)
+	}
+	var order orderspb.Order
+	if err := proto.Unmarshal(data, &order); err != nil {
+		t.Fatalf("couldn't unmarshal order: %s", err)
+	}
+	if order.Id != "order-1234" || order.Status != orderspb.OrderStatus_ORDER_STATUS_PAID {
+		t.Fatalf("expected order-1234 to be paid. Got %v.", &order)
+	}
+
+	resp, data = doRequest(t, http.MethodGet, server.URL+"/orders?limit=1", "", "application/protobuf", nil)
+	if ct := resp.Header.Get("Content-Type"); ct != contentTypeProtobuf {
+		t.Fatalf("expected content type %s. Got %s.", contentTypeProtobuf, ct)
+	}
+	var list orderspb.OrderList
+	if err := proto.Unmarshal(data, &list); err != nil {
+		t.Fatalf("couldn't unmarshal order list: %s", err)
+	}
+	if len(list.Items) != 1 || list.Items[0].Id != "order-1234" || list.GetLimit() != 1 || list.NextOffset == nil {
+		t.Fatalf("expected a full page with order-1234. Got %v.", &list)
+	}
+
+	// the same order is readable as JSON
+	resp, data = doRequest(t, http.MethodGet, server.URL+"/orders/order-1234", "", "", nil)
+	if ct := resp.Header.Get("Content-Type"); ct != contentTypeJSON {
+		t.Fatalf("expected content type %s. Got %s.", contentTypeJSON, ct)
+	}
+	if expected := `{"id":"order-1234","status":"PAID"}` + "\n"; string(data) != expected {
+		t.Fatalf("expected body %s. Got %s.", expected, data)
+	}
+}
+
+func TestOrdersUnsupportedMediaTypes(t *testing.T) {
+	server := newOrdersServer(t)
+
+	resp, _ := doRequest(t, http.MethodPut, server.URL+"/orders/order-1234", "text/plain", "", []byte("PAID"))
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusUnsupportedMediaType, resp.StatusCode)
+	}
+
+	resp, _ = doRequest(t, http.MethodGet, server.URL+"/orders", "", "text/html", nil)
+	if resp.StatusCode != http.StatusNotAcceptable {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusNotAcceptable, resp.StatusCode)
+	}
+}
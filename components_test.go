@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+// componentTemplates is the directory of the component templates.
+const componentTemplates = "./testdata/components"
+
+// componentParams are the parameters of the component templates.
+type componentParams struct {
+	// Name is the name of the component.
+	Name string
+	// Host is the host:port address of the broker.
+	Host string
+	// Stream is the stream holding the topics, for brokers which need one.
+	Stream string
+	// ConsumerID identifies the subscriptions of the sidecar to the broker,
+	// {appID} standing for the ID of its app.
+	ConsumerID string
+}
+
+// renderComponent renders the component template file name of
+// componentTemplates with params to dir, in a file named after the component
+// so that it can be copied as is into a sidecar, and returns its path.
+func renderComponent(dir, name string, params componentParams) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").ParseFiles(filepath.Join(componentTemplates, name))
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, params.Name+".yaml")
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := tmpl.Execute(f, params); err != nil {
+		return "", err
+	}
+	return path, f.Close()
+}
+
+func TestRenderComponents(t *testing.T) {
+	params := componentParams{Name: pubsubName, Host: "broker:1234", Stream: jetStreamName, ConsumerID: "{appID}"}
+
+	for broker, b := range pubsubBrokers {
+		t.Run(broker, func(t *testing.T) {
+			path, err := renderComponent(t.TempDir(), b.template, params)
+			if err != nil {
+				t.Fatalf("couldn't render component: %s", err)
+			}
+			if filepath.Base(path) != pubsubName+".yaml" {
+				t.Fatalf("expected the component to be named after %s. Got %s.", pubsubName, path)
+			}
+
+			component, err := readComponent(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if component.Name != pubsubName || !strings.HasPrefix(component.Type, "pubsub.") {
+				t.Fatalf("expected pubsub component %s. Got %+v.", pubsubName, component)
+			}
+
+			// local brokers have no address
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !b.local && !strings.Contains(string(data), params.Host) {
+				t.Fatalf("expected the component to use broker %s. Got:\n%s", params.Host, data)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+//go:build compose
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/testcontainers/testcontainers-go/modules/compose"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// composeFile describes the stack started by setupCompose, which is also the
+// one of `docker compose up`.
+const composeFile = "./docker-compose.yaml"
+
+// composeStack is a stack started from composeFile. Only the app and the
+// subscriber of the embedded Stack are set.
+type composeStack struct {
+	*Stack
+
+	compose compose.ComposeStack
+}
+
+// setupCompose starts the stack of composeFile as a compose project of its
+// own, publishing the app on a random host port rather than APP_PORT, so that
+// it can run alongside other stacks and a local `docker compose up`.
+func setupCompose(ctx context.Context) (*composeStack, error) {
+	id, err := newStackID()
+	if err != nil {
+		return nil, err
+	}
+	c, err := compose.NewDockerComposeWith(
+		compose.StackIdentifier("dapr-"+id),
+		compose.WithStackFiles(composeFile),
+	)
+	if err != nil {
+		return nil, err
+	}
+	stack := &composeStack{Stack: &Stack{ID: id}, compose: c}
+
+	err = c.
+		WithEnv(map[string]string{"APP_PORT": "0"}).
+		WaitForService("app", wait.ForHTTP("/health").WithPort("3000/tcp")).
+		WaitForService("integration", wait.ForHTTP("/health").WithPort("8080/tcp")).
+		WaitForService("dapr-app", sidecarHealthy()).
+		WaitForService("dapr-integration", sidecarHealthy()).
+		Up(ctx, compose.Wait(true))
+	if err != nil {
+		return stack, err
+	}
+
+	if stack.app, err = composeService(ctx, c, "app", "3000/tcp"); err != nil {
+		return stack, err
+	}
+	if err := stack.waitForReady(ctx, stack.app); err != nil {
+		return stack, err
+	}
+	if stack.subscriber, err = composeService(ctx, c, "integration", "8080/tcp"); err != nil {
+		return stack, err
+	}
+	return stack, nil
+}
+
+// composeService returns the container of service, along with the base URL
+// of its port from the host.
+func composeService(ctx context.Context, c compose.ComposeStack, service string, port nat.Port) (*appContainer, error) {
+	container, err := c.ServiceContainer(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := endpoint(ctx, container, port)
+	if err != nil {
+		return nil, err
+	}
+	return &appContainer{Container: container, URI: "http://" + addr}, nil
+}
+
+// sidecarHealthy waits for the health endpoint of a daprd service to report
+// it initialized.
+func sidecarHealthy() wait.Strategy {
+	return wait.ForHTTP("/v1.0/healthz").
+		WithPort("3500/tcp").
+		WithStatusCodeMatcher(func(status int) bool {
+			return status == http.StatusNoContent
+		})
+}
+
+// Terminate removes the containers, networks and volumes of the project. It
+// can be called on a partially started stack.
+func (s *composeStack) Terminate(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	if err := s.compose.Down(ctx, compose.RemoveOrphans(true), compose.RemoveVolumes(true)); err != nil {
+		return fmt.Errorf("failed to stop compose project: %w", err)
+	}
+	return nil
+}
+
+func TestIntegrationCompose(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers, err := setupCompose(ctx)
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := putOrder(t, runningContainers.app.URI, "order-1234", OrderStatusPaid, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+	if order := waitForOrderEvents(ctx, t, runningContainers.Stack, 1)[0]; order.ID != "order-1234" || order.Status != OrderStatusPaid {
+		t.Fatalf("expected event order id=order-1234, status=paid. Got %v.", order)
+	}
+}
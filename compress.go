@@ -0,0 +1,134 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	encodingGzip   = "gzip"
+	encodingBrotli = "br"
+
+	defaultCompressionMinSize = 1024
+)
+
+// CompressionConfig configures the compression of the answers of the list
+// routes.
+type CompressionConfig struct {
+	Enabled bool
+	// MinSize is the size an answer reaches before it is compressed, in
+	// bytes, as compressing small answers costs more than it saves.
+	MinSize int
+}
+
+// acceptedEncoding returns the encoding the Accept-Encoding header of r
+// prefers, brotli or gzip, or "" if it accepts neither. Brotli is preferred
+// over gzip, compressing better, when both are accepted as much, and gzip is
+// used for any encoding.
+func acceptedEncoding(r *http.Request) string {
+	var encoding string
+	var best float64
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch coding {
+		case encodingBrotli, encodingGzip:
+		case "*":
+			coding = encodingGzip
+		default:
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil || q <= 0 {
+				continue
+			}
+		}
+		if q > best || (q == best && coding == encodingBrotli) {
+			encoding, best = coding, q
+		}
+	}
+	return encoding
+}
+
+// compressed returns handler answering in brotli or gzip the clients accepting
+// either once its answer reaches the minimum size, or handler as is if compression is
+// disabled. Answers are buffered until then, to tell.
+func (h *AppHandler) compressed(handler http.HandlerFunc) http.HandlerFunc {
+	config := h.config.Compression
+	if !config.Enabled {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := acceptedEncoding(r)
+		if encoding == "" {
+			handler(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: config.MinSize, status: http.StatusOK}
+		handler(cw, r)
+		if err := cw.close(); err != nil {
+			slog.ErrorContext(r.Context(), "couldn't compress answer", "error", err)
+		}
+	}
+}
+
+// compressWriter buffers an answer until it reaches minSize, from which it
+// writes it in encoding. Smaller answers are written as is once closed.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	status   int
+	buf      []byte
+	enc      io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.enc != nil {
+		return w.enc.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) < w.minSize {
+		return len(p), nil
+	}
+
+	// the length of the answer, if set, is the uncompressed one
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Encoding", w.encoding)
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.encoding == encodingBrotli {
+		w.enc = brotli.NewWriter(w.ResponseWriter)
+	} else {
+		w.enc = gzip.NewWriter(w.ResponseWriter)
+	}
+	if _, err := w.enc.Write(w.buf); err != nil {
+		return 0, err
+	}
+	w.buf = nil
+	return len(p), nil
+}
+
+// close writes the end of the answer.
+func (w *compressWriter) close() error {
+	if w.enc != nil {
+		return w.enc.Close()
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(w.buf)
+	return err
+}
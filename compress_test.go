@@ -0,0 +1,82 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestCompressed(t *testing.T) {
+	large := strings.Repeat(`{"id":"order-1234","status":"PAID"},`, 10)
+	tests := []struct {
+		name           string
+		disabled       bool
+		acceptEncoding string
+		body           string
+		encoding       string
+	}{
+		{name: "gzip", acceptEncoding: "gzip, deflate", body: large, encoding: encodingGzip},
+		{name: "any encoding", acceptEncoding: "*", body: large, encoding: encodingGzip},
+		{name: "small answer", acceptEncoding: "gzip", body: `[]`},
+		{name: "gzip refused", acceptEncoding: "gzip;q=0, identity", body: large},
+		{name: "brotli", acceptEncoding: "br", body: large, encoding: encodingBrotli},
+		{name: "brotli preferred", acceptEncoding: "gzip, deflate, br", body: large, encoding: encodingBrotli},
+		{name: "gzip preferred", acceptEncoding: "br;q=0.5, gzip", body: large, encoding: encodingGzip},
+		{name: "brotli refused", acceptEncoding: "br;q=0, gzip;q=0", body: large},
+		{name: "no accept encoding", body: large},
+		{name: "disabled", disabled: true, acceptEncoding: "gzip", body: large},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewAppHandler(&Config{Compression: CompressionConfig{Enabled: !tt.disabled, MinSize: 64}}, NewMetrics(), nil, nil)
+			handler := h.compressed(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", contentTypeJSON)
+				w.WriteHeader(http.StatusAccepted)
+				// written in parts, the first ones below the minimum size
+				for _, part := range strings.SplitAfter(tt.body, ",") {
+					io.WriteString(w, part)
+				}
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if rec.Code != http.StatusAccepted {
+				t.Fatalf("expected status code %d. Got %d.", http.StatusAccepted, rec.Code)
+			}
+			if encoding := rec.Header().Get("Content-Encoding"); encoding != tt.encoding {
+				t.Fatalf("expected encoding %q. Got headers %v.", tt.encoding, rec.Header())
+			}
+			body := io.Reader(rec.Body)
+			switch tt.encoding {
+			case encodingGzip:
+				gz, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatalf("couldn't read gzip answer: %s", err)
+				}
+				body = gz
+			case encodingBrotli:
+				body = brotli.NewReader(rec.Body)
+			}
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("couldn't read answer: %s", err)
+			}
+			if string(got) != tt.body {
+				t.Fatalf("expected body %s. Got %s.", tt.body, got)
+			}
+			if vary := rec.Header().Get("Vary"); !tt.disabled && vary != "Accept-Encoding" {
+				t.Fatalf("expected the answer to vary by Accept-Encoding. Got %q.", vary)
+			}
+		})
+	}
+}
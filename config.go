@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// defaultConfigFile is read if present, unless CONFIG_FILE names
+	// another file.
+	defaultConfigFile = "config.yaml"
+
+	defaultPort = 3000
+)
+
+// PubsubConfig names the pubsub component the app publishes and subscribes
+// through, and the topic of the orders on the broker, the defaults applying
+// if empty.
+type PubsubConfig struct {
+	Name        string
+	OrdersTopic string
+}
+
+func (c PubsubConfig) name() string {
+	if c.Name == "" {
+		return pubsubName
+	}
+	return c.Name
+}
+
+// topicName returns the name on the broker of topic, one of the topics the
+// allowlist knows of.
+func (c PubsubConfig) topicName(topic string) string {
+	if topic == topicOrders && c.OrdersTopic != "" {
+		return c.OrdersTopic
+	}
+	return topic
+}
+
+// fileConfig is the layout of the config file. Its keys are all optional,
+// those missing keeping their default, and each is overridden by its
+// environment variable.
+type fileConfig struct {
+	Server struct {
+		Port         *int    `yaml:"port"`
+		PprofAddress *string `yaml:"pprofAddress"`
+	} `yaml:"server"`
+	Dapr struct {
+		URL          *string `yaml:"url"`
+		Pubsub       *string `yaml:"pubsub"`
+		OrdersTopic  *string `yaml:"ordersTopic"`
+		FeatureFlags *string `yaml:"featureFlagsStore"`
+		SecretStore  *string `yaml:"secretStore"`
+		Timeouts     struct {
+			Publish *time.Duration `yaml:"publish"`
+			State   *time.Duration `yaml:"state"`
+			Startup *time.Duration `yaml:"startup"`
+		} `yaml:"timeouts"`
+	} `yaml:"dapr"`
+	Features struct {
+		EventSourcing  *bool `yaml:"eventSourcing"`
+		RefundWorkflow *bool `yaml:"refundWorkflow"`
+		MultiTenancy   *bool `yaml:"multiTenancy"`
+		Compression    *bool `yaml:"compression"`
+		Pprof          *bool `yaml:"pprof"`
+	} `yaml:"features"`
+	CORS struct {
+		AllowedOrigins   []string       `yaml:"allowedOrigins"`
+		AllowedMethods   []string       `yaml:"allowedMethods"`
+		AllowedHeaders   []string       `yaml:"allowedHeaders"`
+		AllowCredentials *bool          `yaml:"allowCredentials"`
+		MaxAge           *time.Duration `yaml:"maxAge"`
+	} `yaml:"cors"`
+	Log struct {
+		Level  *string `yaml:"level"`
+		Format *string `yaml:"format"`
+		Output *string `yaml:"output"`
+	} `yaml:"log"`
+}
+
+// loadConfigFile applies the config file at path to config. A missing file
+// is only an error if required, that is if it was named explicitly. Unknown
+// keys are rejected, so that a misspelled key doesn't go unnoticed.
+func loadConfigFile(config *Config, path string, required bool) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't read config file: %w", err)
+	}
+	defer f.Close()
+
+	var file fileConfig
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	// an empty file is a valid one
+	if err := dec.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if err := file.apply(config); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (f fileConfig) apply(config *Config) error {
+	set(&config.Port, f.Server.Port)
+	set(&config.PprofAddress, f.Server.PprofAddress)
+
+	set(&config.DaprURL, f.Dapr.URL)
+	set(&config.Pubsub.Name, f.Dapr.Pubsub)
+	set(&config.Pubsub.OrdersTopic, f.Dapr.OrdersTopic)
+	set(&config.FeatureFlagsStore, f.Dapr.FeatureFlags)
+	set(&config.Secrets.Store, f.Dapr.SecretStore)
+	set(&config.Timeouts.Publish, f.Dapr.Timeouts.Publish)
+	set(&config.Timeouts.State, f.Dapr.Timeouts.State)
+	set(&config.StartupTimeout, f.Dapr.Timeouts.Startup)
+
+	set(&config.EventSourcing, f.Features.EventSourcing)
+	set(&config.RefundWorkflow, f.Features.RefundWorkflow)
+	set(&config.Tenants.Enabled, f.Features.MultiTenancy)
+	set(&config.Compression.Enabled, f.Features.Compression)
+	set(&config.EnablePprof, f.Features.Pprof)
+
+	if f.CORS.AllowedOrigins != nil {
+		config.CORS.AllowedOrigins = f.CORS.AllowedOrigins
+	}
+	if f.CORS.AllowedMethods != nil {
+		config.CORS.AllowedMethods = f.CORS.AllowedMethods
+	}
+	if f.CORS.AllowedHeaders != nil {
+		config.CORS.AllowedHeaders = f.CORS.AllowedHeaders
+	}
+	set(&config.CORS.AllowCredentials, f.CORS.AllowCredentials)
+	set(&config.CORS.MaxAge, f.CORS.MaxAge)
+
+	if f.Log.Level != nil {
+		if err := config.Log.Level.UnmarshalText([]byte(*f.Log.Level)); err != nil {
+			return fmt.Errorf("log.level: %w", err)
+		}
+	}
+	set(&config.Log.Format, f.Log.Format)
+	set(&config.Log.Output, f.Log.Output)
+	return nil
+}
+
+// set sets *dst to *src, unless src is nil.
+func set[T any](dst *T, src *T) {
+	if src != nil {
+		*dst = *src
+	}
+}
+
+// validateServer rejects the values of the port and the pubsub settings the
+// app can't run with, naming both the key of the config file and the
+// environment variable setting them.
+func (c *Config) validateServer() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d (server.port, APP_PORT): must be between 1 and 65535", c.Port)
+	}
+	if c.Pubsub.Name == "" {
+		return errors.New("invalid pubsub (dapr.pubsub, PUBSUB_NAME): must not be empty")
+	}
+	if c.Pubsub.OrdersTopic == "" {
+		return errors.New("invalid orders topic (dapr.ordersTopic, PUBSUB_ORDERS_TOPIC): must not be empty")
+	}
+	if c.Pubsub.OrdersTopic != topicOrders && slices.Contains(knownTopics, c.Pubsub.OrdersTopic) {
+		return fmt.Errorf("invalid orders topic %q (dapr.ordersTopic, PUBSUB_ORDERS_TOPIC): the app publishes other events to it", c.Pubsub.OrdersTopic)
+	}
+	return nil
+}
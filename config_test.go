@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes content to a config file of its own, and returns
+// its path.
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("couldn't write config file: %s", err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		required bool
+		// expectedErr is contained in the error returned, if any
+		expectedErr string
+		check       func(t *testing.T, config *Config)
+	}{
+		{
+			name: "keys",
+			content: `
+server:
+  port: 8080
+dapr:
+  pubsub: orders-pubsub
+  ordersTopic: orders-v2
+  timeouts:
+    publish: 2s
+features:
+  compression: true
+cors:
+  allowedOrigins: [https://dashboard.example.com]
+log:
+  level: debug
+`,
+			check: func(t *testing.T, config *Config) {
+				if config.Port != 8080 || config.Pubsub.Name != "orders-pubsub" || config.Pubsub.OrdersTopic != "orders-v2" {
+					t.Fatalf("expected the port and pubsub of the file. Got %d %+v.", config.Port, config.Pubsub)
+				}
+				if config.Timeouts.Publish != 2*time.Second || !config.Compression.Enabled || config.CORS.AllowedOrigins[0] != "https://dashboard.example.com" {
+					t.Fatalf("expected the timeouts, features and CORS of the file. Got %+v.", config)
+				}
+				// the keys missing keep their default
+				if config.Timeouts.State != defaultDaprStateTimeout || config.DaprURL != defaultDaprURL {
+					t.Fatalf("expected the defaults of the keys missing. Got %+v.", config)
+				}
+				if config.Log.Level.String() != "DEBUG" {
+					t.Fatalf("expected log level DEBUG. Got %s.", config.Log.Level)
+				}
+			},
+		},
+		{name: "empty file", content: ``},
+		{name: "misspelled key", content: "server:\n  prot: 8080\n", expectedErr: "line 2: field prot not found"},
+		{name: "value of the wrong type", content: "server:\n  port: eighty\n", expectedErr: "cannot unmarshal !!str `eighty` into int"},
+		{name: "malformed duration", content: "dapr:\n  timeouts:\n    state: soon\n", expectedErr: "soon"},
+		{name: "unknown log level", content: "log:\n  level: verbose\n", expectedErr: "log.level"},
+		{name: "missing file", expectedErr: ""},
+		{name: "missing required file", required: true, expectedErr: "couldn't read config file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "missing.yaml")
+			if !strings.HasPrefix(tt.name, "missing") {
+				path = writeConfigFile(t, tt.content)
+			}
+			config := &Config{Port: defaultPort, DaprURL: defaultDaprURL, Timeouts: DaprTimeouts{State: defaultDaprStateTimeout}}
+
+			err := loadConfigFile(config, path, tt.required)
+			if tt.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedErr) {
+					t.Fatalf("expected an error containing %q. Got %v.", tt.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error. Got %s.", err)
+			}
+			if tt.check != nil {
+				tt.check(t, config)
+			}
+		})
+	}
+}
+
+func TestLoadConfigOverrides(t *testing.T) {
+	t.Setenv("CONFIG_FILE", writeConfigFile(t, "server:\n  port: 8080\ndapr:\n  pubsub: orders-pubsub\n"))
+	// the environment overrides the keys of the file one by one
+	t.Setenv("APP_PORT", "9090")
+
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+	if config.Port != 9090 || config.Pubsub.Name != "orders-pubsub" {
+		t.Fatalf("expected the port of the environment and the pubsub of the file. Got %d %s.", config.Port, config.Pubsub.Name)
+	}
+
+	t.Setenv("APP_PORT", "70000")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "server.port, APP_PORT") {
+		t.Fatalf("expected the error to name the key and the variable of the port. Got %v.", err)
+	}
+	t.Setenv("APP_PORT", "9090")
+	t.Setenv("PUBSUB_ORDERS_TOPIC", topicShipments)
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "dapr.ordersTopic, PUBSUB_ORDERS_TOPIC") {
+		t.Fatalf("expected the error to name the key and the variable of the orders topic. Got %v.", err)
+	}
+}
+
+func TestPublishOrdersTopic(t *testing.T) {
+	client := &fakeDaprClient{}
+	config := &Config{
+		Pubsub:         PubsubConfig{Name: "orders-pubsub", OrdersTopic: "orders-v2"},
+		TopicAllowlist: defaultTopicAllowlist(),
+		PublishRetry:   RetryPolicy{MaxAttempts: 1},
+	}
+	publisher := NewPublisher(client, config, NewMetrics())
+
+	for _, topic := range []string{topicOrders, topicShipments} {
+		handler := handlerOrdersPut
+		if topic == topicShipments {
+			handler = handlerShipmentsCreate
+		}
+		if err := publisher.Publish(context.Background(), handler, topic, map[string]string{"id": "order-1234"}); err != nil {
+			t.Fatalf("expected no error. Got %s.", err)
+		}
+	}
+	// only the orders topic is renamed
+	if len(client.published) != 2 || client.published[0].topic != "orders-v2" || client.published[1].topic != topicShipments {
+		t.Fatalf("expected events published to orders-v2 and %s. Got %+v.", topicShipments, client.published)
+	}
+	if client.published[0].pubsubName != "orders-pubsub" {
+		t.Fatalf("expected events published through orders-pubsub. Got %s.", client.published[0].pubsubName)
+	}
+}
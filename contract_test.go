@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/etiennetremel/testcontainers-dapr-example/orderspb"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// contractsDir holds the contracts between the app and its consumers, in the
+// format of the Pact specification v3 so that consumers can check their
+// expectations against them with their own Pact tooling.
+const contractsDir = "./testdata/contracts"
+
+// pactContract is a contract between a consumer and the app, made of the
+// HTTP interactions and the messages the consumer relies on.
+type pactContract struct {
+	Consumer struct {
+		Name string `json:"name"`
+	} `json:"consumer"`
+	Provider struct {
+		Name string `json:"name"`
+	} `json:"provider"`
+	Interactions []pactInteraction `json:"interactions"`
+	Messages     []pactMessage     `json:"messages"`
+}
+
+// pactProviderState is a state the app is put in before an interaction or
+// a message, set up by the function of providerStates of the same name.
+type pactProviderState struct {
+	Name   string         `json:"name"`
+	Params map[string]any `json:"params"`
+}
+
+type pactInteraction struct {
+	Description    string              `json:"description"`
+	ProviderStates []pactProviderState `json:"providerStates"`
+	Request        struct {
+		Method  string            `json:"method"`
+		Path    string            `json:"path"`
+		Headers map[string]string `json:"headers"`
+		Body    json.RawMessage   `json:"body"`
+	} `json:"request"`
+	Response struct {
+		Status        int               `json:"status"`
+		Headers       map[string]string `json:"headers"`
+		Body          json.RawMessage   `json:"body"`
+		MatchingRules pactMatchingRules `json:"matchingRules"`
+	} `json:"response"`
+}
+
+// pactMessage is an event published by the app, triggered by the function of
+// messageProducers of the same description. Its contents are the JSON form of
+// the protobuf payload.
+type pactMessage struct {
+	Description    string              `json:"description"`
+	ProviderStates []pactProviderState `json:"providerStates"`
+	Contents       json.RawMessage     `json:"contents"`
+	MetaData       map[string]string   `json:"metaData"`
+	MatchingRules  pactMatchingRules   `json:"matchingRules"`
+}
+
+// pactMatchingRules relax the comparison of the values at a path, such as
+// $.changedAt for bodies or the name of a header.
+type pactMatchingRules struct {
+	Body   map[string]pactMatchers `json:"body"`
+	Header map[string]pactMatchers `json:"header"`
+}
+
+type pactMatchers struct {
+	Matchers []struct {
+		// Match is type, for a value of the same JSON type, or regex.
+		Match string `json:"match"`
+		Regex string `json:"regex"`
+	} `json:"matchers"`
+}
+
+// match reports whether actual satisfies the matchers, expected being the
+// example value of the contract.
+func (m pactMatchers) match(expected, actual any) error {
+	for _, matcher := range m.Matchers {
+		switch matcher.Match {
+		case "type":
+			if reflect.TypeOf(expected) != reflect.TypeOf(actual) {
+				return fmt.Errorf("expected a value of the type of %v, got %v", expected, actual)
+			}
+		case "regex":
+			s, ok := actual.(string)
+			if !ok {
+				return fmt.Errorf("expected a string matching %s, got %v", matcher.Regex, actual)
+			}
+			re, err := regexp.Compile(matcher.Regex)
+			if err != nil {
+				return err
+			}
+			if !re.MatchString(s) {
+				return fmt.Errorf("expected a string matching %s, got %q", matcher.Regex, s)
+			}
+		default:
+			return fmt.Errorf("unsupported matcher %q", matcher.Match)
+		}
+	}
+	return nil
+}
+
+// matchValue compares actual with the value expected at path. As in Pact,
+// objects may hold keys the contract doesn't mention, whereas arrays must
+// have the expected length.
+func matchValue(path string, expected, actual any, rules map[string]pactMatchers) error {
+	if m, ok := rules[path]; ok {
+		if err := m.match(expected, actual); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return nil
+	}
+
+	switch expected := expected.(type) {
+	case map[string]any:
+		actual, ok := actual.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: expected an object, got %v", path, actual)
+		}
+		for k, v := range expected {
+			if err := matchValue(path+"."+k, v, actual[k], rules); err != nil {
+				return err
+			}
+		}
+	case []any:
+		actual, ok := actual.([]any)
+		if !ok || len(actual) != len(expected) {
+			return fmt.Errorf("%s: expected %d items, got %v", path, len(expected), actual)
+		}
+		for i := range expected {
+			if err := matchValue(fmt.Sprintf("%s[%d]", path, i), expected[i], actual[i], rules); err != nil {
+				return err
+			}
+		}
+	default:
+		if !reflect.DeepEqual(expected, actual) {
+			return fmt.Errorf("%s: expected %v, got %v", path, expected, actual)
+		}
+	}
+	return nil
+}
+
+// matchJSON compares the JSON document actual with expected.
+func matchJSON(expected, actual []byte, rules map[string]pactMatchers) error {
+	var e, a any
+	if err := json.Unmarshal(expected, &e); err != nil {
+		return fmt.Errorf("invalid contract: %w", err)
+	}
+	if err := json.Unmarshal(actual, &a); err != nil {
+		return fmt.Errorf("expected a JSON document, got %q", actual)
+	}
+	return matchValue("$", e, a, rules)
+}
+
+// providerStates set up the state the contracts expect the app to be in.
+var providerStates = map[string]func(client *fakeDaprClient, params map[string]any) error{
+	"an order exists": func(client *fakeDaprClient, params map[string]any) error {
+		id, _ := params["id"].(string)
+		status, _ := params["status"].(string)
+		return NewOrderStore(client).Save(context.Background(), Order{ID: id, Status: OrderStatus(status)}, "")
+	},
+	"the broker is unavailable": func(client *fakeDaprClient, params map[string]any) error {
+		client.publishErr = errors.New("broker unavailable")
+		return nil
+	},
+}
+
+// messageProducers trigger the messages of the contracts.
+var messageProducers = map[string]func(t *testing.T, uri string){
+	"an order status changed": func(t *testing.T, uri string) {
+		resp := putOrder(t, uri, "order-1234", OrderStatusPaid, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+		}
+	},
+}
+
+// setupProviderStates returns a client in states.
+func setupProviderStates(t *testing.T, states []pactProviderState) *fakeDaprClient {
+	t.Helper()
+
+	client := &fakeDaprClient{}
+	for _, state := range states {
+		setup, ok := providerStates[state.Name]
+		if !ok {
+			t.Fatalf("unknown provider state %q", state.Name)
+		}
+		if err := setup(client, state.Params); err != nil {
+			t.Fatalf("couldn't set up provider state %q: %s", state.Name, err)
+		}
+	}
+	return client
+}
+
+func loadContracts(t *testing.T) map[string]pactContract {
+	t.Helper()
+
+	paths, err := filepath.Glob(filepath.Join(contractsDir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatalf("expected contracts in %s", contractsDir)
+	}
+	contracts := make(map[string]pactContract, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var contract pactContract
+		if err := json.Unmarshal(data, &contract); err != nil {
+			t.Fatalf("couldn't decode contract %s: %s", path, err)
+		}
+		if contract.Provider.Name != "app" {
+			t.Fatalf("expected contract %s to be provided by the app. Got %q.", path, contract.Provider.Name)
+		}
+		contracts[filepath.Base(path)] = contract
+	}
+	return contracts
+}
+
+func verifyInteraction(t *testing.T, interaction pactInteraction) {
+	server := newOrdersServerWith(t, setupProviderStates(t, interaction.ProviderStates))
+
+	req, err := http.NewRequest(interaction.Request.Method, server.URL+interaction.Request.Path, bytes.NewReader(interaction.Request.Body))
+	if err != nil {
+		t.Fatalf("couldn't create request: %s", err)
+	}
+	for k, v := range interaction.Request.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("couldn't do request: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("couldn't read response: %s", err)
+	}
+
+	expected := interaction.Response
+	if resp.StatusCode != expected.Status {
+		t.Fatalf("expected status code %d. Got %d: %s", expected.Status, resp.StatusCode, body)
+	}
+	for k, v := range expected.Headers {
+		actual := resp.Header.Get(k)
+		if m, ok := expected.MatchingRules.Header[k]; ok {
+			if err := m.match(v, actual); err != nil {
+				t.Fatalf("header %s: %s", k, err)
+			}
+			continue
+		}
+		// parameters of the content type, such as the charset, are ignored
+		if http.CanonicalHeaderKey(k) == "Content-Type" {
+			actual, _, _ = mime.ParseMediaType(actual)
+		}
+		if actual != v {
+			t.Fatalf("expected header %s %q. Got %q.", k, v, actual)
+		}
+	}
+
+	if len(expected.Body) == 0 {
+		return
+	}
+	// plain text bodies are JSON strings of the contract
+	var text string
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != contentTypeJSON && json.Unmarshal(expected.Body, &text) == nil {
+		if string(body) != text {
+			t.Fatalf("expected body %q. Got %q.", text, body)
+		}
+		return
+	}
+	if err := matchJSON(expected.Body, body, expected.MatchingRules.Body); err != nil {
+		t.Fatalf("unexpected body: %s", err)
+	}
+}
+
+func verifyMessage(t *testing.T, message pactMessage) {
+	produce, ok := messageProducers[message.Description]
+	if !ok {
+		t.Fatalf("no producer for message %q", message.Description)
+	}
+	client := setupProviderStates(t, message.ProviderStates)
+	server := newOrdersServerWith(t, client)
+	produce(t, server.URL)
+
+	if len(client.published) != 1 {
+		t.Fatalf("expected one event to be published. Got %d.", len(client.published))
+	}
+	published := client.published[0]
+	envelope, ok := published.data.(map[string]any)
+	if !ok {
+		t.Fatalf("expected a CloudEvent to be published. Got %v.", published.data)
+	}
+
+	metaData := map[string]string{
+		"pubsubname":  published.pubsubName,
+		"topic":       published.topic,
+		"type":        fmt.Sprint(envelope["type"]),
+		"contentType": fmt.Sprint(envelope["datacontenttype"]),
+	}
+	for k, v := range message.MetaData {
+		if metaData[k] != v {
+			t.Fatalf("expected metadata %s %q. Got %q.", k, v, metaData[k])
+		}
+	}
+
+	data, err := base64.StdEncoding.DecodeString(fmt.Sprint(envelope["data_base64"]))
+	if err != nil {
+		t.Fatalf("couldn't decode data_base64: %s", err)
+	}
+	var msg orderspb.OrderStatusChanged
+	if err := proto.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("couldn't decode event: %s", err)
+	}
+	contents, err := protojson.Marshal(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := matchJSON(message.Contents, contents, message.MatchingRules.Body); err != nil {
+		t.Fatalf("unexpected contents: %s", err)
+	}
+}
+
+func TestContracts(t *testing.T) {
+	for name, contract := range loadContracts(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, interaction := range contract.Interactions {
+				t.Run(interaction.Description, func(t *testing.T) {
+					verifyInteraction(t, interaction)
+				})
+			}
+			for _, message := range contract.Messages {
+				t.Run(message.Description, func(t *testing.T) {
+					verifyMessage(t, message)
+				})
+			}
+		})
+	}
+}
+
+func TestMatchValue(t *testing.T) {
+	rules := map[string]pactMatchers{}
+	if err := json.Unmarshal([]byte(`{"$.at": {"matchers": [{"match": "regex", "regex": "^\\d+$"}]}, "$.n": {"matchers": [{"match": "type"}]}}`), &rules); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expected string
+		actual   string
+		ok       bool
+	}{
+		{expected: `{"a": "x"}`, actual: `{"a": "x", "b": 1}`, ok: true},
+		{expected: `{"a": "x"}`, actual: `{"a": "y"}`},
+		{expected: `{"a": "x"}`, actual: `{}`},
+		{expected: `{"a": [1, 2]}`, actual: `{"a": [1, 2, 3]}`},
+		{expected: `{"at": "1"}`, actual: `{"at": "1700000000"}`, ok: true},
+		{expected: `{"at": "1"}`, actual: `{"at": "yesterday"}`},
+		{expected: `{"n": 1}`, actual: `{"n": 2}`, ok: true},
+		{expected: `{"n": 1}`, actual: `{"n": "2"}`},
+	}
+
+	for _, tt := range tests {
+		err := matchJSON([]byte(tt.expected), []byte(tt.actual), rules)
+		if (err == nil) != tt.ok {
+			t.Fatalf("expected %s to match %s: %t. Got %v.", tt.actual, tt.expected, tt.ok, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"regexp"
+)
+
+const (
+	// headerCorrelationID carries the correlation ID of a request, and of
+	// its answer.
+	headerCorrelationID = "X-Correlation-ID"
+	// cloudEventCorrelationExtension is the CloudEvent extension attribute
+	// carrying the correlation ID of the request an event was published
+	// for.
+	cloudEventCorrelationExtension = "correlationid"
+	// logKeyCorrelationID is the attribute of the records logged for a
+	// correlated request or event.
+	logKeyCorrelationID = "correlationId"
+)
+
+// correlationIDPattern bounds the correlation IDs of clients, which end up in
+// logs and events.
+var correlationIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:@/-]{1,128}$`)
+
+type correlationIDKey struct{}
+
+// WithCorrelationID returns a copy of ctx carrying the correlation ID id.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationIDFromContext returns the correlation ID ctx carries, if any.
+func CorrelationIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+func newCorrelationID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// eventCorrelationID returns the correlation ID a CloudEvent carries in the
+// correlationid extension, if any.
+func eventCorrelationID(payload []byte) string {
+	var event struct {
+		CorrelationID string `json:"correlationid"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return ""
+	}
+	return event.CorrelationID
+}
+
+// PropagateCorrelationID stores the correlation ID of requests in their
+// context and answers it in the X-Correlation-ID header, so that the logs and
+// events of a request can be told apart from those of the others. Requests
+// without a valid correlation ID are given a new one.
+func PropagateCorrelationID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(headerCorrelationID)
+		if !correlationIDPattern.MatchString(id) {
+			var err error
+			if id, err = newCorrelationID(); err != nil {
+				slog.Error("couldn't generate correlation ID", "error", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set(headerCorrelationID, id)
+		next.ServeHTTP(w, r.WithContext(WithCorrelationID(r.Context(), id)))
+	})
+}
+
+// correlationHandler adds the correlation ID of the context of the records it
+// handles to them, see the Context variants of the slog functions.
+type correlationHandler struct {
+	slog.Handler
+}
+
+func (h correlationHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := CorrelationIDFromContext(ctx); id != "" {
+		record.AddAttrs(slog.String(logKeyCorrelationID, id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h correlationHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return correlationHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h correlationHandler) WithGroup(name string) slog.Handler {
+	return correlationHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPropagateCorrelationID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		// kept is whether the correlation ID of the request is kept, rather
+		// than a new one generated
+		kept bool
+	}{
+		{name: "valid", header: "checkout-5f2a/1", kept: true},
+		{name: "missing"},
+		{name: "malformed", header: "id with spaces"},
+		{name: "too long", header: strings.Repeat("a", 129)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := PropagateCorrelationID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = CorrelationIDFromContext(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodPut, "/orders/order-1234", nil)
+			if tt.header != "" {
+				req.Header.Set(headerCorrelationID, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if tt.kept && got != tt.header {
+				t.Fatalf("expected correlation ID %s. Got %s.", tt.header, got)
+			}
+			if !tt.kept && (got == tt.header || !correlationIDPattern.MatchString(got)) {
+				t.Fatalf("expected a new correlation ID. Got %q.", got)
+			}
+			if answered := rec.Header().Get(headerCorrelationID); answered != got {
+				t.Fatalf("expected correlation ID %s answered. Got %s.", got, answered)
+			}
+		})
+	}
+}
+
+func TestCorrelatedLogs(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LogConfig{Format: LogFormatJSON, Service: "app", Version: "dev"}, slog.LevelInfo)
+
+	logger.With("order", "order-1234").InfoContext(WithCorrelationID(context.Background(), "checkout-5f2a"), "correlated")
+	logger.InfoContext(context.Background(), "uncorrelated")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records. Got %s.", buf.String())
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record[logKeyCorrelationID] != "checkout-5f2a" || record["order"] != "order-1234" || record["service"] != "app" {
+		t.Fatalf("expected the record to carry its correlation ID and attributes. Got %v.", record)
+	}
+	if strings.Contains(lines[1], logKeyCorrelationID) {
+		t.Fatalf("expected no correlation ID. Got %s.", lines[1])
+	}
+}
+
+func TestCorrelationIDPublished(t *testing.T) {
+	client := &fakeDaprClient{}
+	config := &Config{TopicAllowlist: defaultTopicAllowlist(), PublishRetry: RetryPolicy{MaxAttempts: 1}}
+	metrics := NewMetrics()
+	notifier := NewWebhookDispatcher(NewWebhookStore(client), WebhookConfig{QueueSize: 10}, metrics)
+	h := NewAppHandler(config, metrics, NewPublisher(client, config, metrics), newMockOrderRepository())
+	h.notifier = notifier
+	h.RegisterRoutes()
+
+	req := httptest.NewRequest(http.MethodPut, "/orders/order-1234", strings.NewReader(`{"status":"PENDING"}`))
+	req.Header.Set("Content-Type", contentTypeJSON)
+	req.Header.Set(headerCorrelationID, "checkout-5f2a")
+	rec := httptest.NewRecorder()
+	h.router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+	if len(client.published) != 1 {
+		t.Fatalf("expected one event published. Got %v.", client.published)
+	}
+	event, ok := client.published[0].data.(map[string]any)
+	if !ok || event[cloudEventCorrelationExtension] != "checkout-5f2a" {
+		t.Fatalf("expected a CloudEvent carrying correlation ID checkout-5f2a. Got %v.", client.published[0].data)
+	}
+
+	// the event delivered back to the app is correlated with the request
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(NewLogger(&buf, LogConfig{Format: LogFormatJSON}, slog.LevelDebug))
+	defer slog.SetDefault(previous)
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest(http.MethodPost, routeOrderEvents, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentTypeCloudEvents)
+	h.router.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !strings.Contains(buf.String(), `"msg":"handled order event"`) || !strings.Contains(buf.String(), `"correlationId":"checkout-5f2a"`) {
+		t.Fatalf("expected the event to be logged with correlation ID checkout-5f2a. Got %s.", buf.String())
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// corsAnyOrigin allows every origin.
+const corsAnyOrigin = "*"
+
+// defaultCORSMethods and defaultCORSHeaders are the methods and headers of
+// the API the browsers are allowed to send, unless configured otherwise.
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	defaultCORSHeaders = []string{
+		"Content-Type", "Accept", "Authorization", "X-API-Key", "If-Match",
+		headerTenantID, headerOrderPriority, headerCorrelationID,
+	}
+)
+
+// corsExposedHeaders are the headers of the answers the browsers hand to
+// the dashboards.
+var corsExposedHeaders = []string{"ETag", headerCorrelationID}
+
+// CORSConfig lets the browser dashboards served from AllowedOrigins call the
+// API. CORS is disabled when no origin is allowed.
+type CORSConfig struct {
+	// AllowedOrigins are the origins allowed, such as
+	// https://dashboard.example.com, or * for any.
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+	// AllowCredentials lets the browsers send their cookies and
+	// authorization headers.
+	AllowCredentials bool
+	// MaxAge is the time the browsers cache the answers to preflight
+	// requests, unless zero.
+	MaxAge time.Duration
+}
+
+// Enabled reports whether any origin is allowed.
+func (c CORSConfig) Enabled() bool {
+	return len(c.AllowedOrigins) > 0
+}
+
+// Validate rejects credentials allowed to any origin, which the browsers
+// refuse.
+func (c CORSConfig) Validate() error {
+	if c.AllowCredentials && slices.Contains(c.AllowedOrigins, corsAnyOrigin) {
+		return errors.New("credentials can't be allowed to any origin, list the origins instead")
+	}
+	return nil
+}
+
+func (c CORSConfig) allows(origin string) bool {
+	return slices.Contains(c.AllowedOrigins, corsAnyOrigin) || slices.Contains(c.AllowedOrigins, origin)
+}
+
+// CORS answers the preflight requests of the allowed origins, and lets the
+// browsers hand the answers to the other requests of those origins to the
+// page which made them. The requests of other origins are served without the
+// CORS headers, so the browsers withhold the answers.
+func CORS(config CORSConfig) mux.MiddlewareFunc {
+	methods := strings.Join(config.AllowedMethods, ", ")
+	headers := strings.Join(config.AllowedHeaders, ", ")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Origin")
+			origin := r.Header.Get("Origin")
+			if origin == "" || !config.allows(origin) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if config.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", methods)
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+				if config.MaxAge > 0 {
+					w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(config.MaxAge/time.Second)))
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
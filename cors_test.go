@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	config := &Config{
+		Auth: AuthConfig{APIKeys: []Secret{"api-key"}},
+		CORS: CORSConfig{
+			AllowedOrigins:   []string{"https://dashboard.example.com"},
+			AllowedMethods:   defaultCORSMethods,
+			AllowedHeaders:   defaultCORSHeaders,
+			AllowCredentials: true,
+			MaxAge:           10 * time.Minute,
+		},
+	}
+	h := NewAppHandler(config, NewMetrics(), nil, newMockOrderRepository())
+	h.RegisterRoutes()
+
+	tests := []struct {
+		name      string
+		method    string
+		origin    string
+		preflight bool
+		apiKey    string
+		// expected is the status code of the answer, and headers the CORS
+		// headers it carries, none if nil
+		expected int
+		headers  map[string]string
+	}{
+		{
+			// preflight requests are answered without credentials
+			name: "preflight", method: http.MethodOptions, origin: "https://dashboard.example.com", preflight: true,
+			expected: http.StatusNoContent,
+			headers: map[string]string{
+				"Access-Control-Allow-Origin":      "https://dashboard.example.com",
+				"Access-Control-Allow-Methods":     "GET, POST, PUT, PATCH, DELETE",
+				"Access-Control-Allow-Headers":     "Content-Type, Accept, Authorization, X-API-Key, If-Match, X-Tenant-ID, X-Order-Priority, X-Correlation-ID",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Max-Age":           "600",
+			},
+		},
+		{name: "preflight of an unknown origin", method: http.MethodOptions, origin: "https://evil.example.com", preflight: true, expected: http.StatusNoContent},
+		{
+			name: "request", method: http.MethodGet, origin: "https://dashboard.example.com", apiKey: "api-key",
+			expected: http.StatusOK,
+			headers: map[string]string{
+				"Access-Control-Allow-Origin":   "https://dashboard.example.com",
+				"Access-Control-Expose-Headers": "ETag, X-Correlation-ID",
+			},
+		},
+		{name: "request of an unknown origin", method: http.MethodGet, origin: "https://evil.example.com", apiKey: "api-key", expected: http.StatusOK},
+		{name: "unauthenticated request", method: http.MethodGet, origin: "https://dashboard.example.com", expected: http.StatusUnauthorized, headers: map[string]string{
+			"Access-Control-Allow-Origin": "https://dashboard.example.com",
+		}},
+		{name: "same origin request", method: http.MethodGet, apiKey: "api-key", expected: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/orders", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+			}
+			req.Header.Set("X-API-Key", tt.apiKey)
+			rec := httptest.NewRecorder()
+			h.router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.expected {
+				t.Fatalf("expected status code %d. Got %d.", tt.expected, rec.Code)
+			}
+			if tt.headers == nil && rec.Header().Get("Access-Control-Allow-Origin") != "" {
+				t.Fatalf("expected no CORS headers. Got %v.", rec.Header())
+			}
+			for header, expected := range tt.headers {
+				if got := rec.Header().Get(header); got != expected {
+					t.Fatalf("expected %s to be %q. Got %q.", header, expected, got)
+				}
+			}
+			if vary := rec.Header().Values("Vary"); len(vary) == 0 || vary[0] != "Origin" {
+				t.Fatalf("expected the answer to vary by Origin. Got %v.", vary)
+			}
+		})
+	}
+}
+
+func TestCORSConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  CORSConfig
+		wantErr bool
+	}{
+		{name: "disabled", config: CORSConfig{}},
+		{name: "any origin", config: CORSConfig{AllowedOrigins: []string{"*"}}},
+		{name: "credentials", config: CORSConfig{AllowedOrigins: []string{"https://dashboard.example.com"}, AllowCredentials: true}},
+		{name: "credentials to any origin", config: CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("expected error: %t. Got %v.", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const customerStoreName = "customer-state"
+
+// ErrCustomerNotFound is returned when no customer is stored under an ID.
+var ErrCustomerNotFound = errors.New("customer not found")
+
+// customerIDPattern matches the IDs of customers, as routed.
+var customerIDPattern = regexp.MustCompile(`^customer-[0-9]{4}$`)
+
+// Customer is who places orders.
+type Customer struct {
+	ID     string `json:"id"`
+	Tenant string `json:"tenant,omitempty"`
+	Name   string `json:"name"`
+	Email  string `json:"email,omitempty"`
+}
+
+func customerOrdersKey(customerID string) string {
+	return "customer-orders-" + customerID
+}
+
+// CustomerStore persists customers in the Dapr state store, along with the
+// index of the orders of each customer. The order store can't be queried by
+// customer, so the index is stored next to the customer under a key of its
+// own, holding the sorted IDs of its orders. Keys are scoped to the tenant of
+// the context.
+type CustomerStore struct {
+	client    dapr.Client
+	storeName string
+}
+
+func NewCustomerStore(client dapr.Client) *CustomerStore {
+	return &CustomerStore{
+		client:    client,
+		storeName: customerStoreName,
+	}
+}
+
+// Get returns the customer stored under id.
+func (s *CustomerStore) Get(ctx context.Context, id string) (Customer, error) {
+	item, err := s.client.GetState(ctx, s.storeName, tenantKey(ctx, id), nil)
+	if err != nil {
+		return Customer{}, err
+	}
+	if item == nil || len(item.Value) == 0 {
+		return Customer{}, ErrCustomerNotFound
+	}
+
+	var customer Customer
+	if err := json.Unmarshal(item.Value, &customer); err != nil {
+		return Customer{}, fmt.Errorf("couldn't decode customer %s: %w", id, err)
+	}
+	return customer, nil
+}
+
+// Save stores customer under its ID, replacing the stored one if any.
+func (s *CustomerStore) Save(ctx context.Context, customer Customer) error {
+	data, err := json.Marshal(customer)
+	if err != nil {
+		return err
+	}
+	return s.client.SaveState(ctx, s.storeName, tenantKey(ctx, customer.ID), data,
+		map[string]string{"contentType": "application/json"})
+}
+
+// OrderIDs returns the sorted IDs of the orders indexed under the customer
+// customerID, along with the ETag of the index.
+func (s *CustomerStore) OrderIDs(ctx context.Context, customerID string) ([]string, string, error) {
+	item, err := s.client.GetState(ctx, s.storeName, tenantKey(ctx, customerOrdersKey(customerID)), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	ids := []string{}
+	if item == nil {
+		return ids, "", nil
+	}
+	if len(item.Value) > 0 {
+		if err := json.Unmarshal(item.Value, &ids); err != nil {
+			return nil, "", fmt.Errorf("couldn't decode orders of %s: %w", customerID, err)
+		}
+	}
+	return ids, item.Etag, nil
+}
+
+// IndexOrder adds the order orderID to the index of the customer customerID,
+// retrying when another writer modified the index in the meantime.
+// ErrCustomerNotFound is returned if there is no such customer.
+func (s *CustomerStore) IndexOrder(ctx context.Context, customerID, orderID string) error {
+	if _, err := s.Get(ctx, customerID); err != nil {
+		return err
+	}
+
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: 10 * time.Millisecond, MaxDelay: 100 * time.Millisecond}
+	return policy.Do(ctx, func(ctx context.Context) error {
+		ids, etag, err := s.OrderIDs(ctx, customerID)
+		if err != nil {
+			return Permanent(err)
+		}
+		i, found := slices.BinarySearch(ids, orderID)
+		if found {
+			return nil
+		}
+		data, err := json.Marshal(slices.Insert(ids, i, orderID))
+		if err != nil {
+			return Permanent(err)
+		}
+		err = s.client.SaveStateWithETag(ctx, s.storeName, tenantKey(ctx, customerOrdersKey(customerID)), data, etag,
+			map[string]string{"contentType": "application/json"},
+			dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+		// only a concurrent write is worth retrying
+		if code := status.Code(err); err != nil && code != codes.Aborted && code != codes.InvalidArgument {
+			return Permanent(err)
+		}
+		return err
+	}, nil)
+}
+
+// indexCustomerOrder indexes order under its customer before it is saved,
+// answering res unless ok. An order saved after being indexed is never
+// missing from the index, while an order indexed but not saved, or reverted,
+// is skipped when listed.
+func (h *AppHandler) indexCustomerOrder(ctx context.Context, order Order) (res updateResult, ok bool) {
+	err := h.customers.IndexOrder(ctx, order.CustomerID, order.ID)
+	switch {
+	case errors.Is(err, ErrCustomerNotFound):
+		return updateResult{Code: http.StatusBadRequest, Message: fmt.Sprintf("Bad request: unknown customer %s", order.CustomerID)}, false
+	case err != nil:
+		slog.ErrorContext(ctx, "couldn't index order", "order", order.ID, "customer", order.CustomerID, "error", err)
+		return updateResult{Code: http.StatusServiceUnavailable, Message: "Service unavailable"}, false
+	}
+	return updateResult{}, true
+}
+
+type schemaPutCustomer struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// handleCustomersPut creates or replaces a customer.
+func (h *AppHandler) handleCustomersPut(w http.ResponseWriter, r *http.Request) {
+	var body schemaPutCustomer
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad request")
+		return
+	}
+	if body.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad request: name is required")
+		return
+	}
+
+	customer := Customer{
+		ID:     mux.Vars(r)["id"],
+		Tenant: TenantFromContext(r.Context()),
+		Name:   body.Name,
+		Email:  body.Email,
+	}
+	if err := h.customers.Save(r.Context(), customer); err != nil {
+		slog.ErrorContext(r.Context(), "couldn't save customer", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Service unavailable")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(customer); err != nil {
+		slog.ErrorContext(r.Context(), "couldn't encode customer", "error", err)
+	}
+}
+
+func (h *AppHandler) handleCustomersGet(w http.ResponseWriter, r *http.Request) {
+	customer, err := h.customers.Get(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, ErrCustomerNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Customer not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "couldn't get customer", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Service unavailable")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(customer); err != nil {
+		slog.ErrorContext(r.Context(), "couldn't encode customer", "error", err)
+	}
+}
+
+// handleCustomersOrders lists the orders of a customer, through its index.
+// The page is taken from the index, so orders indexed but missing from the
+// order store or placed by another customer may make it shorter than limit.
+func (h *AppHandler) handleCustomersOrders(m OrderMapper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		customerID := mux.Vars(r)["id"]
+
+		mediaType, err := negotiate(r)
+		if err != nil {
+			writeCodecError(w, err)
+			return
+		}
+
+		limit, err := queryInt(r, "limit", defaultListLimit)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Bad request: limit must be between 1 and %d", maxListLimit)
+			return
+		}
+		offset, err := queryInt(r, "offset", 0)
+		if err != nil || offset < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Bad request: offset must be a positive integer")
+			return
+		}
+
+		if _, err := h.customers.Get(ctx, customerID); errors.Is(err, ErrCustomerNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "Customer not found")
+			return
+		} else if err != nil {
+			slog.ErrorContext(ctx, "couldn't get customer", "error", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Service unavailable")
+			return
+		}
+
+		ids, _, err := h.customers.OrderIDs(ctx, customerID)
+		if err != nil {
+			slog.ErrorContext(ctx, "couldn't list orders of customer", "customer", customerID, "error", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Service unavailable")
+			return
+		}
+
+		list := &OrderList{Items: []Order{}, Limit: limit, Offset: offset}
+		if end := offset + limit; end < len(ids) {
+			list.NextOffset = &end
+		}
+		for _, id := range ids[min(offset, len(ids)):min(offset+limit, len(ids))] {
+			order, _, err := h.store.Get(ctx, id)
+			if errors.Is(err, ErrOrderNotFound) {
+				continue
+			}
+			if err != nil {
+				slog.ErrorContext(ctx, "couldn't get order", "error", err)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintf(w, "Service unavailable")
+				return
+			}
+			if order.CustomerID == customerID {
+				list.Items = append(list.Items, order)
+			}
+		}
+
+		v, msg := m.List(list)
+		if err := writeBody(w, mediaType, v, msg); err != nil {
+			slog.ErrorContext(ctx, "couldn't encode orders", "error", err)
+		}
+	}
+}
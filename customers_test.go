@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// newCustomersHandler returns a handler with its routes registered, storing
+// customer-1234 and indexing the orders of the customers.
+func newCustomersHandler(t *testing.T) *AppHandler {
+	t.Helper()
+
+	h := newMockHandler(&mockPublisher{}, newMockOrderRepository())
+	h.customers = NewCustomerStore(&fakeDaprClient{})
+	h.RegisterRoutes()
+
+	if rec := serve(h, http.MethodPut, "/customers/customer-1234", `{"name":"Ada","email":"ada@example.com"}`); rec.Code != http.StatusOK {
+		t.Fatalf("couldn't create customer. Got %d: %s", rec.Code, rec.Body)
+	}
+	return h
+}
+
+func TestCustomerOrderUpdates(t *testing.T) {
+	tests := []struct {
+		name         string
+		path         string
+		body         string
+		expected     int
+		expectedBody string
+	}{
+		{
+			name: "known customer", path: "/v2/orders/order-2222", body: `{"status":"PENDING","customerId":"customer-1234"}`,
+			expected: http.StatusOK, expectedBody: "Order updated",
+		},
+		{
+			name: "same customer", path: "/v2/orders/order-1111", body: `{"status":"PENDING","customerId":"customer-1234"}`,
+			expected: http.StatusOK, expectedBody: "Order unchanged",
+		},
+		{
+			name: "v1 update keeping the customer", path: "/orders/order-1111", body: `{"status":"PAID"}`,
+			expected: http.StatusOK, expectedBody: "Order updated",
+		},
+		{
+			name: "other customer", path: "/v2/orders/order-1111", body: `{"status":"PENDING","customerId":"customer-5678"}`,
+			expected: http.StatusBadRequest, expectedBody: "the customer of order-1111 can't change",
+		},
+		{
+			name: "unknown customer", path: "/v2/orders/order-2222", body: `{"status":"PENDING","customerId":"customer-5678"}`,
+			expected: http.StatusBadRequest, expectedBody: "unknown customer customer-5678",
+		},
+		{
+			name: "invalid customer", path: "/v2/orders/order-2222", body: `{"status":"PENDING","customerId":"ada"}`,
+			expected: http.StatusBadRequest, expectedBody: `invalid customer ID "ada"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newCustomersHandler(t)
+			serve(h, http.MethodPut, "/v2/orders/order-1111", `{"status":"PENDING","customerId":"customer-1234"}`)
+
+			rec := serve(h, http.MethodPut, tt.path, tt.body)
+			if rec.Code != tt.expected || !strings.Contains(rec.Body.String(), tt.expectedBody) {
+				t.Fatalf("expected status code %d and %s. Got %d: %s", tt.expected, tt.expectedBody, rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestCustomerOrders(t *testing.T) {
+	h := newCustomersHandler(t)
+	for _, id := range []string{"order-3333", "order-1111", "order-2222"} {
+		if rec := serve(h, http.MethodPut, "/v2/orders/"+id, `{"status":"PENDING","customerId":"customer-1234"}`); rec.Code != http.StatusOK {
+			t.Fatalf("couldn't create %s. Got %d: %s", id, rec.Code, rec.Body)
+		}
+	}
+	serve(h, http.MethodPut, "/v2/orders/order-4444", `{"status":"PENDING"}`)
+	// an order indexed but never saved, as when saving it failed
+	if err := h.customers.IndexOrder(context.Background(), "customer-1234", "order-5555"); err != nil {
+		t.Fatalf("couldn't index order: %s", err)
+	}
+
+	tests := []struct {
+		path         string
+		expected     int
+		expectedBody string
+	}{
+		{
+			"/v2/customers/customer-1234/orders", http.StatusOK,
+			`{"items":[{"id":"order-1111","status":"PENDING","customerId":"customer-1234"},{"id":"order-2222","status":"PENDING","customerId":"customer-1234"},{"id":"order-3333","status":"PENDING","customerId":"customer-1234"}],"limit":20,"offset":0}`,
+		},
+		{
+			"/v2/customers/customer-1234/orders?limit=2&offset=1", http.StatusOK,
+			`{"items":[{"id":"order-2222","status":"PENDING","customerId":"customer-1234"},{"id":"order-3333","status":"PENDING","customerId":"customer-1234"}],"limit":2,"offset":1,"nextOffset":3}`,
+		},
+		{
+			"/customers/customer-1234/orders?offset=3", http.StatusOK,
+			`{"items":[],"limit":20,"offset":3}`,
+		},
+		{"/customers/customer-5678/orders", http.StatusNotFound, "Customer not found"},
+		{"/customers/customer-1234/orders?limit=0", http.StatusBadRequest, "limit must be between"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := serve(h, http.MethodGet, tt.path, "")
+			if rec.Code != tt.expected || !strings.Contains(rec.Body.String(), tt.expectedBody) {
+				t.Fatalf("expected status code %d and %s. Got %d: %s", tt.expected, tt.expectedBody, rec.Code, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// circuitBreakerClient decorates a Dapr client so that calls fail fast with
+// ErrCircuitOpen while the sidecar is unhealthy. Methods that are not
+// overridden are forwarded to the wrapped client as is.
+type circuitBreakerClient struct {
+	dapr.Client
+	breaker *CircuitBreaker
+	metrics *Metrics
+}
+
+func NewCircuitBreakerClient(client dapr.Client, breaker *CircuitBreaker, metrics *Metrics) dapr.Client {
+	breaker.OnStateChange = func(state CircuitState) {
+		metrics.CircuitBreakerState.Set(float64(state))
+	}
+	breaker.IsFailure = isSidecarFailure
+
+	return &circuitBreakerClient{
+		Client:  client,
+		breaker: breaker,
+		metrics: metrics,
+	}
+}
+
+// isSidecarFailure reports whether err means the sidecar or the component
+// behind it is unhealthy, as opposed to the sidecar rejecting the request
+// itself, e.g. on an ETag mismatch.
+func isSidecarFailure(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	switch status.Code(err) {
+	case codes.OK, codes.Canceled, codes.InvalidArgument, codes.NotFound, codes.AlreadyExists,
+		codes.PermissionDenied, codes.Unauthenticated, codes.FailedPrecondition, codes.Aborted:
+		return false
+	}
+	return true
+}
+
+func (c *circuitBreakerClient) execute(operation string, fn func() error) error {
+	err := c.breaker.Execute(fn)
+	if err == ErrCircuitOpen {
+		c.metrics.CircuitBreakerRejections.WithLabelValues(operation).Inc()
+	}
+	return err
+}
+
+func (c *circuitBreakerClient) PublishEvent(ctx context.Context, pubsubName, topicName string, data interface{}, opts ...dapr.PublishEventOption) error {
+	return c.execute("publish", func() error {
+		return c.Client.PublishEvent(ctx, pubsubName, topicName, data, opts...)
+	})
+}
+
+func (c *circuitBreakerClient) SaveState(ctx context.Context, storeName, key string, data []byte, meta map[string]string, so ...dapr.StateOption) error {
+	return c.execute("save_state", func() error {
+		return c.Client.SaveState(ctx, storeName, key, data, meta, so...)
+	})
+}
+
+func (c *circuitBreakerClient) QueryStateAlpha1(ctx context.Context, storeName, query string, meta map[string]string) (resp *dapr.QueryResponse, err error) {
+	err = c.execute("query_state", func() error {
+		resp, err = c.Client.QueryStateAlpha1(ctx, storeName, query, meta)
+		return err
+	})
+	return resp, err
+}
+
+func (c *circuitBreakerClient) SaveStateWithETag(ctx context.Context, storeName, key string, data []byte, etag string, meta map[string]string, so ...dapr.StateOption) error {
+	return c.execute("save_state", func() error {
+		return c.Client.SaveStateWithETag(ctx, storeName, key, data, etag, meta, so...)
+	})
+}
+
+func (c *circuitBreakerClient) GetState(ctx context.Context, storeName, key string, meta map[string]string) (item *dapr.StateItem, err error) {
+	err = c.execute("get_state", func() error {
+		item, err = c.Client.GetState(ctx, storeName, key, meta)
+		return err
+	})
+	return item, err
+}
+
+func (c *circuitBreakerClient) DeleteState(ctx context.Context, storeName, key string, meta map[string]string) error {
+	return c.execute("delete_state", func() error {
+		return c.Client.DeleteState(ctx, storeName, key, meta)
+	})
+}
+
+func (c *circuitBreakerClient) DeleteStateWithETag(ctx context.Context, storeName, key string, etag *dapr.ETag, meta map[string]string, opts *dapr.StateOptions) error {
+	return c.execute("delete_state", func() error {
+		return c.Client.DeleteStateWithETag(ctx, storeName, key, etag, meta, opts)
+	})
+}
+
+func (c *circuitBreakerClient) GetBulkState(ctx context.Context, storeName string, keys []string, meta map[string]string, parallelism int32) (items []*dapr.BulkStateItem, err error) {
+	err = c.execute("get_bulk_state", func() error {
+		items, err = c.Client.GetBulkState(ctx, storeName, keys, meta, parallelism)
+		return err
+	})
+	return items, err
+}
+
+func (c *circuitBreakerClient) ExecuteStateTransaction(ctx context.Context, storeName string, meta map[string]string, ops []*dapr.StateOperation) error {
+	return c.execute("transaction_state", func() error {
+		return c.Client.ExecuteStateTransaction(ctx, storeName, meta, ops)
+	})
+}
+
+// DaprTimeouts bounds the duration of each call to the sidecar, per kind of
+// operation. A zero timeout leaves calls bounded by their context only.
+type DaprTimeouts struct {
+	Publish time.Duration
+	State   time.Duration
+}
+
+// timeoutClient decorates a Dapr client so that every call is cancelled once
+// the timeout of its operation expires. Methods that are not overridden are
+// forwarded to the wrapped client as is.
+type timeoutClient struct {
+	dapr.Client
+	timeouts DaprTimeouts
+}
+
+func NewTimeoutClient(client dapr.Client, timeouts DaprTimeouts) dapr.Client {
+	return &timeoutClient{Client: client, timeouts: timeouts}
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (c *timeoutClient) PublishEvent(ctx context.Context, pubsubName, topicName string, data interface{}, opts ...dapr.PublishEventOption) error {
+	ctx, cancel := withTimeout(ctx, c.timeouts.Publish)
+	defer cancel()
+	return c.Client.PublishEvent(ctx, pubsubName, topicName, data, opts...)
+}
+
+func (c *timeoutClient) SaveState(ctx context.Context, storeName, key string, data []byte, meta map[string]string, so ...dapr.StateOption) error {
+	ctx, cancel := withTimeout(ctx, c.timeouts.State)
+	defer cancel()
+	return c.Client.SaveState(ctx, storeName, key, data, meta, so...)
+}
+
+func (c *timeoutClient) SaveStateWithETag(ctx context.Context, storeName, key string, data []byte, etag string, meta map[string]string, so ...dapr.StateOption) error {
+	ctx, cancel := withTimeout(ctx, c.timeouts.State)
+	defer cancel()
+	return c.Client.SaveStateWithETag(ctx, storeName, key, data, etag, meta, so...)
+}
+
+func (c *timeoutClient) GetState(ctx context.Context, storeName, key string, meta map[string]string) (*dapr.StateItem, error) {
+	ctx, cancel := withTimeout(ctx, c.timeouts.State)
+	defer cancel()
+	return c.Client.GetState(ctx, storeName, key, meta)
+}
+
+func (c *timeoutClient) QueryStateAlpha1(ctx context.Context, storeName, query string, meta map[string]string) (*dapr.QueryResponse, error) {
+	ctx, cancel := withTimeout(ctx, c.timeouts.State)
+	defer cancel()
+	return c.Client.QueryStateAlpha1(ctx, storeName, query, meta)
+}
+
+func (c *timeoutClient) DeleteState(ctx context.Context, storeName, key string, meta map[string]string) error {
+	ctx, cancel := withTimeout(ctx, c.timeouts.State)
+	defer cancel()
+	return c.Client.DeleteState(ctx, storeName, key, meta)
+}
+
+func (c *timeoutClient) DeleteStateWithETag(ctx context.Context, storeName, key string, etag *dapr.ETag, meta map[string]string, opts *dapr.StateOptions) error {
+	ctx, cancel := withTimeout(ctx, c.timeouts.State)
+	defer cancel()
+	return c.Client.DeleteStateWithETag(ctx, storeName, key, etag, meta, opts)
+}
+
+func (c *timeoutClient) GetBulkState(ctx context.Context, storeName string, keys []string, meta map[string]string, parallelism int32) ([]*dapr.BulkStateItem, error) {
+	ctx, cancel := withTimeout(ctx, c.timeouts.State)
+	defer cancel()
+	return c.Client.GetBulkState(ctx, storeName, keys, meta, parallelism)
+}
+
+func (c *timeoutClient) ExecuteStateTransaction(ctx context.Context, storeName string, meta map[string]string, ops []*dapr.StateOperation) error {
+	ctx, cancel := withTimeout(ctx, c.timeouts.State)
+	defer cancel()
+	return c.Client.ExecuteStateTransaction(ctx, storeName, meta, ops)
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/dapr/dapr/pkg/proto/runtime/v1"
+	dapr "github.com/dapr/go-sdk/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type publishedEvent struct {
+	pubsubName  string
+	topic       string
+	data        any
+	contentType string
+	metadata    map[string]string
+}
+
+// fakeDaprClient records published events and keeps state in memory instead
+// of talking to a sidecar. Calling any other method panics.
+type fakeDaprClient struct {
+	dapr.Client
+
+	mu         sync.Mutex
+	published  []publishedEvent
+	publishErr error
+	state      map[string][]byte
+	etags      map[string]int
+	stateErr   error
+
+	components []*dapr.MetadataRegisteredComponents
+	// subscriptions are the subscriptions listed by the metadata API.
+	subscriptions []*dapr.MetadataSubscription
+	metadataErr   error
+
+	// invoke answers the service invocations.
+	invoke func(appID, method string, content *dapr.DataContent) ([]byte, error)
+
+	// actorCalls records the actor invocations, failing with actorErr if
+	// set, actorState and reminders are keyed by actor type, ID and name.
+	actorCalls []*dapr.InvokeActorRequest
+	actorErr   error
+	actorState map[string][]byte
+	reminders  map[string]*dapr.RegisterActorReminderRequest
+
+	// configuration holds the items of the configuration store, read with
+	// configurationErr if set, and configurationHandler is the handler of
+	// the subscription to their changes.
+	configuration        map[string]*dapr.ConfigurationItem
+	configurationErr     error
+	configurationHandler dapr.ConfigurationHandleFunction
+
+	// secrets are the secrets of the secret store, read with secretsErr if
+	// set.
+	secrets    map[string]map[string]string
+	secretsErr error
+}
+
+func (c *fakeDaprClient) PublishEvent(ctx context.Context, pubsubName, topicName string, data interface{}, opts ...dapr.PublishEventOption) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.publishErr != nil {
+		return c.publishErr
+	}
+	req := &pb.PublishEventRequest{}
+	for _, opt := range opts {
+		opt(req)
+	}
+	c.published = append(c.published, publishedEvent{pubsubName: pubsubName, topic: topicName, data: data, contentType: req.DataContentType, metadata: req.Metadata})
+	return nil
+}
+
+func (c *fakeDaprClient) SaveState(ctx context.Context, storeName, key string, data []byte, meta map[string]string, so ...dapr.StateOption) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stateErr != nil {
+		return c.stateErr
+	}
+	c.set(key, data)
+	return nil
+}
+
+func (c *fakeDaprClient) set(key string, data []byte) {
+	if c.state == nil {
+		c.state = map[string][]byte{}
+		c.etags = map[string]int{}
+	}
+	c.state[key] = data
+	c.etags[key]++
+}
+
+// SaveStateWithETag fails with the Aborted code the sidecar uses when etag
+// doesn't match the stored version. As with first-write concurrency, a save
+// without ETag fails if the key is already stored.
+func (c *fakeDaprClient) SaveStateWithETag(ctx context.Context, storeName, key string, data []byte, etag string, meta map[string]string, so ...dapr.StateOption) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stateErr != nil {
+		return c.stateErr
+	}
+	options := &dapr.StateOptions{}
+	for _, o := range so {
+		o(options)
+	}
+	_, stored := c.state[key]
+	switch {
+	case etag != "" && etag != strconv.Itoa(c.etags[key]):
+		return status.Error(codes.Aborted, "possible etag mismatch")
+	case etag == "" && options.Concurrency == dapr.StateConcurrencyFirstWrite && stored:
+		return status.Error(codes.Aborted, "possible etag mismatch")
+	}
+	c.set(key, data)
+	return nil
+}
+
+func (c *fakeDaprClient) GetState(ctx context.Context, storeName, key string, meta map[string]string) (*dapr.StateItem, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stateErr != nil {
+		return nil, c.stateErr
+	}
+	item := &dapr.StateItem{Key: key, Value: c.state[key]}
+	if _, ok := c.state[key]; ok {
+		item.Etag = strconv.Itoa(c.etags[key])
+	}
+	return item, nil
+}
+
+// QueryStateAlpha1 only honours the pagination and top-level EQ filters of the
+// query, results are sorted by key.
+func (c *fakeDaprClient) QueryStateAlpha1(ctx context.Context, storeName, query string, meta map[string]string) (*dapr.QueryResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stateErr != nil {
+		return nil, c.stateErr
+	}
+
+	var q StateQuery
+	if err := json.Unmarshal([]byte(query), &q); err != nil {
+		return nil, err
+	}
+	offset := 0
+	if q.Page.Token != "" {
+		offset, _ = strconv.Atoi(q.Page.Token)
+	}
+
+	keys := make([]string, 0, len(c.state))
+	for key, value := range c.state {
+		if matchesEqualFilter(q.Filter, value) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	resp := &dapr.QueryResponse{}
+	for i := offset; i < len(keys) && len(resp.Results) < q.Page.Limit; i++ {
+		resp.Results = append(resp.Results, dapr.QueryItem{Key: keys[i], Value: c.state[keys[i]]})
+	}
+	if len(resp.Results) == q.Page.Limit {
+		resp.Token = strconv.Itoa(offset + q.Page.Limit)
+	}
+	return resp, nil
+}
+
+func (c *fakeDaprClient) DeleteState(ctx context.Context, storeName, key string, meta map[string]string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stateErr != nil {
+		return c.stateErr
+	}
+	delete(c.state, key)
+	delete(c.etags, key)
+	return nil
+}
+
+// DeleteStateWithETag fails with the Aborted code the sidecar uses when etag
+// doesn't match the stored version.
+func (c *fakeDaprClient) DeleteStateWithETag(ctx context.Context, storeName, key string, etag *dapr.ETag, meta map[string]string, opts *dapr.StateOptions) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stateErr != nil {
+		return c.stateErr
+	}
+	if etag != nil && etag.Value != strconv.Itoa(c.etags[key]) {
+		return status.Error(codes.Aborted, "possible etag mismatch")
+	}
+	delete(c.state, key)
+	delete(c.etags, key)
+	return nil
+}
+
+// GetBulkState answers the keys in reverse order, as the sidecar answers
+// them in any order.
+func (c *fakeDaprClient) GetBulkState(ctx context.Context, storeName string, keys []string, meta map[string]string, parallelism int32) ([]*dapr.BulkStateItem, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stateErr != nil {
+		return nil, c.stateErr
+	}
+	items := make([]*dapr.BulkStateItem, 0, len(keys))
+	for i := len(keys) - 1; i >= 0; i-- {
+		item := &dapr.BulkStateItem{Key: keys[i], Value: c.state[keys[i]]}
+		if _, ok := c.state[keys[i]]; ok {
+			item.Etag = strconv.Itoa(c.etags[keys[i]])
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// ExecuteStateTransaction applies ops only if all their ETags match, failing
+// with the Aborted code the sidecar uses otherwise. As with first-write
+// concurrency, an upsert without ETag fails if the key is already stored.
+func (c *fakeDaprClient) ExecuteStateTransaction(ctx context.Context, storeName string, meta map[string]string, ops []*dapr.StateOperation) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stateErr != nil {
+		return c.stateErr
+	}
+	for _, op := range ops {
+		_, stored := c.state[op.Item.Key]
+		firstWrite := op.Item.Options != nil && op.Item.Options.Concurrency == dapr.StateConcurrencyFirstWrite
+		switch {
+		case op.Item.Etag != nil && op.Item.Etag.Value != strconv.Itoa(c.etags[op.Item.Key]):
+			return status.Error(codes.Aborted, "possible etag mismatch")
+		case op.Item.Etag == nil && firstWrite && stored && op.Type == dapr.StateOperationTypeUpsert:
+			return status.Error(codes.Aborted, "possible etag mismatch")
+		}
+	}
+	for _, op := range ops {
+		if op.Type == dapr.StateOperationTypeDelete {
+			delete(c.state, op.Item.Key)
+			delete(c.etags, op.Item.Key)
+			continue
+		}
+		c.set(op.Item.Key, op.Item.Value)
+	}
+	return nil
+}
+
+func matchesEqualFilter(filter map[string]any, value []byte) bool {
+	eq, ok := filter["EQ"].(map[string]any)
+	if !ok {
+		return true
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(value, &doc); err != nil {
+		return false
+	}
+	for k, v := range eq {
+		if doc[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *fakeDaprClient) GetMetadata(ctx context.Context) (*dapr.GetMetadataResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.metadataErr != nil {
+		return nil, c.metadataErr
+	}
+	return &dapr.GetMetadataResponse{ID: "app", RegisteredComponents: c.components, Subscriptions: c.subscriptions}, nil
+}
+
+func (c *fakeDaprClient) GetConfigurationItems(ctx context.Context, storeName string, keys []string, opts ...dapr.ConfigurationOpt) (map[string]*dapr.ConfigurationItem, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.configurationErr != nil {
+		return nil, c.configurationErr
+	}
+	items := map[string]*dapr.ConfigurationItem{}
+	for _, key := range keys {
+		if item, ok := c.configuration[key]; ok {
+			items[key] = item
+		}
+	}
+	return items, nil
+}
+
+func (c *fakeDaprClient) SubscribeConfigurationItems(ctx context.Context, storeName string, keys []string, handler dapr.ConfigurationHandleFunction, opts ...dapr.ConfigurationOpt) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.configurationErr != nil {
+		return "", c.configurationErr
+	}
+	c.configurationHandler = handler
+	return "subscription-1", nil
+}
+
+func (c *fakeDaprClient) GetBulkSecret(ctx context.Context, storeName string, meta map[string]string) (map[string]map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.secretsErr != nil {
+		return nil, c.secretsErr
+	}
+	secrets := make(map[string]map[string]string, len(c.secrets))
+	for name, secret := range c.secrets {
+		secrets[name] = maps.Clone(secret)
+	}
+	return secrets, nil
+}
+
+func (c *fakeDaprClient) InvokeMethod(ctx context.Context, appID, methodName, verb string) ([]byte, error) {
+	return c.invoke(appID, methodName, nil)
+}
+
+func (c *fakeDaprClient) InvokeMethodWithContent(ctx context.Context, appID, methodName, verb string, content *dapr.DataContent) ([]byte, error) {
+	return c.invoke(appID, methodName, content)
+}
+
+func (c *fakeDaprClient) InvokeActor(ctx context.Context, in *dapr.InvokeActorRequest) (*dapr.InvokeActorResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.actorCalls = append(c.actorCalls, in)
+	if c.actorErr != nil {
+		return nil, c.actorErr
+	}
+	return &dapr.InvokeActorResponse{}, nil
+}
+
+func actorKey(actorType, actorID, name string) string {
+	return actorType + "/" + actorID + "/" + name
+}
+
+func (c *fakeDaprClient) GetActorState(ctx context.Context, in *dapr.GetActorStateRequest) (*dapr.GetActorStateResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stateErr != nil {
+		return nil, c.stateErr
+	}
+	return &dapr.GetActorStateResponse{Data: c.actorState[actorKey(in.ActorType, in.ActorID, in.KeyName)]}, nil
+}
+
+// SaveStateTransactionally only supports upserts.
+func (c *fakeDaprClient) SaveStateTransactionally(ctx context.Context, actorType, actorID string, operations []*dapr.ActorStateOperation) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stateErr != nil {
+		return c.stateErr
+	}
+	if c.actorState == nil {
+		c.actorState = map[string][]byte{}
+	}
+	for _, op := range operations {
+		c.actorState[actorKey(actorType, actorID, op.Key)] = op.Value
+	}
+	return nil
+}
+
+func (c *fakeDaprClient) RegisterActorReminder(ctx context.Context, in *dapr.RegisterActorReminderRequest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reminders == nil {
+		c.reminders = map[string]*dapr.RegisterActorReminderRequest{}
+	}
+	c.reminders[actorKey(in.ActorType, in.ActorID, in.Name)] = in
+	return nil
+}
+
+func (c *fakeDaprClient) UnregisterActorReminder(ctx context.Context, in *dapr.UnregisterActorReminderRequest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.reminders, actorKey(in.ActorType, in.ActorID, in.Name))
+	return nil
+}
+
+// blockingDaprClient publishes until its context is done.
+type blockingDaprClient struct {
+	dapr.Client
+}
+
+func (c *blockingDaprClient) PublishEvent(ctx context.Context, pubsubName, topicName string, data interface{}, opts ...dapr.PublishEventOption) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestTimeoutClient(t *testing.T) {
+	client := NewTimeoutClient(&blockingDaprClient{}, DaprTimeouts{Publish: 10 * time.Millisecond})
+
+	err := client.PublishEvent(context.Background(), pubsubName, topicOrders, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected error %q. Got %v.", context.DeadlineExceeded, err)
+	}
+}
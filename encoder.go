@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/etiennetremel/testcontainers-dapr-example/orderspb"
+	"github.com/linkedin/goavro/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	EventEncodingProtobuf = "protobuf"
+	EventEncodingAvro     = "avro"
+
+	contentTypeAvro = "application/avro"
+
+	// avroMagicByte starts every payload in the Confluent wire format, followed
+	// by the 4 bytes big-endian ID of the schema.
+	avroMagicByte    = 0
+	avroHeaderLength = 5
+)
+
+//go:embed schemas/order_status_changed.avsc
+var orderStatusChangedSchema string
+
+// EncodedEvent is the payload of an event along with the CloudEvent
+// attributes describing it.
+type EncodedEvent struct {
+	ContentType string
+	Type        string
+	// DataSchema, if set, is the URL of the schema of Data.
+	DataSchema string
+	Data       []byte
+}
+
+// EventEncoder encodes the events published on a topic.
+type EventEncoder interface {
+	Encode(ctx context.Context, topic string, msg proto.Message) (*EncodedEvent, error)
+}
+
+// EventConfig controls how published events are encoded, and how long they
+// may be delivered.
+type EventConfig struct {
+	// Encoding is either protobuf or avro.
+	Encoding string
+	// SchemaRegistryURL is the Confluent compatible schema registry used with
+	// the avro encoding.
+	SchemaRegistryURL string
+	// TTL is the time after which published events expire, rather than
+	// being delivered late. Events don't expire if zero.
+	TTL time.Duration
+	// SigningKey is the HMAC key the events are signed and verified with,
+	// unless the secret store holds one. Events aren't signed if empty.
+	SigningKey Secret
+}
+
+// Validate ensures the encoding is known and configured, and the TTL is a
+// number of seconds, the unit the sidecar takes it in.
+func (c EventConfig) Validate() error {
+	if c.TTL < 0 || c.TTL%time.Second != 0 {
+		return fmt.Errorf("invalid event TTL %s: must be a positive number of seconds", c.TTL)
+	}
+	switch c.Encoding {
+	case EventEncodingProtobuf:
+		return nil
+	case EventEncodingAvro:
+		if c.SchemaRegistryURL == "" {
+			return errors.New("the avro encoding requires a schema registry URL")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown event encoding %q", c.Encoding)
+}
+
+// NewEventEncoder returns the encoder configured by config.
+func NewEventEncoder(config EventConfig) (EventEncoder, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.Encoding == EventEncodingAvro {
+		return NewAvroEncoder(NewSchemaRegistryClient(config.SchemaRegistryURL))
+	}
+	return ProtobufEncoder{}, nil
+}
+
+// ProtobufEncoder encodes events in their protobuf binary format.
+type ProtobufEncoder struct{}
+
+func (ProtobufEncoder) Encode(ctx context.Context, topic string, msg proto.Message) (*EncodedEvent, error) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &EncodedEvent{
+		ContentType: contentTypeProtobuf,
+		Type:        string(msg.ProtoReflect().Descriptor().FullName()),
+		Data:        data,
+	}, nil
+}
+
+// AvroEncoder encodes events in Avro, in the Confluent wire format. Before
+// the first event of a topic is published, the schema is checked for
+// compatibility and registered under the <topic>-value subject.
+type AvroEncoder struct {
+	registry *SchemaRegistryClient
+	codec    *goavro.Codec
+
+	mu        sync.Mutex
+	schemaIDs map[string]int
+}
+
+func NewAvroEncoder(registry *SchemaRegistryClient) (*AvroEncoder, error) {
+	codec, err := goavro.NewCodec(orderStatusChangedSchema)
+	if err != nil {
+		return nil, err
+	}
+	return &AvroEncoder{
+		registry:  registry,
+		codec:     codec,
+		schemaIDs: map[string]int{},
+	}, nil
+}
+
+func (e *AvroEncoder) Encode(ctx context.Context, topic string, msg proto.Message) (*EncodedEvent, error) {
+	event, ok := msg.(*orderspb.OrderStatusChanged)
+	if !ok {
+		return nil, fmt.Errorf("no avro schema for %s", msg.ProtoReflect().Descriptor().FullName())
+	}
+
+	id, err := e.schemaID(ctx, topic+"-value")
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, avroHeaderLength, 64)
+	data[0] = avroMagicByte
+	binary.BigEndian.PutUint32(data[1:], uint32(id))
+	data, err = e.codec.BinaryFromNative(data, orderStatusChangedToAvro(event))
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncodedEvent{
+		ContentType: contentTypeAvro,
+		Type:        string(event.ProtoReflect().Descriptor().FullName()),
+		DataSchema:  e.registry.SchemaURL(id),
+		Data:        data,
+	}, nil
+}
+
+// schemaID returns the ID of the schema registered under subject, checking
+// its compatibility and registering it the first time. Failures aren't
+// cached so that the next publish tries again.
+func (e *AvroEncoder) schemaID(ctx context.Context, subject string) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if id, ok := e.schemaIDs[subject]; ok {
+		return id, nil
+	}
+	if err := e.registry.CheckCompatibility(ctx, subject, orderStatusChangedSchema); err != nil {
+		return 0, err
+	}
+	id, err := e.registry.Register(ctx, subject, orderStatusChangedSchema)
+	if err != nil {
+		return 0, err
+	}
+	e.schemaIDs[subject] = id
+	return id, nil
+}
+
+// avroStatus maps a protobuf status to its symbol in the avro schema.
+func avroStatus(status orderspb.OrderStatus) string {
+	return strings.TrimPrefix(status.String(), "ORDER_STATUS_")
+}
+
+func orderStatusChangedToAvro(event *orderspb.OrderStatusChanged) map[string]any {
+	order := event.GetOrder()
+	lineItems := make([]any, 0, len(order.GetLineItems()))
+	for _, item := range order.GetLineItems() {
+		lineItems = append(lineItems, map[string]any{
+			"sku":        item.GetSku(),
+			"quantity":   item.GetQuantity(),
+			"unit_price": item.GetUnitPrice(),
+		})
+	}
+	return map[string]any{
+		"order": map[string]any{
+			"id":          order.GetId(),
+			"status":      avroStatus(order.GetStatus()),
+			"tenant":      order.GetTenant(),
+			"amount":      order.GetAmount(),
+			"currency":    order.GetCurrency(),
+			"line_items":  lineItems,
+			"customer_id": order.GetCustomerId(),
+		},
+		"previous_status": avroStatus(event.GetPreviousStatus()),
+		"changed_at":      event.GetChangedAt().AsTime(),
+	}
+}
+
+// DecodeAvroOrderStatusChanged decodes an OrderStatusChanged event encoded in
+// Avro in the Confluent wire format and returns the order it carries. The
+// payload is read with the schema embedded in the application, which is the
+// one it publishes with.
+func DecodeAvroOrderStatusChanged(data []byte) (Order, error) {
+	if len(data) < avroHeaderLength || data[0] != avroMagicByte {
+		return Order{}, errors.New("couldn't decode order event: not in the Confluent wire format")
+	}
+
+	codec, err := goavro.NewCodec(orderStatusChangedSchema)
+	if err != nil {
+		return Order{}, err
+	}
+	native, _, err := codec.NativeFromBinary(data[avroHeaderLength:])
+	if err != nil {
+		return Order{}, fmt.Errorf("couldn't decode order event: %w", err)
+	}
+
+	record, _ := native.(map[string]any)
+	order, _ := record["order"].(map[string]any)
+	id, _ := order["id"].(string)
+	status, _ := order["status"].(string)
+	tenant, _ := order["tenant"].(string)
+	amount, _ := order["amount"].(int64)
+	currency, _ := order["currency"].(string)
+	customerID, _ := order["customer_id"].(string)
+	if status == "UNSPECIFIED" {
+		status = ""
+	}
+
+	var lineItems []LineItem
+	items, _ := order["line_items"].([]any)
+	for _, item := range items {
+		item, _ := item.(map[string]any)
+		sku, _ := item["sku"].(string)
+		quantity, _ := item["quantity"].(int32)
+		unitPrice, _ := item["unit_price"].(int64)
+		lineItems = append(lineItems, LineItem{SKU: sku, Quantity: int(quantity), UnitPrice: unitPrice})
+	}
+	return Order{ID: id, Status: OrderStatus(status), Tenant: tenant, LineItems: lineItems, Amount: amount, Currency: currency, CustomerID: customerID}, nil
+}
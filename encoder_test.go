@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSchemaRegistry serves the compatibility and registration endpoints of
+// a Confluent schema registry for a single schema ID.
+type fakeSchemaRegistry struct {
+	mu            sync.Mutex
+	incompatible  bool
+	subjects      map[string]bool
+	registrations int
+}
+
+func (f *fakeSchemaRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var req schemaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Schema == "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeSchemaRegistry)
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/compatibility/subjects/"):
+		subject := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/compatibility/subjects/"), "/versions/latest")
+		if !f.subjects[subject] {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(schemaRegistryError{ErrorCode: errorCodeSubjectNotFound, Message: "Subject not found"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]bool{"is_compatible": !f.incompatible})
+	case strings.HasPrefix(r.URL.Path, "/subjects/"):
+		subject := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/subjects/"), "/versions")
+		if f.subjects == nil {
+			f.subjects = map[string]bool{}
+		}
+		f.subjects[subject] = true
+		f.registrations++
+		json.NewEncoder(w).Encode(map[string]int{"id": 42})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newAvroEncoder(t *testing.T, registry *fakeSchemaRegistry) *AvroEncoder {
+	t.Helper()
+
+	server := httptest.NewServer(registry)
+	t.Cleanup(server.Close)
+
+	encoder, err := NewAvroEncoder(NewSchemaRegistryClient(server.URL))
+	if err != nil {
+		t.Fatalf("couldn't create encoder: %s", err)
+	}
+	return encoder
+}
+
+func TestAvroEncoderRoundTrip(t *testing.T) {
+	registry := &fakeSchemaRegistry{}
+	encoder := newAvroEncoder(t, registry)
+
+	order := Order{
+		ID:         "order-1234",
+		Status:     OrderStatusPaid,
+		Tenant:     "acme",
+		LineItems:  []LineItem{{SKU: "book", Quantity: 2, UnitPrice: 999}, {SKU: "pen", Quantity: 1}},
+		Amount:     1998,
+		Currency:   "EUR",
+		CustomerID: "customer-1234",
+	}
+	for i := 0; i < 2; i++ {
+		encoded, err := encoder.Encode(context.Background(), topicOrders, newOrderStatusChanged(order, OrderStatusPending, time.Now()))
+		if err != nil {
+			t.Fatalf("expected no error. Got %s.", err)
+		}
+
+		if encoded.ContentType != contentTypeAvro || !strings.HasSuffix(encoded.DataSchema, "/schemas/ids/42") {
+			t.Fatalf("expected an avro event with schema 42. Got %+v.", encoded)
+		}
+		if encoded.Data[0] != avroMagicByte || binary.BigEndian.Uint32(encoded.Data[1:5]) != 42 {
+			t.Fatalf("expected the payload to start with the ID of the schema. Got %x.", encoded.Data[:5])
+		}
+
+		got, err := DecodeAvroOrderStatusChanged(encoded.Data)
+		if err != nil {
+			t.Fatalf("couldn't decode event: %s", err)
+		}
+		if !reflect.DeepEqual(got, order) {
+			t.Fatalf("expected order %v. Got %v.", order, got)
+		}
+	}
+
+	if registry.registrations != 1 {
+		t.Fatalf("expected the schema to be registered once. Got %d registrations.", registry.registrations)
+	}
+}
+
+func TestAvroEncoderIncompatibleSchema(t *testing.T) {
+	registry := &fakeSchemaRegistry{incompatible: true, subjects: map[string]bool{"orders-value": true}}
+	encoder := newAvroEncoder(t, registry)
+
+	client := &fakeDaprClient{}
+	config := &Config{TopicAllowlist: defaultTopicAllowlist(), PublishRetry: RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}}
+	publisher := NewPublisher(client, config, NewMetrics())
+	publisher.Encoder = encoder
+
+	event := newOrderStatusChanged(Order{ID: "order-1234", Status: OrderStatusPaid}, OrderStatusPending, time.Now())
+	err := publisher.Publish(context.Background(), handlerOrdersPut, topicOrders, event)
+	if !errors.Is(err, ErrIncompatibleSchema) {
+		t.Fatalf("expected error %q. Got %v.", ErrIncompatibleSchema, err)
+	}
+	if len(client.published) != 0 || registry.registrations != 0 {
+		t.Fatalf("expected nothing to be published nor registered. Got %d events and %d registrations.", len(client.published), registry.registrations)
+	}
+}
+
+func TestDecodeAvroOrderStatusChangedRejectsUnframedPayloads(t *testing.T) {
+	if _, err := DecodeAvroOrderStatusChanged([]byte{1, 2}); err == nil {
+		t.Fatal("expected an error for a payload without the wire format header")
+	}
+}
+
+func TestEventConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  EventConfig
+		wantErr bool
+	}{
+		{"protobuf", EventConfig{Encoding: EventEncodingProtobuf}, false},
+		{"avro", EventConfig{Encoding: EventEncodingAvro, SchemaRegistryURL: "http://schema-registry:8080"}, false},
+		{"avro without registry", EventConfig{Encoding: EventEncodingAvro}, true},
+		{"unknown", EventConfig{Encoding: "json"}, true},
+		{"ttl", EventConfig{Encoding: EventEncodingProtobuf, TTL: time.Minute}, false},
+		{"negative ttl", EventConfig{Encoding: EventEncodingProtobuf, TTL: -time.Second}, true},
+		{"sub-second ttl", EventConfig{Encoding: EventEncodingProtobuf, TTL: 1500 * time.Millisecond}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error: %t. Got %v.", tt.wantErr, err)
+			}
+		})
+	}
+}
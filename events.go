@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/etiennetremel/testcontainers-dapr-example/orderspb"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// newOrderStatusChanged builds the event published when order moved from
+// the previous status, empty for a new order.
+func newOrderStatusChanged(order Order, previous OrderStatus, changedAt time.Time) *orderspb.OrderStatusChanged {
+	return &orderspb.OrderStatusChanged{
+		Order:          orderToProto(order),
+		PreviousStatus: statusToProto(previous),
+		ChangedAt:      timestamppb.New(changedAt),
+	}
+}
+
+// CloudEvent types of the events published in JSON.
+const (
+	cloudEventTypeOrderCancelled = "order.cancelled"
+	cloudEventTypeOrderRefunded  = "order.refunded"
+
+	cloudEventTypeShipmentCreated       = "shipment.created"
+	cloudEventTypeShipmentStatusChanged = "shipment.status_changed"
+)
+
+// OrderCancelled is published in JSON when an order is cancelled, so that
+// downstream systems release what they held for it, such as inventory. Its
+// payload decodes as the cancelled order.
+type OrderCancelled struct {
+	Order
+	PreviousStatus OrderStatus `json:"previousStatus"`
+	CancelledAt    time.Time   `json:"cancelledAt"`
+}
+
+func (OrderCancelled) CloudEventType() string {
+	return cloudEventTypeOrderCancelled
+}
+
+// OrderRefunded is published in JSON once the charge of a refunded order was
+// reversed. Its payload decodes as the refunded order.
+type OrderRefunded struct {
+	Order
+	RefundedAt time.Time `json:"refundedAt"`
+}
+
+func (OrderRefunded) CloudEventType() string {
+	return cloudEventTypeOrderRefunded
+}
+
+// orderEventKey returns the key of the event changing orderID from the
+// version etag, 0 for a new order, scoped to the tenant of ctx. Publishing
+// the same change again yields the same key, whereas any other change of the
+// order is based on another version.
+func orderEventKey(ctx context.Context, orderID, etag string) string {
+	if etag == "" {
+		etag = "0"
+	}
+	key := orderID + "@" + etag
+	if tenant := TenantFromContext(ctx); tenant != "" {
+		return tenant + "/" + key
+	}
+	return key
+}
+
+// eventOrderStatus returns the status the order event data leaves its order
+// in, false if data isn't an order event.
+func eventOrderStatus(data any) (OrderStatus, bool) {
+	switch event := data.(type) {
+	case *orderspb.OrderStatusChanged:
+		return statusFromProto(event.GetOrder().GetStatus()), true
+	case OrderCancelled:
+		return event.Status, true
+	case OrderRefunded:
+		return event.Status, true
+	}
+	return "", false
+}
+
+// ShipmentCreated is published in JSON on the shipments topic when an order
+// is shipped.
+type ShipmentCreated struct {
+	Shipment
+}
+
+func (ShipmentCreated) CloudEventType() string {
+	return cloudEventTypeShipmentCreated
+}
+
+// ShipmentStatusChanged is published in JSON on the shipments topic when the
+// tracking status of a shipment changes.
+type ShipmentStatusChanged struct {
+	Shipment
+	PreviousStatus ShipmentStatus `json:"previousStatus"`
+}
+
+func (ShipmentStatusChanged) CloudEventType() string {
+	return cloudEventTypeShipmentStatusChanged
+}
+
+// DecodeOrderStatusChanged decodes a protobuf encoded OrderStatusChanged
+// event and returns the order it carries.
+func DecodeOrderStatusChanged(data []byte) (Order, error) {
+	var event orderspb.OrderStatusChanged
+	if err := proto.Unmarshal(data, &event); err != nil {
+		return Order{}, fmt.Errorf("couldn't decode order event: %w", err)
+	}
+	if event.Order == nil {
+		return Order{}, fmt.Errorf("order event without order")
+	}
+	return orderFromProto(event.Order), nil
+}
+
+const (
+	// routeOrderEvents is where the sidecar delivers the events of the orders
+	// topic the app subscribes to.
+	routeOrderEvents = "/events/orders"
+	// routePriorityOrderEvents is where the sidecar delivers the events of
+	// the orders.priority topic, handled apart from the others.
+	routePriorityOrderEvents = "/events/orders/priority"
+	// routePaidOrderEvents and routeCancelledOrderEvents are where the
+	// sidecar routes the events of the orders topic paying or cancelling an
+	// order, the others being delivered to routeOrderEvents.
+	routePaidOrderEvents      = "/events/orders/paid"
+	routeCancelledOrderEvents = "/events/orders/cancelled"
+
+	// Statuses answered to the sidecar for the events it delivers, RETRY
+	// having it redeliver the event later.
+	eventStatusSuccess = "SUCCESS"
+	eventStatusRetry   = "RETRY"
+	eventStatusDrop    = "DROP"
+)
+
+// daprSubscription is a programmatic subscription, returned to the sidecar
+// on /dapr/subscribe. Its events are delivered to Route, unless it has
+// Routes.
+type daprSubscription struct {
+	PubsubName string      `json:"pubsubname"`
+	Topic      string      `json:"topic"`
+	Route      string      `json:"route,omitempty"`
+	Routes     *daprRoutes `json:"routes,omitempty"`
+}
+
+// daprRoutes routes every event of a subscription to the path of the first
+// rule it matches, or to Default if it matches none.
+type daprRoutes struct {
+	Rules   []daprRoutingRule `json:"rules"`
+	Default string            `json:"default"`
+}
+
+// daprRoutingRule matches the events whose CloudEvent satisfies the CEL
+// expression Match, in which the CloudEvent is event.
+type daprRoutingRule struct {
+	Match string `json:"match"`
+	Path  string `json:"path"`
+}
+
+// orderEventRoutes routes the events of the orders topic by type. Events
+// published before the orderstatus extension was introduced don't carry it,
+// hence the has macro: reading an attribute an event doesn't carry fails the
+// evaluation of the rule, rather than not matching it.
+var orderEventRoutes = &daprRoutes{
+	Rules: []daprRoutingRule{
+		{Match: fmt.Sprintf("event.type == %q", cloudEventTypeOrderCancelled), Path: routeCancelledOrderEvents},
+		{Match: fmt.Sprintf("has(event.%[1]s) && event.%[1]s == %[2]q", cloudEventStatusExtension, OrderStatusPaid), Path: routePaidOrderEvents},
+	},
+	Default: routeOrderEvents,
+}
+
+func (h *AppHandler) handleDaprSubscribe(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode([]daprSubscription{
+		{PubsubName: h.config.Pubsub.name(), Topic: h.config.Pubsub.topicName(topicOrders), Routes: orderEventRoutes},
+		{PubsubName: h.config.Pubsub.name(), Topic: topicOrdersPriority, Route: routePriorityOrderEvents},
+	})
+}
+
+// handleOrderEvent receives the events of the orders and orders.priority
+// topics from the sidecar on their default routes.
+func (h *AppHandler) handleOrderEvent(w http.ResponseWriter, r *http.Request) {
+	h.serveOrderEvent(w, r, decodeCloudEventOrder, nil)
+}
+
+// handlePaidOrderEvent receives the events of the orders topic paying an
+// order, and confirms the stock reserved for it.
+func (h *AppHandler) handlePaidOrderEvent(w http.ResponseWriter, r *http.Request) {
+	h.serveOrderEvent(w, r, decodeCloudEventOrder, func(ctx context.Context, order Order) error {
+		if order.Status != OrderStatusPaid {
+			return Permanent(fmt.Errorf("unexpected status %q of paid order %s", order.Status, order.ID))
+		}
+		if h.inventory == nil {
+			return nil
+		}
+		return h.inventory.Confirm(ctx, order)
+	})
+}
+
+// handleCancelledOrderEvent receives the OrderCancelled events of the orders
+// topic, and releases the stock reserved for their order.
+func (h *AppHandler) handleCancelledOrderEvent(w http.ResponseWriter, r *http.Request) {
+	h.serveOrderEvent(w, r, decodeCloudEventOrderCancelled, func(ctx context.Context, order Order) error {
+		if h.inventory == nil {
+			return nil
+		}
+		return h.inventory.Release(ctx, order)
+	})
+}
+
+// serveOrderEvent processes the event of the request, decoded by decode,
+// counting it by route. Its order is handed to settle, if set, then projected
+// into the stats of the orders and pushed to the WebSocket clients. Events
+// failing for good are quarantined rather than dropped, except the expired
+// ones, which are only late.
+func (h *AppHandler) serveOrderEvent(w http.ResponseWriter, r *http.Request, decode func(io.Reader) (Order, error), settle func(context.Context, Order) error) {
+	h.metrics.OrderEventsReceived.WithLabelValues(r.URL.Path).Inc()
+	var payload bytes.Buffer
+	status, err := processOrderEvent(io.TeeReader(r.Body, &payload), decode, func(order Order) error {
+		// the event is read in full by now, and tampered events are
+		// dropped rather than retried
+		if err := h.signer.Verify(payload.Bytes()); err != nil {
+			if errors.Is(err, ErrInvalidSignature) {
+				return Permanent(err)
+			}
+			return err
+		}
+		ctx := WithTenant(r.Context(), order.Tenant)
+		// the reservations are settled before the projection, which a
+		// retried event would count twice
+		if settle != nil {
+			if err := settle(ctx, order); err != nil {
+				return err
+			}
+		}
+		// events are projected into the stats of the tenant of their order
+		if h.stats != nil {
+			if err := h.stats.Project(ctx, order); err != nil {
+				return err
+			}
+		}
+		h.hub.Broadcast(order)
+		return nil
+	})
+	// the event is correlated with the request it was published for
+	ctx := r.Context()
+	if id := eventCorrelationID(payload.Bytes()); correlationIDPattern.MatchString(id) {
+		ctx = WithCorrelationID(ctx, id)
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "couldn't process order event", "status", status, "error", err)
+	}
+	if status == eventStatusDrop && h.quarantined != nil && !errors.Is(err, errEventExpired) {
+		status = h.quarantine(ctx, r.URL.Path, payload.Bytes(), err)
+	}
+	slog.DebugContext(ctx, "handled order event", "route", r.URL.Path, "status", status)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"status":%q}`, status)
+}
+
+// errEventExpired is returned for the events delivered past their expiration.
+var errEventExpired = errors.New("event expired")
+
+// processOrderEvent reads an event of the orders topic from body, hands the
+// order decode reads from it to deliver, and returns the status answered to the sidecar
+// along with the reason the event wasn't processed. Events which couldn't be
+// read or delivered are retried, whereas malformed events and events of
+// orders the app doesn't know of are dropped, as redelivering them wouldn't
+// make them valid, as are the events deliver refuses for good, see Permanent.
+// Expired events are dropped as well: the sidecar only
+// checks their expiration once, so that a delivery it retried may arrive
+// late, with a status the order moved on from.
+func processOrderEvent(body io.Reader, decode func(io.Reader) (Order, error), deliver func(Order) error) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(body, maxBodySize))
+	if err != nil {
+		return eventStatusRetry, fmt.Errorf("couldn't read event: %w", err)
+	}
+
+	var envelope struct {
+		Expiration time.Time `json:"expiration"`
+	}
+	if err := json.Unmarshal(data, &envelope); err == nil && !envelope.Expiration.IsZero() && time.Now().After(envelope.Expiration) {
+		return eventStatusDrop, fmt.Errorf("%w at %s", errEventExpired, envelope.Expiration)
+	}
+
+	order, err := decode(bytes.NewReader(data))
+	if err != nil {
+		return eventStatusDrop, fmt.Errorf("invalid order event: %w", err)
+	}
+	if !orderIDPattern.MatchString(order.ID) {
+		return eventStatusDrop, fmt.Errorf("unexpected order ID %q", order.ID)
+	}
+	if _, ok := orderTransitions[order.Status]; !ok || order.Status == "" {
+		return eventStatusDrop, fmt.Errorf("unknown status %q of order %s", order.Status, order.ID)
+	}
+
+	if err := deliver(order); err != nil {
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return eventStatusDrop, permanent.err
+		}
+		return eventStatusRetry, fmt.Errorf("couldn't deliver order event: %w", err)
+	}
+	return eventStatusSuccess, nil
+}
+
+// decodeCloudEventOrder returns the order carried by a CloudEvent of the
+// orders topic, either an OrderStatusChanged event in protobuf or Avro, or a
+// JSON order.
+func decodeCloudEventOrder(body io.Reader) (Order, error) {
+	var event struct {
+		DataContentType string          `json:"datacontenttype"`
+		Data            json.RawMessage `json:"data"`
+		DataBase64      string          `json:"data_base64"`
+	}
+	if err := json.NewDecoder(body).Decode(&event); err != nil {
+		return Order{}, err
+	}
+
+	var order Order
+	switch event.DataContentType {
+	case contentTypeProtobuf, contentTypeAvro:
+		data, err := base64.StdEncoding.DecodeString(event.DataBase64)
+		if err != nil {
+			return Order{}, err
+		}
+		decode := DecodeOrderStatusChanged
+		if event.DataContentType == contentTypeAvro {
+			decode = DecodeAvroOrderStatusChanged
+		}
+		if order, err = decode(data); err != nil {
+			return Order{}, err
+		}
+	default:
+		if err := json.Unmarshal(event.Data, &order); err != nil {
+			return Order{}, err
+		}
+	}
+
+	if order.ID == "" {
+		return Order{}, errors.New("order event without order ID")
+	}
+	return order, nil
+}
+
+// decodeCloudEventOrderCancelled returns the order cancelled by an
+// OrderCancelled CloudEvent, failing for any other event.
+func decodeCloudEventOrderCancelled(body io.Reader) (Order, error) {
+	var event struct {
+		Type string         `json:"type"`
+		Data OrderCancelled `json:"data"`
+	}
+	if err := json.NewDecoder(body).Decode(&event); err != nil {
+		return Order{}, err
+	}
+	if event.Type != cloudEventTypeOrderCancelled {
+		return Order{}, fmt.Errorf("unexpected event type %q", event.Type)
+	}
+	if event.Data.ID == "" {
+		return Order{}, errors.New("order event without order ID")
+	}
+	if event.Data.Status != OrderStatusCancelled {
+		return Order{}, fmt.Errorf("unexpected status %q of cancelled order %s", event.Data.Status, event.Data.ID)
+	}
+	return event.Data.Order, nil
+}
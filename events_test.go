@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProcessOrderEvent(t *testing.T) {
+	protobufEvent, err := newCloudEvent(context.Background(), ProtobufEncoder{}, topicOrders,
+		newOrderStatusChanged(Order{ID: "order-1234", Status: OrderStatusPaid}, OrderStatusPending, time.Now()))
+	if err != nil {
+		t.Fatalf("couldn't create event: %s", err)
+	}
+	protobufBody, err := json.Marshal(protobufEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errUnavailable := errors.New("unavailable")
+
+	tests := []struct {
+		name string
+		body io.Reader
+		// deliverErr is returned by the delivery of the order
+		deliverErr error
+		expected   string
+		// delivered is the order expected to be delivered, if any
+		delivered *Order
+	}{
+		{
+			name:      "json order",
+			body:      strings.NewReader(`{"datacontenttype":"application/json","data":{"id":"order-1234","status":"PAID"}}`),
+			expected:  eventStatusSuccess,
+			delivered: &Order{ID: "order-1234", Status: OrderStatusPaid},
+		},
+		{
+			name:      "protobuf event",
+			body:      bytes.NewReader(protobufBody),
+			expected:  eventStatusSuccess,
+			delivered: &Order{ID: "order-1234", Status: OrderStatusPaid},
+		},
+		{name: "malformed envelope", body: strings.NewReader(`{"data":`), expected: eventStatusDrop},
+		{name: "malformed data", body: strings.NewReader(`{"data":"PAID"}`), expected: eventStatusDrop},
+		{
+			name:     "malformed data_base64",
+			body:     strings.NewReader(`{"datacontenttype":"application/x-protobuf","data_base64":"%%%"}`),
+			expected: eventStatusDrop,
+		},
+		{name: "missing order ID", body: strings.NewReader(`{"data":{"status":"PAID"}}`), expected: eventStatusDrop},
+		{name: "unexpected order ID", body: strings.NewReader(`{"data":{"id":"order-1","status":"PAID"}}`), expected: eventStatusDrop},
+		{name: "unknown status", body: strings.NewReader(`{"data":{"id":"order-1234","status":"SHIPPED"}}`), expected: eventStatusDrop},
+		{name: "missing status", body: strings.NewReader(`{"data":{"id":"order-1234"}}`), expected: eventStatusDrop},
+		{name: "unreadable body", body: iotest.ErrReader(errUnavailable), expected: eventStatusRetry},
+		{
+			name:     "expired event",
+			body:     strings.NewReader(`{"expiration":"` + time.Now().Add(-time.Second).UTC().Format(time.RFC3339) + `","data":{"id":"order-1234","status":"PAID"}}`),
+			expected: eventStatusDrop,
+		},
+		{
+			name:      "unexpired event",
+			body:      strings.NewReader(`{"expiration":"` + time.Now().Add(time.Minute).UTC().Format(time.RFC3339) + `","data":{"id":"order-1234","status":"PAID"}}`),
+			expected:  eventStatusSuccess,
+			delivered: &Order{ID: "order-1234", Status: OrderStatusPaid},
+		},
+		{
+			name:       "failed delivery",
+			body:       strings.NewReader(`{"data":{"id":"order-1234","status":"PAID"}}`),
+			deliverErr: errUnavailable,
+			expected:   eventStatusRetry,
+			delivered:  &Order{ID: "order-1234", Status: OrderStatusPaid},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var delivered []Order
+			status, err := processOrderEvent(tt.body, decodeCloudEventOrder, func(order Order) error {
+				delivered = append(delivered, order)
+				return tt.deliverErr
+			})
+
+			if status != tt.expected {
+				t.Fatalf("expected status %s. Got %s (%v).", tt.expected, status, err)
+			}
+			if (err == nil) != (status == eventStatusSuccess) {
+				t.Fatalf("expected an error unless the event is processed. Got %v.", err)
+			}
+			var expected []Order
+			if tt.delivered != nil {
+				expected = []Order{*tt.delivered}
+			}
+			if !reflect.DeepEqual(delivered, expected) {
+				t.Fatalf("expected delivered orders %v. Got %v.", expected, delivered)
+			}
+		})
+	}
+}
+
+func TestOrderEventRouting(t *testing.T) {
+	tests := []struct {
+		name string
+		data any
+		// expectedType and expectedStatus are the attributes the events are
+		// routed on, the event being expected on expectedRoute
+		expectedType   string
+		expectedStatus any
+		expectedRoute  string
+		// expectedCalls are the reservation calls of the handler of the
+		// route
+		expectedCalls []string
+	}{
+		{
+			name:         "paid",
+			data:         newOrderStatusChanged(Order{ID: "order-1234", Status: OrderStatusPaid}, OrderStatusPending, time.Now()),
+			expectedType: "orders.v1.OrderStatusChanged", expectedStatus: OrderStatusPaid, expectedRoute: routePaidOrderEvents,
+			expectedCalls: []string{"confirm order-1234"},
+		},
+		{
+			name:         "cancelled",
+			data:         OrderCancelled{Order: Order{ID: "order-1234", Status: OrderStatusCancelled}, PreviousStatus: OrderStatusPending},
+			expectedType: cloudEventTypeOrderCancelled, expectedStatus: OrderStatusCancelled, expectedRoute: routeCancelledOrderEvents,
+			expectedCalls: []string{"release order-1234"},
+		},
+		{
+			name:         "pending",
+			data:         newOrderStatusChanged(Order{ID: "order-1234", Status: OrderStatusPending}, "", time.Now()),
+			expectedType: "orders.v1.OrderStatusChanged", expectedStatus: OrderStatusPending, expectedRoute: routeOrderEvents,
+		},
+		{
+			name:         "refunded",
+			data:         OrderRefunded{Order: Order{ID: "order-1234", Status: OrderStatusRefunded}},
+			expectedType: cloudEventTypeOrderRefunded, expectedStatus: OrderStatusRefunded, expectedRoute: routeOrderEvents,
+		},
+		{
+			name:         "untyped",
+			data:         Order{ID: "order-1234", Status: OrderStatusPaid},
+			expectedType: "com.dapr.event.sent", expectedRoute: routeOrderEvents,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := newCloudEvent(context.Background(), ProtobufEncoder{}, topicOrders, tt.data)
+			if err != nil {
+				t.Fatalf("couldn't create event: %s", err)
+			}
+			if event["type"] != tt.expectedType || event[cloudEventStatusExtension] != tt.expectedStatus {
+				t.Fatalf("expected a %s event with status %v. Got %v.", tt.expectedType, tt.expectedStatus, event)
+			}
+
+			// the route the rules give the event matches the attributes it
+			// carries
+			route := orderEventRoutes.Default
+			for _, rule := range orderEventRoutes.Rules {
+				if strings.Contains(rule.Match, fmt.Sprintf("%q", event["type"])) ||
+					(event[cloudEventStatusExtension] != nil && strings.Contains(rule.Match, fmt.Sprintf("%q", event[cloudEventStatusExtension]))) {
+					route = rule.Path
+					break
+				}
+			}
+			if route != tt.expectedRoute {
+				t.Fatalf("expected the event to be routed to %s. Got %s.", tt.expectedRoute, route)
+			}
+
+			h, server := newWebSocketServer(t)
+			inventory := &mockInventory{}
+			h.inventory = inventory
+			body, err := json.Marshal(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.Post(server.URL+route, contentTypeCloudEvents, bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("couldn't post event: %s", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+			}
+			if received := testutil.ToFloat64(h.metrics.OrderEventsReceived.WithLabelValues(route)); received != 1 {
+				t.Fatalf("expected the event to be counted on %s. Got %v.", route, received)
+			}
+			if !slices.Equal(inventory.calls, tt.expectedCalls) {
+				t.Fatalf("expected reservation calls %v. Got %v.", tt.expectedCalls, inventory.calls)
+			}
+		})
+	}
+}
+
+func TestSettleOrderEvents(t *testing.T) {
+	errUnavailable := errors.New("unavailable")
+
+	tests := []struct {
+		name         string
+		route        string
+		body         string
+		inventoryErr error
+		expected     string
+		// expectedCalls are the reservation calls of the handler
+		expectedCalls []string
+	}{
+		{
+			name:          "paid order",
+			route:         routePaidOrderEvents,
+			body:          `{"datacontenttype":"application/json","orderstatus":"PAID","data":{"id":"order-1234","status":"PAID"}}`,
+			expected:      eventStatusSuccess,
+			expectedCalls: []string{"confirm order-1234"},
+		},
+		{
+			name:     "paid route of an order not paid",
+			route:    routePaidOrderEvents,
+			body:     `{"datacontenttype":"application/json","data":{"id":"order-1234","status":"PENDING"}}`,
+			expected: eventStatusDrop,
+		},
+		{
+			name:          "reservation not confirmed",
+			route:         routePaidOrderEvents,
+			body:          `{"datacontenttype":"application/json","orderstatus":"PAID","data":{"id":"order-1234","status":"PAID"}}`,
+			inventoryErr:  errUnavailable,
+			expected:      eventStatusRetry,
+			expectedCalls: []string{"confirm order-1234"},
+		},
+		{
+			name:          "cancelled order",
+			route:         routeCancelledOrderEvents,
+			body:          `{"type":"order.cancelled","datacontenttype":"application/json","data":{"id":"order-1234","status":"CANCELLED","previousStatus":"PENDING"}}`,
+			expected:      eventStatusSuccess,
+			expectedCalls: []string{"release order-1234"},
+		},
+		{
+			name:     "cancelled route of another event",
+			route:    routeCancelledOrderEvents,
+			body:     `{"type":"order.refunded","datacontenttype":"application/json","data":{"id":"order-1234","status":"REFUNDED"}}`,
+			expected: eventStatusDrop,
+		},
+		{
+			name:     "cancelled event of an order not cancelled",
+			route:    routeCancelledOrderEvents,
+			body:     `{"type":"order.cancelled","datacontenttype":"application/json","data":{"id":"order-1234","status":"PAID"}}`,
+			expected: eventStatusDrop,
+		},
+		{
+			name:          "reservation not released",
+			route:         routeCancelledOrderEvents,
+			body:          `{"type":"order.cancelled","datacontenttype":"application/json","data":{"id":"order-1234","status":"CANCELLED"}}`,
+			inventoryErr:  errUnavailable,
+			expected:      eventStatusRetry,
+			expectedCalls: []string{"release order-1234"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, server := newWebSocketServer(t)
+			inventory := &mockInventory{err: tt.inventoryErr}
+			h.inventory = inventory
+
+			resp, err := http.Post(server.URL+tt.route, contentTypeCloudEvents, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("couldn't post event: %s", err)
+			}
+			defer resp.Body.Close()
+			var answer struct {
+				Status string `json:"status"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+				t.Fatalf("couldn't decode answer: %s", err)
+			}
+			if answer.Status != tt.expected {
+				t.Fatalf("expected status %s. Got %s.", tt.expected, answer.Status)
+			}
+			if !slices.Equal(inventory.calls, tt.expectedCalls) {
+				t.Fatalf("expected reservation calls %v. Got %v.", tt.expectedCalls, inventory.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Types of the events of the stream of an order, named after the order.
+const (
+	// orderEventPlaced carries the order, placed or placed again once
+	// deleted.
+	orderEventPlaced = "order.placed"
+	// orderEventStatusChanged carries the new status of the order.
+	orderEventStatusChanged = "order.status_changed"
+	// orderEventContentChanged carries the new line items, amount and
+	// customer of the order.
+	orderEventContentChanged = "order.content_changed"
+	orderEventDeleted        = "order.deleted"
+)
+
+type orderStatusData struct {
+	Status OrderStatus `json:"status"`
+}
+
+type orderContentData struct {
+	LineItems  []LineItem `json:"lineItems,omitempty"`
+	Amount     int64      `json:"amount,omitempty"`
+	Currency   string     `json:"currency,omitempty"`
+	CustomerID string     `json:"customerId,omitempty"`
+}
+
+// EventSourcedOrderRepository persists every change of an order as an event
+// appended to the stream of the order in an EventStore, the order being
+// derived by folding the events of its stream. The ETag of an order is the
+// version of its stream, so that a write based on a stale version is
+// rejected when appending.
+//
+// Every snapshotEvery events, the order is snapshotted along with the
+// events, so that only the events following the latest snapshot are folded.
+// Orders aren't snapshotted if snapshotEvery is 0.
+type EventSourcedOrderRepository struct {
+	events        *EventStore
+	snapshotEvery int
+}
+
+func NewEventSourcedOrderRepository(events *EventStore, snapshotEvery int) *EventSourcedOrderRepository {
+	return &EventSourcedOrderRepository{events: events, snapshotEvery: snapshotEvery}
+}
+
+// Get rehydrates the order id from its events, and returns it along with the
+// version of its stream as ETag.
+func (r *EventSourcedOrderRepository) Get(ctx context.Context, id string) (Order, string, error) {
+	order, version, err := r.load(ctx, id)
+	if err != nil {
+		return Order{}, "", err
+	}
+	if order == nil {
+		return Order{}, "", ErrOrderNotFound
+	}
+	return *order, strconv.Itoa(version), nil
+}
+
+// Save appends the changes from the current order to order to its stream,
+// only if the stream is still at the version etag. With an empty etag, the
+// changes are appended whatever the version, retrying if another writer
+// appended in the meantime.
+func (r *EventSourcedOrderRepository) Save(ctx context.Context, order Order, etag string) error {
+	return r.append(ctx, order.ID, etag, func(current *Order) ([]StreamEvent, error) {
+		return orderChanges(current, order)
+	})
+}
+
+// Delete appends the deletion of order id to its stream, only if the stream
+// is still at the version etag, or whatever its version if etag is empty.
+// The events of the order are kept.
+func (r *EventSourcedOrderRepository) Delete(ctx context.Context, id, etag string) error {
+	return r.append(ctx, id, etag, func(current *Order) ([]StreamEvent, error) {
+		if current == nil {
+			return nil, nil
+		}
+		return []StreamEvent{{Type: orderEventDeleted}}, nil
+	})
+}
+
+// append appends the events returned by changes for the current order id to
+// its stream, only if the order isn't stored for etagAbsent.
+func (r *EventSourcedOrderRepository) append(ctx context.Context, id, etag string, changes func(current *Order) ([]StreamEvent, error)) error {
+	expected := anyVersion
+	if etag != "" && etag != etagAbsent {
+		v, err := strconv.Atoi(etag)
+		if err != nil {
+			return fmt.Errorf("%w: %q isn't a version", ErrETagMismatch, etag)
+		}
+		expected = v
+	}
+
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: 10 * time.Millisecond, MaxDelay: 100 * time.Millisecond}
+	return policy.Do(ctx, func(ctx context.Context) error {
+		current, version, err := r.load(ctx, id)
+		if err != nil {
+			return Permanent(err)
+		}
+		if expected != anyVersion && version != expected || etag == etagAbsent && current != nil {
+			return Permanent(ErrETagMismatch)
+		}
+		events, err := changes(current)
+		if err != nil || len(events) == 0 {
+			return Permanent(err)
+		}
+
+		snapshot, err := r.snapshot(current, id, version, events)
+		if err != nil {
+			return Permanent(err)
+		}
+		_, err = r.events.AppendWithSnapshot(ctx, id, version, snapshot, events...)
+		switch {
+		case errors.Is(err, ErrVersionConflict) && expected != anyVersion:
+			return Permanent(fmt.Errorf("%w: %w", ErrETagMismatch, err))
+		case errors.Is(err, ErrVersionConflict):
+			// the changes are computed again from the new version
+			return err
+		case err != nil:
+			return Permanent(err)
+		}
+		return nil
+	}, nil)
+}
+
+// List returns limit orders sorted by ID, starting at offset, rehydrating
+// every order up to the end of the page from its events. Only the orders of
+// the tenant of ctx are listed when multi-tenancy is enabled, the streams
+// being scoped to it.
+func (r *EventSourcedOrderRepository) List(ctx context.Context, limit, offset int) (*OrderList, error) {
+	streams, err := r.events.Streams(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &OrderList{Items: []Order{}, Limit: limit, Offset: offset}
+	// deleted orders keep their stream, so the orders are counted as they
+	// are rehydrated
+	found := 0
+	for _, stream := range streams {
+		order, _, err := r.load(ctx, stream)
+		if err != nil {
+			return nil, err
+		}
+		if order == nil {
+			continue
+		}
+		if found == offset+limit {
+			next := offset + limit
+			list.NextOffset = &next
+			break
+		}
+		if found >= offset {
+			list.Items = append(list.Items, *order)
+		}
+		found++
+	}
+	return list, nil
+}
+
+// snapshot returns the snapshot of current once events appended to its
+// stream at version, nil unless the events reach the next multiple of
+// snapshotEvery.
+func (r *EventSourcedOrderRepository) snapshot(current *Order, id string, version int, events []StreamEvent) (json.RawMessage, error) {
+	if r.snapshotEvery <= 0 || (version+len(events))/r.snapshotEvery == version/r.snapshotEvery {
+		return nil, nil
+	}
+	order := current
+	for i, event := range events {
+		event.Stream, event.Version = id, version+i+1
+		var err error
+		if order, err = applyOrderEvent(order, event); err != nil {
+			return nil, err
+		}
+	}
+	// a deleted order is snapshotted as null
+	return json.Marshal(order)
+}
+
+// load rehydrates the order id from its latest snapshot and the events
+// following it, nil if it has none or was deleted, and returns it along with
+// the version of its stream.
+func (r *EventSourcedOrderRepository) load(ctx context.Context, id string) (*Order, int, error) {
+	var order *Order
+	after := 0
+	snapshot, err := r.events.Snapshot(ctx, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if snapshot != nil {
+		if err := json.Unmarshal(snapshot.Data, &order); err != nil {
+			return nil, 0, fmt.Errorf("couldn't decode snapshot of %s: %w", id, err)
+		}
+		after = snapshot.Version
+	}
+
+	events, version, err := r.events.Load(ctx, id, after)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, event := range events {
+		if order, err = applyOrderEvent(order, event); err != nil {
+			return nil, 0, err
+		}
+	}
+	return order, version, nil
+}
+
+// applyOrderEvent returns order once event applied to it.
+func applyOrderEvent(order *Order, event StreamEvent) (*Order, error) {
+	switch event.Type {
+	case orderEventPlaced:
+		var placed Order
+		if err := json.Unmarshal(event.Data, &placed); err != nil {
+			return nil, fmt.Errorf("couldn't decode event %d of %s: %w", event.Version, event.Stream, err)
+		}
+		return &placed, nil
+	case orderEventDeleted:
+		return nil, nil
+	}
+
+	if order == nil {
+		return nil, fmt.Errorf("event %d of %s is a %s of no order", event.Version, event.Stream, event.Type)
+	}
+	updated := *order
+	switch event.Type {
+	case orderEventStatusChanged:
+		var data orderStatusData
+		if err := json.Unmarshal(event.Data, &data); err != nil {
+			return nil, fmt.Errorf("couldn't decode event %d of %s: %w", event.Version, event.Stream, err)
+		}
+		updated.Status = data.Status
+	case orderEventContentChanged:
+		var data orderContentData
+		if err := json.Unmarshal(event.Data, &data); err != nil {
+			return nil, fmt.Errorf("couldn't decode event %d of %s: %w", event.Version, event.Stream, err)
+		}
+		updated.LineItems, updated.Amount, updated.Currency, updated.CustomerID = data.LineItems, data.Amount, data.Currency, data.CustomerID
+	default:
+		return nil, fmt.Errorf("unknown event %s of %s", event.Type, event.Stream)
+	}
+	return &updated, nil
+}
+
+// orderChanges returns the events changing current, nil if there is no such
+// order, to order.
+func orderChanges(current *Order, order Order) ([]StreamEvent, error) {
+	if current == nil {
+		return newStreamEvents(orderEventPlaced, order)
+	}
+
+	var events []StreamEvent
+	if current.Status != order.Status {
+		changed, err := newStreamEvents(orderEventStatusChanged, orderStatusData{Status: order.Status})
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, changed...)
+	}
+	if !sameContent(*current, order) {
+		changed, err := newStreamEvents(orderEventContentChanged, orderContentData{
+			LineItems:  order.LineItems,
+			Amount:     order.Amount,
+			Currency:   order.Currency,
+			CustomerID: order.CustomerID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, changed...)
+	}
+	return events, nil
+}
+
+// newStreamEvents returns a single event of type eventType carrying data.
+func newStreamEvents(eventType string, data any) ([]StreamEvent, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return []StreamEvent{{Type: eventType, Data: encoded}}, nil
+}
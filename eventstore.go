@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	eventStoreName = "order-events"
+
+	// anyVersion appends to a stream whatever its version.
+	anyVersion = -1
+	// streamsKey is the key of the sorted names of the streams.
+	streamsKey = "streams"
+)
+
+// ErrVersionConflict is returned when appending to a stream which isn't at
+// the expected version, another writer having appended to it in the
+// meantime.
+var ErrVersionConflict = errors.New("version conflict")
+
+// StreamEvent is an event of a stream. Its version, the position of the event
+// in the stream starting at 1, and the time it was recorded at are set when
+// it is appended.
+type StreamEvent struct {
+	Stream     string          `json:"stream"`
+	Version    int             `json:"version"`
+	Type       string          `json:"type"`
+	Data       json.RawMessage `json:"data,omitempty"`
+	RecordedAt time.Time       `json:"recordedAt"`
+}
+
+// streamHead is the version of a stream, the number of its events.
+type streamHead struct {
+	Version int `json:"version"`
+}
+
+// StreamSnapshot is the state a stream folds into as of its version, so that
+// only the events following it have to be folded.
+type StreamSnapshot struct {
+	Stream     string          `json:"stream"`
+	Version    int             `json:"version"`
+	Data       json.RawMessage `json:"data"`
+	RecordedAt time.Time       `json:"recordedAt"`
+}
+
+func eventKey(stream string, version int) string {
+	return stream + "-event-" + strconv.Itoa(version)
+}
+
+func snapshotKey(stream string) string {
+	return stream + "-snapshot"
+}
+
+// EventStore persists streams of events in the Dapr state store. Events are
+// never modified once appended: each is stored under a key of its own, next
+// to the head of its stream holding its version. An append writes its events
+// and the new head in a single transaction, conditioned on the ETag of the
+// head, so that concurrent appends to a stream can't both succeed. The store
+// must thus support transactions. A snapshot of a stream may be written along
+// with an append, under a key of its own too. Keys are scoped to the tenant
+// of the context.
+type EventStore struct {
+	client    dapr.Client
+	storeName string
+}
+
+func NewEventStore(client dapr.Client) *EventStore {
+	return &EventStore{
+		client:    client,
+		storeName: eventStoreName,
+	}
+}
+
+// Check reads the event store, for the health checks.
+func (s *EventStore) Check(ctx context.Context) error {
+	_, err := s.client.GetState(ctx, s.storeName, healthProbeKey, nil)
+	return err
+}
+
+// Version returns the version of stream, 0 if it has no events, along with
+// the ETag of its head.
+func (s *EventStore) Version(ctx context.Context, stream string) (int, string, error) {
+	item, err := s.client.GetState(ctx, s.storeName, tenantKey(ctx, stream), nil)
+	if err != nil {
+		return 0, "", err
+	}
+	if item == nil || len(item.Value) == 0 {
+		return 0, "", nil
+	}
+	var head streamHead
+	if err := json.Unmarshal(item.Value, &head); err != nil {
+		return 0, "", fmt.Errorf("couldn't decode head of %s: %w", stream, err)
+	}
+	return head.Version, item.Etag, nil
+}
+
+// Load returns the events of stream following the version after, in order,
+// along with the version of the stream.
+func (s *EventStore) Load(ctx context.Context, stream string, after int) ([]StreamEvent, int, error) {
+	version, _, err := s.Version(ctx, stream)
+	if err != nil {
+		return nil, 0, err
+	}
+	if version <= after {
+		return nil, version, nil
+	}
+
+	keys := make([]string, 0, version-after)
+	for v := after + 1; v <= version; v++ {
+		keys = append(keys, tenantKey(ctx, eventKey(stream, v)))
+	}
+	items, err := s.client.GetBulkState(ctx, s.storeName, keys, nil, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	events := make([]StreamEvent, 0, len(items))
+	for _, item := range items {
+		if item.Error != "" {
+			return nil, 0, fmt.Errorf("couldn't get event %s: %s", item.Key, item.Error)
+		}
+		if len(item.Value) == 0 {
+			return nil, 0, fmt.Errorf("missing event %s", item.Key)
+		}
+		var event StreamEvent
+		if err := json.Unmarshal(item.Value, &event); err != nil {
+			return nil, 0, fmt.Errorf("couldn't decode event %s: %w", item.Key, err)
+		}
+		events = append(events, event)
+	}
+	// bulk reads answer in any order
+	slices.SortFunc(events, func(a, b StreamEvent) int { return a.Version - b.Version })
+	return events, version, nil
+}
+
+// Append appends events to stream if it is at the version expected, or
+// whatever its version with anyVersion, and returns the new version of the
+// stream. ErrVersionConflict is returned if the stream is at another version
+// or was appended to concurrently, and nothing is appended.
+func (s *EventStore) Append(ctx context.Context, stream string, expected int, events ...StreamEvent) (int, error) {
+	return s.append(ctx, stream, expected, nil, events)
+}
+
+// AppendWithSnapshot appends events to stream like Append, replacing the
+// snapshot of the stream with snapshot, the state the stream folds into once
+// the events appended, in the same transaction.
+func (s *EventStore) AppendWithSnapshot(ctx context.Context, stream string, expected int, snapshot json.RawMessage, events ...StreamEvent) (int, error) {
+	return s.append(ctx, stream, expected, snapshot, events)
+}
+
+func (s *EventStore) append(ctx context.Context, stream string, expected int, snapshot json.RawMessage, events []StreamEvent) (int, error) {
+	version, etag, err := s.Version(ctx, stream)
+	if err != nil {
+		return 0, err
+	}
+	if expected != anyVersion && version != expected {
+		return 0, fmt.Errorf("%w: %s is at version %d, not %d", ErrVersionConflict, stream, version, expected)
+	}
+
+	now := time.Now().UTC()
+	ops := make([]*dapr.StateOperation, 0, len(events)+3)
+	for i, event := range events {
+		event.Stream, event.Version, event.RecordedAt = stream, version+i+1, now
+		data, err := json.Marshal(event)
+		if err != nil {
+			return 0, err
+		}
+		ops = append(ops, upsertOperation(tenantKey(ctx, eventKey(stream, event.Version)), data, ""))
+	}
+	head, err := json.Marshal(streamHead{Version: version + len(events)})
+	if err != nil {
+		return 0, err
+	}
+	ops = append(ops, upsertOperation(tenantKey(ctx, stream), head, etag))
+
+	if snapshot != nil {
+		data, err := json.Marshal(StreamSnapshot{Stream: stream, Version: version + len(events), Data: snapshot, RecordedAt: now})
+		if err != nil {
+			return 0, err
+		}
+		// the head guards the snapshot, which is replaced whatever its ETag
+		op := upsertOperation(tenantKey(ctx, snapshotKey(stream)), data, "")
+		op.Item.Options.Concurrency = dapr.StateConcurrencyLastWrite
+		ops = append(ops, op)
+	}
+
+	// new streams are added to the list of the streams in the same
+	// transaction, whose ETag guards their creation as they have no head yet
+	if version == 0 {
+		streams, etag, err := s.streams(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if i, found := slices.BinarySearch(streams, stream); !found {
+			data, err := json.Marshal(slices.Insert(streams, i, stream))
+			if err != nil {
+				return 0, err
+			}
+			ops = append(ops, upsertOperation(tenantKey(ctx, streamsKey), data, etag))
+		}
+	}
+
+	err = s.client.ExecuteStateTransaction(ctx, s.storeName, nil, ops)
+	// the sidecar answers Aborted on mismatch and InvalidArgument when the
+	// ETag isn't one the store could have produced
+	if code := status.Code(err); code == codes.Aborted || code == codes.InvalidArgument {
+		return 0, fmt.Errorf("%w: %w", ErrVersionConflict, err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return version + len(events), nil
+}
+
+// Snapshot returns the latest snapshot of stream, nil if it has none.
+func (s *EventStore) Snapshot(ctx context.Context, stream string) (*StreamSnapshot, error) {
+	item, err := s.client.GetState(ctx, s.storeName, tenantKey(ctx, snapshotKey(stream)), nil)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil || len(item.Value) == 0 {
+		return nil, nil
+	}
+	var snapshot StreamSnapshot
+	if err := json.Unmarshal(item.Value, &snapshot); err != nil {
+		return nil, fmt.Errorf("couldn't decode snapshot of %s: %w", stream, err)
+	}
+	return &snapshot, nil
+}
+
+// Streams returns the sorted names of the streams.
+func (s *EventStore) Streams(ctx context.Context) ([]string, error) {
+	streams, _, err := s.streams(ctx)
+	return streams, err
+}
+
+func (s *EventStore) streams(ctx context.Context) ([]string, string, error) {
+	item, err := s.client.GetState(ctx, s.storeName, tenantKey(ctx, streamsKey), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	streams := []string{}
+	if item == nil {
+		return streams, "", nil
+	}
+	if len(item.Value) > 0 {
+		if err := json.Unmarshal(item.Value, &streams); err != nil {
+			return nil, "", fmt.Errorf("couldn't decode streams: %w", err)
+		}
+	}
+	return streams, item.Etag, nil
+}
+
+// upsertOperation writes data under key, only if the stored version still
+// matches etag unless it is empty.
+func upsertOperation(key string, data []byte, etag string) *dapr.StateOperation {
+	item := &dapr.SetStateItem{
+		Key:      key,
+		Value:    data,
+		Metadata: map[string]string{"contentType": "application/json"},
+		Options:  &dapr.StateOptions{Concurrency: dapr.StateConcurrencyFirstWrite},
+	}
+	if etag != "" {
+		item.Etag = &dapr.ETag{Value: etag}
+	}
+	return &dapr.StateOperation{Type: dapr.StateOperationTypeUpsert, Item: item}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestEventStoreAppend(t *testing.T) {
+	ctx := context.Background()
+	events := NewEventStore(&fakeDaprClient{})
+
+	version, err := events.Append(ctx, "order-1234", 0, StreamEvent{Type: "a"}, StreamEvent{Type: "b"})
+	if err != nil || version != 2 {
+		t.Fatalf("expected version 2. Got %d: %v", version, err)
+	}
+	if version, err = events.Append(ctx, "order-1234", anyVersion, StreamEvent{Type: "c"}); err != nil || version != 3 {
+		t.Fatalf("expected version 3. Got %d: %v", version, err)
+	}
+
+	// the stream moved on since version 2
+	if _, err := events.Append(ctx, "order-1234", 2, StreamEvent{Type: "d"}); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("expected error %q. Got %v.", ErrVersionConflict, err)
+	}
+
+	loaded, version, err := events.Load(ctx, "order-1234", 1)
+	if err != nil {
+		t.Fatalf("couldn't load stream: %s", err)
+	}
+	if version != 3 || len(loaded) != 2 || loaded[0].Type != "b" || loaded[0].Version != 2 || loaded[1].Type != "c" || loaded[1].Version != 3 {
+		t.Fatalf("expected events b and c at version 3. Got %+v at version %d.", loaded, version)
+	}
+
+	if _, err := events.Append(ctx, "order-0001", 0, StreamEvent{Type: "a"}); err != nil {
+		t.Fatalf("couldn't append to stream: %s", err)
+	}
+	streams, err := events.Streams(ctx)
+	if err != nil {
+		t.Fatalf("couldn't list streams: %s", err)
+	}
+	if len(streams) != 2 || streams[0] != "order-0001" || streams[1] != "order-1234" {
+		t.Fatalf("expected streams order-0001 and order-1234. Got %v.", streams)
+	}
+}
+
+func TestEventSourcedOrderRepository(t *testing.T) {
+	ctx := context.Background()
+	events := NewEventStore(&fakeDaprClient{})
+	store := NewEventSourcedOrderRepository(events, 0)
+
+	if err := store.Save(ctx, Order{ID: "order-1234", Status: OrderStatusPending}, ""); err != nil {
+		t.Fatalf("couldn't save order: %s", err)
+	}
+	// saving the order unchanged appends nothing
+	if err := store.Save(ctx, Order{ID: "order-1234", Status: OrderStatusPending}, ""); err != nil {
+		t.Fatalf("couldn't save order: %s", err)
+	}
+	updated := Order{ID: "order-1234", Status: OrderStatusPaid, LineItems: []LineItem{{SKU: "sku-1", Quantity: 2}}}
+	if err := store.Save(ctx, updated, "1"); err != nil {
+		t.Fatalf("couldn't save order: %s", err)
+	}
+	if err := store.Delete(ctx, "order-1234", "3"); err != nil {
+		t.Fatalf("couldn't delete order: %s", err)
+	}
+
+	loaded, version, err := events.Load(ctx, "order-1234", 0)
+	if err != nil {
+		t.Fatalf("couldn't load stream: %s", err)
+	}
+	expected := []string{orderEventPlaced, orderEventStatusChanged, orderEventContentChanged, orderEventDeleted}
+	if version != len(expected) {
+		t.Fatalf("expected version %d. Got %d.", len(expected), version)
+	}
+	for i, event := range loaded {
+		if event.Type != expected[i] {
+			t.Fatalf("expected events %v. Got %+v.", expected, loaded)
+		}
+	}
+
+	// the order is rehydrated as of any version
+	var order *Order
+	for _, event := range loaded[:3] {
+		if order, err = applyOrderEvent(order, event); err != nil {
+			t.Fatalf("couldn't apply event: %s", err)
+		}
+	}
+	if order.Status != OrderStatusPaid || len(order.LineItems) != 1 || order.LineItems[0].Quantity != 2 {
+		t.Fatalf("expected order %+v. Got %+v.", updated, order)
+	}
+
+	if err := store.Save(ctx, Order{ID: "order-1234"}, "not-a-version"); !errors.Is(err, ErrETagMismatch) {
+		t.Fatalf("expected error %q. Got %v.", ErrETagMismatch, err)
+	}
+}
+
+func TestEventSourcedOrderSnapshots(t *testing.T) {
+	ctx := context.Background()
+	client := &fakeDaprClient{}
+	events := NewEventStore(client)
+	store := NewEventSourcedOrderRepository(events, 2)
+
+	for _, order := range []Order{
+		{ID: "order-1234", Status: OrderStatusPending},
+		{ID: "order-1234", Status: OrderStatusPaid},
+		{ID: "order-1234", Status: OrderStatusPaid, LineItems: []LineItem{{SKU: "sku-1", Quantity: 2}}},
+	} {
+		if err := store.Save(ctx, order, ""); err != nil {
+			t.Fatalf("couldn't save order: %s", err)
+		}
+	}
+
+	snapshot, err := events.Snapshot(ctx, "order-1234")
+	if err != nil {
+		t.Fatalf("couldn't get snapshot: %s", err)
+	}
+	if snapshot == nil || snapshot.Version != 2 {
+		t.Fatalf("expected a snapshot at version 2. Got %+v.", snapshot)
+	}
+
+	// only the events following the snapshot are folded
+	for _, version := range []int{1, 2} {
+		if err := client.DeleteState(ctx, eventStoreName, eventKey("order-1234", version), nil); err != nil {
+			t.Fatalf("couldn't delete event: %s", err)
+		}
+	}
+	order, etag, err := store.Get(ctx, "order-1234")
+	if err != nil {
+		t.Fatalf("couldn't get order: %s", err)
+	}
+	if etag != "3" || order.Status != OrderStatusPaid || len(order.LineItems) != 1 {
+		t.Fatalf("expected the paid order with its line item at version 3. Got %+v at version %s.", order, etag)
+	}
+
+	// a deleted order is snapshotted too
+	if err := store.Delete(ctx, "order-1234", etag); err != nil {
+		t.Fatalf("couldn't delete order: %s", err)
+	}
+	if snapshot, err = events.Snapshot(ctx, "order-1234"); err != nil || snapshot.Version != 4 || string(snapshot.Data) != "null" {
+		t.Fatalf("expected a null snapshot at version 4. Got %+v: %v", snapshot, err)
+	}
+	if _, _, err := store.Get(ctx, "order-1234"); !errors.Is(err, ErrOrderNotFound) {
+		t.Fatalf("expected error %q. Got %v.", ErrOrderNotFound, err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+)
+
+const (
+	// flagPriorityTopics publishes the expedited status changes to the
+	// priority topic, instead of the orders topic.
+	flagPriorityTopics = "priority-topics"
+	// flagBatchUpdates serves the batch updates of the orders.
+	flagBatchUpdates = "batch-updates"
+)
+
+// defaultFeatureFlags are the flags of the app, and their value until the
+// configuration store sets them.
+var defaultFeatureFlags = map[string]bool{
+	flagPriorityTopics: true,
+	flagBatchUpdates:   true,
+}
+
+// sidecarReadRetry spaces the attempts to read the feature flags and the
+// credentials while the sidecar or the store is unavailable.
+var sidecarReadRetry = RetryPolicy{BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+
+// FeatureFlags holds the flags gating the behaviors of the app, kept up to
+// date with the keys of a Dapr configuration store, so that they are toggled
+// without a redeploy. A nil FeatureFlags has every flag at its default.
+type FeatureFlags struct {
+	client  dapr.Client
+	store   string
+	metrics *Metrics
+
+	mu     sync.RWMutex
+	values map[string]bool
+}
+
+func NewFeatureFlags(client dapr.Client, store string, metrics *Metrics) *FeatureFlags {
+	f := &FeatureFlags{
+		client:  client,
+		store:   store,
+		metrics: metrics,
+		values:  maps.Clone(defaultFeatureFlags),
+	}
+	for name, enabled := range f.values {
+		f.setMetric(name, enabled)
+	}
+	return f
+}
+
+// Enabled reports whether the flag name is on.
+func (f *FeatureFlags) Enabled(name string) bool {
+	if f == nil {
+		return defaultFeatureFlags[name]
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.values[name]
+}
+
+// Values returns the value of every flag.
+func (f *FeatureFlags) Values() map[string]bool {
+	if f == nil {
+		return maps.Clone(defaultFeatureFlags)
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return maps.Clone(f.values)
+}
+
+// Watch reads the flags from the configuration store and subscribes to their
+// changes, until ctx is done. It tries again while the sidecar or the store
+// is unavailable, the flags keeping their value meanwhile.
+func (f *FeatureFlags) Watch(ctx context.Context) {
+	for attempt := 1; ; attempt++ {
+		err := f.subscribe(ctx)
+		if err == nil {
+			return
+		}
+		slog.Warn("couldn't read feature flags", "store", f.store, "attempt", attempt, "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(sidecarReadRetry.Backoff(attempt)):
+		}
+	}
+}
+
+func (f *FeatureFlags) subscribe(ctx context.Context) error {
+	keys := make([]string, 0, len(defaultFeatureFlags))
+	for name := range defaultFeatureFlags {
+		keys = append(keys, name)
+	}
+	slices.Sort(keys)
+	// reading the keys first fails on a missing store, which the
+	// subscription would wait on forever
+	items, err := f.client.GetConfigurationItems(ctx, f.store, keys)
+	if err != nil {
+		return err
+	}
+	f.update(items)
+
+	// the subscription ends with ctx
+	_, err = f.client.SubscribeConfigurationItems(ctx, f.store, keys, func(_ string, items map[string]*dapr.ConfigurationItem) {
+		f.update(items)
+	})
+	return err
+}
+
+// update applies the items of the configuration store to the flags. A key
+// removed from the store sets its flag back to its default, and an invalid
+// value is ignored.
+func (f *FeatureFlags) update(items map[string]*dapr.ConfigurationItem) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name, item := range items {
+		def, ok := defaultFeatureFlags[name]
+		if !ok || item == nil {
+			continue
+		}
+		enabled := def
+		if item.Value != "" {
+			var err error
+			if enabled, err = strconv.ParseBool(strings.TrimSpace(item.Value)); err != nil {
+				slog.Warn("ignoring invalid feature flag", "flag", name, "value", item.Value, "error", err)
+				continue
+			}
+		}
+		if enabled != f.values[name] {
+			slog.Info("feature flag changed", "flag", name, "enabled", enabled, "version", item.Version)
+		}
+		f.values[name] = enabled
+		f.setMetric(name, enabled)
+	}
+}
+
+func (f *FeatureFlags) setMetric(name string, enabled bool) {
+	value := 0.0
+	if enabled {
+		value = 1
+	}
+	f.metrics.FeatureFlags.WithLabelValues(name).Set(value)
+}
+
+// featureFlagged serves the requests with next while the flag name is on,
+// and answers them as an unknown route otherwise.
+func (h *AppHandler) featureFlagged(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.flags.Enabled(name) {
+			http.NotFound(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleFeatureFlagsGet answers with the value of every flag.
+func (h *AppHandler) handleFeatureFlagsGet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(h.flags.Values()); err != nil {
+		slog.ErrorContext(r.Context(), "couldn't encode feature flags", "error", err)
+	}
+}
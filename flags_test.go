@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFeatureFlagsWatch(t *testing.T) {
+	client := &fakeDaprClient{configuration: map[string]*dapr.ConfigurationItem{
+		flagPriorityTopics: {Value: "false", Version: "1"},
+		"unknown-flag":     {Value: "true"},
+	}}
+	metrics := NewMetrics()
+	flags := NewFeatureFlags(client, "feature-flags", metrics)
+	flags.Watch(context.Background())
+
+	if flags.Enabled(flagPriorityTopics) || !flags.Enabled(flagBatchUpdates) {
+		t.Fatalf("expected the flags of the store over their default. Got %v.", flags.Values())
+	}
+	if got := testutil.ToFloat64(metrics.FeatureFlags.WithLabelValues(flagPriorityTopics)); got != 0 {
+		t.Fatalf("expected the metric of %s to be 0. Got %f.", flagPriorityTopics, got)
+	}
+
+	// the changes are pushed by the subscription
+	tests := []struct {
+		name     string
+		value    string
+		expected bool
+	}{
+		{name: "enabled", value: "true", expected: true},
+		{name: "disabled", value: "0", expected: false},
+		{name: "invalid value", value: "maybe", expected: false},
+		{name: "removed", value: "", expected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client.configurationHandler("subscription-1", map[string]*dapr.ConfigurationItem{flagPriorityTopics: {Value: tt.value}})
+			if got := flags.Enabled(flagPriorityTopics); got != tt.expected {
+				t.Fatalf("expected %s to be %t. Got %t.", flagPriorityTopics, tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestFeatureFlagsWatchUnavailable(t *testing.T) {
+	client := &fakeDaprClient{configurationErr: errors.New("configuration store feature-flags not found")}
+	flags := NewFeatureFlags(client, "feature-flags", NewMetrics())
+
+	// the attempts stop with ctx, the flags keeping their default
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	flags.Watch(ctx)
+	if !flags.Enabled(flagPriorityTopics) || !flags.Enabled(flagBatchUpdates) {
+		t.Fatalf("expected the flags at their default. Got %v.", flags.Values())
+	}
+	if nilFlags := (*FeatureFlags)(nil); !nilFlags.Enabled(flagPriorityTopics) {
+		t.Fatalf("expected the flags of no store at their default. Got %v.", nilFlags.Values())
+	}
+}
+
+func TestFeatureFlagged(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		disabled string
+		// expected is the status code of the answer, and expectedTopic the
+		// topic the status change is published to
+		expected      int
+		expectedTopic string
+	}{
+		{name: "priority topics", path: "/orders/order-1111", body: `{"status":"PAID"}`, expected: http.StatusOK, expectedTopic: topicOrdersPriority},
+		{name: "priority topics off", path: "/orders/order-1111", body: `{"status":"PAID"}`, disabled: flagPriorityTopics, expected: http.StatusOK, expectedTopic: topicOrders},
+		{name: "batch updates", path: "/orders", body: `[{"id":"order-1111","status":"PAID"}]`, expected: http.StatusOK, expectedTopic: topicOrdersPriority},
+		{name: "batch updates off", path: "/orders", body: `[{"id":"order-1111","status":"PAID"}]`, disabled: flagBatchUpdates, expected: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := &mockPublisher{}
+			store := newMockOrderRepository()
+			if err := store.Save(context.Background(), Order{ID: "order-1111", Status: OrderStatusPending}, ""); err != nil {
+				t.Fatalf("couldn't save order: %s", err)
+			}
+			h := newMockHandler(publisher, store)
+			h.flags = NewFeatureFlags(&fakeDaprClient{}, "feature-flags", h.metrics)
+			if tt.disabled != "" {
+				h.flags.update(map[string]*dapr.ConfigurationItem{tt.disabled: {Value: "false"}})
+			}
+			h.RegisterRoutes()
+
+			req := httptest.NewRequest(http.MethodPut, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", contentTypeJSON)
+			req.Header.Set(headerOrderPriority, priorityExpedited)
+			rec := httptest.NewRecorder()
+			h.router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.expected {
+				t.Fatalf("expected status code %d. Got %d: %s", tt.expected, rec.Code, rec.Body)
+			}
+			if tt.expectedTopic == "" {
+				if len(publisher.events) != 0 {
+					t.Fatalf("expected no event. Got %v.", publisher.events)
+				}
+				return
+			}
+			if len(publisher.events) != 1 || publisher.events[0].topic != tt.expectedTopic {
+				t.Fatalf("expected an event on %s. Got %v.", tt.expectedTopic, publisher.events)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/etiennetremel/testcontainers-dapr-example/orderspb"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of testdata/golden with the actual results")
+
+// goldenDir holds the golden files.
+const goldenDir = "./testdata/golden"
+
+// volatileAttributes are the CloudEvent attributes which change with every
+// event, replaced with a placeholder by normalizeCloudEvent.
+var volatileAttributes = []string{"id", "time", "traceid", "traceparent", "tracestate", cloudEventCorrelationExtension}
+
+// normalizeCloudEvent returns the envelope of a CloudEvent, indented and with
+// its volatile attributes replaced with placeholders, so that it can be
+// compared with a golden file. A protobuf payload in data_base64 is replaced
+// with the decoded message, whose changedAt is replaced as well.
+func normalizeCloudEvent(envelope []byte) ([]byte, error) {
+	var event map[string]any
+	if err := json.Unmarshal(envelope, &event); err != nil {
+		return nil, fmt.Errorf("couldn't decode CloudEvent: %w", err)
+	}
+	for _, attr := range volatileAttributes {
+		if _, ok := event[attr]; ok {
+			event[attr] = "<" + attr + ">"
+		}
+	}
+
+	if encoded, ok := event["data_base64"].(string); ok && event["datacontenttype"] == contentTypeProtobuf {
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode data_base64: %w", err)
+		}
+		var msg orderspb.OrderStatusChanged
+		if err := proto.Unmarshal(data, &msg); err != nil {
+			return nil, fmt.Errorf("couldn't decode payload: %w", err)
+		}
+		// protojson varies its output on purpose, so it is decoded again
+		// to be rendered as the rest of the envelope
+		js, err := protojson.Marshal(&msg)
+		if err != nil {
+			return nil, err
+		}
+		var decoded map[string]any
+		if err := json.Unmarshal(js, &decoded); err != nil {
+			return nil, err
+		}
+		if _, ok := decoded["changedAt"]; ok {
+			decoded["changedAt"] = "<changedAt>"
+		}
+		event["data_base64"] = decoded
+	}
+
+	// the placeholders are kept readable in the golden files
+	var normalized bytes.Buffer
+	enc := json.NewEncoder(&normalized)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(event); err != nil {
+		return nil, err
+	}
+	return normalized.Bytes(), nil
+}
+
+// assertGolden compares actual with the golden file name, or rewrites it
+// with -update.
+func assertGolden(t *testing.T, name string, actual []byte) {
+	t.Helper()
+
+	path := filepath.Join(goldenDir, name)
+	if *updateGolden {
+		if err := os.MkdirAll(goldenDir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, actual, 0o644); err != nil {
+			t.Fatalf("couldn't update golden file: %s", err)
+		}
+		return
+	}
+
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("couldn't read golden file, run with -update to create it: %s", err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Fatalf("%s doesn't match, run with -update if the change is intended.\nExpected:\n%s\nGot:\n%s", path, expected, actual)
+	}
+}
+
+func TestNormalizeCloudEvent(t *testing.T) {
+	msg, err := proto.Marshal(&orderspb.OrderStatusChanged{
+		Order:          &orderspb.Order{Id: "order-1234", Status: orderspb.OrderStatus_ORDER_STATUS_PAID},
+		PreviousStatus: orderspb.OrderStatus_ORDER_STATUS_PENDING,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope := fmt.Sprintf(`{"id":"5d1c2b3a","specversion":"1.0","traceid":"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01","datacontenttype":%q,"data_base64":%q}`,
+		contentTypeProtobuf, base64.StdEncoding.EncodeToString(msg))
+
+	normalized, err := normalizeCloudEvent([]byte(envelope))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{
+  "data_base64": {
+    "order": {
+      "id": "order-1234",
+      "status": "ORDER_STATUS_PAID"
+    },
+    "previousStatus": "ORDER_STATUS_PENDING"
+  },
+  "datacontenttype": "application/x-protobuf",
+  "id": "<id>",
+  "specversion": "1.0",
+  "traceid": "<traceid>"
+}
+`
+	if string(normalized) != expected {
+		t.Fatalf("expected:\n%s\nGot:\n%s", expected, normalized)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+)
+
+const (
+	healthStatusOK          = "ok"
+	healthStatusUnavailable = "unavailable"
+	healthStatusDegraded    = "degraded"
+	healthStatusFailed      = "failed"
+
+	// healthProbeKey is the key the state stores are read at by their health
+	// checks. Nothing is stored there.
+	healthProbeKey = "health-probe"
+
+	defaultHealthCheckTimeout = 5 * time.Second
+)
+
+// ComponentHealth is the status of a component the app depends on.
+type ComponentHealth struct {
+	Name    string `json:"name"`
+	Type    string `json:"type,omitempty"`
+	Version string `json:"version,omitempty"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// HealthReport is the body of /healthz/deep. Its status is ok only when every
+// component is.
+type HealthReport struct {
+	Status     string            `json:"status"`
+	Components []ComponentHealth `json:"components"`
+}
+
+// HealthCheck checks a dependency of the app, returning an error unless it is
+// usable.
+type HealthCheck interface {
+	Check(ctx context.Context) error
+}
+
+// HealthCheckFunc adapts a function to a HealthCheck.
+type HealthCheckFunc func(ctx context.Context) error
+
+func (f HealthCheckFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+// CheckResult is the outcome of a registered check.
+type CheckResult struct {
+	Name     string `json:"name"`
+	Critical bool   `json:"critical"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// CheckReport is the body of /healthz. Its status is failed when a critical
+// check fails, degraded when only other checks do, and ok otherwise.
+type CheckReport struct {
+	Status string        `json:"status"`
+	Checks []CheckResult `json:"checks"`
+}
+
+type registeredCheck struct {
+	name     string
+	critical bool
+	check    HealthCheck
+}
+
+// HealthChecker checks that the sidecar loaded the pubsub component and that
+// its broker is reachable, along with the checks registered by the other
+// dependencies of the app.
+type HealthChecker struct {
+	client     dapr.Client
+	pubsubName string
+	timeout    time.Duration
+	// broker tells whether the broker is reachable, if set.
+	broker interface{ BrokerError() error }
+
+	mu     sync.Mutex
+	checks []registeredCheck
+	// required and subscriptions are the components and the subscriptions
+	// the app isn't ready without.
+	required      []RequiredComponent
+	subscriptions []RequiredSubscription
+}
+
+// NewHealthChecker returns a checker of the pubsub component pubsubName using
+// client. It should bypass the circuit breaker, so that checks report the
+// actual state of the sidecar and don't count as failures of the app traffic.
+// The sidecar and the pubsub component are registered as critical checks, the
+// latter checked as by Check, without publishing.
+func NewHealthChecker(client dapr.Client, pubsubName string) *HealthChecker {
+	c := &HealthChecker{
+		client:     client,
+		pubsubName: pubsubName,
+		timeout:    defaultHealthCheckTimeout,
+	}
+	c.Register("dapr", true, HealthCheckFunc(func(ctx context.Context) error {
+		_, err := client.GetMetadata(ctx)
+		return err
+	}))
+	c.Register(pubsubName, true, HealthCheckFunc(func(ctx context.Context) error {
+		metadata, err := client.GetMetadata(ctx)
+		if err != nil {
+			return fmt.Errorf("sidecar unavailable: %w", err)
+		}
+		pubsub := c.checkPubsub(metadata, ComponentHealth{Name: pubsubName, Status: healthStatusUnavailable})
+		if pubsub.Status != healthStatusOK {
+			return errors.New(pubsub.Error)
+		}
+		return nil
+	}))
+	return c
+}
+
+// ObserveBroker has the checks of the pubsub component tell whether its broker
+// is reachable from the publishes of publisher, rather than publish probes.
+func (c *HealthChecker) ObserveBroker(publisher *Publisher) {
+	c.broker = publisher
+}
+
+// Register adds check to the report of /healthz under name. A critical check
+// failing fails the app, any other only degrades it.
+func (c *HealthChecker) Register(name string, critical bool, check HealthCheck) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, registeredCheck{name: name, critical: critical, check: check})
+}
+
+// Require makes the app not ready unless the sidecar lists components.
+func (c *HealthChecker) Require(components ...RequiredComponent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.required = append(c.required, components...)
+}
+
+// RequireSubscriptions makes the app not ready unless the sidecar registered
+// subscriptions.
+func (c *HealthChecker) RequireSubscriptions(subscriptions ...RequiredSubscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscriptions = append(c.subscriptions, subscriptions...)
+}
+
+// Report runs the registered checks at once, each within the timeout of the
+// checker, and returns their results in the order they were registered.
+func (c *HealthChecker) Report(ctx context.Context) CheckReport {
+	c.mu.Lock()
+	checks := slices.Clone(c.checks)
+	c.mu.Unlock()
+
+	report := CheckReport{Status: healthStatusOK, Checks: make([]CheckResult, len(checks))}
+	var wg sync.WaitGroup
+	for i, registered := range checks {
+		i, registered := i, registered
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report.Checks[i] = c.run(ctx, registered)
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		switch {
+		case result.Status == healthStatusOK:
+		case result.Critical:
+			report.Status = healthStatusFailed
+		case report.Status == healthStatusOK:
+			report.Status = healthStatusDegraded
+		}
+	}
+	return report
+}
+
+func (c *HealthChecker) run(ctx context.Context, registered registeredCheck) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	result := CheckResult{Name: registered.name, Critical: registered.critical, Status: healthStatusOK}
+	start := time.Now()
+	if err := registered.check.Check(ctx); err != nil {
+		result.Status = healthStatusFailed
+		result.Error = err.Error()
+	}
+	result.Duration = time.Since(start).Round(time.Microsecond).String()
+	return result
+}
+
+// Check queries the metadata API of the sidecar for the pubsub component, and
+// reports its broker unreachable if the last publish failed to reach it.
+func (c *HealthChecker) Check(ctx context.Context) HealthReport {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	sidecar := ComponentHealth{Name: "sidecar", Status: healthStatusOK}
+	pubsub := ComponentHealth{Name: c.pubsubName, Status: healthStatusUnavailable}
+	report := HealthReport{Status: healthStatusUnavailable}
+
+	metadata, err := c.client.GetMetadata(ctx)
+	if err != nil {
+		sidecar.Status = healthStatusUnavailable
+		sidecar.Error = err.Error()
+		pubsub.Error = "sidecar unavailable"
+		report.Components = []ComponentHealth{sidecar, pubsub}
+		return report
+	}
+	report.Components = []ComponentHealth{sidecar, c.checkPubsub(metadata, pubsub)}
+
+	report.Status = healthStatusOK
+	for _, component := range report.Components {
+		if component.Status != healthStatusOK {
+			report.Status = healthStatusUnavailable
+		}
+	}
+	return report
+}
+
+func (c *HealthChecker) checkPubsub(metadata *dapr.GetMetadataResponse, pubsub ComponentHealth) ComponentHealth {
+	for _, component := range metadata.RegisteredComponents {
+		if component.Name == c.pubsubName && strings.HasPrefix(component.Type, "pubsub.") {
+			pubsub.Type = component.Type
+			pubsub.Version = component.Version
+			break
+		}
+	}
+	if pubsub.Type == "" {
+		pubsub.Error = "component not loaded"
+		return pubsub
+	}
+
+	if c.broker != nil {
+		if err := c.broker.BrokerError(); err != nil {
+			pubsub.Error = fmt.Sprintf("broker unreachable: %s", err)
+			return pubsub
+		}
+	}
+	pubsub.Status = healthStatusOK
+	return pubsub
+}
+
+// Ready returns an error unless the sidecar answers its metadata API, which
+// the app needs for any order or webhook request, and lists the required
+// components and subscriptions, e.g. once a component is removed while the
+// sidecar runs.
+func (c *HealthChecker) Ready(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	metadata, err := c.client.GetMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("sidecar unavailable: %w", err)
+	}
+	c.mu.Lock()
+	required, subscriptions := slices.Clone(c.required), slices.Clone(c.subscriptions)
+	c.mu.Unlock()
+	if err := checkComponents(metadata, required); err != nil {
+		return err
+	}
+	return checkSubscriptions(metadata, subscriptions)
+}
+
+// handleReady answers whether the app can serve requests, unlike /health
+// which only reports that it runs.
+func (h *AppHandler) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !h.startup.Open() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "not ready: waiting for the sidecar\n")
+		return
+	}
+	if err := h.health.Ready(r.Context()); err != nil {
+		slog.Warn("app not ready", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "not ready: %s\n", err)
+		return
+	}
+	fmt.Fprintf(w, "ready\n")
+}
+
+// handleHealthz answers the report of the registered checks, with a 503 only
+// when a critical one fails, so that a degraded app keeps its traffic.
+func (h *AppHandler) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	report := h.health.Report(r.Context())
+	if report.Status != healthStatusOK {
+		slog.Warn("health check "+report.Status, "checks", report.Checks)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status == healthStatusFailed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.Error("couldn't encode health report", "error", err)
+	}
+}
+
+func (h *AppHandler) handleHealthDeep(w http.ResponseWriter, r *http.Request) {
+	report := h.health.Check(r.Context())
+	if report.Status != healthStatusOK {
+		slog.Warn("deep health check failed", "components", report.Components)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != healthStatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.Error("couldn't encode health report", "error", err)
+	}
+}
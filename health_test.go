@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	dapr "github.com/dapr/go-sdk/client"
+)
+
+func TestHealthDeep(t *testing.T) {
+	pubsub := &dapr.MetadataRegisteredComponents{Name: pubsubName, Type: "pubsub.redis", Version: "v1"}
+
+	errUnreachable := errors.New("connection refused")
+
+	tests := []struct {
+		name   string
+		client *fakeDaprClient
+		// publishes are the outcomes of the publishes of the app before the
+		// check
+		publishes  []error
+		wantCode   int
+		wantPubsub ComponentHealth
+	}{
+		{
+			name:       "healthy",
+			client:     &fakeDaprClient{components: []*dapr.MetadataRegisteredComponents{pubsub}},
+			wantCode:   http.StatusOK,
+			wantPubsub: ComponentHealth{Name: pubsubName, Type: "pubsub.redis", Version: "v1", Status: healthStatusOK},
+		},
+		{
+			name:       "broker reachable again",
+			client:     &fakeDaprClient{components: []*dapr.MetadataRegisteredComponents{pubsub}},
+			publishes:  []error{errUnreachable, nil},
+			wantCode:   http.StatusOK,
+			wantPubsub: ComponentHealth{Name: pubsubName, Type: "pubsub.redis", Version: "v1", Status: healthStatusOK},
+		},
+		{
+			name:       "component not loaded",
+			client:     &fakeDaprClient{components: []*dapr.MetadataRegisteredComponents{{Name: stateStoreName, Type: "state.postgresql"}}},
+			wantCode:   http.StatusServiceUnavailable,
+			wantPubsub: ComponentHealth{Name: pubsubName, Status: healthStatusUnavailable, Error: "component not loaded"},
+		},
+		{
+			name:       "broker unreachable",
+			client:     &fakeDaprClient{components: []*dapr.MetadataRegisteredComponents{pubsub}},
+			publishes:  []error{nil, errUnreachable},
+			wantCode:   http.StatusServiceUnavailable,
+			wantPubsub: ComponentHealth{Name: pubsubName, Type: "pubsub.redis", Version: "v1", Status: healthStatusUnavailable, Error: "broker unreachable: connection refused"},
+		},
+		{
+			name:       "sidecar unavailable",
+			client:     &fakeDaprClient{metadataErr: errors.New("connection refused")},
+			wantCode:   http.StatusServiceUnavailable,
+			wantPubsub: ComponentHealth{Name: pubsubName, Status: healthStatusUnavailable, Error: "sidecar unavailable"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{TopicAllowlist: defaultTopicAllowlist(), PublishRetry: RetryPolicy{MaxAttempts: 1}}
+			metrics := NewMetrics()
+			publisher := NewPublisher(tt.client, config, metrics)
+			for _, err := range tt.publishes {
+				tt.client.publishErr = err
+				publisher.Publish(context.Background(), handlerOrdersPut, topicOrders, map[string]string{})
+			}
+			published := len(tt.client.published)
+
+			h := NewAppHandler(config, metrics, publisher, nil)
+			h.health = NewHealthChecker(tt.client, pubsubName)
+			h.health.ObserveBroker(publisher)
+			h.RegisterRoutes()
+
+			rec := httptest.NewRecorder()
+			h.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz/deep", nil))
+
+			// the broker is checked without publishing
+			if len(tt.client.published) != published {
+				t.Fatalf("expected no probe published. Got %v.", tt.client.published[published:])
+			}
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected status code %d. Got %d.", tt.wantCode, rec.Code)
+			}
+			var report HealthReport
+			if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+				t.Fatalf("couldn't decode report: %s", err)
+			}
+			if len(report.Components) != 2 || report.Components[1] != tt.wantPubsub {
+				t.Fatalf("expected pubsub health %+v. Got %+v.", tt.wantPubsub, report.Components)
+			}
+		})
+	}
+}
+
+func TestReady(t *testing.T) {
+	tests := []struct {
+		name     string
+		client   *fakeDaprClient
+		wantCode int
+		wantBody string
+	}{
+		{
+			name: "ready",
+			client: &fakeDaprClient{
+				components:    []*dapr.MetadataRegisteredComponents{{Name: pubsubName, Type: "pubsub.redis"}, {Name: stateStoreName, Type: "state.redis"}},
+				subscriptions: []*dapr.MetadataSubscription{{PubsubName: pubsubName, Topic: topicOrders}},
+			},
+			wantCode: http.StatusOK,
+			wantBody: "ready\n",
+		},
+		{
+			name:     "sidecar unavailable",
+			client:   &fakeDaprClient{metadataErr: errors.New("connection refused")},
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: "not ready: sidecar unavailable: connection refused\n",
+		},
+		{
+			name:     "component removed",
+			client:   &fakeDaprClient{components: []*dapr.MetadataRegisteredComponents{{Name: pubsubName, Type: "pubsub.redis"}}},
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: "not ready: components not loaded: order-state (state)\n",
+		},
+		{
+			name:     "subscription not registered",
+			client:   &fakeDaprClient{components: []*dapr.MetadataRegisteredComponents{{Name: pubsubName, Type: "pubsub.redis"}, {Name: stateStoreName, Type: "state.redis"}}},
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: "not ready: subscriptions not registered: order-pub-sub/orders\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			health := NewHealthChecker(tt.client, pubsubName)
+			health.Require(requiredComponents...)
+			health.RequireSubscriptions(ordersSubscription)
+			h := NewAppHandler(&Config{}, NewMetrics(), nil, nil)
+			h.health = health
+			h.RegisterRoutes()
+
+			rec := httptest.NewRecorder()
+			h.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected status code %d. Got %d.", tt.wantCode, rec.Code)
+			}
+			if rec.Body.String() != tt.wantBody {
+				t.Fatalf("expected body %q. Got %q.", tt.wantBody, rec.Body)
+			}
+		})
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	pubsub := &dapr.MetadataRegisteredComponents{Name: pubsubName, Type: "pubsub.redis", Version: "v1"}
+
+	tests := []struct {
+		name       string
+		client     *fakeDaprClient
+		paymentErr error
+		// publishErr is the outcome of a publish of the app before the check
+		publishErr error
+		wantCode   int
+		wantStatus string
+		// wantChecks is the status of each check, in the order registered
+		wantChecks []string
+	}{
+		{
+			name:       "healthy",
+			client:     &fakeDaprClient{components: []*dapr.MetadataRegisteredComponents{pubsub}},
+			wantCode:   http.StatusOK,
+			wantStatus: healthStatusOK,
+			wantChecks: []string{healthStatusOK, healthStatusOK, healthStatusOK, healthStatusOK},
+		},
+		{
+			name:       "payments unavailable",
+			client:     &fakeDaprClient{components: []*dapr.MetadataRegisteredComponents{pubsub}},
+			paymentErr: errors.New("connection refused"),
+			wantCode:   http.StatusOK,
+			wantStatus: healthStatusDegraded,
+			wantChecks: []string{healthStatusOK, healthStatusOK, healthStatusOK, healthStatusFailed},
+		},
+		{
+			name:       "state store unavailable",
+			client:     &fakeDaprClient{components: []*dapr.MetadataRegisteredComponents{pubsub}, stateErr: errors.New("connection refused")},
+			paymentErr: errors.New("connection refused"),
+			wantCode:   http.StatusServiceUnavailable,
+			wantStatus: healthStatusFailed,
+			wantChecks: []string{healthStatusOK, healthStatusOK, healthStatusFailed, healthStatusFailed},
+		},
+		{
+			name:       "pubsub component not loaded",
+			client:     &fakeDaprClient{},
+			wantCode:   http.StatusServiceUnavailable,
+			wantStatus: healthStatusFailed,
+			wantChecks: []string{healthStatusOK, healthStatusFailed, healthStatusOK, healthStatusOK},
+		},
+		{
+			name:       "broker unreachable",
+			client:     &fakeDaprClient{components: []*dapr.MetadataRegisteredComponents{pubsub}},
+			publishErr: errors.New("connection refused"),
+			wantCode:   http.StatusServiceUnavailable,
+			wantStatus: healthStatusFailed,
+			wantChecks: []string{healthStatusOK, healthStatusFailed, healthStatusOK, healthStatusOK},
+		},
+		{
+			name:       "sidecar unavailable",
+			client:     &fakeDaprClient{metadataErr: errors.New("connection refused")},
+			wantCode:   http.StatusServiceUnavailable,
+			wantStatus: healthStatusFailed,
+			wantChecks: []string{healthStatusFailed, healthStatusFailed, healthStatusOK, healthStatusOK},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.client.invoke = func(appID, method string, content *dapr.DataContent) ([]byte, error) {
+				return nil, tt.paymentErr
+			}
+			config := &Config{TopicAllowlist: defaultTopicAllowlist(), PublishRetry: RetryPolicy{MaxAttempts: 1}}
+			metrics := NewMetrics()
+			publisher := NewPublisher(tt.client, config, metrics)
+			tt.client.publishErr = tt.publishErr
+			publisher.Publish(context.Background(), handlerOrdersPut, topicOrders, map[string]string{})
+			published := len(tt.client.published)
+
+			health := NewHealthChecker(tt.client, pubsubName)
+			health.ObserveBroker(publisher)
+			health.Register(stateStoreName, true, NewOrderStore(tt.client))
+			health.Register("payments", false, NewDaprPayments(tt.client, "payments"))
+			h := NewAppHandler(config, metrics, publisher, nil)
+			h.health = health
+			h.RegisterRoutes()
+
+			rec := httptest.NewRecorder()
+			h.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+			if len(tt.client.published) != published {
+				t.Fatalf("expected no probe published. Got %v.", tt.client.published[published:])
+			}
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected status code %d. Got %d.", tt.wantCode, rec.Code)
+			}
+			var report CheckReport
+			if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+				t.Fatalf("couldn't decode report: %s", err)
+			}
+			if report.Status != tt.wantStatus {
+				t.Fatalf("expected status %s. Got %s.", tt.wantStatus, report.Status)
+			}
+			var names, statuses []string
+			for _, check := range report.Checks {
+				names = append(names, check.Name)
+				statuses = append(statuses, check.Status)
+				if (check.Status == healthStatusFailed) != (check.Error != "") {
+					t.Fatalf("expected an error for the failed checks only. Got %+v.", check)
+				}
+			}
+			if expected := []string{"dapr", pubsubName, stateStoreName, "payments"}; !slices.Equal(names, expected) {
+				t.Fatalf("expected checks %v. Got %v.", expected, names)
+			}
+			if !slices.Equal(statuses, tt.wantChecks) {
+				t.Fatalf("expected check statuses %v. Got %v.", tt.wantChecks, statuses)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// defaultDaprVersion is the version of the Dapr images of the stacks, unless
+// DAPR_VERSION sets another one, e.g. to run the tests against several Dapr
+// releases in CI.
+const defaultDaprVersion = "1.14.4"
+
+// Images of the stacks, each overridden by the environment variable named
+// after it.
+var (
+	redisImage          = imageFromEnv("REDIS_IMAGE", "redis:7.2-alpine")
+	postgresImage       = imageFromEnv("POSTGRES_IMAGE", "postgres:16-alpine")
+	redpandaImage       = imageFromEnv("REDPANDA_IMAGE", "docker.redpanda.com/redpandadata/redpanda:v23.2.14")
+	rabbitmqImage       = imageFromEnv("RABBITMQ_IMAGE", "rabbitmq:3.12-management-alpine")
+	natsImage           = imageFromEnv("NATS_IMAGE", "nats:2.10-alpine")
+	natsBoxImage        = imageFromEnv("NATS_BOX_IMAGE", "natsio/nats-box:0.14.1")
+	jaegerImage         = imageFromEnv("JAEGER_IMAGE", "jaegertracing/all-in-one:1.50")
+	otelCollectorImage  = imageFromEnv("OTEL_COLLECTOR_IMAGE", "otel/opentelemetry-collector:0.88.0")
+	prometheusImage     = imageFromEnv("PROMETHEUS_IMAGE", "prom/prometheus:v2.47.2")
+	toxiproxyImage      = imageFromEnv("TOXIPROXY_IMAGE", "ghcr.io/shopify/toxiproxy:2.7.0")
+	schemaRegistryImage = imageFromEnv("SCHEMA_REGISTRY_IMAGE", "apicurio/apicurio-registry-mem:2.5.8.Final")
+)
+
+// imageFromEnv returns the image set by the environment variable env, or
+// fallback.
+func imageFromEnv(env, fallback string) string {
+	if image := os.Getenv(env); image != "" {
+		return image
+	}
+	return fallback
+}
+
+// daprImage returns the image of the Dapr service name, such as daprd or
+// placement, at the version DAPR_VERSION, or defaultDaprVersion.
+func daprImage(name string) string {
+	return "daprio/" + name + ":" + imageFromEnv("DAPR_VERSION", defaultDaprVersion)
+}
+
+func TestImages(t *testing.T) {
+	if image := imageFromEnv("TEST_UNSET_IMAGE", "redis:7.2-alpine"); image != "redis:7.2-alpine" {
+		t.Fatalf("expected the default image. Got %s.", image)
+	}
+	t.Setenv("TEST_SET_IMAGE", "redis:6-alpine")
+	if image := imageFromEnv("TEST_SET_IMAGE", "redis:7.2-alpine"); image != "redis:6-alpine" {
+		t.Fatalf("expected the image of the environment. Got %s.", image)
+	}
+
+	if image := daprImage("daprd"); os.Getenv("DAPR_VERSION") == "" && image != "daprio/daprd:"+defaultDaprVersion {
+		t.Fatalf("expected daprd to be pinned to %s. Got %s.", defaultDaprVersion, image)
+	}
+	t.Setenv("DAPR_VERSION", "1.12.5")
+	if image := daprImage("placement"); image != "daprio/placement:1.12.5" {
+		t.Fatalf("expected placement at DAPR_VERSION. Got %s.", image)
+	}
+}
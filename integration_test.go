@@ -2,294 +2,3520 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/dapr/go-sdk/service/common"
-	daprd "github.com/dapr/go-sdk/service/http"
-	"github.com/testcontainers/testcontainers-go"
-	"github.com/testcontainers/testcontainers-go/wait"
+	"github.com/andybalholm/brotli"
+	"github.com/etiennetremel/testcontainers-dapr-example/orderspb"
+	"github.com/etiennetremel/testcontainers-dapr-example/testhelpers"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
 )
 
-var sub = &common.Subscription{
-	PubsubName: "order-pub-sub",
-	Topic:      "orders",
-	Route:      "/checkout",
-}
+func TestIntegrationPutOrderStatus(t *testing.T) {
+	ctx := context.Background()
+
+	// start containers, or reuse those started by a previous test
+	runningContainers := sharedStack(t)
+
+	artifactsDir := defaultArtifactsDir
+	if dir, ok := os.LookupEnv("TEST_ARTIFACTS_DIR"); ok {
+		artifactsDir = dir
+	}
+	// the stack ID keeps apart the artifacts of concurrent runs of the test
+	if path, err := runningContainers.Topology.Write(artifactsDir, t.Name()+"-"+runningContainers.ID); err != nil {
+		t.Logf("couldn't write stack topology: %s", err)
+	} else {
+		t.Logf("stack topology written to %s.topology.{json,mmd}", path)
+	}
+
+	// make request to the app container
+	url := fmt.Sprintf("%s/orders/order-1234", runningContainers.app.URI)
+	payload := []byte(`{"status": "PAID"}`)
+
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewBuffer(payload))
+	if err != nil {
+		t.Fatalf("couldn't create PUT request: %q", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+
+	// check response status
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if string(body) != "Order updated" {
+		t.Fatalf("expected body \"Order updated\". Got %s.", body)
+	}
+
+	log.Println("Waiting for event to be published in orders topic")
+	order := waitForOrderEvents(ctx, t, runningContainers, 1)[0]
+	log.Printf("Subscriber received: %v\n", order)
 
-type appContainer struct {
-	testcontainers.Container
-	URI string
+	if order.ID != "order-1234" || order.Status != OrderStatusPaid {
+		t.Fatalf("expected event order id=order-1234, status=paid. Got %v.", order)
+	}
 }
 
-type containers struct {
-	app             *appContainer
-	daprApp         testcontainers.Container
-	daprIntegration testcontainers.Container
-	redis           testcontainers.Container
+func TestIntegrationIsolatedStacks(t *testing.T) {
+	ctx := context.Background()
+
+	orderIDs := []string{"order-1111", "order-2222"}
+	stacks := make([]*Stack, len(orderIDs))
+
+	for i := range orderIDs {
+		stack, err := setupApp(ctx, t)
+		t.Cleanup(func() {
+			if err := stack.Terminate(ctx); err != nil {
+				t.Errorf("failed to terminate stack: %s", err)
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stacks[i] = stack
+	}
+
+	for i, stack := range stacks {
+		resp := putOrder(t, stack.app.URI, orderIDs[i], OrderStatusPaid, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	// each subscriber only sees the event published through its own stack
+	for i, stack := range stacks {
+		if id := waitForOrderEvents(ctx, t, stack, 1)[0].ID; id != orderIDs[i] {
+			t.Fatalf("expected stack %s to receive %s. Got %s.", stack.ID, orderIDs[i], id)
+		}
+	}
 }
 
-// helper to display container logs
-func showContainerLogs(ctx context.Context, c testcontainers.Container) error {
-	name, err := c.Name(ctx)
+func TestIntegrationDaprAPIToken(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers, err := setupApp(ctx, t, WithDaprAPIToken("integration-test-token"))
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
-	buf := new(bytes.Buffer)
-	readCloser, err := c.Logs(ctx)
+
+	// the sidecar rejects calls that don't carry the token
+	daprHTTP, err := runningContainers.daprApp.HTTPEndpoint(ctx)
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
-	_, err = buf.ReadFrom(readCloser)
+	resp, err := http.Get(daprHTTP + "/v1.0/metadata")
 	if err != nil {
-		log.Fatal(err)
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected sidecar to answer %d without token. Got %d.", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// the app sends the token, so publishing goes through
+	resp = putOrder(t, runningContainers.app.URI, "order-1234", OrderStatusPaid, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
 	}
-	readCloser.Close()
-	content := buf.String()
-	fmt.Printf("[%s] container logs: %s\r\n", name, content)
 
-	return nil
+	if id := waitForOrderEvents(ctx, t, runningContainers, 1)[0].ID; id != "order-1234" {
+		t.Fatalf("expected event for order-1234. Got %s.", id)
+	}
 }
 
-func setupApp(ctx context.Context) (*containers, error) {
-	// Redis
-	redisC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
-		ContainerRequest: testcontainers.ContainerRequest{
-			Name:         "redis",
-			Hostname:     "redis",
-			Image:        "redis:alpine",
-			ExposedPorts: []string{"6379/tcp"},
-			WaitingFor:   wait.ForLog("Ready to accept connections tcp"),
-			LifecycleHooks: []testcontainers.ContainerLifecycleHooks{
-				{
-					PreTerminates: []testcontainers.ContainerHook{
-						showContainerLogs,
-					},
-				},
-			},
-		},
-		Started: true,
-	})
+func TestIntegrationListOrders(t *testing.T) {
+	runningContainers := sharedStack(t)
+
+	for _, id := range []string{"order-0003", "order-0001", "order-0002"} {
+		resp := putOrder(t, runningContainers.app.URI, id, OrderStatusPending, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	tests := []struct {
+		query      string
+		expected   []string
+		nextOffset *int
+	}{
+		{"limit=2", []string{"order-0001", "order-0002"}, intPtr(2)},
+		{"limit=2&offset=2", []string{"order-0003"}, nil},
+	}
+
+	for _, tt := range tests {
+		resp, err := http.Get(fmt.Sprintf("%s/orders?%s", runningContainers.app.URI, tt.query))
+		if err != nil {
+			t.Fatalf("couldn't do request: %q", err)
+		}
+
+		var list OrderList
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("couldn't decode response: %s", err)
+		}
+
+		ids := make([]string, 0, len(list.Items))
+		for _, order := range list.Items {
+			ids = append(ids, order.ID)
+		}
+		if !slices.Equal(ids, tt.expected) {
+			t.Fatalf("expected orders %v for %q. Got %v.", tt.expected, tt.query, ids)
+		}
+		if (list.NextOffset == nil) != (tt.nextOffset == nil) || (list.NextOffset != nil && *list.NextOffset != *tt.nextOffset) {
+			t.Fatalf("expected next offset %v for %q. Got %v.", tt.nextOffset, tt.query, list.NextOffset)
+		}
+	}
+}
+
+// decodeOrderEvent returns the order carried by an event of the orders topic,
+// typed events such as OrderCancelled being published in JSON.
+func decodeOrderEvent(e subscriberEvent) (Order, error) {
+	switch e.DataContentType {
+	case contentTypeProtobuf:
+		return DecodeOrderStatusChanged(e.Data)
+	case contentTypeAvro:
+		return DecodeAvroOrderStatusChanged(e.Data)
+	case contentTypeJSON:
+		var order Order
+		err := json.Unmarshal(e.Data, &order)
+		return order, err
+	}
+	return Order{}, fmt.Errorf("expected a %s, %s or %s event, got %q", contentTypeProtobuf, contentTypeAvro, contentTypeJSON, e.DataContentType)
+}
+
+// waitForOrderEvents waits for the subscriber of stack to receive n events,
+// and returns the orders they carry.
+func waitForOrderEvents(ctx context.Context, t *testing.T, stack *Stack, n int) []Order {
+	t.Helper()
+
+	events, err := stack.waitForEvents(ctx, n)
 	if err != nil {
-		return nil, err
+		t.Fatalf("couldn't receive events: %s", err)
+	}
+	orders := make([]Order, 0, len(events))
+	for _, e := range events {
+		order, err := decodeOrderEvent(e)
+		if err != nil {
+			t.Fatalf("couldn't decode event %s: %s", e.ID, err)
+		}
+		orders = append(orders, order)
 	}
+	return orders
+}
 
-	appC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
-		ContainerRequest: testcontainers.ContainerRequest{
-			Name:         "app",
-			Hostname:     "app",
-			ExposedPorts: []string{"3000/tcp"},
-			WaitingFor:   wait.ForHTTP("/health"),
-			Env: map[string]string{
-				"DAPR_URL": "dapr-app:50001",
-			},
-			FromDockerfile: testcontainers.FromDockerfile{
-				Context:    ".",
-				Dockerfile: "Dockerfile",
-				KeepImage:  true,
-			},
-			LifecycleHooks: []testcontainers.ContainerLifecycleHooks{
-				{
-					PreTerminates: []testcontainers.ContainerHook{
-						showContainerLogs,
-					},
-				},
-			},
-		},
-		Started: true,
-	})
+func intPtr(i int) *int {
+	return &i
+}
+
+func newPutOrderRequest(uri, id string, status OrderStatus, header http.Header) (*http.Request, error) {
+	url := fmt.Sprintf("%s/orders/%s", uri, id)
+	payload := fmt.Sprintf(`{"status": %q}`, status)
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewBufferString(payload))
 	if err != nil {
 		return nil, err
 	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
 
-	ip, err := appC.Host(ctx)
+// putOrder sets the status of order id through the app API at uri.
+func putOrder(t *testing.T, uri, id string, status OrderStatus, header http.Header) *http.Response {
+	t.Helper()
+
+	req, err := newPutOrderRequest(uri, id, status, header)
 	if err != nil {
-		return nil, err
+		t.Fatalf("couldn't create PUT request: %q", err)
 	}
 
-	mappedPort, err := appC.MappedPort(ctx, "3000")
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, err
+		t.Fatalf("couldn't do request: %q", err)
 	}
+	return resp
+}
 
-	uri := fmt.Sprintf("http://%s:%s", ip, mappedPort.Port())
-
-	// DAPR
-	daprAppC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
-		ContainerRequest: testcontainers.ContainerRequest{
-			Name:         "dapr-app",
-			Hostname:     "dapr-app",
-			Image:        "daprio/daprd",
-			WaitingFor:   wait.ForLog("dapr initialized"),
-			ExposedPorts: []string{"3500/tcp", "50001/tcp"},
-			Cmd: []string{
-				"./daprd",
-				"-app-id", "app",
-				"-app-port", "3000",
-				"-app-protocol", "http",
-				"-app-channel-address", "app",
-				"-dapr-listen-addresses", "0.0.0.0",
-				"-resources-path", "./components",
-				"-log-level", "debug",
-			},
-			Files: []testcontainers.ContainerFile{
-				{
-					HostFilePath:      "./order-pub-sub.yaml",
-					ContainerFilePath: "./components/order-pub-sub.yaml",
-					FileMode:          0o644,
-				},
-			},
-			LifecycleHooks: []testcontainers.ContainerLifecycleHooks{
-				{
-					PreTerminates: []testcontainers.ContainerHook{
-						showContainerLogs,
-					},
-				},
-			},
-		},
-		Started: true,
-	})
+// postOrderAction runs action, such as cancel, on order id through the app
+// API at uri.
+func postOrderAction(t *testing.T, uri, id, action string) *http.Response {
+	t.Helper()
+
+	resp, err := http.Post(fmt.Sprintf("%s/orders/%s/%s", uri, id, action), "", nil)
 	if err != nil {
-		return nil, err
+		t.Fatalf("couldn't do request: %q", err)
 	}
+	return resp
+}
 
-	// DAPR Integration
-	daprIntegrationC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
-		ContainerRequest: testcontainers.ContainerRequest{
-			Name:         "dapr-integration",
-			Hostname:     "dapr-integration",
-			Image:        "daprio/daprd",
-			WaitingFor:   wait.ForLog("dapr initialized"),
-			ExposedPorts: []string{"3500/tcp", "50001/tcp"}, // HTTP + GRPC port
-			Cmd: []string{
-				"./daprd",
-				"-app-id", "integration",
-				"-app-port", "6002",
-				"-app-protocol", "http",
-				"-app-channel-address", "host.docker.internal",
-				"-dapr-listen-addresses", "0.0.0.0",
-				"-resources-path", "./components",
-				"-log-level", "debug",
-			},
-			Files: []testcontainers.ContainerFile{
-				{
-					HostFilePath:      "./order-pub-sub.yaml",
-					ContainerFilePath: "./components/order-pub-sub.yaml",
-					FileMode:          0o644,
-				},
-			},
-			LifecycleHooks: []testcontainers.ContainerLifecycleHooks{
-				{
-					PreTerminates: []testcontainers.ContainerHook{
-						showContainerLogs,
-					},
-				},
-			},
-		},
-		Started: true,
-	})
+func TestIntegrationOptimisticConcurrency(t *testing.T) {
+	runningContainers := sharedStack(t)
+
+	uri := runningContainers.app.URI
+
+	resp := putOrder(t, uri, "order-1234", OrderStatusPending, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/orders/order-1234", uri))
 	if err != nil {
-		return nil, err
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("expected GET to return an ETag")
 	}
 
-	return &containers{
-		app:             &appContainer{Container: appC, URI: uri},
-		daprApp:         daprAppC,
-		daprIntegration: daprIntegrationC,
-		redis:           redisC,
-	}, nil
-}
+	t.Run("stale write is rejected", func(t *testing.T) {
+		resp := putOrder(t, uri, "order-1234", OrderStatusPaid, http.Header{"If-Match": {etag}})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+		}
 
-func TestIntegrationPutOrderStatus(t *testing.T) {
-	ctx := context.Background()
-	receivedEvent := make(chan bool)
+		// etag is now outdated
+		resp = putOrder(t, uri, "order-1234", OrderStatusPending, http.Header{"If-Match": {etag}})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusConflict {
+			t.Fatalf("expected status code %d. Got %d.", http.StatusConflict, resp.StatusCode)
+		}
+		if current := resp.Header.Get("ETag"); current == "" || current == etag {
+			t.Fatalf("expected conflict to return the current ETag. Got %q.", current)
+		}
+	})
 
-	// start integration server to check events
-	go func() {
-		s := daprd.NewService(":6002")
-		log.Println("Running service at :6002")
-		err := s.AddTopicEventHandler(sub, func(ctx context.Context, e *common.TopicEvent) (retry bool, err error) {
-			log.Printf("Subscriber received: %s\n", e.RawData)
+	t.Run("only one of concurrent writes wins", func(t *testing.T) {
+		resp := putOrder(t, uri, "order-5678", OrderStatusPending, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+		}
+
+		resp, err := http.Get(fmt.Sprintf("%s/orders/order-5678", uri))
+		if err != nil {
+			t.Fatalf("couldn't do request: %q", err)
+		}
+		resp.Body.Close()
+		etag := resp.Header.Get("ETag")
 
-			// when event is received, we forward true to the channel
-			defer func() {
-				receivedEvent <- true
+		const writers = 5
+		codes := make(chan int, writers)
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, err := newPutOrderRequest(uri, "order-5678", OrderStatusPaid, http.Header{"If-Match": {etag}})
+				if err != nil {
+					t.Errorf("couldn't create PUT request: %q", err)
+					return
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Errorf("couldn't do request: %q", err)
+					return
+				}
+				resp.Body.Close()
+				codes <- resp.StatusCode
 			}()
+		}
+		wg.Wait()
+		close(codes)
 
-			var order Order
-			if err := e.Struct(&order); err != nil {
-				t.Fatalf("couldn't parse received event. Got %s. Err: %s", e.RawData, err)
-			}
+		count := map[int]int{}
+		for code := range codes {
+			count[code]++
+		}
+		if count[http.StatusOK] != 1 || count[http.StatusConflict] != writers-1 {
+			t.Fatalf("expected 1 write to succeed and %d to conflict. Got %v.", writers-1, count)
+		}
+	})
+}
+
+func TestIntegrationConcurrentPuts(t *testing.T) {
+	ctx := context.Background()
+	runningContainers := sharedStack(t)
 
-			if order.ID != "order-1234" || order.Status != OrderStatusPaid {
-				t.Fatalf("expected event order id=order-1234, status=paid. Got %v.", order)
+	uri := runningContainers.app.URI
+
+	// writers race to create the order, then to pay it, without If-Match, so
+	// that the ETag of the version each of them read guards its write
+	const writers = 10
+	type answer struct {
+		code int
+		body string
+	}
+	answers := make(chan answer, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		status := OrderStatusPending
+		if i%2 == 1 {
+			status = OrderStatusPaid
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := newPutOrderRequest(uri, "order-1234", status, nil)
+			if err != nil {
+				t.Errorf("couldn't create PUT request: %q", err)
+				return
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("couldn't do request: %q", err)
+				return
 			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			answers <- answer{code: resp.StatusCode, body: string(body)}
+		}()
+	}
+	wg.Wait()
+	close(answers)
 
-			return false, nil
-		})
-		if err != nil {
-			log.Fatalf("error adding topic subscription: %v", err)
+	// every write is applied, found unchanged or rejected as a conflict
+	updated := 0
+	for a := range answers {
+		switch {
+		case a.code == http.StatusOK && a.body == "Order updated":
+			updated++
+		case a.code == http.StatusOK && a.body == "Order unchanged":
+		case a.code == http.StatusConflict:
+		default:
+			t.Fatalf("expected the write to be applied or to conflict. Got %d: %s", a.code, a.body)
 		}
+	}
+	if updated == 0 {
+		t.Fatal("expected a write to be applied")
+	}
+
+	// exactly one event per applied write, late ones included
+	events, err := runningContainers.waitForEvents(ctx, updated)
+	if err != nil {
+		t.Fatalf("couldn't receive events: %s", err)
+	}
+	time.Sleep(2 * time.Second)
+	if events, err = runningContainers.receivedEvents(ctx); err != nil {
+		t.Fatalf("couldn't receive events: %s", err)
+	}
+	if len(events) != updated {
+		t.Fatalf("expected %d events, one per applied write. Got %d.", updated, len(events))
+	}
 
-		if err := s.Start(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("error listening: %v", err)
+	// the events chain the statuses from the creation of the order to the
+	// one persisted, whatever the order they were delivered in
+	next := map[OrderStatus]OrderStatus{}
+	for _, e := range events {
+		var msg orderspb.OrderStatusChanged
+		if err := proto.Unmarshal(e.Data, &msg); err != nil {
+			t.Fatalf("couldn't decode event %s: %s", e.ID, err)
+		}
+		previous := statusFromProto(msg.PreviousStatus)
+		if _, ok := next[previous]; ok {
+			t.Fatalf("expected a single change from status %q. Got %v.", previous, events)
+		}
+		next[previous] = statusFromProto(msg.GetOrder().GetStatus())
+	}
+	var last OrderStatus
+	for range events {
+		status, ok := next[last]
+		if !ok {
+			t.Fatalf("expected the events to chain the statuses. Got %v.", next)
 		}
-	}()
+		last = status
+	}
 
-	// start containers
-	runningContainers, err := setupApp(ctx)
+	resp, err := http.Get(fmt.Sprintf("%s/orders/order-1234", uri))
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	defer resp.Body.Close()
+	var order Order
+	if err := json.NewDecoder(resp.Body).Decode(&order); err != nil {
+		t.Fatalf("couldn't decode response: %s", err)
+	}
+	if order.Status != last {
+		t.Fatalf("expected order-1234 to be persisted with the status of the last event, %q. Got %q.", last, order.Status)
+	}
+}
+
+func TestIntegrationOrderStatusTransitions(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers := sharedStack(t)
+
+	uri := runningContainers.app.URI
+
+	for _, status := range []OrderStatus{OrderStatusPending, OrderStatusPaid} {
+		resp := putOrder(t, uri, "order-1234", status, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	// a paid order can't go back to pending
+	resp := putOrder(t, uri, "order-1234", OrderStatusPending, nil)
+	var transitionErr TransitionError
+	err := json.NewDecoder(resp.Body).Decode(&transitionErr)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("couldn't decode response: %s", err)
+	}
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusConflict, resp.StatusCode)
+	}
+	expected := TransitionError{From: OrderStatusPaid, To: OrderStatusPending, Reason: TransitionReasonInvalid}
+	if transitionErr != expected {
+		t.Fatalf("expected error %+v. Got %+v.", expected, transitionErr)
 	}
 
-	// clean up the container after the test is complete
+	// publish another order to know when every event made it through
+	resp = putOrder(t, uri, "order-9999", OrderStatusPending, nil)
+	resp.Body.Close()
+
+	events := waitForOrderEvents(ctx, t, runningContainers, 3)
+
+	expectedEvents := []Order{
+		{ID: "order-1234", Status: OrderStatusPending},
+		{ID: "order-1234", Status: OrderStatusPaid},
+		{ID: "order-9999", Status: OrderStatusPending},
+	}
+	if !reflect.DeepEqual(events, expectedEvents) {
+		t.Fatalf("expected events %v. Got %v.", expectedEvents, events)
+	}
+}
+
+func TestIntegrationWebhookNotifications(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers, err := setupApp(ctx, t, WithWebhookReceiver(1))
 	t.Cleanup(func() {
-		if err := runningContainers.daprIntegration.Terminate(ctx); err != nil {
-			t.Fatalf("failed to terminate container: %s", err)
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
 		}
-		if err := runningContainers.daprApp.Terminate(ctx); err != nil {
-			t.Fatalf("failed to terminate container: %s", err)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri := runningContainers.app.URI
+
+	resp, err := http.Post(uri+"/webhooks", "application/json", bytes.NewBufferString(`{"url": "http://webhook-receiver:8080/hooks", "secret": "`+string(webhookSecret)+`"}`))
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	var webhook Webhook
+	err = json.NewDecoder(resp.Body).Decode(&webhook)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("couldn't decode response: %s", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusCreated, resp.StatusCode)
+	}
+
+	resp = putOrder(t, uri, "order-1234", OrderStatusPaid, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	// the receiver fails the first attempt, the notification arrives on retry
+	var events []WebhookEvent
+	testhelpers.Eventually(t, 30*time.Second, 500*time.Millisecond, func() error {
+		resp, err := http.Get(runningContainers.webhookReceiver.URI + "/received")
+		if err != nil {
+			t.Fatalf("couldn't do request: %q", err)
 		}
-		if err := runningContainers.app.Terminate(ctx); err != nil {
-			t.Fatalf("failed to terminate container: %s", err)
+		err = json.NewDecoder(resp.Body).Decode(&events)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("couldn't decode response: %s", err)
 		}
-		if err := runningContainers.redis.Terminate(ctx); err != nil {
-			t.Fatalf("failed to terminate container: %s", err)
+		if len(events) == 0 {
+			return errors.New("expected the receiver to be notified")
 		}
+		return nil
 	})
 
-	// make request to the app container
-	url := fmt.Sprintf("%s/orders/order-1234", runningContainers.app.URI)
-	payload := []byte(`{"status": "PAID"}`)
+	expected := Order{ID: "order-1234", Status: OrderStatusPaid}
+	if len(events) != 1 || events[0].Type != webhookEventStatusChanged || !reflect.DeepEqual(events[0].Order, expected) {
+		t.Fatalf("expected a single %s event for %v. Got %v.", webhookEventStatusChanged, expected, events)
+	}
 
-	req, err := http.NewRequest(http.MethodPut, url, bytes.NewBuffer(payload))
+	// the receiver only records the notifications signed with the secret
+	forged, err := http.NewRequest(http.MethodPost, runningContainers.webhookReceiver.URI+"/hooks", bytes.NewBufferString(`{"type":"order.status_changed"}`))
 	if err != nil {
-		t.Fatalf("couldn't create PUT request: %q", err)
+		t.Fatalf("couldn't create request: %q", err)
+	}
+	forged.Header.Set(headerWebhookSignature, webhookSignature("other-secret", []byte(`{"type":"order.status_changed"}`)))
+	resp, err = http.DefaultClient.Do(forged)
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusUnauthorized, resp.StatusCode)
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	// the delivery is recorded right after the receiver answered
+	testhelpers.Eventually(t, 10*time.Second, 200*time.Millisecond, func() error {
+		resp, err := http.Get(uri + "/webhooks/" + webhook.ID)
+		if err != nil {
+			t.Fatalf("couldn't do request: %q", err)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&webhook)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("couldn't decode response: %s", err)
+		}
+		if webhook.Delivery.Delivered == 0 {
+			return errors.New("expected the delivery to be recorded")
+		}
+		return nil
+	})
+	if webhook.Delivery.Delivered != 1 || webhook.Delivery.LastStatusCode != http.StatusOK {
+		t.Fatalf("expected a successful delivery to be recorded. Got %+v.", webhook.Delivery)
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, uri+"/webhooks/"+webhook.ID, nil)
+	if err != nil {
+		t.Fatalf("couldn't create DELETE request: %q", err)
+	}
+	resp, err = http.DefaultClient.Do(req)
 	if err != nil {
 		t.Fatalf("couldn't do request: %q", err)
 	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusNoContent, resp.StatusCode)
+	}
+}
 
-	// check response status
-	if resp.StatusCode != http.StatusOK {
-		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+// TestIntegrationWebhookCACertificates checks that the image ships the CA
+// certificates the webhook receivers served over HTTPS are verified with. The
+// receivers of the tests are served over plain HTTP, as an HTTPS one would
+// need a certificate of a public CA to be verified through the image alone.
+func TestIntegrationWebhookCACertificates(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers, err := setupApp(ctx, t, WithoutSidecar())
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if string(body) != "Order updated" {
-		t.Fatalf("expected body \"Order updated\". Got %s.", body)
+	r, err := runningContainers.app.CopyFileFromContainer(ctx, "/etc/ssl/certs/ca-certificates.crt")
+	if err != nil {
+		t.Fatalf("couldn't copy the CA certificates from the app: %s", err)
+	}
+	defer r.Close()
+	bundle, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("couldn't read the CA certificates: %s", err)
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(bundle) {
+		t.Fatal("expected the image to hold CA certificates")
 	}
+}
+func TestIntegrationWebSocketOrderUpdates(t *testing.T) {
+	runningContainers := sharedStack(t)
 
-	log.Println("Waiting for event to be published in orders topic")
-	ok := <-receivedEvent
-	log.Printf("Event received: %t\n", ok)
+	uri := runningContainers.app.URI
+	wsURL := "ws" + strings.TrimPrefix(uri, "http") + "/ws?orders=order-1234"
+	conn, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("couldn't dial %s: %s", wsURL, err)
+	}
+	resp.Body.Close()
+	defer conn.Close()
+
+	// only the events of order-1234 are pushed to the connection
+	for _, id := range []string{"order-5678", "order-1234"} {
+		resp := putOrder(t, uri, id, OrderStatusPaid, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	var msg WSMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("couldn't read message: %s", err)
+	}
+	expected := Order{ID: "order-1234", Status: OrderStatusPaid}
+	if msg.Type != wsMessageOrder || msg.Order == nil || !reflect.DeepEqual(*msg.Order, expected) {
+		t.Fatalf("expected an order message for %v. Got %+v.", expected, msg)
+	}
+
+	err = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err != nil {
+		t.Fatalf("couldn't close connection: %s", err)
+	}
+}
+
+func TestIntegrationMultiTenancy(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers, err := setupApp(ctx, t, WithAppEnv(map[string]string{
+		"MULTI_TENANCY":    "true",
+		"TENANT_ALLOWLIST": "acme,globex",
+	}))
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri := runningContainers.app.URI
+	tenant := func(id string) http.Header {
+		return http.Header{headerTenantID: {id}}
+	}
+
+	// requests must name an allowed tenant
+	for header, expected := range map[string]int{"": http.StatusBadRequest, "initech": http.StatusForbidden} {
+		h := http.Header{}
+		if header != "" {
+			h = tenant(header)
+		}
+		resp := putOrder(t, uri, "order-1234", OrderStatusPaid, h)
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("expected status code %d for tenant %q. Got %d.", expected, header, resp.StatusCode)
+		}
+	}
+
+	// the same order ID is independent across tenants
+	for _, id := range []string{"acme", "globex"} {
+		resp := putOrder(t, uri, "order-1234", OrderStatusPending, tenant(id))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+		}
+	}
+	resp := putOrder(t, uri, "order-1234", OrderStatusPaid, tenant("acme"))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	for id, expected := range map[string]OrderStatus{"acme": OrderStatusPaid, "globex": OrderStatusPending} {
+		req, err := http.NewRequest(http.MethodGet, uri+"/orders", nil)
+		if err != nil {
+			t.Fatalf("couldn't create GET request: %q", err)
+		}
+		req.Header = tenant(id)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("couldn't do request: %q", err)
+		}
+		var list OrderList
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("couldn't decode response: %s", err)
+		}
+
+		want := []Order{{ID: "order-1234", Status: expected, Tenant: id}}
+		if !reflect.DeepEqual(list.Items, want) {
+			t.Fatalf("expected orders %v for tenant %s. Got %v.", want, id, list.Items)
+		}
+	}
+
+	// events carry their tenant
+	events := waitForOrderEvents(ctx, t, runningContainers, 3)
+	for _, order := range events {
+		if order.Tenant != "acme" && order.Tenant != "globex" {
+			t.Fatalf("expected events to carry their tenant. Got %v.", events)
+		}
+	}
+}
+
+func TestIntegrationAvroEvents(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers, err := setupApp(ctx, t, WithSchemaRegistry())
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := putOrder(t, runningContainers.app.URI, "order-1234", OrderStatusPaid, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	events, err := runningContainers.waitForEvents(ctx, 1)
+	if err != nil {
+		t.Fatalf("couldn't receive events: %s", err)
+	}
+	e := events[0]
+	order, err := decodeOrderEvent(e)
+	if err != nil {
+		t.Fatalf("couldn't decode event: %s", err)
+	}
+	if e.DataContentType != contentTypeAvro || order.ID != "order-1234" || order.Status != OrderStatusPaid {
+		t.Fatalf("expected an avro event for order-1234 paid. Got %s %v.", e.DataContentType, order)
+	}
+
+	// the schema was registered under the subject of the topic
+	registryResp, err := http.Get(runningContainers.schemaRegistry.URI + "/subjects/" + topicOrders + "-value/versions")
+	if err != nil {
+		t.Fatalf("couldn't list schema versions: %s", err)
+	}
+	defer registryResp.Body.Close()
+	var versions []int
+	if err := json.NewDecoder(registryResp.Body).Decode(&versions); err != nil {
+		t.Fatalf("couldn't decode schema versions: %s", err)
+	}
+	if len(versions) != 1 {
+		t.Fatalf("expected a single schema version. Got %v.", versions)
+	}
+}
+
+func TestIntegrationDeepHealth(t *testing.T) {
+	runningContainers := sharedStack(t)
+
+	resp, err := http.Get(runningContainers.app.URI + "/healthz/deep")
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	var report HealthReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("couldn't decode report: %s", err)
+	}
+	pubsub, err := readComponent(runningContainers.pubsubComponent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, component := range report.Components {
+		if component.Name == pubsubName && component.Type == pubsub.Type && component.Status == healthStatusOK {
+			return
+		}
+	}
+	t.Fatalf("expected %s to be healthy. Got %+v.", pubsubName, report.Components)
+}
+
+func TestIntegrationHealthz(t *testing.T) {
+	runningContainers := sharedStack(t)
+
+	resp, err := http.Get(runningContainers.app.URI + "/healthz")
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	var report CheckReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("couldn't decode report: %s", err)
+	}
+	if report.Status != healthStatusOK {
+		t.Fatalf("expected the app healthy. Got %+v.", report.Checks)
+	}
+	var names []string
+	for _, check := range report.Checks {
+		names = append(names, check.Name)
+	}
+	if expected := []string{"dapr", pubsubName, stateStoreName}; !slices.Equal(names, expected) {
+		t.Fatalf("expected checks %v. Got %v.", expected, names)
+	}
+}
+
+func TestIntegrationBatchPut(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers := sharedStack(t)
+
+	body := []byte(`[{"id":"order-0001","status":"PAID"},{"id":"order-0002","status":"PENDING"},{"id":"order-0003","status":"PAID"}]`)
+	req, err := http.NewRequest(http.MethodPut, runningContainers.app.URI+"/orders", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("couldn't create PUT request: %q", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	defer resp.Body.Close()
+
+	var results []BatchResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatalf("couldn't decode results: %s", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results. Got %v.", results)
+	}
+	for _, result := range results {
+		if result.Status != http.StatusOK {
+			t.Fatalf("expected every update to succeed. Got %v.", results)
+		}
+	}
+
+	ids := map[string]bool{}
+	for _, order := range waitForOrderEvents(ctx, t, runningContainers, 3) {
+		ids[order.ID] = true
+	}
+	if len(ids) != 3 {
+		t.Fatalf("expected an event per order. Got %v.", ids)
+	}
+}
+
+func TestIntegrationRabbitMQ(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers, err := setupApp(ctx, t, WithPubsub(pubsubRabbitMQ))
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := putOrder(t, runningContainers.app.URI, "order-1234", OrderStatusPaid, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+	if order := waitForOrderEvents(ctx, t, runningContainers, 1)[0]; order.ID != "order-1234" || order.Status != OrderStatusPaid {
+		t.Fatalf("expected event order id=order-1234, status=paid. Got %v.", order)
+	}
+
+	management, err := endpoint(ctx, runningContainers.broker, "15672/tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	getManagement := func(path string, v any) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, "http://"+management+"/api"+path, nil)
+		if err != nil {
+			t.Fatalf("couldn't create GET request: %q", err)
+		}
+		req.SetBasicAuth(rabbitMQUser, rabbitMQPassword)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("couldn't do request: %q", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d for %s. Got %d.", http.StatusOK, path, resp.StatusCode)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("couldn't decode %s: %s", path, err)
+		}
+	}
+
+	// the topic is a durable fanout exchange
+	var exchange struct {
+		Type    string `json:"type"`
+		Durable bool   `json:"durable"`
+	}
+	getManagement("/exchanges/%2F/"+topicOrders, &exchange)
+	if exchange.Type != "fanout" || !exchange.Durable {
+		t.Fatalf("expected a durable fanout exchange. Got %+v.", exchange)
+	}
+
+	// each subscribing app gets a queue of its own, bound to the exchange
+	var bindings []struct {
+		Destination     string `json:"destination"`
+		DestinationType string `json:"destination_type"`
+	}
+	getManagement("/exchanges/%2F/"+topicOrders+"/bindings/source", &bindings)
+	queues := map[string]bool{}
+	for _, binding := range bindings {
+		if binding.DestinationType == "queue" {
+			queues[binding.Destination] = true
+		}
+	}
+	for _, queue := range []string{"app-" + topicOrders, "integration-" + topicOrders} {
+		if !queues[queue] {
+			t.Fatalf("expected queue %s to be bound to the exchange. Got %v.", queue, bindings)
+		}
+	}
+}
+
+func TestIntegrationPostgresState(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers := sharedStack(t)
+
+	// the component creates its tables when the sidecar starts, and records
+	// the migrations it applied
+	tables, err := runningContainers.psql(ctx, "SELECT tablename FROM pg_tables WHERE schemaname = 'public' ORDER BY tablename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tables != "dapr_metadata\nstate" {
+		t.Fatalf("expected tables dapr_metadata and state. Got %q.", tables)
+	}
+	migrations, err := runningContainers.psql(ctx, "SELECT value FROM dapr_metadata WHERE key = 'migrations'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrations == "" {
+		t.Fatal("expected the applied migrations to be recorded")
+	}
+
+	for _, status := range []OrderStatus{OrderStatusPending, OrderStatusPaid} {
+		resp := putOrder(t, runningContainers.app.URI, "order-1234", status, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	// keys are prefixed with the app ID, and JSON values stored as jsonb
+	row, err := runningContainers.psql(ctx, "SELECT value->>'id', value->>'status', isbinary, updatedate IS NOT NULL FROM state WHERE key = 'app||order-1234'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "order-1234|PAID|f|t"; row != expected {
+		t.Fatalf("expected row %q. Got %q.", expected, row)
+	}
+}
+
+func TestIntegrationPlacement(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers, err := setupApp(ctx, t, WithPlacement())
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	daprHTTP, err := runningContainers.daprApp.HTTPEndpoint(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the sidecar connects to the placement service in the background
+	testhelpers.Eventually(t, 30*time.Second, 500*time.Millisecond, func() error {
+		resp, err := http.Get(daprHTTP + "/v1.0/metadata")
+		if err != nil {
+			t.Fatalf("couldn't do request: %q", err)
+		}
+		var metadata struct {
+			ActorRuntime struct {
+				Placement string `json:"placement"`
+			} `json:"actorRuntime"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&metadata)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("couldn't decode metadata: %s", err)
+		}
+		if placement := metadata.ActorRuntime.Placement; !strings.HasSuffix(placement, ": connected") {
+			return fmt.Errorf("expected the sidecar to connect to the placement service. Got %q.", placement)
+		}
+		return nil
+	})
+}
+
+func TestIntegrationJobs(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers, err := setupApp(ctx, t, WithScheduler())
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	daprHTTP, err := runningContainers.daprIntegration.HTTPEndpoint(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"dueTime": "1s", "data": {"orderId": "order-1234"}}`)
+	resp, err := http.Post(daprHTTP+"/v1.0-alpha1/jobs/order-reminder", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status code %d. Got %d: %s.", http.StatusNoContent, resp.StatusCode, data)
+	}
+
+	// the scheduler calls the subscriber back once the job is due
+	testhelpers.Eventually(t, *eventsTimeout, 500*time.Millisecond, func() error {
+		jobs, err := runningContainers.triggeredJobs(ctx)
+		if err != nil {
+			return err
+		}
+		if len(jobs) == 0 {
+			return errors.New("expected the job to be triggered")
+		}
+		if jobs[0].Name != "order-reminder" || !bytes.Contains(jobs[0].Data, []byte("order-1234")) {
+			t.Fatalf("expected job order-reminder for order-1234. Got %s %s.", jobs[0].Name, jobs[0].Data)
+		}
+		return nil
+	})
+}
+
+func TestIntegrationMTLS(t *testing.T) {
+	ctx := context.Background()
+
+	// with mTLS enabled, sidecars only report initialized once Sentry issued
+	// their certificate
+	runningContainers, err := setupApp(ctx, t, WithMTLS())
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := putOrder(t, runningContainers.app.URI, "order-1234", OrderStatusPaid, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+	if order := waitForOrderEvents(ctx, t, runningContainers, 1)[0]; order.ID != "order-1234" || order.Status != OrderStatusPaid {
+		t.Fatalf("expected event order id=order-1234, status=paid. Got %v.", order)
+	}
+}
+
+func TestIntegrationTracing(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers, err := setupApp(ctx, t, WithTracing())
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the request goes through the sidecar of the app, which starts its span
+	// in the trace of the traceparent header
+	daprHTTP, err := runningContainers.daprApp.HTTPEndpoint(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, err := newPutOrderRequest(daprHTTP+"/v1.0/invoke/app/method", "order-1234", OrderStatusPaid, http.Header{
+		headerTraceparent: {"00-" + traceID + "-00f067aa0ba902b7-01"},
+	})
+	if err != nil {
+		t.Fatalf("couldn't create PUT request: %q", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	// a request made straight to the app hands its trace context, tracestate
+	// included, to the sidecar of the app itself
+	const directTraceID = "0af7651916cd43dd8448eb211c80319c"
+	resp = putOrder(t, runningContainers.app.URI, "order-5678", OrderStatusPaid, http.Header{
+		headerTraceparent: {"00-" + directTraceID + "-b7ad6b7169203331-01"},
+		headerTracestate:  {"vendor=value"},
+	})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	// the subscriber receives every event in the trace of its request
+	events, err := runningContainers.waitForEvents(ctx, 2)
+	if err != nil {
+		t.Fatalf("couldn't receive events: %s", err)
+	}
+	type eventTrace struct {
+		id, state string
+	}
+	expected := map[string]eventTrace{
+		"order-1234": {id: traceID},
+		"order-5678": {id: directTraceID, state: "vendor=value"},
+	}
+	for _, e := range events {
+		order, err := decodeOrderEvent(e)
+		if err != nil {
+			t.Fatalf("couldn't decode event %s: %s", e.ID, err)
+		}
+		var envelope struct {
+			Traceparent string `json:"traceparent"`
+			Tracestate  string `json:"tracestate"`
+		}
+		if err := json.Unmarshal(e.Envelope, &envelope); err != nil {
+			t.Fatalf("couldn't decode CloudEvent %s: %s", e.ID, err)
+		}
+		// the sidecars add spans of their own to the trace, only its ID
+		// is kept
+		fields := strings.Split(envelope.Traceparent, "-")
+		if len(fields) != 4 || fields[1] != expected[order.ID].id {
+			t.Fatalf("expected the event of %s in trace %s. Got traceparent %q.", order.ID, expected[order.ID].id, envelope.Traceparent)
+		}
+		if expected[order.ID].state != "" && envelope.Tracestate != expected[order.ID].state {
+			t.Fatalf("expected the event of %s with tracestate %s. Got %q.", order.ID, expected[order.ID].state, envelope.Tracestate)
+		}
+	}
+
+	type span struct {
+		OperationName string `json:"operationName"`
+		ProcessID     string `json:"processID"`
+	}
+	var trace struct {
+		Spans     []span `json:"spans"`
+		Processes map[string]struct {
+			ServiceName string `json:"serviceName"`
+		} `json:"processes"`
+	}
+
+	// the trace holds the span of the HTTP request and the publish by the
+	// sidecar of the app, and the delivery by the sidecar of the subscriber
+	hasSpans := func() bool {
+		var invoke, publish, deliver bool
+		for _, s := range trace.Spans {
+			service := trace.Processes[s.ProcessID].ServiceName
+			switch {
+			case service == "app" && strings.Contains(s.OperationName, "/v1.0/invoke/app/method/orders"):
+				invoke = true
+			case service == "app" && strings.Contains(s.OperationName, "PublishEvent"):
+				publish = true
+			case service == "integration":
+				deliver = true
+			}
+		}
+		return invoke && publish && deliver
+	}
+
+	// spans reach Jaeger in batches
+	testhelpers.Eventually(t, *eventsTimeout, time.Second, func() error {
+		resp, err := http.Get(runningContainers.jaeger.URI + "/api/traces/" + traceID)
+		if err != nil {
+			t.Fatalf("couldn't do request: %q", err)
+		}
+		var body struct {
+			Data []json.RawMessage `json:"data"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err == nil && len(body.Data) == 1 {
+			if err := json.Unmarshal(body.Data[0], &trace); err != nil {
+				t.Fatalf("couldn't decode trace: %s", err)
+			}
+			if hasSpans() {
+				return nil
+			}
+		}
+		return fmt.Errorf("expected trace %s to span the request, the publish and the delivery. Got %+v.", traceID, trace)
+	})
+}
+
+func TestIntegrationPrometheus(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers, err := setupApp(ctx, t, WithPrometheus())
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// waitForMetric polls query until its sample satisfies cond
+	waitForMetric := func(query string, cond func(v float64, ok bool) bool) float64 {
+		t.Helper()
+		var v float64
+		testhelpers.Eventually(t, *eventsTimeout, prometheusScrapeInterval, func() error {
+			var ok bool
+			v, ok, err = runningContainers.promQuery(ctx, query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cond(v, ok) {
+				return fmt.Errorf("expected %s to change. Got %v (sample: %t).", query, v, ok)
+			}
+			return nil
+		})
+		return v
+	}
+
+	// the app and both sidecars are scraped
+	waitForMetric(`count(up == 1)`, func(v float64, ok bool) bool { return ok && v == 3 })
+	waitForMetric(`count(count by (app_id) (dapr_runtime_component_loaded))`, func(v float64, ok bool) bool { return ok && v == 2 })
+
+	const published = `sum(order_published_total{job="app", topic="orders"})`
+	before, _, err := runningContainers.promQuery(ctx, published)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := newPutOrderRequest(runningContainers.app.URI, "order-1234", OrderStatusPaid, nil)
+	if err != nil {
+		t.Fatalf("couldn't create PUT request: %q", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	after := waitForMetric(published, func(v float64, ok bool) bool { return ok && v > before })
+	if after != before+1 {
+		t.Fatalf("expected order_published_total to increment by 1 from %v. Got %v.", before, after)
+	}
+}
+
+func TestIntegrationPubsubMatrix(t *testing.T) {
+	tests := []struct {
+		broker string
+		// slow brokers are skipped in -short mode
+		slow bool
+	}{
+		{broker: pubsubRedis},
+		{broker: pubsubInMemory},
+		{broker: pubsubKafka, slow: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.broker, func(t *testing.T) {
+			if tt.slow && testing.Short() {
+				t.Skipf("skipping %s in short mode", tt.broker)
+			}
+			ctx := context.Background()
+
+			runningContainers, err := setupApp(ctx, t, WithPubsub(tt.broker))
+			t.Cleanup(func() {
+				if err := runningContainers.Terminate(ctx); err != nil {
+					t.Fatalf("failed to terminate stack: %s", err)
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			uri := runningContainers.app.URI
+			wsURL := "ws" + strings.TrimPrefix(uri, "http") + "/ws?orders=order-1234"
+			conn, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+			if err != nil {
+				t.Fatalf("couldn't dial %s: %s", wsURL, err)
+			}
+			resp.Body.Close()
+			defer conn.Close()
+
+			expected := []Order{
+				{ID: "order-1234", Status: OrderStatusPending},
+				{ID: "order-1234", Status: OrderStatusPaid},
+			}
+			for _, order := range expected {
+				resp := putOrder(t, uri, order.ID, order.Status, nil)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+				}
+			}
+
+			// the app subscribes through its own sidecar, which every broker
+			// delivers to, in order
+			conn.SetReadDeadline(time.Now().Add(*eventsTimeout))
+			for _, order := range expected {
+				var msg WSMessage
+				if err := conn.ReadJSON(&msg); err != nil {
+					t.Fatalf("couldn't read message: %s", err)
+				}
+				if msg.Type != wsMessageOrder || msg.Order == nil || !reflect.DeepEqual(*msg.Order, order) {
+					t.Fatalf("expected an order message for %v. Got %+v.", order, msg)
+				}
+			}
+
+			// events of local brokers don't leave the sidecar of the app
+			if pubsubBrokers[tt.broker].local {
+				return
+			}
+			if events := waitForOrderEvents(ctx, t, runningContainers, len(expected)); !reflect.DeepEqual(events, expected) {
+				t.Fatalf("expected events %v. Got %v.", expected, events)
+			}
+		})
+	}
+}
+
+func TestIntegrationPublishFailure(t *testing.T) {
+	ctx := context.Background()
+
+	// a single short attempt, so that failures are answered quickly
+	runningContainers, err := setupApp(ctx, t, WithPubsub(pubsubRedis), WithAppEnv(map[string]string{
+		"PUBLISH_RETRY_ATTEMPTS": "1",
+		"DAPR_PUBLISH_TIMEOUT":   "2s",
+	}))
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri := runningContainers.app.URI
+	resp := putOrder(t, uri, "order-1111", OrderStatusPending, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	// failed publishes are timed too, but aren't counted as successes
+	const (
+		successes = `order_publish_outcomes_total{error_class="none",outcome="success",topic="orders"}`
+		timed     = `order_publish_duration_seconds_count{topic="orders"}`
+	)
+	if got := appCounter(t, uri, successes); got != 1 {
+		t.Fatalf("expected %s to be 1. Got %v.", successes, got)
+	}
+	timedBefore := appCounter(t, uri, timed)
+
+	// the broker goes away while the state store, in Postgres, stays up
+	timeout := 10 * time.Second
+	if err := runningContainers.redis.Stop(ctx, &timeout); err != nil {
+		t.Fatalf("couldn't stop redis: %s", err)
+	}
+
+	tests := []struct {
+		id string
+		// expected is the status code of GET once the update failed, and
+		// status the stored status, if any
+		expected int
+		status   OrderStatus
+	}{
+		{id: "order-1111", expected: http.StatusOK, status: OrderStatusPending},
+		{id: "order-2222", expected: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		resp := putOrder(t, uri, tt.id, OrderStatusPaid, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("expected status code %d for %s. Got %d.", http.StatusServiceUnavailable, tt.id, resp.StatusCode)
+		}
+
+		// the update was reverted
+		resp, err := http.Get(fmt.Sprintf("%s/orders/%s", uri, tt.id))
+		if err != nil {
+			t.Fatalf("couldn't do request: %q", err)
+		}
+		var order Order
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&order)
+		}
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("couldn't decode response: %s", err)
+		}
+		if resp.StatusCode != tt.expected || order.Status != tt.status {
+			t.Fatalf("expected %s to be stored with status %q (%d). Got %q (%d).", tt.id, tt.status, tt.expected, order.Status, resp.StatusCode)
+		}
+	}
+
+	if got := appCounter(t, uri, successes); got != 1 {
+		t.Fatalf("expected %s to stay at 1. Got %v.", successes, got)
+	}
+	if got := appCounter(t, uri, timed); got != timedBefore+float64(len(tests)) {
+		t.Fatalf("expected %s to increment by %d from %v. Got %v.", timed, len(tests), timedBefore, got)
+	}
+}
+
+// appCounter returns the value of the series of the app metrics, such as
+// `order_published_total{topic="orders"}`, 0 if it wasn't incremented yet.
+func appCounter(t *testing.T, uri, series string) float64 {
+	t.Helper()
+
+	resp, err := http.Get(uri + "/metrics")
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("couldn't read metrics: %s", err)
+	}
+	for _, line := range strings.Split(string(body), "\n") {
+		if value, ok := strings.CutPrefix(line, series+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("couldn't parse %s: %s", series, err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestIntegrationToxiproxy(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers, err := setupApp(ctx, t, WithToxiproxy(), WithAppEnv(map[string]string{
+		"PUBLISH_RETRY_ATTEMPTS":       "2",
+		"DAPR_PUBLISH_TIMEOUT":         "1s",
+		"DAPR_STATE_TIMEOUT":           "2s",
+		"CIRCUIT_BREAKER_OPEN_TIMEOUT": "1s",
+	}))
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri := runningContainers.app.URI
+	api := runningContainers.toxiproxyAPI()
+
+	// withToxic runs f while toxic alters the traffic of proxy
+	withToxic := func(t *testing.T, proxy string, toxic toxic, f func()) {
+		t.Helper()
+		if err := api.addToxic(ctx, proxy, toxic); err != nil {
+			t.Fatalf("couldn't add toxic: %s", err)
+		}
+		defer func() {
+			if err := api.removeToxic(ctx, proxy, toxic.Name); err != nil {
+				t.Fatalf("couldn't remove toxic: %s", err)
+			}
+		}()
+		f()
+	}
+
+	// waitForUpdate retries the update of id until it succeeds, once the
+	// client reconnected and the circuit closed
+	waitForUpdate := func(t *testing.T, id string, status OrderStatus) {
+		t.Helper()
+		testhelpers.Eventually(t, *eventsTimeout, 500*time.Millisecond, func() error {
+			resp := putOrder(t, uri, id, status, nil)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("expected the update of %s to succeed again. Got %d.", id, resp.StatusCode)
+			}
+			return nil
+		})
+	}
+
+	t.Run("broker latency times out publishes", func(t *testing.T) {
+		const retries = `order_publish_retries_total{topic="orders"}`
+		before := appCounter(t, uri, retries)
+
+		withToxic(t, proxyRedis, toxic{Name: "latency", Type: "latency", Attributes: map[string]int{"latency": 3000}}, func() {
+			start := time.Now()
+			resp := putOrder(t, uri, "order-1111", OrderStatusPaid, nil)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusServiceUnavailable {
+				t.Fatalf("expected status code %d. Got %d.", http.StatusServiceUnavailable, resp.StatusCode)
+			}
+			// two attempts of 1s, and a short backoff in between
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Fatalf("expected publishing to time out. Took %s.", elapsed)
+			}
+		})
+
+		if after := appCounter(t, uri, retries); after != before+1 {
+			t.Fatalf("expected %s to increment by 1 from %v. Got %v.", retries, before, after)
+		}
+		waitForUpdate(t, "order-1111", OrderStatusPaid)
+	})
+
+	t.Run("sidecar resets fail fast", func(t *testing.T) {
+		withToxic(t, proxySidecar, toxic{Name: "reset", Type: "reset_peer"}, func() {
+			start := time.Now()
+			resp := putOrder(t, uri, "order-2222", OrderStatusPaid, nil)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusServiceUnavailable {
+				t.Fatalf("expected status code %d. Got %d.", http.StatusServiceUnavailable, resp.StatusCode)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Fatalf("expected the update to fail fast. Took %s.", elapsed)
+			}
+		})
+
+		waitForUpdate(t, "order-2222", OrderStatusPaid)
+	})
+
+	t.Run("slow sidecar link is tolerated", func(t *testing.T) {
+		// a few KB/s, slow but enough for the small messages of the app
+		withToxic(t, proxySidecar, toxic{Name: "bandwidth", Type: "bandwidth", Attributes: map[string]int{"rate": 4}}, func() {
+			resp := putOrder(t, uri, "order-3333", OrderStatusPaid, nil)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+			}
+		})
+	})
+
+	// the events of the successful updates made it through; publishes which
+	// timed out may have reached the broker all the same, so only the
+	// presence of each event is checked
+	ids := map[string]bool{}
+	for _, order := range waitForOrderEvents(ctx, t, runningContainers, 3) {
+		ids[order.ID] = true
+	}
+	for _, id := range []string{"order-1111", "order-2222", "order-3333"} {
+		if !ids[id] {
+			t.Fatalf("expected an event for %s. Got %v.", id, ids)
+		}
+	}
+}
+
+func TestIntegrationCloudEventGolden(t *testing.T) {
+	ctx := context.Background()
+	runningContainers := sharedStack(t)
+
+	for _, status := range []OrderStatus{OrderStatusPending, OrderStatusPaid} {
+		resp := putOrder(t, runningContainers.app.URI, "order-1234", status, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	events, err := runningContainers.waitForEvents(ctx, 2)
+	if err != nil {
+		t.Fatalf("couldn't receive events: %s", err)
+	}
+	// the transition carries a previous status, unlike the creation
+	envelope, err := normalizeCloudEvent(events[1].Envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGolden(t, "order-status-changed.json", envelope)
+}
+
+func TestIntegrationUnreachableSidecar(t *testing.T) {
+	ctx := context.Background()
+
+	// short state timeouts, so that the answer doesn't wait on the default
+	runningContainers, err := setupApp(ctx, t, WithoutSidecar(), WithAppEnv(map[string]string{
+		"DAPR_STATE_TIMEOUT": "2s",
+	}))
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := runningContainers.app.URI
+
+	// the app runs, but isn't ready, waiting for its sidecar
+	resp, err := http.Get(uri + "/readyz")
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != "not ready: waiting for the sidecar\n" {
+		t.Fatalf("expected /readyz to report the app waiting for its sidecar. Got %d: %s", resp.StatusCode, body)
+	}
+
+	// updates are held rather than hang or succeed
+	client := &http.Client{Timeout: 30 * time.Second}
+	req, err := newPutOrderRequest(uri, "order-1234", OrderStatusPaid, nil)
+	if err != nil {
+		t.Fatalf("couldn't create PUT request: %q", err)
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected status code %d with Retry-After. Got %d.", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
+
+func TestIntegrationMissingComponent(t *testing.T) {
+	ctx := context.Background()
+
+	// the sidecar loads no pubsub component by that name
+	runningContainers, err := setupApp(ctx, t, WithAppEnv(map[string]string{
+		"PUBSUB_NAME": "missing-pub-sub",
+	}))
+	if runningContainers != nil {
+		t.Cleanup(func() {
+			if err := runningContainers.Terminate(ctx); err != nil {
+				t.Fatalf("failed to terminate stack: %s", err)
+			}
+		})
+	}
+	// any other error, e.g. Docker being unavailable, fails the test
+	var notReady *appNotReadyError
+	if !errors.As(err, &notReady) {
+		t.Fatalf("expected the app never to be ready. Got %v.", err)
+	}
+	if runningContainers == nil || runningContainers.app == nil {
+		t.Fatal("expected the app to be started.")
+	}
+
+	// the app exits once the sidecar answers, naming the component
+	testhelpers.Eventually(t, time.Minute, time.Second, func() error {
+		state, err := runningContainers.app.State(ctx)
+		if err != nil {
+			return err
+		}
+		if state.Running {
+			return errors.New("app still running")
+		}
+		return nil
+	})
+	logs, err := runningContainers.app.Logs(ctx)
+	if err != nil {
+		t.Fatalf("couldn't get logs: %s", err)
+	}
+	data, err := io.ReadAll(logs)
+	logs.Close()
+	if err != nil {
+		t.Fatalf("couldn't read logs: %s", err)
+	}
+	if !strings.Contains(string(data), "required component not loaded by the sidecar") || !strings.Contains(string(data), `"component":"missing-pub-sub"`) {
+		t.Fatalf("expected the missing component logged. Got %s", data)
+	}
+}
+
+func TestIntegrationRedisStream(t *testing.T) {
+	ctx := context.Background()
+	runningContainers := sharedStack(t)
+	if runningContainers.options.pubsub != pubsubRedis {
+		t.Skipf("the stream is only stored by the %s broker", pubsubRedis)
+	}
+
+	for _, status := range []OrderStatus{OrderStatusPending, OrderStatusPaid} {
+		resp := putOrder(t, runningContainers.app.URI, "order-1234", status, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	// the entries are stored once published, the subscriber receiving them
+	// tells they all are
+	waitForOrderEvents(ctx, t, runningContainers, 2)
+	entries, err := runningContainers.readStream(ctx, topicOrders)
+	if err != nil {
+		t.Fatalf("couldn't read stream: %s", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries in the %s stream. Got %d: %v.", topicOrders, len(entries), entries)
+	}
+
+	// the broker stores the CloudEvent as delivered to subscribers
+	data, ok := entries[1].Fields["data"]
+	if !ok {
+		t.Fatalf("expected entry %s to hold the event in its data field. Got %v.", entries[1].ID, entries[1].Fields)
+	}
+	envelope, err := normalizeCloudEvent([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGolden(t, "order-status-changed.json", envelope)
+}
+
+func TestIntegrationReplicas(t *testing.T) {
+	ctx := context.Background()
+	if pubsubBrokers[*pubsubFlag].local {
+		t.Skipf("the replicas don't share the %s broker", *pubsubFlag)
+	}
+
+	runningContainers, err := setupApp(ctx, t, WithReplica())
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicas := []*appContainer{runningContainers.app, runningContainers.replica}
+
+	// each replica pushes the events its sidecar delivers to its WebSocket
+	// clients
+	var mu sync.Mutex
+	delivered := map[string][]int{}
+	for i, replica := range replicas {
+		wsURL := "ws" + strings.TrimPrefix(replica.URI, "http") + "/ws"
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("couldn't dial %s: %s", wsURL, err)
+		}
+		resp.Body.Close()
+		t.Cleanup(func() { conn.Close() })
+
+		go func(replica int) {
+			for {
+				var msg WSMessage
+				if err := conn.ReadJSON(&msg); err != nil {
+					return
+				}
+				if msg.Type == wsMessageOrder && msg.Order != nil {
+					mu.Lock()
+					delivered[msg.Order.ID] = append(delivered[msg.Order.ID], replica)
+					mu.Unlock()
+				}
+			}
+		}(i)
+	}
+
+	// both replicas publish
+	const orders = 10
+	for i := 0; i < orders; i++ {
+		resp := putOrder(t, replicas[i%len(replicas)].URI, fmt.Sprintf("order-%d", 1000+i), OrderStatusPaid, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d from replica %d. Got %d.", http.StatusOK, i%len(replicas), resp.StatusCode)
+		}
+	}
+	waitForOrderEvents(ctx, t, runningContainers, orders)
+
+	// the replicas compete for the events of their subscription, each
+	// event being delivered to a single one
+	testhelpers.Eventually(t, *eventsTimeout, 500*time.Millisecond, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(delivered) != orders {
+			return fmt.Errorf("expected the events of %d orders to be delivered to the replicas. Got %v.", orders, delivered)
+		}
+		return nil
+	})
+	// redeliveries to the other replica would show up by now
+	time.Sleep(2 * time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	perReplica := make([]int, len(replicas))
+	for id, to := range delivered {
+		if len(to) != 1 {
+			t.Fatalf("expected the event of %s to be delivered to a single replica. Got replicas %v.", id, to)
+		}
+		perReplica[to[0]]++
+	}
+	t.Logf("events delivered per replica: %v", perReplica)
+}
+
+func TestIntegrationResiliency(t *testing.T) {
+	ctx := context.Background()
+
+	const failFirst = 3
+	runningContainers, err := setupApp(ctx, t, WithFlakySubscriber(failFirst))
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	resp := putOrder(t, runningContainers.app.URI, "order-1234", OrderStatusPaid, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	events, err := runningContainers.waitForEvents(ctx, 1)
+	if err != nil {
+		t.Fatalf("couldn't receive events: %s", err)
+	}
+	// the broker would only redeliver after the processing timeout of the
+	// component, 130s, whereas the sidecar retries every 500ms
+	if elapsed := time.Since(start); elapsed > 20*time.Second {
+		t.Fatalf("expected the sidecar to retry the delivery. Took %s.", elapsed)
+	}
+
+	attempts, err := runningContainers.deliveryAttempts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := attempts[events[0].ID]; got != failFirst+1 {
+		t.Fatalf("expected event %s to be delivered %d times. Got %d.", events[0].ID, failFirst+1, got)
+	}
+}
+
+func TestIntegrationBulkSubscribe(t *testing.T) {
+	ctx := context.Background()
+
+	const maxMessages = 5
+	runningContainers, err := setupApp(ctx, t, WithBulkSubscribe(maxMessages, 2*time.Second))
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a batch update publishes its events in a burst, which the sidecar
+	// delivers in bulk
+	updates := make([]string, 0, 20)
+	for i := 1; i <= cap(updates); i++ {
+		updates = append(updates, fmt.Sprintf(`{"id":"order-%04d","status":"PENDING"}`, i))
+	}
+	resp, body := doRequest(t, http.MethodPut, runningContainers.app.URI+"/orders", contentTypeJSON, "", []byte("["+strings.Join(updates, ",")+"]"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the batch to be updated with %d. Got %d: %s", http.StatusOK, resp.StatusCode, body)
+	}
+
+	if _, err := runningContainers.waitForEvents(ctx, len(updates)); err != nil {
+		t.Fatalf("couldn't receive events: %s", err)
+	}
+	batches, err := runningContainers.bulkDeliveries(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, n := range batches {
+		if n > maxMessages {
+			t.Fatalf("expected at most %d events per delivery. Got %v.", maxMessages, batches)
+		}
+		total += n
+	}
+	if total != len(updates) || len(batches) == len(updates) {
+		t.Fatalf("expected the %d events to be delivered in bulk. Got deliveries of %v.", len(updates), batches)
+	}
+}
+
+func TestIntegrationDeclarativeSubscription(t *testing.T) {
+	ctx := context.Background()
+	if pubsubBrokers[*pubsubFlag].local {
+		t.Skipf("the subscriber doesn't share the %s broker", *pubsubFlag)
+	}
+
+	runningContainers, err := setupApp(ctx, t, WithDeclarativeSubscription())
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the sidecar of the subscriber only knows of the subscription of
+	// subscription.yaml
+	daprHTTP, err := runningContainers.daprIntegration.HTTPEndpoint(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(daprHTTP + "/v1.0/metadata")
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	var metadata struct {
+		Subscriptions []struct {
+			PubsubName string `json:"pubsubname"`
+			Topic      string `json:"topic"`
+			Type       string `json:"type"`
+		} `json:"subscriptions"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&metadata)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("couldn't decode metadata: %s", err)
+	}
+	subs := metadata.Subscriptions
+	if len(subs) != 1 || subs[0].PubsubName != pubsubName || subs[0].Topic != topicOrders || subs[0].Type != "DECLARATIVE" {
+		t.Fatalf("expected a single declarative subscription to %s/%s. Got %+v.", pubsubName, topicOrders, subs)
+	}
+
+	resp = putOrder(t, runningContainers.app.URI, "order-1234", OrderStatusPaid, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+	order := waitForOrderEvents(ctx, t, runningContainers, 1)[0]
+	if order.ID != "order-1234" || order.Status != OrderStatusPaid {
+		t.Fatalf("expected event order id=order-1234, status=paid. Got %v.", order)
+	}
+}
+
+func TestIntegrationAppTLS(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers, err := setupApp(ctx, t, WithAppTLS())
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := runningContainers.app.URI
+	client := runningContainers.appClient()
+
+	// the app only serves HTTPS
+	resp, err := http.Get("http" + strings.TrimPrefix(uri, "https") + "/health")
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected plain HTTP to be refused with status code %d. Got %d.", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// the sidecar delivers the events of the app subscription over HTTPS,
+	// which the app pushes to its WebSocket clients
+	dialer := websocket.Dialer{TLSClientConfig: runningContainers.appTLS}
+	wsURL := "wss" + strings.TrimPrefix(uri, "https") + "/ws?orders=order-1234"
+	conn, resp, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("couldn't dial %s: %s", wsURL, err)
+	}
+	resp.Body.Close()
+	defer conn.Close()
+
+	req, err := newPutOrderRequest(uri, "order-1234", OrderStatusPaid, nil)
+	if err != nil {
+		t.Fatalf("couldn't create PUT request: %q", err)
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+	waitForOrderEvents(ctx, t, runningContainers, 1)
+
+	conn.SetReadDeadline(time.Now().Add(*eventsTimeout))
+	var msg WSMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("couldn't read message: %s", err)
+	}
+	expected := Order{ID: "order-1234", Status: OrderStatusPaid}
+	if msg.Type != wsMessageOrder || msg.Order == nil || !reflect.DeepEqual(*msg.Order, expected) {
+		t.Fatalf("expected an order message for %v. Got %+v.", expected, msg)
+	}
+}
+
+func TestIntegrationPayments(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers, err := setupApp(ctx, t, WithPayments("order-2222"))
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := runningContainers.app.URI
+
+	// only the changes to paid are verified
+	for _, id := range []string{"order-1111", "order-2222"} {
+		resp := putOrder(t, uri, id, OrderStatusPending, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d for %s. Got %d.", http.StatusOK, id, resp.StatusCode)
+		}
+	}
+
+	resp := putOrder(t, uri, "order-1111", OrderStatusPaid, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the approved payment to be accepted with %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	resp = putOrder(t, uri, "order-2222", OrderStatusPaid, nil)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("couldn't read response: %s", err)
+	}
+	if resp.StatusCode != http.StatusPaymentRequired || string(body) != "Payment declined: insufficient funds" {
+		t.Fatalf("expected the declined payment to be rejected with %d. Got %d: %s", http.StatusPaymentRequired, resp.StatusCode, body)
+	}
+
+	requests, err := runningContainers.paymentRequests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified := requests[paymentsMethodVerify]; !slices.Equal(verified, []string{"order-1111", "order-2222"}) {
+		t.Fatalf("expected the payments of order-1111 and order-2222 to be verified. Got %v.", verified)
+	}
+
+	// the declined order is still pending, and its change never published
+	resp, err = http.Get(uri + "/orders/order-2222")
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	var order Order
+	err = json.NewDecoder(resp.Body).Decode(&order)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("couldn't decode response: %s", err)
+	}
+	if order.Status != OrderStatusPending {
+		t.Fatalf("expected order-2222 to stay %s. Got %s.", OrderStatusPending, order.Status)
+	}
+
+	orders := waitForOrderEvents(ctx, t, runningContainers, 3)
+	if len(orders) != 3 || !slices.ContainsFunc(orders, func(o Order) bool {
+		return o.ID == "order-1111" && o.Status == OrderStatusPaid
+	}) {
+		t.Fatalf("expected the two pending orders and the approved payment to be published. Got %v.", orders)
+	}
+}
+
+func TestIntegrationCancelOrder(t *testing.T) {
+	ctx := context.Background()
+	runningContainers := sharedStack(t)
+	uri := runningContainers.app.URI
+
+	resp := putOrder(t, uri, "order-1234", OrderStatusPending, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	resp = postOrderAction(t, uri, "order-1234", "cancel")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the pending order to be cancelled with %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+	// a cancelled order is final
+	resp = postOrderAction(t, uri, "order-1234", "cancel")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected the cancelled order not to be cancelled again, with %d. Got %d.", http.StatusConflict, resp.StatusCode)
+	}
+
+	events, err := runningContainers.waitForEvents(ctx, 2)
+	if err != nil {
+		t.Fatalf("couldn't receive events: %s", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected the creation and the cancellation to be published. Got %s.", describeEvents(events))
+	}
+	i := slices.IndexFunc(events, func(e subscriberEvent) bool {
+		return e.Type == cloudEventTypeOrderCancelled
+	})
+	if i < 0 || events[i].DataContentType != contentTypeJSON {
+		t.Fatalf("expected a JSON %s event. Got %s.", cloudEventTypeOrderCancelled, describeEvents(events))
+	}
+	cancelled := events[i]
+	var event OrderCancelled
+	if err := json.Unmarshal(cancelled.Data, &event); err != nil {
+		t.Fatalf("couldn't decode event: %s", err)
+	}
+	if event.ID != "order-1234" || event.Status != OrderStatusCancelled || event.PreviousStatus != OrderStatusPending {
+		t.Fatalf("expected order-1234 to be cancelled while pending. Got %+v.", event)
+	}
+}
+
+func TestIntegrationRefund(t *testing.T) {
+	ctx := context.Background()
+
+	// the refunds run as workflows, whose actors are placed by the placement
+	// service
+	runningContainers, err := setupApp(ctx, t, WithPayments(), WithRefusedRefunds("order-2222"), WithPlacement(), WithAppEnv(map[string]string{
+		"REFUND_WORKFLOW": "true",
+	}))
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := runningContainers.app.URI
+
+	daprHTTP, err := runningContainers.daprApp.HTTPEndpoint(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sidecar runs no workflow before it connected to the placement
+	// service, in the background
+	testhelpers.Eventually(t, 30*time.Second, 500*time.Millisecond, func() error {
+		resp, err := http.Get(daprHTTP + "/v1.0/metadata")
+		if err != nil {
+			t.Fatalf("couldn't do request: %q", err)
+		}
+		var metadata struct {
+			ActorRuntime struct {
+				Placement string `json:"placement"`
+			} `json:"actorRuntime"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&metadata)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("couldn't decode metadata: %s", err)
+		}
+		if placement := metadata.ActorRuntime.Placement; !strings.HasSuffix(placement, ": connected") {
+			return fmt.Errorf("expected the sidecar to connect to the placement service. Got %q.", placement)
+		}
+		return nil
+	})
+
+	for _, id := range []string{"order-1111", "order-2222"} {
+		resp := putOrder(t, uri, id, OrderStatusPaid, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d for %s. Got %d.", http.StatusOK, id, resp.StatusCode)
+		}
+	}
+
+	resp := postOrderAction(t, uri, "order-1111", "refund")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected order-1111 to be refunded with %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	// the refused reversal is compensated, the order being paid again
+	resp = postOrderAction(t, uri, "order-2222", "refund")
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("couldn't read response: %s", err)
+	}
+	if resp.StatusCode != http.StatusPaymentRequired || string(body) != "Refund declined: charge settled" {
+		t.Fatalf("expected the refund of order-2222 to be declined with %d. Got %d: %s", http.StatusPaymentRequired, resp.StatusCode, body)
+	}
+
+	for id, status := range map[string]OrderStatus{"order-1111": OrderStatusRefunded, "order-2222": OrderStatusPaid} {
+		resp, err := http.Get(uri + "/orders/" + id)
+		if err != nil {
+			t.Fatalf("couldn't do request: %q", err)
+		}
+		var order Order
+		err = json.NewDecoder(resp.Body).Decode(&order)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("couldn't decode response: %s", err)
+		}
+		if order.Status != status {
+			t.Fatalf("expected %s to be %s. Got %s.", id, status, order.Status)
+		}
+	}
+
+	requests, err := runningContainers.paymentRequests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refunds := requests[paymentsMethodRefund]; !slices.Equal(refunds, []string{"order-1111", "order-2222"}) {
+		t.Fatalf("expected the charges of order-1111 and order-2222 to be reversed. Got %v.", refunds)
+	}
+
+	// the two payments and the refund of order-1111 only
+	events, err := runningContainers.waitForEvents(ctx, 3)
+	if err != nil {
+		t.Fatalf("couldn't receive events: %s", err)
+	}
+	var refunded []Order
+	for _, e := range events {
+		if e.Type != cloudEventTypeOrderRefunded {
+			continue
+		}
+		order, err := decodeOrderEvent(e)
+		if err != nil {
+			t.Fatalf("couldn't decode event %s: %s", e.ID, err)
+		}
+		refunded = append(refunded, order)
+	}
+	if len(events) != 3 || len(refunded) != 1 || refunded[0].ID != "order-1111" || refunded[0].Status != OrderStatusRefunded {
+		t.Fatalf("expected a single %s event, for order-1111. Got %s.", cloudEventTypeOrderRefunded, describeEvents(events))
+	}
+}
+
+func TestIntegrationInventoryReservation(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers, err := setupApp(ctx, t, WithPlacement(), WithAppEnv(map[string]string{
+		"INVENTORY_RESERVATION_WINDOW": "5s",
+	}))
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := runningContainers.app.URI
+
+	daprHTTP, err := runningContainers.daprApp.HTTPEndpoint(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reservationStatus reads the reservation of id from the state of its
+	// actor, through the sidecar
+	reservationStatus := func(id string) (ReservationStatus, error) {
+		resp, err := http.Get(daprHTTP + "/v1.0/actors/" + inventoryActorType + "/" + id + "/state/" + inventoryStateKey)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+		}
+		var reservation Reservation
+		if err := json.NewDecoder(resp.Body).Decode(&reservation); err != nil {
+			return "", fmt.Errorf("couldn't decode reservation: %w", err)
+		}
+		return reservation.Status, nil
+	}
+
+	// the actors are placed once the sidecar connected to the placement
+	// service, which releasing an order never reserved waits for
+	testhelpers.Eventually(t, 30*time.Second, time.Second, func() error {
+		req, err := http.NewRequest("PUT", daprHTTP+"/v1.0/actors/"+inventoryActorType+"/order-0000/method/"+inventoryMethodRelease, strings.NewReader(`{"id":"order-0000"}`))
+		if err != nil {
+			t.Fatalf("couldn't create request: %s", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("expected the actors to be placed. Got %d.", resp.StatusCode)
+		}
+		return nil
+	})
+
+	resp := putOrder(t, uri, "order-1111", OrderStatusPending, nil)
+	resp.Body.Close()
+	if status, err := reservationStatus("order-1111"); err != nil || status != ReservationStatusReserved {
+		t.Fatalf("expected order-1111 to be reserved. Got %q (%v).", status, err)
+	}
+
+	resp = putOrder(t, uri, "order-2222", OrderStatusPending, nil)
+	resp.Body.Close()
+	resp = putOrder(t, uri, "order-2222", OrderStatusPaid, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected order-2222 to be paid with %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	// the reminder releases the stock of the order left unpaid only
+	testhelpers.Eventually(t, 30*time.Second, time.Second, func() error {
+		if status, err := reservationStatus("order-1111"); err != nil || status != ReservationStatusReleased {
+			return fmt.Errorf("expected the reservation of order-1111 to be released. Got %q (%v).", status, err)
+		}
+		return nil
+	})
+	if status, err := reservationStatus("order-2222"); err != nil || status != ReservationStatusConfirmed {
+		t.Fatalf("expected the reservation of order-2222 to be confirmed. Got %q (%v).", status, err)
+	}
+}
+
+func TestIntegrationShipments(t *testing.T) {
+	ctx := context.Background()
+	runningContainers := sharedStack(t)
+	uri := runningContainers.app.URI
+
+	resp := putOrder(t, uri, "order-1234", OrderStatusPaid, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	resp, err := http.Post(uri+"/orders/order-1234/shipments", contentTypeJSON, strings.NewReader(`{"carrier":"dhl","trackingNumber":"JD0123"}`))
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	var shipment Shipment
+	err = json.NewDecoder(resp.Body).Decode(&shipment)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("couldn't decode shipment: %s", err)
+	}
+	if resp.StatusCode != http.StatusCreated || shipment.Status != ShipmentStatusCreated {
+		t.Fatalf("expected the shipment to be created with %d. Got %d: %+v", http.StatusCreated, resp.StatusCode, shipment)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, uri+"/orders/order-1234/shipments/"+shipment.ID+"/tracking", strings.NewReader(`{"status":"IN_TRANSIT"}`))
+	if err != nil {
+		t.Fatalf("couldn't create PUT request: %q", err)
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the shipment to be tracked with %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	// the subscriber subscribes to the shipments topic as well, the payment
+	// being delivered from the orders topic
+	events, err := runningContainers.waitForEvents(ctx, 3)
+	if err != nil {
+		t.Fatalf("couldn't receive events: %s", err)
+	}
+	var shipments []subscriberEvent
+	for _, e := range events {
+		if e.Topic == topicShipments {
+			shipments = append(shipments, e)
+		}
+	}
+	if len(events) != 3 || len(shipments) != 2 {
+		t.Fatalf("expected the payment and two shipment events. Got %s.", describeEvents(events))
+	}
+	for _, eventType := range []string{cloudEventTypeShipmentCreated, cloudEventTypeShipmentStatusChanged} {
+		i := slices.IndexFunc(shipments, func(e subscriberEvent) bool { return e.Type == eventType })
+		if i < 0 {
+			t.Fatalf("expected a %s event. Got %s.", eventType, describeEvents(shipments))
+		}
+		var got Shipment
+		if err := json.Unmarshal(shipments[i].Data, &got); err != nil {
+			t.Fatalf("couldn't decode event: %s", err)
+		}
+		if got.ID != shipment.ID || got.OrderID != "order-1234" {
+			t.Fatalf("expected the %s event to be about %s. Got %+v.", eventType, shipment.ID, got)
+		}
+	}
+}
+
+func TestIntegrationCustomerOrders(t *testing.T) {
+	runningContainers := sharedStack(t)
+	uri := runningContainers.app.URI
+
+	resp, body := doRequest(t, http.MethodPut, uri+"/customers/customer-1234", contentTypeJSON, "", []byte(`{"name":"Ada"}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the customer to be created with %d. Got %d: %s", http.StatusOK, resp.StatusCode, body)
+	}
+	resp, body = doRequest(t, http.MethodPut, uri+"/v2/orders/order-1234", contentTypeJSON, "", []byte(`{"status":"PENDING","customerId":"customer-1234"}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the order to be placed with %d. Got %d: %s", http.StatusOK, resp.StatusCode, body)
+	}
+
+	// the index is read from the customer-state store, and the orders from
+	// the order-state one
+	resp, body = doRequest(t, http.MethodGet, uri+"/v2/customers/customer-1234/orders", "", "", nil)
+	var list OrderList
+	if err := json.Unmarshal(body, &list); err != nil {
+		t.Fatalf("couldn't decode orders: %s: %s", err, body)
+	}
+	i := slices.IndexFunc(list.Items, func(order Order) bool { return order.ID == "order-1234" })
+	if resp.StatusCode != http.StatusOK || i < 0 || list.Items[i].CustomerID != "customer-1234" {
+		t.Fatalf("expected order-1234 to be listed. Got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestIntegrationEventSourcing(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers, err := setupApp(ctx, t, WithAppEnv(map[string]string{
+		"ORDER_EVENT_SOURCING": "true",
+		"ORDER_SNAPSHOT_EVERY": "2",
+	}))
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := runningContainers.app.URI
+
+	for _, body := range []string{
+		`{"status":"PENDING"}`,
+		`{"status":"PENDING","lineItems":[{"sku":"sku-1","quantity":2}]}`,
+		`{"status":"PAID"}`,
+	} {
+		resp, respBody := doRequest(t, http.MethodPut, uri+"/v2/orders/order-1234", contentTypeJSON, "", []byte(body))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected the order to be updated with %d. Got %d: %s", http.StatusOK, resp.StatusCode, respBody)
+		}
+	}
+
+	// the order is rehydrated from its snapshot at version 2 and its last
+	// event in the order-events store, the ETag being the version of its
+	// stream
+	resp, body := doRequest(t, http.MethodGet, uri+"/v2/orders/order-1234", "", "", nil)
+	var order Order
+	if err := json.Unmarshal(body, &order); err != nil {
+		t.Fatalf("couldn't decode order: %s: %s", err, body)
+	}
+	if resp.StatusCode != http.StatusOK || order.Status != OrderStatusPaid || len(order.LineItems) != 1 {
+		t.Fatalf("expected the paid order with its line item. Got %d: %s", resp.StatusCode, body)
+	}
+	if etag := resp.Header.Get("ETag"); etag != `"3"` {
+		t.Fatalf("expected ETag %q. Got %q.", `"3"`, etag)
+	}
+}
+
+func TestIntegrationStats(t *testing.T) {
+	runningContainers := sharedStack(t)
+	uri := runningContainers.app.URI
+
+	resp, body := doRequest(t, http.MethodPut, uri+"/orders/order-1357", contentTypeJSON, "", []byte(`{"status":"PENDING"}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the order to be placed with %d. Got %d: %s", http.StatusOK, resp.StatusCode, body)
+	}
+
+	// the stats are projected from the event of the order delivered to the
+	// app's own subscription, so they catch up with the order store
+	testhelpers.Eventually(t, 30*time.Second, 500*time.Millisecond, func() error {
+		resp, body := doRequest(t, http.MethodGet, uri+"/stats", "", "", nil)
+		var stats OrderStats
+		if err := json.Unmarshal(body, &stats); err != nil {
+			t.Fatalf("couldn't decode stats: %s: %s", err, body)
+		}
+		if resp.StatusCode != http.StatusOK || stats.Counts[OrderStatusPending] < 1 ||
+			!slices.ContainsFunc(stats.Latest, func(o OrderSummary) bool { return o.ID == "order-1357" }) {
+			return fmt.Errorf("order-1357 isn't projected yet: %d: %s", resp.StatusCode, body)
+		}
+		return nil
+	})
+}
+
+func TestIntegrationPriorityTopic(t *testing.T) {
+	ctx := context.Background()
+	runningContainers := sharedStack(t)
+	uri := runningContainers.app.URI
+
+	resp := putOrder(t, uri, "order-2468", OrderStatusPending, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+	resp = putOrder(t, uri, "order-2468", OrderStatusPaid, http.Header{headerOrderPriority: {priorityExpedited}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	// the expedited change is published to the priority topic only
+	events, err := runningContainers.waitForEvents(ctx, 2)
+	if err != nil {
+		t.Fatalf("couldn't receive events: %s", err)
+	}
+	topics := map[OrderStatus]string{}
+	for _, e := range events {
+		order, err := decodeOrderEvent(e)
+		if err != nil {
+			t.Fatalf("couldn't decode event %s: %s", e.ID, err)
+		}
+		topics[order.Status] = e.Topic
+	}
+	expected := map[OrderStatus]string{OrderStatusPending: topicOrders, OrderStatusPaid: topicOrdersPriority}
+	if !maps.Equal(topics, expected) {
+		t.Fatalf("expected events on topics %v. Got %v.", expected, topics)
+	}
+}
+
+func TestIntegrationEventRouting(t *testing.T) {
+	runningContainers := sharedStack(t)
+	uri := runningContainers.app.URI
+
+	series := func(route string) string {
+		return fmt.Sprintf(`order_events_received_total{route=%q}`, route)
+	}
+	routes := []string{routeOrderEvents, routePaidOrderEvents, routeCancelledOrderEvents}
+	before := map[string]float64{}
+	for _, route := range routes {
+		before[route] = appCounter(t, uri, series(route))
+	}
+
+	for _, id := range []string{"order-9753", "order-9754"} {
+		resp := putOrder(t, uri, id, OrderStatusPending, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+		}
+	}
+	resp := putOrder(t, uri, "order-9753", OrderStatusPaid, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+	resp = postOrderAction(t, uri, "order-9754", "cancel")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the order to be cancelled with %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	// the sidecar routes the placements to the default route, and the
+	// payment and cancellation to routes of their own
+	expected := map[string]float64{routeOrderEvents: 2, routePaidOrderEvents: 1, routeCancelledOrderEvents: 1}
+	testhelpers.Eventually(t, 30*time.Second, 500*time.Millisecond, func() error {
+		for _, route := range routes {
+			if received := appCounter(t, uri, series(route)) - before[route]; received < expected[route] {
+				return fmt.Errorf("expected %v events on %s. Got %v.", expected[route], route, received)
+			}
+		}
+		return nil
+	})
+}
+
+func TestIntegrationEventTTL(t *testing.T) {
+	ctx := context.Background()
+
+	// the subscriber fails the first five deliveries, which the sidecar
+	// retries every 500ms as resiliency.yaml says, so that the last one
+	// arrives after the TTL
+	const failFirst = 5
+	runningContainers, err := setupApp(ctx, t, WithFlakySubscriber(failFirst), WithAppEnv(map[string]string{"EVENT_TTL": "2s"}))
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := putOrder(t, runningContainers.app.URI, "order-1234", OrderStatusPaid, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	var expired []string
+	testhelpers.Eventually(t, 30*time.Second, 500*time.Millisecond, func() error {
+		if expired, err = runningContainers.expiredEvents(ctx); err != nil {
+			return err
+		}
+		if len(expired) == 0 {
+			return errors.New("no event expired yet")
+		}
+		return nil
+	})
+
+	// the stale event was dropped rather than recorded
+	events, err := runningContainers.receivedEvents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || len(events) != 0 {
+		t.Fatalf("expected the event to expire undelivered. Got expired events %v and %s.", expired, describeEvents(events))
+	}
+	attempts, err := runningContainers.deliveryAttempts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := attempts[expired[0]]; got <= 1 || got > failFirst+1 {
+		t.Fatalf("expected event %s to expire while its delivery was retried. Got %d deliveries.", expired[0], got)
+	}
+}
+
+func TestIntegrationEventKeys(t *testing.T) {
+	ctx := context.Background()
+	runningContainers := sharedStack(t)
+	uri := runningContainers.app.URI
+
+	resp := putOrder(t, uri, "order-8642", OrderStatusPending, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+	resp, err := http.Get(uri + "/orders/order-8642")
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+
+	// the update sent twice, as a client retrying it would, only changes
+	// the order once
+	for i := 0; i < 2; i++ {
+		resp = putOrder(t, uri, "order-8642", OrderStatusPaid, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+		}
+	}
+	events, err := runningContainers.waitForEvents(ctx, 2)
+	if err != nil {
+		t.Fatalf("couldn't receive events: %s", err)
+	}
+	i := slices.IndexFunc(events, func(e subscriberEvent) bool {
+		order, err := decodeOrderEvent(e)
+		return err == nil && order.Status == OrderStatusPaid
+	})
+	key := orderEventKey(ctx, "order-8642", parseETag(etag))
+	if len(events) != 2 || i < 0 || events[i].ID != key {
+		t.Fatalf("expected the payment to be published once, identified by %s. Got %s.", key, describeEvents(events))
+	}
+
+	// the payment published again, as a publish retried after reaching the
+	// broker would be, keeps its ID, which the subscriber dedupes it on
+	daprHTTP, err := runningContainers.daprIntegration.HTTPEndpoint(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Post(daprHTTP+"/v1.0/publish/"+pubsubName+"/"+topicOrders, contentTypeCloudEvents, bytes.NewReader(events[i].Envelope))
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusNoContent, resp.StatusCode)
+	}
+	testhelpers.Eventually(t, *eventsTimeout, 500*time.Millisecond, func() error {
+		attempts, err := runningContainers.deliveryAttempts(ctx)
+		if err != nil {
+			return err
+		}
+		if attempts[key] < 2 {
+			return fmt.Errorf("expected the payment to be delivered again, got %d deliveries", attempts[key])
+		}
+		return nil
+	})
+	events, err = runningContainers.receivedEvents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(slices.DeleteFunc(events, func(e subscriberEvent) bool { return e.ID != key })); n != 1 {
+		t.Fatalf("expected the payment to be recorded once. Got %d.", n)
+	}
+}
+
+func TestIntegrationIdempotentSubscriber(t *testing.T) {
+	ctx := context.Background()
+	runningContainers := sharedStack(t)
+
+	// the retry extension has the subscriber fail the event once processed,
+	// as if it crashed before acknowledging it
+	const id = "order-7531@0"
+	envelope := []byte(`{"specversion":"1.0","id":"` + id + `","source":"integration","type":"order.test",` +
+		`"datacontenttype":"application/json","data":{"id":"order-7531","status":"PENDING"},"retry":"true"}`)
+	daprHTTP, err := runningContainers.daprIntegration.HTTPEndpoint(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(daprHTTP+"/v1.0/publish/"+pubsubName+"/"+topicOrders, contentTypeCloudEvents, bytes.NewReader(envelope))
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusNoContent, resp.StatusCode)
+	}
+
+	testhelpers.Eventually(t, *eventsTimeout, 500*time.Millisecond, func() error {
+		attempts, err := runningContainers.deliveryAttempts(ctx)
+		if err != nil {
+			return err
+		}
+		if attempts[id] < 2 {
+			return fmt.Errorf("expected the event to be redelivered, got %d deliveries", attempts[id])
+		}
+		return nil
+	})
+
+	// the redelivery was recognized as processed
+	events, err := runningContainers.receivedEvents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].ID != id {
+		t.Fatalf("expected event %s to be recorded once. Got %s.", id, describeEvents(events))
+	}
+}
+
+func TestIntegrationQuarantine(t *testing.T) {
+	ctx := context.Background()
+	runningContainers := sharedStack(t)
+	uri := runningContainers.app.URI
+
+	// the event carries no order, so redelivering it wouldn't make it valid
+	const id = "poison-0001"
+	envelope := []byte(`{"specversion":"1.0","id":"` + id + `","source":"integration","type":"order.test",` +
+		`"datacontenttype":"application/json","data":"PAID"}`)
+	daprHTTP, err := runningContainers.daprIntegration.HTTPEndpoint(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(daprHTTP+"/v1.0/publish/"+pubsubName+"/"+topicOrders, contentTypeCloudEvents, bytes.NewReader(envelope))
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusNoContent, resp.StatusCode)
+	}
+
+	testhelpers.Eventually(t, *eventsTimeout, 500*time.Millisecond, func() error {
+		resp, err := http.Get(uri + "/admin/quarantine/" + id)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("expected the event to be quarantined, got status code %d", resp.StatusCode)
+		}
+		var event QuarantinedEvent
+		if err := json.NewDecoder(resp.Body).Decode(&event); err != nil {
+			return err
+		}
+		if event.Route != routeOrderEvents || event.Attempts != 1 || !bytes.Contains(event.Payload, []byte(`"data":"PAID"`)) {
+			t.Fatalf("expected the event delivered once to %s. Got %+v.", routeOrderEvents, event)
+		}
+		return nil
+	})
+
+	req, err := http.NewRequest(http.MethodDelete, uri+"/admin/quarantine/"+id, nil)
+	if err != nil {
+		t.Fatalf("couldn't create DELETE request: %q", err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusNoContent, resp.StatusCode)
+	}
+
+	resp, err = http.Get(uri + "/admin/quarantine/" + id)
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected the event to be released. Got status code %d.", resp.StatusCode)
+	}
+}
+
+func TestIntegrationDLQReplay(t *testing.T) {
+	ctx := context.Background()
+	runningContainers := sharedStack(t)
+	uri := runningContainers.app.URI
+
+	const id = "poison-0002"
+	envelope := []byte(`{"specversion":"1.0","id":"` + id + `","source":"integration","type":"order.test",` +
+		`"datacontenttype":"application/json","data":"PAID"}`)
+	daprHTTP, err := runningContainers.daprIntegration.HTTPEndpoint(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(daprHTTP+"/v1.0/publish/"+pubsubName+"/"+topicOrders, contentTypeCloudEvents, bytes.NewReader(envelope))
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusNoContent, resp.StatusCode)
+	}
+
+	quarantined := func() (QuarantinedEvent, error) {
+		resp, err := http.Get(uri + "/admin/quarantine/" + id)
+		if err != nil {
+			return QuarantinedEvent{}, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return QuarantinedEvent{}, fmt.Errorf("expected the event to be quarantined, got status code %d", resp.StatusCode)
+		}
+		var event QuarantinedEvent
+		err = json.NewDecoder(resp.Body).Decode(&event)
+		return event, err
+	}
+	testhelpers.Eventually(t, *eventsTimeout, 500*time.Millisecond, func() error {
+		_, err := quarantined()
+		return err
+	})
+	t.Cleanup(func() {
+		req, err := http.NewRequest(http.MethodDelete, uri+"/admin/quarantine/"+id, nil)
+		if err != nil {
+			t.Fatalf("couldn't create DELETE request: %q", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("couldn't do request: %q", err)
+		}
+		resp.Body.Close()
+	})
+
+	resp, err = http.Post(uri+"/admin/dlq/replay", contentTypeJSON, strings.NewReader(`["`+id+`"]`))
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	var results []ReplayResult
+	err = json.NewDecoder(resp.Body).Decode(&results)
+	resp.Body.Close()
+	if err != nil || len(results) != 1 || results[0].Status != http.StatusOK || results[0].Attempt != 1 {
+		t.Fatalf("expected the event to be replayed at attempt 1. Got %+v: %v", results, err)
+	}
+
+	// the replayed event is still poison, so the app quarantines it again,
+	// as delivered with its replay attempt
+	testhelpers.Eventually(t, *eventsTimeout, 500*time.Millisecond, func() error {
+		event, err := quarantined()
+		if err != nil {
+			return err
+		}
+		if event.Attempts != 2 {
+			return fmt.Errorf("expected the replayed event to be delivered, got %d deliveries", event.Attempts)
+		}
+		if event.Replays != 1 || !bytes.Contains(event.Payload, []byte(`"`+cloudEventReplayExtension+`":"1"`)) {
+			t.Fatalf("expected the event delivered with replay attempt 1. Got %+v.", event)
+		}
+		return nil
+	})
+}
+
+func TestIntegrationPprof(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers, err := setupApp(ctx, t, WithPprof())
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := runningContainers.app
+
+	// a CPU profile is taken while the app serves requests
+	for i := 0; i < 10; i++ {
+		resp := putOrder(t, app.URI, "order-1234", OrderStatusPending, nil)
+		resp.Body.Close()
+	}
+	for _, path := range []string{"/debug/pprof/heap?debug=1", "/debug/pprof/profile?seconds=1"} {
+		resp, err := http.Get(app.PprofURI + path)
+		if err != nil {
+			t.Fatalf("couldn't do request: %q", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("couldn't read profile: %s", err)
+		}
+		if resp.StatusCode != http.StatusOK || len(body) == 0 {
+			t.Fatalf("expected a profile at %s. Got %d: %s", path, resp.StatusCode, body)
+		}
+	}
+
+	// the app port doesn't serve them
+	resp, err := http.Get(app.URI + "/debug/pprof/")
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status code %d on the app port. Got %d.", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestIntegrationStructuredLogs(t *testing.T) {
+	ctx := context.Background()
+	runningContainers := sharedStack(t)
+
+	logs, err := runningContainers.app.Logs(ctx)
+	if err != nil {
+		t.Fatalf("couldn't get logs: %s", err)
+	}
+	data, err := io.ReadAll(logs)
+	logs.Close()
+	if err != nil {
+		t.Fatalf("couldn't read logs: %s", err)
+	}
+
+	// every line is a JSON record, tagged with the service and its version
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("expected a JSON record. Got %q: %s", line, err)
+		}
+		if record["service"] != defaultServiceName || record["version"] != version || record["level"] == nil {
+			t.Fatalf("expected a record of %s at version %s with its level. Got %v.", defaultServiceName, version, record)
+		}
+	}
+}
+
+func TestIntegrationLogLevel(t *testing.T) {
+	ctx := context.Background()
+	runningContainers := sharedStack(t)
+	uri := runningContainers.app.URI
+
+	setLevel := func(level string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPut, uri+"/admin/loglevel", strings.NewReader(`{"level":"`+level+`"}`))
+		if err != nil {
+			t.Fatalf("couldn't create PUT request: %q", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("couldn't do request: %q", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+		}
+	}
+	setLevel("debug")
+	// the stack is shared, so the level is set back for the other tests
+	t.Cleanup(func() { setLevel("info") })
+
+	resp := putOrder(t, uri, "order-8642", OrderStatusPending, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	// the app logs at the debug level without restarting
+	testhelpers.Eventually(t, *eventsTimeout, 500*time.Millisecond, func() error {
+		logs, err := runningContainers.app.Logs(ctx)
+		if err != nil {
+			return err
+		}
+		defer logs.Close()
+		data, err := io.ReadAll(logs)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			var record struct {
+				Level string `json:"level"`
+				Msg   string `json:"msg"`
+			}
+			if json.Unmarshal([]byte(line), &record) == nil && record.Level == "DEBUG" && record.Msg == "handled order event" {
+				return nil
+			}
+		}
+		return errors.New("expected the app to log the order event at the debug level")
+	})
+}
+
+func TestIntegrationCorrelationID(t *testing.T) {
+	ctx := context.Background()
+	runningContainers := sharedStack(t)
+
+	resp := putOrder(t, runningContainers.app.URI, "order-7531", OrderStatusPending, http.Header{headerCorrelationID: {"checkout-7531"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+	if got := resp.Header.Get(headerCorrelationID); got != "checkout-7531" {
+		t.Fatalf("expected correlation ID checkout-7531 answered. Got %s.", got)
+	}
+
+	// the correlation ID reaches the subscriber in the CloudEvent
+	events, err := runningContainers.waitForEvents(ctx, 1)
+	if err != nil {
+		t.Fatalf("couldn't receive events: %s", err)
+	}
+	var envelope map[string]any
+	if err := json.Unmarshal(events[0].Envelope, &envelope); err != nil {
+		t.Fatalf("couldn't decode CloudEvent: %s", err)
+	}
+	if envelope[cloudEventCorrelationExtension] != "checkout-7531" {
+		t.Fatalf("expected the event to carry correlation ID checkout-7531. Got %v.", envelope)
+	}
+}
+
+func TestIntegrationBodySizeLimit(t *testing.T) {
+	runningContainers := sharedStack(t)
+
+	// the webhook is refused before it reaches the state store
+	body := `{"url":"http://receiver/` + strings.Repeat("a", maxBodySize) + `"}`
+	resp, err := http.Post(runningContainers.app.URI+"/webhooks", contentTypeJSON, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+	var answer bodyTooLargeError
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil || answer.Limit != maxBodySize {
+		t.Fatalf("expected a JSON error with limit %d. Got %+v: %v", maxBodySize, answer, err)
+	}
+}
+
+func TestIntegrationCompression(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers, err := setupApp(ctx, t, WithAppEnv(map[string]string{
+		"ENABLE_COMPRESSION":   "true",
+		"COMPRESSION_MIN_SIZE": "1",
+	}))
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := putOrder(t, runningContainers.app.URI, "order-1234", OrderStatusPending, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	// the transport only leaves the answer compressed when asked for an
+	// encoding explicitly
+	for _, encoding := range []string{"gzip", "br"} {
+		req, err := http.NewRequest(http.MethodGet, runningContainers.app.URI+"/orders", nil)
+		if err != nil {
+			t.Fatalf("couldn't create GET request: %q", err)
+		}
+		req.Header.Set("Accept-Encoding", encoding)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("couldn't do request: %q", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != encoding {
+			t.Fatalf("expected a %s answer. Got %d %v.", encoding, resp.StatusCode, resp.Header)
+		}
+		body := io.Reader(brotli.NewReader(resp.Body))
+		if encoding == "gzip" {
+			if body, err = gzip.NewReader(resp.Body); err != nil {
+				t.Fatalf("couldn't read gzip answer: %s", err)
+			}
+		}
+		got, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("couldn't read answer: %s", err)
+		}
+		if !strings.Contains(string(got), `"id":"order-1234"`) {
+			t.Fatalf("expected the %s answer to list order-1234. Got %s.", encoding, got)
+		}
+	}
+}
+
+func TestIntegrationCORS(t *testing.T) {
+	ctx := context.Background()
+
+	// preflight requests are answered by the app alone
+	runningContainers, err := setupApp(ctx, t, WithoutSidecar(), WithAppEnv(map[string]string{
+		"CORS_ALLOWED_ORIGINS": "https://dashboard.example.com",
+		"CORS_MAX_AGE":         "10m",
+	}))
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodOptions, runningContainers.app.URI+"/orders/order-1234", nil)
+	if err != nil {
+		t.Fatalf("couldn't create OPTIONS request: %q", err)
+	}
+	req.Header.Set("Origin", "https://dashboard.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+	req.Header.Set("Access-Control-Request-Headers", "content-type, if-match")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusNoContent, resp.StatusCode)
+	}
+	if origin := resp.Header.Get("Access-Control-Allow-Origin"); origin != "https://dashboard.example.com" {
+		t.Fatalf("expected the dashboard origin to be allowed. Got %q.", origin)
+	}
+	if !strings.Contains(resp.Header.Get("Access-Control-Allow-Methods"), http.MethodPut) || resp.Header.Get("Access-Control-Max-Age") != "600" {
+		t.Fatalf("expected PUT allowed for 10 minutes. Got %v.", resp.Header)
+	}
+}
+
+func TestIntegrationFeatureFlags(t *testing.T) {
+	ctx := context.Background()
+
+	// the flags are toggled for the app of this stack only
+	runningContainers, err := setupApp(ctx, t, WithAppEnv(map[string]string{"FEATURE_FLAGS_STORE": "feature-flags"}))
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := runningContainers.app.URI
+
+	if err := runningContainers.setFeatureFlag(ctx, flagPriorityTopics, "false"); err != nil {
+		t.Fatalf("couldn't set feature flag: %s", err)
+	}
+	// the change is pushed to the app without a restart
+	testhelpers.Eventually(t, *eventsTimeout, 500*time.Millisecond, func() error {
+		resp, err := http.Get(uri + "/admin/flags")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		var flags map[string]bool
+		if err := json.NewDecoder(resp.Body).Decode(&flags); err != nil {
+			return err
+		}
+		if flags[flagPriorityTopics] {
+			return fmt.Errorf("expected %s to be off. Got %v.", flagPriorityTopics, flags)
+		}
+		return nil
+	})
+
+	// the expedited change is published to the orders topic
+	resp := putOrder(t, uri, "order-1357", OrderStatusPending, http.Header{headerOrderPriority: {priorityExpedited}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+	events, err := runningContainers.waitForEvents(ctx, 1)
+	if err != nil {
+		t.Fatalf("couldn't receive events: %s", err)
+	}
+	if events[0].Topic != topicOrders {
+		t.Fatalf("expected the event on %s. Got %s.", topicOrders, events[0].Topic)
+	}
+}
+
+func TestIntegrationSecretRotation(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers, err := setupApp(ctx, t, WithSecretStore())
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := runningContainers.app.URI
+
+	// status returns the status code of a request with the API key
+	status := func(key string) (int, error) {
+		req, err := http.NewRequest(http.MethodGet, uri+"/orders", nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("X-API-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	expectKeys := func(accepted, rejected string) {
+		t.Helper()
+		testhelpers.Eventually(t, *eventsTimeout, 500*time.Millisecond, func() error {
+			for key, expected := range map[string]int{accepted: http.StatusOK, rejected: http.StatusUnauthorized} {
+				code, err := status(key)
+				if err != nil {
+					return err
+				}
+				if code != expected {
+					return fmt.Errorf("expected status code %d with key %s. Got %d.", expected, key, code)
+				}
+			}
+			return nil
+		})
+	}
+	expectKeys("key-1", "key-2")
+
+	// the rotated key replaces the former one, without restarting the app
+	if err := runningContainers.rotateSecrets(ctx, map[string]string{secretAPIKeys: "key-2"}, 2); err != nil {
+		t.Fatalf("couldn't rotate secrets: %s", err)
+	}
+	expectKeys("key-2", "key-1")
+}
+
+func TestIntegrationEventSigning(t *testing.T) {
+	ctx := context.Background()
+
+	const signingKey = "integration-signing-key"
+	runningContainers, err := setupApp(ctx, t, WithAppEnv(map[string]string{"EVENT_SIGNING_KEY": signingKey}))
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := runningContainers.app.URI
+
+	// the events of the app are still verified once relayed by the sidecars
+	resp := putOrder(t, uri, "order-2468", OrderStatusPending, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+	events, err := runningContainers.waitForEvents(ctx, 1)
+	if err != nil {
+		t.Fatalf("couldn't receive events: %s", err)
+	}
+	signer := NewEventSigner(NewCredentials(nil, SecretsConfig{}, AuthConfig{}, signingKey, NewMetrics()))
+	if err := signer.Verify(events[0].Envelope); err != nil {
+		t.Fatalf("expected the event delivered with a valid signature. Got %s: %s", err, events[0].Envelope)
+	}
+
+	// an event published by anyone else is quarantined
+	const id = "forged-0001"
+	envelope := []byte(`{"specversion":"1.0","id":"` + id + `","source":"integration","type":"order.test",` +
+		`"datacontenttype":"application/json","data":{"id":"order-2468","status":"CANCELLED"},"signature":"00"}`)
+	daprHTTP, err := runningContainers.daprIntegration.HTTPEndpoint(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Post(daprHTTP+"/v1.0/publish/"+pubsubName+"/"+topicOrders, contentTypeCloudEvents, bytes.NewReader(envelope))
+	if err != nil {
+		t.Fatalf("couldn't do request: %q", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusNoContent, resp.StatusCode)
+	}
+	testhelpers.Eventually(t, *eventsTimeout, 500*time.Millisecond, func() error {
+		resp, err := http.Get(uri + "/admin/quarantine/" + id)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("expected the event to be quarantined, got status code %d", resp.StatusCode)
+		}
+		var event QuarantinedEvent
+		if err := json.NewDecoder(resp.Body).Decode(&event); err != nil {
+			return err
+		}
+		if !strings.Contains(event.Error, ErrInvalidSignature.Error()) {
+			t.Fatalf("expected the event quarantined for its signature. Got %+v.", event)
+		}
+		return nil
+	})
+}
+
+func TestIntegrationAsyncPublish(t *testing.T) {
+	ctx := context.Background()
+
+	runningContainers, err := setupApp(ctx, t, WithAppEnv(map[string]string{"ASYNC_PUBLISH": "true"}))
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the update is answered once stored, its event published afterwards
+	resp := putOrder(t, runningContainers.app.URI, "order-3579", OrderStatusPending, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusAccepted, resp.StatusCode)
+	}
+	events, err := runningContainers.waitForEvents(ctx, 1)
+	if err != nil {
+		t.Fatalf("couldn't receive events: %s", err)
+	}
+	if events[0].Topic != topicOrders {
+		t.Fatalf("expected the event on %s. Got %s.", topicOrders, events[0].Topic)
+	}
+}
+
+func TestIntegrationPublishSpool(t *testing.T) {
+	ctx := context.Background()
+
+	// the state store, in Postgres, stays up while the broker goes away
+	runningContainers, err := setupApp(ctx, t, WithPubsub(pubsubRedis), WithAppEnv(map[string]string{
+		"ASYNC_PUBLISH":                "true",
+		"PUBLISH_QUEUE_DIR":            "/var/spool/publish",
+		"PUBLISH_QUEUE_FLUSH_INTERVAL": "1s",
+		"PUBLISH_RETRY_ATTEMPTS":       "1",
+		"DAPR_PUBLISH_TIMEOUT":         "2s",
+	}))
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := runningContainers.app.URI
+
+	timeout := 10 * time.Second
+	if err := runningContainers.redis.Stop(ctx, &timeout); err != nil {
+		t.Fatalf("couldn't stop redis: %s", err)
+	}
+
+	// the update is accepted, its event kept in the spool rather than lost
+	resp := putOrder(t, uri, "order-4680", OrderStatusPending, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusAccepted, resp.StatusCode)
+	}
+	testhelpers.Eventually(t, *eventsTimeout, 500*time.Millisecond, func() error {
+		// failed publishes are timed too
+		if got := appCounter(t, uri, `order_publish_duration_seconds_count{topic="orders"}`); got == 0 {
+			return errors.New("expected the publish to fail while the broker is down")
+		}
+		return nil
+	})
+	if got := appCounter(t, uri, "publish_spool_size"); got != 1 {
+		t.Fatalf("expected 1 spooled update. Got %v.", got)
+	}
+
+	// the event is published once the broker is back
+	if err := runningContainers.redis.Start(ctx); err != nil {
+		t.Fatalf("couldn't start redis: %s", err)
+	}
+	events, err := runningContainers.waitForEvents(ctx, 1)
+	if err != nil {
+		t.Fatalf("couldn't receive events: %s", err)
+	}
+	if events[0].ID != "order-4680@0" {
+		t.Fatalf("expected the event of order-4680. Got %s.", events[0].ID)
+	}
+	testhelpers.Eventually(t, *eventsTimeout, 500*time.Millisecond, func() error {
+		if got := appCounter(t, uri, "publish_spool_size"); got != 0 {
+			return fmt.Errorf("expected an empty spool. Got %v.", got)
+		}
+		return nil
+	})
+}
+
+func TestIntegrationPublishBackpressure(t *testing.T) {
+	ctx := context.Background()
+
+	// a single worker and a single queued publish saturate the queue as
+	// soon as the broker slows down
+	runningContainers, err := setupApp(ctx, t, WithToxiproxy(), WithAppEnv(map[string]string{
+		"ASYNC_PUBLISH":             "true",
+		"PUBLISH_QUEUE_SIZE":        "1",
+		"PUBLISH_WORKERS":           "1",
+		"PUBLISH_QUEUE_RETRY_AFTER": "3s",
+		"DAPR_PUBLISH_TIMEOUT":      "10s",
+	}))
+	t.Cleanup(func() {
+		if err := runningContainers.Terminate(ctx); err != nil {
+			t.Fatalf("failed to terminate stack: %s", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := runningContainers.app.URI
+	api := runningContainers.toxiproxyAPI()
+
+	latency := toxic{Name: "latency", Type: "latency", Attributes: map[string]int{"latency": 5000}}
+	if err := api.addToxic(ctx, proxyRedis, latency); err != nil {
+		t.Fatalf("couldn't add toxic: %s", err)
+	}
+	// the first publish holds the worker, the second one waits in the queue
+	var throttled *http.Response
+	for _, id := range []string{"order-1111", "order-2222", "order-3333"} {
+		resp := putOrder(t, uri, id, OrderStatusPending, nil)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusTooManyRequests {
+			throttled = resp
+			break
+		}
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("expected status code %d for %s. Got %d.", http.StatusAccepted, id, resp.StatusCode)
+		}
+	}
+	if throttled == nil || throttled.Header.Get("Retry-After") != "3" {
+		t.Fatalf("expected an update answered %d with Retry-After 3. Got %v.", http.StatusTooManyRequests, throttled)
+	}
+	if got := appCounter(t, uri, "publish_queue_throttled_total"); got != 1 {
+		t.Fatalf("expected 1 throttled update. Got %v.", got)
+	}
+	if err := api.removeToxic(ctx, proxyRedis, latency.Name); err != nil {
+		t.Fatalf("couldn't remove toxic: %s", err)
+	}
+
+	// the accepted updates are published, and the queue accepts updates again
+	if _, err := runningContainers.waitForEvents(ctx, 2); err != nil {
+		t.Fatalf("couldn't receive events: %s", err)
+	}
+	testhelpers.Eventually(t, *eventsTimeout, 500*time.Millisecond, func() error {
+		resp := putOrder(t, uri, "order-3333", OrderStatusPending, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			return fmt.Errorf("expected status code %d. Got %d.", http.StatusAccepted, resp.StatusCode)
+		}
+		return nil
+	})
 }
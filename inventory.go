@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"github.com/gorilla/mux"
+)
+
+const (
+	inventoryActorType = "InventoryActor"
+	// inventoryReminderRelease releases a reservation once its window
+	// expired, and inventoryStateKey is the key of the reservation in the
+	// state of its actor.
+	inventoryReminderRelease = "release"
+	inventoryStateKey        = "reservation"
+)
+
+// Methods of the InventoryActor.
+const (
+	inventoryMethodReserve = "reserve"
+	inventoryMethodConfirm = "confirm"
+	inventoryMethodRelease = "release"
+)
+
+// Inventory holds the stock of the orders awaiting payment.
+type Inventory interface {
+	// Reserve reserves the line items of order, until the reservation is
+	// confirmed or released, or its window expires.
+	Reserve(ctx context.Context, order Order) error
+	// Confirm keeps the stock reserved for order for good, once it is paid.
+	Confirm(ctx context.Context, order Order) error
+	// Release gives back the stock reserved for order, e.g. once cancelled.
+	Release(ctx context.Context, order Order) error
+}
+
+type ReservationStatus string
+
+const (
+	ReservationStatusReserved  ReservationStatus = "RESERVED"
+	ReservationStatusConfirmed ReservationStatus = "CONFIRMED"
+	ReservationStatusReleased  ReservationStatus = "RELEASED"
+)
+
+// Reservation is the stock held for an order, kept in the state of the
+// InventoryActor of the order.
+type Reservation struct {
+	OrderID    string            `json:"orderId"`
+	Tenant     string            `json:"tenant,omitempty"`
+	LineItems  []LineItem        `json:"lineItems,omitempty"`
+	Status     ReservationStatus `json:"status"`
+	ReservedAt time.Time         `json:"reservedAt"`
+	ExpiresAt  time.Time         `json:"expiresAt"`
+}
+
+// inventoryActorID returns the ID of the InventoryActor of order, scoped to
+// its tenant.
+func inventoryActorID(order Order) string {
+	if order.Tenant != "" {
+		return order.Tenant + "." + order.ID
+	}
+	return order.ID
+}
+
+// DaprInventory reserves stock through the InventoryActor of each order,
+// invoked through the sidecar.
+type DaprInventory struct {
+	client dapr.Client
+}
+
+func NewDaprInventory(client dapr.Client) *DaprInventory {
+	return &DaprInventory{client: client}
+}
+
+func (i *DaprInventory) Reserve(ctx context.Context, order Order) error {
+	return i.invoke(ctx, inventoryMethodReserve, order)
+}
+
+func (i *DaprInventory) Confirm(ctx context.Context, order Order) error {
+	return i.invoke(ctx, inventoryMethodConfirm, order)
+}
+
+func (i *DaprInventory) Release(ctx context.Context, order Order) error {
+	return i.invoke(ctx, inventoryMethodRelease, order)
+}
+
+// invoke calls method of the InventoryActor of order.
+func (i *DaprInventory) invoke(ctx context.Context, method string, order Order) error {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return fmt.Errorf("couldn't encode order: %w", err)
+	}
+	actorID := inventoryActorID(order)
+	if _, err := i.client.InvokeActor(ctx, &dapr.InvokeActorRequest{
+		ActorType: inventoryActorType,
+		ActorID:   actorID,
+		Method:    method,
+		Data:      data,
+	}); err != nil {
+		return fmt.Errorf("couldn't invoke %s/%s/%s: %w", inventoryActorType, actorID, method, err)
+	}
+	return nil
+}
+
+// InventoryActor hosts the InventoryActors, which the sidecar calls through
+// the actor HTTP protocol. Each actor holds the reservation of an order, and
+// a reminder releases it unless the order is paid within the reservation
+// window. The sidecar calls each actor one call at a time, so its state needs
+// no further locking.
+type InventoryActor struct {
+	client dapr.Client
+	window time.Duration
+}
+
+func NewInventoryActor(client dapr.Client, window time.Duration) *InventoryActor {
+	return &InventoryActor{client: client, window: window}
+}
+
+// daprActorConfig is the configuration of the actors hosted by the app,
+// fetched by the sidecar at startup.
+type daprActorConfig struct {
+	Entities         []string `json:"entities"`
+	ActorIdleTimeout string   `json:"actorIdleTimeout"`
+}
+
+// RegisterRoutes registers the routes of the actor HTTP protocol on router.
+// They are called by the sidecar, which doesn't authenticate to the app.
+func (a *InventoryActor) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/dapr/config", a.handleConfig).Methods("GET")
+	// the sidecar checks the health of the app before placing actors on it
+	router.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+
+	actors := router.PathPrefix("/actors/" + inventoryActorType + "/{id}").Subrouter()
+	actors.HandleFunc("", a.handleDeactivate).Methods("DELETE")
+	actors.HandleFunc("/method/remind/{reminder}", a.handleReminder).Methods("PUT")
+	actors.HandleFunc("/method/{method}", a.handleMethod).Methods("PUT")
+}
+
+func (a *InventoryActor) handleConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(daprActorConfig{
+		Entities:         []string{inventoryActorType},
+		ActorIdleTimeout: "1h",
+	})
+}
+
+// handleDeactivate acknowledges the deactivation of an actor, which keeps no
+// state in memory.
+func (a *InventoryActor) handleDeactivate(w http.ResponseWriter, r *http.Request) {}
+
+func (a *InventoryActor) handleMethod(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	actorID, method := vars["id"], vars["method"]
+
+	var order Order
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBodySize)).Decode(&order); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad request: invalid order")
+		return
+	}
+
+	var err error
+	switch method {
+	case inventoryMethodReserve:
+		err = a.reserve(r.Context(), actorID, order)
+	case inventoryMethodConfirm:
+		err = a.settle(r.Context(), actorID, ReservationStatusConfirmed)
+	case inventoryMethodRelease:
+		err = a.settle(r.Context(), actorID, ReservationStatusReleased)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Unknown method %s", method)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "couldn't update reservation", "actor", actorID, "method", method, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Internal server error")
+	}
+}
+
+// handleReminder releases the reservation of an order which wasn't paid
+// within the reservation window.
+func (a *InventoryActor) handleReminder(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	actorID, reminder := vars["id"], vars["reminder"]
+	if reminder != inventoryReminderRelease {
+		slog.WarnContext(r.Context(), "ignoring unknown reminder", "actor", actorID, "reminder", reminder)
+		return
+	}
+
+	// the reminder fires once, so it needs no unregistering
+	if err := a.update(r.Context(), actorID, ReservationStatusReleased); err != nil {
+		slog.ErrorContext(r.Context(), "couldn't release reservation", "actor", actorID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Internal server error")
+		return
+	}
+	slog.InfoContext(r.Context(), "released expired reservation", "actor", actorID)
+}
+
+// reserve reserves the line items of order and registers the reminder
+// releasing them once the window expires.
+func (a *InventoryActor) reserve(ctx context.Context, actorID string, order Order) error {
+	now := time.Now().UTC()
+	reservation := Reservation{
+		OrderID:    order.ID,
+		Tenant:     order.Tenant,
+		LineItems:  order.LineItems,
+		Status:     ReservationStatusReserved,
+		ReservedAt: now,
+		ExpiresAt:  now.Add(a.window),
+	}
+	if err := a.save(ctx, actorID, reservation); err != nil {
+		return err
+	}
+	if err := a.client.RegisterActorReminder(ctx, &dapr.RegisterActorReminderRequest{
+		ActorType: inventoryActorType,
+		ActorID:   actorID,
+		Name:      inventoryReminderRelease,
+		DueTime:   a.window.String(),
+	}); err != nil {
+		return fmt.Errorf("couldn't register reminder: %w", err)
+	}
+	return nil
+}
+
+// settle confirms or releases the reservation before its window expires, and
+// unregisters the reminder which would have released it.
+func (a *InventoryActor) settle(ctx context.Context, actorID string, status ReservationStatus) error {
+	if err := a.update(ctx, actorID, status); err != nil {
+		return err
+	}
+	if err := a.client.UnregisterActorReminder(ctx, &dapr.UnregisterActorReminderRequest{
+		ActorType: inventoryActorType,
+		ActorID:   actorID,
+		Name:      inventoryReminderRelease,
+	}); err != nil {
+		return fmt.Errorf("couldn't unregister reminder: %w", err)
+	}
+	return nil
+}
+
+// update moves the reservation of the actor to status, if it is still
+// reserved. Settled reservations are left as they are, so that a late
+// reminder doesn't release the stock of a paid order.
+func (a *InventoryActor) update(ctx context.Context, actorID string, status ReservationStatus) error {
+	reservation, err := a.load(ctx, actorID)
+	if errors.Is(err, errNoReservation) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if reservation.Status != ReservationStatusReserved {
+		return nil
+	}
+	reservation.Status = status
+	return a.save(ctx, actorID, reservation)
+}
+
+var errNoReservation = errors.New("no reservation")
+
+func (a *InventoryActor) load(ctx context.Context, actorID string) (Reservation, error) {
+	resp, err := a.client.GetActorState(ctx, &dapr.GetActorStateRequest{
+		ActorType: inventoryActorType,
+		ActorID:   actorID,
+		KeyName:   inventoryStateKey,
+	})
+	if err != nil {
+		return Reservation{}, fmt.Errorf("couldn't get reservation: %w", err)
+	}
+	if len(resp.Data) == 0 {
+		return Reservation{}, errNoReservation
+	}
+	var reservation Reservation
+	if err := json.Unmarshal(resp.Data, &reservation); err != nil {
+		return Reservation{}, fmt.Errorf("couldn't decode reservation: %w", err)
+	}
+	return reservation, nil
+}
+
+func (a *InventoryActor) save(ctx context.Context, actorID string, reservation Reservation) error {
+	data, err := json.Marshal(reservation)
+	if err != nil {
+		return fmt.Errorf("couldn't encode reservation: %w", err)
+	}
+	if err := a.client.SaveStateTransactionally(ctx, inventoryActorType, actorID, []*dapr.ActorStateOperation{
+		{OperationType: "upsert", Key: inventoryStateKey, Value: data},
+	}); err != nil {
+		return fmt.Errorf("couldn't save reservation: %w", err)
+	}
+	return nil
+}
+
+// updateReservation reserves the stock of the orders changing to pending, and
+// confirms or releases it when they are paid or cancelled. Failures are only
+// logged: the order stands, and a reservation left behind is released by its
+// reminder.
+func (h *AppHandler) updateReservation(ctx context.Context, previous OrderStatus, order Order) {
+	var err error
+	switch {
+	case order.Status == OrderStatusPending:
+		err = h.inventory.Reserve(ctx, order)
+	case previous == OrderStatusPending && order.Status == OrderStatusPaid:
+		err = h.inventory.Confirm(ctx, order)
+	case previous == OrderStatusPending && order.Status == OrderStatusCancelled:
+		err = h.inventory.Release(ctx, order)
+	default:
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't update inventory reservation", "order", order.ID, "status", order.Status, "error", err)
+	}
+}
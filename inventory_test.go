@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestDaprInventory(t *testing.T) {
+	client := &fakeDaprClient{}
+	inventory := NewDaprInventory(client)
+	order := Order{ID: "order-1234", Status: OrderStatusPending, Tenant: "acme"}
+
+	for _, call := range []func(context.Context, Order) error{inventory.Reserve, inventory.Confirm, inventory.Release} {
+		if err := call(context.Background(), order); err != nil {
+			t.Fatalf("couldn't invoke actor: %s", err)
+		}
+	}
+
+	var methods []string
+	for _, call := range client.actorCalls {
+		if call.ActorType != inventoryActorType || call.ActorID != "acme.order-1234" {
+			t.Fatalf("expected the actor of the order to be invoked. Got %s/%s.", call.ActorType, call.ActorID)
+		}
+		var got Order
+		if err := json.Unmarshal(call.Data, &got); err != nil || got.ID != order.ID {
+			t.Fatalf("expected the order to be sent. Got %s (%v).", call.Data, err)
+		}
+		methods = append(methods, call.Method)
+	}
+	if expected := []string{inventoryMethodReserve, inventoryMethodConfirm, inventoryMethodRelease}; !slices.Equal(methods, expected) {
+		t.Fatalf("expected methods %v. Got %v.", expected, methods)
+	}
+
+	client.actorErr = errors.New("unavailable")
+	if err := inventory.Reserve(context.Background(), order); err == nil {
+		t.Fatal("expected the reservation to fail")
+	}
+}
+
+// newInventoryActorServer serves the InventoryActors keeping their state in
+// client.
+func newInventoryActorServer(t *testing.T, client *fakeDaprClient) *httptest.Server {
+	t.Helper()
+
+	router := mux.NewRouter()
+	NewInventoryActor(client, time.Minute).RegisterRoutes(router)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// reservation returns the reservation of order-1234 kept in client.
+func reservation(t *testing.T, client *fakeDaprClient) Reservation {
+	t.Helper()
+
+	var reservation Reservation
+	if err := json.Unmarshal(client.actorState[actorKey(inventoryActorType, "order-1234", inventoryStateKey)], &reservation); err != nil {
+		t.Fatalf("couldn't decode reservation: %s", err)
+	}
+	return reservation
+}
+
+func TestInventoryActor(t *testing.T) {
+	order := `{"id":"order-1234","status":"PENDING","lineItems":[{"sku":"sku-1","quantity":2}]}`
+	methodPath := "/actors/InventoryActor/order-1234/method/"
+	reminderKey := actorKey(inventoryActorType, "order-1234", inventoryReminderRelease)
+
+	tests := []struct {
+		name string
+		// calls are the paths called in turn after the reservation, reminder
+		// whether the reminder is left registered, the fake client not
+		// deleting the reminders which fired
+		calls    []string
+		expected ReservationStatus
+		reminder bool
+	}{
+		{name: "reserved", expected: ReservationStatusReserved, reminder: true},
+		{name: "paid", calls: []string{methodPath + "confirm"}, expected: ReservationStatusConfirmed},
+		{name: "cancelled", calls: []string{methodPath + "release"}, expected: ReservationStatusReleased},
+		{name: "expired", calls: []string{methodPath + "remind/release"}, expected: ReservationStatusReleased, reminder: true},
+		{name: "paid before expiring", calls: []string{methodPath + "confirm", methodPath + "remind/release"}, expected: ReservationStatusConfirmed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeDaprClient{}
+			server := newInventoryActorServer(t, client)
+
+			for _, path := range append([]string{methodPath + "reserve"}, tt.calls...) {
+				resp, body := doRequest(t, "PUT", server.URL+path, "application/json", "", []byte(order))
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("expected status code %d for %s. Got %d: %s", http.StatusOK, path, resp.StatusCode, body)
+				}
+			}
+
+			got := reservation(t, client)
+			if got.Status != tt.expected || len(got.LineItems) != 1 || !got.ExpiresAt.Equal(got.ReservedAt.Add(time.Minute)) {
+				t.Fatalf("expected a %s reservation of the line items for a minute. Got %+v.", tt.expected, got)
+			}
+			reminder, ok := client.reminders[reminderKey]
+			if ok != tt.reminder {
+				t.Fatalf("expected the reminder to be registered to be %t. Got %t.", tt.reminder, ok)
+			}
+			if ok && reminder.DueTime != "1m0s" {
+				t.Fatalf("expected the reminder to be due in a minute. Got %q.", reminder.DueTime)
+			}
+		})
+	}
+}
+
+func TestInventoryActorRoutes(t *testing.T) {
+	server := newInventoryActorServer(t, &fakeDaprClient{})
+
+	resp, body := doRequest(t, "GET", server.URL+"/dapr/config", "", "", nil)
+	var config daprActorConfig
+	if err := json.Unmarshal(body, &config); err != nil || !slices.Equal(config.Entities, []string{inventoryActorType}) {
+		t.Fatalf("expected the app to host %s. Got %d: %s", inventoryActorType, resp.StatusCode, body)
+	}
+
+	tests := []struct {
+		method   string
+		path     string
+		expected int
+	}{
+		{"GET", "/healthz", http.StatusOK},
+		{"DELETE", "/actors/InventoryActor/order-1234", http.StatusOK},
+		{"PUT", "/actors/InventoryActor/order-1234/method/unknown", http.StatusNotFound},
+		{"PUT", "/actors/OtherActor/order-1234/method/reserve", http.StatusNotFound},
+		// releasing an order never reserved is a no-op
+		{"PUT", "/actors/InventoryActor/order-1234/method/release", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			resp, body := doRequest(t, tt.method, server.URL+tt.path, "application/json", "", []byte(`{"id":"order-1234"}`))
+			if resp.StatusCode != tt.expected {
+				t.Fatalf("expected status code %d. Got %d: %s", tt.expected, resp.StatusCode, body)
+			}
+		})
+	}
+}
+
+func TestUpdateReservation(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing *Order
+		update   func(h *AppHandler) updateResult
+		expected []string
+	}{
+		{
+			name: "pending order",
+			update: func(h *AppHandler) updateResult {
+				return h.updateOrder(context.Background(), "order-1234", OrderUpdate{Status: OrderStatusPending}, "")
+			},
+			expected: []string{"reserve order-1234"},
+		},
+		{
+			name:     "paid order",
+			existing: &Order{ID: "order-1234", Status: OrderStatusPending},
+			update: func(h *AppHandler) updateResult {
+				return h.updateOrder(context.Background(), "order-1234", OrderUpdate{Status: OrderStatusPaid}, "")
+			},
+			expected: []string{"confirm order-1234"},
+		},
+		{
+			name: "order paid right away",
+			update: func(h *AppHandler) updateResult {
+				return h.updateOrder(context.Background(), "order-1234", OrderUpdate{Status: OrderStatusPaid}, "")
+			},
+		},
+		{
+			name:     "cancelled order",
+			existing: &Order{ID: "order-1234", Status: OrderStatusPending},
+			update:   func(h *AppHandler) updateResult { return h.cancelOrder(context.Background(), "order-1234", "") },
+			expected: []string{"release order-1234"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMockOrderRepository()
+			if tt.existing != nil {
+				store.save(*tt.existing)
+			}
+			// a failed reservation doesn't fail the order
+			inventory := &mockInventory{err: errors.New("unavailable")}
+			h := newMockHandler(&mockPublisher{}, store)
+			h.inventory = inventory
+
+			if res := tt.update(h); res.Code != http.StatusOK {
+				t.Fatalf("expected the order to be updated. Got %+v.", res)
+			}
+			if !slices.Equal(inventory.calls, tt.expected) {
+				t.Fatalf("expected reservation calls %v. Got %v.", tt.expected, inventory.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+const (
+	LogFormatJSON = "json"
+	LogFormatText = "text"
+
+	LogOutputStdout = "stdout"
+	LogOutputStderr = "stderr"
+
+	defaultServiceName = "app"
+)
+
+// version is the version of the app, set at build time with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+// LogConfig configures the logs of the app. Every record carries the service
+// and version attributes, so that the log pipeline tells the apps and their
+// releases apart.
+type LogConfig struct {
+	// Level is the level the app starts logging at.
+	Level slog.Level
+	// Format is either LogFormatJSON or LogFormatText.
+	Format string
+	// Output is either LogOutputStdout or LogOutputStderr.
+	Output  string
+	Service string
+	Version string
+}
+
+// Validate rejects unknown formats and outputs.
+func (c LogConfig) Validate() error {
+	if c.Format != LogFormatJSON && c.Format != LogFormatText {
+		return fmt.Errorf("unknown log format %q, expected %s or %s", c.Format, LogFormatJSON, LogFormatText)
+	}
+	if c.Output != LogOutputStdout && c.Output != LogOutputStderr {
+		return fmt.Errorf("unknown log output %q, expected %s or %s", c.Output, LogOutputStdout, LogOutputStderr)
+	}
+	return nil
+}
+
+// Writer returns the stream the logs are written to.
+func (c LogConfig) Writer() io.Writer {
+	if c.Output == LogOutputStderr {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// NewLogger returns a logger writing the records of level and above to w, in
+// config's format. level is a *slog.LevelVar for the level to change at
+// runtime. Records logged with a context carrying a correlation ID carry it
+// as well.
+func NewLogger(w io.Writer, config LogConfig, level slog.Leveler) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewJSONHandler(w, opts)
+	if config.Format == LogFormatText {
+		handler = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(correlationHandler{handler}).With("service", config.Service, "version", config.Version)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LogConfig{Format: LogFormatJSON, Output: LogOutputStdout, Service: "app", Version: "1.2.3"}, slog.LevelInfo)
+
+	logger.Debug("hidden")
+	logger.Info("shown", "order", "order-1234")
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single JSON record. Got %s: %s", buf.String(), err)
+	}
+	for key, expected := range map[string]any{"level": "INFO", "msg": "shown", "service": "app", "version": "1.2.3", "order": "order-1234"} {
+		if record[key] != expected {
+			t.Fatalf("expected %s to be %v. Got %v.", key, expected, record)
+		}
+	}
+
+	buf.Reset()
+	NewLogger(&buf, LogConfig{Format: LogFormatText, Service: "app", Version: "dev"}, slog.LevelDebug).Debug("shown")
+	if !strings.Contains(buf.String(), "level=DEBUG msg=shown service=app version=dev") {
+		t.Fatalf("expected a text record at the debug level. Got %s.", buf.String())
+	}
+}
+
+func TestLogConfigRedactsSecrets(t *testing.T) {
+	config := &Config{
+		DaprAPIToken: "dapr-api-token",
+		Auth: AuthConfig{
+			APIKeys:      []Secret{"api-key-1", "api-key-2"},
+			AdminAPIKeys: []Secret{"admin-api-key"},
+			JWTSecret:    "jwt-secret",
+		},
+		Events: EventConfig{SigningKey: "signing-key"},
+	}
+
+	var buf bytes.Buffer
+	NewLogger(&buf, LogConfig{Format: LogFormatJSON, Output: LogOutputStdout}, slog.LevelInfo).Info("Starting server", "config", config, "token", config.DaprAPIToken)
+
+	for _, secret := range []string{"dapr-api-token", "api-key-1", "api-key-2", "admin-api-key", "jwt-secret", "signing-key"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Fatalf("expected %s redacted. Got %s.", secret, buf.String())
+		}
+	}
+	if !strings.Contains(buf.String(), `"JWTSecret":"[redacted]"`) {
+		t.Fatalf("expected the secrets logged as redacted. Got %s.", buf.String())
+	}
+}
+
+func TestLogConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  LogConfig
+		wantErr bool
+	}{
+		{name: "json to stdout", config: LogConfig{Format: LogFormatJSON, Output: LogOutputStdout}},
+		{name: "text to stderr", config: LogConfig{Format: LogFormatText, Output: LogOutputStderr}},
+		{name: "unknown format", config: LogConfig{Format: "logfmt", Output: LogOutputStdout}, wantErr: true},
+		{name: "unknown output", config: LogConfig{Format: LogFormatJSON, Output: "/var/log/app.log"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("expected error: %t. Got %v.", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLogLevelRoutes(t *testing.T) {
+	logLevel := new(slog.LevelVar)
+	config := &Config{Auth: AuthConfig{APIKeys: []Secret{"api-key"}, AdminAPIKeys: []Secret{"admin-key"}}}
+	h := NewAppHandler(config, NewMetrics(), nil, nil)
+	h.logLevel = logLevel
+	h.RegisterRoutes()
+
+	tests := []struct {
+		name   string
+		method string
+		apiKey string
+		body   string
+		// expected is the status code of the answer, whose body contains
+		// expectedBody, and level the level logged at afterwards
+		expected     int
+		expectedBody string
+		level        slog.Level
+	}{
+		{name: "get", method: http.MethodGet, apiKey: "admin-key", expected: http.StatusOK, expectedBody: `{"level":"INFO"}`},
+		{name: "API key", method: http.MethodPut, apiKey: "api-key", body: `{"level":"debug"}`, expected: http.StatusUnauthorized},
+		{name: "no key", method: http.MethodPut, body: `{"level":"debug"}`, expected: http.StatusUnauthorized},
+		{name: "unknown level", method: http.MethodPut, apiKey: "admin-key", body: `{"level":"verbose"}`, expected: http.StatusBadRequest},
+		{name: "malformed body", method: http.MethodPut, apiKey: "admin-key", body: `debug`, expected: http.StatusBadRequest},
+		{
+			name: "debug", method: http.MethodPut, apiKey: "admin-key", body: `{"level":"debug"}`,
+			expected: http.StatusOK, expectedBody: `{"level":"DEBUG"}`, level: slog.LevelDebug,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logLevel.Set(slog.LevelInfo)
+
+			req := httptest.NewRequest(tt.method, "/admin/loglevel", strings.NewReader(tt.body))
+			req.Header.Set("X-API-Key", tt.apiKey)
+			rec := httptest.NewRecorder()
+			h.router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.expected || !strings.Contains(rec.Body.String(), tt.expectedBody) {
+				t.Fatalf("expected status code %d and body %s. Got %d: %s", tt.expected, tt.expectedBody, rec.Code, rec.Body)
+			}
+			if logLevel.Level() != tt.level {
+				t.Fatalf("expected level %s. Got %s.", tt.level, logLevel.Level())
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// logLevelBody is the body of the log level routes.
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+func (h *AppHandler) handleLogLevelGet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(logLevelBody{Level: h.logLevel.Level().String()}); err != nil {
+		slog.ErrorContext(r.Context(), "couldn't encode log level", "error", err)
+	}
+}
+
+// handleLogLevelPut changes the level of the logs, such as to debug during an
+// incident, until the app restarts or the level is changed back. It answers
+// the level the app now logs at.
+func (h *AppHandler) handleLogLevelPut(w http.ResponseWriter, r *http.Request) {
+	var body logLevelBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad request")
+		return
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(body.Level)); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad request: %s", err)
+		return
+	}
+
+	previous := h.logLevel.Level()
+	h.logLevel.Set(level)
+	// logged whatever the level, so that the change shows in the logs
+	slog.WarnContext(r.Context(), "changed log level", "from", previous, "to", level)
+
+	h.handleLogLevelGet(w, r)
+}
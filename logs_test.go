@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// testLog writes the logs of the containers of a stack to the log of the
+// test using the stack, or to the standard logger when no test does, such as
+// between the tests sharing a stack.
+type testLog struct {
+	mu sync.Mutex
+	t  testing.TB
+}
+
+// use writes the logs to the log of t until it completes.
+func (l *testLog) use(t testing.TB) {
+	l.mu.Lock()
+	l.t = t
+	l.mu.Unlock()
+	t.Cleanup(func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.t == t {
+			l.t = nil
+		}
+	})
+}
+
+func (l *testLog) printf(format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.t != nil {
+		l.t.Logf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// containerLog is a LogConsumer writing the lines a container logs, prefixed
+// with its name, to a testLog.
+type containerLog struct {
+	name string
+	log  *testLog
+}
+
+func (c containerLog) Accept(l testcontainers.Log) {
+	for _, line := range strings.Split(strings.TrimRight(string(l.Content), "\n"), "\n") {
+		c.log.printf("[%s] %s", c.name, line)
+	}
+}
+
+// followLogs is a wait strategy streaming the logs of the container to
+// consumer before waiting with strategy. Lifecycle hooks only run once the
+// container is ready, whereas the logs of a container which never gets ready
+// are the ones that matter.
+type followLogs struct {
+	consumer testcontainers.LogConsumer
+	strategy wait.Strategy
+}
+
+func (f followLogs) WaitUntilReady(ctx context.Context, target wait.StrategyTarget) error {
+	if c, ok := target.(testcontainers.Container); ok {
+		c.FollowOutput(f.consumer)
+		if err := c.StartLogProducer(ctx); err != nil {
+			return err
+		}
+	}
+	if f.strategy == nil {
+		return nil
+	}
+	return f.strategy.WaitUntilReady(ctx, target)
+}
+
+// recordingTB records the messages logged through Logf, and the functions
+// registered through Cleanup.
+type recordingTB struct {
+	testing.TB
+	lines    []string
+	cleanups []func()
+}
+
+func (r *recordingTB) Logf(format string, args ...any) {
+	r.lines = append(r.lines, fmt.Sprintf(format, args...))
+}
+
+func (r *recordingTB) Cleanup(f func()) {
+	r.cleanups = append(r.cleanups, f)
+}
+
+func TestContainerLog(t *testing.T) {
+	var l testLog
+	tb := &recordingTB{TB: t}
+	l.use(tb)
+
+	consumer := containerLog{name: "dapr-app-1234", log: &l}
+	consumer.Accept(testcontainers.Log{
+		LogType: testcontainers.StdoutLog,
+		Content: []byte("dapr initialized\nstatus: ready\n"),
+	})
+
+	expected := []string{"[dapr-app-1234] dapr initialized", "[dapr-app-1234] status: ready"}
+	if !slices.Equal(tb.lines, expected) {
+		t.Fatalf("expected %q. Got %q.", expected, tb.lines)
+	}
+
+	// once the test completed, logs no longer go to it
+	for _, f := range tb.cleanups {
+		f()
+	}
+	consumer.Accept(testcontainers.Log{LogType: testcontainers.StdoutLog, Content: []byte("shutting down\n")})
+	if len(tb.lines) != len(expected) {
+		t.Fatalf("expected no message after the test completed. Got %q.", tb.lines)
+	}
+}
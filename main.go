@@ -3,19 +3,54 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	dapr "github.com/dapr/go-sdk/client"
 	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 type Order struct {
-	ID     string      `json:"id"`
-	Status OrderStatus `json:"status"`
+	ID        string      `json:"id"`
+	Status    OrderStatus `json:"status"`
+	Tenant    string      `json:"tenant,omitempty"`
+	LineItems []LineItem  `json:"lineItems,omitempty"`
+	// Amount is the total of the order in minor units of Currency, e.g.
+	// cents of EUR. Both are exposed by the v2 API.
+	Amount   int64  `json:"amount,omitempty"`
+	Currency string `json:"currency,omitempty"`
+	// CustomerID is the customer who placed the order, exposed by the v2
+	// API. It can't change once set.
+	CustomerID string `json:"customerId,omitempty"`
+}
+
+// LineItem is a product of an order, exposed by the v2 API.
+type LineItem struct {
+	SKU      string `json:"sku"`
+	Quantity int    `json:"quantity"`
+	// UnitPrice is in minor units of the currency of the order. The amount of
+	// an order whose line items are priced is their total.
+	UnitPrice int64 `json:"unitPrice,omitempty"`
+}
+
+// sameContent reports whether a and b have the same line items, amount and
+// customer, what an order holds besides its status.
+func sameContent(a, b Order) bool {
+	return slices.Equal(a.LineItems, b.LineItems) && a.Amount == b.Amount && a.Currency == b.Currency &&
+		a.CustomerID == b.CustomerID
 }
 
 type OrderStatus string
@@ -24,93 +59,1253 @@ const (
 	OrderStatusPaid    OrderStatus = "PAID"
 	OrderStatusPending OrderStatus = "PENDING"
 	OrderStatusUnknown OrderStatus = "UNKNOWN"
+	// OrderStatusCancelled and OrderStatusRefunded are only reached through
+	// the endpoints of statusEndpoints.
+	OrderStatusCancelled OrderStatus = "CANCELLED"
+	OrderStatusRefunded  OrderStatus = "REFUNDED"
 )
 
 type SchemaPatchOrder struct {
 	Status OrderStatus `json:"status"`
 }
 
-const defaultDaprURL = "0.0.0.0:50001"
+const (
+	defaultDaprURL            = "0.0.0.0:50001"
+	defaultListLimit          = 20
+	maxListLimit              = 100
+	defaultPublishMaxAttempts = 3
+	defaultPublishBaseDelay   = 100 * time.Millisecond
+	defaultPublishMaxDelay    = 2 * time.Second
+
+	defaultCircuitBreakerFailureThreshold = 5
+	defaultCircuitBreakerOpenTimeout      = 30 * time.Second
+
+	defaultWebhookWorkers       = 2
+	defaultWebhookQueueSize     = 100
+	defaultWebhookTimeout       = 5 * time.Second
+	defaultWebhookRetryAttempts = 3
+
+	defaultBatchWorkers = 8
+
+	defaultSnapshotEvery = 100
+
+	defaultOrderEventsConcurrency    = 8
+	defaultPriorityEventsConcurrency = 4
+
+	defaultDaprPublishTimeout = 5 * time.Second
+	defaultDaprStateTimeout   = 5 * time.Second
+
+	// shutdownTimeout bounds the time left to in-flight requests once the
+	// server is asked to stop.
+	shutdownTimeout = 10 * time.Second
+)
+
+// Secret is a configuration value that must not end up in logs. It is
+// redacted however it is formatted, including by the JSON handler of the
+// logger, which encodes the structs logged with encoding/json.
+type Secret string
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(s.String())
+}
 
 type Config struct {
-	DaprURL string
+	// Port is the port the API is served on.
+	Port         int
+	DaprURL      string
+	DaprAPIToken Secret
+	Pubsub       PubsubConfig
+	// FeatureFlagsStore is the Dapr configuration store the feature flags
+	// are read from, none if empty.
+	FeatureFlagsStore string
+	// Secrets configures the rotation of the credentials of Auth.
+	Secrets        SecretsConfig
+	PublishRetry   RetryPolicy
+	CircuitBreaker CircuitBreakerConfig
+	Timeouts       DaprTimeouts
+	TopicAllowlist TopicAllowlist
+	Auth           AuthConfig
+	Webhooks       WebhookConfig
+	Tenants        TenantConfig
+	Events         EventConfig
+	// BatchWorkers bounds the number of orders of a batch updated
+	// concurrently.
+	BatchWorkers int
+	PublishQueue PublishQueueConfig
+	TLS          TLSConfig
+	// PaymentsAppID is the app ID of the payments app verifying the charge of
+	// the orders changing to paid, none if empty.
+	PaymentsAppID string
+	// ReservationWindow is the time the stock of a pending order stays
+	// reserved, waiting for its payment. Stock isn't reserved if zero.
+	ReservationWindow time.Duration
+	// EventSourcing stores the orders as streams of events, their state
+	// being derived from their events.
+	EventSourcing bool
+	// RefundWorkflow runs the refunds as Dapr workflows, which the sidecar
+	// runs with the placement service, rather than within the requests.
+	RefundWorkflow bool
+	// SnapshotEvery is the number of events of an order between two
+	// snapshots of it. Orders aren't snapshotted if zero.
+	SnapshotEvery int
+	// StartupTimeout bounds the time the app waits for the sidecar to be
+	// ready before it serves traffic.
+	StartupTimeout time.Duration
+	// OrderEventsConcurrency and PriorityEventsConcurrency bound the events
+	// of the orders and orders.priority topics handled at once, unless zero.
+	OrderEventsConcurrency    int
+	PriorityEventsConcurrency int
+	// EnablePprof serves the pprof endpoints on PprofAddress, a port of
+	// their own.
+	EnablePprof  bool
+	PprofAddress string
+	Log          LogConfig
+	// MaxRequestBodySize bounds the body of the requests changing orders,
+	// customers, webhooks or operating the app, in bytes.
+	MaxRequestBodySize int
+	Compression        CompressionConfig
+	CORS               CORSConfig
+}
+
+// TLSConfig holds the certificate and key the app serves HTTPS with. The app
+// serves plain HTTP unless both are set.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Enabled reports whether the app serves HTTPS.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
 }
 
 type AppHandler struct {
-	config *Config
-	router *mux.Router
+	config    *Config
+	router    *mux.Router
+	metrics   *Metrics
+	publisher EventPublisher
+	store     OrderRepository
+	webhooks  *WebhookStore
+	shipments *ShipmentStore
+	notifier  *WebhookDispatcher
+	hub       *OrderHub
+	health    *HealthChecker
+	// payments verifies the charge of the orders changing to paid, if set.
+	payments Payments
+	// inventory reserves the stock of the pending orders, if set.
+	inventory Inventory
+	// customers indexes the orders of the customers, if set.
+	customers *CustomerStore
+	// stats projects the order events into the stats of the orders, if set.
+	stats *StatsStore
+	// quarantined keeps the order events failing for good, if set.
+	quarantined *QuarantineStore
+	// logLevel is the level of the logs operators change at runtime, if set.
+	logLevel *slog.LevelVar
+	// flags gates the behaviors toggled at runtime, all at their default if
+	// nil.
+	flags *FeatureFlags
+	// credentials authenticates the requests, with the credentials of the
+	// config if nil.
+	credentials *Credentials
+	// signer verifies the signature of the order events delivered.
+	signer *EventSigner
+	// publishQueue publishes the events of the order updates once they are
+	// answered, if set.
+	publishQueue *PublishQueue
+	// startup holds the traffic until the sidecar is ready, if set.
+	startup *StartupGate
+	// refunds runs the refunds as Dapr workflows, if set.
+	refunds *RefundWorkflow
 }
 
-func NewAppHandler(config *Config) *AppHandler {
+// NewAppHandler returns a handler publishing the order events with publisher
+// and storing the orders in store. The optional dependencies, left nil, are
+// set on its fields before RegisterRoutes.
+func NewAppHandler(config *Config, metrics *Metrics, publisher EventPublisher, store OrderRepository) *AppHandler {
 	return &AppHandler{
-		config: config,
-		router: mux.NewRouter(),
+		config:    config,
+		router:    mux.NewRouter(),
+		metrics:   metrics,
+		publisher: publisher,
+		store:     store,
+		hub:       NewOrderHub(),
 	}
 }
 
 func (h *AppHandler) RegisterRoutes() {
+	h.router.Use(PropagateTraceContext)
+	h.router.Use(PropagateCorrelationID)
+	if h.config.CORS.Enabled() {
+		h.router.Use(CORS(h.config.CORS))
+		// the preflight requests of the browsers carry no credentials, they
+		// are answered by the middleware on any path
+		h.router.Methods(http.MethodOptions).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+
+	// the preflight requests are answered while the traffic is held, the
+	// CORS middleware answering them first
+	if h.startup != nil {
+		h.router.Use(h.startup.Middleware)
+	}
+
 	h.router.HandleFunc("/health", h.handleHealth).Methods("GET")
-	h.router.HandleFunc("/orders/{id:order-[0-9]{4}}", h.handleOrdersPut).Methods("PUT")
+	h.router.HandleFunc("/readyz", h.handleReady).Methods("GET")
+	h.router.HandleFunc("/healthz", h.handleHealthz).Methods("GET")
+	h.router.HandleFunc("/healthz/deep", h.handleHealthDeep).Methods("GET")
+	h.router.Handle("/metrics", h.metrics.Handler()).Methods("GET")
+
+	// called by the sidecar, which doesn't authenticate to the app
+	h.router.HandleFunc("/dapr/subscribe", h.handleDaprSubscribe).Methods("GET")
+	// priority events are handled with slots of their own, so that a burst
+	// of other events doesn't hold them back
+	// the routes of the orders topic share its slots
+	orderEvents := newConcurrencyLimit(h.config.OrderEventsConcurrency)
+	h.router.HandleFunc(routeOrderEvents, orderEvents(h.handleOrderEvent)).Methods("POST")
+	h.router.HandleFunc(routePaidOrderEvents, orderEvents(h.handlePaidOrderEvent)).Methods("POST")
+	h.router.HandleFunc(routeCancelledOrderEvents, orderEvents(h.handleCancelledOrderEvent)).Methods("POST")
+	h.router.HandleFunc(routePriorityOrderEvents, limitConcurrency(h.config.PriorityEventsConcurrency, h.handleOrderEvent)).Methods("POST")
+
+	if h.credentials == nil {
+		h.credentials = NewCredentials(nil, SecretsConfig{}, h.config.Auth, h.config.Events.SigningKey, h.metrics)
+	}
+	h.signer = NewEventSigner(h.credentials)
+	if !h.credentials.Enabled() {
+		slog.Warn("authentication is disabled, order, webhook and websocket routes are not protected")
+	}
+
+	// the admin routes operate the app for every tenant
+	admin := h.router.PathPrefix("/admin").Subrouter()
+	if h.credentials.AdminEnabled() {
+		admin.Use(RequireAuth(h.credentials.AdminAuthenticator()))
+	}
+	admin.Use(LimitBodySize(int64(h.config.MaxRequestBodySize)))
+	admin.HandleFunc("/quarantine", h.compressed(h.handleQuarantineList)).Methods("GET")
+	admin.HandleFunc("/quarantine", h.handleQuarantineDelete).Methods("DELETE")
+	admin.HandleFunc("/quarantine/{id:.+}", h.handleQuarantineGet).Methods("GET")
+	admin.HandleFunc("/quarantine/{id:.+}", h.handleQuarantineDelete).Methods("DELETE")
+	admin.HandleFunc("/dlq/replay", h.handleDLQReplay).Methods("POST")
+	if h.logLevel != nil {
+		admin.HandleFunc("/loglevel", h.handleLogLevelGet).Methods("GET")
+		admin.HandleFunc("/loglevel", h.handleLogLevelPut).Methods("PUT")
+	}
+	admin.HandleFunc("/flags", h.handleFeatureFlagsGet).Methods("GET")
+
+	// the unversioned routes predate versioning and serve the v1 API
+	h.registerAPI(h.router, orderMapperV1{})
+	h.registerAPI(h.router.PathPrefix("/v1").Subrouter(), orderMapperV1{})
+	h.registerAPI(h.router.PathPrefix("/v2").Subrouter(), orderMapperV2{})
+}
+
+// registerAPI registers the order, customer, stats, webhook and websocket
+// routes of a version of the API on router, the order payloads being mapped
+// by m.
+func (h *AppHandler) registerAPI(router *mux.Router, m OrderMapper) {
+	orders := h.protected(router.PathPrefix("/orders").Subrouter())
+	orders.HandleFunc("", h.compressed(h.handleOrdersList(m))).Methods("GET")
+	orders.HandleFunc("", h.featureFlagged(flagBatchUpdates, h.backpressured(h.handleOrdersBatchPut(m)))).Methods("PUT")
+	orders.HandleFunc("/{id:order-[0-9]{4}}", h.handleOrdersGet(m)).Methods("GET")
+	orders.HandleFunc("/{id:order-[0-9]{4}}", h.backpressured(h.handleOrdersPut(m))).Methods("PUT")
+	orders.HandleFunc("/{id:order-[0-9]{4}}", h.backpressured(h.handleOrdersPatch(m))).Methods("PATCH")
+	orders.HandleFunc("/{id:order-[0-9]{4}}/cancel", h.handleOrdersCancel).Methods("POST")
+	orders.HandleFunc("/{id:order-[0-9]{4}}/refund", h.handleOrdersRefund).Methods("POST")
+	orders.HandleFunc("/{id:order-[0-9]{4}}/shipments", h.handleShipmentsCreate).Methods("POST")
+	orders.HandleFunc("/{id:order-[0-9]{4}}/shipments", h.compressed(h.handleShipmentsList)).Methods("GET")
+	orders.HandleFunc("/{id:order-[0-9]{4}}/shipments/{shipmentID}", h.handleShipmentsGet).Methods("GET")
+	orders.HandleFunc("/{id:order-[0-9]{4}}/shipments/{shipmentID}/tracking", h.handleShipmentsTrack).Methods("PUT")
+
+	customers := h.protected(router.PathPrefix("/customers").Subrouter())
+	customers.HandleFunc("/{id:customer-[0-9]{4}}", h.handleCustomersPut).Methods("PUT")
+	customers.HandleFunc("/{id:customer-[0-9]{4}}", h.handleCustomersGet).Methods("GET")
+	customers.HandleFunc("/{id:customer-[0-9]{4}}/orders", h.compressed(h.handleCustomersOrders(m))).Methods("GET")
+
+	stats := h.protected(router.PathPrefix("/stats").Subrouter())
+	stats.HandleFunc("", h.handleStats).Methods("GET")
+
+	webhooks := h.protected(router.PathPrefix("/webhooks").Subrouter())
+	webhooks.HandleFunc("", h.handleWebhooksCreate).Methods("POST")
+	webhooks.HandleFunc("", h.compressed(h.handleWebhooksList)).Methods("GET")
+	webhooks.HandleFunc("/{id}", h.handleWebhooksGet).Methods("GET")
+	webhooks.HandleFunc("/{id}", h.handleWebhooksDelete).Methods("DELETE")
+
+	ws := h.protected(router.PathPrefix("/ws").Subrouter())
+	ws.HandleFunc("", h.handleWebSocket).Methods("GET")
+}
+
+// protected requires authentication on router when it is enabled, scopes its
+// requests to their tenant and bounds their body.
+func (h *AppHandler) protected(router *mux.Router) *mux.Router {
+	if h.credentials.Enabled() {
+		router.Use(RequireAuth(h.credentials.Authenticator()))
+	}
+	router.Use(RequireTenant(h.config.Tenants, h.metrics))
+	router.Use(LimitBodySize(int64(h.config.MaxRequestBodySize)))
+	return router
 }
 
 func (h *AppHandler) handleHealth(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "ok\n")
 }
 
-func (h *AppHandler) handleOrdersPut(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	orderID := params["id"]
+func (h *AppHandler) handleOrdersPut(m OrderMapper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderID := mux.Vars(r)["id"]
 
-	ctx := context.Background()
+		update, err := m.DecodeUpdate(r)
+		if err != nil {
+			writeCodecError(w, err)
+			return
+		}
+		expedited, err := expeditedHeader(r)
+		if err != nil {
+			writePriorityError(w, err)
+			return
+		}
+		update.Expedited = update.Expedited || expedited
 
-	client, err := dapr.NewClientWithAddressContext(ctx, h.config.DaprURL)
-	if err != nil {
-		slog.Error("couldn't initialize Dapr client", "error", err)
+		h.writeUpdateResult(w, h.updateOrder(r.Context(), orderID, update, r.Header.Get("If-Match")))
+	}
+}
+
+// updateResult is the outcome of an order update, answered to a single
+// update or reported as an item of a batch.
+type updateResult struct {
+	Code    int
+	Message string
+	// ETag is the version of the stored order, set on conflicts.
+	ETag string
+	// Transition is set when the status change was rejected.
+	Transition *TransitionError
+	// RetryAfter is the time the client should wait before sending the
+	// update again, if set.
+	RetryAfter time.Duration
+}
+
+// updateOrder applies update to the order orderID, publishing and notifying
+// status changes, to the priority topic if the update is expedited. The write
+// is based on the version ifMatch if set. The calls
+// to the sidecar are cancelled with ctx, and a status change whose event
+// couldn't be published is reverted. With a publish queue, the status change
+// is answered as accepted once stored, its event being published afterwards.
+func (h *AppHandler) updateOrder(ctx context.Context, orderID string, update OrderUpdate, ifMatch string) updateResult {
+	if endpoint, ok := statusEndpoints[update.Status]; ok {
+		return updateResult{Code: http.StatusBadRequest, Message: fmt.Sprintf("Bad request: status %s is set with %s", update.Status, endpoint)}
+	}
+
+	data := Order{
+		ID:         orderID,
+		Status:     update.Status,
+		Tenant:     TenantFromContext(ctx),
+		LineItems:  update.LineItems,
+		Currency:   update.Currency,
+		CustomerID: update.CustomerID,
+	}
+	if update.Amount != nil {
+		data.Amount = *update.Amount
+	}
+
+	// the write is based on the version the client has seen if it sent one,
+	// otherwise on the version currently stored, so that concurrent updates
+	// are detected either way
+	current, etag, err := h.store.Get(ctx, orderID)
+	if err != nil && !errors.Is(err, ErrOrderNotFound) {
+		slog.ErrorContext(ctx, "couldn't get order", "error", err)
+		return updateResult{Code: http.StatusServiceUnavailable, Message: "Service unavailable"}
+	}
+	if ifMatch != "" && parseETag(ifMatch) != etag {
+		return conflictResult(etag)
+	}
+
+	if update.LineItems == nil {
+		data.LineItems = current.LineItems
+	}
+	switch {
+	case update.CustomerID == "":
+		data.CustomerID = current.CustomerID
+	case current.CustomerID != "" && update.CustomerID != current.CustomerID:
+		return updateResult{Code: http.StatusBadRequest, Message: fmt.Sprintf("Bad request: the customer of %s can't change", orderID)}
+	}
+	if update.Amount == nil {
+		data.Amount = current.Amount
+		// a currency comes without amount only along with priced line items
+		if data.Currency == "" {
+			data.Currency = current.Currency
+		}
+	}
+	if total, priced := lineItemsTotal(data.LineItems); priced {
+		if update.Amount != nil && *update.Amount != total {
+			return updateResult{Code: http.StatusBadRequest, Message: fmt.Sprintf("Bad request: amount %d isn't the total %d of the line items", *update.Amount, total)}
+		}
+		if data.Currency == "" {
+			return updateResult{Code: http.StatusBadRequest, Message: "Bad request: priced line items need a currency"}
+		}
+		data.Amount = total
+	}
+
+	statusChanged := etag == "" || current.Status != data.Status
+	if !statusChanged && sameContent(current, data) {
+		return updateResult{Code: http.StatusOK, Message: "Order unchanged"}
+	}
+	if statusChanged {
+		if err := orderTransitions.Check(current.Status, data.Status); err != nil {
+			return transitionResult(err)
+		}
+	}
+	if statusChanged && data.Status == OrderStatusPaid && h.payments != nil {
+		if res, ok := h.verifyPayment(ctx, data); !ok {
+			return res
+		}
+	}
+
+	if h.customers != nil && data.CustomerID != current.CustomerID {
+		if res, ok := h.indexCustomerOrder(ctx, data); !ok {
+			return res
+		}
+	}
+
+	// a new order is only created if no concurrent update created it first,
+	// which would otherwise be overwritten and published twice
+	expected := etag
+	if expected == "" {
+		expected = etagAbsent
+	}
+	if err := h.store.Save(ctx, data, expected); err != nil {
+		if errors.Is(err, ErrETagMismatch) {
+			_, currentETag, err := h.store.Get(ctx, orderID)
+			if err != nil {
+				slog.ErrorContext(ctx, "couldn't get order", "error", err)
+				return updateResult{Code: http.StatusServiceUnavailable, Message: "Service unavailable"}
+			}
+			return conflictResult(currentETag)
+		}
+		slog.ErrorContext(ctx, "couldn't save order", "error", err)
+		return updateResult{Code: http.StatusServiceUnavailable, Message: "Service unavailable"}
+	}
+
+	// only status changes are published and notified
+	if !statusChanged {
+		return updateResult{Code: http.StatusOK, Message: "Order updated"}
+	}
+
+	topic := topicOrders
+	if h.flags.Enabled(flagPriorityTopics) {
+		topic = orderTopic(update)
+	}
+	queued := &queuedUpdate{Topic: topic, Order: data, Previous: current, ETag: etag, Time: time.Now()}
+	if h.publishQueue != nil {
+		return h.queueUpdate(ctx, queued)
+	}
+	if err := h.publishUpdate(ctx, queued); err != nil {
+		// subscribers would never hear of the change, so it is undone, even
+		// if the client went away
+		h.revertUpdate(ctx, queued)
+		if permanentPublishError(err) {
+			return updateResult{Code: http.StatusInternalServerError, Message: "Internal server error"}
+		}
+		return updateResult{Code: http.StatusServiceUnavailable, Message: "Service unavailable"}
+	}
+	return updateResult{Code: http.StatusOK, Message: "Order updated"}
+}
+
+// publishUpdate publishes the status change of update to its topic, and
+// notifies it once published.
+func (h *AppHandler) publishUpdate(ctx context.Context, update *queuedUpdate) error {
+	data, current := update.Order, update.Previous
+	event := newOrderStatusChanged(data, current.Status, update.Time)
+	if err := h.publisher.Publish(WithEventKey(ctx, orderEventKey(ctx, data.ID, update.ETag)), handlerOrdersPut, update.Topic, event); err != nil {
+		slog.ErrorContext(ctx, "couldn't publish event", "error", err)
+		return err
+	}
+
+	slog.InfoContext(ctx, "sent message to orders topic", "topic", update.Topic, "data", data)
+	if h.inventory != nil {
+		h.updateReservation(ctx, current.Status, data)
+	}
+	h.metrics.OrderUpdates.WithLabelValues(h.config.Tenants.MetricLabel(data.Tenant)).Inc()
+	h.notifier.Notify(data)
+	return nil
+}
+
+// revertUpdate restores the order of update as it was before.
+func (h *AppHandler) revertUpdate(ctx context.Context, update *queuedUpdate) {
+	if err := RevertOrder(context.WithoutCancel(ctx), h.store, update.Order, update.Previous, update.ETag != ""); err != nil {
+		slog.ErrorContext(ctx, "couldn't revert order", "order", update.Order.ID, "error", err)
+	}
+}
+
+// permanentPublishError reports whether publishing failed for a reason
+// publishing again wouldn't fix.
+func permanentPublishError(err error) bool {
+	return errors.Is(err, ErrTopicNotAllowed) || errors.Is(err, ErrIncompatibleSchema)
+}
+
+// verifyPayment verifies the charge of order, answering res unless ok.
+func (h *AppHandler) verifyPayment(ctx context.Context, order Order) (res updateResult, ok bool) {
+	err := h.payments.Verify(ctx, order)
+	var declined *PaymentDeclinedError
+	switch {
+	case err == nil:
+		return updateResult{}, true
+	case errors.As(err, &declined):
+		slog.InfoContext(ctx, "payment declined", "order", order.ID, "reason", declined.Reason)
+		return updateResult{Code: http.StatusPaymentRequired, Message: "Payment declined: " + declined.Reason}, false
+	default:
+		slog.ErrorContext(ctx, "couldn't verify payment", "order", order.ID, "error", err)
+		return updateResult{Code: http.StatusServiceUnavailable, Message: "Service unavailable"}, false
+	}
+}
+
+// conflictResult rejects a stale write, etag being the stored version.
+func conflictResult(etag string) updateResult {
+	return updateResult{Code: http.StatusConflict, Message: "Conflict: order was modified", ETag: etag}
+}
+
+// transitionResult rejects a status change with its reason.
+func transitionResult(err error) updateResult {
+	var transitionErr *TransitionError
+	if !errors.As(err, &transitionErr) {
+		return updateResult{Code: http.StatusInternalServerError, Message: "Internal server error"}
+	}
+	code := http.StatusConflict
+	if transitionErr.Reason == TransitionReasonUnknownStatus {
+		code = http.StatusBadRequest
+	}
+	return updateResult{Code: code, Message: transitionErr.Error(), Transition: transitionErr}
+}
+
+// writeUpdateResult answers a single update with res. Rejected status changes
+// are answered with their reason in JSON, anything else in plain text.
+func (h *AppHandler) writeUpdateResult(w http.ResponseWriter, res updateResult) {
+	if res.ETag != "" {
+		w.Header().Set("ETag", formatETag(res.ETag))
+	}
+	if res.RetryAfter > 0 {
+		w.Header().Set("Retry-After", retryAfterHeader(res.RetryAfter))
+	}
+	if res.Transition != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(res.Code)
+		if err := json.NewEncoder(w).Encode(res.Transition); err != nil {
+			slog.Error("couldn't encode transition error", "error", err)
+		}
 		return
 	}
+	if res.Code != http.StatusOK {
+		w.WriteHeader(res.Code)
+	}
+	fmt.Fprint(w, res.Message)
+}
 
-	var order SchemaPatchOrder
-	decoder := json.NewDecoder(r.Body)
-	err = decoder.Decode(&order)
+func formatETag(etag string) string {
+	return strconv.Quote(etag)
+}
+
+// parseETag strips the quotes and weak validator prefix of an HTTP ETag.
+func parseETag(header string) string {
+	header = strings.TrimPrefix(strings.TrimSpace(header), "W/")
+	if unquoted, err := strconv.Unquote(header); err == nil {
+		return unquoted
+	}
+	return header
+}
+
+func (h *AppHandler) handleOrdersGet(m OrderMapper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderID := mux.Vars(r)["id"]
+
+		mediaType, err := negotiate(r)
+		if err != nil {
+			writeCodecError(w, err)
+			return
+		}
+
+		order, etag, err := h.store.Get(r.Context(), orderID)
+		if errors.Is(err, ErrOrderNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "Order not found")
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "couldn't get order", "error", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Service unavailable")
+			return
+		}
+
+		w.Header().Set("ETag", formatETag(etag))
+		v, msg := m.Order(order)
+		if err := writeBody(w, mediaType, v, msg); err != nil {
+			slog.ErrorContext(r.Context(), "couldn't encode order", "error", err)
+		}
+	}
+}
+
+// queryInt returns the integer query parameter key of r, or def when it is
+// not set.
+func queryInt(r *http.Request, key string, def int) (int, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Bad request")
-		return
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
 	}
+	return i, nil
+}
 
-	defer client.Close()
+func (h *AppHandler) handleOrdersList(m OrderMapper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mediaType, err := negotiate(r)
+		if err != nil {
+			writeCodecError(w, err)
+			return
+		}
 
-	data := Order{ID: orderID, Status: order.Status}
+		limit, err := queryInt(r, "limit", defaultListLimit)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Bad request: limit must be between 1 and %d", maxListLimit)
+			return
+		}
+		offset, err := queryInt(r, "offset", 0)
+		if err != nil || offset < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Bad request: offset must be a positive integer")
+			return
+		}
 
-	if err := client.PublishEvent(ctx, "order-pub-sub", "orders", data); err != nil {
-		slog.Error("couldn't publish event", "error", err)
-		return
+		list, err := h.store.List(r.Context(), limit, offset)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "couldn't list orders", "error", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Service unavailable")
+			return
+		}
+
+		v, msg := m.List(list)
+		if err := writeBody(w, mediaType, v, msg); err != nil {
+			slog.ErrorContext(r.Context(), "couldn't encode orders", "error", err)
+		}
 	}
+}
 
-	slog.Info("sent message to orders topic", "data", data)
-	fmt.Fprintf(w, "Order updated")
+// StartServer serves the routes on address until ctx is done. Requests are
+// then given shutdownTimeout to complete, their context being cancelled
+// right away so that the calls to the sidecar in progress stop.
+func (h *AppHandler) StartServer(ctx context.Context, address string) error {
+	server := &http.Server{
+		Addr:        address,
+		Handler:     h.router,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		if tlsConfig := h.config.TLS; tlsConfig.Enabled() {
+			errs <- server.ListenAndServeTLS(tlsConfig.CertFile, tlsConfig.KeyFile)
+			return
+		}
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
 }
 
-func (h *AppHandler) StartServer(address string) error {
-	return http.ListenAndServe(address, h.router)
+func lookupEnvInt(key string, value *int) error {
+	if v, ok := os.LookupEnv(key); ok {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+		*value = i
+	}
+	return nil
 }
 
-func main() {
+func lookupEnvList(key string, value *[]string) {
+	if v, ok := os.LookupEnv(key); ok {
+		*value = splitList(v)
+	}
+}
+
+// splitList splits a comma-separated list, ignoring blank items.
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func lookupEnvBool(key string, value *bool) error {
+	if v, ok := os.LookupEnv(key); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+		*value = b
+	}
+	return nil
+}
+
+func lookupEnvDuration(key string, value *time.Duration) error {
+	if v, ok := os.LookupEnv(key); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+		*value = d
+	}
+	return nil
+}
+
+func loadConfig() (*Config, error) {
 	config := &Config{
+		Port:    defaultPort,
 		DaprURL: defaultDaprURL,
+		Pubsub:  PubsubConfig{Name: pubsubName, OrdersTopic: topicOrders},
+		Secrets: SecretsConfig{RefreshInterval: defaultSecretsRefreshInterval},
+		PublishRetry: RetryPolicy{
+			MaxAttempts: defaultPublishMaxAttempts,
+			BaseDelay:   defaultPublishBaseDelay,
+			MaxDelay:    defaultPublishMaxDelay,
+		},
+		CircuitBreaker: CircuitBreakerConfig{
+			FailureThreshold: defaultCircuitBreakerFailureThreshold,
+			OpenTimeout:      defaultCircuitBreakerOpenTimeout,
+		},
+		Timeouts: DaprTimeouts{
+			Publish: defaultDaprPublishTimeout,
+			State:   defaultDaprStateTimeout,
+		},
+		TopicAllowlist: defaultTopicAllowlist(),
+		Webhooks: WebhookConfig{
+			Workers:   defaultWebhookWorkers,
+			QueueSize: defaultWebhookQueueSize,
+			Timeout:   defaultWebhookTimeout,
+			Retry: RetryPolicy{
+				MaxAttempts: defaultWebhookRetryAttempts,
+				BaseDelay:   500 * time.Millisecond,
+				MaxDelay:    10 * time.Second,
+			},
+		},
+		Events:       EventConfig{Encoding: EventEncodingProtobuf},
+		BatchWorkers: defaultBatchWorkers,
+		PublishQueue: PublishQueueConfig{
+			Size:          defaultPublishQueueSize,
+			Workers:       defaultPublishQueueWorkers,
+			FlushInterval: defaultPublishSpoolFlushInterval,
+			RetryAfter:    defaultPublishQueueRetryAfter,
+		},
+		SnapshotEvery:  defaultSnapshotEvery,
+		StartupTimeout: defaultDaprStartupTimeout,
+
+		OrderEventsConcurrency:    defaultOrderEventsConcurrency,
+		PriorityEventsConcurrency: defaultPriorityEventsConcurrency,
+
+		PprofAddress:       defaultPprofAddress,
+		MaxRequestBodySize: maxBodySize,
+		Compression:        CompressionConfig{MinSize: defaultCompressionMinSize},
+		CORS: CORSConfig{
+			AllowedMethods: defaultCORSMethods,
+			AllowedHeaders: defaultCORSHeaders,
+		},
+		Log: LogConfig{
+			Level:   slog.LevelInfo,
+			Format:  LogFormatJSON,
+			Output:  LogOutputStdout,
+			Service: defaultServiceName,
+			Version: version,
+		},
 	}
 
+	// the config file sets the keys its environment variable doesn't
+	configFile, required := os.LookupEnv("CONFIG_FILE")
+	if !required {
+		configFile = defaultConfigFile
+	}
+	if err := loadConfigFile(config, configFile, required); err != nil {
+		return nil, err
+	}
+
+	if err := lookupEnvInt("APP_PORT", &config.Port); err != nil {
+		return nil, err
+	}
 	if daprURL, ok := os.LookupEnv("DAPR_URL"); ok {
 		config.DaprURL = daprURL
 	}
+	if v, ok := os.LookupEnv("PUBSUB_NAME"); ok {
+		config.Pubsub.Name = v
+	}
+	if v, ok := os.LookupEnv("PUBSUB_ORDERS_TOPIC"); ok {
+		config.Pubsub.OrdersTopic = v
+	}
+	if v, ok := os.LookupEnv("FEATURE_FLAGS_STORE"); ok {
+		config.FeatureFlagsStore = v
+	}
+	if v, ok := os.LookupEnv("SECRET_STORE"); ok {
+		config.Secrets.Store = v
+	}
+	if err := lookupEnvDuration("SECRETS_REFRESH_INTERVAL", &config.Secrets.RefreshInterval); err != nil {
+		return nil, err
+	}
+	if config.Secrets.RefreshInterval < 0 {
+		return nil, fmt.Errorf("invalid SECRETS_REFRESH_INTERVAL: must not be negative")
+	}
+	if err := config.validateServer(); err != nil {
+		return nil, err
+	}
+	if token, ok := os.LookupEnv("DAPR_API_TOKEN"); ok {
+		config.DaprAPIToken = Secret(token)
+	}
+
+	if err := lookupEnvInt("PUBLISH_RETRY_ATTEMPTS", &config.PublishRetry.MaxAttempts); err != nil {
+		return nil, err
+	}
+	if err := lookupEnvDuration("PUBLISH_RETRY_BASE_DELAY", &config.PublishRetry.BaseDelay); err != nil {
+		return nil, err
+	}
+	if err := lookupEnvDuration("PUBLISH_RETRY_MAX_DELAY", &config.PublishRetry.MaxDelay); err != nil {
+		return nil, err
+	}
+	if err := lookupEnvInt("CIRCUIT_BREAKER_FAILURE_THRESHOLD", &config.CircuitBreaker.FailureThreshold); err != nil {
+		return nil, err
+	}
+	if err := lookupEnvDuration("CIRCUIT_BREAKER_OPEN_TIMEOUT", &config.CircuitBreaker.OpenTimeout); err != nil {
+		return nil, err
+	}
+	if err := lookupEnvDuration("DAPR_PUBLISH_TIMEOUT", &config.Timeouts.Publish); err != nil {
+		return nil, err
+	}
+	if err := lookupEnvDuration("DAPR_STATE_TIMEOUT", &config.Timeouts.State); err != nil {
+		return nil, err
+	}
+	if err := lookupEnvDuration("DAPR_STARTUP_TIMEOUT", &config.StartupTimeout); err != nil {
+		return nil, err
+	}
+	if config.StartupTimeout <= 0 {
+		return nil, fmt.Errorf("invalid DAPR_STARTUP_TIMEOUT: must be positive")
+	}
+	// the credentials are first read as the sidecar starts
+	config.Secrets.ReadTimeout = config.StartupTimeout
+
+	if v, ok := os.LookupEnv("PUBLISH_TOPIC_ALLOWLIST"); ok {
+		allowlist, err := ParseTopicAllowlist(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PUBLISH_TOPIC_ALLOWLIST: %w", err)
+		}
+		config.TopicAllowlist = allowlist
+	}
+	if err := config.TopicAllowlist.Validate(knownHandlers, knownTopics); err != nil {
+		return nil, err
+	}
+
+	if err := lookupEnvInt("WEBHOOK_WORKERS", &config.Webhooks.Workers); err != nil {
+		return nil, err
+	}
+	if err := lookupEnvInt("WEBHOOK_QUEUE_SIZE", &config.Webhooks.QueueSize); err != nil {
+		return nil, err
+	}
+	if err := lookupEnvDuration("WEBHOOK_TIMEOUT", &config.Webhooks.Timeout); err != nil {
+		return nil, err
+	}
+	if err := lookupEnvInt("WEBHOOK_RETRY_ATTEMPTS", &config.Webhooks.Retry.MaxAttempts); err != nil {
+		return nil, err
+	}
+	if err := lookupEnvInt("BATCH_WORKERS", &config.BatchWorkers); err != nil {
+		return nil, err
+	}
+	if config.BatchWorkers < 1 {
+		return nil, fmt.Errorf("invalid BATCH_WORKERS: must be at least 1")
+	}
+	if err := lookupEnvBool("ASYNC_PUBLISH", &config.PublishQueue.Enabled); err != nil {
+		return nil, err
+	}
+	if err := lookupEnvInt("PUBLISH_QUEUE_SIZE", &config.PublishQueue.Size); err != nil {
+		return nil, err
+	}
+	if err := lookupEnvInt("PUBLISH_WORKERS", &config.PublishQueue.Workers); err != nil {
+		return nil, err
+	}
+	if config.PublishQueue.Size < 1 {
+		return nil, fmt.Errorf("invalid PUBLISH_QUEUE_SIZE: must be at least 1")
+	}
+	if config.PublishQueue.Workers < 1 {
+		return nil, fmt.Errorf("invalid PUBLISH_WORKERS: must be at least 1")
+	}
+	if v, ok := os.LookupEnv("PUBLISH_QUEUE_DIR"); ok {
+		config.PublishQueue.Dir = v
+	}
+	if config.PublishQueue.Dir != "" && !config.PublishQueue.Enabled {
+		return nil, fmt.Errorf("invalid PUBLISH_QUEUE_DIR: requires ASYNC_PUBLISH")
+	}
+	if err := lookupEnvDuration("PUBLISH_QUEUE_FLUSH_INTERVAL", &config.PublishQueue.FlushInterval); err != nil {
+		return nil, err
+	}
+	if config.PublishQueue.FlushInterval <= 0 {
+		return nil, fmt.Errorf("invalid PUBLISH_QUEUE_FLUSH_INTERVAL: must be positive")
+	}
+	if err := lookupEnvDuration("PUBLISH_QUEUE_RETRY_AFTER", &config.PublishQueue.RetryAfter); err != nil {
+		return nil, err
+	}
+	if config.PublishQueue.RetryAfter <= 0 {
+		return nil, fmt.Errorf("invalid PUBLISH_QUEUE_RETRY_AFTER: must be positive")
+	}
+
+	var apiKeys []string
+	lookupEnvList("AUTH_API_KEYS", &apiKeys)
+	for _, key := range apiKeys {
+		config.Auth.APIKeys = append(config.Auth.APIKeys, Secret(key))
+	}
+	var adminKeys []string
+	lookupEnvList("AUTH_ADMIN_API_KEYS", &adminKeys)
+	for _, key := range adminKeys {
+		config.Auth.AdminAPIKeys = append(config.Auth.AdminAPIKeys, Secret(key))
+	}
+	if v, ok := os.LookupEnv("AUTH_JWT_SECRET"); ok {
+		config.Auth.JWTSecret = Secret(v)
+	}
+	if v, ok := os.LookupEnv("AUTH_JWT_ISSUER"); ok {
+		config.Auth.JWTIssuer = v
+	}
+	if v, ok := os.LookupEnv("AUTH_JWT_AUDIENCE"); ok {
+		config.Auth.JWTAudience = v
+	}
+
+	if err := lookupEnvBool("MULTI_TENANCY", &config.Tenants.Enabled); err != nil {
+		return nil, err
+	}
+	lookupEnvList("TENANT_ALLOWLIST", &config.Tenants.Allowlist)
+	for _, tenant := range config.Tenants.Allowlist {
+		if err := ValidateTenantID(tenant); err != nil {
+			return nil, fmt.Errorf("invalid TENANT_ALLOWLIST: %w", err)
+		}
+	}
+
+	if v, ok := os.LookupEnv("EVENT_ENCODING"); ok {
+		config.Events.Encoding = v
+	}
+	if v, ok := os.LookupEnv("SCHEMA_REGISTRY_URL"); ok {
+		config.Events.SchemaRegistryURL = v
+	}
+	if err := lookupEnvDuration("EVENT_TTL", &config.Events.TTL); err != nil {
+		return nil, err
+	}
+	if v, ok := os.LookupEnv("EVENT_SIGNING_KEY"); ok {
+		config.Events.SigningKey = Secret(v)
+	}
+	if err := config.Events.Validate(); err != nil {
+		return nil, err
+	}
+
+	config.TLS.CertFile = os.Getenv("TLS_CERT_FILE")
+	config.TLS.KeyFile = os.Getenv("TLS_KEY_FILE")
+	if (config.TLS.CertFile == "") != (config.TLS.KeyFile == "") {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	config.PaymentsAppID = os.Getenv("PAYMENTS_APP_ID")
+
+	if err := lookupEnvDuration("INVENTORY_RESERVATION_WINDOW", &config.ReservationWindow); err != nil {
+		return nil, err
+	}
+	if config.ReservationWindow < 0 {
+		return nil, fmt.Errorf("invalid INVENTORY_RESERVATION_WINDOW: must be positive")
+	}
+
+	if err := lookupEnvBool("ORDER_EVENT_SOURCING", &config.EventSourcing); err != nil {
+		return nil, err
+	}
+	if err := lookupEnvBool("REFUND_WORKFLOW", &config.RefundWorkflow); err != nil {
+		return nil, err
+	}
+	if err := lookupEnvInt("ORDER_SNAPSHOT_EVERY", &config.SnapshotEvery); err != nil {
+		return nil, err
+	}
+	if config.SnapshotEvery < 0 {
+		return nil, fmt.Errorf("invalid ORDER_SNAPSHOT_EVERY: must be positive")
+	}
+
+	if err := lookupEnvInt("ORDER_EVENTS_CONCURRENCY", &config.OrderEventsConcurrency); err != nil {
+		return nil, err
+	}
+	if err := lookupEnvInt("PRIORITY_EVENTS_CONCURRENCY", &config.PriorityEventsConcurrency); err != nil {
+		return nil, err
+	}
+	if config.OrderEventsConcurrency < 0 || config.PriorityEventsConcurrency < 0 {
+		return nil, fmt.Errorf("invalid ORDER_EVENTS_CONCURRENCY or PRIORITY_EVENTS_CONCURRENCY: must be positive")
+	}
+
+	if err := lookupEnvInt("MAX_REQUEST_BODY_SIZE", &config.MaxRequestBodySize); err != nil {
+		return nil, err
+	}
+	if config.MaxRequestBodySize <= 0 {
+		return nil, fmt.Errorf("invalid MAX_REQUEST_BODY_SIZE: must be positive")
+	}
+
+	if err := lookupEnvBool("ENABLE_COMPRESSION", &config.Compression.Enabled); err != nil {
+		return nil, err
+	}
+	if err := lookupEnvInt("COMPRESSION_MIN_SIZE", &config.Compression.MinSize); err != nil {
+		return nil, err
+	}
+	if config.Compression.MinSize < 0 {
+		return nil, fmt.Errorf("invalid COMPRESSION_MIN_SIZE: must be positive")
+	}
+
+	lookupEnvList("CORS_ALLOWED_ORIGINS", &config.CORS.AllowedOrigins)
+	lookupEnvList("CORS_ALLOWED_METHODS", &config.CORS.AllowedMethods)
+	lookupEnvList("CORS_ALLOWED_HEADERS", &config.CORS.AllowedHeaders)
+	if err := lookupEnvBool("CORS_ALLOW_CREDENTIALS", &config.CORS.AllowCredentials); err != nil {
+		return nil, err
+	}
+	if err := lookupEnvDuration("CORS_MAX_AGE", &config.CORS.MaxAge); err != nil {
+		return nil, err
+	}
+	if err := config.CORS.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid CORS configuration: %w", err)
+	}
+
+	if err := lookupEnvBool("ENABLE_PPROF", &config.EnablePprof); err != nil {
+		return nil, err
+	}
+	if v, ok := os.LookupEnv("PPROF_ADDRESS"); ok {
+		config.PprofAddress = v
+	}
+
+	if v, ok := os.LookupEnv("LOG_LEVEL"); ok {
+		if err := config.Log.Level.UnmarshalText([]byte(v)); err != nil {
+			return nil, fmt.Errorf("invalid LOG_LEVEL: %w", err)
+		}
+	}
+	if v, ok := os.LookupEnv("LOG_FORMAT"); ok {
+		config.Log.Format = v
+	}
+	if v, ok := os.LookupEnv("LOG_OUTPUT"); ok {
+		config.Log.Output = v
+	}
+	if v, ok := os.LookupEnv("SERVICE_NAME"); ok {
+		config.Log.Service = v
+	}
+	if v, ok := os.LookupEnv("SERVICE_VERSION"); ok {
+		config.Log.Version = v
+	}
+	if err := config.Log.Validate(); err != nil {
+		return nil, err
+	}
 
-	appHandler := NewAppHandler(config)
+	return config, nil
+}
+
+func main() {
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the log package writes through the logger too, at the info level
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(config.Log.Level)
+	slog.SetDefault(NewLogger(config.Log.Writer(), config.Log, logLevel))
+
+	metrics := NewMetrics()
+
+	// the connection to the sidecar is established lazily, so the client can be
+	// created before daprd is up
+	conn, err := grpc.Dial(config.DaprURL,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(traceContextInterceptor),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := dapr.NewClientWithConnection(conn)
+	defer client.Close()
+
+	if config.DaprAPIToken != "" {
+		client.WithAuthToken(string(config.DaprAPIToken))
+	}
+
+	health := NewHealthChecker(client, config.Pubsub.name())
+	// the stores and services are checked bypassing the circuit breaker too
+	orderStoreName := stateStoreName
+	if config.EventSourcing {
+		orderStoreName = eventStoreName
+		health.Register(eventStoreName, true, NewEventStore(client))
+	} else {
+		health.Register(stateStoreName, true, NewOrderStore(client))
+	}
+	// the app can't serve any order without them
+	required := []RequiredComponent{{Name: config.Pubsub.name(), Kind: "pubsub"}, {Name: orderStoreName, Kind: "state"}}
+	health.Require(required...)
+	startup := NewStartupGate(client, config.StartupTimeout, required...)
+	// a sidecar which never reached the app, e.g. on another app port, would
+	// otherwise deliver no event without any error
+	orders := RequiredSubscription{PubsubName: config.Pubsub.name(), Topic: config.Pubsub.topicName(topicOrders)}
+	health.RequireSubscriptions(orders)
+	startup.RequireSubscriptions(orders)
+	if config.PaymentsAppID != "" {
+		health.Register(config.PaymentsAppID, false, NewDaprPayments(client, config.PaymentsAppID))
+	}
+	// timeouts are within the circuit breaker, so that calls timing out
+	// count as failures
+	client = NewTimeoutClient(client, config.Timeouts)
+	client = NewCircuitBreakerClient(client, NewCircuitBreaker(config.CircuitBreaker), metrics)
+
+	webhooks := NewWebhookStore(client)
+	notifier := NewWebhookDispatcher(webhooks, config.Webhooks, metrics)
+	notifier.Start(context.Background())
+
+	publisher := NewPublisher(client, config, metrics)
+	health.ObserveBroker(publisher)
+	if publisher.Encoder, err = NewEventEncoder(config.Events); err != nil {
+		log.Fatal(err)
+	}
+
+	var payments Payments
+	if config.PaymentsAppID != "" {
+		payments = NewDaprPayments(client, config.PaymentsAppID)
+	}
+
+	var inventory Inventory
+	if config.ReservationWindow > 0 {
+		inventory = NewDaprInventory(client)
+	}
+
+	var store OrderRepository = NewOrderStore(client)
+	if config.EventSourcing {
+		store = NewEventSourcedOrderRepository(NewEventStore(client), config.SnapshotEvery)
+	}
+
+	var flags *FeatureFlags
+	if config.FeatureFlagsStore != "" {
+		flags = NewFeatureFlags(client, config.FeatureFlagsStore, metrics)
+	}
+
+	credentials := NewCredentials(client, config.Secrets, config.Auth, config.Events.SigningKey, metrics)
+	if config.Events.SigningKey != "" || config.Secrets.Store != "" {
+		publisher.Signer = NewEventSigner(credentials)
+	}
+
+	var publishQueue *PublishQueue
+	if config.PublishQueue.Enabled {
+		publishQueue = NewPublishQueue(config.PublishQueue, metrics)
+		if config.PublishQueue.Dir != "" {
+			if publishQueue.Spool, err = NewPublishSpool(config.PublishQueue.Dir, metrics); err != nil {
+				log.Fatal(err)
+			}
+		}
+		publishQueue.Start()
+	}
+
+	appHandler := NewAppHandler(config, metrics, publisher, store)
+	appHandler.webhooks = webhooks
+	appHandler.notifier = notifier
+	appHandler.health = health
+	appHandler.payments = payments
+	appHandler.inventory = inventory
+	appHandler.shipments = NewShipmentStore(client)
+	appHandler.customers = NewCustomerStore(client)
+	appHandler.stats = NewStatsStore(client)
+	appHandler.quarantined = NewQuarantineStore(client)
+	appHandler.logLevel = logLevel
+	appHandler.flags = flags
+	appHandler.credentials = credentials
+	appHandler.publishQueue = publishQueue
+	appHandler.startup = startup
+	if config.RefundWorkflow {
+		if appHandler.refunds, err = NewRefundWorkflow(client, appHandler); err != nil {
+			log.Fatal(err)
+		}
+	}
 	appHandler.RegisterRoutes()
+	if inventory != nil {
+		// the app hosts the actors it reserves stock with
+		NewInventoryActor(client, config.ReservationWindow).RegisterRoutes(appHandler.router)
+	}
 
 	slog.Info("Starting server", "config", config)
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		if err := startup.Wait(ctx); err != nil && ctx.Err() == nil {
+			log.Fatal(err)
+		}
+		// the sidecar only runs the workflows of the app once it is ready
+		if appHandler.refunds != nil && ctx.Err() == nil {
+			if err := appHandler.refunds.Start(); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}()
+	if flags != nil {
+		go flags.Watch(ctx)
+	}
+	if publishQueue != nil && publishQueue.Spool != nil {
+		go appHandler.FlushPublishSpool(ctx, config.PublishQueue.FlushInterval)
+	}
+	// SIGHUP reads the credentials again, once rotated in the secret store
+	rotate := make(chan os.Signal, 1)
+	signal.Notify(rotate, syscall.SIGHUP)
+	go func() {
+		if err := credentials.Run(ctx, rotate); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if config.EnablePprof {
+		slog.Warn("pprof is enabled", "address", config.PprofAddress)
+		go func() {
+			// profiling is a debugging aid, which the app serves without
+			if err := StartPprofServer(ctx, config.PprofAddress); err != nil {
+				slog.Error("couldn't serve pprof", "error", err)
+			}
+		}()
+	}
+
 	// Start the server
-	if err := appHandler.StartServer(":3000"); err != nil {
+	err = appHandler.StartServer(ctx, fmt.Sprintf(":%d", config.Port))
+	if publishQueue != nil {
+		// the updates answered before the shutdown are still published
+		publishQueue.Close()
+		publishQueue.Wait()
+		if publishQueue.Spool != nil {
+			if err := publishQueue.Spool.Close(); err != nil {
+				slog.Error("couldn't close publish spool", "error", err)
+			}
+		}
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	dapr "github.com/dapr/go-sdk/client"
+)
+
+func TestOrdersInvalidRequests(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		// expected is the status code and body of the answer
+		expected     int
+		expectedBody string
+	}{
+		{
+			name: "malformed JSON", method: http.MethodPut, path: "/orders/order-1234", body: `{"status": "PAID"`,
+			expected: http.StatusBadRequest, expectedBody: "Bad request",
+		},
+		{
+			name: "empty body", method: http.MethodPut, path: "/orders/order-1234",
+			expected: http.StatusBadRequest, expectedBody: "Bad request",
+		},
+		{
+			name: "not an object", method: http.MethodPut, path: "/orders/order-1234", body: `"PAID"`,
+			expected: http.StatusBadRequest, expectedBody: "Bad request",
+		},
+		{
+			name: "status of the wrong type", method: http.MethodPut, path: "/orders/order-1234", body: `{"status": 1}`,
+			expected: http.StatusBadRequest, expectedBody: "Bad request",
+		},
+		{
+			name: "unknown status", method: http.MethodPut, path: "/orders/order-1234", body: `{"status": "SHIPPED"}`,
+			expected:     http.StatusBadRequest,
+			expectedBody: `{"from":"","to":"SHIPPED","reason":"unknown_status"}` + "\n",
+		},
+		{
+			name: "lowercase status", method: http.MethodPut, path: "/orders/order-1234", body: `{"status": "paid"}`,
+			expected:     http.StatusBadRequest,
+			expectedBody: `{"from":"","to":"paid","reason":"unknown_status"}` + "\n",
+		},
+		{
+			name: "missing status", method: http.MethodPut, path: "/orders/order-1234", body: `{}`,
+			expected:     http.StatusBadRequest,
+			expectedBody: `{"from":"","to":"","reason":"unknown_status"}` + "\n",
+		},
+		{
+			name: "unsupported content type", method: http.MethodPut, path: "/orders/order-1234", contentType: "application/xml", body: `<status>PAID</status>`,
+			expected:     http.StatusUnsupportedMediaType,
+			expectedBody: "Unsupported media type: expected application/json or application/x-protobuf",
+		},
+		{
+			name: "malformed content type", method: http.MethodPut, path: "/orders/order-1234", contentType: "application/", body: `{"status": "PAID"}`,
+			expected:     http.StatusUnsupportedMediaType,
+			expectedBody: "Unsupported media type: expected application/json or application/x-protobuf",
+		},
+		{
+			name: "too short ID", method: http.MethodPut, path: "/orders/order-123", body: `{"status": "PAID"}`,
+			expected: http.StatusNotFound, expectedBody: "404 page not found\n",
+		},
+		{
+			name: "too long ID", method: http.MethodPut, path: "/orders/order-12345", body: `{"status": "PAID"}`,
+			expected: http.StatusNotFound, expectedBody: "404 page not found\n",
+		},
+		{
+			name: "uppercase ID", method: http.MethodPut, path: "/orders/ORDER-1234", body: `{"status": "PAID"}`,
+			expected: http.StatusNotFound, expectedBody: "404 page not found\n",
+		},
+		{
+			name: "non numeric ID", method: http.MethodGet, path: "/orders/order-abcd",
+			expected: http.StatusNotFound, expectedBody: "404 page not found\n",
+		},
+		{
+			name: "ID without prefix", method: http.MethodGet, path: "/orders/1234",
+			expected: http.StatusNotFound, expectedBody: "404 page not found\n",
+		},
+		{
+			name: "nested path", method: http.MethodGet, path: "/orders/order-1234/items",
+			expected: http.StatusNotFound, expectedBody: "404 page not found\n",
+		},
+		{
+			name: "unknown version", method: http.MethodGet, path: "/v3/orders/order-1234",
+			expected: http.StatusNotFound, expectedBody: "404 page not found\n",
+		},
+		{
+			name: "unknown order", method: http.MethodGet, path: "/orders/order-9999",
+			expected: http.StatusNotFound, expectedBody: "Order not found",
+		},
+		{
+			name: "unsupported method", method: http.MethodDelete, path: "/orders/order-1234",
+			expected: http.StatusMethodNotAllowed,
+		},
+	}
+
+	client := &fakeDaprClient{}
+	server := newOrdersServerWith(t, client)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := doRequest(t, tt.method, server.URL+tt.path, tt.contentType, "", []byte(tt.body))
+			if resp.StatusCode != tt.expected {
+				t.Fatalf("expected status code %d. Got %d: %s", tt.expected, resp.StatusCode, body)
+			}
+			if string(body) != tt.expectedBody {
+				t.Fatalf("expected body %q. Got %q.", tt.expectedBody, body)
+			}
+		})
+	}
+
+	// none of them reached the state store nor the broker
+	if len(client.state) != 0 || len(client.published) != 0 {
+		t.Fatalf("expected invalid requests to be rejected before any write. Got state %v and events %v.", client.state, client.published)
+	}
+}
+
+// newMockHandler returns a handler publishing with publisher and storing
+// orders in store, so that its logic runs without a sidecar.
+func newMockHandler(publisher EventPublisher, store OrderRepository) *AppHandler {
+	metrics := NewMetrics()
+	notifier := NewWebhookDispatcher(NewWebhookStore(&fakeDaprClient{}), WebhookConfig{QueueSize: 10}, metrics)
+	h := NewAppHandler(&Config{}, metrics, publisher, store)
+	h.notifier = notifier
+	h.shipments = NewShipmentStore(&fakeDaprClient{})
+	return h
+}
+
+func TestUpdateOrder(t *testing.T) {
+	errUnavailable := errors.New("unavailable")
+
+	tests := []struct {
+		name string
+		// existing is stored beforehand if set
+		existing  *Order
+		status    OrderStatus
+		ifMatch   string
+		storeErrs map[string]error
+		publisher *mockPublisher
+		payments  *mockPayments
+		// expected is the answer, stored the order stored afterwards if any,
+		// and published the number of events
+		expected  updateResult
+		stored    *Order
+		published int
+		calls     []string
+	}{
+		{
+			name:      "new order",
+			status:    OrderStatusPending,
+			expected:  updateResult{Code: http.StatusOK, Message: "Order updated"},
+			stored:    &Order{ID: "order-1234", Status: OrderStatusPending},
+			published: 1,
+			calls:     []string{"Get", "Save"},
+		},
+		{
+			name:      "status change",
+			existing:  &Order{ID: "order-1234", Status: OrderStatusPending},
+			status:    OrderStatusPaid,
+			expected:  updateResult{Code: http.StatusOK, Message: "Order updated"},
+			stored:    &Order{ID: "order-1234", Status: OrderStatusPaid},
+			published: 1,
+			calls:     []string{"Get", "Save"},
+		},
+		{
+			name:     "unchanged order",
+			existing: &Order{ID: "order-1234", Status: OrderStatusPending},
+			status:   OrderStatusPending,
+			expected: updateResult{Code: http.StatusOK, Message: "Order unchanged"},
+			stored:   &Order{ID: "order-1234", Status: OrderStatusPending},
+			calls:    []string{"Get"},
+		},
+		{
+			name:     "invalid transition",
+			existing: &Order{ID: "order-1234", Status: OrderStatusPaid},
+			status:   OrderStatusPending,
+			expected: updateResult{
+				Code:       http.StatusConflict,
+				Message:    `order status can't change from "PAID" to "PENDING"`,
+				Transition: &TransitionError{From: OrderStatusPaid, To: OrderStatusPending, Reason: TransitionReasonInvalid},
+			},
+			stored: &Order{ID: "order-1234", Status: OrderStatusPaid},
+			calls:  []string{"Get"},
+		},
+		{
+			name:     "stale If-Match",
+			existing: &Order{ID: "order-1234", Status: OrderStatusPending},
+			status:   OrderStatusPaid,
+			ifMatch:  `"0"`,
+			expected: conflictResult("1"),
+			stored:   &Order{ID: "order-1234", Status: OrderStatusPending},
+			calls:    []string{"Get"},
+		},
+		{
+			name:      "concurrent write",
+			existing:  &Order{ID: "order-1234", Status: OrderStatusPending},
+			status:    OrderStatusPaid,
+			storeErrs: map[string]error{"Save": ErrETagMismatch},
+			expected:  conflictResult("1"),
+			stored:    &Order{ID: "order-1234", Status: OrderStatusPending},
+			calls:     []string{"Get", "Save", "Get"},
+		},
+		{
+			name:      "unavailable store",
+			status:    OrderStatusPaid,
+			storeErrs: map[string]error{"Get": errUnavailable},
+			expected:  updateResult{Code: http.StatusServiceUnavailable, Message: "Service unavailable"},
+			calls:     []string{"Get"},
+		},
+		{
+			name:      "unavailable broker reverts a new order",
+			status:    OrderStatusPaid,
+			publisher: &mockPublisher{err: errUnavailable},
+			expected:  updateResult{Code: http.StatusServiceUnavailable, Message: "Service unavailable"},
+			calls:     []string{"Get", "Save", "Get", "Delete"},
+		},
+		{
+			name:      "unavailable broker reverts a status change",
+			existing:  &Order{ID: "order-1234", Status: OrderStatusPending},
+			status:    OrderStatusPaid,
+			publisher: &mockPublisher{err: errUnavailable},
+			expected:  updateResult{Code: http.StatusServiceUnavailable, Message: "Service unavailable"},
+			stored:    &Order{ID: "order-1234", Status: OrderStatusPending},
+			calls:     []string{"Get", "Save", "Get", "Save"},
+		},
+		{
+			name:      "approved payment",
+			existing:  &Order{ID: "order-1234", Status: OrderStatusPending},
+			status:    OrderStatusPaid,
+			payments:  &mockPayments{},
+			expected:  updateResult{Code: http.StatusOK, Message: "Order updated"},
+			stored:    &Order{ID: "order-1234", Status: OrderStatusPaid},
+			published: 1,
+			calls:     []string{"Get", "Save"},
+		},
+		{
+			name:     "declined payment",
+			existing: &Order{ID: "order-1234", Status: OrderStatusPending},
+			status:   OrderStatusPaid,
+			payments: &mockPayments{err: &PaymentDeclinedError{Reason: "insufficient funds"}},
+			expected: updateResult{Code: http.StatusPaymentRequired, Message: "Payment declined: insufficient funds"},
+			stored:   &Order{ID: "order-1234", Status: OrderStatusPending},
+			calls:    []string{"Get"},
+		},
+		{
+			name:     "unavailable payments",
+			status:   OrderStatusPaid,
+			payments: &mockPayments{err: errUnavailable},
+			expected: updateResult{Code: http.StatusServiceUnavailable, Message: "Service unavailable"},
+			calls:    []string{"Get"},
+		},
+		{
+			name:      "pending order skips payments",
+			status:    OrderStatusPending,
+			payments:  &mockPayments{err: errUnavailable},
+			expected:  updateResult{Code: http.StatusOK, Message: "Order updated"},
+			stored:    &Order{ID: "order-1234", Status: OrderStatusPending},
+			published: 1,
+			calls:     []string{"Get", "Save"},
+		},
+		{
+			name:     "cancellation",
+			existing: &Order{ID: "order-1234", Status: OrderStatusPending},
+			status:   OrderStatusCancelled,
+			expected: updateResult{Code: http.StatusBadRequest, Message: "Bad request: status CANCELLED is set with POST /orders/{id}/cancel"},
+			stored:   &Order{ID: "order-1234", Status: OrderStatusPending},
+		},
+		{
+			name:      "topic not allowed",
+			status:    OrderStatusPaid,
+			publisher: &mockPublisher{err: ErrTopicNotAllowed},
+			expected:  updateResult{Code: http.StatusInternalServerError, Message: "Internal server error"},
+			calls:     []string{"Get", "Save", "Get", "Delete"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMockOrderRepository()
+			if tt.existing != nil {
+				store.save(*tt.existing)
+			}
+			store.errs = tt.storeErrs
+			publisher := tt.publisher
+			if publisher == nil {
+				publisher = &mockPublisher{}
+			}
+
+			h := newMockHandler(publisher, store)
+			if tt.payments != nil {
+				h.payments = tt.payments
+			}
+			res := h.updateOrder(context.Background(), "order-1234", OrderUpdate{Status: tt.status}, tt.ifMatch)
+			if !reflect.DeepEqual(res, tt.expected) {
+				t.Fatalf("expected result %+v. Got %+v.", tt.expected, res)
+			}
+
+			stored, ok := store.orders["order-1234"]
+			if (tt.stored == nil && ok) || (tt.stored != nil && !reflect.DeepEqual(stored, *tt.stored)) {
+				t.Fatalf("expected stored order %v. Got %v (%t).", tt.stored, stored, ok)
+			}
+			if len(publisher.events) != tt.published {
+				t.Fatalf("expected %d events. Got %v.", tt.published, publisher.events)
+			}
+			if !slices.Equal(store.calls, tt.calls) {
+				t.Fatalf("expected calls %v. Got %v.", tt.calls, store.calls)
+			}
+		})
+	}
+}
+
+// creatingOrderRepository creates order, as a concurrent update would, once
+// the order it reports as not found was read. The reads fail with err from
+// then on, if set.
+type creatingOrderRepository struct {
+	*mockOrderRepository
+	order Order
+	err   error
+}
+
+func (r *creatingOrderRepository) Get(ctx context.Context, id string) (Order, string, error) {
+	order, etag, err := r.mockOrderRepository.Get(ctx, id)
+	if errors.Is(err, ErrOrderNotFound) {
+		r.save(r.order)
+		r.errs = map[string]error{"Get": r.err}
+	}
+	return order, etag, err
+}
+
+func TestUpdateOrderConcurrentCreation(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected updateResult
+	}{
+		{name: "conflict", expected: conflictResult("1")},
+		{name: "unavailable store", err: errors.New("unavailable"), expected: updateResult{Code: http.StatusServiceUnavailable, Message: "Service unavailable"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &creatingOrderRepository{
+				mockOrderRepository: newMockOrderRepository(),
+				order:               Order{ID: "order-1234", Status: OrderStatusPaid},
+				err:                 tt.err,
+			}
+			publisher := &mockPublisher{}
+			h := newMockHandler(publisher, store)
+
+			// the order created in the meantime isn't overwritten
+			res := h.updateOrder(context.Background(), "order-1234", OrderUpdate{Status: OrderStatusPending}, "")
+			if !reflect.DeepEqual(res, tt.expected) {
+				t.Fatalf("expected result %+v. Got %+v.", tt.expected, res)
+			}
+			if stored := store.orders["order-1234"]; stored.Status != OrderStatusPaid {
+				t.Fatalf("expected stored status %s. Got %s.", OrderStatusPaid, stored.Status)
+			}
+			if len(publisher.events) != 0 {
+				t.Fatalf("expected no events. Got %v.", publisher.events)
+			}
+		})
+	}
+}
+
+// newRoutesHandler returns a handler with its routes registered, storing
+// order-1111 as pending and order-2222 as paid in store, and a webhook,
+// whose ID is returned.
+func newRoutesHandler(t *testing.T, store *mockOrderRepository) (*AppHandler, string) {
+	t.Helper()
+
+	store.save(Order{ID: "order-1111", Status: OrderStatusPending})
+	store.save(Order{ID: "order-2222", Status: OrderStatusPaid})
+
+	client := &fakeDaprClient{components: []*dapr.MetadataRegisteredComponents{{Name: pubsubName, Type: "pubsub.redis", Version: "v1"}}}
+	metrics := NewMetrics()
+	webhooks := NewWebhookStore(client)
+	webhook, err := webhooks.Register(context.Background(), "http://receiver/hook", "")
+	if err != nil {
+		t.Fatalf("couldn't register webhook: %s", err)
+	}
+
+	h := NewAppHandler(&Config{}, metrics, &mockPublisher{}, store)
+	h.webhooks = webhooks
+	h.notifier = NewWebhookDispatcher(webhooks, WebhookConfig{QueueSize: 10}, metrics)
+	h.health = NewHealthChecker(client, pubsubName)
+	h.shipments = NewShipmentStore(client)
+	h.customers = NewCustomerStore(client)
+	h.stats = NewStatsStore(client)
+	h.quarantined = NewQuarantineStore(client)
+	h.logLevel = new(slog.LevelVar)
+	h.RegisterRoutes()
+	return h, webhook.ID
+}
+
+func TestRoutes(t *testing.T) {
+	type route struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		// expected is the status code of the answer, whose body contains
+		// expectedBody
+		expected     int
+		expectedBody string
+		// stored is the order expected to be stored afterwards, if any, its
+		// line items aside
+		stored *Order
+	}
+	tests := []route{
+		{name: "health", method: http.MethodGet, path: "/health", expected: http.StatusOK, expectedBody: "ok"},
+		{name: "readiness", method: http.MethodGet, path: "/readyz", expected: http.StatusOK, expectedBody: "ready"},
+		{name: "deep health", method: http.MethodGet, path: "/healthz/deep", expected: http.StatusOK, expectedBody: `"status":"ok"`},
+		{name: "metrics", method: http.MethodGet, path: "/metrics", expected: http.StatusOK, expectedBody: "# HELP"},
+		{
+			name: "subscriptions", method: http.MethodGet, path: "/dapr/subscribe",
+			expected: http.StatusOK, expectedBody: `{"pubsubname":"order-pub-sub","topic":"orders.priority","route":"/events/orders/priority"}`,
+		},
+		{
+			name: "routed subscription", method: http.MethodGet, path: "/dapr/subscribe",
+			expected: http.StatusOK, expectedBody: `"path":"/events/orders/paid"}],"default":"/events/orders"}`,
+		},
+		{
+			name: "paid order event", method: http.MethodPost, path: routePaidOrderEvents, contentType: contentTypeCloudEvents,
+			body:     `{"datacontenttype":"application/json","orderstatus":"PAID","data":{"id":"order-1111","status":"PAID"}}`,
+			expected: http.StatusOK, expectedBody: `{"status":"SUCCESS"}`,
+		},
+		{
+			name: "cancelled order event", method: http.MethodPost, path: routeCancelledOrderEvents, contentType: contentTypeCloudEvents,
+			body:     `{"type":"order.cancelled","datacontenttype":"application/json","data":{"id":"order-1111","status":"CANCELLED"}}`,
+			expected: http.StatusOK, expectedBody: `{"status":"SUCCESS"}`,
+		},
+		{
+			name: "order event", method: http.MethodPost, path: routeOrderEvents, contentType: contentTypeCloudEvents,
+			body:     `{"datacontenttype":"application/json","data":{"id":"order-1111","status":"PAID"}}`,
+			expected: http.StatusOK, expectedBody: `{"status":"SUCCESS"}`,
+		},
+		{
+			name: "priority order event", method: http.MethodPost, path: routePriorityOrderEvents, contentType: contentTypeCloudEvents,
+			body:     `{"datacontenttype":"application/json","data":{"id":"order-1111","status":"PAID"}}`,
+			expected: http.StatusOK, expectedBody: `{"status":"SUCCESS"}`,
+		},
+		{
+			name: "malformed order event", method: http.MethodPost, path: routeOrderEvents, contentType: contentTypeCloudEvents,
+			body:     `{"data":"PAID"}`,
+			expected: http.StatusOK, expectedBody: `{"status":"DROP"}`,
+		},
+		{name: "quarantine list", method: http.MethodGet, path: "/admin/quarantine", expected: http.StatusOK, expectedBody: "[]"},
+		{
+			name: "unknown quarantined event", method: http.MethodGet, path: "/admin/quarantine/unknown",
+			expected: http.StatusNotFound, expectedBody: "Quarantined event not found",
+		},
+		{
+			name: "unknown quarantined event release", method: http.MethodDelete, path: "/admin/quarantine/unknown",
+			expected: http.StatusNotFound, expectedBody: "Quarantined event not found",
+		},
+		{name: "quarantine purge", method: http.MethodDelete, path: "/admin/quarantine", expected: http.StatusNoContent},
+		{name: "log level", method: http.MethodGet, path: "/admin/loglevel", expected: http.StatusOK, expectedBody: `{"level":"INFO"}`},
+		{
+			name: "feature flags", method: http.MethodGet, path: "/admin/flags",
+			expected: http.StatusOK, expectedBody: `{"batch-updates":true,"priority-topics":true}`,
+		},
+		{
+			name: "oversized body", method: http.MethodPut, path: "/v2/orders/order-1234", body: `{"status":"PAID"}` + strings.Repeat(" ", maxBodySize),
+			expected: http.StatusRequestEntityTooLarge, expectedBody: `"limit":1048576`,
+		},
+		{
+			name: "dlq replay", method: http.MethodPost, path: "/admin/dlq/replay", contentType: contentTypeJSON,
+			body:     `["unknown"]`,
+			expected: http.StatusOK, expectedBody: `{"id":"unknown","status":404,"message":"Quarantined event not found"}`,
+		},
+		{
+			name: "webhooks list", method: http.MethodGet, path: "/webhooks",
+			expected: http.StatusOK, expectedBody: `"url":"http://receiver/hook","delivery"`,
+		},
+		{
+			name: "webhook create", method: http.MethodPost, path: "/webhooks", contentType: contentTypeJSON,
+			body:     `{"url":"https://receiver/other","secret":"receiver-secret"}`,
+			expected: http.StatusCreated, expectedBody: `"url":"https://receiver/other","secret":"receiver-secret"`,
+		},
+		{
+			name: "webhook get", method: http.MethodGet, path: "/webhooks/{webhook}",
+			expected: http.StatusOK, expectedBody: `"url":"http://receiver/hook","delivery"`,
+		},
+		{name: "webhook delete", method: http.MethodDelete, path: "/webhooks/{webhook}", expected: http.StatusNoContent},
+		{
+			name: "unknown webhook", method: http.MethodGet, path: "/webhooks/unknown",
+			expected: http.StatusNotFound, expectedBody: "Webhook not found",
+		},
+		// a plain request can't be upgraded
+		{name: "websocket", method: http.MethodGet, path: "/ws", expected: http.StatusBadRequest},
+	}
+
+	// the order routes are served by every version of the API
+	for _, prefix := range []string{"", "/v1", "/v2"} {
+		tests = append(tests,
+			route{
+				name: prefix + " orders list", method: http.MethodGet, path: prefix + "/orders?limit=1&offset=1",
+				expected: http.StatusOK, expectedBody: `"id":"order-2222"`,
+			},
+			route{
+				name: prefix + " order get", method: http.MethodGet, path: prefix + "/orders/order-2222",
+				expected: http.StatusOK, expectedBody: `"id":"order-2222","status":"PAID"`,
+			},
+			route{
+				name: prefix + " order put", method: http.MethodPut, path: prefix + "/orders/order-1111", contentType: contentTypeJSON,
+				body:     `{"status":"PAID"}`,
+				expected: http.StatusOK, expectedBody: "Order updated",
+				stored: &Order{ID: "order-1111", Status: OrderStatusPaid},
+			},
+			route{
+				name: prefix + " order put of a new order", method: http.MethodPut, path: prefix + "/orders/order-3333", contentType: contentTypeJSON,
+				body:     `{"status":"PENDING"}`,
+				expected: http.StatusOK, expectedBody: "Order updated",
+				stored: &Order{ID: "order-3333", Status: OrderStatusPending},
+			},
+			route{
+				name: prefix + " order patch", method: http.MethodPatch, path: prefix + "/orders/order-1111", contentType: contentTypeMergePatch,
+				body:     `{"status":"PAID"}`,
+				expected: http.StatusOK,
+				stored:   &Order{ID: "order-1111", Status: OrderStatusPaid},
+			},
+			route{
+				name: prefix + " order cancel", method: http.MethodPost, path: prefix + "/orders/order-1111/cancel",
+				expected: http.StatusOK, expectedBody: "Order cancelled",
+				stored: &Order{ID: "order-1111", Status: OrderStatusCancelled},
+			},
+			route{
+				name: prefix + " order refund", method: http.MethodPost, path: prefix + "/orders/order-2222/refund",
+				expected: http.StatusOK, expectedBody: "Order refunded",
+				stored: &Order{ID: "order-2222", Status: OrderStatusRefunded},
+			},
+			route{
+				name: prefix + " shipment create", method: http.MethodPost, path: prefix + "/orders/order-2222/shipments", contentType: contentTypeJSON,
+				body:     `{"carrier":"dhl","trackingNumber":"JD0123"}`,
+				expected: http.StatusCreated, expectedBody: `"status":"CREATED"`,
+			},
+			route{
+				name: prefix + " shipments list", method: http.MethodGet, path: prefix + "/orders/order-2222/shipments",
+				expected: http.StatusOK, expectedBody: "[]",
+			},
+			route{
+				name: prefix + " customer put", method: http.MethodPut, path: prefix + "/customers/customer-1111", contentType: contentTypeJSON,
+				body:     `{"name":"Ada"}`,
+				expected: http.StatusOK, expectedBody: `"id":"customer-1111","name":"Ada"`,
+			},
+			route{
+				name: prefix + " customer get", method: http.MethodGet, path: prefix + "/customers/customer-1111",
+				expected: http.StatusNotFound, expectedBody: "Customer not found",
+			},
+			route{
+				name: prefix + " customer orders", method: http.MethodGet, path: prefix + "/customers/customer-1111/orders",
+				expected: http.StatusNotFound, expectedBody: "Customer not found",
+			},
+			route{
+				name: prefix + " stats", method: http.MethodGet, path: prefix + "/stats",
+				expected: http.StatusOK, expectedBody: `{"counts":{},"total":0,"latest":[]}`,
+			},
+			route{
+				name: prefix + " orders batch put", method: http.MethodPut, path: prefix + "/orders", contentType: contentTypeJSON,
+				body:     `[{"id":"order-4444","status":"PAID"}]`,
+				expected: http.StatusOK, expectedBody: `"id":"order-4444"`,
+				stored: &Order{ID: "order-4444", Status: OrderStatusPaid},
+			},
+		)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMockOrderRepository()
+			h, webhookID := newRoutesHandler(t, store)
+
+			req := httptest.NewRequest(tt.method, strings.ReplaceAll(tt.path, "{webhook}", webhookID), strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			h.router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.expected {
+				t.Fatalf("expected status code %d. Got %d: %s", tt.expected, rec.Code, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tt.expectedBody) {
+				t.Fatalf("expected body to contain %s. Got %s.", tt.expectedBody, rec.Body)
+			}
+			// the order is the one of the path
+			if tt.stored != nil {
+				if order, ok := store.orders[tt.stored.ID]; !ok || order.Status != tt.stored.Status {
+					t.Fatalf("expected %s to be stored with status %s. Got %v.", tt.stored.ID, tt.stored.Status, order)
+				}
+			}
+		})
+	}
+}
+
+func TestOrderEventKeys(t *testing.T) {
+	ctx := context.Background()
+	publisher := &mockPublisher{}
+	store := newMockOrderRepository()
+	h := newMockHandler(publisher, store)
+
+	// every change is keyed by the version it was made from
+	var expected []string
+	for _, change := range []func() updateResult{
+		func() updateResult {
+			return h.updateOrder(ctx, "order-1234", OrderUpdate{Status: OrderStatusPending}, "")
+		},
+		func() updateResult { return h.cancelOrder(ctx, "order-1234", "") },
+	} {
+		_, etag, err := store.Get(ctx, "order-1234")
+		if err != nil && !errors.Is(err, ErrOrderNotFound) {
+			t.Fatalf("couldn't get order: %s", err)
+		}
+		expected = append(expected, orderEventKey(ctx, "order-1234", etag))
+		if res := change(); res.Code != http.StatusOK {
+			t.Fatalf("expected the change to succeed. Got %+v.", res)
+		}
+	}
+	if expected[0] != "order-1234@0" || expected[0] == expected[1] {
+		t.Fatalf("expected distinct keys, the first of version 0. Got %v.", expected)
+	}
+	var keys []string
+	for _, event := range publisher.events {
+		keys = append(keys, event.key)
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("expected events keyed %v. Got %v.", expected, keys)
+	}
+
+	if key := orderEventKey(WithTenant(ctx, "acme"), "order-1234", "3"); key != "acme/order-1234@3" {
+		t.Fatalf("expected the key to be scoped to the tenant. Got %s.", key)
+	}
+}
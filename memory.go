@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MemoryOrderRepository keeps orders in memory, for tests and backends yet to
+// come to compare with. The ETag of an order counts its writes.
+type MemoryOrderRepository struct {
+	mu sync.Mutex
+	// orders and versions are keyed by tenantKey, versions outliving the
+	// deleted orders so that their ETags are never reused
+	orders   map[string]Order
+	versions map[string]int
+}
+
+func NewMemoryOrderRepository() *MemoryOrderRepository {
+	return &MemoryOrderRepository{
+		orders:   map[string]Order{},
+		versions: map[string]int{},
+	}
+}
+
+// Get returns the order stored under id along with its ETag.
+func (r *MemoryOrderRepository) Get(ctx context.Context, id string) (Order, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := tenantKey(ctx, id)
+	order, ok := r.orders[key]
+	if !ok {
+		return Order{}, "", ErrOrderNotFound
+	}
+	return order, strconv.Itoa(r.versions[key]), nil
+}
+
+// Save stores order only if the stored version still matches etag, or
+// unconditionally if etag is empty.
+func (r *MemoryOrderRepository) Save(ctx context.Context, order Order, etag string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := tenantKey(ctx, order.ID)
+	if !r.matches(key, etag) {
+		return ErrETagMismatch
+	}
+	r.orders[key] = order
+	r.versions[key]++
+	return nil
+}
+
+// Delete deletes order id only if the stored version still matches etag, or
+// unconditionally if etag is empty.
+func (r *MemoryOrderRepository) Delete(ctx context.Context, id, etag string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := tenantKey(ctx, id)
+	if !r.matches(key, etag) {
+		return ErrETagMismatch
+	}
+	delete(r.orders, key)
+	return nil
+}
+
+// matches reports whether the order stored under key has the version etag,
+// or isn't stored for etagAbsent.
+func (r *MemoryOrderRepository) matches(key, etag string) bool {
+	_, ok := r.orders[key]
+	switch etag {
+	case "":
+		return true
+	case etagAbsent:
+		return !ok
+	}
+	return ok && etag == strconv.Itoa(r.versions[key])
+}
+
+// List returns limit orders sorted by ID, starting at offset. Only the orders
+// of the tenant of ctx are listed when multi-tenancy is enabled.
+func (r *MemoryOrderRepository) List(ctx context.Context, limit, offset int) (*OrderList, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tenant := TenantFromContext(ctx)
+	orders := make([]Order, 0, len(r.orders))
+	for _, order := range r.orders {
+		if tenant == "" || order.Tenant == tenant {
+			orders = append(orders, order)
+		}
+	}
+	slices.SortFunc(orders, func(a, b Order) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	list := &OrderList{Items: []Order{}, Limit: limit, Offset: offset}
+	list.Items = append(list.Items, orders[min(offset, len(orders)):min(offset+limit, len(orders))]...)
+	if offset+limit < len(orders) {
+		next := offset + limit
+		list.NextOffset = &next
+	}
+	return list, nil
+}
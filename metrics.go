@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the Prometheus collectors exposed by the application.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	OrdersPublished          *prometheus.CounterVec
+	PublishRetries           *prometheus.CounterVec
+	PublishDuration          *prometheus.HistogramVec
+	PublishOutcomes          *prometheus.CounterVec
+	CircuitBreakerState      prometheus.Gauge
+	CircuitBreakerRejections *prometheus.CounterVec
+	WebhookDeliveries        *prometheus.CounterVec
+	TenantRequests           *prometheus.CounterVec
+	OrderUpdates             *prometheus.CounterVec
+	OrderEventsReceived      *prometheus.CounterVec
+	FeatureFlags             *prometheus.GaugeVec
+	SecretRefreshes          *prometheus.CounterVec
+	PublishQueueDepth        prometheus.Gauge
+	PublishQueueJobs         *prometheus.CounterVec
+	PublishSpoolSize         prometheus.Gauge
+	PublishQueueThrottled    prometheus.Counter
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		OrdersPublished: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "order_published_total",
+			Help: "Number of events published to the pubsub component, by topic.",
+		}, []string{"topic"}),
+		PublishRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "order_publish_retries_total",
+			Help: "Number of publish attempts that failed and were retried.",
+		}, []string{"topic"}),
+		PublishDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "order_publish_duration_seconds",
+			Help:    "Duration of the publishes to the pubsub component, retries included, by topic.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"topic"}),
+		PublishOutcomes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "order_publish_outcomes_total",
+			Help: "Number of publishes by topic, outcome (success, failure) and error class, none on success.",
+		}, []string{"topic", "outcome", "error_class"}),
+		CircuitBreakerState: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dapr_circuit_breaker_state",
+			Help: "State of the circuit breaker around the Dapr client (0=closed, 1=half-open, 2=open).",
+		}),
+		CircuitBreakerRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dapr_circuit_breaker_rejections_total",
+			Help: "Number of Dapr client calls rejected because the circuit breaker was open.",
+		}, []string{"operation"}),
+		WebhookDeliveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_deliveries_total",
+			Help: "Number of webhook deliveries by outcome (delivered, failed, retried, dropped).",
+		}, []string{"outcome"}),
+		TenantRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tenant_requests_total",
+			Help: "Number of requests accepted for each tenant.",
+		}, []string{"tenant"}),
+		OrderUpdates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "order_updates_total",
+			Help: "Number of order status changes stored and published, by tenant.",
+		}, []string{"tenant"}),
+		OrderEventsReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "order_events_received_total",
+			Help: "Number of order events delivered by the sidecar, by route.",
+		}, []string{"route"}),
+		FeatureFlags: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "feature_flag_enabled",
+			Help: "Value of the feature flags (0=off, 1=on), by flag.",
+		}, []string{"flag"}),
+		SecretRefreshes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "secret_refreshes_total",
+			Help: "Number of reads of the credentials from the secret store, by outcome (success, failure).",
+		}, []string{"outcome"}),
+		PublishQueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "publish_queue_depth",
+			Help: "Number of publishes queued and not yet run by a worker.",
+		}),
+		PublishQueueJobs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "publish_queue_jobs_total",
+			Help: "Number of publishes handed to the publish queue, by outcome (queued, rejected).",
+		}, []string{"outcome"}),
+		PublishSpoolSize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "publish_spool_size",
+			Help: "Number of updates kept in the publish spool until their event is published.",
+		}),
+		PublishQueueThrottled: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "publish_queue_throttled_total",
+			Help: "Number of order updates answered with a 429 as the publish queue was full.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.OrdersPublished,
+		m.PublishRetries,
+		m.PublishDuration,
+		m.PublishOutcomes,
+		m.CircuitBreakerState,
+		m.CircuitBreakerRejections,
+		m.WebhookDeliveries,
+		m.TenantRequests,
+		m.OrderUpdates,
+		m.OrderEventsReceived,
+		m.FeatureFlags,
+		m.SecretRefreshes,
+		m.PublishQueueDepth,
+		m.PublishQueueJobs,
+		m.PublishSpoolSize,
+		m.PublishQueueThrottled,
+	)
+
+	return m
+}
+
+// Handler returns an HTTP handler serving the metrics in the Prometheus
+// exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
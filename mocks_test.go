@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+type mockEvent struct {
+	handler string
+	topic   string
+	data    any
+	// key is the key the event was published with, if any
+	key string
+}
+
+// mockPublisher records the events published by the handlers, failing with
+// err if set.
+type mockPublisher struct {
+	mu     sync.Mutex
+	err    error
+	events []mockEvent
+}
+
+func (p *mockPublisher) Publish(ctx context.Context, handler, topic string, data any) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.events = append(p.events, mockEvent{handler: handler, topic: topic, data: data, key: eventKeyFromContext(ctx)})
+	return nil
+}
+
+// mockOrderRepository keeps orders in a MemoryOrderRepository. The methods
+// named in errs fail with the error, and the calls are recorded by name.
+type mockOrderRepository struct {
+	*MemoryOrderRepository
+
+	mu    sync.Mutex
+	errs  map[string]error
+	calls []string
+}
+
+func newMockOrderRepository() *mockOrderRepository {
+	return &mockOrderRepository{MemoryOrderRepository: NewMemoryOrderRepository()}
+}
+
+// call records the call of method and returns the error it should fail with.
+func (r *mockOrderRepository) call(method string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, method)
+	return r.errs[method]
+}
+
+// save stores order without recording the call.
+func (r *mockOrderRepository) save(order Order) {
+	if err := r.MemoryOrderRepository.Save(context.Background(), order, ""); err != nil {
+		panic(err)
+	}
+}
+
+func (r *mockOrderRepository) Get(ctx context.Context, id string) (Order, string, error) {
+	if err := r.call("Get"); err != nil {
+		return Order{}, "", err
+	}
+	return r.MemoryOrderRepository.Get(ctx, id)
+}
+
+func (r *mockOrderRepository) Save(ctx context.Context, order Order, etag string) error {
+	if err := r.call("Save"); err != nil {
+		return err
+	}
+	return r.MemoryOrderRepository.Save(ctx, order, etag)
+}
+
+func (r *mockOrderRepository) Delete(ctx context.Context, id, etag string) error {
+	if err := r.call("Delete"); err != nil {
+		return err
+	}
+	return r.MemoryOrderRepository.Delete(ctx, id, etag)
+}
+
+func (r *mockOrderRepository) List(ctx context.Context, limit, offset int) (*OrderList, error) {
+	if err := r.call("List"); err != nil {
+		return nil, err
+	}
+	return r.MemoryOrderRepository.List(ctx, limit, offset)
+}
+
+// mockPayments fails the verifications with err and the refunds with
+// refundErr if set, and records the orders verified and refunded.
+type mockPayments struct {
+	mu        sync.Mutex
+	err       error
+	refundErr error
+	verified  []string
+	refunded  []string
+}
+
+func (p *mockPayments) Verify(ctx context.Context, order Order) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.verified = append(p.verified, order.ID)
+	return p.err
+}
+
+func (p *mockPayments) Refund(ctx context.Context, order Order) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refunded = append(p.refunded, order.ID)
+	return p.refundErr
+}
+
+// mockInventory fails with err if set, and records the reservation calls as
+// method and order ID.
+type mockInventory struct {
+	mu    sync.Mutex
+	err   error
+	calls []string
+}
+
+func (i *mockInventory) call(method string, order Order) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.calls = append(i.calls, method+" "+order.ID)
+	return i.err
+}
+
+func (i *mockInventory) Reserve(ctx context.Context, order Order) error {
+	return i.call(inventoryMethodReserve, order)
+}
+
+func (i *mockInventory) Confirm(ctx context.Context, order Order) error {
+	return i.call(inventoryMethodConfirm, order)
+}
+
+func (i *mockInventory) Release(ctx context.Context, order Order) error {
+	return i.call(inventoryMethodRelease, order)
+}
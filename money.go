@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// currencies are the active ISO-4217 currency codes accepted for the amount
+// of orders.
+var currencies = strings.Fields(`
+	AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND
+	BOB BRL BSD BTN BWP BYN BZD CAD CDF CHF CLP CNY COP CRC CUP CVE CZK DJF
+	DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD GNF GTQ GYD HKD
+	HNL HTG HUF IDR ILS INR IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW KRW
+	KWD KYD KZT LAK LBP LKR LRD LSL LYD MAD MDL MGA MKD MMK MNT MOP MRU MUR
+	MVR MWK MXN MYR MZN NAD NGN NIO NOK NPR NZD OMR PAB PEN PGK PHP PKR PLN
+	PYG QAR RON RSD RUB RWF SAR SBD SCR SDG SEK SGD SHP SLE SOS SRD SSP STN
+	SVC SYP SZL THB TJS TMT TND TOP TRY TTD TWD TZS UAH UGX USD UYU UZS VES
+	VND VUV WST XAF XCD XOF XPF YER ZAR ZMW ZWL`)
+
+// validateAmount ensures an amount, if set, isn't negative and is in a known
+// currency. A currency can't be set without an amount, and only a zero amount
+// goes without a currency.
+func validateAmount(amount *int64, currency string) error {
+	if amount == nil {
+		if currency != "" {
+			return fmt.Errorf("%w: currency %s has no amount", ErrInvalidOrder, currency)
+		}
+		return nil
+	}
+	if *amount < 0 {
+		return fmt.Errorf("%w: amount must not be negative", ErrInvalidOrder)
+	}
+	if currency == "" && *amount != 0 {
+		return fmt.Errorf("%w: amount has no currency", ErrInvalidOrder)
+	}
+	return validateCurrency(currency)
+}
+
+// validateCurrency ensures currency, if set, is a known ISO-4217 code.
+func validateCurrency(currency string) error {
+	if currency != "" && !slices.Contains(currencies, currency) {
+		return fmt.Errorf("%w: unknown currency %q", ErrInvalidOrder, currency)
+	}
+	return nil
+}
+
+// lineItemsTotal returns the total of items, and whether any of them is
+// priced. validateLineItems ensures the total doesn't overflow.
+func lineItemsTotal(items []LineItem) (total int64, priced bool) {
+	for _, item := range items {
+		total += item.UnitPrice * int64(item.Quantity)
+		priced = priced || item.UnitPrice > 0
+	}
+	return total, priced
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Files of the issuer credentials Sentry reads from its credentials
+// directory.
+const (
+	trustAnchorsFile = "ca.crt"
+	issuerCertFile   = "issuer.crt"
+	issuerKeyFile    = "issuer.key"
+)
+
+// writeTrustAnchors generates a root CA and an issuer CA signed by it, valid
+// for a day, and writes them to dir as Sentry expects them. It returns the PEM
+// encoded root certificate, which the sidecars trust.
+func writeTrustAnchors(dir string) ([]byte, error) {
+	now := time.Now()
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"testcontainers-dapr-example"}, CommonName: "cluster.local"},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, root, root, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		return nil, err
+	}
+	root, err = x509.ParseCertificate(rootDER)
+	if err != nil {
+		return nil, err
+	}
+
+	issuerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	issuer := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{Organization: []string{"testcontainers-dapr-example"}, CommonName: "cluster.local"},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	issuerDER, err := x509.CreateCertificate(rand.Reader, issuer, root, &issuerKey.PublicKey, rootKey)
+	if err != nil {
+		return nil, err
+	}
+	issuerKeyDER, err := x509.MarshalECPrivateKey(issuerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	rootPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootDER})
+	files := map[string][]byte{
+		trustAnchorsFile: rootPEM,
+		issuerCertFile:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issuerDER}),
+		issuerKeyFile:    pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: issuerKeyDER}),
+	}
+	for name, content := range files {
+		// Sentry runs as a non root user, which must be able to read the key
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0o644); err != nil {
+			return nil, err
+		}
+	}
+	return rootPEM, nil
+}
+
+func TestWriteTrustAnchors(t *testing.T) {
+	dir := t.TempDir()
+
+	rootPEM, err := writeTrustAnchors(dir)
+	if err != nil {
+		t.Fatalf("couldn't write trust anchors: %s", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(rootPEM) {
+		t.Fatal("expected the trust anchors to hold a certificate")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, issuerCertFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	issuer, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("couldn't parse issuer certificate: %s", err)
+	}
+	if !issuer.IsCA {
+		t.Fatal("expected the issuer to be a CA")
+	}
+	if _, err := issuer.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		t.Fatalf("expected the issuer to chain to the trust anchors. Got %s.", err)
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, issuerKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ = pem.Decode(data)
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("couldn't parse issuer key: %s", err)
+	}
+	if !key.PublicKey.Equal(issuer.PublicKey) {
+		t.Fatal("expected the issuer key to match its certificate")
+	}
+}
@@ -0,0 +1,4 @@
+// Package orderspb holds the protobuf messages of the orders API.
+package orderspb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative orders.proto events.proto
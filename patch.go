@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/gorilla/mux"
+)
+
+const (
+	contentTypeMergePatch = "application/merge-patch+json"
+	contentTypeJSONPatch  = "application/json-patch+json"
+)
+
+// ErrPatchTestFailed is returned when a test operation of a JSON Patch
+// doesn't match the stored order.
+var ErrPatchTestFailed = errors.New("patch test failed")
+
+// applyPatch applies the merge patch (RFC 7396) or JSON Patch (RFC 6902)
+// body of r, according to its Content-Type, to doc.
+func applyPatch(r *http.Request, doc []byte) ([]byte, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedMediaType, err)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mediaType {
+	case contentTypeMergePatch:
+		patched, err := jsonpatch.MergePatch(doc, body)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidOrder, err)
+		}
+		return patched, nil
+	case contentTypeJSONPatch:
+		patch, err := jsonpatch.DecodePatch(body)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidOrder, err)
+		}
+		patched, err := patch.Apply(doc)
+		if errors.Is(err, jsonpatch.ErrTestFailed) {
+			return nil, fmt.Errorf("%w: %s", ErrPatchTestFailed, err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidOrder, err)
+		}
+		return patched, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedMediaType, mediaType)
+}
+
+// handleOrdersPatch applies a patch to the stored order, as represented by the
+// version of the API, and saves the result like a PUT would. Only the fields
+// the patch changes are updated, and an event is published only if the
+// status changes.
+func (h *AppHandler) handleOrdersPatch(m OrderMapper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderID := mux.Vars(r)["id"]
+		expedited, err := expeditedHeader(r)
+		if err != nil {
+			writePriorityError(w, err)
+			return
+		}
+
+		current, etag, err := h.store.Get(r.Context(), orderID)
+		if errors.Is(err, ErrOrderNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "Order not found")
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "couldn't get order", "error", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Service unavailable")
+			return
+		}
+
+		v, _ := m.Order(current)
+		doc, err := json.Marshal(v)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "couldn't encode order", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Internal server error")
+			return
+		}
+
+		patched, err := applyPatch(r, doc)
+		if errors.Is(err, ErrPatchTestFailed) {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "Conflict: %s", err)
+			return
+		}
+		if err != nil {
+			writePatchError(w, err)
+			return
+		}
+
+		order, err := m.DecodeOrder(patched, current)
+		if err == nil && (order.ID != current.ID || order.Tenant != current.Tenant) {
+			err = fmt.Errorf("%w: id and tenant can't be changed", ErrInvalidOrder)
+		}
+		if err != nil {
+			writePatchError(w, err)
+			return
+		}
+
+		// the patch was applied to the version read above, so it is saved on
+		// top of it unless the client asked for another one
+		ifMatch := r.Header.Get("If-Match")
+		if ifMatch == "" {
+			ifMatch = formatETag(etag)
+		}
+
+		update := OrderUpdate{
+			Status:     order.Status,
+			LineItems:  order.LineItems,
+			Amount:     &order.Amount,
+			Currency:   order.Currency,
+			CustomerID: order.CustomerID,
+			Expedited:  expedited,
+		}
+		h.writeUpdateResult(w, h.updateOrder(r.Context(), orderID, update, ifMatch))
+	}
+}
+
+// writePatchError answers a patch that can't be applied, or whose result
+// isn't a valid order.
+func writePatchError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrUnsupportedMediaType) {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		fmt.Fprintf(w, "Unsupported media type: expected %s or %s", contentTypeMergePatch, contentTypeJSONPatch)
+		return
+	}
+	writeCodecError(w, err)
+}
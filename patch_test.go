@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOrdersPatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		patch       string
+		wantCode    int
+		wantOrder   string
+	}{
+		{
+			name:        "merge patch",
+			path:        "/orders/order-1234",
+			contentType: contentTypeMergePatch,
+			patch:       `{"status":"PAID"}`,
+			wantCode:    http.StatusOK,
+			wantOrder:   `{"id":"order-1234","status":"PAID","lineItems":[{"sku":"book","quantity":1}]}`,
+		},
+		{
+			name:        "json patch",
+			path:        "/v2/orders/order-1234",
+			contentType: contentTypeJSONPatch,
+			patch:       `[{"op":"add","path":"/lineItems/-","value":{"sku":"pen","quantity":2}}]`,
+			wantCode:    http.StatusOK,
+			wantOrder:   `{"id":"order-1234","status":"PENDING","lineItems":[{"sku":"book","quantity":1},{"sku":"pen","quantity":2}]}`,
+		},
+		{
+			name:        "json patch adding a priced line item",
+			path:        "/v2/orders/order-1234",
+			contentType: contentTypeJSONPatch,
+			patch:       `[{"op":"add","path":"/lineItems/-","value":{"sku":"pen","quantity":2,"unitPrice":150}},{"op":"add","path":"/currency","value":"EUR"}]`,
+			wantCode:    http.StatusOK,
+			wantOrder:   `{"id":"order-1234","status":"PENDING","lineItems":[{"sku":"book","quantity":1},{"sku":"pen","quantity":2,"unitPrice":150}],"amount":300,"currency":"EUR"}`,
+		},
+		{
+			name:        "merge patch removing line items",
+			path:        "/v2/orders/order-1234",
+			contentType: contentTypeMergePatch,
+			patch:       `{"lineItems":null}`,
+			wantCode:    http.StatusOK,
+			wantOrder:   `{"id":"order-1234","status":"PENDING"}`,
+		},
+		{
+			name:        "failed test",
+			path:        "/orders/order-1234",
+			contentType: contentTypeJSONPatch,
+			patch:       `[{"op":"test","path":"/status","value":"PAID"},{"op":"replace","path":"/status","value":"PENDING"}]`,
+			wantCode:    http.StatusConflict,
+		},
+		{
+			name:        "invalid transition",
+			path:        "/orders/order-1234",
+			contentType: contentTypeMergePatch,
+			patch:       `{"status":"SHIPPED"}`,
+			wantCode:    http.StatusBadRequest,
+		},
+		{
+			name:        "changed id",
+			path:        "/orders/order-1234",
+			contentType: contentTypeMergePatch,
+			patch:       `{"id":"order-5678"}`,
+			wantCode:    http.StatusBadRequest,
+		},
+		{
+			name:        "invalid patch",
+			path:        "/orders/order-1234",
+			contentType: contentTypeJSONPatch,
+			patch:       `{"op":"add"}`,
+			wantCode:    http.StatusBadRequest,
+		},
+		{
+			name:        "plain json",
+			path:        "/orders/order-1234",
+			contentType: contentTypeJSON,
+			patch:       `{"status":"PAID"}`,
+			wantCode:    http.StatusUnsupportedMediaType,
+		},
+		{
+			name:        "unknown order",
+			path:        "/orders/order-5678",
+			contentType: contentTypeMergePatch,
+			patch:       `{"status":"PAID"}`,
+			wantCode:    http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newOrdersServer(t)
+			body := []byte(`{"status":"PENDING","lineItems":[{"sku":"book","quantity":1}]}`)
+			doRequest(t, http.MethodPut, server.URL+"/v2/orders/order-1234", contentTypeJSON, "", body)
+
+			resp, data := doRequest(t, http.MethodPatch, server.URL+tt.path, tt.contentType, "", []byte(tt.patch))
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("expected status code %d. Got %d: %s.", tt.wantCode, resp.StatusCode, data)
+			}
+			if tt.wantOrder == "" {
+				return
+			}
+
+			_, data = doRequest(t, http.MethodGet, server.URL+"/v2/orders/order-1234", "", "", nil)
+			if string(data) != tt.wantOrder+"\n" {
+				t.Fatalf("expected order %s. Got %s.", tt.wantOrder, data)
+			}
+		})
+	}
+}
+
+func TestOrdersPatchStaleETag(t *testing.T) {
+	server := newOrdersServer(t)
+	doRequest(t, http.MethodPut, server.URL+"/orders/order-1234", contentTypeJSON, "", []byte(`{"status":"PENDING"}`))
+
+	req, err := http.NewRequest(http.MethodPatch, server.URL+"/orders/order-1234", strings.NewReader(`{"status":"PAID"}`))
+	if err != nil {
+		t.Fatalf("couldn't create request: %s", err)
+	}
+	req.Header.Set("Content-Type", contentTypeMergePatch)
+	req.Header.Set("If-Match", `"0"`)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("couldn't do request: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusConflict || resp.Header.Get("ETag") != `"1"` {
+		t.Fatalf("expected a conflict with the current ETag. Got %d with ETag %s.", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+}
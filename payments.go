@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	dapr "github.com/dapr/go-sdk/client"
+)
+
+// Methods of the payments app, verifying and refunding the charge of an
+// order.
+const (
+	paymentsMethodVerify = "verify"
+	paymentsMethodRefund = "refund"
+)
+
+// Payments verifies that an order was charged before it is accepted as paid,
+// and reverses the charge of refunded orders.
+type Payments interface {
+	// Verify returns a *PaymentDeclinedError if the charge of order was
+	// declined, or another error if it couldn't be verified.
+	Verify(ctx context.Context, order Order) error
+	// Refund returns a *PaymentDeclinedError if the charge of order couldn't
+	// be reversed, or another error if the payments app couldn't be reached.
+	Refund(ctx context.Context, order Order) error
+}
+
+// PaymentDeclinedError rejects an order whose charge, or the reversal of its
+// charge, was declined.
+type PaymentDeclinedError struct {
+	Reason string
+}
+
+func (e *PaymentDeclinedError) Error() string {
+	if e.Reason == "" {
+		return "payment declined"
+	}
+	return "payment declined: " + e.Reason
+}
+
+// paymentRequest and paymentAnswer are the request and the answer of the
+// methods of the payments app.
+type paymentRequest struct {
+	OrderID string `json:"orderId"`
+	Tenant  string `json:"tenant,omitempty"`
+}
+
+type paymentAnswer struct {
+	Approved bool   `json:"approved"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// DaprPayments reaches the payments app through the sidecar.
+type DaprPayments struct {
+	client dapr.Client
+	appID  string
+}
+
+func NewDaprPayments(client dapr.Client, appID string) *DaprPayments {
+	return &DaprPayments{client: client, appID: appID}
+}
+
+func (p *DaprPayments) Verify(ctx context.Context, order Order) error {
+	return p.invoke(ctx, paymentsMethodVerify, order)
+}
+
+func (p *DaprPayments) Refund(ctx context.Context, order Order) error {
+	return p.invoke(ctx, paymentsMethodRefund, order)
+}
+
+// Check calls the health endpoint of the payments app, for the health
+// checks.
+func (p *DaprPayments) Check(ctx context.Context) error {
+	if _, err := p.client.InvokeMethod(ctx, p.appID, "health", "get"); err != nil {
+		return fmt.Errorf("couldn't invoke %s/health: %w", p.appID, err)
+	}
+	return nil
+}
+
+// invoke calls method of the payments app for order, returning a
+// *PaymentDeclinedError unless it is approved.
+func (p *DaprPayments) invoke(ctx context.Context, method string, order Order) error {
+	data, err := json.Marshal(paymentRequest{OrderID: order.ID, Tenant: order.Tenant})
+	if err != nil {
+		return fmt.Errorf("couldn't encode %s request: %w", method, err)
+	}
+	out, err := p.client.InvokeMethodWithContent(ctx, p.appID, method, "post", &dapr.DataContent{
+		ContentType: contentTypeJSON,
+		Data:        data,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't invoke %s/%s: %w", p.appID, method, err)
+	}
+
+	var answer paymentAnswer
+	if err := json.Unmarshal(out, &answer); err != nil {
+		return fmt.Errorf("couldn't decode answer of %s/%s: %w", p.appID, method, err)
+	}
+	if !answer.Approved {
+		return &PaymentDeclinedError{Reason: answer.Reason}
+	}
+	return nil
+}
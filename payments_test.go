@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	dapr "github.com/dapr/go-sdk/client"
+)
+
+func TestDaprPayments(t *testing.T) {
+	errUnavailable := errors.New("unavailable")
+
+	tests := []struct {
+		name     string
+		out      string
+		err      error
+		declined *PaymentDeclinedError
+		// failed is set when the call itself is expected to fail
+		failed bool
+	}{
+		{name: "approved", out: `{"approved":true}`},
+		{name: "declined", out: `{"approved":false,"reason":"insufficient funds"}`, declined: &PaymentDeclinedError{Reason: "insufficient funds"}},
+		{name: "unavailable", err: errUnavailable, failed: true},
+		{name: "invalid answer", out: `approved`, failed: true},
+	}
+
+	methods := map[string]func(*DaprPayments) func(context.Context, Order) error{
+		paymentsMethodVerify: func(p *DaprPayments) func(context.Context, Order) error { return p.Verify },
+		paymentsMethodRefund: func(p *DaprPayments) func(context.Context, Order) error { return p.Refund },
+	}
+	for method, call := range methods {
+		for _, tt := range tests {
+			t.Run(method+" "+tt.name, func(t *testing.T) {
+				var request paymentRequest
+				client := &fakeDaprClient{invoke: func(appID, m string, content *dapr.DataContent) ([]byte, error) {
+					if appID != "payments" || m != method || content.ContentType != contentTypeJSON {
+						t.Fatalf("expected a JSON call to payments/%s. Got %s/%s in %s.", method, appID, m, content.ContentType)
+					}
+					if err := json.Unmarshal(content.Data, &request); err != nil {
+						t.Fatalf("couldn't decode request: %s", err)
+					}
+					return []byte(tt.out), tt.err
+				}}
+
+				err := call(NewDaprPayments(client, "payments"))(context.Background(), Order{ID: "order-1234", Tenant: "acme"})
+				if request != (paymentRequest{OrderID: "order-1234", Tenant: "acme"}) {
+					t.Fatalf("expected the request to be about the order. Got %+v.", request)
+				}
+
+				var declined *PaymentDeclinedError
+				switch {
+				case tt.declined != nil:
+					if !errors.As(err, &declined) || *declined != *tt.declined {
+						t.Fatalf("expected %v. Got %v.", tt.declined, err)
+					}
+				case tt.failed:
+					if err == nil || errors.As(err, &declined) {
+						t.Fatalf("expected the call to fail. Got %v.", err)
+					}
+				case err != nil:
+					t.Fatalf("expected the call to be approved. Got %s.", err)
+				}
+			})
+		}
+	}
+}
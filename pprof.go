@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+const defaultPprofAddress = ":6060"
+
+// newPprofHandler returns the handler of the pprof endpoints, under
+// /debug/pprof/ as `go tool pprof` expects. They are registered on a mux of
+// their own rather than on the router of the app, so that they are only
+// reachable on the admin port.
+func newPprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// StartPprofServer serves the pprof endpoints on address until ctx is done.
+// The admin port serves plain HTTP and no authentication, so it must not be
+// published beyond the operators.
+func StartPprofServer(ctx context.Context, address string) error {
+	server := &http.Server{
+		Addr:        address,
+		Handler:     newPprofHandler(),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down pprof server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPprofHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newPprofHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "heap") {
+		t.Fatalf("expected the pprof index. Got %d: %s", rec.Code, rec.Body)
+	}
+
+	// the app itself doesn't serve them
+	h := newMockHandler(&mockPublisher{}, newMockOrderRepository())
+	h.RegisterRoutes()
+	rec = httptest.NewRecorder()
+	h.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status code %d on the app port. Got %d.", http.StatusNotFound, rec.Code)
+	}
+}
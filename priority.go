@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const (
+	// headerOrderPriority sets the priority of an order update, whatever
+	// the encoding of its body.
+	headerOrderPriority = "X-Order-Priority"
+
+	priorityNormal    = "normal"
+	priorityExpedited = "expedited"
+)
+
+// expeditedHeader reports whether the X-Order-Priority header of r expedites
+// the update, a missing header leaving it at normal priority.
+func expeditedHeader(r *http.Request) (bool, error) {
+	switch priority := r.Header.Get(headerOrderPriority); priority {
+	case "", priorityNormal:
+		return false, nil
+	case priorityExpedited:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown priority %q, expected %s or %s", priority, priorityNormal, priorityExpedited)
+	}
+}
+
+// writePriorityError answers a request with an invalid X-Order-Priority
+// header.
+func writePriorityError(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, "Bad request: %s", err)
+}
+
+// orderTopic returns the topic the status change of update is published to.
+func orderTopic(update OrderUpdate) string {
+	if update.Expedited {
+		return topicOrdersPriority
+	}
+	return topicOrders
+}
+
+// limitConcurrency serves at most n requests with next at once, the others
+// waiting for their turn or for their client to give up, unless n is zero.
+func limitConcurrency(n int, next http.HandlerFunc) http.HandlerFunc {
+	return newConcurrencyLimit(n)(next)
+}
+
+// newConcurrencyLimit returns a middleware serving at most n requests at once
+// across all the handlers it wraps, unless n is zero.
+func newConcurrencyLimit(n int) func(next http.HandlerFunc) http.HandlerFunc {
+	if n <= 0 {
+		return func(next http.HandlerFunc) http.HandlerFunc { return next }
+	}
+	slots := make(chan struct{}, n)
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-r.Context().Done():
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			next(w, r)
+		}
+	}
+}
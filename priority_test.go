@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExpeditedOrders(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		priority string
+		body     string
+		// expected is the status code of the answer, and expectedTopic the
+		// topic the status change is published to
+		expected      int
+		expectedTopic string
+	}{
+		{name: "normal", method: http.MethodPut, path: "/v2/orders/order-1111", body: `{"status":"PAID"}`, expected: http.StatusOK, expectedTopic: topicOrders},
+		{name: "expedited field", method: http.MethodPut, path: "/v2/orders/order-1111", body: `{"status":"PAID","expedited":true}`, expected: http.StatusOK, expectedTopic: topicOrdersPriority},
+		{name: "expedited header", method: http.MethodPut, path: "/orders/order-1111", priority: "expedited", body: `{"status":"PAID"}`, expected: http.StatusOK, expectedTopic: topicOrdersPriority},
+		{name: "normal header", method: http.MethodPut, path: "/orders/order-1111", priority: "normal", body: `{"status":"PAID"}`, expected: http.StatusOK, expectedTopic: topicOrders},
+		{name: "expedited batch", method: http.MethodPut, path: "/v2/orders", priority: "expedited", body: `[{"id":"order-1111","status":"PAID"}]`, expected: http.StatusOK, expectedTopic: topicOrdersPriority},
+		{name: "expedited patch", method: http.MethodPatch, path: "/v2/orders/order-1111", priority: "expedited", body: `{"status":"PAID"}`, expected: http.StatusOK, expectedTopic: topicOrdersPriority},
+		{name: "unknown priority", method: http.MethodPut, path: "/orders/order-1111", priority: "urgent", body: `{"status":"PAID"}`, expected: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := &mockPublisher{}
+			store := newMockOrderRepository()
+			if err := store.Save(context.Background(), Order{ID: "order-1111", Status: OrderStatusPending}, ""); err != nil {
+				t.Fatalf("couldn't save order: %s", err)
+			}
+			h := newMockHandler(publisher, store)
+			h.RegisterRoutes()
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", contentTypeJSON)
+			if tt.method == http.MethodPatch {
+				req.Header.Set("Content-Type", contentTypeMergePatch)
+			}
+			if tt.priority != "" {
+				req.Header.Set(headerOrderPriority, tt.priority)
+			}
+			rec := httptest.NewRecorder()
+			h.router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.expected {
+				t.Fatalf("expected status code %d. Got %d: %s", tt.expected, rec.Code, rec.Body)
+			}
+			if tt.expectedTopic == "" {
+				if len(publisher.events) != 0 {
+					t.Fatalf("expected no event. Got %v.", publisher.events)
+				}
+				return
+			}
+			if len(publisher.events) != 1 || publisher.events[0].topic != tt.expectedTopic {
+				t.Fatalf("expected an event on %s. Got %v.", tt.expectedTopic, publisher.events)
+			}
+		})
+	}
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	const n = 2
+
+	var (
+		mu      sync.Mutex
+		running int
+		maxSeen int
+	)
+	handler := limitConcurrency(n, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		maxSeen = max(maxSeen, running)
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3*n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, routePriorityOrderEvents, nil))
+		}()
+	}
+	wg.Wait()
+
+	if maxSeen != n {
+		t.Fatalf("expected %d requests served at once. Got %d.", n, maxSeen)
+	}
+}
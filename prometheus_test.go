@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// prometheusConfigFile is the name of the configuration written by
+// writePrometheusConfig.
+const prometheusConfigFile = "prometheus.yml"
+
+// prometheusConfig is the subset of the Prometheus configuration the stack
+// sets.
+type prometheusConfig struct {
+	Global struct {
+		ScrapeInterval string `yaml:"scrape_interval"`
+	} `yaml:"global"`
+	ScrapeConfigs []prometheusScrapeConfig `yaml:"scrape_configs"`
+}
+
+type prometheusScrapeConfig struct {
+	JobName       string                   `yaml:"job_name"`
+	StaticConfigs []prometheusStaticConfig `yaml:"static_configs"`
+}
+
+type prometheusStaticConfig struct {
+	Targets []string `yaml:"targets"`
+}
+
+// writePrometheusConfig writes to dir a Prometheus configuration scraping the
+// host:port targets of each job every interval, and returns its path.
+func writePrometheusConfig(dir string, interval time.Duration, jobs map[string][]string) (string, error) {
+	var config prometheusConfig
+	config.Global.ScrapeInterval = interval.String()
+	for job, targets := range jobs {
+		config.ScrapeConfigs = append(config.ScrapeConfigs, prometheusScrapeConfig{
+			JobName:       job,
+			StaticConfigs: []prometheusStaticConfig{{Targets: targets}},
+		})
+	}
+
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, prometheusConfigFile)
+	// Prometheus runs as nobody, which must be able to read it
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func TestWritePrometheusConfig(t *testing.T) {
+	path, err := writePrometheusConfig(t.TempDir(), time.Second, map[string][]string{
+		"app":  {"app:3000"},
+		"dapr": {"dapr-app:9090", "dapr-integration:9090"},
+	})
+	if err != nil {
+		t.Fatalf("couldn't write configuration: %s", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config prometheusConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		t.Fatalf("couldn't parse configuration: %s", err)
+	}
+
+	if config.Global.ScrapeInterval != "1s" {
+		t.Fatalf("expected scrape interval 1s. Got %s.", config.Global.ScrapeInterval)
+	}
+	targets := map[string][]string{}
+	for _, scrape := range config.ScrapeConfigs {
+		for _, static := range scrape.StaticConfigs {
+			targets[scrape.JobName] = append(targets[scrape.JobName], static.Targets...)
+		}
+	}
+	if len(targets) != 2 || len(targets["app"]) != 1 || len(targets["dapr"]) != 2 {
+		t.Fatalf("expected the targets of the app and dapr jobs. Got %v.", targets)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	pubsubName = "order-pub-sub"
+
+	topicOrders    = "orders"
+	topicShipments = "shipments"
+	// topicOrdersPriority carries the status changes of expedited updates,
+	// rather than topicOrders.
+	topicOrdersPriority = "orders.priority"
+
+	handlerOrdersPut       = "orders.put"
+	handlerOrdersCancel    = "orders.cancel"
+	handlerOrdersRefund    = "orders.refund"
+	handlerShipmentsCreate = "shipments.create"
+	handlerShipmentsTrack  = "shipments.track"
+	handlerDLQReplay       = "dlq.replay"
+
+	// cloudEventTenantExtension is the CloudEvent extension attribute
+	// carrying the tenant of an event.
+	cloudEventTenantExtension = "tenantid"
+	// metadataTTL is the publish metadata setting the time to live of an
+	// event, in seconds.
+	metadataTTL = "ttlInSeconds"
+
+	// cloudEventStatusExtension is the CloudEvent extension attribute
+	// carrying the status an order event leaves its order in, which
+	// subscriptions route the events on.
+	cloudEventStatusExtension = "orderstatus"
+
+	contentTypeCloudEvents = "application/cloudevents+json"
+)
+
+// knownTopics lists the topics the application is allowed to publish to at
+// all. Any topic referenced by the allowlist must be part of it.
+var knownTopics = []string{topicOrders, topicOrdersPriority, topicShipments}
+
+// knownHandlers lists the handlers that publish events.
+var knownHandlers = []string{handlerOrdersPut, handlerOrdersCancel, handlerOrdersRefund, handlerShipmentsCreate, handlerShipmentsTrack, handlerDLQReplay}
+
+// ErrTopicNotAllowed is returned when a handler publishes to a topic that is
+// not part of its allowlist.
+var ErrTopicNotAllowed = errors.New("topic not allowed")
+
+// TopicAllowlist maps handler names to the topics they are permitted to
+// publish to.
+type TopicAllowlist map[string][]string
+
+func defaultTopicAllowlist() TopicAllowlist {
+	return TopicAllowlist{
+		handlerOrdersPut:       {topicOrders, topicOrdersPriority},
+		handlerOrdersCancel:    {topicOrders},
+		handlerOrdersRefund:    {topicOrders},
+		handlerShipmentsCreate: {topicShipments},
+		handlerShipmentsTrack:  {topicShipments},
+		handlerDLQReplay:       {topicOrders},
+	}
+}
+
+// ParseTopicAllowlist parses an allowlist in the form
+// "handler=topic1,topic2;handler2=topic3".
+func ParseTopicAllowlist(s string) (TopicAllowlist, error) {
+	allowlist := TopicAllowlist{}
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		handler, topics, ok := strings.Cut(entry, "=")
+		handler = strings.TrimSpace(handler)
+		if !ok || handler == "" {
+			return nil, fmt.Errorf("invalid allowlist entry %q, expected handler=topic1,topic2", entry)
+		}
+
+		for _, topic := range strings.Split(topics, ",") {
+			if topic = strings.TrimSpace(topic); topic != "" {
+				allowlist[handler] = append(allowlist[handler], topic)
+			}
+		}
+	}
+	return allowlist, nil
+}
+
+// Validate ensures every handler and topic referenced by the allowlist is
+// known, so that a typo doesn't silently create a new publish target.
+func (a TopicAllowlist) Validate(handlers, topics []string) error {
+	for handler, allowed := range a {
+		if !slices.Contains(handlers, handler) {
+			return fmt.Errorf("topic allowlist references unknown handler %q", handler)
+		}
+		for _, topic := range allowed {
+			if !slices.Contains(topics, topic) {
+				return fmt.Errorf("topic allowlist references unknown topic %q for handler %q", topic, handler)
+			}
+		}
+	}
+	return nil
+}
+
+// Allows reports whether handler may publish to topic.
+func (a TopicAllowlist) Allows(handler, topic string) bool {
+	return slices.Contains(a[handler], topic)
+}
+
+// TypedEvent is implemented by the JSON events published with a CloudEvent
+// type of their own, rather than the one the sidecar gives to any event.
+type TypedEvent interface {
+	CloudEventType() string
+}
+
+type eventKeyContextKey struct{}
+
+// WithEventKey returns a copy of ctx publishing its event identified by key
+// rather than by a random ID, so that the event published again, such as by
+// a retried publish, keeps its CloudEvent ID for brokers and consumers to
+// dedupe on.
+func WithEventKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, eventKeyContextKey{}, key)
+}
+
+func eventKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(eventKeyContextKey{}).(string)
+	return key
+}
+
+type eventMetadataContextKey struct{}
+
+// WithEventMetadata returns a copy of ctx publishing its event with metadata
+// on top of the metadata of the publisher, which the sidecar hands to the
+// broker.
+func WithEventMetadata(ctx context.Context, metadata map[string]string) context.Context {
+	return context.WithValue(ctx, eventMetadataContextKey{}, metadata)
+}
+
+func eventMetadataFromContext(ctx context.Context) map[string]string {
+	metadata, _ := ctx.Value(eventMetadataContextKey{}).(map[string]string)
+	return metadata
+}
+
+// CloudEvent is an event already wrapped in its CloudEvent envelope, such as
+// an event replayed, which is published as is.
+type CloudEvent map[string]any
+
+// EventPublisher publishes the events of the handlers. *Publisher publishes
+// them through the sidecar.
+type EventPublisher interface {
+	Publish(ctx context.Context, handler, topic string, data any) error
+}
+
+// Publisher publishes events to the pubsub component on behalf of handlers,
+// enforcing the topic allowlist and retrying transient failures.
+type Publisher struct {
+	client    dapr.Client
+	pubsub    PubsubConfig
+	allowlist TopicAllowlist
+	retry     RetryPolicy
+	metrics   *Metrics
+	// ttl is the time to live of the events published, none if zero.
+	ttl time.Duration
+
+	// Encoder encodes the protobuf messages published, in their protobuf
+	// binary format by default.
+	Encoder EventEncoder
+	// Signer signs the events published, if set.
+	Signer *EventSigner
+
+	// brokerErr is the error of the last publish, if it failed to reach the
+	// broker.
+	mu        sync.Mutex
+	brokerErr error
+}
+
+func NewPublisher(client dapr.Client, config *Config, metrics *Metrics) *Publisher {
+	return &Publisher{
+		client:    client,
+		pubsub:    config.Pubsub,
+		allowlist: config.TopicAllowlist,
+		retry:     config.PublishRetry,
+		metrics:   metrics,
+		ttl:       config.Events.TTL,
+		Encoder:   ProtobufEncoder{},
+	}
+}
+
+// Publish sends data to topic on behalf of handler, retrying the transient
+// failures. It returns ErrTopicNotAllowed without contacting the sidecar if
+// handler is not permitted to publish to topic. ErrIncompatibleSchema and
+// ErrCircuitOpen are Permanent, returned without retrying, and any other
+// error is that of the last attempt.
+func (p *Publisher) Publish(ctx context.Context, handler, topic string, data any) (err error) {
+	defer func() {
+		outcome := "success"
+		if err != nil {
+			outcome = "failure"
+		}
+		p.metrics.PublishOutcomes.WithLabelValues(topic, outcome, publishErrorClass(err)).Inc()
+	}()
+	if !p.allowlist.Allows(handler, topic) {
+		return fmt.Errorf("%w: handler %q cannot publish to %q", ErrTopicNotAllowed, handler, topic)
+	}
+	// the publishes refused by the allowlist never reach the sidecar, so
+	// only the others are timed
+	start := time.Now()
+	defer func() {
+		p.metrics.PublishDuration.WithLabelValues(topic).Observe(time.Since(start).Seconds())
+	}()
+
+	publish := func(ctx context.Context) error {
+		// encoding is retried along with the publish as it may have to reach
+		// the schema registry
+		payload, opts, err := p.payload(ctx, topic, data)
+		if err != nil {
+			return err
+		}
+		if metadata := p.metadata(ctx); metadata != nil {
+			opts = append(opts, dapr.PublishEventWithMetadata(metadata))
+		}
+
+		err = p.client.PublishEvent(ctx, p.pubsub.name(), p.pubsub.topicName(topic), payload, opts...)
+		p.observe(err)
+		if errors.Is(err, ErrCircuitOpen) {
+			return Permanent(err)
+		}
+		return err
+	}
+	onRetry := func(attempt int, err error) {
+		slog.WarnContext(ctx, "couldn't publish event, retrying", "topic", topic, "attempt", attempt, "error", err)
+		p.metrics.PublishRetries.WithLabelValues(topic).Inc()
+	}
+
+	if err := p.retry.Do(ctx, publish, onRetry); err != nil {
+		return err
+	}
+	p.metrics.OrdersPublished.WithLabelValues(topic).Inc()
+	slog.DebugContext(ctx, "published event", "handler", handler, "topic", topic)
+	return nil
+}
+
+// observe records the outcome of a publish: the broker is unreachable from a
+// failure of the sidecar or of its component until a publish succeeds again.
+// The publishes the sidecar refused, or the circuit breaker rejected, tell
+// nothing of the broker.
+func (p *Publisher) observe(err error) {
+	if err != nil && (errors.Is(err, ErrCircuitOpen) || !isSidecarFailure(err)) {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.brokerErr = err
+}
+
+// BrokerError returns the error of the last publish if it failed to reach
+// the broker, nil if none did since a publish reached it. It tells whether
+// the broker is reachable from the traffic of the app, without publishing.
+func (p *Publisher) BrokerError() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.brokerErr
+}
+
+// payload returns data as published to topic, along with the options of its
+// content type. CloudEvents are published as is. Protobuf messages, typed
+// events, and the events carrying a tenant, a key or a correlation ID, or to
+// be signed, are wrapped by wrap. Anything else is published as JSON, for the
+// sidecar to wrap.
+func (p *Publisher) payload(ctx context.Context, topic string, data any) (any, []dapr.PublishEventOption, error) {
+	cloudEvents := []dapr.PublishEventOption{dapr.PublishEventWithContentType(contentTypeCloudEvents)}
+	if envelope, ok := data.(CloudEvent); ok {
+		return map[string]any(envelope), cloudEvents, nil
+	}
+	_, isProto := data.(proto.Message)
+	_, isTyped := data.(TypedEvent)
+	if !isProto && !isTyped && TenantFromContext(ctx) == "" && eventKeyFromContext(ctx) == "" && CorrelationIDFromContext(ctx) == "" && p.Signer == nil {
+		return data, nil, nil
+	}
+	event, err := p.wrap(ctx, topic, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return event, cloudEvents, nil
+}
+
+// wrap wraps data in a CloudEvent of its CloudEvent type, protobuf messages
+// being encoded with the Encoder; an incompatible schema fails for good. The
+// event carries the tenant of ctx in the tenantid extension, the correlation
+// ID of its request in the correlationid extension, and its key, see
+// WithEventKey, as ID. It is signed by the Signer if set, in the signature
+// extension.
+func (p *Publisher) wrap(ctx context.Context, topic string, data any) (map[string]any, error) {
+	event, err := newCloudEvent(ctx, p.Encoder, topic, data)
+	if errors.Is(err, ErrIncompatibleSchema) {
+		return nil, Permanent(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tenant := TenantFromContext(ctx); tenant != "" {
+		event[cloudEventTenantExtension] = tenant
+	}
+	if key := eventKeyFromContext(ctx); key != "" {
+		event["id"] = key
+	}
+	if correlationID := CorrelationIDFromContext(ctx); correlationID != "" {
+		event[cloudEventCorrelationExtension] = correlationID
+	}
+	if p.Signer != nil {
+		if err := p.Signer.Sign(event); err != nil {
+			return nil, err
+		}
+	}
+	return event, nil
+}
+
+// metadata returns the metadata of an event published with ctx, that of ctx
+// if any, see WithEventMetadata, along with the TTL of the events if set. The
+// sidecar records their expiration in the expiration CloudEvent attribute,
+// and drops them once expired.
+func (p *Publisher) metadata(ctx context.Context) map[string]string {
+	metadata := maps.Clone(eventMetadataFromContext(ctx))
+	if p.ttl > 0 {
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		metadata[metadataTTL] = strconv.Itoa(int(p.ttl / time.Second))
+	}
+	return metadata
+}
+
+// publishErrorClass returns the class of the error of a publish, a label of
+// bounded cardinality for alerts to tell the broker degrading from the app
+// refusing to publish: none on success, the sentinel errors of the app, or the
+// gRPC code of the errors of the sidecar.
+func publishErrorClass(err error) string {
+	switch {
+	case err == nil:
+		return "none"
+	case errors.Is(err, ErrTopicNotAllowed):
+		return "topic_not_allowed"
+	case errors.Is(err, ErrIncompatibleSchema):
+		return "incompatible_schema"
+	case errors.Is(err, ErrCircuitOpen):
+		return "circuit_open"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "deadline_exceeded"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	}
+	if s, ok := status.FromError(err); ok {
+		// ResourceExhausted is reported as resource_exhausted
+		var class strings.Builder
+		for i, r := range s.Code().String() {
+			if unicode.IsUpper(r) && i > 0 {
+				class.WriteByte('_')
+			}
+			class.WriteRune(unicode.ToLower(r))
+		}
+		return class.String()
+	}
+	return "unknown"
+}
+
+// newCloudEvent wraps data in a CloudEvent, encoded with encoder in
+// data_base64 when it is a protobuf message. The sidecar forwards CloudEvents
+// published as such unchanged, whereas the envelope it builds itself can't
+// carry extensions nor binary payloads. Order events carry the status of
+// their order in the orderstatus extension.
+func newCloudEvent(ctx context.Context, encoder EventEncoder, topic string, data any) (map[string]any, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	event := map[string]any{
+		"specversion": "1.0",
+		"id":          hex.EncodeToString(b),
+		"source":      "app",
+		"type":        "com.dapr.event.sent",
+		"topic":       topic,
+	}
+	if status, ok := eventOrderStatus(data); ok {
+		event[cloudEventStatusExtension] = status
+	}
+
+	msg, ok := data.(proto.Message)
+	if !ok {
+		if typed, ok := data.(TypedEvent); ok {
+			event["type"] = typed.CloudEventType()
+		}
+		event["datacontenttype"] = contentTypeJSON
+		event["data"] = data
+		return event, nil
+	}
+
+	encoded, err := encoder.Encode(ctx, topic, msg)
+	if err != nil {
+		return nil, err
+	}
+	event["type"] = encoded.Type
+	event["datacontenttype"] = encoded.ContentType
+	event["data_base64"] = base64.StdEncoding.EncodeToString(encoded.Data)
+	if encoded.DataSchema != "" {
+		event["dataschema"] = encoded.DataSchema
+	}
+	return event, nil
+}
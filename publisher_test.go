@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseTopicAllowlist(t *testing.T) {
+	allowlist, err := ParseTopicAllowlist(" orders.put = orders, audit ; other=orders;")
+	if err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+
+	if !allowlist.Allows("orders.put", "orders") || !allowlist.Allows("orders.put", "audit") || !allowlist.Allows("other", "orders") {
+		t.Fatalf("expected parsed allowlist to contain all entries. Got %v.", allowlist)
+	}
+	if allowlist.Allows("other", "audit") {
+		t.Fatalf("expected handler other not to be allowed to publish to audit. Got %v.", allowlist)
+	}
+
+	if _, err := ParseTopicAllowlist("orders"); err == nil {
+		t.Fatal("expected an error for an entry without topics")
+	}
+}
+
+func TestTopicAllowlistValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowlist TopicAllowlist
+		wantErr   bool
+	}{
+		{"default", defaultTopicAllowlist(), false},
+		{"empty", TopicAllowlist{}, false},
+		{"unknown topic", TopicAllowlist{handlerOrdersPut: {topicOrders, "order"}}, true},
+		{"unknown handler", TopicAllowlist{"orders.delete": {topicOrders}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.allowlist.Validate(knownHandlers, knownTopics)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error: %t. Got %v.", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestPublisherRejectsTopicNotInAllowlist(t *testing.T) {
+	client := &fakeDaprClient{}
+	config := &Config{TopicAllowlist: defaultTopicAllowlist(), PublishRetry: RetryPolicy{MaxAttempts: 1}}
+	metrics := NewMetrics()
+	publisher := NewPublisher(client, config, metrics)
+
+	err := publisher.Publish(context.Background(), handlerOrdersPut, "payments", Order{ID: "order-1234"})
+	if !errors.Is(err, ErrTopicNotAllowed) {
+		t.Fatalf("expected error %q. Got %v.", ErrTopicNotAllowed, err)
+	}
+	if len(client.published) != 0 {
+		t.Fatalf("expected no event to be published. Got %v.", client.published)
+	}
+
+	if err := publisher.Publish(context.Background(), handlerOrdersPut, topicOrders, Order{ID: "order-1234"}); err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+	if len(client.published) != 1 || client.published[0].pubsubName != pubsubName || client.published[0].topic != topicOrders {
+		t.Fatalf("expected one event published to %s/%s. Got %v.", pubsubName, topicOrders, client.published)
+	}
+	if got := testutil.ToFloat64(metrics.OrdersPublished.WithLabelValues(topicOrders)); got != 1 {
+		t.Fatalf("expected one published event to be counted. Got %v.", got)
+	}
+}
+
+func TestPublisherMetrics(t *testing.T) {
+	client := &fakeDaprClient{}
+	config := &Config{TopicAllowlist: defaultTopicAllowlist(), PublishRetry: RetryPolicy{MaxAttempts: 1}}
+	metrics := NewMetrics()
+	publisher := NewPublisher(client, config, metrics)
+	ctx := context.Background()
+
+	if err := publisher.Publish(ctx, handlerOrdersPut, topicOrders, Order{ID: "order-1234"}); err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+	client.publishErr = status.Error(codes.ResourceExhausted, "broker is full")
+	if err := publisher.Publish(ctx, handlerOrdersPut, topicOrders, Order{ID: "order-1234"}); err == nil {
+		t.Fatal("expected an error. Got none.")
+	}
+	if err := publisher.Publish(ctx, handlerOrdersPut, "payments", Order{ID: "order-1234"}); err == nil {
+		t.Fatal("expected an error. Got none.")
+	}
+
+	for _, labels := range [][]string{
+		{topicOrders, "success", "none"},
+		{topicOrders, "failure", "resource_exhausted"},
+		{"payments", "failure", "topic_not_allowed"},
+	} {
+		if got := testutil.ToFloat64(metrics.PublishOutcomes.WithLabelValues(labels...)); got != 1 {
+			t.Fatalf("expected one publish counted with %v. Got %v.", labels, got)
+		}
+	}
+	// only the publishes reaching the sidecar are timed
+	if got := testutil.CollectAndCount(metrics.PublishDuration); got != 1 {
+		t.Fatalf("expected the publishes of a single topic to be timed. Got %d topics.", got)
+	}
+}
+
+func TestPublishErrorClass(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{err: nil, expected: "none"},
+		{err: fmt.Errorf("%w: nope", ErrTopicNotAllowed), expected: "topic_not_allowed"},
+		{err: ErrCircuitOpen, expected: "circuit_open"},
+		{err: context.DeadlineExceeded, expected: "deadline_exceeded"},
+		{err: status.Error(codes.Unavailable, "sidecar is down"), expected: "unavailable"},
+		{err: errors.New("boom"), expected: "unknown"},
+	}
+	for _, tt := range tests {
+		if got := publishErrorClass(tt.err); got != tt.expected {
+			t.Fatalf("expected class %s for %v. Got %s.", tt.expected, tt.err, got)
+		}
+	}
+}
+
+func TestPublisherTenantCloudEvent(t *testing.T) {
+	client := &fakeDaprClient{}
+	config := &Config{TopicAllowlist: defaultTopicAllowlist(), PublishRetry: RetryPolicy{MaxAttempts: 1}}
+	publisher := NewPublisher(client, config, NewMetrics())
+
+	order := Order{ID: "order-1234", Status: OrderStatusPaid, Tenant: "acme"}
+	if err := publisher.Publish(WithTenant(context.Background(), "acme"), handlerOrdersPut, topicOrders, order); err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+
+	if len(client.published) != 1 || client.published[0].contentType != contentTypeCloudEvents {
+		t.Fatalf("expected one event published as %s. Got %v.", contentTypeCloudEvents, client.published)
+	}
+	event, ok := client.published[0].data.(map[string]any)
+	if !ok {
+		t.Fatalf("expected a CloudEvent envelope. Got %T.", client.published[0].data)
+	}
+	if event[cloudEventTenantExtension] != "acme" || !reflect.DeepEqual(event["data"], order) {
+		t.Fatalf("expected the envelope to carry tenant acme and the order. Got %v.", event)
+	}
+}
+
+func TestPublisherTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		expected map[string]string
+	}{
+		{name: "no ttl", ttl: 0},
+		{name: "ttl", ttl: time.Minute, expected: map[string]string{metadataTTL: "60"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeDaprClient{}
+			config := &Config{TopicAllowlist: defaultTopicAllowlist(), PublishRetry: RetryPolicy{MaxAttempts: 1}, Events: EventConfig{TTL: tt.ttl}}
+			publisher := NewPublisher(client, config, NewMetrics())
+
+			if err := publisher.Publish(context.Background(), handlerOrdersPut, topicOrders, Order{ID: "order-1234"}); err != nil {
+				t.Fatalf("expected no error. Got %s.", err)
+			}
+			if len(client.published) != 1 || !reflect.DeepEqual(client.published[0].metadata, tt.expected) {
+				t.Fatalf("expected one event published with metadata %v. Got %v.", tt.expected, client.published)
+			}
+		})
+	}
+}
+
+func TestPublisherEventKey(t *testing.T) {
+	client := &fakeDaprClient{}
+	config := &Config{TopicAllowlist: defaultTopicAllowlist(), PublishRetry: RetryPolicy{MaxAttempts: 1}}
+	publisher := NewPublisher(client, config, NewMetrics())
+
+	// the same change published twice is identified by its key both times,
+	// even when it wouldn't otherwise be wrapped in a CloudEvent
+	ctx := WithEventKey(context.Background(), "order-1234@1")
+	for i := 0; i < 2; i++ {
+		if err := publisher.Publish(ctx, handlerOrdersPut, topicOrders, Order{ID: "order-1234", Status: OrderStatusPaid}); err != nil {
+			t.Fatalf("expected no error. Got %s.", err)
+		}
+	}
+	if err := publisher.Publish(context.Background(), handlerOrdersPut, topicOrders, newOrderStatusChanged(Order{ID: "order-1234"}, "", time.Now())); err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+
+	var ids []any
+	for _, published := range client.published {
+		envelope, ok := published.data.(map[string]any)
+		if !ok {
+			t.Fatalf("expected a CloudEvent envelope. Got %T.", published.data)
+		}
+		ids = append(ids, envelope["id"])
+	}
+	if len(ids) != 3 || ids[0] != "order-1234@1" || ids[1] != "order-1234@1" || ids[2] == "order-1234@1" {
+		t.Fatalf("expected the keyed events to be identified by their key only. Got %v.", ids)
+	}
+}
+
+func TestPublisherProtobufCloudEvent(t *testing.T) {
+	client := &fakeDaprClient{}
+	config := &Config{TopicAllowlist: defaultTopicAllowlist(), PublishRetry: RetryPolicy{MaxAttempts: 1}}
+	publisher := NewPublisher(client, config, NewMetrics())
+
+	order := Order{ID: "order-1234", Status: OrderStatusPaid}
+	event := newOrderStatusChanged(order, OrderStatusPending, time.Now())
+	if err := publisher.Publish(context.Background(), handlerOrdersPut, topicOrders, event); err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+
+	if len(client.published) != 1 || client.published[0].contentType != contentTypeCloudEvents {
+		t.Fatalf("expected one event published as %s. Got %v.", contentTypeCloudEvents, client.published)
+	}
+	envelope := client.published[0].data.(map[string]any)
+	if envelope["datacontenttype"] != contentTypeProtobuf || envelope["type"] != "orders.v1.OrderStatusChanged" {
+		t.Fatalf("expected a protobuf orders.v1.OrderStatusChanged event. Got %v.", envelope)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(envelope["data_base64"].(string))
+	if err != nil {
+		t.Fatalf("couldn't decode data_base64: %s", err)
+	}
+	got, err := DecodeOrderStatusChanged(data)
+	if err != nil {
+		t.Fatalf("couldn't decode event: %s", err)
+	}
+	if !reflect.DeepEqual(got, order) {
+		t.Fatalf("expected order %v. Got %v.", order, got)
+	}
+}
+
+func TestPublisherTypedCloudEvent(t *testing.T) {
+	client := &fakeDaprClient{}
+	config := &Config{TopicAllowlist: defaultTopicAllowlist(), PublishRetry: RetryPolicy{MaxAttempts: 1}}
+	publisher := NewPublisher(client, config, NewMetrics())
+
+	event := OrderCancelled{Order: Order{ID: "order-1234", Status: OrderStatusCancelled}, PreviousStatus: OrderStatusPending}
+	if err := publisher.Publish(context.Background(), handlerOrdersCancel, topicOrders, event); err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+
+	if len(client.published) != 1 || client.published[0].contentType != contentTypeCloudEvents {
+		t.Fatalf("expected one event published as %s. Got %v.", contentTypeCloudEvents, client.published)
+	}
+	envelope := client.published[0].data.(map[string]any)
+	if envelope["type"] != cloudEventTypeOrderCancelled || envelope["datacontenttype"] != contentTypeJSON || !reflect.DeepEqual(envelope["data"], event) {
+		t.Fatalf("expected a JSON %s event. Got %v.", cloudEventTypeOrderCancelled, envelope)
+	}
+
+	// the payload decodes as the cancelled order
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatalf("couldn't encode envelope: %s", err)
+	}
+	order, err := decodeCloudEventOrder(bytes.NewReader(body))
+	if err != nil || !reflect.DeepEqual(order, event.Order) {
+		t.Fatalf("expected the event to decode as %v. Got %v (%v).", event.Order, order, err)
+	}
+}
+
+func TestPublisherStopsWhenContextIsCancelled(t *testing.T) {
+	config := &Config{TopicAllowlist: defaultTopicAllowlist(), PublishRetry: RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Second}}
+	publisher := NewPublisher(&blockingDaprClient{}, config, NewMetrics())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := publisher.Publish(ctx, handlerOrdersPut, topicOrders, Order{ID: "order-1234"})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected error %q. Got %v.", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("expected the publish to stop with its context. Took %s.", elapsed)
+	}
+}
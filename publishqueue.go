@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultPublishQueueSize       = 1000
+	defaultPublishQueueWorkers    = 4
+	defaultPublishQueueRetryAfter = time.Second
+)
+
+// ErrPublishQueueFull is returned when a publish is enqueued while the queue
+// is full.
+var ErrPublishQueueFull = errors.New("publish queue is full")
+
+// PublishQueueConfig configures the asynchronous publish of the order events.
+type PublishQueueConfig struct {
+	// Enabled publishes the events of the order updates from the queue,
+	// the updates being answered once stored.
+	Enabled bool
+	// Size is the number of publishes queued before the updates are
+	// rejected.
+	Size int
+	// Workers is the number of publishes run at once, those of an order
+	// being run one at a time, in the order they were queued.
+	Workers int
+	// Dir is the directory of the PublishSpool keeping the queued updates
+	// until their event is published, none if empty.
+	Dir string
+	// FlushInterval is the time between two flushes of the spool.
+	FlushInterval time.Duration
+	// RetryAfter is the time the clients are asked to wait before sending
+	// an update again while the queue is full.
+	RetryAfter time.Duration
+}
+
+// publishJob is a publish queued along with the context of the update it
+// was queued by.
+type publishJob struct {
+	ctx     context.Context
+	publish func(ctx context.Context)
+}
+
+// PublishQueue runs the publishes of the order events on a pool of workers,
+// from a bounded queue, so that the updates don't wait for the sidecar. Each
+// worker has a queue of its own, the publishes being routed by the hash of
+// their order, so that the events of an order are published in order.
+type PublishQueue struct {
+	// Spool keeps the updates queued until their event is published, if
+	// set, so that they are published again after a failure or a restart
+	// rather than reverted.
+	Spool *PublishSpool
+
+	config  PublishQueueConfig
+	metrics *Metrics
+	queues  []chan publishJob
+	// pending is the number of publishes queued across the queues of the
+	// workers, bounded by the size of the queue
+	pending atomic.Int64
+	wg      sync.WaitGroup
+
+	// mu guards closed, so that no publish is queued once the queue is
+	// closed
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewPublishQueue(config PublishQueueConfig, metrics *Metrics) *PublishQueue {
+	// each queue holds up to the size of the whole queue, which pending
+	// bounds, so that the publishes of a busy order don't fill their queue
+	// before the others
+	queues := make([]chan publishJob, max(config.Workers, 1))
+	for i := range queues {
+		queues[i] = make(chan publishJob, config.Size)
+	}
+	return &PublishQueue{
+		config:  config,
+		metrics: metrics,
+		queues:  queues,
+	}
+}
+
+// Start runs the workers, until the queue is closed and drained.
+func (q *PublishQueue) Start() {
+	for _, queue := range q.queues {
+		queue := queue
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for job := range queue {
+				q.pending.Add(-1)
+				q.metrics.PublishQueueDepth.Dec()
+				job.publish(job.ctx)
+			}
+		}()
+	}
+}
+
+// Full reports whether the queue is full, never for a nil queue.
+func (q *PublishQueue) Full() bool {
+	return q != nil && q.pending.Load() >= int64(q.config.Size)
+}
+
+// Enqueue queues publish, run with the values of ctx once the worker of key,
+// the ID of the order published, is free, even if ctx is cancelled
+// meanwhile. The publishes of a key run in the order they were queued. It
+// never blocks: it returns ErrPublishQueueFull if the queue is full or
+// closed.
+func (q *PublishQueue) Enqueue(ctx context.Context, key string, publish func(ctx context.Context)) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		q.metrics.PublishQueueJobs.WithLabelValues("rejected").Inc()
+		return ErrPublishQueueFull
+	}
+	if q.pending.Add(1) > int64(q.config.Size) {
+		q.pending.Add(-1)
+		q.metrics.PublishQueueJobs.WithLabelValues("rejected").Inc()
+		slog.WarnContext(ctx, "publish queue is full", "size", q.config.Size)
+		return ErrPublishQueueFull
+	}
+
+	// the depth is raised first, so that a worker never lowers it below
+	// zero, and the send never blocks, the queue of the worker holding as
+	// many publishes as the whole queue
+	q.metrics.PublishQueueDepth.Inc()
+	q.queues[q.worker(key)] <- publishJob{ctx: context.WithoutCancel(ctx), publish: publish}
+	q.metrics.PublishQueueJobs.WithLabelValues("queued").Inc()
+	return nil
+}
+
+// worker returns the index of the worker running the publishes of key.
+func (q *PublishQueue) worker(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(q.queues)))
+}
+
+// Close stops queueing publishes, and Wait blocks until those queued before
+// ran, so that the stored updates aren't left unpublished on shutdown.
+func (q *PublishQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		for _, queue := range q.queues {
+			close(queue)
+		}
+	}
+}
+
+func (q *PublishQueue) Wait() {
+	q.wg.Wait()
+}
+
+// queueUpdate queues the publish of the status change of update, spooling it
+// first if the queue has a spool, and answers it as accepted. An update
+// which can't be queued is reverted.
+func (h *AppHandler) queueUpdate(ctx context.Context, update *queuedUpdate) updateResult {
+	spool := h.publishQueue.Spool
+	if spool != nil {
+		if err := spool.Put(update); err != nil {
+			slog.ErrorContext(ctx, "couldn't spool update", "order", update.Order.ID, "error", err)
+			h.revertUpdate(ctx, update)
+			return updateResult{Code: http.StatusServiceUnavailable, Message: "Service unavailable"}
+		}
+	}
+	err := h.publishQueue.Enqueue(ctx, update.Order.ID, func(ctx context.Context) {
+		h.runQueuedUpdate(ctx, update)
+	})
+	if err != nil {
+		if spool != nil {
+			if err := spool.Done(update.ID); err != nil {
+				slog.ErrorContext(ctx, "couldn't remove spooled update", "order", update.Order.ID, "error", err)
+			}
+		}
+		h.revertUpdate(ctx, update)
+		return h.throttledResult()
+	}
+	return updateResult{Code: http.StatusAccepted, Message: "Order accepted"}
+}
+
+// throttledResult rejects an update while the publish queue is full, rather
+// than queueing it without bound.
+func (h *AppHandler) throttledResult() updateResult {
+	h.metrics.PublishQueueThrottled.Inc()
+	return updateResult{Code: http.StatusTooManyRequests, Message: "Too many requests: publish queue is full", RetryAfter: h.publishQueue.config.RetryAfter}
+}
+
+// backpressured rejects the requests of next with a 429 while the publish
+// queue is full, before they change anything. The updates queued meanwhile
+// may still find it full, and are rejected the same way.
+func (h *AppHandler) backpressured(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.publishQueue.Full() {
+			h.writeUpdateResult(w, h.throttledResult())
+			return
+		}
+		next(w, r)
+	}
+}
+
+// retryAfterHeader formats d as the value of a Retry-After header, in whole
+// seconds, at least 1.
+func retryAfterHeader(d time.Duration) string {
+	return strconv.Itoa(max(int(math.Ceil(d.Seconds())), 1))
+}
+
+// runQueuedUpdate publishes the status change of update from the queue. An
+// update whose event couldn't be published is kept in the spool if any, to
+// be published by a later flush, or reverted otherwise, as it would have
+// been before being answered.
+func (h *AppHandler) runQueuedUpdate(ctx context.Context, update *queuedUpdate) {
+	spool := h.publishQueue.Spool
+	err := h.publishUpdate(ctx, update)
+	if err != nil && spool != nil && !permanentPublishError(err) {
+		slog.WarnContext(ctx, "keeping update spooled until its event is published", "order", update.Order.ID)
+		spool.Release(update.ID)
+		return
+	}
+	if err != nil {
+		h.revertUpdate(ctx, update)
+	}
+	if spool != nil {
+		if err := spool.Done(update.ID); err != nil {
+			slog.ErrorContext(ctx, "couldn't remove spooled update", "order", update.Order.ID, "error", err)
+		}
+	}
+}
+
+// FlushPublishSpool queues the updates of the spool every interval until ctx
+// is done, starting with those spooled before the app restarted, so that
+// their events are published once the sidecar is back.
+func (h *AppHandler) FlushPublishSpool(ctx context.Context, interval time.Duration) {
+	spool := h.publishQueue.Spool
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		updates, err := spool.Flush()
+		if err != nil {
+			slog.WarnContext(ctx, "couldn't flush publish spool", "error", err)
+		}
+		for _, update := range updates {
+			update := update
+			// the updates are published on behalf of their tenant
+			err := h.publishQueue.Enqueue(WithTenant(ctx, update.Order.Tenant), update.Order.ID, func(ctx context.Context) {
+				h.runQueuedUpdate(ctx, update)
+			})
+			if err != nil {
+				spool.Release(update.ID)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
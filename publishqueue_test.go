@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPublishQueue(t *testing.T) {
+	metrics := NewMetrics()
+	queue := NewPublishQueue(PublishQueueConfig{Enabled: true, Size: 1, Workers: 1}, metrics)
+	queue.Start()
+
+	// the worker is held by the first publish, the second one waits in the
+	// queue, which is then full
+	started, release := make(chan struct{}), make(chan struct{})
+	var published atomic.Int32
+	if err := queue.Enqueue(context.Background(), "order-1234", func(ctx context.Context) {
+		close(started)
+		<-release
+		published.Add(1)
+	}); err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := queue.Enqueue(ctx, "order-1234", func(ctx context.Context) {
+		// the publish outlives the request it was queued by
+		if ctx.Err() == nil {
+			published.Add(1)
+		}
+	}); err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+	cancel()
+	if err := queue.Enqueue(context.Background(), "order-1234", func(ctx context.Context) {}); !errors.Is(err, ErrPublishQueueFull) {
+		t.Fatalf("expected ErrPublishQueueFull. Got %v.", err)
+	}
+	if got := testutil.ToFloat64(metrics.PublishQueueDepth); got != 1 {
+		t.Fatalf("expected a depth of 1. Got %f.", got)
+	}
+
+	// the queued publishes run before the workers stop
+	close(release)
+	queue.Close()
+	queue.Wait()
+	if got := published.Load(); got != 2 {
+		t.Fatalf("expected 2 publishes. Got %d.", got)
+	}
+	if got := testutil.ToFloat64(metrics.PublishQueueDepth); got != 0 {
+		t.Fatalf("expected an empty queue. Got %f.", got)
+	}
+	if err := queue.Enqueue(context.Background(), "order-1234", func(ctx context.Context) {}); !errors.Is(err, ErrPublishQueueFull) {
+		t.Fatalf("expected ErrPublishQueueFull once closed. Got %v.", err)
+	}
+	if got := testutil.ToFloat64(metrics.PublishQueueJobs.WithLabelValues("rejected")); got != 2 {
+		t.Fatalf("expected 2 rejected publishes. Got %f.", got)
+	}
+}
+
+func TestPublishQueueOrdersPublishes(t *testing.T) {
+	metrics := NewMetrics()
+	queue := NewPublishQueue(PublishQueueConfig{Enabled: true, Size: 100, Workers: 4}, metrics)
+
+	// the publishes of each order are queued before the workers start, so
+	// that the workers would run them at once if they weren't routed by
+	// order
+	var mu sync.Mutex
+	published := map[string][]int{}
+	orders := []string{"order-1111", "order-2222", "order-3333"}
+	for i := 0; i < 20; i++ {
+		for _, id := range orders {
+			i, id := i, id
+			if err := queue.Enqueue(context.Background(), id, func(ctx context.Context) {
+				// later publishes would overtake the earlier ones of
+				// another worker
+				time.Sleep(time.Duration(20-i) * 100 * time.Microsecond)
+				mu.Lock()
+				defer mu.Unlock()
+				published[id] = append(published[id], i)
+			}); err != nil {
+				t.Fatalf("expected no error. Got %s.", err)
+			}
+		}
+	}
+	queue.Start()
+	queue.Close()
+	queue.Wait()
+
+	for _, id := range orders {
+		if len(published[id]) != 20 || !slices.IsSorted(published[id]) {
+			t.Fatalf("expected the publishes of %s in the order queued. Got %v.", id, published[id])
+		}
+	}
+}
+
+func TestPublishQueueSizeAcrossWorkers(t *testing.T) {
+	queue := NewPublishQueue(PublishQueueConfig{Enabled: true, Size: 2, Workers: 4}, NewMetrics())
+
+	// the size bounds the publishes queued for all the workers
+	for _, id := range []string{"order-1111", "order-2222"} {
+		if err := queue.Enqueue(context.Background(), id, func(ctx context.Context) {}); err != nil {
+			t.Fatalf("expected no error. Got %s.", err)
+		}
+	}
+	if !queue.Full() {
+		t.Fatal("expected the queue full.")
+	}
+	if err := queue.Enqueue(context.Background(), "order-3333", func(ctx context.Context) {}); !errors.Is(err, ErrPublishQueueFull) {
+		t.Fatalf("expected ErrPublishQueueFull. Got %v.", err)
+	}
+
+	queue.Start()
+	queue.Close()
+	queue.Wait()
+	if queue.Full() {
+		t.Fatal("expected the queue drained.")
+	}
+}
+
+func TestOrdersPutAsync(t *testing.T) {
+	tests := []struct {
+		name       string
+		publishErr error
+		// full fills the queue before the update
+		full bool
+		// expected is the status code of the answer, and stored whether the
+		// order is stored once the queue is drained
+		expected int
+		stored   bool
+	}{
+		{name: "published", expected: http.StatusAccepted, stored: true},
+		{name: "publish fails", publishErr: errors.New("unavailable"), expected: http.StatusAccepted},
+		{name: "queue full", full: true, expected: http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := &mockPublisher{err: tt.publishErr}
+			store := newMockOrderRepository()
+			h := newMockHandler(publisher, store)
+			h.publishQueue = NewPublishQueue(PublishQueueConfig{Enabled: true, Size: 1, Workers: 1}, h.metrics)
+			if tt.full {
+				if err := h.publishQueue.Enqueue(context.Background(), "order-1234", func(ctx context.Context) {}); err != nil {
+					t.Fatalf("couldn't fill queue: %s", err)
+				}
+			}
+			h.RegisterRoutes()
+
+			req := httptest.NewRequest(http.MethodPut, "/orders/order-1234", strings.NewReader(`{"status":"PENDING"}`))
+			req.Header.Set("Content-Type", contentTypeJSON)
+			rec := httptest.NewRecorder()
+			h.router.ServeHTTP(rec, req)
+			if rec.Code != tt.expected {
+				t.Fatalf("expected status code %d. Got %d: %s", tt.expected, rec.Code, rec.Body)
+			}
+
+			h.publishQueue.Start()
+			h.publishQueue.Close()
+			h.publishQueue.Wait()
+			_, _, err := store.Get(context.Background(), "order-1234")
+			if stored := err == nil; stored != tt.stored {
+				t.Fatalf("expected the order stored: %t. Got %v.", tt.stored, err)
+			}
+			if tt.stored && len(publisher.events) != 1 {
+				t.Fatalf("expected the event published. Got %v.", publisher.events)
+			}
+		})
+	}
+}
+
+func TestPublishBackpressure(t *testing.T) {
+	publisher := &mockPublisher{}
+	store := newMockOrderRepository()
+	h := newMockHandler(publisher, store)
+	// the workers are started once the queue is saturated
+	h.publishQueue = NewPublishQueue(PublishQueueConfig{Enabled: true, Size: 2, Workers: 1, RetryAfter: 1500 * time.Millisecond}, h.metrics)
+	h.RegisterRoutes()
+
+	put := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentTypeJSON)
+		rec := httptest.NewRecorder()
+		h.router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// the batch fills the queue, its last update being rejected
+	rec := put("/orders", `[{"id":"order-1111","status":"PENDING"},{"id":"order-2222","status":"PENDING"},{"id":"order-3333","status":"PENDING"}]`)
+	var results []BatchResult
+	if err := json.NewDecoder(rec.Body).Decode(&results); err != nil {
+		t.Fatalf("couldn't decode results: %s", err)
+	}
+	var statuses []int
+	for _, result := range results {
+		statuses = append(statuses, result.Status)
+	}
+	if expected := []int{http.StatusAccepted, http.StatusAccepted, http.StatusTooManyRequests}; !reflect.DeepEqual(statuses, expected) {
+		t.Fatalf("expected statuses %v. Got %v.", expected, statuses)
+	}
+
+	// the updates are rejected before they change anything
+	rec = put("/orders/order-4444", `{"status":"PENDING"}`)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "2" {
+		t.Fatalf("expected status code %d with Retry-After 2. Got %d with %q.", http.StatusTooManyRequests, rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if got := testutil.ToFloat64(h.metrics.PublishQueueThrottled); got != 2 {
+		t.Fatalf("expected 2 throttled updates. Got %f.", got)
+	}
+
+	// once drained, the queue accepts the updates again
+	h.publishQueue.Start()
+	deadline := time.Now().Add(time.Second)
+	for h.publishQueue.Full() || testutil.ToFloat64(h.metrics.PublishQueueDepth) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the queue drained.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rec := put("/orders/order-4444", `{"status":"PENDING"}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status code %d. Got %d: %s", http.StatusAccepted, rec.Code, rec.Body)
+	}
+	h.publishQueue.Close()
+	h.publishQueue.Wait()
+	for id, expected := range map[string]bool{"order-1111": true, "order-2222": true, "order-3333": false, "order-4444": true} {
+		if _, _, err := store.Get(context.Background(), id); (err == nil) != expected {
+			t.Fatalf("expected %s stored: %t. Got %v.", id, expected, err)
+		}
+	}
+	if len(publisher.events) != 3 {
+		t.Fatalf("expected the 3 accepted updates published. Got %v.", publisher.events)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	quarantineStoreName = "event-quarantine"
+	quarantineIndexKey  = "quarantine"
+)
+
+// ErrQuarantinedEventNotFound is returned when no event is quarantined under
+// an ID.
+var ErrQuarantinedEventNotFound = errors.New("quarantined event not found")
+
+// QuarantinedEvent is an event the app failed to process for good, kept for
+// operators to look into rather than dropped.
+type QuarantinedEvent struct {
+	// ID is the ID of the CloudEvent, or a random one if it couldn't be read.
+	ID string `json:"id"`
+	// Route is the route the event was delivered to.
+	Route string `json:"route"`
+	// Payload is the event as delivered.
+	Payload []byte `json:"payload"`
+	Error   string `json:"error"`
+	// Attempts is the number of deliveries of the event which failed for
+	// good, the event being delivered again when published again.
+	Attempts int `json:"attempts"`
+	// Replays is the number of times operators replayed the event.
+	Replays       int       `json:"replays"`
+	QuarantinedAt time.Time `json:"quarantinedAt"`
+}
+
+func quarantineKey(id string) string {
+	return "quarantined-" + id
+}
+
+// newQuarantinedEvent returns the quarantined event of payload, delivered to
+// route and failed with err.
+func newQuarantinedEvent(route string, payload []byte, err error) (QuarantinedEvent, error) {
+	var envelope struct {
+		ID string `json:"id"`
+	}
+	if json.Unmarshal(payload, &envelope) != nil || envelope.ID == "" {
+		id, err := newWebhookID()
+		if err != nil {
+			return QuarantinedEvent{}, err
+		}
+		envelope.ID = id
+	}
+	return QuarantinedEvent{ID: envelope.ID, Route: route, Payload: payload, Error: err.Error()}, nil
+}
+
+// QuarantineStore keeps the quarantined events in the Dapr state store. Each
+// event is stored under its own key, and an index key lists the quarantined
+// IDs, both being written in a single transaction conditioned on their
+// ETags. The quarantine is shared by the tenants.
+type QuarantineStore struct {
+	client    dapr.Client
+	storeName string
+}
+
+func NewQuarantineStore(client dapr.Client) *QuarantineStore {
+	return &QuarantineStore{
+		client:    client,
+		storeName: quarantineStoreName,
+	}
+}
+
+// Add quarantines event, counting one more attempt if it was quarantined
+// already, such as after a replay, retrying when the quarantine changed in
+// the meantime.
+func (s *QuarantineStore) Add(ctx context.Context, event QuarantinedEvent) error {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: 10 * time.Millisecond, MaxDelay: 100 * time.Millisecond}
+	return policy.Do(ctx, func(ctx context.Context) error {
+		ids, indexETag, err := s.index(ctx)
+		if err != nil {
+			return Permanent(err)
+		}
+		existing, etag, err := s.get(ctx, event.ID)
+		if err != nil && !errors.Is(err, ErrQuarantinedEventNotFound) {
+			return Permanent(err)
+		}
+
+		event.Attempts = existing.Attempts + 1
+		event.Replays = existing.Replays
+		event.QuarantinedAt = time.Now().UTC()
+		data, err := json.Marshal(event)
+		if err != nil {
+			return Permanent(err)
+		}
+		ops := []*dapr.StateOperation{upsertOperation(quarantineKey(event.ID), data, etag)}
+		if !slices.Contains(ids, event.ID) {
+			index, err := json.Marshal(append(ids, event.ID))
+			if err != nil {
+				return Permanent(err)
+			}
+			ops = append(ops, upsertOperation(quarantineIndexKey, index, indexETag))
+		}
+		return s.execute(ctx, ops)
+	}, nil)
+}
+
+// Get returns the event quarantined under id.
+func (s *QuarantineStore) Get(ctx context.Context, id string) (QuarantinedEvent, error) {
+	event, _, err := s.get(ctx, id)
+	return event, err
+}
+
+func (s *QuarantineStore) get(ctx context.Context, id string) (QuarantinedEvent, string, error) {
+	item, err := s.client.GetState(ctx, s.storeName, quarantineKey(id), nil)
+	if err != nil {
+		return QuarantinedEvent{}, "", err
+	}
+	if item == nil || len(item.Value) == 0 {
+		return QuarantinedEvent{}, "", ErrQuarantinedEventNotFound
+	}
+	var event QuarantinedEvent
+	if err := json.Unmarshal(item.Value, &event); err != nil {
+		return QuarantinedEvent{}, "", fmt.Errorf("couldn't decode quarantined event %s: %w", id, err)
+	}
+	return event, item.Etag, nil
+}
+
+// CountReplay counts one more replay of the event quarantined under id and
+// returns the event, retrying when it changed in the meantime.
+func (s *QuarantineStore) CountReplay(ctx context.Context, id string) (QuarantinedEvent, error) {
+	var event QuarantinedEvent
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: 10 * time.Millisecond, MaxDelay: 100 * time.Millisecond}
+	err := policy.Do(ctx, func(ctx context.Context) error {
+		var (
+			etag string
+			err  error
+		)
+		event, etag, err = s.get(ctx, id)
+		if err != nil {
+			return Permanent(err)
+		}
+
+		event.Replays++
+		data, err := json.Marshal(event)
+		if err != nil {
+			return Permanent(err)
+		}
+		return s.execute(ctx, []*dapr.StateOperation{upsertOperation(quarantineKey(id), data, etag)})
+	}, nil)
+	return event, err
+}
+
+// List returns the quarantined events, in the order they were first
+// quarantined.
+func (s *QuarantineStore) List(ctx context.Context) ([]QuarantinedEvent, error) {
+	ids, _, err := s.index(ctx)
+	if err != nil {
+		return nil, err
+	}
+	events := []QuarantinedEvent{}
+	if len(ids) == 0 {
+		return events, nil
+	}
+
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, quarantineKey(id))
+	}
+	items, err := s.client.GetBulkState(ctx, s.storeName, keys, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if item.Error != "" {
+			return nil, fmt.Errorf("couldn't get quarantined event %s: %s", item.Key, item.Error)
+		}
+		// the event may be deleted between the index and its read
+		if len(item.Value) == 0 {
+			continue
+		}
+		var event QuarantinedEvent
+		if err := json.Unmarshal(item.Value, &event); err != nil {
+			return nil, fmt.Errorf("couldn't decode quarantined event %s: %w", item.Key, err)
+		}
+		events = append(events, event)
+	}
+	// bulk reads answer in any order
+	slices.SortFunc(events, func(a, b QuarantinedEvent) int {
+		return slices.Index(ids, a.ID) - slices.Index(ids, b.ID)
+	})
+	return events, nil
+}
+
+// Delete releases the events quarantined under ids, every quarantined event
+// if ids is empty, and returns the number of events released.
+func (s *QuarantineStore) Delete(ctx context.Context, ids ...string) (int, error) {
+	released := 0
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: 10 * time.Millisecond, MaxDelay: 100 * time.Millisecond}
+	err := policy.Do(ctx, func(ctx context.Context) error {
+		quarantined, etag, err := s.index(ctx)
+		if err != nil {
+			return Permanent(err)
+		}
+		if len(ids) == 0 {
+			ids = quarantined
+		}
+
+		var ops []*dapr.StateOperation
+		remaining := slices.DeleteFunc(slices.Clone(quarantined), func(id string) bool {
+			if !slices.Contains(ids, id) {
+				return false
+			}
+			ops = append(ops, &dapr.StateOperation{Type: dapr.StateOperationTypeDelete, Item: &dapr.SetStateItem{Key: quarantineKey(id)}})
+			return true
+		})
+		if len(ops) == 0 {
+			released = 0
+			return nil
+		}
+		index, err := json.Marshal(remaining)
+		if err != nil {
+			return Permanent(err)
+		}
+		ops = append(ops, upsertOperation(quarantineIndexKey, index, etag))
+		released = len(ops) - 1
+		return s.execute(ctx, ops)
+	}, nil)
+	return released, err
+}
+
+func (s *QuarantineStore) index(ctx context.Context) ([]string, string, error) {
+	item, err := s.client.GetState(ctx, s.storeName, quarantineIndexKey, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	ids := []string{}
+	if item == nil {
+		return ids, "", nil
+	}
+	if len(item.Value) > 0 {
+		if err := json.Unmarshal(item.Value, &ids); err != nil {
+			return nil, "", fmt.Errorf("couldn't decode quarantine index: %w", err)
+		}
+	}
+	return ids, item.Etag, nil
+}
+
+// execute runs ops in a transaction, only a concurrent change of the
+// quarantine being worth retrying.
+func (s *QuarantineStore) execute(ctx context.Context, ops []*dapr.StateOperation) error {
+	err := s.client.ExecuteStateTransaction(ctx, s.storeName, nil, ops)
+	if code := status.Code(err); err != nil && code != codes.Aborted && code != codes.InvalidArgument {
+		return Permanent(err)
+	}
+	return err
+}
+
+// quarantine quarantines payload, delivered to route and failed for good with
+// processErr, and returns the status answered to the sidecar: the event is
+// dropped once quarantined, and retried if it couldn't be.
+func (h *AppHandler) quarantine(ctx context.Context, route string, payload []byte, processErr error) string {
+	event, err := newQuarantinedEvent(route, payload, processErr)
+	if err == nil {
+		err = h.quarantined.Add(ctx, event)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't quarantine event", "route", route, "error", err)
+		return eventStatusRetry
+	}
+	slog.WarnContext(ctx, "quarantined event", "id", event.ID, "route", route, "error", processErr)
+	return eventStatusDrop
+}
+
+func (h *AppHandler) handleQuarantineList(w http.ResponseWriter, r *http.Request) {
+	events, err := h.quarantined.List(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "couldn't list quarantined events", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Service unavailable")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		slog.ErrorContext(r.Context(), "couldn't encode quarantined events", "error", err)
+	}
+}
+
+func (h *AppHandler) handleQuarantineGet(w http.ResponseWriter, r *http.Request) {
+	event, err := h.quarantined.Get(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, ErrQuarantinedEventNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Quarantined event not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "couldn't get quarantined event", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Service unavailable")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(event); err != nil {
+		slog.ErrorContext(r.Context(), "couldn't encode quarantined event", "error", err)
+	}
+}
+
+// handleQuarantineDelete releases the event of the path, or every quarantined
+// event without one.
+func (h *AppHandler) handleQuarantineDelete(w http.ResponseWriter, r *http.Request) {
+	var ids []string
+	if id, ok := mux.Vars(r)["id"]; ok {
+		ids = append(ids, id)
+	}
+	released, err := h.quarantined.Delete(r.Context(), ids...)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "couldn't release quarantined events", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Service unavailable")
+		return
+	}
+	if released == 0 && len(ids) > 0 {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Quarantined event not found")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "released quarantined events", "count", released)
+	w.WriteHeader(http.StatusNoContent)
+}
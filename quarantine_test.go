@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQuarantineStore(t *testing.T) {
+	ctx := context.Background()
+	quarantined := NewQuarantineStore(&fakeDaprClient{})
+
+	for _, event := range []QuarantinedEvent{
+		{ID: "event-1", Route: routeOrderEvents, Payload: []byte(`{"id":"event-1"}`), Error: "invalid"},
+		{ID: "event-2", Route: routePaidOrderEvents, Payload: []byte(`{"id":"event-2"}`), Error: "invalid"},
+		// the first event is delivered again
+		{ID: "event-1", Route: routeOrderEvents, Payload: []byte(`{"id":"event-1"}`), Error: "still invalid"},
+	} {
+		if err := quarantined.Add(ctx, event); err != nil {
+			t.Fatalf("couldn't quarantine event: %s", err)
+		}
+	}
+
+	events, err := quarantined.List(ctx)
+	if err != nil {
+		t.Fatalf("couldn't list quarantined events: %s", err)
+	}
+	if len(events) != 2 || events[0].ID != "event-1" || events[1].ID != "event-2" {
+		t.Fatalf("expected events event-1 and event-2. Got %+v.", events)
+	}
+	if events[0].Attempts != 2 || events[0].Error != "still invalid" || events[1].Attempts != 1 {
+		t.Fatalf("expected event-1 to be quarantined twice and event-2 once. Got %+v.", events)
+	}
+
+	if released, err := quarantined.Delete(ctx, "event-1"); err != nil || released != 1 {
+		t.Fatalf("expected 1 event released. Got %d: %v", released, err)
+	}
+	if _, err := quarantined.Get(ctx, "event-1"); !errors.Is(err, ErrQuarantinedEventNotFound) {
+		t.Fatalf("expected error %q. Got %v.", ErrQuarantinedEventNotFound, err)
+	}
+	if released, err := quarantined.Delete(ctx, "event-1"); err != nil || released != 0 {
+		t.Fatalf("expected no event released. Got %d: %v", released, err)
+	}
+
+	// releasing no event in particular releases them all
+	if released, err := quarantined.Delete(ctx); err != nil || released != 1 {
+		t.Fatalf("expected 1 event released. Got %d: %v", released, err)
+	}
+	if events, err := quarantined.List(ctx); err != nil || len(events) != 0 {
+		t.Fatalf("expected no quarantined event. Got %+v: %v", events, err)
+	}
+}
+
+func TestOrderEventQuarantine(t *testing.T) {
+	errUnavailable := errors.New("unavailable")
+	tests := []struct {
+		name     string
+		body     string
+		stateErr error
+		// expected is the status answered to the sidecar, and quarantined
+		// whether the event is quarantined
+		expected    string
+		quarantined bool
+	}{
+		{name: "valid event", body: `{"id":"event-1","data":{"id":"order-1234","status":"PAID"}}`, expected: eventStatusSuccess},
+		{name: "malformed event", body: `{"id":"event-1","data":"PAID"}`, expected: eventStatusDrop, quarantined: true},
+		{name: "malformed envelope", body: `{"data":`, expected: eventStatusDrop, quarantined: true},
+		{name: "expired event", body: `{"id":"event-1","expiration":"2000-01-01T00:00:00Z","data":{"id":"order-1234","status":"PAID"}}`, expected: eventStatusDrop},
+		// the event is redelivered until it is quarantined
+		{name: "unavailable quarantine", body: `{"id":"event-1","data":"PAID"}`, stateErr: errUnavailable, expected: eventStatusRetry},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeDaprClient{stateErr: tt.stateErr}
+			h := NewAppHandler(&Config{}, NewMetrics(), nil, nil)
+			h.quarantined = NewQuarantineStore(client)
+			h.RegisterRoutes()
+
+			req := httptest.NewRequest(http.MethodPost, routeOrderEvents, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", contentTypeCloudEvents)
+			rec := httptest.NewRecorder()
+			h.router.ServeHTTP(rec, req)
+
+			var answer struct {
+				Status string `json:"status"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&answer); err != nil || answer.Status != tt.expected {
+				t.Fatalf("expected status %s. Got %+v: %v", tt.expected, answer, err)
+			}
+
+			client.stateErr = nil
+			events, err := h.quarantined.List(context.Background())
+			if err != nil {
+				t.Fatalf("couldn't list quarantined events: %s", err)
+			}
+			if !tt.quarantined {
+				if len(events) != 0 {
+					t.Fatalf("expected no quarantined event. Got %+v.", events)
+				}
+				return
+			}
+			if len(events) != 1 || string(events[0].Payload) != tt.body || events[0].Route != routeOrderEvents || events[0].Error == "" {
+				t.Fatalf("expected the event to be quarantined with its error. Got %+v.", events)
+			}
+		})
+	}
+}
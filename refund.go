@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"github.com/dapr/go-sdk/workflow"
+	"github.com/gorilla/mux"
+	"github.com/microsoft/durabletask-go/api"
+	"github.com/microsoft/durabletask-go/backend"
+	durabletask "github.com/microsoft/durabletask-go/client"
+)
+
+// handleOrdersRefund refunds the order, if it is paid, and publishes an
+// OrderRefunded event. The refund is based on the version If-Match if set.
+func (h *AppHandler) handleOrdersRefund(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["id"]
+	h.writeUpdateResult(w, h.refundOrder(r.Context(), orderID, r.Header.Get("If-Match")))
+}
+
+// refundOrder runs the refund saga of the order orderID: the order is
+// validated and claimed as refunded, its charge is reversed by the payments
+// app, and the refund is notified. Claiming the order first keeps concurrent
+// refunds from reversing the charge twice. The claim is compensated, the
+// order being paid again, if the charge couldn't be reversed, whereas a
+// reversed charge stands even if the refund couldn't be notified.
+//
+// The saga runs as a Dapr workflow if h.refunds is set, and within the
+// request otherwise.
+func (h *AppHandler) refundOrder(ctx context.Context, orderID, ifMatch string) updateResult {
+	saga := refundSaga{
+		OrderID:       orderID,
+		IfMatch:       ifMatch,
+		Tenant:        TenantFromContext(ctx),
+		CorrelationID: CorrelationIDFromContext(ctx),
+	}
+	if h.refunds == nil {
+		saga, _ = h.refundSteps(ctx).run(saga)
+		return *saga.Result
+	}
+
+	res, err := h.refunds.Refund(ctx, saga)
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't run refund workflow", "order", orderID, "error", err)
+		return updateResult{Code: http.StatusServiceUnavailable, Message: "Service unavailable"}
+	}
+	return res
+}
+
+// refundSaga is the state of the refund of an order, passed from a step of
+// the saga to the next. It is the input and the output of the activities of
+// the refund workflow, recorded in its history.
+type refundSaga struct {
+	OrderID string `json:"orderId"`
+	IfMatch string `json:"ifMatch,omitempty"`
+	// Tenant and CorrelationID are those of the request, which the steps run
+	// by the workflow don't share the context of.
+	Tenant        string `json:"tenant,omitempty"`
+	CorrelationID string `json:"correlationId,omitempty"`
+	// Paid and Refunded are the order before and after it was claimed, from
+	// the version ETag.
+	Paid     Order  `json:"paid"`
+	Refunded Order  `json:"refunded"`
+	ETag     string `json:"etag,omitempty"`
+	// Result is the answer to the refund, once it is settled.
+	Result *updateResult `json:"result,omitempty"`
+}
+
+// context returns ctx with the tenant and the correlation ID of the request
+// of the saga.
+func (s refundSaga) context(ctx context.Context) context.Context {
+	return WithCorrelationID(WithTenant(ctx, s.Tenant), s.CorrelationID)
+}
+
+// refundSteps are the steps of the refund saga.
+type refundSteps struct {
+	claim, reverseCharge, compensate, notify func(saga refundSaga) (refundSaga, error)
+}
+
+// run runs the steps of the refund saga, until one of them settles its
+// result, compensating the claim of the order if its charge couldn't be
+// reversed.
+func (s refundSteps) run(saga refundSaga) (refundSaga, error) {
+	saga, err := s.claim(saga)
+	if err != nil || saga.Result != nil {
+		return saga, err
+	}
+	if saga, err = s.reverseCharge(saga); err != nil {
+		return saga, err
+	}
+	if saga.Result != nil {
+		_, err := s.compensate(saga)
+		return saga, err
+	}
+	return s.notify(saga)
+}
+
+// refundSteps returns the steps of the refund saga run within the request,
+// with ctx.
+func (h *AppHandler) refundSteps(ctx context.Context) refundSteps {
+	step := func(run func(ctx context.Context, saga refundSaga) refundSaga) func(refundSaga) (refundSaga, error) {
+		return func(saga refundSaga) (refundSaga, error) {
+			return run(ctx, saga), nil
+		}
+	}
+	return refundSteps{
+		claim:         step(h.claimRefund),
+		reverseCharge: step(h.reverseCharge),
+		compensate:    step(h.compensateRefund),
+		notify:        step(h.notifyRefund),
+	}
+}
+
+// claimRefund validates the order of saga and claims it as refunded.
+func (h *AppHandler) claimRefund(ctx context.Context, saga refundSaga) refundSaga {
+	paid, refunded, etag, res, ok := h.claimStatus(ctx, saga.OrderID, saga.IfMatch, OrderStatusRefunded)
+	if !ok {
+		saga.Result = &res
+		return saga
+	}
+	saga.Paid, saga.Refunded, saga.ETag = paid, refunded, etag
+	return saga
+}
+
+// reverseCharge has the payments app reverse the charge of the order of saga,
+// settling the result if it couldn't.
+func (h *AppHandler) reverseCharge(ctx context.Context, saga refundSaga) refundSaga {
+	if h.payments == nil {
+		return saga
+	}
+	err := h.payments.Refund(ctx, saga.Refunded)
+	var declined *PaymentDeclinedError
+	switch {
+	case errors.As(err, &declined):
+		slog.InfoContext(ctx, "refund declined", "order", saga.OrderID, "reason", declined.Reason)
+		saga.Result = &updateResult{Code: http.StatusPaymentRequired, Message: "Refund declined: " + declined.Reason}
+	case err != nil:
+		slog.ErrorContext(ctx, "couldn't reverse charge", "order", saga.OrderID, "error", err)
+		saga.Result = &updateResult{Code: http.StatusServiceUnavailable, Message: "Service unavailable"}
+	}
+	return saga
+}
+
+// compensateRefund pays the order of saga again, its charge not being
+// reversed.
+func (h *AppHandler) compensateRefund(ctx context.Context, saga refundSaga) refundSaga {
+	if err := RevertOrder(context.WithoutCancel(ctx), h.store, saga.Refunded, saga.Paid, true); err != nil {
+		slog.ErrorContext(ctx, "couldn't revert order", "order", saga.OrderID, "error", err)
+	}
+	return saga
+}
+
+// notifyRefund publishes the refund of the order of saga and notifies the
+// webhooks.
+func (h *AppHandler) notifyRefund(ctx context.Context, saga refundSaga) refundSaga {
+	event := OrderRefunded{Order: saga.Refunded, RefundedAt: time.Now().UTC()}
+	if err := h.publisher.Publish(WithEventKey(ctx, orderEventKey(ctx, saga.OrderID, saga.ETag)), handlerOrdersRefund, topicOrders, event); err != nil {
+		slog.ErrorContext(ctx, "couldn't publish refund, the charge is reversed nonetheless", "order", saga.OrderID, "error", err)
+	} else {
+		slog.InfoContext(ctx, "sent order refund to orders topic", "data", saga.Refunded)
+	}
+	h.metrics.OrderUpdates.WithLabelValues(h.config.Tenants.MetricLabel(saga.Refunded.Tenant)).Inc()
+	h.notifier.Notify(saga.Refunded)
+	saga.Result = &updateResult{Code: http.StatusOK, Message: "Order refunded"}
+	return saga
+}
+
+// RefundWorkflow runs the refund saga of the orders as a Dapr workflow, each
+// step being an activity, so that the sidecar resumes a refund interrupted by
+// a restart of the app rather than leave the order claimed.
+type RefundWorkflow struct {
+	handler *AppHandler
+	worker  *workflow.WorkflowWorker
+	// client schedules the workflows. The client of the workflow package
+	// panics when waiting for a workflow fails, so the durable task client
+	// it wraps is used instead.
+	client *durabletask.TaskHubGrpcClient
+}
+
+// NewRefundWorkflow registers the refund workflow, whose steps are run by h,
+// with the sidecar of client.
+func NewRefundWorkflow(client dapr.Client, h *AppHandler) (*RefundWorkflow, error) {
+	worker, err := workflow.NewWorker(workflow.WorkerWithDaprClient(client))
+	if err != nil {
+		return nil, err
+	}
+	w := &RefundWorkflow{
+		handler: h,
+		worker:  worker,
+		client:  durabletask.NewTaskHubGrpcClient(client.GrpcClientConn(), backend.DefaultLogger()),
+	}
+	if err := worker.RegisterWorkflow(w.refund); err != nil {
+		return nil, err
+	}
+	for _, activity := range []workflow.Activity{w.claim, w.reverseCharge, w.compensate, w.notify} {
+		if err := worker.RegisterActivity(activity); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Start has the sidecar run the refund workflows of the app, once it is ready.
+func (w *RefundWorkflow) Start() error {
+	return w.worker.Start()
+}
+
+// Refund runs the refund workflow of the order of saga, and returns its
+// result once it completed.
+func (w *RefundWorkflow) Refund(ctx context.Context, saga refundSaga) (updateResult, error) {
+	id, err := w.client.ScheduleNewOrchestration(ctx, workflowName(w.refund), api.WithInput(saga))
+	if err != nil {
+		return updateResult{}, fmt.Errorf("couldn't schedule refund: %w", err)
+	}
+	metadata, err := w.client.WaitForOrchestrationCompletion(ctx, id, api.WithFetchPayloads(true))
+	if err != nil {
+		return updateResult{}, fmt.Errorf("couldn't wait for refund %s: %w", id, err)
+	}
+	if metadata.RuntimeStatus != api.RUNTIME_STATUS_COMPLETED {
+		return updateResult{}, fmt.Errorf("refund %s is %s: %s", id, metadata.RuntimeStatus, metadata.FailureDetails.GetErrorMessage())
+	}
+
+	var res updateResult
+	if err := json.Unmarshal([]byte(metadata.SerializedOutput), &res); err != nil {
+		return updateResult{}, fmt.Errorf("couldn't decode result of refund %s: %w", id, err)
+	}
+	return res, nil
+}
+
+// refund is the refund workflow, running the steps of the saga as
+// activities.
+func (w *RefundWorkflow) refund(ctx *workflow.WorkflowContext) (any, error) {
+	var saga refundSaga
+	if err := ctx.GetInput(&saga); err != nil {
+		return nil, err
+	}
+	step := func(activity workflow.Activity) func(refundSaga) (refundSaga, error) {
+		return func(saga refundSaga) (refundSaga, error) {
+			var next refundSaga
+			err := ctx.CallActivity(activity, workflow.ActivityInput(saga)).Await(&next)
+			return next, err
+		}
+	}
+	saga, err := refundSteps{
+		claim:         step(w.claim),
+		reverseCharge: step(w.reverseCharge),
+		compensate:    step(w.compensate),
+		notify:        step(w.notify),
+	}.run(saga)
+	if err != nil {
+		return nil, err
+	}
+	return saga.Result, nil
+}
+
+// The activities of the refund workflow, each running a step of the saga.
+func (w *RefundWorkflow) claim(ctx workflow.ActivityContext) (any, error) {
+	return runRefundStep(ctx, w.handler.claimRefund)
+}
+
+func (w *RefundWorkflow) reverseCharge(ctx workflow.ActivityContext) (any, error) {
+	return runRefundStep(ctx, w.handler.reverseCharge)
+}
+
+func (w *RefundWorkflow) compensate(ctx workflow.ActivityContext) (any, error) {
+	return runRefundStep(ctx, w.handler.compensateRefund)
+}
+
+func (w *RefundWorkflow) notify(ctx workflow.ActivityContext) (any, error) {
+	return runRefundStep(ctx, w.handler.notifyRefund)
+}
+
+// runRefundStep runs step with the saga an activity is called with, within
+// the context of its request.
+func runRefundStep(ctx workflow.ActivityContext, step func(ctx context.Context, saga refundSaga) refundSaga) (any, error) {
+	var saga refundSaga
+	if err := ctx.GetInput(&saga); err != nil {
+		return nil, err
+	}
+	return step(saga.context(ctx.Context()), saga), nil
+}
+
+// workflowName returns the name the workflow worker registers the workflow f
+// under, the name of the function without its package.
+func workflowName(f workflow.Workflow) string {
+	name := runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
+	return name[strings.LastIndexByte(name, '.')+1:]
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestRefundOrder(t *testing.T) {
+	errUnavailable := errors.New("unavailable")
+	paid := Order{ID: "order-1234", Status: OrderStatusPaid}
+	refunded := Order{ID: "order-1234", Status: OrderStatusRefunded}
+
+	tests := []struct {
+		name string
+		// existing is stored beforehand if set
+		existing  *Order
+		payments  *mockPayments
+		publisher *mockPublisher
+		// expected is the answer, stored the order stored afterwards if any,
+		// refunded whether the charge was to be reversed, and published
+		// whether an OrderRefunded event was published
+		expected  updateResult
+		stored    *Order
+		refunded  bool
+		published bool
+		calls     []string
+	}{
+		{
+			name:      "paid order",
+			existing:  &paid,
+			payments:  &mockPayments{},
+			expected:  updateResult{Code: http.StatusOK, Message: "Order refunded"},
+			stored:    &refunded,
+			refunded:  true,
+			published: true,
+			calls:     []string{"Get", "Save"},
+		},
+		{
+			name:      "without payments app",
+			existing:  &paid,
+			expected:  updateResult{Code: http.StatusOK, Message: "Order refunded"},
+			stored:    &refunded,
+			published: true,
+			calls:     []string{"Get", "Save"},
+		},
+		{
+			name:     "unknown order",
+			payments: &mockPayments{},
+			expected: updateResult{Code: http.StatusNotFound, Message: "Order not found"},
+			calls:    []string{"Get"},
+		},
+		{
+			name:     "pending order",
+			existing: &Order{ID: "order-1234", Status: OrderStatusPending},
+			payments: &mockPayments{},
+			expected: updateResult{
+				Code:       http.StatusConflict,
+				Message:    `order status can't change from "PENDING" to "REFUNDED"`,
+				Transition: &TransitionError{From: OrderStatusPending, To: OrderStatusRefunded, Reason: TransitionReasonInvalid},
+			},
+			stored: &Order{ID: "order-1234", Status: OrderStatusPending},
+			calls:  []string{"Get"},
+		},
+		{
+			name:     "declined reversal is compensated",
+			existing: &paid,
+			payments: &mockPayments{refundErr: &PaymentDeclinedError{Reason: "charge settled"}},
+			expected: updateResult{Code: http.StatusPaymentRequired, Message: "Refund declined: charge settled"},
+			stored:   &paid,
+			refunded: true,
+			calls:    []string{"Get", "Save", "Get", "Save"},
+		},
+		{
+			name:     "unavailable payments app is compensated",
+			existing: &paid,
+			payments: &mockPayments{refundErr: errUnavailable},
+			expected: updateResult{Code: http.StatusServiceUnavailable, Message: "Service unavailable"},
+			stored:   &paid,
+			refunded: true,
+			calls:    []string{"Get", "Save", "Get", "Save"},
+		},
+		{
+			name:      "unavailable broker keeps the refund",
+			existing:  &paid,
+			payments:  &mockPayments{},
+			publisher: &mockPublisher{err: errUnavailable},
+			expected:  updateResult{Code: http.StatusOK, Message: "Order refunded"},
+			stored:    &refunded,
+			refunded:  true,
+			calls:     []string{"Get", "Save"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMockOrderRepository()
+			if tt.existing != nil {
+				store.save(*tt.existing)
+			}
+			publisher := tt.publisher
+			if publisher == nil {
+				publisher = &mockPublisher{}
+			}
+
+			h := newMockHandler(publisher, store)
+			if tt.payments != nil {
+				h.payments = tt.payments
+			}
+			res := h.refundOrder(context.Background(), "order-1234", "")
+			if !reflect.DeepEqual(res, tt.expected) {
+				t.Fatalf("expected result %+v. Got %+v.", tt.expected, res)
+			}
+
+			stored, ok := store.orders["order-1234"]
+			if (tt.stored == nil && ok) || (tt.stored != nil && !reflect.DeepEqual(stored, *tt.stored)) {
+				t.Fatalf("expected stored order %v. Got %v (%t).", tt.stored, stored, ok)
+			}
+			if !slices.Equal(store.calls, tt.calls) {
+				t.Fatalf("expected calls %v. Got %v.", tt.calls, store.calls)
+			}
+			if tt.payments != nil && (len(tt.payments.refunded) == 1) != tt.refunded {
+				t.Fatalf("expected the charge to be reversed: %t. Got %v.", tt.refunded, tt.payments.refunded)
+			}
+
+			if !tt.published {
+				if len(publisher.events) != 0 {
+					t.Fatalf("expected no event. Got %v.", publisher.events)
+				}
+				return
+			}
+			if len(publisher.events) != 1 {
+				t.Fatalf("expected one event. Got %v.", publisher.events)
+			}
+			e := publisher.events[0]
+			event, ok := e.data.(OrderRefunded)
+			if e.handler != handlerOrdersRefund || e.topic != topicOrders || !ok {
+				t.Fatalf("expected an OrderRefunded event of %s on %s. Got %+v.", handlerOrdersRefund, topicOrders, e)
+			}
+			if !reflect.DeepEqual(event.Order, refunded) || event.RefundedAt.IsZero() {
+				t.Fatalf("expected the event to carry the refunded order. Got %+v.", event)
+			}
+		})
+	}
+}
+
+func TestRefundSagaSerialized(t *testing.T) {
+	// the saga is recorded in the history of the refund workflow, from step
+	// to step
+	saga := refundSaga{
+		OrderID:       "order-1234",
+		Tenant:        "acme",
+		CorrelationID: "correlation-id",
+		Paid:          Order{ID: "order-1234", Status: OrderStatusPaid, Tenant: "acme"},
+		Refunded:      Order{ID: "order-1234", Status: OrderStatusRefunded, Tenant: "acme"},
+		ETag:          "3",
+		Result: &updateResult{
+			Code:       http.StatusConflict,
+			Message:    `order status can't change from "PENDING" to "REFUNDED"`,
+			Transition: &TransitionError{From: OrderStatusPending, To: OrderStatusRefunded, Reason: TransitionReasonInvalid},
+		},
+	}
+	data, err := json.Marshal(saga)
+	if err != nil {
+		t.Fatalf("couldn't encode saga: %s", err)
+	}
+	var decoded refundSaga
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("couldn't decode saga: %s", err)
+	}
+	if !reflect.DeepEqual(decoded, saga) {
+		t.Fatalf("expected saga %+v. Got %+v.", saga, decoded)
+	}
+
+	ctx := saga.context(context.Background())
+	if TenantFromContext(ctx) != "acme" || CorrelationIDFromContext(ctx) != "correlation-id" {
+		t.Fatalf("expected the steps to run for tenant acme with correlation ID correlation-id. Got %q and %q.", TenantFromContext(ctx), CorrelationIDFromContext(ctx))
+	}
+}
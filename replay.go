@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// cloudEventReplayExtension is the CloudEvent extension attribute
+	// carrying the replay attempt of a replayed event.
+	cloudEventReplayExtension = "replayattempt"
+	// metadataReplayAttempt is the publish metadata carrying the replay
+	// attempt of a replayed event to the broker.
+	metadataReplayAttempt = "replayAttempt"
+)
+
+// ReplayResult is the outcome of the replay of a quarantined event. Status is
+// the HTTP status code the replay would have been answered with on its own.
+type ReplayResult struct {
+	ID      string `json:"id"`
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	// Attempt is the replay attempt the event was published with.
+	Attempt int `json:"attempt,omitempty"`
+}
+
+// handleDLQReplay republishes the quarantined events of a JSON array of IDs
+// onto the orders topic, and answers with the result of each in the same
+// order. Replayed events stay quarantined until released, and are
+// quarantined again if they still fail.
+func (h *AppHandler) handleDLQReplay(w http.ResponseWriter, r *http.Request) {
+	var ids []string
+	if err := decodeBatch(r, &ids); err != nil {
+		writeCodecError(w, err)
+		return
+	}
+	if len(ids) == 0 || len(ids) > maxBatchSize {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad request: expected 1 to %d event IDs", maxBatchSize)
+		return
+	}
+
+	results := make([]ReplayResult, 0, len(ids))
+	for _, id := range ids {
+		results = append(results, h.replayEvent(r.Context(), id))
+	}
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		slog.ErrorContext(r.Context(), "couldn't encode replay results", "error", err)
+	}
+}
+
+// replayEvent republishes the event quarantined under id as it was
+// delivered, counting the replay in its replayattempt extension and its
+// publish metadata. The expiration of the event is dropped, as it would
+// otherwise be dropped on delivery as expired.
+func (h *AppHandler) replayEvent(ctx context.Context, id string) ReplayResult {
+	result := ReplayResult{ID: id, Status: http.StatusServiceUnavailable, Message: "Service unavailable"}
+
+	event, err := h.quarantined.Get(ctx, id)
+	if errors.Is(err, ErrQuarantinedEventNotFound) {
+		result.Status, result.Message = http.StatusNotFound, "Quarantined event not found"
+		return result
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't get quarantined event", "id", id, "error", err)
+		return result
+	}
+	var envelope CloudEvent
+	if err := json.Unmarshal(event.Payload, &envelope); err != nil {
+		result.Status, result.Message = http.StatusUnprocessableEntity, "Unprocessable entity: the event isn't a CloudEvent"
+		return result
+	}
+
+	if event, err = h.quarantined.CountReplay(ctx, id); err != nil {
+		slog.ErrorContext(ctx, "couldn't count replay", "id", id, "error", err)
+		return result
+	}
+	attempt := strconv.Itoa(event.Replays)
+	envelope[cloudEventReplayExtension] = attempt
+	delete(envelope, "expiration")
+
+	ctx = WithEventMetadata(ctx, map[string]string{metadataReplayAttempt: attempt})
+	if err := h.publisher.Publish(ctx, handlerDLQReplay, topicOrders, envelope); err != nil {
+		slog.ErrorContext(ctx, "couldn't replay event", "id", id, "error", err)
+		if errors.Is(err, ErrTopicNotAllowed) {
+			result.Status, result.Message = http.StatusInternalServerError, "Internal server error"
+		}
+		return result
+	}
+
+	slog.InfoContext(ctx, "replayed quarantined event", "id", id, "attempt", event.Replays)
+	result.Status, result.Message, result.Attempt = http.StatusOK, "Replayed", event.Replays
+	return result
+}
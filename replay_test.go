@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDLQReplay(t *testing.T) {
+	ctx := context.Background()
+	client := &fakeDaprClient{}
+	config := &Config{TopicAllowlist: defaultTopicAllowlist(), PublishRetry: RetryPolicy{MaxAttempts: 1}}
+	metrics := NewMetrics()
+	quarantined := NewQuarantineStore(client)
+	h := NewAppHandler(config, metrics, NewPublisher(client, config, metrics), nil)
+	h.quarantined = quarantined
+	h.RegisterRoutes()
+
+	for _, event := range []QuarantinedEvent{
+		{ID: "event-1", Route: routePaidOrderEvents, Payload: []byte(`{"id":"event-1","expiration":"2000-01-01T00:00:00Z","data":"PAID"}`)},
+		{ID: "event-2", Route: routeOrderEvents, Payload: []byte(`{"data":`)},
+	} {
+		if err := quarantined.Add(ctx, event); err != nil {
+			t.Fatalf("couldn't quarantine event: %s", err)
+		}
+	}
+
+	replay := func(body string) (int, []ReplayResult) {
+		req := httptest.NewRequest(http.MethodPost, "/admin/dlq/replay", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentTypeJSON)
+		rec := httptest.NewRecorder()
+		h.router.ServeHTTP(rec, req)
+
+		var results []ReplayResult
+		if rec.Code == http.StatusOK {
+			if err := json.NewDecoder(rec.Body).Decode(&results); err != nil {
+				t.Fatalf("couldn't decode replay results: %s", err)
+			}
+		}
+		return rec.Code, results
+	}
+
+	code, results := replay(`["event-1","event-2","unknown"]`)
+	expected := []ReplayResult{
+		{ID: "event-1", Status: http.StatusOK, Message: "Replayed", Attempt: 1},
+		{ID: "event-2", Status: http.StatusUnprocessableEntity, Message: "Unprocessable entity: the event isn't a CloudEvent"},
+		{ID: "unknown", Status: http.StatusNotFound, Message: "Quarantined event not found"},
+	}
+	if code != http.StatusOK || !reflect.DeepEqual(results, expected) {
+		t.Fatalf("expected results %+v. Got %d %+v.", expected, code, results)
+	}
+
+	// every replay is one more attempt
+	if _, results = replay(`["event-1"]`); len(results) != 1 || results[0].Attempt != 2 {
+		t.Fatalf("expected replay attempt 2. Got %+v.", results)
+	}
+	if len(client.published) != 2 {
+		t.Fatalf("expected 2 events published. Got %v.", client.published)
+	}
+	published := client.published[1]
+	envelope, ok := published.data.(map[string]any)
+	if !ok || published.topic != topicOrders || published.contentType != contentTypeCloudEvents {
+		t.Fatalf("expected a CloudEvent published to %s. Got %+v.", topicOrders, published)
+	}
+	if envelope["id"] != "event-1" || envelope[cloudEventReplayExtension] != "2" || envelope["expiration"] != nil {
+		t.Fatalf("expected event-1 at replay attempt 2 without its expiration. Got %v.", envelope)
+	}
+	if published.metadata[metadataReplayAttempt] != "2" {
+		t.Fatalf("expected replay attempt 2 in the metadata. Got %v.", published.metadata)
+	}
+
+	// the replayed event stays quarantined, and keeps its replays when
+	// quarantined again
+	if err := quarantined.Add(ctx, QuarantinedEvent{ID: "event-1", Route: routePaidOrderEvents}); err != nil {
+		t.Fatalf("couldn't quarantine event: %s", err)
+	}
+	if event, err := quarantined.Get(ctx, "event-1"); err != nil || event.Attempts != 2 || event.Replays != 2 {
+		t.Fatalf("expected event-1 delivered twice and replayed twice. Got %+v: %v", event, err)
+	}
+
+	for _, body := range []string{`[]`, `{"ids":["event-1"]}`} {
+		if code, _ := replay(body); code != http.StatusBadRequest {
+			t.Fatalf("expected status code %d for %s. Got %d.", http.StatusBadRequest, body, code)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	tests := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{10, time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := p.Backoff(tt.attempt); got != tt.expected {
+			t.Errorf("expected backoff %s for attempt %d. Got %s.", tt.expected, tt.attempt, got)
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	errPublish := errors.New("publish failed")
+
+	t.Run("succeeds after retries", func(t *testing.T) {
+		calls, retries := 0, 0
+		err := p.Do(context.Background(), func(ctx context.Context) error {
+			calls++
+			if calls < 3 {
+				return errPublish
+			}
+			return nil
+		}, func(attempt int, err error) {
+			retries++
+		})
+		if err != nil {
+			t.Fatalf("expected no error. Got %s.", err)
+		}
+		if calls != 3 || retries != 2 {
+			t.Fatalf("expected 3 calls and 2 retries. Got %d calls and %d retries.", calls, retries)
+		}
+	})
+
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		calls := 0
+		err := p.Do(context.Background(), func(ctx context.Context) error {
+			calls++
+			return errPublish
+		}, nil)
+		if !errors.Is(err, errPublish) {
+			t.Fatalf("expected error %q. Got %v.", errPublish, err)
+		}
+		if calls != 3 {
+			t.Fatalf("expected 3 calls. Got %d.", calls)
+		}
+	})
+
+	t.Run("stops when context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		calls := 0
+		err := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}.Do(ctx, func(ctx context.Context) error {
+			calls++
+			cancel()
+			return errPublish
+		}, nil)
+		if !errors.Is(err, errPublish) {
+			t.Fatalf("expected error %q. Got %v.", errPublish, err)
+		}
+		if calls != 1 {
+			t.Fatalf("expected 1 call. Got %d.", calls)
+		}
+	})
+}
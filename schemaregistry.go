@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const contentTypeSchemaRegistry = "application/vnd.schemaregistry.v1+json"
+
+// ErrIncompatibleSchema is returned when the schema registry rejects a schema
+// as incompatible with the versions already registered.
+var ErrIncompatibleSchema = errors.New("incompatible schema")
+
+// SchemaRegistryClient talks to a Confluent compatible schema registry.
+type SchemaRegistryClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewSchemaRegistryClient(baseURL string) *SchemaRegistryClient {
+	return &SchemaRegistryClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// schemaRegistryError is the body of the registry error responses.
+type schemaRegistryError struct {
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+// errorCodeSubjectNotFound is returned by the registry for unknown subjects.
+const errorCodeSubjectNotFound = 40401
+
+func (c *SchemaRegistryClient) do(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", contentTypeSchemaRegistry)
+	if body != nil {
+		req.Header.Set("Content-Type", contentTypeSchemaRegistry)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		regErr := &schemaRegistryError{}
+		if err := json.NewDecoder(resp.Body).Decode(regErr); err != nil || regErr.ErrorCode == 0 {
+			regErr = &schemaRegistryError{ErrorCode: resp.StatusCode, Message: resp.Status}
+		}
+		return regErr
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (e *schemaRegistryError) Error() string {
+	return fmt.Sprintf("schema registry error %d: %s", e.ErrorCode, e.Message)
+}
+
+type schemaRequest struct {
+	Schema string `json:"schema"`
+}
+
+// CheckCompatibility returns ErrIncompatibleSchema if schema can't be
+// registered as a new version of subject. Any schema is compatible with a
+// subject that doesn't exist yet.
+func (c *SchemaRegistryClient) CheckCompatibility(ctx context.Context, subject, schema string) error {
+	var resp struct {
+		IsCompatible bool `json:"is_compatible"`
+	}
+	err := c.do(ctx, http.MethodPost, "/compatibility/subjects/"+url.PathEscape(subject)+"/versions/latest", schemaRequest{Schema: schema}, &resp)
+	var regErr *schemaRegistryError
+	if errors.As(err, &regErr) && regErr.ErrorCode == errorCodeSubjectNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !resp.IsCompatible {
+		return fmt.Errorf("%w with the latest version of subject %s", ErrIncompatibleSchema, subject)
+	}
+	return nil
+}
+
+// Register registers schema under subject, or looks its ID up if it was
+// registered already, and returns its ID.
+func (c *SchemaRegistryClient) Register(ctx context.Context, subject, schema string) (int, error) {
+	var resp struct {
+		ID int `json:"id"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/subjects/"+url.PathEscape(subject)+"/versions", schemaRequest{Schema: schema}, &resp); err != nil {
+		return 0, err
+	}
+	return resp.ID, nil
+}
+
+// SchemaURL returns the URL at which the schema with id can be fetched.
+func (c *SchemaRegistryClient) SchemaURL(id int) string {
+	return fmt.Sprintf("%s/schemas/ids/%d", c.baseURL, id)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+)
+
+// The secrets of the secret store holding the credentials of the API, each
+// overriding its environment variable when present.
+const (
+	// secretAPIKeys holds comma-separated API keys, as AUTH_API_KEYS.
+	secretAPIKeys = "api-keys"
+	// secretAdminAPIKeys holds comma-separated API keys of the admin
+	// routes, as AUTH_ADMIN_API_KEYS.
+	secretAdminAPIKeys = "admin-api-keys"
+	// secretJWTSecret holds the HMAC secret of the bearer tokens, as
+	// AUTH_JWT_SECRET.
+	secretJWTSecret = "jwt-secret"
+	// secretEventSigningKey holds the key the events are signed with, as
+	// EVENT_SIGNING_KEY.
+	secretEventSigningKey = "event-signing-key"
+
+	defaultSecretsRefreshInterval = time.Minute
+)
+
+// SecretsConfig configures the rotation of the credentials of the API.
+type SecretsConfig struct {
+	// Store is the Dapr secret store the credentials are read from, none if
+	// empty.
+	Store string
+	// RefreshInterval is the time between two reads of the store, which is
+	// only read on SIGHUP if zero.
+	RefreshInterval time.Duration
+	// ReadTimeout bounds the time the credentials are first read, unless
+	// zero.
+	ReadTimeout time.Duration
+}
+
+// Credentials holds the credentials of the API and the key of the events,
+// read from a Dapr secret store when one is configured and refreshed as they
+// are rotated there, without a restart. Rotated credentials are swapped at
+// once, so that a request is authenticated with either the old or the new
+// ones.
+type Credentials struct {
+	client  dapr.Client
+	config  SecretsConfig
+	metrics *Metrics
+	// base and baseSigningKey are the credentials of the environment, those
+	// of the store overriding them.
+	base           AuthConfig
+	baseSigningKey Secret
+
+	// current is nil until the credentials are first read from the store.
+	current atomic.Pointer[credentials]
+}
+
+// credentials are the authenticators built from a version of the
+// credentials, along with the key the events are signed with, and the one
+// it replaced if any.
+type credentials struct {
+	auth               AuthConfig
+	api                Authenticator
+	admin              Authenticator
+	signingKey         Secret
+	previousSigningKey Secret
+}
+
+func NewCredentials(client dapr.Client, config SecretsConfig, auth AuthConfig, signingKey Secret, metrics *Metrics) *Credentials {
+	c := &Credentials{
+		client:         client,
+		config:         config,
+		metrics:        metrics,
+		base:           auth,
+		baseSigningKey: signingKey,
+	}
+	if config.Store == "" {
+		c.set(auth, signingKey)
+	}
+	return c
+}
+
+func (c *Credentials) set(auth AuthConfig, signingKey Secret) {
+	current := &credentials{
+		auth:       auth,
+		api:        NewAuthenticator(auth),
+		admin:      NewAdminAuthenticator(auth),
+		signingKey: signingKey,
+	}
+	// the events signed with the former key are still verified, as they
+	// were published before the rotation
+	if previous := c.current.Load(); previous != nil {
+		current.previousSigningKey = previous.previousSigningKey
+		if previous.signingKey != signingKey {
+			current.previousSigningKey = previous.signingKey
+		}
+	}
+	c.current.Store(current)
+}
+
+// SigningKeys returns the keys the events are verified with, the first one
+// signing them, none if the events aren't signed. It reports false until the
+// credentials are first read from the secret store.
+func (c *Credentials) SigningKeys() ([]Secret, bool) {
+	current := c.current.Load()
+	if current == nil {
+		return nil, false
+	}
+	var keys []Secret
+	for _, key := range []Secret{current.signingKey, current.previousSigningKey} {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys, true
+}
+
+// Enabled reports whether the API requires authentication, as it always
+// does with a secret store, even before its credentials are read.
+func (c *Credentials) Enabled() bool {
+	return c.config.Store != "" || c.base.Enabled()
+}
+
+// AdminEnabled reports whether the admin routes require authentication.
+func (c *Credentials) AdminEnabled() bool {
+	return c.config.Store != "" || c.base.AdminEnabled()
+}
+
+// Authenticator returns the Authenticator of the API, and AdminAuthenticator
+// that of the admin routes, both authenticating each request with the
+// credentials current at the time.
+func (c *Credentials) Authenticator() Authenticator {
+	return credentialsAuthenticator{credentials: c}
+}
+
+func (c *Credentials) AdminAuthenticator() Authenticator {
+	return credentialsAuthenticator{credentials: c, admin: true}
+}
+
+type credentialsAuthenticator struct {
+	credentials *Credentials
+	admin       bool
+}
+
+func (a credentialsAuthenticator) Authenticate(r *http.Request) error {
+	current := a.credentials.current.Load()
+	if current == nil {
+		return fmt.Errorf("%w: credentials not read from the secret store yet", ErrUnauthenticated)
+	}
+	if a.admin {
+		return current.admin.Authenticate(r)
+	}
+	return current.api.Authenticate(r)
+}
+
+// Refresh reads the credentials from the secret store, and swaps them for
+// the current ones. A secret missing from the store leaves its environment
+// variable in effect.
+func (c *Credentials) Refresh(ctx context.Context) error {
+	secrets, err := c.client.GetBulkSecret(ctx, c.config.Store, nil)
+	if err != nil {
+		c.metrics.SecretRefreshes.WithLabelValues("failure").Inc()
+		return fmt.Errorf("couldn't read secret store %s: %w", c.config.Store, err)
+	}
+	c.metrics.SecretRefreshes.WithLabelValues("success").Inc()
+
+	auth := c.base
+	if v, ok := secretValue(secrets, secretAPIKeys); ok {
+		auth.APIKeys = splitSecrets(v)
+	}
+	if v, ok := secretValue(secrets, secretAdminAPIKeys); ok {
+		auth.AdminAPIKeys = splitSecrets(v)
+	}
+	if v, ok := secretValue(secrets, secretJWTSecret); ok {
+		auth.JWTSecret = Secret(v)
+	}
+	signingKey := c.baseSigningKey
+	if v, ok := secretValue(secrets, secretEventSigningKey); ok {
+		signingKey = Secret(v)
+	}
+
+	previous := c.current.Load()
+	if previous != nil && sameCredentials(previous.auth, auth) && previous.signingKey == signingKey {
+		return nil
+	}
+	c.set(auth, signingKey)
+	if previous != nil {
+		slog.InfoContext(ctx, "rotated credentials", "store", c.config.Store)
+	}
+	return nil
+}
+
+// Run reads the credentials from the secret store, then reads them again
+// every RefreshInterval and on every signal of rotate, until ctx is done.
+// The first read is tried again until it succeeds, the requests being
+// rejected meanwhile, and Run returns an error if it didn't within
+// ReadTimeout; a failed refresh leaves the current credentials in effect.
+func (c *Credentials) Run(ctx context.Context, rotate <-chan os.Signal) error {
+	if c.config.Store == "" {
+		return nil
+	}
+	if err := c.firstRead(ctx); err != nil {
+		return err
+	}
+
+	var tick <-chan time.Time
+	if c.config.RefreshInterval > 0 {
+		ticker := time.NewTicker(c.config.RefreshInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick:
+		case <-rotate:
+			slog.Info("rotation signal received, reading credentials", "store", c.config.Store)
+		}
+		if err := c.Refresh(ctx); err != nil {
+			slog.Warn("couldn't refresh credentials, keeping the current ones", "error", err)
+		}
+	}
+}
+
+// firstRead reads the credentials until it succeeds, returning an error if
+// it didn't within ReadTimeout, and nil if ctx is done first.
+func (c *Credentials) firstRead(ctx context.Context) error {
+	var timeout <-chan time.Time
+	if c.config.ReadTimeout > 0 {
+		timer := time.NewTimer(c.config.ReadTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for attempt := 1; ; attempt++ {
+		err := c.Refresh(ctx)
+		if err == nil {
+			return nil
+		}
+		slog.Warn("couldn't read credentials", "attempt", attempt, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timeout:
+			return fmt.Errorf("couldn't read credentials from %s within %s: %w", c.config.Store, c.config.ReadTimeout, err)
+		case <-time.After(sidecarReadRetry.Backoff(attempt)):
+		}
+	}
+}
+
+// secretValue returns the value of the secret name of a bulk read, whose
+// secrets hold a single key, named after them by most stores.
+func secretValue(secrets map[string]map[string]string, name string) (string, bool) {
+	secret, ok := secrets[name]
+	if !ok {
+		return "", false
+	}
+	if v, ok := secret[name]; ok {
+		return v, true
+	}
+	for _, v := range secret {
+		return v, true
+	}
+	return "", false
+}
+
+// splitSecrets splits comma-separated secrets, ignoring the empty ones.
+func splitSecrets(v string) []Secret {
+	var secrets []Secret
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			secrets = append(secrets, Secret(s))
+		}
+	}
+	return secrets
+}
+
+func sameCredentials(a, b AuthConfig) bool {
+	return slices.Equal(a.APIKeys, b.APIKeys) && slices.Equal(a.AdminAPIKeys, b.AdminAPIKeys) && a.JWTSecret == b.JWTSecret
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// authenticate reports whether authenticator accepts a request with the API
+// key.
+func authenticate(authenticator Authenticator, key string) bool {
+	req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	req.Header.Set("X-API-Key", key)
+	return authenticator.Authenticate(req) == nil
+}
+
+func TestCredentialsRefresh(t *testing.T) {
+	client := &fakeDaprClient{secrets: map[string]map[string]string{
+		secretAPIKeys: {secretAPIKeys: "key-1, key-2"},
+	}}
+	metrics := NewMetrics()
+	credentials := NewCredentials(client, SecretsConfig{Store: "app-secrets"}, AuthConfig{
+		APIKeys:      []Secret{"env-key"},
+		AdminAPIKeys: []Secret{"admin-key"},
+	}, "", metrics)
+	api, admin := credentials.Authenticator(), credentials.AdminAuthenticator()
+
+	// the requests are rejected until the credentials are read
+	if authenticate(api, "env-key") {
+		t.Fatal("expected the requests rejected before the credentials are read.")
+	}
+
+	if err := credentials.Refresh(context.Background()); err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+	// the secrets of the store override the environment, the others staying
+	// in effect
+	for key, expected := range map[string]bool{"key-1": true, "key-2": true, "env-key": false} {
+		if got := authenticate(api, key); got != expected {
+			t.Fatalf("expected key %s accepted: %t. Got %t.", key, expected, got)
+		}
+	}
+	if !authenticate(admin, "admin-key") || authenticate(admin, "key-1") {
+		t.Fatal("expected the admin routes to accept the admin key of the environment only.")
+	}
+
+	// the rotated key replaces the former one
+	client.secrets[secretAPIKeys] = map[string]string{secretAPIKeys: "key-3"}
+	if err := credentials.Refresh(context.Background()); err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+	if !authenticate(api, "key-3") || authenticate(api, "key-1") {
+		t.Fatal("expected the rotated key to replace the former ones.")
+	}
+
+	// the credentials are kept while the store is unavailable
+	client.secretsErr = errors.New("secret store app-secrets not found")
+	if err := credentials.Refresh(context.Background()); err == nil {
+		t.Fatal("expected an error reading an unavailable store.")
+	}
+	if !authenticate(api, "key-3") {
+		t.Fatal("expected the current key to stay accepted.")
+	}
+	if got := testutil.ToFloat64(metrics.SecretRefreshes.WithLabelValues("failure")); got != 1 {
+		t.Fatalf("expected 1 failed refresh. Got %f.", got)
+	}
+}
+
+func TestCredentialsWithoutStore(t *testing.T) {
+	credentials := NewCredentials(nil, SecretsConfig{}, AuthConfig{APIKeys: []Secret{"env-key"}}, "", NewMetrics())
+	if !credentials.Enabled() || !authenticate(credentials.Authenticator(), "env-key") {
+		t.Fatal("expected the API keys of the environment accepted.")
+	}
+
+	if NewCredentials(nil, SecretsConfig{}, AuthConfig{}, "", NewMetrics()).Enabled() {
+		t.Fatal("expected authentication disabled without credentials.")
+	}
+	// the store may hold credentials the environment doesn't
+	if !NewCredentials(nil, SecretsConfig{Store: "app-secrets"}, AuthConfig{}, "", NewMetrics()).Enabled() {
+		t.Fatal("expected authentication enabled with a secret store.")
+	}
+}
+
+func TestCredentialsRunSignal(t *testing.T) {
+	client := &fakeDaprClient{secrets: map[string]map[string]string{secretAPIKeys: {secretAPIKeys: "key-1"}}}
+	credentials := NewCredentials(client, SecretsConfig{Store: "app-secrets"}, AuthConfig{}, "", NewMetrics())
+	rotate := make(chan os.Signal)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := credentials.Run(ctx, rotate); err != nil {
+			t.Errorf("couldn't run credentials: %s", err)
+		}
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// the channel is unbuffered, so the signal is received once the
+	// credentials are first read
+	rotate <- syscall.SIGHUP
+	if !authenticate(credentials.Authenticator(), "key-1") {
+		t.Fatal("expected the credentials read before the signal.")
+	}
+
+	client.mu.Lock()
+	client.secrets[secretAPIKeys] = map[string]string{secretAPIKeys: "key-2"}
+	client.mu.Unlock()
+	rotate <- syscall.SIGHUP
+	deadline := time.Now().Add(time.Second)
+	for !authenticate(credentials.Authenticator(), "key-2") {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the rotated key accepted after the signal.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCredentialsRunTimeout(t *testing.T) {
+	client := &fakeDaprClient{secretsErr: errors.New("secret store app-secrets not found")}
+	credentials := NewCredentials(client, SecretsConfig{Store: "app-secrets", ReadTimeout: 50 * time.Millisecond}, AuthConfig{}, "", NewMetrics())
+
+	// the first read isn't tried again past the timeout
+	err := credentials.Run(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "secret store app-secrets not found") {
+		t.Fatalf("expected the error of the last read. Got %v.", err)
+	}
+	if authenticate(credentials.Authenticator(), "key-1") {
+		t.Fatal("expected the requests to be rejected.")
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const shipmentStoreName = "shipment-state"
+
+var (
+	// ErrShipmentNotFound is returned when an order has no shipment under an
+	// ID.
+	ErrShipmentNotFound = errors.New("shipment not found")
+	// ErrShipmentTransition is returned when a shipment can't move to a
+	// tracking status.
+	ErrShipmentTransition = errors.New("invalid shipment status change")
+)
+
+// Shipment is a parcel sent for a paid order, tracked through its status.
+type Shipment struct {
+	ID             string         `json:"id"`
+	OrderID        string         `json:"orderId"`
+	Tenant         string         `json:"tenant,omitempty"`
+	Carrier        string         `json:"carrier"`
+	TrackingNumber string         `json:"trackingNumber"`
+	Status         ShipmentStatus `json:"status"`
+	CreatedAt      time.Time      `json:"createdAt"`
+	UpdatedAt      time.Time      `json:"updatedAt"`
+}
+
+type ShipmentStatus string
+
+const (
+	ShipmentStatusCreated        ShipmentStatus = "CREATED"
+	ShipmentStatusInTransit      ShipmentStatus = "IN_TRANSIT"
+	ShipmentStatusOutForDelivery ShipmentStatus = "OUT_FOR_DELIVERY"
+	ShipmentStatusDelivered      ShipmentStatus = "DELIVERED"
+)
+
+// shipmentTransitions lists for every tracking status the statuses a
+// shipment may move to. Delivered shipments are final.
+var shipmentTransitions = map[ShipmentStatus][]ShipmentStatus{
+	ShipmentStatusCreated:        {ShipmentStatusInTransit},
+	ShipmentStatusInTransit:      {ShipmentStatusOutForDelivery, ShipmentStatusDelivered},
+	ShipmentStatusOutForDelivery: {ShipmentStatusDelivered},
+	ShipmentStatusDelivered:      {},
+}
+
+func newShipmentID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "shipment-" + hex.EncodeToString(b), nil
+}
+
+func shipmentsKey(orderID string) string {
+	return "shipments-" + orderID
+}
+
+// ShipmentStore persists the shipments of the orders in the Dapr state
+// store, those of an order being stored together under a key of their own.
+// Keys are scoped to the tenant of the context.
+type ShipmentStore struct {
+	client    dapr.Client
+	storeName string
+}
+
+func NewShipmentStore(client dapr.Client) *ShipmentStore {
+	return &ShipmentStore{
+		client:    client,
+		storeName: shipmentStoreName,
+	}
+}
+
+// List returns the shipments of the order orderID, in the order they were
+// created, along with their ETag.
+func (s *ShipmentStore) List(ctx context.Context, orderID string) ([]Shipment, string, error) {
+	item, err := s.client.GetState(ctx, s.storeName, tenantKey(ctx, shipmentsKey(orderID)), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	shipments := []Shipment{}
+	if item == nil {
+		return shipments, "", nil
+	}
+	if len(item.Value) > 0 {
+		if err := json.Unmarshal(item.Value, &shipments); err != nil {
+			return nil, "", fmt.Errorf("couldn't decode shipments of %s: %w", orderID, err)
+		}
+	}
+	return shipments, item.Etag, nil
+}
+
+// Get returns the shipment id of the order orderID.
+func (s *ShipmentStore) Get(ctx context.Context, orderID, id string) (Shipment, error) {
+	shipments, _, err := s.List(ctx, orderID)
+	if err != nil {
+		return Shipment{}, err
+	}
+	i := slices.IndexFunc(shipments, func(shipment Shipment) bool { return shipment.ID == id })
+	if i < 0 {
+		return Shipment{}, ErrShipmentNotFound
+	}
+	return shipments[i], nil
+}
+
+// Update applies update to the shipments of the order orderID, retrying when
+// another writer modified them in the meantime. An error of update is
+// returned as is, and nothing is saved.
+func (s *ShipmentStore) Update(ctx context.Context, orderID string, update func([]Shipment) ([]Shipment, error)) error {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: 10 * time.Millisecond, MaxDelay: 100 * time.Millisecond}
+	return policy.Do(ctx, func(ctx context.Context) error {
+		shipments, etag, err := s.List(ctx, orderID)
+		if err != nil {
+			return Permanent(err)
+		}
+		shipments, err = update(shipments)
+		if err != nil {
+			return Permanent(err)
+		}
+		data, err := json.Marshal(shipments)
+		if err != nil {
+			return Permanent(err)
+		}
+		err = s.client.SaveStateWithETag(ctx, s.storeName, tenantKey(ctx, shipmentsKey(orderID)), data, etag,
+			map[string]string{"contentType": "application/json"},
+			dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+		// only a concurrent write is worth retrying
+		if code := status.Code(err); err != nil && code != codes.Aborted && code != codes.InvalidArgument {
+			return Permanent(err)
+		}
+		return err
+	}, nil)
+}
+
+type schemaCreateShipment struct {
+	Carrier        string `json:"carrier"`
+	TrackingNumber string `json:"trackingNumber"`
+}
+
+type schemaTrackShipment struct {
+	Status ShipmentStatus `json:"status"`
+}
+
+// handleShipmentsCreate ships a paid order, and publishes a ShipmentCreated
+// event. The shipment is deleted again if its event couldn't be published.
+func (h *AppHandler) handleShipmentsCreate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	orderID := mux.Vars(r)["id"]
+
+	var body schemaCreateShipment
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad request")
+		return
+	}
+	if body.Carrier == "" || body.TrackingNumber == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad request: carrier and trackingNumber are required")
+		return
+	}
+
+	order, _, err := h.store.Get(ctx, orderID)
+	if errors.Is(err, ErrOrderNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Order not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't get order", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Service unavailable")
+		return
+	}
+	if order.Status != OrderStatusPaid {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Conflict: only paid orders are shipped, %s is %s", orderID, order.Status)
+		return
+	}
+
+	id, err := newShipmentID()
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't generate shipment ID", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Internal server error")
+		return
+	}
+	now := time.Now().UTC()
+	shipment := Shipment{
+		ID:             id,
+		OrderID:        orderID,
+		Tenant:         order.Tenant,
+		Carrier:        body.Carrier,
+		TrackingNumber: body.TrackingNumber,
+		Status:         ShipmentStatusCreated,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	if err := h.shipments.Update(ctx, orderID, func(shipments []Shipment) ([]Shipment, error) {
+		return append(shipments, shipment), nil
+	}); err != nil {
+		slog.ErrorContext(ctx, "couldn't save shipment", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Service unavailable")
+		return
+	}
+
+	if err := h.publisher.Publish(ctx, handlerShipmentsCreate, topicShipments, ShipmentCreated{Shipment: shipment}); err != nil {
+		slog.ErrorContext(ctx, "couldn't publish event", "error", err)
+		if err := h.shipments.Update(context.WithoutCancel(ctx), orderID, func(shipments []Shipment) ([]Shipment, error) {
+			return slices.DeleteFunc(shipments, func(s Shipment) bool { return s.ID == id }), nil
+		}); err != nil {
+			slog.ErrorContext(ctx, "couldn't delete shipment", "shipment", id, "error", err)
+		}
+		writePublishError(w, err)
+		return
+	}
+
+	slog.InfoContext(ctx, "sent shipment to shipments topic", "data", shipment)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(shipment); err != nil {
+		slog.ErrorContext(ctx, "couldn't encode shipment", "error", err)
+	}
+}
+
+func (h *AppHandler) handleShipmentsList(w http.ResponseWriter, r *http.Request) {
+	shipments, _, err := h.shipments.List(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		slog.ErrorContext(r.Context(), "couldn't list shipments", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Service unavailable")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(shipments); err != nil {
+		slog.ErrorContext(r.Context(), "couldn't encode shipments", "error", err)
+	}
+}
+
+func (h *AppHandler) handleShipmentsGet(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	shipment, err := h.shipments.Get(r.Context(), vars["id"], vars["shipmentID"])
+	if errors.Is(err, ErrShipmentNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Shipment not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "couldn't get shipment", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Service unavailable")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(shipment); err != nil {
+		slog.ErrorContext(r.Context(), "couldn't encode shipment", "error", err)
+	}
+}
+
+// handleShipmentsTrack moves a shipment to the tracking status of the body,
+// and publishes a ShipmentStatusChanged event. The change is undone if its
+// event couldn't be published.
+func (h *AppHandler) handleShipmentsTrack(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	orderID, id := vars["id"], vars["shipmentID"]
+
+	var body schemaTrackShipment
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad request")
+		return
+	}
+	if _, ok := shipmentTransitions[body.Status]; !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad request: unknown shipment status %q", body.Status)
+		return
+	}
+
+	var previous, tracked Shipment
+	err := h.shipments.Update(ctx, orderID, func(shipments []Shipment) ([]Shipment, error) {
+		i := slices.IndexFunc(shipments, func(s Shipment) bool { return s.ID == id })
+		if i < 0 {
+			return nil, ErrShipmentNotFound
+		}
+		previous = shipments[i]
+		if !slices.Contains(shipmentTransitions[previous.Status], body.Status) {
+			return nil, fmt.Errorf("%w: can't change from %q to %q", ErrShipmentTransition, previous.Status, body.Status)
+		}
+		tracked = previous
+		tracked.Status = body.Status
+		tracked.UpdatedAt = time.Now().UTC()
+		shipments[i] = tracked
+		return shipments, nil
+	})
+	switch {
+	case errors.Is(err, ErrShipmentNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Shipment not found")
+		return
+	case errors.Is(err, ErrShipmentTransition):
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Conflict: %s", err)
+		return
+	case err != nil:
+		slog.ErrorContext(ctx, "couldn't save shipment", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Service unavailable")
+		return
+	}
+
+	event := ShipmentStatusChanged{Shipment: tracked, PreviousStatus: previous.Status}
+	if err := h.publisher.Publish(ctx, handlerShipmentsTrack, topicShipments, event); err != nil {
+		slog.ErrorContext(ctx, "couldn't publish event", "error", err)
+		if err := h.shipments.Update(context.WithoutCancel(ctx), orderID, func(shipments []Shipment) ([]Shipment, error) {
+			// a shipment changed since then is left as it is
+			if i := slices.IndexFunc(shipments, func(s Shipment) bool {
+				return s.ID == id && s.Status == tracked.Status
+			}); i >= 0 {
+				shipments[i] = previous
+			}
+			return shipments, nil
+		}); err != nil {
+			slog.ErrorContext(ctx, "couldn't revert shipment", "shipment", id, "error", err)
+		}
+		writePublishError(w, err)
+		return
+	}
+
+	slog.InfoContext(ctx, "sent shipment status change to shipments topic", "data", tracked)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tracked); err != nil {
+		slog.ErrorContext(ctx, "couldn't encode shipment", "error", err)
+	}
+}
+
+// writePublishError answers a change whose event couldn't be published.
+func writePublishError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrTopicNotAllowed) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Internal server error")
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintf(w, "Service unavailable")
+}
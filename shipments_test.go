@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newShipmentsHandler returns a handler with its routes registered, storing
+// order-1111 as pending and order-2222 as paid, and the shipments in client.
+func newShipmentsHandler(t *testing.T, publisher *mockPublisher, client *fakeDaprClient) *AppHandler {
+	t.Helper()
+
+	store := newMockOrderRepository()
+	store.save(Order{ID: "order-1111", Status: OrderStatusPending})
+	store.save(Order{ID: "order-2222", Status: OrderStatusPaid})
+
+	h := newMockHandler(publisher, store)
+	h.shipments = NewShipmentStore(client)
+	h.RegisterRoutes()
+	return h
+}
+
+func serve(h *AppHandler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentTypeJSON)
+	rec := httptest.NewRecorder()
+	h.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCreateShipment(t *testing.T) {
+	errUnavailable := errors.New("unavailable")
+
+	tests := []struct {
+		name      string
+		orderID   string
+		body      string
+		publisher *mockPublisher
+		// expected is the status code of the answer, whose body contains
+		// expectedBody, and stored whether the shipment is stored afterwards
+		expected     int
+		expectedBody string
+		stored       bool
+	}{
+		{
+			name: "paid order", orderID: "order-2222", body: `{"carrier":"dhl","trackingNumber":"JD0123"}`,
+			expected: http.StatusCreated, expectedBody: `"orderId":"order-2222","carrier":"dhl","trackingNumber":"JD0123","status":"CREATED"`,
+			stored: true,
+		},
+		{
+			name: "pending order", orderID: "order-1111", body: `{"carrier":"dhl","trackingNumber":"JD0123"}`,
+			expected: http.StatusConflict, expectedBody: "only paid orders are shipped",
+		},
+		{
+			name: "unknown order", orderID: "order-3333", body: `{"carrier":"dhl","trackingNumber":"JD0123"}`,
+			expected: http.StatusNotFound, expectedBody: "Order not found",
+		},
+		{
+			name: "missing tracking number", orderID: "order-2222", body: `{"carrier":"dhl"}`,
+			expected: http.StatusBadRequest, expectedBody: "carrier and trackingNumber are required",
+		},
+		{
+			name: "unavailable broker", orderID: "order-2222", body: `{"carrier":"dhl","trackingNumber":"JD0123"}`,
+			publisher: &mockPublisher{err: errUnavailable},
+			expected:  http.StatusServiceUnavailable, expectedBody: "Service unavailable",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := tt.publisher
+			if publisher == nil {
+				publisher = &mockPublisher{}
+			}
+			client := &fakeDaprClient{}
+			h := newShipmentsHandler(t, publisher, client)
+
+			rec := serve(h, http.MethodPost, "/orders/"+tt.orderID+"/shipments", tt.body)
+			if rec.Code != tt.expected || !strings.Contains(rec.Body.String(), tt.expectedBody) {
+				t.Fatalf("expected status code %d and %s. Got %d: %s", tt.expected, tt.expectedBody, rec.Code, rec.Body)
+			}
+
+			shipments, _, err := h.shipments.List(context.Background(), tt.orderID)
+			if err != nil {
+				t.Fatalf("couldn't list shipments: %s", err)
+			}
+			if stored := len(shipments) == 1; stored != tt.stored {
+				t.Fatalf("expected the shipment to be stored to be %t. Got %v.", tt.stored, shipments)
+			}
+			if !tt.stored {
+				return
+			}
+			if len(publisher.events) != 1 || publisher.events[0].topic != topicShipments {
+				t.Fatalf("expected an event on the %s topic. Got %v.", topicShipments, publisher.events)
+			}
+			if event, ok := publisher.events[0].data.(ShipmentCreated); !ok || event.ID != shipments[0].ID {
+				t.Fatalf("expected a ShipmentCreated event of %s. Got %v.", shipments[0].ID, publisher.events[0].data)
+			}
+		})
+	}
+}
+
+func TestTrackShipment(t *testing.T) {
+	errUnavailable := errors.New("unavailable")
+
+	tests := []struct {
+		name       string
+		shipmentID string
+		body       string
+		publisher  *mockPublisher
+		// expected is the status code of the answer, whose body contains
+		// expectedBody, and status the status stored afterwards
+		expected     int
+		expectedBody string
+		status       ShipmentStatus
+	}{
+		{
+			name: "in transit", body: `{"status":"IN_TRANSIT"}`,
+			expected: http.StatusOK, expectedBody: `"status":"IN_TRANSIT"`,
+			status: ShipmentStatusInTransit,
+		},
+		{
+			name: "delivered before transit", body: `{"status":"DELIVERED"}`,
+			expected: http.StatusConflict, expectedBody: `can't change from "CREATED" to "DELIVERED"`,
+			status: ShipmentStatusCreated,
+		},
+		{
+			name: "unknown status", body: `{"status":"LOST"}`,
+			expected: http.StatusBadRequest, expectedBody: `unknown shipment status "LOST"`,
+			status: ShipmentStatusCreated,
+		},
+		{
+			name: "unknown shipment", shipmentID: "shipment-unknown", body: `{"status":"IN_TRANSIT"}`,
+			expected: http.StatusNotFound, expectedBody: "Shipment not found",
+			status: ShipmentStatusCreated,
+		},
+		{
+			name: "unavailable broker", body: `{"status":"IN_TRANSIT"}`,
+			publisher: &mockPublisher{err: errUnavailable},
+			expected:  http.StatusServiceUnavailable, expectedBody: "Service unavailable",
+			status: ShipmentStatusCreated,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newShipmentsHandler(t, &mockPublisher{}, &fakeDaprClient{})
+			rec := serve(h, http.MethodPost, "/orders/order-2222/shipments", `{"carrier":"dhl","trackingNumber":"JD0123"}`)
+			var created Shipment
+			if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+				t.Fatalf("couldn't decode shipment: %s", err)
+			}
+			if tt.publisher != nil {
+				h.publisher = tt.publisher
+			}
+
+			shipmentID := tt.shipmentID
+			if shipmentID == "" {
+				shipmentID = created.ID
+			}
+			rec = serve(h, http.MethodPut, "/orders/order-2222/shipments/"+shipmentID+"/tracking", tt.body)
+			if rec.Code != tt.expected || !strings.Contains(rec.Body.String(), tt.expectedBody) {
+				t.Fatalf("expected status code %d and %s. Got %d: %s", tt.expected, tt.expectedBody, rec.Code, rec.Body)
+			}
+
+			rec = serve(h, http.MethodGet, "/orders/order-2222/shipments/"+created.ID, "")
+			var stored Shipment
+			if err := json.Unmarshal(rec.Body.Bytes(), &stored); err != nil {
+				t.Fatalf("couldn't decode shipment: %s", err)
+			}
+			if stored.Status != tt.status {
+				t.Fatalf("expected the shipment to be %s. Got %s.", tt.status, stored.Status)
+			}
+		})
+	}
+}
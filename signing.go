@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// cloudEventSignatureExtension is the CloudEvent extension attribute carrying
+// the detached signature of an event, the hex-encoded HMAC-SHA256 of its
+// signed attributes and data.
+const cloudEventSignatureExtension = "signature"
+
+// signedAttributes are the attributes of the CloudEvents covered by their
+// signature, along with their data. The attributes the sidecar sets, such as
+// the topic or the trace context, are left out, as they change on the way.
+var signedAttributes = []string{"id", "type", "datacontenttype", cloudEventTenantExtension, cloudEventStatusExtension}
+
+// ErrInvalidSignature is returned for the events delivered without a valid
+// signature, which were tampered with or weren't published by the app.
+var ErrInvalidSignature = errors.New("invalid event signature")
+
+// EventSigner signs the CloudEvents the app publishes, and verifies the
+// signature of those delivered to it, with the signing keys of credentials.
+type EventSigner struct {
+	credentials *Credentials
+}
+
+func NewEventSigner(credentials *Credentials) *EventSigner {
+	return &EventSigner{credentials: credentials}
+}
+
+// Sign sets the signature of event, unless there is no signing key. It fails
+// until the key is first read from the secret store.
+func (s *EventSigner) Sign(event map[string]any) error {
+	keys, ok := s.credentials.SigningKeys()
+	if !ok {
+		return errors.New("couldn't sign event: signing key not read from the secret store yet")
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	input, err := signingInput(event)
+	if err != nil {
+		return fmt.Errorf("couldn't sign event: %w", err)
+	}
+	event[cloudEventSignatureExtension] = sign(keys[0], input)
+	return nil
+}
+
+// Verify checks the signature of the CloudEvent payload against any of the
+// signing keys, the events being accepted as they are if there is none. It
+// returns ErrInvalidSignature for an event which isn't signed or whose
+// signature doesn't match, and another error until the keys are first read
+// from the secret store.
+func (s *EventSigner) Verify(payload []byte) error {
+	keys, ok := s.credentials.SigningKeys()
+	if !ok {
+		return errors.New("couldn't verify event: signing key not read from the secret store yet")
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// the numbers of the data are kept as written
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var event map[string]any
+	if err := dec.Decode(&event); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSignature, err)
+	}
+	signature, _ := event[cloudEventSignatureExtension].(string)
+	if signature == "" {
+		return fmt.Errorf("%w: event isn't signed", ErrInvalidSignature)
+	}
+	input, err := signingInput(event)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSignature, err)
+	}
+	for _, key := range keys {
+		if hmac.Equal([]byte(sign(key, input)), []byte(signature)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: signature doesn't match", ErrInvalidSignature)
+}
+
+func sign(key Secret, input []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(input)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signingInput returns the bytes the signature of event covers: a line for
+// each signed attribute, quoted and empty if missing, followed by its data,
+// decoded from data_base64, or in canonical JSON so that the sidecar encoding
+// it again doesn't change it.
+func signingInput(event map[string]any) ([]byte, error) {
+	var input bytes.Buffer
+	for _, attribute := range signedAttributes {
+		// the attributes set by the app may be typed, such as the order
+		// status, and are strings once delivered
+		var value string
+		if v, ok := event[attribute]; ok && v != nil {
+			value = fmt.Sprint(v)
+		}
+		fmt.Fprintf(&input, "%s=%q\n", attribute, value)
+	}
+	input.WriteString("data=")
+
+	if encoded, ok := event["data_base64"].(string); ok {
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data_base64: %w", err)
+		}
+		input.Write(data)
+		return input.Bytes(), nil
+	}
+	if data, ok := event["data"]; ok {
+		canonical, err := canonicalJSON(data)
+		if err != nil {
+			return nil, err
+		}
+		input.Write(canonical)
+	}
+	return input.Bytes(), nil
+}
+
+// canonicalJSON encodes v in JSON with its object keys sorted and without
+// spaces, its numbers kept as written.
+func canonicalJSON(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var decoded any
+	if err := dec.Decode(&decoded); err != nil {
+		return nil, err
+	}
+	return json.Marshal(decoded)
+}
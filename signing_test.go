@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// publishSigned publishes data with a publisher signing its events with key,
+// and returns the event as the sidecar delivers it: encoded again, with the
+// attributes of the sidecar.
+func publishSigned(t *testing.T, key Secret, data any) []byte {
+	t.Helper()
+	client := &fakeDaprClient{}
+	config := &Config{TopicAllowlist: defaultTopicAllowlist(), PublishRetry: RetryPolicy{MaxAttempts: 1}}
+	publisher := NewPublisher(client, config, NewMetrics())
+	publisher.Signer = NewEventSigner(NewCredentials(nil, SecretsConfig{}, AuthConfig{}, key, NewMetrics()))
+	ctx := WithTenant(context.Background(), "acme")
+	if err := publisher.Publish(ctx, handlerOrdersPut, topicOrders, data); err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+
+	event, ok := client.published[0].data.(map[string]any)
+	if !ok {
+		t.Fatalf("expected a CloudEvent envelope. Got %T.", client.published[0].data)
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("couldn't encode event: %s", err)
+	}
+	var delivered map[string]any
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&delivered); err != nil {
+		t.Fatalf("couldn't decode event: %s", err)
+	}
+	delivered["traceparent"] = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	delivered["pubsubname"] = pubsubName
+	payload, err = json.MarshalIndent(delivered, "", "  ")
+	if err != nil {
+		t.Fatalf("couldn't encode event: %s", err)
+	}
+	return payload
+}
+
+// tamper returns payload with its attribute set to value.
+func tamper(t *testing.T, payload []byte, attribute string, value any) []byte {
+	t.Helper()
+	var event map[string]any
+	if err := json.Unmarshal(payload, &event); err != nil {
+		t.Fatalf("couldn't decode event: %s", err)
+	}
+	event[attribute] = value
+	tampered, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("couldn't encode event: %s", err)
+	}
+	return tampered
+}
+
+func TestEventSigner(t *testing.T) {
+	signer := NewEventSigner(NewCredentials(nil, SecretsConfig{}, AuthConfig{}, "signing-key", NewMetrics()))
+	protobuf := publishSigned(t, "signing-key", newOrderStatusChanged(Order{ID: "order-1234", Status: OrderStatusPaid, Amount: 12345678901234567}, OrderStatusPending, time.Now()))
+	jsonEvent := publishSigned(t, "signing-key", Order{ID: "order-1234", Status: OrderStatusPaid, Amount: 12345678901234567})
+
+	tests := []struct {
+		name    string
+		payload []byte
+		wantErr bool
+	}{
+		{name: "protobuf event", payload: protobuf},
+		{name: "JSON event", payload: jsonEvent},
+		{name: "tampered data", payload: tamper(t, protobuf, "data_base64", "dGFtcGVyZWQ="), wantErr: true},
+		{name: "tampered JSON data", payload: tamper(t, jsonEvent, "data", map[string]any{"id": "order-1234", "status": "CANCELLED"}), wantErr: true},
+		{name: "tampered status", payload: tamper(t, protobuf, cloudEventStatusExtension, "CANCELLED"), wantErr: true},
+		{name: "tampered tenant", payload: tamper(t, protobuf, cloudEventTenantExtension, "globex"), wantErr: true},
+		{name: "unsigned event", payload: tamper(t, protobuf, cloudEventSignatureExtension, ""), wantErr: true},
+		{name: "other key", payload: publishSigned(t, "other-key", Order{ID: "order-1234", Status: OrderStatusPaid}), wantErr: true},
+		// the attributes of the sidecar aren't signed
+		{name: "trace context", payload: tamper(t, protobuf, "traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := signer.Verify(tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error: %t. Got %v.", tt.wantErr, err)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("expected ErrInvalidSignature. Got %v.", err)
+			}
+		})
+	}
+}
+
+func TestEventSignerRotation(t *testing.T) {
+	client := &fakeDaprClient{secrets: map[string]map[string]string{secretEventSigningKey: {secretEventSigningKey: "key-1"}}}
+	credentials := NewCredentials(client, SecretsConfig{Store: "app-secrets"}, AuthConfig{}, "", NewMetrics())
+	signer := NewEventSigner(credentials)
+
+	if err := signer.Sign(map[string]any{"id": "event-1"}); err == nil {
+		t.Fatal("expected an error signing before the key is read.")
+	}
+	if err := credentials.Refresh(context.Background()); err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+	signed := publishSigned(t, "key-1", Order{ID: "order-1234", Status: OrderStatusPaid})
+
+	// the events published before the rotation are still verified
+	client.secrets[secretEventSigningKey] = map[string]string{secretEventSigningKey: "key-2"}
+	if err := credentials.Refresh(context.Background()); err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+	if err := signer.Verify(signed); err != nil {
+		t.Fatalf("expected the event signed with the former key verified. Got %s.", err)
+	}
+	event := map[string]any{"id": "event-1", "data": map[string]any{"id": "order-1234"}}
+	if err := signer.Sign(event); err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+	input, _ := signingInput(event)
+	if event[cloudEventSignatureExtension] != sign("key-2", input) {
+		t.Fatalf("expected the event signed with the rotated key. Got %v.", event[cloudEventSignatureExtension])
+	}
+
+	// no more than one former key is verified
+	client.secrets[secretEventSigningKey] = map[string]string{secretEventSigningKey: "key-3"}
+	if err := credentials.Refresh(context.Background()); err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+	if err := signer.Verify(signed); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected ErrInvalidSignature. Got %v.", err)
+	}
+}
+
+func TestOrderEventSignature(t *testing.T) {
+	signed := publishSigned(t, "signing-key", Order{ID: "order-1234", Status: OrderStatusPaid})
+	tests := []struct {
+		name string
+		body []byte
+		// expected is the status answered to the sidecar
+		expected    string
+		quarantined bool
+	}{
+		{name: "signed event", body: signed, expected: eventStatusSuccess},
+		{name: "tampered event", body: tamper(t, signed, "data", map[string]any{"id": "order-1234", "status": "CANCELLED"}), expected: eventStatusDrop, quarantined: true},
+		{name: "unsigned event", body: []byte(`{"id":"event-1","data":{"id":"order-1234","status":"PAID"}}`), expected: eventStatusDrop, quarantined: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Events: EventConfig{SigningKey: "signing-key"}}
+			h := NewAppHandler(config, NewMetrics(), nil, nil)
+			h.quarantined = NewQuarantineStore(&fakeDaprClient{})
+			h.RegisterRoutes()
+
+			req := httptest.NewRequest(http.MethodPost, routeOrderEvents, strings.NewReader(string(tt.body)))
+			req.Header.Set("Content-Type", contentTypeCloudEvents)
+			rec := httptest.NewRecorder()
+			h.router.ServeHTTP(rec, req)
+
+			var answer struct {
+				Status string `json:"status"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&answer); err != nil || answer.Status != tt.expected {
+				t.Fatalf("expected status %s. Got %+v: %v", tt.expected, answer, err)
+			}
+			events, err := h.quarantined.List(context.Background())
+			if err != nil {
+				t.Fatalf("couldn't list quarantined events: %s", err)
+			}
+			if quarantined := len(events) == 1 && strings.Contains(events[0].Error, ErrInvalidSignature.Error()); quarantined != tt.quarantined {
+				t.Fatalf("expected quarantined for its signature: %t. Got %+v.", tt.quarantined, events)
+			}
+		})
+	}
+}
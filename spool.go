@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	defaultPublishSpoolFlushInterval = 5 * time.Second
+
+	// spoolFile is the database of the spool, in its directory.
+	spoolFile = "spool.db"
+	// spoolOpenTimeout is the time the spool waits for the lock of its
+	// database, held by another app sharing its directory.
+	spoolOpenTimeout = 5 * time.Second
+)
+
+// queuedUpdate is an order status change whose event is yet to be published,
+// kept by the PublishSpool, if any, until it is.
+type queuedUpdate struct {
+	// ID is the key of the update, in the order the updates were spooled.
+	ID    string `json:"-"`
+	Topic string `json:"topic"`
+	// Order is the order as stored by the update, over the version ETag of
+	// Previous, none if the order is new.
+	Order    Order     `json:"order"`
+	Previous Order     `json:"previous"`
+	ETag     string    `json:"etag,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// PublishSpool keeps the status changes queued for publishing in a bbolt
+// database of a directory, so that they survive the restarts of the app and
+// the outages of the sidecar. Each update is added and removed by a
+// transaction synced to disk before it returns, and read back in the order it
+// was added. An update is in flight from the time it is spooled or flushed
+// until it is either done or released, and isn't flushed meanwhile.
+type PublishSpool struct {
+	db      *bolt.DB
+	metrics *Metrics
+
+	mu       sync.Mutex
+	inFlight map[string]bool
+}
+
+var spoolBucket = []byte("updates")
+
+// NewPublishSpool opens the spool of dir, creating the directory if needed.
+// The updates found there are flushed, having been spooled before a restart.
+func NewPublishSpool(dir string, metrics *Metrics) (*PublishSpool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("couldn't create publish spool %s: %w", dir, err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, spoolFile), 0o600, &bolt.Options{Timeout: spoolOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open publish spool %s: %w", dir, err)
+	}
+	var size int
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(spoolBucket)
+		if err != nil {
+			return err
+		}
+		size = bucket.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("couldn't open publish spool %s: %w", dir, err)
+	}
+	metrics.PublishSpoolSize.Set(float64(size))
+	return &PublishSpool{db: db, metrics: metrics, inFlight: map[string]bool{}}, nil
+}
+
+// Close closes the database of the spool, once nothing is spooled anymore.
+func (s *PublishSpool) Close() error {
+	return s.db.Close()
+}
+
+// Put writes update to the spool, setting its ID, in flight.
+func (s *PublishSpool) Put(update *queuedUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(spoolBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		// the keys are sorted as bytes, the sequence being padded for them
+		// to be sorted in the order the updates were spooled
+		update.ID = fmt.Sprintf("%020d", seq)
+		data, err := json.Marshal(update)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(update.ID), data)
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't spool update: %w", err)
+	}
+	s.inFlight[update.ID] = true
+	s.metrics.PublishSpoolSize.Inc()
+	return nil
+}
+
+// Done removes the update id once its event is published, or given up on.
+func (s *PublishSpool) Done(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inFlight, id)
+	var removed bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(spoolBucket)
+		if bucket.Get([]byte(id)) == nil {
+			return nil
+		}
+		removed = true
+		return bucket.Delete([]byte(id))
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't remove spooled update %s: %w", id, err)
+	}
+	if removed {
+		s.metrics.PublishSpoolSize.Dec()
+	}
+	return nil
+}
+
+// Release keeps the update id in the spool, for its event to be published by
+// a later flush.
+func (s *PublishSpool) Release(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inFlight, id)
+}
+
+// Flush returns the spooled updates which aren't in flight, oldest first,
+// and sets them in flight. An update which can't be decoded is left in the
+// spool, for an operator to look into.
+func (s *PublishSpool) Flush() ([]*queuedUpdate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var updates []*queuedUpdate
+	var errs []error
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(spoolBucket).ForEach(func(key, data []byte) error {
+			id := string(key)
+			if s.inFlight[id] {
+				return nil
+			}
+			update := &queuedUpdate{ID: id}
+			if err := json.Unmarshal(data, update); err != nil {
+				errs = append(errs, fmt.Errorf("couldn't decode spooled update %s: %w", id, err))
+				return nil
+			}
+			updates = append(updates, update)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read publish spool: %w", err)
+	}
+	for _, update := range updates {
+		s.inFlight[update.ID] = true
+	}
+	if len(errs) > 0 {
+		return updates, fmt.Errorf("couldn't read %d spooled updates: %w", len(errs), errs[0])
+	}
+	return updates, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPublishSpool(t *testing.T) {
+	dir := t.TempDir()
+	metrics := NewMetrics()
+	spool, err := NewPublishSpool(dir, metrics)
+	if err != nil {
+		t.Fatalf("couldn't open spool: %s", err)
+	}
+
+	first := &queuedUpdate{Topic: topicOrders, Order: Order{ID: "order-1111", Status: OrderStatusPaid, Tenant: "acme"}, ETag: "1", Time: time.Now().UTC()}
+	second := &queuedUpdate{Topic: topicOrders, Order: Order{ID: "order-2222", Status: OrderStatusPending}}
+	for _, update := range []*queuedUpdate{first, second} {
+		if err := spool.Put(update); err != nil {
+			t.Fatalf("couldn't spool update: %s", err)
+		}
+	}
+
+	// the updates in flight aren't flushed
+	if updates, err := spool.Flush(); err != nil || len(updates) != 0 {
+		t.Fatalf("expected no update flushed. Got %v: %v", updates, err)
+	}
+	spool.Release(first.ID)
+	updates, err := spool.Flush()
+	if err != nil || len(updates) != 1 || updates[0].ID != first.ID || !reflect.DeepEqual(updates[0].Order, first.Order) || !updates[0].Time.Equal(first.Time) {
+		t.Fatalf("expected the released update flushed. Got %v: %v", updates, err)
+	}
+	if err := spool.Done(first.ID); err != nil {
+		t.Fatalf("couldn't remove update: %s", err)
+	}
+	if err := spool.Close(); err != nil {
+		t.Fatalf("couldn't close spool: %s", err)
+	}
+
+	// the updates left are flushed once the app restarted
+	restarted, err := NewPublishSpool(dir, metrics)
+	if err != nil {
+		t.Fatalf("couldn't open spool: %s", err)
+	}
+	defer restarted.Close()
+	updates, err = restarted.Flush()
+	if err != nil || len(updates) != 1 || updates[0].ID != second.ID {
+		t.Fatalf("expected the second update flushed. Got %v: %v", updates, err)
+	}
+	if got := testutil.ToFloat64(metrics.PublishSpoolSize); got != 1 {
+		t.Fatalf("expected 1 spooled update. Got %f.", got)
+	}
+}
+
+func TestPublishSpoolOrder(t *testing.T) {
+	spool, err := NewPublishSpool(t.TempDir(), NewMetrics())
+	if err != nil {
+		t.Fatalf("couldn't open spool: %s", err)
+	}
+	defer spool.Close()
+
+	var spooled []string
+	for i := 0; i < 12; i++ {
+		update := &queuedUpdate{Topic: topicOrders, Order: Order{ID: fmt.Sprintf("order-%d", i), Status: OrderStatusPending}}
+		if err := spool.Put(update); err != nil {
+			t.Fatalf("couldn't spool update: %s", err)
+		}
+		spool.Release(update.ID)
+		spooled = append(spooled, update.Order.ID)
+	}
+
+	updates, err := spool.Flush()
+	if err != nil {
+		t.Fatalf("couldn't flush spool: %s", err)
+	}
+	var flushed []string
+	for _, update := range updates {
+		flushed = append(flushed, update.Order.ID)
+	}
+	if !slices.Equal(flushed, spooled) {
+		t.Fatalf("expected the updates flushed in the order spooled %v. Got %v.", spooled, flushed)
+	}
+}
+
+func TestPublishSpoolOutage(t *testing.T) {
+	tests := []struct {
+		name       string
+		publishErr error
+		// stored is whether the order is stored once the spool is flushed,
+		// and published whether its event is published
+		stored    bool
+		published bool
+	}{
+		{name: "sidecar unavailable", publishErr: errors.New("unavailable"), stored: true, published: true},
+		{name: "topic not allowed", publishErr: ErrTopicNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := &mockPublisher{err: tt.publishErr}
+			store := newMockOrderRepository()
+			h := newMockHandler(publisher, store)
+			h.publishQueue = NewPublishQueue(PublishQueueConfig{Enabled: true, Size: 1, Workers: 1}, h.metrics)
+			spool, err := NewPublishSpool(t.TempDir(), h.metrics)
+			if err != nil {
+				t.Fatalf("couldn't open spool: %s", err)
+			}
+			defer spool.Close()
+			h.publishQueue.Spool = spool
+			h.publishQueue.Start()
+			h.RegisterRoutes()
+
+			req := httptest.NewRequest(http.MethodPut, "/orders/order-1234", strings.NewReader(`{"status":"PENDING"}`))
+			req.Header.Set("Content-Type", contentTypeJSON)
+			rec := httptest.NewRecorder()
+			h.router.ServeHTTP(rec, req)
+			if rec.Code != http.StatusAccepted {
+				t.Fatalf("expected status code %d. Got %d: %s", http.StatusAccepted, rec.Code, rec.Body)
+			}
+
+			// the sidecar is back, and the spool flushed once
+			deadline := time.Now().Add(time.Second)
+			for testutil.ToFloat64(h.metrics.PublishQueueDepth) != 0 || len(spoolInFlight(spool)) != 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("expected the publish to be run.")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			publisher.mu.Lock()
+			publisher.err = nil
+			publisher.mu.Unlock()
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			h.FlushPublishSpool(ctx, time.Second)
+			h.publishQueue.Close()
+			h.publishQueue.Wait()
+
+			_, _, err = store.Get(context.Background(), "order-1234")
+			if stored := err == nil; stored != tt.stored {
+				t.Fatalf("expected the order stored: %t. Got %v.", tt.stored, err)
+			}
+			if published := len(publisher.events) == 1; published != tt.published {
+				t.Fatalf("expected the event published: %t. Got %v.", tt.published, publisher.events)
+			}
+			if got := testutil.ToFloat64(h.metrics.PublishSpoolSize); got != 0 {
+				t.Fatalf("expected an empty spool. Got %f.", got)
+			}
+		})
+	}
+}
+
+// spoolInFlight returns the IDs of the updates of spool in flight.
+func spoolInFlight(spool *PublishSpool) []string {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	var ids []string
+	for id := range spool.inFlight {
+		ids = append(ids, id)
+	}
+	return ids
+}
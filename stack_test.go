@@ -0,0 +1,1995 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/etiennetremel/testcontainers-dapr-example/testdapr"
+	"github.com/testcontainers/testcontainers-go"
+	tcexec "github.com/testcontainers/testcontainers-go/exec"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+type appContainer struct {
+	testcontainers.Container
+	URI string
+	// PprofURI is the address of the pprof endpoints of the app, if enabled.
+	PprofURI string
+}
+
+// Stack is the set of containers started for an integration test. All of its
+// state is scoped to the instance: containers get unique names and join a
+// network of their own, where they reach each other through fixed aliases, so
+// several stacks can run side by side in one test process.
+type Stack struct {
+	ID string
+
+	network         testcontainers.Network
+	networkName     string
+	subscriber      *appContainer
+	app             *appContainer
+	daprApp         *testdapr.Container
+	replica         *appContainer
+	daprReplica     *testdapr.Container
+	daprIntegration *testdapr.Container
+	redis           testcontainers.Container
+	broker          testcontainers.Container
+	postgres        testcontainers.Container
+	webhookReceiver *appContainer
+	payments        *appContainer
+	daprPayments    *testdapr.Container
+	schemaRegistry  *appContainer
+	placement       testcontainers.Container
+	scheduler       testcontainers.Container
+	sentry          testcontainers.Container
+	otelCollector   testcontainers.Container
+	jaeger          *appContainer
+	prometheus      *appContainer
+	toxiproxy       *appContainer
+	// certsDir holds the issuer credentials of Sentry, and trustAnchors the
+	// root certificate they chain to.
+	certsDir     string
+	trustAnchors []byte
+	// prometheusDir holds the scrape configuration of Prometheus.
+	prometheusDir string
+	// appTLSDir holds the certificate the app serves HTTPS with, and appTLS
+	// the configuration of its clients.
+	appTLSDir string
+	appTLS    *tls.Config
+	// componentsDir holds the components rendered for the sidecars, and
+	// pubsubComponent the pubsub component of the sidecar of the app.
+	componentsDir   string
+	pubsubComponent string
+
+	Topology Topology
+
+	options stackOptions
+	logs    testLog
+}
+
+type stackOptions struct {
+	daprAPIToken string
+	appEnv       map[string]string
+	pubsub       string
+
+	webhookReceiver  bool
+	webhookFailFirst int
+
+	payments         bool
+	paymentsDeclined []string
+	refundsRefused   []string
+
+	subscriberFailFirst     int
+	declarativeSubscription bool
+	// bulkMaxMessages and bulkMaxAwait bound the bulk deliveries to the
+	// subscriber, the defaults of the subscriber applying if zero.
+	bulkMaxMessages int
+	bulkMaxAwait    time.Duration
+
+	schemaRegistry bool
+
+	placement  bool
+	scheduler  bool
+	mtls       bool
+	tracing    bool
+	secrets    bool
+	prometheus bool
+	toxiproxy  bool
+
+	withoutSidecar bool
+	replica        bool
+	appTLS         bool
+	pprof          bool
+}
+
+// StackOption customizes the stack started by setupApp.
+type StackOption func(*stackOptions)
+
+// WithDaprAPIToken starts the app sidecar with API token authentication
+// enabled and configures the app to send the token.
+func WithDaprAPIToken(token string) StackOption {
+	return func(o *stackOptions) {
+		o.daprAPIToken = token
+	}
+}
+
+// WithAppEnv sets additional environment variables on the app container.
+func WithAppEnv(env map[string]string) StackOption {
+	return func(o *stackOptions) {
+		if o.appEnv == nil {
+			o.appEnv = map[string]string{}
+		}
+		for k, v := range env {
+			o.appEnv[k] = v
+		}
+	}
+}
+
+// WithWebhookReceiver starts a container recording the webhook notifications
+// it receives at http://webhook-receiver:8080/hooks, provided they are
+// signed with webhookSecret. The first failFirst notifications are answered
+// with a 503.
+func WithWebhookReceiver(failFirst int) StackOption {
+	return func(o *stackOptions) {
+		o.webhookReceiver = true
+		o.webhookFailFirst = failFirst
+	}
+}
+
+// WithPayments starts the stub payments app of testdata/payments and its
+// sidecar, and has the app verify through it the charge of the orders
+// changing to paid and reverse the charge of the orders refunded. The charges
+// of the orders declined are declined.
+func WithPayments(declined ...string) StackOption {
+	return func(o *stackOptions) {
+		o.payments = true
+		o.paymentsDeclined = declined
+	}
+}
+
+// WithRefusedRefunds has the payments app started by WithPayments refuse to
+// reverse the charge of the orders refused.
+func WithRefusedRefunds(refused ...string) StackOption {
+	return func(o *stackOptions) {
+		o.refundsRefused = refused
+	}
+}
+
+// paymentsAppID is the app ID of the sidecar of the payments app.
+const paymentsAppID = "payments"
+
+// WithSchemaRegistry starts a Confluent compatible schema registry at
+// http://schema-registry:8080 and configures the app to publish its events
+// in Avro with the schemas registered there.
+func WithSchemaRegistry() StackOption {
+	return func(o *stackOptions) {
+		o.schemaRegistry = true
+		WithAppEnv(map[string]string{
+			"EVENT_ENCODING":      EventEncodingAvro,
+			"SCHEMA_REGISTRY_URL": schemaRegistryURL,
+		})(o)
+	}
+}
+
+// WithFlakySubscriber has the subscriber fail the first failFirst deliveries
+// of every event, which the sidecars retry as resiliency.yaml says.
+func WithFlakySubscriber(failFirst int) StackOption {
+	return func(o *stackOptions) {
+		o.subscriberFailFirst = failFirst
+	}
+}
+
+// WithBulkSubscribe has the sidecar of the subscriber deliver up to
+// maxMessages events at once, waiting at most maxAwait for them.
+func WithBulkSubscribe(maxMessages int, maxAwait time.Duration) StackOption {
+	return func(o *stackOptions) {
+		o.bulkMaxMessages = maxMessages
+		o.bulkMaxAwait = maxAwait
+	}
+}
+
+// WithDeclarativeSubscription has the subscriber subscribe to the orders
+// topic through subscription.yaml, loaded by its sidecar, rather than
+// programmatically.
+func WithDeclarativeSubscription() StackOption {
+	return func(o *stackOptions) {
+		o.declarativeSubscription = true
+	}
+}
+
+// WithPlacement starts the Dapr placement service at placement:50005 and
+// registers both sidecars with it, so that actors can be tested.
+func WithPlacement() StackOption {
+	return func(o *stackOptions) {
+		o.placement = true
+	}
+}
+
+// WithScheduler starts the Dapr scheduler service at scheduler:50006 and
+// registers both sidecars with it, so that the jobs API can be tested. Jobs
+// scheduled through dapr-integration are delivered to the subscriber.
+func WithScheduler() StackOption {
+	return func(o *stackOptions) {
+		o.scheduler = true
+	}
+}
+
+// WithMTLS starts the Dapr Sentry service at sentry:50001, with trust anchors
+// generated for the stack, and enables mTLS on both sidecars.
+func WithMTLS() StackOption {
+	return func(o *stackOptions) {
+		o.mtls = true
+	}
+}
+
+// WithTracing starts an OpenTelemetry collector exporting to Jaeger, and has
+// both sidecars sample and export every trace to the collector.
+func WithTracing() StackOption {
+	return func(o *stackOptions) {
+		o.tracing = true
+	}
+}
+
+// WithSecretStore loads the app-secrets secret store, holding the API keys
+// of testdata/app-secrets.json, in the sidecar of the app, which reloads it
+// as it changes, and has the app read its credentials from the store every
+// second. The hot reload configuration of the sidecar replaces the tracing
+// one, the options being exclusive.
+func WithSecretStore() StackOption {
+	return func(o *stackOptions) {
+		o.secrets = true
+	}
+}
+
+// WithPrometheus starts Prometheus, whose API is exposed on port 9090,
+// scraping the metrics of the app and of both sidecars.
+func WithPrometheus() StackOption {
+	return func(o *stackOptions) {
+		o.prometheus = true
+	}
+}
+
+// WithPprof enables the pprof endpoints of the app, exposed on port 6060.
+func WithPprof() StackOption {
+	return func(o *stackOptions) {
+		o.pprof = true
+	}
+}
+
+// WithToxiproxy starts Toxiproxy, whose API is exposed on port 8474, between
+// the app and its sidecar, and between the sidecar and Redis, which must then
+// be the pubsub broker. Toxics are added to the proxySidecar and proxyRedis
+// proxies.
+func WithToxiproxy() StackOption {
+	return func(o *stackOptions) {
+		o.toxiproxy = true
+	}
+}
+
+// WithoutSidecar doesn't start the sidecar of the app, which then runs with an
+// unreachable DAPR_URL, so that tests can check how it copes without it.
+func WithoutSidecar() StackOption {
+	return func(o *stackOptions) {
+		o.withoutSidecar = true
+	}
+}
+
+// WithReplica starts a second replica of the app, app-2, along with its own
+// sidecar, dapr-app-2, under the same app ID, so that tests can check how the
+// replicas share the work.
+func WithReplica() StackOption {
+	return func(o *stackOptions) {
+		o.replica = true
+	}
+}
+
+// resiliencyPolicy is the resiliency policy of the deliveries of the pubsub
+// component, loaded by the sidecars along with their components.
+const resiliencyPolicy = "./resiliency.yaml"
+
+// declarativeSubscription subscribes the subscriber to the orders topic, in
+// place of its /dapr/subscribe endpoint.
+const declarativeSubscription = "./subscription.yaml"
+
+// WithAppTLS has the app serve HTTPS with a certificate generated for the
+// stack, and its sidecar call it over HTTPS.
+func WithAppTLS() StackOption {
+	return func(o *stackOptions) {
+		o.appTLS = true
+	}
+}
+
+// sentryAddress is the address of the Sentry service, from within the stack
+// network.
+const sentryAddress = "sentry:50001"
+
+// schedulerAddress is the address of the scheduler service, from within the
+// stack network.
+const schedulerAddress = "scheduler:50006"
+
+// placementAddress is the address of the placement service, from within the
+// stack network.
+const placementAddress = "placement:50005"
+
+// Pubsub brokers the stack can run, selected with the -pubsub flag.
+const (
+	pubsubRedis    = "redis"
+	pubsubKafka    = "kafka"
+	pubsubRabbitMQ = "rabbitmq"
+	pubsubNATS     = "nats"
+	pubsubInMemory = "inmemory"
+)
+
+// pubsubBroker describes how to run a broker of the pubsub component.
+type pubsubBroker struct {
+	// template is the template of the pubsub component using the broker, in
+	// componentTemplates.
+	template string
+	// address is the host:port address of the broker in the stack network.
+	address string
+	// request returns the container of the broker, which joins the stack
+	// network under the name of the broker. It is nil for Redis, which the
+	// stack always runs.
+	request func() testcontainers.ContainerRequest
+	// setup, if set, prepares the broker once it is running and before the
+	// sidecars start.
+	setup func(ctx context.Context, s *Stack) error
+	// local is set for brokers running within each sidecar, whose events
+	// only reach the subscriptions of the app publishing them.
+	local bool
+}
+
+var pubsubBrokers = map[string]pubsubBroker{
+	pubsubRedis:    {template: "pubsub-redis.yaml.tmpl", address: "redis:6379"},
+	pubsubKafka:    {template: "pubsub-kafka.yaml.tmpl", address: "kafka:9092", request: kafkaRequest},
+	pubsubRabbitMQ: {template: "pubsub-rabbitmq.yaml.tmpl", address: "rabbitmq:5672", request: rabbitMQRequest},
+	pubsubNATS:     {template: "pubsub-jetstream.yaml.tmpl", address: "nats:4222", request: natsRequest, setup: createJetStream},
+	pubsubInMemory: {template: "pubsub-inmemory.yaml.tmpl", local: true},
+}
+
+var pubsubFlag = flag.String("pubsub", pubsubRedis, "broker of the pubsub component of integration tests, redis, kafka, rabbitmq, nats or inmemory")
+
+// WithPubsub sets the broker of the pubsub component, overriding the -pubsub
+// flag.
+func WithPubsub(broker string) StackOption {
+	return func(o *stackOptions) {
+		o.pubsub = broker
+	}
+}
+
+// schemaRegistryURL is the base URL of the Confluent compatible API of the
+// registry, from within the stack network.
+const schemaRegistryURL = "http://schema-registry:8080/apis/ccompat/v7"
+
+func newStackID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// name returns the container name of service, unique to the stack.
+func (s *Stack) name(service string) string {
+	return fmt.Sprintf("%s-%s", service, s.ID)
+}
+
+// attach joins req to the stack network under alias, and streams the logs of
+// the container to the test log as soon as it starts.
+func (s *Stack) attach(req *testcontainers.ContainerRequest, alias string) {
+	req.Name = s.name(alias)
+	req.Labels = sessionLabels(s.ID)
+	req.Hostname = alias
+	req.Networks = []string{s.networkName}
+	req.NetworkAliases = map[string][]string{s.networkName: {alias}}
+	req.WaitingFor = followLogs{
+		consumer: containerLog{name: req.Name, log: &s.logs},
+		strategy: req.WaitingFor,
+	}
+}
+
+// sidecar attaches a daprd container to the stack network under alias.
+func (s *Stack) sidecar(alias string) testcontainers.CustomizeRequestOption {
+	return func(req *testcontainers.GenericContainerRequest) {
+		s.attach(&req.ContainerRequest, alias)
+	}
+}
+
+// appClient returns the client of the app, which trusts its certificate when
+// it serves HTTPS.
+func (s *Stack) appClient() *http.Client {
+	if s.appTLS == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: s.appTLS}}
+}
+
+// endpoint returns the host address at which port of c is reachable.
+func endpoint(ctx context.Context, c testcontainers.Container, port nat.Port) (string, error) {
+	host, err := c.Host(ctx)
+	if err != nil {
+		return "", err
+	}
+	mappedPort, err := c.MappedPort(ctx, port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, mappedPort.Port()), nil
+}
+
+// subscriberEvent is an event recorded by the subscriber of
+// testdata/subscriber.
+type subscriberEvent struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	DataContentType string `json:"datacontenttype"`
+	DataSchema      string `json:"dataschema"`
+	Topic           string `json:"topic"`
+	Data            []byte `json:"data"`
+	// Envelope is the CloudEvent as delivered to the subscriber.
+	Envelope json.RawMessage `json:"envelope"`
+}
+
+// eventsTimeout bounds the time the tests wait for events to be delivered,
+// raised with -events-timeout on slow machines.
+var eventsTimeout = flag.Duration("events-timeout", 30*time.Second, "time integration tests wait for events to be delivered")
+
+// startSubscriber runs the subscriber of testdata/subscriber on the stack
+// network, where its sidecar delivers the events of the orders and shipments
+// topics.
+func (s *Stack) startSubscriber(ctx context.Context) error {
+	req := testcontainers.ContainerRequest{
+		ExposedPorts: []string{"8080/tcp"},
+		WaitingFor:   wait.ForHTTP("/health").WithPort("8080/tcp"),
+		Env: map[string]string{
+			"PUBSUB_NAME": pubsubName,
+			"TOPIC":       topicOrders + "," + topicOrdersPriority + "," + topicShipments,
+			"FAIL_FIRST":  strconv.Itoa(s.options.subscriberFailFirst),
+			"DECLARATIVE": strconv.FormatBool(s.options.declarativeSubscription),
+			// the subscriber keeps the events it processed in a state store
+			// of its sidecar, so that it doesn't record redeliveries
+			"PROCESSED_STORE":    "processed-events",
+			"DAPR_HTTP_ENDPOINT": "http://dapr-integration:" + testdapr.HTTPPort.Port(),
+		},
+		FromDockerfile: testcontainers.FromDockerfile{
+			Context:    "./testdata/subscriber",
+			Dockerfile: "Dockerfile",
+			KeepImage:  true,
+			Repo:       builtImageRepo("subscriber"),
+			Tag:        sessionID,
+		},
+	}
+	if s.options.bulkMaxMessages > 0 {
+		req.Env["BULK_MAX_MESSAGES"] = strconv.Itoa(s.options.bulkMaxMessages)
+		req.Env["BULK_MAX_AWAIT_MS"] = strconv.FormatInt(s.options.bulkMaxAwait.Milliseconds(), 10)
+	}
+	s.attach(&req, "integration")
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		return err
+	}
+	addr, err := endpoint(ctx, c, "8080/tcp")
+	if err != nil {
+		return errors.Join(err, c.Terminate(ctx))
+	}
+	s.subscriber = &appContainer{Container: c, URI: "http://" + addr}
+	return s.Topology.addContainer(ctx, c, req)
+}
+
+// receivedEvents returns the events the subscriber received so far, in the
+// order it received them.
+func (s *Stack) receivedEvents(ctx context.Context) ([]subscriberEvent, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.subscriber.URI+"/received", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var events []subscriberEvent
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+		return nil, fmt.Errorf("couldn't decode received events: %w", err)
+	}
+	return events, nil
+}
+
+// deliveryAttempts returns the number of times the sidecar of the subscriber
+// delivered every event, by event ID.
+func (s *Stack) deliveryAttempts(ctx context.Context) (map[string]int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.subscriber.URI+"/attempts", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var attempts map[string]int
+	if err := json.NewDecoder(resp.Body).Decode(&attempts); err != nil {
+		return nil, fmt.Errorf("couldn't decode delivery attempts: %w", err)
+	}
+	return attempts, nil
+}
+
+// bulkDeliveries returns the number of events of every bulk delivery to the
+// subscriber, in the order they were delivered.
+func (s *Stack) bulkDeliveries(ctx context.Context) ([]int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.subscriber.URI+"/batches", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var batches []int
+	if err := json.NewDecoder(resp.Body).Decode(&batches); err != nil {
+		return nil, fmt.Errorf("couldn't decode bulk deliveries: %w", err)
+	}
+	return batches, nil
+}
+
+// expiredEvents returns the IDs of the events the subscriber dropped as
+// they had expired, in the order they were delivered.
+func (s *Stack) expiredEvents(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.subscriber.URI+"/expired", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var expired []string
+	if err := json.NewDecoder(resp.Body).Decode(&expired); err != nil {
+		return nil, fmt.Errorf("couldn't decode expired events: %w", err)
+	}
+	return expired, nil
+}
+
+// waitForEvents polls the subscriber until it received at least n events,
+// and returns them.
+func (s *Stack) waitForEvents(ctx context.Context, n int) ([]subscriberEvent, error) {
+	ctx, cancel := context.WithTimeout(ctx, *eventsTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		events, err := s.receivedEvents(ctx)
+		if err == nil && len(events) >= n {
+			return events, nil
+		}
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = fmt.Errorf("received %d events, expected %d: %s", len(events), n, describeEvents(events))
+			}
+			// the logs of the sidecars, streamed to the test log, tell
+			// where the events got lost
+			return events, fmt.Errorf("%w after %s: %s, see the logs of the stack", ctx.Err(), *eventsTimeout, err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// appNotReadyError is returned by waitForReady when the app never answered
+// /readyz.
+type appNotReadyError struct {
+	err error
+}
+
+func (e *appNotReadyError) Error() string {
+	return fmt.Sprintf("app not ready: %s", e.err)
+}
+
+func (e *appNotReadyError) Unwrap() error {
+	return e.err
+}
+
+// waitForReady polls /readyz of app until it answers, the app holding its
+// traffic until it found its sidecar ready.
+func (s *Stack) waitForReady(ctx context.Context, app *appContainer) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, app.URI+"/readyz", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := s.appClient().Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+			err = fmt.Errorf("status code %d", resp.StatusCode)
+		}
+		select {
+		case <-ctx.Done():
+			return &appNotReadyError{err: err}
+		case <-ticker.C:
+		}
+	}
+}
+
+// describeEvents lists the topics and types of events.
+func describeEvents(events []subscriberEvent) string {
+	if len(events) == 0 {
+		return "none"
+	}
+	described := make([]string, len(events))
+	for i, event := range events {
+		described[i] = event.Topic + "/" + event.Type
+	}
+	return strings.Join(described, ", ")
+}
+
+// setupApp starts a stack, whose containers log to the log of t.
+func setupApp(ctx context.Context, t testing.TB, opts ...StackOption) (*Stack, error) {
+	id, err := newStackID()
+	if err != nil {
+		return nil, err
+	}
+	stack := &Stack{ID: id, options: stackOptions{pubsub: *pubsubFlag}}
+	stack.logs.use(t)
+	for _, opt := range opts {
+		opt(&stack.options)
+	}
+	broker, ok := pubsubBrokers[stack.options.pubsub]
+	if !ok {
+		return nil, fmt.Errorf("unknown pubsub broker %q", stack.options.pubsub)
+	}
+	if stack.options.toxiproxy && stack.options.pubsub != pubsubRedis {
+		return nil, fmt.Errorf("toxiproxy requires the %s pubsub broker, not %s", pubsubRedis, stack.options.pubsub)
+	}
+	if stack.options.withoutSidecar && (stack.options.toxiproxy || stack.options.prometheus || stack.options.replica) {
+		return nil, errors.New("toxiproxy, prometheus and replicas require the sidecar of the app")
+	}
+	if stack.options.replica && stack.options.toxiproxy {
+		return nil, errors.New("toxiproxy only proxies the sidecar of the first replica")
+	}
+	if stack.options.appTLS && stack.options.prometheus {
+		return nil, errors.New("prometheus scrapes the app over HTTP")
+	}
+	stack.networkName = "dapr-" + id
+
+	network, err := testcontainers.GenericNetwork(ctx, testcontainers.GenericNetworkRequest{
+		NetworkRequest: testcontainers.NetworkRequest{
+			Name:           stack.networkName,
+			CheckDuplicate: true,
+			Labels:         sessionLabels(id),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	stack.network = network
+
+	// Redis
+	redisReq := testcontainers.ContainerRequest{
+		Image:        redisImage,
+		ExposedPorts: []string{"6379/tcp"},
+		WaitingFor:   wait.ForLog("Ready to accept connections tcp"),
+	}
+	stack.attach(&redisReq, "redis")
+	stack.redis, err = testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: redisReq,
+		Started:          true,
+	})
+	if err != nil {
+		return stack, err
+	}
+	if err := stack.Topology.addContainer(ctx, stack.redis, redisReq); err != nil {
+		return stack, err
+	}
+
+	// Postgres, used as query-capable state store
+	postgresReq := testcontainers.ContainerRequest{
+		Image:        postgresImage,
+		ExposedPorts: []string{"5432/tcp"},
+		Env: map[string]string{
+			"POSTGRES_USER":     "postgres",
+			"POSTGRES_PASSWORD": "postgres",
+			"POSTGRES_DB":       "orders",
+		},
+		// the server restarts once after the init scripts ran
+		WaitingFor: wait.ForLog("database system is ready to accept connections").WithOccurrence(2),
+	}
+	stack.attach(&postgresReq, "postgres")
+	stack.postgres, err = testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: postgresReq,
+		Started:          true,
+	})
+	if err != nil {
+		return stack, err
+	}
+	if err := stack.Topology.addContainer(ctx, stack.postgres, postgresReq); err != nil {
+		return stack, err
+	}
+
+	if broker.request != nil {
+		if err := stack.startBroker(ctx, broker); err != nil {
+			return stack, err
+		}
+	}
+	if stack.options.webhookReceiver {
+		if err := stack.startWebhookReceiver(ctx); err != nil {
+			return stack, err
+		}
+	}
+	if stack.options.schemaRegistry {
+		if err := stack.startSchemaRegistry(ctx); err != nil {
+			return stack, err
+		}
+	}
+	if stack.options.placement {
+		if err := stack.startPlacement(ctx); err != nil {
+			return stack, err
+		}
+	}
+	if stack.options.scheduler {
+		if err := stack.startScheduler(ctx); err != nil {
+			return stack, err
+		}
+	}
+	if stack.options.mtls {
+		if err := stack.startSentry(ctx); err != nil {
+			return stack, err
+		}
+	}
+	if stack.options.tracing {
+		if err := stack.startTracing(ctx); err != nil {
+			return stack, err
+		}
+	}
+	if stack.options.payments {
+		if err := stack.startPayments(ctx); err != nil {
+			return stack, err
+		}
+	}
+	daprURL := "dapr-app:50001"
+	pubsub := componentParams{
+		Name:       pubsubName,
+		Host:       broker.address,
+		Stream:     jetStreamName,
+		ConsumerID: "{appID}",
+	}
+	if stack.options.toxiproxy {
+		if err := stack.startToxiproxy(ctx); err != nil {
+			return stack, err
+		}
+		daprURL = "toxiproxy:50001"
+		pubsub.Host = "toxiproxy:6379"
+	}
+	stack.componentsDir, err = os.MkdirTemp("", "components-"+id)
+	if err != nil {
+		return stack, err
+	}
+	stack.pubsubComponent, err = renderComponent(filepath.Join(stack.componentsDir, "dapr-app"), broker.template, pubsub)
+	if err != nil {
+		return stack, err
+	}
+
+	if stack.options.appTLS {
+		stack.appTLSDir, err = os.MkdirTemp("", "app-tls-"+id)
+		if err != nil {
+			return stack, err
+		}
+		ca, err := writeAppCertificate(stack.appTLSDir, "app", "app-2")
+		if err != nil {
+			return stack, err
+		}
+		// the app is dialed at the mapped port of the host
+		stack.appTLS = appTLSConfig(ca, "app")
+	}
+	stack.app, err = stack.startApp(ctx, "app", daprURL)
+	if err != nil {
+		return stack, err
+	}
+
+	// DAPR
+	if !stack.options.withoutSidecar {
+		stack.daprApp, err = stack.startAppSidecar(ctx, "app", "dapr-app")
+		if err != nil {
+			return stack, err
+		}
+		if err := stack.waitForReady(ctx, stack.app); err != nil {
+			return stack, err
+		}
+	}
+
+	// the replica and its sidecar share the app ID, and thus the consumer
+	// group of the subscriptions of the app
+	if stack.options.replica {
+		stack.replica, err = stack.startApp(ctx, "app-2", "dapr-app-2:50001")
+		if err != nil {
+			return stack, err
+		}
+		stack.daprReplica, err = stack.startAppSidecar(ctx, "app-2", "dapr-app-2")
+		if err != nil {
+			return stack, err
+		}
+		if err := stack.waitForReady(ctx, stack.replica); err != nil {
+			return stack, err
+		}
+	}
+
+	// integration subscriber, which records the events of the orders topic
+	if err := stack.startSubscriber(ctx); err != nil {
+		return stack, err
+	}
+
+	// DAPR Integration, which reaches the broker directly
+	pubsub.Host = broker.address
+	integrationPubsub, err := renderComponent(filepath.Join(stack.componentsDir, "dapr-integration"), broker.template, pubsub)
+	if err != nil {
+		return stack, err
+	}
+	daprIntegrationOpts := []testcontainers.ContainerCustomizer{
+		testdapr.WithAppID("integration"),
+		testdapr.WithImage(daprImage("daprd")),
+		testdapr.WithAppChannel("integration", 8080),
+		testdapr.WithComponents(integrationPubsub, "./processed-events.yaml", resiliencyPolicy),
+		testdapr.WithLogLevel("debug"),
+		stack.sidecar("dapr-integration"),
+	}
+	if stack.options.declarativeSubscription {
+		daprIntegrationOpts = append(daprIntegrationOpts, testdapr.WithComponents(declarativeSubscription))
+	}
+	if stack.options.placement {
+		daprIntegrationOpts = append(daprIntegrationOpts, testdapr.WithPlacement(placementAddress))
+	}
+	if stack.options.scheduler {
+		daprIntegrationOpts = append(daprIntegrationOpts, testdapr.WithScheduler(schedulerAddress))
+	}
+	if stack.options.mtls {
+		daprIntegrationOpts = append(daprIntegrationOpts, testdapr.WithMTLS(sentryAddress, stack.trustAnchors))
+	}
+	if stack.options.tracing {
+		daprIntegrationOpts = append(daprIntegrationOpts, testdapr.WithConfig(tracingConfig))
+	}
+	stack.daprIntegration, err = testdapr.Run(ctx, daprIntegrationOpts...)
+	if err != nil {
+		return stack, err
+	}
+	if err := stack.Topology.addContainer(ctx, stack.daprIntegration, stack.daprIntegration.Request()); err != nil {
+		return stack, err
+	}
+
+	// Prometheus scrapes the app and sidecars, so it starts once they run
+	if stack.options.prometheus {
+		if err := stack.startPrometheus(ctx); err != nil {
+			return stack, err
+		}
+	}
+
+	stack.Topology.Subscriptions = append(stack.Topology.Subscriptions,
+		TopologySubscription{
+			AppID:      "app",
+			PubsubName: pubsubName,
+			Topic:      topicOrders,
+			Route:      routeOrderEvents,
+		},
+		TopologySubscription{
+			AppID:      "app",
+			PubsubName: pubsubName,
+			Topic:      topicOrders,
+			Route:      routePaidOrderEvents,
+		},
+		TopologySubscription{
+			AppID:      "app",
+			PubsubName: pubsubName,
+			Topic:      topicOrders,
+			Route:      routeCancelledOrderEvents,
+		},
+		TopologySubscription{
+			AppID:      "app",
+			PubsubName: pubsubName,
+			Topic:      topicOrdersPriority,
+			Route:      routePriorityOrderEvents,
+		},
+		TopologySubscription{
+			AppID:      "integration",
+			PubsubName: pubsubName,
+			Topic:      topicOrders,
+			Route:      "/events",
+		},
+	)
+	stack.Topology.Links = append(stack.Topology.Links,
+		TopologyLink{From: stack.name("dapr-integration"), To: stack.name("integration"), Label: "HTTP integration:8080"},
+	)
+	if stack.daprApp != nil {
+		stack.Topology.Links = append(stack.Topology.Links,
+			TopologyLink{From: stack.name("app"), To: stack.name("dapr-app"), Label: "gRPC dapr-app:50001"},
+			TopologyLink{From: stack.name("dapr-app"), To: stack.name("app"), Label: "HTTP app:3000"},
+			TopologyLink{From: stack.name("dapr-app"), To: stack.name("postgres"), Label: "state"},
+			TopologyLink{From: stack.name("dapr-app"), To: stack.name("redis"), Label: "webhook state"},
+		)
+	}
+	// local brokers have no container to link to
+	if !broker.local {
+		if stack.daprApp != nil {
+			stack.Topology.Links = append(stack.Topology.Links,
+				TopologyLink{From: stack.name("dapr-app"), To: stack.name(stack.options.pubsub), Label: "publish/subscribe"},
+			)
+		}
+		stack.Topology.Links = append(stack.Topology.Links,
+			TopologyLink{From: stack.name("dapr-integration"), To: stack.name(stack.options.pubsub), Label: "subscribe"},
+		)
+	}
+
+	if stack.replica != nil {
+		stack.Topology.Links = append(stack.Topology.Links,
+			TopologyLink{From: stack.name("app-2"), To: stack.name("dapr-app-2"), Label: "gRPC dapr-app-2:50001"},
+			TopologyLink{From: stack.name("dapr-app-2"), To: stack.name("app-2"), Label: "HTTP app-2:3000"},
+			TopologyLink{From: stack.name("dapr-app-2"), To: stack.name("postgres"), Label: "state"},
+			TopologyLink{From: stack.name("dapr-app-2"), To: stack.name("redis"), Label: "webhook state"},
+		)
+		if !broker.local {
+			stack.Topology.Links = append(stack.Topology.Links,
+				TopologyLink{From: stack.name("dapr-app-2"), To: stack.name(stack.options.pubsub), Label: "publish/subscribe"},
+			)
+		}
+	}
+	if stack.webhookReceiver != nil {
+		stack.Topology.Links = append(stack.Topology.Links,
+			TopologyLink{From: stack.name("app"), To: stack.name("webhook-receiver"), Label: "HTTP webhook-receiver:8080"},
+		)
+	}
+	if stack.daprPayments != nil {
+		stack.Topology.Links = append(stack.Topology.Links,
+			TopologyLink{From: stack.name("dapr-app"), To: stack.name("dapr-payments"), Label: "invoke " + paymentsAppID},
+			TopologyLink{From: stack.name("dapr-payments"), To: stack.name("payments"), Label: "HTTP payments:8080"},
+		)
+		if stack.daprReplica != nil {
+			stack.Topology.Links = append(stack.Topology.Links,
+				TopologyLink{From: stack.name("dapr-app-2"), To: stack.name("dapr-payments"), Label: "invoke " + paymentsAppID},
+			)
+		}
+	}
+	if stack.placement != nil {
+		stack.Topology.Links = append(stack.Topology.Links,
+			TopologyLink{From: stack.name("dapr-app"), To: stack.name("placement"), Label: "gRPC " + placementAddress},
+			TopologyLink{From: stack.name("dapr-integration"), To: stack.name("placement"), Label: "gRPC " + placementAddress},
+		)
+	}
+	if stack.scheduler != nil {
+		stack.Topology.Links = append(stack.Topology.Links,
+			TopologyLink{From: stack.name("dapr-app"), To: stack.name("scheduler"), Label: "gRPC " + schedulerAddress},
+			TopologyLink{From: stack.name("dapr-integration"), To: stack.name("scheduler"), Label: "gRPC " + schedulerAddress},
+		)
+	}
+	if stack.sentry != nil {
+		stack.Topology.Links = append(stack.Topology.Links,
+			TopologyLink{From: stack.name("dapr-app"), To: stack.name("sentry"), Label: "gRPC " + sentryAddress},
+			TopologyLink{From: stack.name("dapr-integration"), To: stack.name("sentry"), Label: "gRPC " + sentryAddress},
+		)
+	}
+	if stack.otelCollector != nil {
+		stack.Topology.Links = append(stack.Topology.Links,
+			TopologyLink{From: stack.name("dapr-app"), To: stack.name("otel-collector"), Label: "OTLP otel-collector:4317"},
+			TopologyLink{From: stack.name("dapr-integration"), To: stack.name("otel-collector"), Label: "OTLP otel-collector:4317"},
+			TopologyLink{From: stack.name("otel-collector"), To: stack.name("jaeger"), Label: "OTLP jaeger:4317"},
+		)
+	}
+	if stack.prometheus != nil {
+		stack.Topology.Links = append(stack.Topology.Links,
+			TopologyLink{From: stack.name("prometheus"), To: stack.name("app"), Label: "scrape app:3000"},
+			TopologyLink{From: stack.name("prometheus"), To: stack.name("dapr-app"), Label: "scrape dapr-app:" + testdapr.MetricsPort.Port()},
+			TopologyLink{From: stack.name("prometheus"), To: stack.name("dapr-integration"), Label: "scrape dapr-integration:" + testdapr.MetricsPort.Port()},
+		)
+	}
+	if stack.toxiproxy != nil {
+		stack.Topology.Links = append(stack.Topology.Links,
+			TopologyLink{From: stack.name("app"), To: stack.name("toxiproxy"), Label: "gRPC toxiproxy:50001"},
+			TopologyLink{From: stack.name("toxiproxy"), To: stack.name("dapr-app"), Label: "gRPC dapr-app:50001"},
+			TopologyLink{From: stack.name("dapr-app"), To: stack.name("toxiproxy"), Label: "publish toxiproxy:6379"},
+			TopologyLink{From: stack.name("toxiproxy"), To: stack.name("redis"), Label: "redis:6379"},
+		)
+	}
+	if stack.schemaRegistry != nil {
+		stack.Topology.Links = append(stack.Topology.Links,
+			TopologyLink{From: stack.name("app"), To: stack.name("schema-registry"), Label: "HTTP schema-registry:8080"},
+		)
+	}
+
+	return stack, nil
+}
+
+// startApp runs a replica of the app on the stack network under alias,
+// reaching its sidecar at daprURL.
+func (s *Stack) startApp(ctx context.Context, alias, daprURL string) (*appContainer, error) {
+	req := testcontainers.ContainerRequest{
+		ExposedPorts: []string{"3000/tcp"},
+		WaitingFor:   wait.ForHTTP("/health"),
+		Env: map[string]string{
+			"DAPR_URL": daprURL,
+			// the app waits for its sidecar, started after it
+			"DAPR_STARTUP_TIMEOUT": "2m",
+		},
+		FromDockerfile: testcontainers.FromDockerfile{
+			Context:    ".",
+			Dockerfile: "Dockerfile",
+			KeepImage:  true,
+			Repo:       builtImageRepo("app"),
+			Tag:        sessionID,
+		},
+	}
+	if token := s.options.daprAPIToken; token != "" {
+		req.Env["DAPR_API_TOKEN"] = token
+	}
+	if s.options.payments {
+		req.Env["PAYMENTS_APP_ID"] = paymentsAppID
+	}
+	if s.options.secrets {
+		req.Env["SECRET_STORE"] = "app-secrets"
+		req.Env["SECRETS_REFRESH_INTERVAL"] = "1s"
+	}
+	if s.options.pprof {
+		req.Env["ENABLE_PPROF"] = "true"
+		req.ExposedPorts = append(req.ExposedPorts, "6060/tcp")
+	}
+	for k, v := range s.options.appEnv {
+		req.Env[k] = v
+	}
+	scheme := "http"
+	if s.appTLS != nil {
+		scheme = "https"
+		req.Env["TLS_CERT_FILE"] = "/tls/" + appCertFile
+		req.Env["TLS_KEY_FILE"] = "/tls/" + appKeyFile
+		for _, name := range []string{appCertFile, appKeyFile} {
+			req.Files = append(req.Files, testcontainers.ContainerFile{
+				HostFilePath:      filepath.Join(s.appTLSDir, name),
+				ContainerFilePath: "/tls/" + name,
+				FileMode:          0o644,
+			})
+		}
+		req.WaitingFor = wait.ForHTTP("/health").WithTLS(true, s.appTLS)
+	}
+	s.attach(&req, alias)
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the container is returned on failure too, so that it is terminated
+	app := &appContainer{Container: c}
+	if err := s.Topology.addContainer(ctx, c, req); err != nil {
+		return app, err
+	}
+	address, err := endpoint(ctx, c, "3000/tcp")
+	if err != nil {
+		return app, err
+	}
+	app.URI = scheme + "://" + address
+	if s.options.pprof {
+		// the admin port serves plain HTTP, whatever the app serves
+		address, err := endpoint(ctx, c, "6060/tcp")
+		if err != nil {
+			return app, err
+		}
+		app.PprofURI = "http://" + address
+	}
+	return app, nil
+}
+
+// startAppSidecar runs the sidecar of the replica of the app reached at
+// appHost, on the stack network under alias.
+func (s *Stack) startAppSidecar(ctx context.Context, appHost, alias string) (*testdapr.Container, error) {
+	opts := []testcontainers.ContainerCustomizer{
+		testdapr.WithAppID("app"),
+		testdapr.WithImage(daprImage("daprd")),
+		testdapr.WithAppChannel(appHost, 3000),
+		testdapr.WithComponents(s.pubsubComponent, "./order-state.yaml", "./webhook-state.yaml", "./shipment-state.yaml", "./customer-state.yaml", "./order-events.yaml", "./order-stats.yaml", "./event-quarantine.yaml", "./feature-flags.yaml", resiliencyPolicy),
+		testdapr.WithLogLevel("debug"),
+		s.sidecar(alias),
+	}
+	if token := s.options.daprAPIToken; token != "" {
+		opts = append(opts, testdapr.WithAPIToken(token))
+	}
+	if s.options.appTLS {
+		opts = append(opts, testdapr.WithAppProtocol("https"))
+	}
+	if s.options.placement {
+		opts = append(opts, testdapr.WithPlacement(placementAddress))
+	}
+	if s.options.scheduler {
+		opts = append(opts, testdapr.WithScheduler(schedulerAddress))
+	}
+	if s.options.mtls {
+		opts = append(opts, testdapr.WithMTLS(sentryAddress, s.trustAnchors))
+	}
+	if s.options.tracing {
+		opts = append(opts, testdapr.WithConfig(tracingConfig))
+	}
+	if s.options.secrets {
+		opts = append(opts,
+			testdapr.WithComponents(secretStoreComponent, secretStoreFile),
+			testdapr.WithConfig(hotReloadConfig),
+		)
+	}
+	sidecar, err := testdapr.Run(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Topology.addContainer(ctx, sidecar, sidecar.Request()); err != nil {
+		return sidecar, err
+	}
+	return sidecar, nil
+}
+
+// startWebhookReceiver runs the receiver of testdata/webhook-receiver on the
+// stack network.
+func (s *Stack) startWebhookReceiver(ctx context.Context) error {
+	req := testcontainers.ContainerRequest{
+		ExposedPorts: []string{"8080/tcp"},
+		WaitingFor:   wait.ForHTTP("/health").WithPort("8080/tcp"),
+		Env: map[string]string{
+			"FAIL_FIRST":     strconv.Itoa(s.options.webhookFailFirst),
+			"WEBHOOK_SECRET": string(webhookSecret),
+		},
+		FromDockerfile: testcontainers.FromDockerfile{
+			Context:    "./testdata/webhook-receiver",
+			Dockerfile: "Dockerfile",
+			KeepImage:  true,
+			Repo:       builtImageRepo("webhook-receiver"),
+			Tag:        sessionID,
+		},
+	}
+	s.attach(&req, "webhook-receiver")
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		return err
+	}
+	addr, err := endpoint(ctx, c, "8080/tcp")
+	if err != nil {
+		return errors.Join(err, c.Terminate(ctx))
+	}
+	s.webhookReceiver = &appContainer{Container: c, URI: "http://" + addr}
+	return s.Topology.addContainer(ctx, c, req)
+}
+
+// startPayments runs the payments app of testdata/payments on the stack
+// network, and its sidecar, which the sidecars of the app find through mDNS.
+func (s *Stack) startPayments(ctx context.Context) error {
+	req := testcontainers.ContainerRequest{
+		ExposedPorts: []string{"8080/tcp"},
+		WaitingFor:   wait.ForHTTP("/health").WithPort("8080/tcp"),
+		Env: map[string]string{
+			"DECLINED":        strings.Join(s.options.paymentsDeclined, ","),
+			"REFUSED_REFUNDS": strings.Join(s.options.refundsRefused, ","),
+		},
+		FromDockerfile: testcontainers.FromDockerfile{
+			Context:    "./testdata/payments",
+			Dockerfile: "Dockerfile",
+			KeepImage:  true,
+			Repo:       builtImageRepo("payments"),
+			Tag:        sessionID,
+		},
+	}
+	s.attach(&req, "payments")
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		return err
+	}
+	addr, err := endpoint(ctx, c, "8080/tcp")
+	if err != nil {
+		return errors.Join(err, c.Terminate(ctx))
+	}
+	s.payments = &appContainer{Container: c, URI: "http://" + addr}
+	if err := s.Topology.addContainer(ctx, c, req); err != nil {
+		return err
+	}
+
+	opts := []testcontainers.ContainerCustomizer{
+		testdapr.WithAppID(paymentsAppID),
+		testdapr.WithImage(daprImage("daprd")),
+		testdapr.WithAppChannel("payments", 8080),
+		testdapr.WithLogLevel("debug"),
+		s.sidecar("dapr-payments"),
+	}
+	if s.options.mtls {
+		opts = append(opts, testdapr.WithMTLS(sentryAddress, s.trustAnchors))
+	}
+	if s.options.tracing {
+		opts = append(opts, testdapr.WithConfig(tracingConfig))
+	}
+	s.daprPayments, err = testdapr.Run(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	return s.Topology.addContainer(ctx, s.daprPayments, s.daprPayments.Request())
+}
+
+// paymentRequests returns the IDs of the orders of the requests the payments
+// app received so far, by method.
+func (s *Stack) paymentRequests(ctx context.Context) (map[string][]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.payments.URI+"/requests", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var requests map[string][]string
+	if err := json.NewDecoder(resp.Body).Decode(&requests); err != nil {
+		return nil, fmt.Errorf("couldn't decode payment requests: %w", err)
+	}
+	return requests, nil
+}
+
+// startBroker runs the pubsub broker on the stack network.
+func (s *Stack) startBroker(ctx context.Context, broker pubsubBroker) error {
+	req := broker.request()
+	s.attach(&req, s.options.pubsub)
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		return err
+	}
+	s.broker = c
+	if err := s.Topology.addContainer(ctx, c, req); err != nil {
+		return err
+	}
+	if broker.setup != nil {
+		return broker.setup(ctx, s)
+	}
+	return nil
+}
+
+// kafkaRequest runs a single node Redpanda broker, which speaks the Kafka
+// protocol. Topics are created on first use.
+func kafkaRequest() testcontainers.ContainerRequest {
+	return testcontainers.ContainerRequest{
+		Image:        redpandaImage,
+		ExposedPorts: []string{"9092/tcp"},
+		Cmd: []string{
+			"redpanda", "start",
+			"--mode", "dev-container",
+			"--smp", "1",
+			"--kafka-addr", "internal://0.0.0.0:9092",
+			"--advertise-kafka-addr", "internal://kafka:9092",
+		},
+		WaitingFor: wait.ForLog("Successfully started Redpanda!").WithStartupTimeout(2 * time.Minute),
+	}
+}
+
+// rabbitMQUser and rabbitMQPassword are the credentials of the broker. The
+// default guest user only accepts local connections, so sidecars can't use it.
+const (
+	rabbitMQUser     = "dapr"
+	rabbitMQPassword = "dapr"
+)
+
+// rabbitMQRequest runs a RabbitMQ broker along with its management API, on
+// port 15672.
+func rabbitMQRequest() testcontainers.ContainerRequest {
+	return testcontainers.ContainerRequest{
+		Image:        rabbitmqImage,
+		ExposedPorts: []string{"5672/tcp", "15672/tcp"},
+		Env: map[string]string{
+			"RABBITMQ_DEFAULT_USER": rabbitMQUser,
+			"RABBITMQ_DEFAULT_PASS": rabbitMQPassword,
+		},
+		WaitingFor: wait.ForLog("Server startup complete").WithStartupTimeout(2 * time.Minute),
+	}
+}
+
+// natsRequest runs a NATS server with JetStream enabled.
+func natsRequest() testcontainers.ContainerRequest {
+	return testcontainers.ContainerRequest{
+		Image:        natsImage,
+		ExposedPorts: []string{"4222/tcp"},
+		Cmd:          []string{"nats-server", "--jetstream"},
+		WaitingFor:   wait.ForLog("Server is ready"),
+	}
+}
+
+// jetStreamName is the stream holding the topics of the app. The JetStream
+// component doesn't create streams, so the stack does.
+const jetStreamName = "dapr"
+
+// createJetStream creates the stream of the topics the app publishes to, with
+// the NATS CLI of a short-lived nats-box container.
+func createJetStream(ctx context.Context, s *Stack) error {
+	req := testcontainers.ContainerRequest{
+		Image: natsBoxImage,
+		Cmd: []string{
+			"nats", "--server", "nats://nats:4222",
+			"stream", "add", jetStreamName,
+			"--subjects", topicOrders + "," + topicOrdersPriority + "," + topicShipments,
+			"--storage", "memory",
+			"--defaults",
+		},
+		WaitingFor: wait.ForExit(),
+	}
+	s.attach(&req, "nats-box")
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		if c != nil {
+			err = errors.Join(err, c.Terminate(ctx))
+		}
+		return err
+	}
+	defer c.Terminate(ctx)
+
+	state, err := c.State(ctx)
+	if err != nil {
+		return err
+	}
+	if state.ExitCode != 0 {
+		return fmt.Errorf("couldn't create stream %s: nats exited with %d", jetStreamName, state.ExitCode)
+	}
+	return nil
+}
+
+// startPlacement runs the Dapr placement service on the stack network.
+func (s *Stack) startPlacement(ctx context.Context) error {
+	req := testcontainers.ContainerRequest{
+		Image:        daprImage("placement"),
+		ExposedPorts: []string{"50005/tcp"},
+		Cmd:          []string{"./placement", "-port", "50005"},
+		WaitingFor:   wait.ForLog("(?i)placement service started").AsRegexp(),
+	}
+	s.attach(&req, "placement")
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		return err
+	}
+	s.placement = c
+	return s.Topology.addContainer(ctx, c, req)
+}
+
+// startScheduler runs the Dapr scheduler service, with its embedded etcd, on
+// the stack network.
+func (s *Stack) startScheduler(ctx context.Context) error {
+	req := testcontainers.ContainerRequest{
+		Image:        daprImage("scheduler"),
+		ExposedPorts: []string{"50006/tcp"},
+		Cmd:          []string{"./scheduler", "--port", "50006", "--etcd-data-dir", "/tmp/etcd"},
+		WaitingFor:   wait.ForLog("(?i)etcd server is ready").AsRegexp(),
+	}
+	s.attach(&req, "scheduler")
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		return err
+	}
+	s.scheduler = c
+	return s.Topology.addContainer(ctx, c, req)
+}
+
+// startSentry generates the trust anchors of the stack and runs the Dapr
+// Sentry service, issuing the certificates of the sidecars with them, on the
+// stack network.
+func (s *Stack) startSentry(ctx context.Context) error {
+	dir, err := os.MkdirTemp("", "sentry-"+s.ID)
+	if err != nil {
+		return err
+	}
+	s.certsDir = dir
+	s.trustAnchors, err = writeTrustAnchors(dir)
+	if err != nil {
+		return err
+	}
+
+	req := testcontainers.ContainerRequest{
+		Image:        daprImage("sentry"),
+		ExposedPorts: []string{"50001/tcp"},
+		Cmd:          []string{"./sentry", "--issuer-credentials", "/certs"},
+		WaitingFor:   wait.ForLog("(?i)certificate authority is running").AsRegexp(),
+	}
+	for _, name := range []string{trustAnchorsFile, issuerCertFile, issuerKeyFile} {
+		req.Files = append(req.Files, testcontainers.ContainerFile{
+			HostFilePath:      filepath.Join(dir, name),
+			ContainerFilePath: "/certs/" + name,
+			FileMode:          0o644,
+		})
+	}
+	s.attach(&req, "sentry")
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		return err
+	}
+	s.sentry = c
+	return s.Topology.addContainer(ctx, c, req)
+}
+
+// secretStoreComponent is the secret store of the credentials of the app,
+// reading secretStoreFile, and hotReloadConfig the Dapr configuration
+// reloading the components as they change.
+const (
+	secretStoreComponent = "./app-secrets.yaml"
+	secretStoreFile      = "./testdata/app-secrets.json"
+	hotReloadConfig      = "./testdata/dapr-hot-reload.yaml"
+)
+
+// rotateSecrets replaces the secrets of the secret store of the sidecar of
+// the app. The secret store only reads its file as it is loaded, so its
+// component is rewritten as well, with a version of its own, for the sidecar
+// to reload it.
+func (s *Stack) rotateSecrets(ctx context.Context, secrets map[string]string, version int) error {
+	data, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	if err := s.daprApp.CopyToContainer(ctx, data, "/components/app-secrets.json", 0o644); err != nil {
+		return fmt.Errorf("couldn't copy secrets: %w", err)
+	}
+	component, err := os.ReadFile(secretStoreComponent)
+	if err != nil {
+		return err
+	}
+	component = fmt.Appendf(component, "  - name: rotation\n    value: \"%d\"\n", version)
+	if err := s.daprApp.CopyToContainer(ctx, component, "/components/app-secrets.yaml", 0o644); err != nil {
+		return fmt.Errorf("couldn't copy secret store component: %w", err)
+	}
+	return nil
+}
+
+// tracingConfig is the Dapr configuration exporting the traces of the
+// sidecars to the collector.
+const tracingConfig = "./testdata/dapr-tracing.yaml"
+
+// startTracing runs Jaeger, whose query API is exposed on port 16686, and an
+// OpenTelemetry collector forwarding the traces it receives to it, on the
+// stack network.
+func (s *Stack) startTracing(ctx context.Context) error {
+	jaegerReq := testcontainers.ContainerRequest{
+		Image:        jaegerImage,
+		ExposedPorts: []string{"16686/tcp"},
+		Env: map[string]string{
+			"COLLECTOR_OTLP_ENABLED": "true",
+		},
+		WaitingFor: wait.ForHTTP("/").WithPort("16686/tcp"),
+	}
+	s.attach(&jaegerReq, "jaeger")
+	jaeger, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: jaegerReq,
+		Started:          true,
+	})
+	if err != nil {
+		return err
+	}
+	addr, err := endpoint(ctx, jaeger, "16686/tcp")
+	if err != nil {
+		return errors.Join(err, jaeger.Terminate(ctx))
+	}
+	s.jaeger = &appContainer{Container: jaeger, URI: "http://" + addr}
+	if err := s.Topology.addContainer(ctx, jaeger, jaegerReq); err != nil {
+		return err
+	}
+
+	collectorReq := testcontainers.ContainerRequest{
+		Image:        otelCollectorImage,
+		ExposedPorts: []string{"4317/tcp"},
+		Cmd:          []string{"--config=/etc/otelcol/config.yaml"},
+		Files: []testcontainers.ContainerFile{
+			{
+				HostFilePath:      "./testdata/otel-collector.yaml",
+				ContainerFilePath: "/etc/otelcol/config.yaml",
+				FileMode:          0o644,
+			},
+		},
+		WaitingFor: wait.ForLog("Everything is ready"),
+	}
+	s.attach(&collectorReq, "otel-collector")
+	s.otelCollector, err = testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: collectorReq,
+		Started:          true,
+	})
+	if err != nil {
+		return err
+	}
+	return s.Topology.addContainer(ctx, s.otelCollector, collectorReq)
+}
+
+// prometheusScrapeInterval is the interval at which Prometheus scrapes the
+// stack, short so that tests don't wait long for new samples.
+const prometheusScrapeInterval = time.Second
+
+// startPrometheus runs Prometheus on the stack network, with a configuration
+// generated for the stack scraping the app and both sidecars.
+func (s *Stack) startPrometheus(ctx context.Context) error {
+	dir, err := os.MkdirTemp("", "prometheus-")
+	if err != nil {
+		return err
+	}
+	s.prometheusDir = dir
+	config, err := writePrometheusConfig(dir, prometheusScrapeInterval, map[string][]string{
+		"app":  {"app:3000"},
+		"dapr": {"dapr-app:" + testdapr.MetricsPort.Port(), "dapr-integration:" + testdapr.MetricsPort.Port()},
+	})
+	if err != nil {
+		return err
+	}
+
+	req := testcontainers.ContainerRequest{
+		Image:        prometheusImage,
+		ExposedPorts: []string{"9090/tcp"},
+		Files: []testcontainers.ContainerFile{
+			{
+				HostFilePath:      config,
+				ContainerFilePath: "/etc/prometheus/prometheus.yml",
+				FileMode:          0o644,
+			},
+		},
+		WaitingFor: wait.ForHTTP("/-/ready").WithPort("9090/tcp"),
+	}
+	s.attach(&req, "prometheus")
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		return err
+	}
+	addr, err := endpoint(ctx, c, "9090/tcp")
+	if err != nil {
+		return errors.Join(err, c.Terminate(ctx))
+	}
+	s.prometheus = &appContainer{Container: c, URI: "http://" + addr}
+	return s.Topology.addContainer(ctx, c, req)
+}
+
+// startToxiproxy runs Toxiproxy on the stack network, with the proxySidecar
+// proxy listening on port 50001 and the proxyRedis proxy on port 6379.
+func (s *Stack) startToxiproxy(ctx context.Context) error {
+	req := testcontainers.ContainerRequest{
+		Image:        toxiproxyImage,
+		ExposedPorts: []string{"8474/tcp"},
+		WaitingFor:   wait.ForHTTP("/version").WithPort("8474/tcp"),
+	}
+	s.attach(&req, "toxiproxy")
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		return err
+	}
+	addr, err := endpoint(ctx, c, "8474/tcp")
+	if err != nil {
+		return errors.Join(err, c.Terminate(ctx))
+	}
+	s.toxiproxy = &appContainer{Container: c, URI: "http://" + addr}
+	if err := s.Topology.addContainer(ctx, c, req); err != nil {
+		return err
+	}
+
+	api := s.toxiproxyAPI()
+	for _, proxy := range []toxiproxyProxy{
+		{Name: proxySidecar, Listen: "0.0.0.0:50001", Upstream: "dapr-app:50001"},
+		{Name: proxyRedis, Listen: "0.0.0.0:6379", Upstream: "redis:6379"},
+	} {
+		if err := api.createProxy(ctx, proxy); err != nil {
+			return fmt.Errorf("couldn't create proxy %s: %w", proxy.Name, err)
+		}
+	}
+	return nil
+}
+
+// toxiproxyAPI returns a client of the API of Toxiproxy.
+func (s *Stack) toxiproxyAPI() toxiproxyClient {
+	return toxiproxyClient{uri: s.toxiproxy.URI}
+}
+
+// promQuery evaluates the PromQL query, which must return at most one
+// sample, at the current time. It returns false if the query returned no
+// sample, e.g. when the series it selects don't exist yet.
+func (s *Stack) promQuery(ctx context.Context, query string) (float64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.prometheus.URI+"/api/v1/query?query="+url.QueryEscape(query), nil)
+	if err != nil {
+		return 0, false, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			Result []struct {
+				// the value is a [timestamp, "value"] pair
+				Value []any `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, false, fmt.Errorf("couldn't decode query result: %w", err)
+	}
+	if body.Status != "success" {
+		return 0, false, fmt.Errorf("query %q failed: %s", query, body.Error)
+	}
+	switch len(body.Data.Result) {
+	case 0:
+		return 0, false, nil
+	case 1:
+	default:
+		return 0, false, fmt.Errorf("query %q returned %d samples", query, len(body.Data.Result))
+	}
+	sample := body.Data.Result[0].Value
+	if len(sample) != 2 {
+		return 0, false, fmt.Errorf("unexpected sample %v", sample)
+	}
+	value, ok := sample[1].(string)
+	if !ok {
+		return 0, false, fmt.Errorf("unexpected sample %v", sample)
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return v, true, nil
+}
+
+// subscriberJob is a job triggered on the subscriber of
+// testdata/subscriber.
+type subscriberJob struct {
+	Name string          `json:"name"`
+	Data json.RawMessage `json:"data"`
+}
+
+// triggeredJobs returns the jobs the scheduler triggered on the subscriber so
+// far, in the order they were triggered.
+func (s *Stack) triggeredJobs(ctx context.Context) ([]subscriberJob, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.subscriber.URI+"/jobs", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var jobs []subscriberJob
+	if err := json.NewDecoder(resp.Body).Decode(&jobs); err != nil {
+		return nil, fmt.Errorf("couldn't decode triggered jobs: %w", err)
+	}
+	return jobs, nil
+}
+
+// startSchemaRegistry runs an in-memory Apicurio registry, which serves the
+// Confluent schema registry API, on the stack network.
+func (s *Stack) startSchemaRegistry(ctx context.Context) error {
+	req := testcontainers.ContainerRequest{
+		Image:        schemaRegistryImage,
+		ExposedPorts: []string{"8080/tcp"},
+		WaitingFor:   wait.ForHTTP("/health/ready").WithPort("8080/tcp").WithStartupTimeout(2 * time.Minute),
+	}
+	s.attach(&req, "schema-registry")
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		return err
+	}
+	addr, err := endpoint(ctx, c, "8080/tcp")
+	if err != nil {
+		return errors.Join(err, c.Terminate(ctx))
+	}
+	s.schemaRegistry = &appContainer{Container: c, URI: "http://" + addr + "/apis/ccompat/v7"}
+	return s.Topology.addContainer(ctx, c, req)
+}
+
+// psql runs query against the orders database of the state store, and
+// returns its rows, one per line, with the columns separated by |.
+func (s *Stack) psql(ctx context.Context, query string) (string, error) {
+	code, out, err := s.postgres.Exec(ctx, []string{"psql", "-U", "postgres", "-d", "orders", "-tAc", query}, tcexec.Multiplexed())
+	if err != nil {
+		return "", err
+	}
+	result, err := io.ReadAll(out)
+	if err != nil {
+		return "", err
+	}
+	if code != 0 {
+		return "", fmt.Errorf("psql exited with %d: %s", code, result)
+	}
+	return strings.TrimSpace(string(result)), nil
+}
+
+// Terminate stops every container of the stack and removes
+// its network. It can be called on a partially started stack.
+func (s *Stack) Terminate(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+
+	var errs []error
+
+	var containers []testcontainers.Container
+	// typed nil pointers would not compare equal to nil below
+	if s.daprIntegration != nil {
+		containers = append(containers, s.daprIntegration)
+	}
+	if s.daprApp != nil {
+		containers = append(containers, s.daprApp)
+	}
+	if s.app != nil {
+		containers = append(containers, s.app)
+	}
+	if s.daprReplica != nil {
+		containers = append(containers, s.daprReplica)
+	}
+	if s.replica != nil {
+		containers = append(containers, s.replica)
+	}
+	if s.subscriber != nil {
+		containers = append(containers, s.subscriber)
+	}
+	if s.jaeger != nil {
+		containers = append(containers, s.jaeger)
+	}
+	if s.prometheus != nil {
+		containers = append(containers, s.prometheus)
+	}
+	if s.webhookReceiver != nil {
+		containers = append(containers, s.webhookReceiver)
+	}
+	if s.daprPayments != nil {
+		containers = append(containers, s.daprPayments)
+	}
+	if s.payments != nil {
+		containers = append(containers, s.payments)
+	}
+	if s.schemaRegistry != nil {
+		containers = append(containers, s.schemaRegistry)
+	}
+	if s.toxiproxy != nil {
+		containers = append(containers, s.toxiproxy)
+	}
+	containers = append(containers, s.otelCollector, s.sentry, s.scheduler, s.placement, s.broker, s.postgres, s.redis)
+
+	for _, c := range containers {
+		if c == nil {
+			continue
+		}
+		if err := c.Terminate(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to terminate container: %w", err))
+		}
+	}
+
+	if s.network != nil {
+		if err := s.network.Remove(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove network: %w", err))
+		}
+	}
+
+	if s.certsDir != "" {
+		if err := os.RemoveAll(s.certsDir); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove certificates: %w", err))
+		}
+	}
+	if s.prometheusDir != "" {
+		if err := os.RemoveAll(s.prometheusDir); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove Prometheus configuration: %w", err))
+		}
+	}
+	if s.appTLSDir != "" {
+		if err := os.RemoveAll(s.appTLSDir); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove app certificate: %w", err))
+		}
+	}
+	if s.componentsDir != "" {
+		if err := os.RemoveAll(s.componentsDir); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove components: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// shared is the default stack the tests which need no option of their own
+// share, started by the first of them and terminated by TestMain.
+var shared struct {
+	once  sync.Once
+	stack *Stack
+	err   error
+}
+
+// sharedStack returns the shared default stack, starting it on first use.
+// Once the test completes, the stack is reset so that the next one doesn't
+// see its orders, webhooks and events.
+func sharedStack(t *testing.T) *Stack {
+	t.Helper()
+	ctx := context.Background()
+
+	shared.once.Do(func() {
+		shared.stack, shared.err = setupApp(ctx, t)
+	})
+	if shared.err != nil {
+		t.Fatal(shared.err)
+	}
+	// the stack may have been started by a previous test
+	shared.stack.logs.use(t)
+	t.Cleanup(func() {
+		if err := shared.stack.reset(ctx); err != nil {
+			t.Fatalf("failed to reset stack: %s", err)
+		}
+	})
+	return shared.stack
+}
+
+// streamEntry is an entry of a Redis stream.
+type streamEntry struct {
+	ID     string
+	Fields map[string]string
+}
+
+// readStream returns the entries of the Redis stream, which the Redis pubsub
+// component names after the topic, as stored by the broker.
+func (s *Stack) readStream(ctx context.Context, stream string) ([]streamEntry, error) {
+	code, out, err := s.redis.Exec(ctx, []string{"redis-cli", "--json", "XRANGE", stream, "-", "+"}, tcexec.Multiplexed())
+	if err != nil {
+		return nil, err
+	}
+	result, err := io.ReadAll(out)
+	if err != nil {
+		return nil, err
+	}
+	if code != 0 {
+		return nil, fmt.Errorf("redis-cli exited with %d: %s", code, result)
+	}
+
+	// each entry is its ID followed by the list of its fields and values
+	var raw [][2]json.RawMessage
+	if err := json.Unmarshal(result, &raw); err != nil {
+		return nil, fmt.Errorf("couldn't decode XRANGE reply %q: %w", result, err)
+	}
+	entries := make([]streamEntry, 0, len(raw))
+	for _, r := range raw {
+		var entry streamEntry
+		var fields []string
+		if err := json.Unmarshal(r[0], &entry.ID); err != nil {
+			return nil, fmt.Errorf("couldn't decode entry ID: %w", err)
+		}
+		if err := json.Unmarshal(r[1], &fields); err != nil {
+			return nil, fmt.Errorf("couldn't decode fields of entry %s: %w", entry.ID, err)
+		}
+		entry.Fields = make(map[string]string, len(fields)/2)
+		for i := 0; i+1 < len(fields); i += 2 {
+			entry.Fields[fields[i]] = fields[i+1]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// setFeatureFlag sets the flag name in the feature-flags configuration store,
+// in the value||version format of the Redis configuration component. The
+// keyspace notifications of Redis push the change to the subscribed sidecar.
+func (s *Stack) setFeatureFlag(ctx context.Context, name, value string) error {
+	for _, cmd := range [][]string{
+		{"redis-cli", "CONFIG", "SET", "notify-keyspace-events", "KA"},
+		{"redis-cli", "SET", name, value + "||1"},
+	} {
+		code, out, err := s.redis.Exec(ctx, cmd, tcexec.Multiplexed())
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			result, _ := io.ReadAll(out)
+			return fmt.Errorf("redis-cli exited with %d: %s", code, result)
+		}
+	}
+	return nil
+}
+
+// reset deletes the orders and webhooks stored by the app, and the events,
+// jobs and deliveries the subscriber recorded.
+func (s *Stack) reset(ctx context.Context) error {
+	if _, err := s.psql(ctx, "DELETE FROM state"); err != nil {
+		return fmt.Errorf("couldn't delete orders: %w", err)
+	}
+	code, out, err := s.redis.Exec(ctx, []string{"redis-cli", "FLUSHALL"}, tcexec.Multiplexed())
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		result, _ := io.ReadAll(out)
+		return fmt.Errorf("redis-cli exited with %d: %s", code, result)
+	}
+
+	for _, path := range []string{"/received", "/jobs", "/attempts", "/batches", "/expired"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.subscriber.URI+path, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("couldn't clear %s of the subscriber: %s", path, resp.Status)
+		}
+	}
+	return nil
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if *cleanupFlag > 0 {
+		if err := cleanupStragglers(context.Background(), time.Now().Add(-*cleanupFlag)); err != nil {
+			log.Printf("failed to clean up previous test runs: %s", err)
+		}
+	}
+
+	code := m.Run()
+
+	// the shared stack may have been partially started
+	if shared.stack != nil {
+		if err := shared.stack.Terminate(context.Background()); err != nil {
+			log.Printf("failed to terminate shared stack: %s", err)
+			if code == 0 {
+				code = 1
+			}
+		}
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+)
+
+const (
+	defaultDaprStartupTimeout = time.Minute
+	startupPollInterval       = time.Second
+)
+
+// ungatedPaths are served while the StartupGate is closed: the probes of the
+// app, and the routes the sidecar calls while it starts, which it would
+// otherwise never finish doing.
+var ungatedPaths = []string{"/health", "/healthz", "/readyz", "/dapr/subscribe", "/dapr/config"}
+
+// ungatedPrefix is the prefix of the routes the sidecar delivers the events
+// of the subscriptions to, which it does as soon as it registered them,
+// possibly before the gate noticed. They are served while the gate is
+// closed, the sidecar being ready by then, rather than answered 503 and
+// redelivered.
+const ungatedPrefix = "/events/"
+
+// RequiredComponent is a Dapr component the app can't serve without.
+type RequiredComponent struct {
+	Name string
+	// Kind is the type of the component without its implementation, e.g.
+	// pubsub for pubsub.redis.
+	Kind string
+}
+
+func (c RequiredComponent) String() string {
+	return c.Name + " (" + c.Kind + ")"
+}
+
+// ComponentsError reports the required components the sidecar didn't load,
+// or loaded with another kind.
+type ComponentsError struct {
+	Missing []RequiredComponent
+}
+
+func (e *ComponentsError) Error() string {
+	missing := make([]string, len(e.Missing))
+	for i, component := range e.Missing {
+		missing[i] = component.String()
+	}
+	return "components not loaded: " + strings.Join(missing, ", ")
+}
+
+// checkComponents returns a *ComponentsError unless metadata lists each of
+// required with its kind.
+func checkComponents(metadata *dapr.GetMetadataResponse, required []RequiredComponent) error {
+	var missing []RequiredComponent
+	for _, component := range required {
+		if !slices.ContainsFunc(metadata.RegisteredComponents, func(c *dapr.MetadataRegisteredComponents) bool {
+			return c.Name == component.Name && strings.HasPrefix(c.Type, component.Kind+".")
+		}) {
+			missing = append(missing, component)
+		}
+	}
+	if len(missing) > 0 {
+		return &ComponentsError{Missing: missing}
+	}
+	return nil
+}
+
+// RequiredSubscription is a subscription the sidecar registers for the app,
+// once it fetched it from /dapr/subscribe or read it from its resources.
+type RequiredSubscription struct {
+	PubsubName string
+	Topic      string
+}
+
+func (s RequiredSubscription) String() string {
+	return s.PubsubName + "/" + s.Topic
+}
+
+// SubscriptionsError reports the required subscriptions the sidecar didn't
+// register.
+type SubscriptionsError struct {
+	Missing []RequiredSubscription
+}
+
+func (e *SubscriptionsError) Error() string {
+	missing := make([]string, len(e.Missing))
+	for i, subscription := range e.Missing {
+		missing[i] = subscription.String()
+	}
+	return "subscriptions not registered: " + strings.Join(missing, ", ")
+}
+
+// checkSubscriptions returns a *SubscriptionsError unless metadata lists each
+// of required.
+func checkSubscriptions(metadata *dapr.GetMetadataResponse, required []RequiredSubscription) error {
+	var missing []RequiredSubscription
+	for _, subscription := range required {
+		if !slices.ContainsFunc(metadata.Subscriptions, func(s *dapr.MetadataSubscription) bool {
+			return s.PubsubName == subscription.PubsubName && s.Topic == subscription.Topic
+		}) {
+			missing = append(missing, subscription)
+		}
+	}
+	if len(missing) > 0 {
+		return &SubscriptionsError{Missing: missing}
+	}
+	return nil
+}
+
+// StartupGate holds the traffic of the app until the sidecar answers over gRPC,
+// loaded the components the app needs and registered its subscriptions, so
+// that no request is accepted while daprd is starting.
+type StartupGate struct {
+	client        dapr.Client
+	components    []RequiredComponent
+	subscriptions []RequiredSubscription
+	timeout       time.Duration
+	interval      time.Duration
+
+	open atomic.Bool
+}
+
+// NewStartupGate returns a closed gate waiting for components through client,
+// which should bypass the circuit breaker, for up to timeout.
+func NewStartupGate(client dapr.Client, timeout time.Duration, components ...RequiredComponent) *StartupGate {
+	return &StartupGate{
+		client:     client,
+		components: components,
+		timeout:    timeout,
+		interval:   startupPollInterval,
+	}
+}
+
+// RequireSubscriptions keeps the gate closed until the sidecar registered
+// subscriptions.
+func (g *StartupGate) RequireSubscriptions(subscriptions ...RequiredSubscription) {
+	g.subscriptions = append(g.subscriptions, subscriptions...)
+}
+
+// Wait polls the metadata API of the sidecar until it answers, lists the
+// components of the gate and registered its subscriptions, then opens the
+// gate. The sidecar only answers once it loaded its components, so that Wait
+// fails fast with a *ComponentsError, logging each component missing, rather
+// than waiting for one. The subscriptions are registered once the sidecar
+// reached the app, which it never does if it isn't configured with the app
+// port: Wait returns an error if the sidecar isn't ready within the timeout of
+// the gate, or ctx is done first.
+func (g *StartupGate) Wait(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	for {
+		err := g.check(ctx)
+		var componentsErr *ComponentsError
+		if errors.As(err, &componentsErr) {
+			return err
+		}
+		if err == nil {
+			slog.InfoContext(ctx, "sidecar ready, serving traffic", "components", g.components, "subscriptions", g.subscriptions, "elapsed", time.Since(start).Round(time.Millisecond))
+			g.open.Store(true)
+			return nil
+		}
+		slog.InfoContext(ctx, "waiting for the sidecar", "error", err)
+
+		select {
+		case <-ctx.Done():
+			var subscriptionsErr *SubscriptionsError
+			if errors.As(err, &subscriptionsErr) {
+				slog.ErrorContext(ctx, "the sidecar didn't register the subscriptions of the app, check that it reaches the app on its app port", "subscriptions", subscriptionsErr.Missing)
+			}
+			return fmt.Errorf("sidecar not ready after %s: %w", time.Since(start).Round(time.Second), err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// check returns an error unless the sidecar answers, lists the components of
+// the gate and registered its subscriptions. It returns a *ComponentsError,
+// logging each component missing, if the components aren't listed.
+func (g *StartupGate) check(ctx context.Context) error {
+	metadata, err := g.client.GetMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("sidecar unavailable: %w", err)
+	}
+	err = checkComponents(metadata, g.components)
+	var componentsErr *ComponentsError
+	if errors.As(err, &componentsErr) {
+		for _, component := range componentsErr.Missing {
+			slog.ErrorContext(ctx, "required component not loaded by the sidecar", "component", component.Name, "kind", component.Kind)
+		}
+		return err
+	}
+	return checkSubscriptions(metadata, g.subscriptions)
+}
+
+// Open reports whether the gate lets the traffic through, always for a nil
+// gate.
+func (g *StartupGate) Open() bool {
+	return g == nil || g.open.Load()
+}
+
+// Middleware answers 503 to the requests but those of ungatedPaths and
+// ungatedPrefix while the gate is closed.
+func (g *StartupGate) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !g.Open() && !slices.Contains(ungatedPaths, r.URL.Path) && !strings.HasPrefix(r.URL.Path, ungatedPrefix) {
+			w.Header().Set("Retry-After", retryAfterHeader(g.interval))
+			http.Error(w, "Service unavailable: waiting for the sidecar", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
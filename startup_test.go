@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+)
+
+// requiredComponents and ordersSubscription are the components and the
+// subscription the tests start the app with.
+var (
+	requiredComponents = []RequiredComponent{{Name: pubsubName, Kind: "pubsub"}, {Name: stateStoreName, Kind: "state"}}
+	ordersSubscription = RequiredSubscription{PubsubName: pubsubName, Topic: topicOrders}
+)
+
+func TestStartupGate(t *testing.T) {
+	client := &fakeDaprClient{metadataErr: errors.New("connection refused")}
+	gate := NewStartupGate(client, time.Second, requiredComponents...)
+	gate.RequireSubscriptions(ordersSubscription)
+	gate.interval = 10 * time.Millisecond
+	h := newMockHandler(&mockPublisher{}, newMockOrderRepository())
+	h.startup = gate
+	h.RegisterRoutes()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	// the traffic is held while the sidecar starts, but the liveness
+	if rec := get("/orders"); rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected status code %d with Retry-After 1. Got %d with %q.", http.StatusServiceUnavailable, rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := get("/health"); rec.Code != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, rec.Code)
+	}
+	if rec := get("/readyz"); rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "not ready: waiting for the sidecar\n" {
+		t.Fatalf("expected the app not ready. Got %d: %s", rec.Code, rec.Body)
+	}
+	// the events the sidecar delivers are handled rather than redelivered
+	rec := httptest.NewRecorder()
+	h.router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, routeOrderEvents, strings.NewReader(`{}`)))
+	if rec.Code == http.StatusServiceUnavailable {
+		t.Fatalf("expected the event delivered to %s to be handled. Got %d: %s", routeOrderEvents, rec.Code, rec.Body)
+	}
+
+	waited := make(chan error, 1)
+	go func() { waited <- gate.Wait(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+	if gate.Open() {
+		t.Fatal("expected the gate closed until the sidecar answers.")
+	}
+	// the sidecar answers before it reached the app for its subscriptions
+	client.mu.Lock()
+	client.metadataErr = nil
+	client.components = []*dapr.MetadataRegisteredComponents{{Name: pubsubName, Type: "pubsub.redis"}, {Name: stateStoreName, Type: "state.postgresql"}}
+	client.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	if gate.Open() {
+		t.Fatal("expected the gate closed until the subscription is registered.")
+	}
+	client.mu.Lock()
+	client.subscriptions = []*dapr.MetadataSubscription{{PubsubName: pubsubName, Topic: topicOrders}}
+	client.mu.Unlock()
+
+	if err := <-waited; err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+	if rec := get("/orders"); rec.Code != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+}
+
+func TestStartupGateComponents(t *testing.T) {
+	tests := []struct {
+		name       string
+		components []*dapr.MetadataRegisteredComponents
+		missing    []RequiredComponent
+	}{
+		{
+			name:       "state store not loaded",
+			components: []*dapr.MetadataRegisteredComponents{{Name: pubsubName, Type: "pubsub.redis"}},
+			missing:    []RequiredComponent{{Name: stateStoreName, Kind: "state"}},
+		},
+		{
+			name:       "pubsub of another kind",
+			components: []*dapr.MetadataRegisteredComponents{{Name: pubsubName, Type: "bindings.redis"}, {Name: stateStoreName, Type: "state.redis"}},
+			missing:    []RequiredComponent{{Name: pubsubName, Kind: "pubsub"}},
+		},
+		{
+			name:    "no component",
+			missing: requiredComponents,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the gate fails fast, rather than waiting for the components
+			gate := NewStartupGate(&fakeDaprClient{components: tt.components}, time.Minute, requiredComponents...)
+			start := time.Now()
+			err := gate.Wait(context.Background())
+			var componentsErr *ComponentsError
+			if !errors.As(err, &componentsErr) || !reflect.DeepEqual(componentsErr.Missing, tt.missing) {
+				t.Fatalf("expected the components %v missing. Got %v.", tt.missing, err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("expected the gate to fail fast. Got %s.", elapsed)
+			}
+			if gate.Open() {
+				t.Fatal("expected the gate closed.")
+			}
+		})
+	}
+}
+
+func TestStartupGateTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		client      *fakeDaprClient
+		expectedErr string
+	}{
+		{
+			name:        "sidecar unavailable",
+			client:      &fakeDaprClient{metadataErr: errors.New("connection refused")},
+			expectedErr: "sidecar unavailable: connection refused",
+		},
+		{
+			// the sidecar never reaches the app, e.g. on another app port
+			name: "subscription not registered",
+			client: &fakeDaprClient{
+				components:    []*dapr.MetadataRegisteredComponents{{Name: pubsubName, Type: "pubsub.redis"}, {Name: stateStoreName, Type: "state.redis"}},
+				subscriptions: []*dapr.MetadataSubscription{{PubsubName: pubsubName, Topic: topicOrdersPriority}},
+			},
+			expectedErr: "subscriptions not registered: order-pub-sub/orders",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gate := NewStartupGate(tt.client, 50*time.Millisecond, requiredComponents...)
+			gate.RequireSubscriptions(ordersSubscription)
+			gate.interval = 10 * time.Millisecond
+
+			err := gate.Wait(context.Background())
+			if err == nil || !strings.HasPrefix(err.Error(), "sidecar not ready after") || !strings.Contains(err.Error(), tt.expectedErr) {
+				t.Fatalf("expected error %q. Got %v.", tt.expectedErr, err)
+			}
+			if gate.Open() {
+				t.Fatal("expected the gate closed.")
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	statsStoreName = "order-stats"
+	statsKey       = "stats"
+
+	// latestOrdersSize is the number of orders most recently changed the
+	// stats hold.
+	latestOrdersSize = 10
+)
+
+// OrderStats is the read model of the orders, projected from the events of
+// the orders topic rather than read from the order store.
+type OrderStats struct {
+	// Counts is the number of orders per status.
+	Counts map[OrderStatus]int `json:"counts"`
+	Total  int                 `json:"total"`
+	// Latest are the orders most recently changed, the latest first.
+	Latest []OrderSummary `json:"latest"`
+}
+
+// OrderSummary is an order as of its latest event.
+type OrderSummary struct {
+	ID          string      `json:"id"`
+	Status      OrderStatus `json:"status"`
+	ProjectedAt time.Time   `json:"projectedAt"`
+}
+
+// projectedOrder is the status of an order the stats were projected with.
+type projectedOrder struct {
+	Status OrderStatus `json:"status"`
+}
+
+func projectedOrderKey(orderID string) string {
+	return "stats-order-" + orderID
+}
+
+// StatsStore maintains the stats of the orders in the Dapr state store. The
+// stats are a single document, next to which the status every order was
+// counted with is kept, so that an order changing status moves from a count
+// to another. Both are written in a single transaction, conditioned on their
+// ETags. Keys are scoped to the tenant of the context.
+type StatsStore struct {
+	client    dapr.Client
+	storeName string
+}
+
+func NewStatsStore(client dapr.Client) *StatsStore {
+	return &StatsStore{
+		client:    client,
+		storeName: statsStoreName,
+	}
+}
+
+// Get returns the stats of the orders.
+func (s *StatsStore) Get(ctx context.Context) (OrderStats, error) {
+	stats, _, err := s.get(ctx)
+	return stats, err
+}
+
+func (s *StatsStore) get(ctx context.Context) (OrderStats, string, error) {
+	stats := OrderStats{Counts: map[OrderStatus]int{}, Latest: []OrderSummary{}}
+	item, err := s.client.GetState(ctx, s.storeName, tenantKey(ctx, statsKey), nil)
+	if err != nil {
+		return OrderStats{}, "", err
+	}
+	if item == nil {
+		return stats, "", nil
+	}
+	if len(item.Value) > 0 {
+		if err := json.Unmarshal(item.Value, &stats); err != nil {
+			return OrderStats{}, "", fmt.Errorf("couldn't decode stats: %w", err)
+		}
+	}
+	return stats, item.Etag, nil
+}
+
+// Project counts order with its status, moving it from the status it was
+// counted with if any, and makes it the latest order, retrying when another
+// event was projected in the meantime. Projecting an event again only moves
+// its order to the front of the latest orders.
+func (s *StatsStore) Project(ctx context.Context, order Order) error {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: 10 * time.Millisecond, MaxDelay: 100 * time.Millisecond}
+	return policy.Do(ctx, func(ctx context.Context) error {
+		stats, etag, err := s.get(ctx)
+		if err != nil {
+			return Permanent(err)
+		}
+		item, err := s.client.GetState(ctx, s.storeName, tenantKey(ctx, projectedOrderKey(order.ID)), nil)
+		if err != nil {
+			return Permanent(err)
+		}
+		var projected projectedOrder
+		if item != nil && len(item.Value) > 0 {
+			if err := json.Unmarshal(item.Value, &projected); err != nil {
+				return Permanent(fmt.Errorf("couldn't decode projection of %s: %w", order.ID, err))
+			}
+		}
+
+		if projected.Status == "" {
+			stats.Total++
+		} else if stats.Counts[projected.Status]--; stats.Counts[projected.Status] <= 0 {
+			delete(stats.Counts, projected.Status)
+		}
+		stats.Counts[order.Status]++
+		stats.Latest = slices.DeleteFunc(stats.Latest, func(o OrderSummary) bool { return o.ID == order.ID })
+		stats.Latest = slices.Insert(stats.Latest, 0, OrderSummary{ID: order.ID, Status: order.Status, ProjectedAt: time.Now().UTC()})
+		stats.Latest = stats.Latest[:min(len(stats.Latest), latestOrdersSize)]
+
+		data, err := json.Marshal(stats)
+		if err != nil {
+			return Permanent(err)
+		}
+		orderData, err := json.Marshal(projectedOrder{Status: order.Status})
+		if err != nil {
+			return Permanent(err)
+		}
+		var orderETag string
+		if item != nil {
+			orderETag = item.Etag
+		}
+		err = s.client.ExecuteStateTransaction(ctx, s.storeName, nil, []*dapr.StateOperation{
+			upsertOperation(tenantKey(ctx, statsKey), data, etag),
+			upsertOperation(tenantKey(ctx, projectedOrderKey(order.ID)), orderData, orderETag),
+		})
+		// only a concurrent projection is worth retrying
+		if code := status.Code(err); err != nil && code != codes.Aborted && code != codes.InvalidArgument {
+			return Permanent(err)
+		}
+		return err
+	}, nil)
+}
+
+// handleStats answers the stats of the orders. They are eventually
+// consistent with the order store, lagging behind it by the events still to
+// be delivered.
+func (h *AppHandler) handleStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.stats.Get(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "couldn't get stats", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Service unavailable")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		slog.ErrorContext(r.Context(), "couldn't encode stats", "error", err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestStatsProject(t *testing.T) {
+	ctx := context.Background()
+	stats := NewStatsStore(&fakeDaprClient{})
+
+	for _, order := range []Order{
+		{ID: "order-1111", Status: OrderStatusPending},
+		{ID: "order-2222", Status: OrderStatusPending},
+		{ID: "order-1111", Status: OrderStatusPaid},
+		// a redelivered event is counted once
+		{ID: "order-1111", Status: OrderStatusPaid},
+	} {
+		if err := stats.Project(ctx, order); err != nil {
+			t.Fatalf("couldn't project order: %s", err)
+		}
+	}
+
+	got, err := stats.Get(ctx)
+	if err != nil {
+		t.Fatalf("couldn't get stats: %s", err)
+	}
+	expected := map[OrderStatus]int{OrderStatusPending: 1, OrderStatusPaid: 1}
+	if got.Total != 2 || !maps.Equal(got.Counts, expected) {
+		t.Fatalf("expected 2 orders counted as %v. Got %d counted as %v.", expected, got.Total, got.Counts)
+	}
+	latest := []OrderSummary{{ID: "order-1111", Status: OrderStatusPaid}, {ID: "order-2222", Status: OrderStatusPending}}
+	if !slices.EqualFunc(got.Latest, latest, func(a, b OrderSummary) bool { return a.ID == b.ID && a.Status == b.Status }) {
+		t.Fatalf("expected latest orders %v. Got %v.", latest, got.Latest)
+	}
+
+	// the stats of a tenant only count its orders
+	got, err = stats.Get(WithTenant(ctx, "acme"))
+	if err != nil {
+		t.Fatalf("couldn't get stats: %s", err)
+	}
+	if got.Total != 0 || len(got.Latest) != 0 {
+		t.Fatalf("expected no order counted for acme. Got %+v.", got)
+	}
+}
+
+func TestStatsFromOrderEvents(t *testing.T) {
+	h := newMockHandler(&mockPublisher{}, newMockOrderRepository())
+	h.stats = NewStatsStore(&fakeDaprClient{})
+	h.RegisterRoutes()
+
+	ids := []string{"order-1111", "order-2222", "order-3333", "order-4444", "order-5555", "order-6666",
+		"order-7777", "order-8888", "order-9999", "order-0001", "order-0002"}
+	for _, id := range ids {
+		rec := serve(h, http.MethodPost, routeOrderEvents, `{"datacontenttype":"application/json","data":{"id":"`+id+`","status":"PENDING"}}`)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), eventStatusSuccess) {
+			t.Fatalf("couldn't post event of %s. Got %d: %s", id, rec.Code, rec.Body)
+		}
+	}
+
+	rec := serve(h, http.MethodGet, "/v2/stats", "")
+	var stats OrderStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("couldn't decode stats: %s: %s", err, rec.Body)
+	}
+	if stats.Total != 11 || stats.Counts[OrderStatusPending] != 11 {
+		t.Fatalf("expected 11 pending orders. Got %+v.", stats)
+	}
+	if len(stats.Latest) != latestOrdersSize || stats.Latest[0].ID != "order-0002" {
+		t.Fatalf("expected the %d latest orders starting with order-0002. Got %v.", latestOrdersSize, stats.Latest)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Reasons reported when a status change is rejected.
+const (
+	TransitionReasonInvalid       = "invalid_transition"
+	TransitionReasonUnknownStatus = "unknown_status"
+)
+
+// TransitionError describes a rejected status change.
+type TransitionError struct {
+	From   OrderStatus `json:"from"`
+	To     OrderStatus `json:"to"`
+	Reason string      `json:"reason"`
+}
+
+func (e *TransitionError) Error() string {
+	if e.Reason == TransitionReasonUnknownStatus {
+		return fmt.Sprintf("unknown order status %q", e.To)
+	}
+	return fmt.Sprintf("order status can't change from %q to %q", e.From, e.To)
+}
+
+// TransitionTable lists for every status the statuses an order may move to.
+// The empty status is the one of an order that doesn't exist yet.
+type TransitionTable map[OrderStatus][]OrderStatus
+
+// orderTransitions is the order lifecycle: orders are created pending or
+// already paid, may be cancelled until they are paid, and refunded once they
+// are. Cancelled and refunded orders are final.
+var orderTransitions = TransitionTable{
+	"":                   {OrderStatusPending, OrderStatusPaid},
+	OrderStatusPending:   {OrderStatusPaid, OrderStatusCancelled},
+	OrderStatusPaid:      {OrderStatusRefunded},
+	OrderStatusUnknown:   {OrderStatusPending, OrderStatusPaid, OrderStatusCancelled},
+	OrderStatusCancelled: {},
+	OrderStatusRefunded:  {},
+}
+
+// statusEndpoints lists the statuses which can't be set by an update, but
+// only through an endpoint of their own, which publishes an event of its own.
+var statusEndpoints = map[OrderStatus]string{
+	OrderStatusCancelled: "POST /orders/{id}/cancel",
+	OrderStatusRefunded:  "POST /orders/{id}/refund",
+}
+
+// Statuses returns every status known to the table, except the empty one.
+func (t TransitionTable) Statuses() []OrderStatus {
+	statuses := make([]OrderStatus, 0, len(t))
+	for status := range t {
+		if status != "" {
+			statuses = append(statuses, status)
+		}
+	}
+	slices.Sort(statuses)
+	return statuses
+}
+
+// Check returns a *TransitionError if an order can't move from one status to
+// the other.
+func (t TransitionTable) Check(from, to OrderStatus) error {
+	if _, ok := t[to]; !ok || to == "" {
+		return &TransitionError{From: from, To: to, Reason: TransitionReasonUnknownStatus}
+	}
+	if !slices.Contains(t[from], to) {
+		return &TransitionError{From: from, To: to, Reason: TransitionReasonInvalid}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOrderTransitions(t *testing.T) {
+	allowed := map[OrderStatus]map[OrderStatus]bool{
+		"": {
+			OrderStatusPending: true,
+			OrderStatusPaid:    true,
+		},
+		OrderStatusPending: {
+			OrderStatusPaid:      true,
+			OrderStatusCancelled: true,
+		},
+		OrderStatusPaid: {
+			OrderStatusRefunded: true,
+		},
+		OrderStatusUnknown: {
+			OrderStatusPending:   true,
+			OrderStatusPaid:      true,
+			OrderStatusCancelled: true,
+		},
+		OrderStatusCancelled: {},
+		OrderStatusRefunded:  {},
+	}
+
+	from := append([]OrderStatus{""}, orderTransitions.Statuses()...)
+	for _, f := range from {
+		if _, ok := allowed[f]; !ok {
+			t.Fatalf("status %q is missing from the expected transitions", f)
+		}
+		for _, to := range orderTransitions.Statuses() {
+			err := orderTransitions.Check(f, to)
+			if allowed[f][to] {
+				if err != nil {
+					t.Errorf("expected %q -> %q to be allowed. Got %s.", f, to, err)
+				}
+				continue
+			}
+
+			var transitionErr *TransitionError
+			if !errors.As(err, &transitionErr) || transitionErr.Reason != TransitionReasonInvalid {
+				t.Errorf("expected %q -> %q to be rejected as %s. Got %v.", f, to, TransitionReasonInvalid, err)
+			}
+		}
+	}
+}
+
+func TestOrderTransitionsUnknownStatus(t *testing.T) {
+	for _, to := range []OrderStatus{"", "SHIPPED", "paid"} {
+		var transitionErr *TransitionError
+		err := orderTransitions.Check(OrderStatusPending, to)
+		if !errors.As(err, &transitionErr) || transitionErr.Reason != TransitionReasonUnknownStatus {
+			t.Errorf("expected %q to be rejected as %s. Got %v.", to, TransitionReasonUnknownStatus, err)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const stateStoreName = "order-state"
+
+var (
+	// ErrOrderNotFound is returned when no order is stored under an ID.
+	ErrOrderNotFound = errors.New("order not found")
+	// ErrETagMismatch is returned when an order was modified since the
+	// version a write is based on.
+	ErrETagMismatch = errors.New("etag mismatch")
+)
+
+// etagAbsent is the etag to Save an order with to create it: the order is
+// only saved if none is stored under its ID yet.
+const etagAbsent = "\x00absent"
+
+// StateQuery is a query against the Dapr state query API. See
+// https://docs.dapr.io/developing-applications/building-blocks/state-management/howto-state-query-api/
+type StateQuery struct {
+	Filter map[string]any `json:"filter,omitempty"`
+	Sort   []QuerySort    `json:"sort,omitempty"`
+	Page   QueryPage      `json:"page"`
+}
+
+type QuerySort struct {
+	Key   string `json:"key"`
+	Order string `json:"order,omitempty"`
+}
+
+type QueryPage struct {
+	Limit int    `json:"limit"`
+	Token string `json:"token,omitempty"`
+}
+
+// QueryBuilder builds a StateQuery.
+type QueryBuilder struct {
+	query StateQuery
+}
+
+func NewQuery() *QueryBuilder {
+	return &QueryBuilder{}
+}
+
+// Equal filters the results on key being equal to value. Several calls are
+// combined with AND.
+func (b *QueryBuilder) Equal(key string, value any) *QueryBuilder {
+	eq := map[string]any{"EQ": map[string]any{key: value}}
+
+	switch {
+	case b.query.Filter == nil:
+		b.query.Filter = eq
+	case b.query.Filter["AND"] != nil:
+		b.query.Filter["AND"] = append(b.query.Filter["AND"].([]any), eq)
+	default:
+		b.query.Filter = map[string]any{"AND": []any{b.query.Filter, eq}}
+	}
+	return b
+}
+
+// SortBy sorts the results on key, in ascending order unless desc is true.
+func (b *QueryBuilder) SortBy(key string, desc bool) *QueryBuilder {
+	sort := QuerySort{Key: key}
+	if desc {
+		sort.Order = "DESC"
+	}
+	b.query.Sort = append(b.query.Sort, sort)
+	return b
+}
+
+// Page limits the results to limit items starting at offset. Query-capable
+// stores such as PostgreSQL and MongoDB use the offset as pagination token.
+func (b *QueryBuilder) Page(limit, offset int) *QueryBuilder {
+	b.query.Page = QueryPage{Limit: limit}
+	if offset > 0 {
+		b.query.Page.Token = strconv.Itoa(offset)
+	}
+	return b
+}
+
+func (b *QueryBuilder) Build() StateQuery {
+	return b.query
+}
+
+// OrderList is a page of orders.
+type OrderList struct {
+	Items      []Order `json:"items"`
+	Limit      int     `json:"limit"`
+	Offset     int     `json:"offset"`
+	NextOffset *int    `json:"nextOffset,omitempty"`
+}
+
+// OrderRepository persists the orders of the handlers, which thus don't
+// depend on where orders are stored. *OrderStore keeps them in the Dapr state
+// store, and *MemoryOrderRepository in memory.
+//
+// Get returns an order along with its ETag, its stored version. Save and
+// Delete only apply if the order still has the version etag, returning
+// ErrETagMismatch otherwise, unless etag is empty. Save with etagAbsent only
+// creates the order, returning ErrETagMismatch if it's already stored. Orders
+// are scoped to the tenant of ctx.
+type OrderRepository interface {
+	Get(ctx context.Context, id string) (Order, string, error)
+	Save(ctx context.Context, order Order, etag string) error
+	List(ctx context.Context, limit, offset int) (*OrderList, error)
+	Delete(ctx context.Context, id, etag string) error
+}
+
+// OrderStore persists orders in the Dapr state store.
+type OrderStore struct {
+	client    dapr.Client
+	storeName string
+}
+
+func NewOrderStore(client dapr.Client) *OrderStore {
+	return &OrderStore{
+		client:    client,
+		storeName: stateStoreName,
+	}
+}
+
+// Check reads the state store, for the health checks.
+func (s *OrderStore) Check(ctx context.Context) error {
+	_, err := s.client.GetState(ctx, s.storeName, healthProbeKey, nil)
+	return err
+}
+
+// Get returns the order stored under id along with its ETag.
+func (s *OrderStore) Get(ctx context.Context, id string) (Order, string, error) {
+	item, err := s.client.GetState(ctx, s.storeName, tenantKey(ctx, id), nil)
+	if err != nil {
+		return Order{}, "", err
+	}
+	if item == nil || len(item.Value) == 0 {
+		return Order{}, "", ErrOrderNotFound
+	}
+
+	var order Order
+	if err := json.Unmarshal(item.Value, &order); err != nil {
+		return Order{}, "", fmt.Errorf("couldn't decode order %s: %w", id, err)
+	}
+	return order, item.Etag, nil
+}
+
+// Save stores order under its ID, scoped to the tenant of ctx, only if the
+// stored version still matches etag. An empty etag writes the order
+// unconditionally, and etagAbsent only if no order is stored yet, which
+// first-write concurrency without ETag does atomically. ErrETagMismatch is
+// returned when the order was modified in the meantime.
+func (s *OrderStore) Save(ctx context.Context, order Order, etag string) error {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+
+	concurrency, tag := dapr.StateConcurrencyFirstWrite, etag
+	switch etag {
+	case "":
+		concurrency = dapr.StateConcurrencyLastWrite
+	case etagAbsent:
+		tag = ""
+	}
+	err = s.client.SaveStateWithETag(ctx, s.storeName, tenantKey(ctx, order.ID), data, tag,
+		map[string]string{"contentType": "application/json"},
+		dapr.WithConcurrency(concurrency))
+
+	// the sidecar answers Aborted on mismatch and InvalidArgument when the
+	// ETag isn't one the store could have produced
+	if code := status.Code(err); etag != "" && (code == codes.Aborted || code == codes.InvalidArgument) {
+		return fmt.Errorf("%w: %w", ErrETagMismatch, err)
+	}
+	return err
+}
+
+// Delete deletes order id only if the stored version still matches etag. An
+// empty etag deletes the order unconditionally. ErrETagMismatch is returned
+// when the order was modified in the meantime.
+func (s *OrderStore) Delete(ctx context.Context, id, etag string) error {
+	var tag *dapr.ETag
+	if etag != "" {
+		tag = &dapr.ETag{Value: etag}
+	}
+	err := s.client.DeleteStateWithETag(ctx, s.storeName, tenantKey(ctx, id), tag, nil,
+		&dapr.StateOptions{Concurrency: dapr.StateConcurrencyFirstWrite})
+	if code := status.Code(err); etag != "" && (code == codes.Aborted || code == codes.InvalidArgument) {
+		return fmt.Errorf("%w: %w", ErrETagMismatch, err)
+	}
+	return err
+}
+
+// RevertOrder undoes the update of an order of repo to updated by restoring
+// previous, or by deleting the order if it didn't exist before.
+// ErrETagMismatch is returned, and nothing is reverted, if the order was
+// modified since the update.
+func RevertOrder(ctx context.Context, repo OrderRepository, updated, previous Order, existed bool) error {
+	stored, etag, err := repo.Get(ctx, updated.ID)
+	if errors.Is(err, ErrOrderNotFound) {
+		return ErrETagMismatch
+	}
+	if err != nil {
+		return err
+	}
+	if stored.Status != updated.Status || !sameContent(stored, updated) {
+		return ErrETagMismatch
+	}
+	if !existed {
+		return repo.Delete(ctx, updated.ID, etag)
+	}
+	return repo.Save(ctx, previous, etag)
+}
+
+// List returns limit orders sorted by ID, starting at offset. Only the orders
+// of the tenant of ctx are listed when multi-tenancy is enabled.
+func (s *OrderStore) List(ctx context.Context, limit, offset int) (*OrderList, error) {
+	builder := NewQuery()
+	if tenant := TenantFromContext(ctx); tenant != "" {
+		builder.Equal("tenant", tenant)
+	}
+	query, err := json.Marshal(builder.SortBy("id", false).Page(limit, offset).Build())
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.QueryStateAlpha1(ctx, s.storeName, string(query), map[string]string{"contentType": "application/json"})
+	if err != nil {
+		return nil, err
+	}
+
+	list := &OrderList{
+		Items:  make([]Order, 0, len(resp.Results)),
+		Limit:  limit,
+		Offset: offset,
+	}
+	for _, item := range resp.Results {
+		if item.Error != "" {
+			return nil, fmt.Errorf("couldn't query order %s: %s", item.Key, item.Error)
+		}
+		var order Order
+		if err := json.Unmarshal(item.Value, &order); err != nil {
+			return nil, fmt.Errorf("couldn't decode order %s: %w", item.Key, err)
+		}
+		list.Items = append(list.Items, order)
+	}
+
+	if resp.Token != "" && len(list.Items) == limit {
+		next, err := strconv.Atoi(resp.Token)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected pagination token %q: %w", resp.Token, err)
+		}
+		list.NextOffset = &next
+	}
+
+	return list, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestQueryBuilder(t *testing.T) {
+	query := NewQuery().
+		Equal("status", OrderStatusPaid).
+		Equal("customer", "c-1").
+		SortBy("id", true).
+		Page(10, 20).
+		Build()
+
+	got, err := json.Marshal(query)
+	if err != nil {
+		t.Fatalf("couldn't marshal query: %s", err)
+	}
+
+	expected := `{"filter":{"AND":[{"EQ":{"status":"PAID"}},{"EQ":{"customer":"c-1"}}]},"sort":[{"key":"id","order":"DESC"}],"page":{"limit":10,"token":"20"}}`
+	if string(got) != expected {
+		t.Fatalf("expected query %s. Got %s.", expected, got)
+	}
+}
+
+// orderRepositories returns an instance of every OrderRepository, which all
+// behave alike.
+func orderRepositories() map[string]OrderRepository {
+	return map[string]OrderRepository{
+		"dapr":      NewOrderStore(&fakeDaprClient{}),
+		"memory":    NewMemoryOrderRepository(),
+		"events":    NewEventSourcedOrderRepository(NewEventStore(&fakeDaprClient{}), 0),
+		"snapshots": NewEventSourcedOrderRepository(NewEventStore(&fakeDaprClient{}), 2),
+	}
+}
+
+func TestOrderRepositoryList(t *testing.T) {
+	for name, store := range orderRepositories() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			for _, id := range []string{"order-0003", "order-0001", "order-0002"} {
+				if err := store.Save(ctx, Order{ID: id, Status: OrderStatusPending}, ""); err != nil {
+					t.Fatalf("couldn't save order: %s", err)
+				}
+			}
+
+			page, err := store.List(ctx, 2, 0)
+			if err != nil {
+				t.Fatalf("couldn't list orders: %s", err)
+			}
+			if len(page.Items) != 2 || page.Items[0].ID != "order-0001" || page.Items[1].ID != "order-0002" {
+				t.Fatalf("expected first page to contain order-0001 and order-0002. Got %v.", page.Items)
+			}
+			if page.NextOffset == nil || *page.NextOffset != 2 {
+				t.Fatalf("expected next offset 2. Got %v.", page.NextOffset)
+			}
+
+			page, err = store.List(ctx, 2, 2)
+			if err != nil {
+				t.Fatalf("couldn't list orders: %s", err)
+			}
+			if len(page.Items) != 1 || page.Items[0].ID != "order-0003" {
+				t.Fatalf("expected last page to contain order-0003. Got %v.", page.Items)
+			}
+			if page.NextOffset != nil {
+				t.Fatalf("expected no next offset on the last page. Got %d.", *page.NextOffset)
+			}
+		})
+	}
+}
+
+func TestOrderRepositorySave(t *testing.T) {
+	for name, store := range orderRepositories() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			if _, _, err := store.Get(ctx, "order-1234"); !errors.Is(err, ErrOrderNotFound) {
+				t.Fatalf("expected error %q. Got %v.", ErrOrderNotFound, err)
+			}
+
+			if err := store.Save(ctx, Order{ID: "order-1234", Status: OrderStatusPending}, etagAbsent); err != nil {
+				t.Fatalf("couldn't save order: %s", err)
+			}
+			// the order is only created once
+			err := store.Save(ctx, Order{ID: "order-1234", Status: OrderStatusUnknown}, etagAbsent)
+			if !errors.Is(err, ErrETagMismatch) {
+				t.Fatalf("expected error %q. Got %v.", ErrETagMismatch, err)
+			}
+			_, etag, err := store.Get(ctx, "order-1234")
+			if err != nil {
+				t.Fatalf("couldn't get order: %s", err)
+			}
+
+			if err := store.Save(ctx, Order{ID: "order-1234", Status: OrderStatusPaid}, etag); err != nil {
+				t.Fatalf("couldn't save order: %s", err)
+			}
+
+			// the ETag read before the previous write is now stale
+			err = store.Save(ctx, Order{ID: "order-1234", Status: OrderStatusUnknown}, etag)
+			if !errors.Is(err, ErrETagMismatch) {
+				t.Fatalf("expected error %q. Got %v.", ErrETagMismatch, err)
+			}
+
+			order, _, err := store.Get(ctx, "order-1234")
+			if err != nil {
+				t.Fatalf("couldn't get order: %s", err)
+			}
+			if order.Status != OrderStatusPaid {
+				t.Fatalf("expected stored status %s. Got %s.", OrderStatusPaid, order.Status)
+			}
+		})
+	}
+}
+
+func TestRevertOrder(t *testing.T) {
+	for name, store := range orderRepositories() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			pending := Order{ID: "order-1234", Status: OrderStatusPending}
+			paid := Order{ID: "order-1234", Status: OrderStatusPaid}
+
+			// an order created by the update is deleted
+			if err := store.Save(ctx, pending, ""); err != nil {
+				t.Fatalf("couldn't save order: %s", err)
+			}
+			if err := RevertOrder(ctx, store, pending, Order{}, false); err != nil {
+				t.Fatalf("couldn't revert order: %s", err)
+			}
+			if _, _, err := store.Get(ctx, "order-1234"); !errors.Is(err, ErrOrderNotFound) {
+				t.Fatalf("expected error %q. Got %v.", ErrOrderNotFound, err)
+			}
+
+			// an order that existed is restored
+			if err := store.Save(ctx, pending, ""); err != nil {
+				t.Fatalf("couldn't save order: %s", err)
+			}
+			_, etag, err := store.Get(ctx, "order-1234")
+			if err != nil {
+				t.Fatalf("couldn't get order: %s", err)
+			}
+			if err := store.Save(ctx, paid, etag); err != nil {
+				t.Fatalf("couldn't save order: %s", err)
+			}
+			if err := RevertOrder(ctx, store, paid, pending, true); err != nil {
+				t.Fatalf("couldn't revert order: %s", err)
+			}
+			order, _, err := store.Get(ctx, "order-1234")
+			if err != nil {
+				t.Fatalf("couldn't get order: %s", err)
+			}
+			if order.Status != OrderStatusPending {
+				t.Fatalf("expected stored status %s. Got %s.", OrderStatusPending, order.Status)
+			}
+
+			// an order modified since the update is left alone
+			if err := RevertOrder(ctx, store, paid, Order{}, false); !errors.Is(err, ErrETagMismatch) {
+				t.Fatalf("expected error %q. Got %v.", ErrETagMismatch, err)
+			}
+			if _, _, err := store.Get(ctx, "order-1234"); err != nil {
+				t.Fatalf("expected order to be kept. Got %v.", err)
+			}
+		})
+	}
+}
+
+func TestOrderRepositoryDelete(t *testing.T) {
+	for name, store := range orderRepositories() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			if err := store.Save(ctx, Order{ID: "order-1234", Status: OrderStatusPending}, ""); err != nil {
+				t.Fatalf("couldn't save order: %s", err)
+			}
+			_, etag, err := store.Get(ctx, "order-1234")
+			if err != nil {
+				t.Fatalf("couldn't get order: %s", err)
+			}
+			if err := store.Save(ctx, Order{ID: "order-1234", Status: OrderStatusPaid}, etag); err != nil {
+				t.Fatalf("couldn't save order: %s", err)
+			}
+
+			// the ETag read before the previous write is now stale
+			if err := store.Delete(ctx, "order-1234", etag); !errors.Is(err, ErrETagMismatch) {
+				t.Fatalf("expected error %q. Got %v.", ErrETagMismatch, err)
+			}
+			if err := store.Delete(ctx, "order-1234", ""); err != nil {
+				t.Fatalf("couldn't delete order: %s", err)
+			}
+			if _, _, err := store.Get(ctx, "order-1234"); !errors.Is(err, ErrOrderNotFound) {
+				t.Fatalf("expected error %q. Got %v.", ErrOrderNotFound, err)
+			}
+		})
+	}
+}
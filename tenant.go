@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	headerTenantID = "X-Tenant-ID"
+
+	// tenantKeySeparator separates the tenant from the key of a state entry,
+	// the way the sidecar prefixes keys with the app ID.
+	tenantKeySeparator = "||"
+)
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// TenantConfig controls multi-tenancy. When enabled, every request to the
+// order, webhook and websocket routes must carry an X-Tenant-ID header, and
+// the state, events and notifications they produce are scoped to the tenant.
+type TenantConfig struct {
+	Enabled bool
+	// Allowlist restricts the accepted tenants, any valid tenant ID is
+	// accepted when it is empty.
+	Allowlist []string
+}
+
+// tenantLabelOther is the metric label of the tenants when no allowlist
+// bounds them.
+const tenantLabelOther = "other"
+
+// MetricLabel returns the metric label of tenant: the tenant itself when the
+// allowlist bounds the tenants, and tenantLabelOther otherwise, so that the
+// clients can't create a time series per tenant ID they make up.
+func (c TenantConfig) MetricLabel(tenant string) string {
+	if tenant == "" || slices.Contains(c.Allowlist, tenant) {
+		return tenant
+	}
+	return tenantLabelOther
+}
+
+type tenantContextKey struct{}
+
+// WithTenant returns a copy of ctx scoped to tenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant ctx is scoped to, or an empty string
+// when multi-tenancy is disabled.
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantContextKey{}).(string)
+	return tenant
+}
+
+// tenantKey scopes key to the tenant of ctx.
+func tenantKey(ctx context.Context, key string) string {
+	if tenant := TenantFromContext(ctx); tenant != "" {
+		return tenant + tenantKeySeparator + key
+	}
+	return key
+}
+
+// ValidateTenantID ensures tenant IDs are safe to embed in state keys and
+// metric labels.
+func ValidateTenantID(tenant string) error {
+	if !tenantIDPattern.MatchString(tenant) {
+		return fmt.Errorf("invalid tenant ID %q: must be lowercase alphanumeric or '-', up to 63 characters", tenant)
+	}
+	return nil
+}
+
+// RequireTenant scopes requests to the tenant of their X-Tenant-ID header,
+// rejecting those without a valid, allowed tenant. It does nothing when
+// multi-tenancy is disabled.
+func RequireTenant(config TenantConfig, metrics *Metrics) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if !config.Enabled {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenant := r.Header.Get(headerTenantID)
+			if tenant == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "Bad request: missing %s header", headerTenantID)
+				return
+			}
+			if err := ValidateTenantID(tenant); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "Bad request: %s", err)
+				return
+			}
+			if len(config.Allowlist) > 0 && !slices.Contains(config.Allowlist, tenant) {
+				slog.WarnContext(r.Context(), "rejected request for unknown tenant", "path", r.URL.Path, "tenant", tenant)
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintf(w, "Forbidden: unknown tenant")
+				return
+			}
+
+			metrics.TenantRequests.WithLabelValues(config.MetricLabel(tenant)).Inc()
+			next.ServeHTTP(w, r.WithContext(WithTenant(r.Context(), tenant)))
+		})
+	}
+}
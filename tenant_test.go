@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRequireTenant(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     TenantConfig
+		tenant     string
+		wantStatus int
+		wantTenant string
+		// wantLabel is the label the request is counted under, if counted
+		wantLabel string
+	}{
+		{"disabled", TenantConfig{}, "acme", http.StatusOK, "", ""},
+		{"missing header", TenantConfig{Enabled: true}, "", http.StatusBadRequest, "", ""},
+		{"invalid tenant", TenantConfig{Enabled: true}, "Acme Corp", http.StatusBadRequest, "", ""},
+		{"any tenant", TenantConfig{Enabled: true}, "acme", http.StatusOK, "acme", tenantLabelOther},
+		{"allowed tenant", TenantConfig{Enabled: true, Allowlist: []string{"acme"}}, "acme", http.StatusOK, "acme", "acme"},
+		{"unknown tenant", TenantConfig{Enabled: true, Allowlist: []string{"acme"}}, "globex", http.StatusForbidden, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotTenant string
+			metrics := NewMetrics()
+			handler := RequireTenant(tt.config, metrics)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotTenant = TenantFromContext(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+			if tt.tenant != "" {
+				req.Header.Set(headerTenantID, tt.tenant)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected status code %d. Got %d.", tt.wantStatus, rec.Code)
+			}
+			if gotTenant != tt.wantTenant {
+				t.Fatalf("expected tenant %q. Got %q.", tt.wantTenant, gotTenant)
+			}
+			if tt.wantLabel != "" {
+				if got := testutil.ToFloat64(metrics.TenantRequests.WithLabelValues(tt.wantLabel)); got != 1 {
+					t.Fatalf("expected 1 request counted for %q. Got %f.", tt.wantLabel, got)
+				}
+			} else if got := testutil.CollectAndCount(metrics.TenantRequests); got != 0 {
+				t.Fatalf("expected no request counted. Got %d.", got)
+			}
+		})
+	}
+}
+
+func TestOrderRepositoryTenantScoping(t *testing.T) {
+	for name, store := range orderRepositories() {
+		t.Run(name, func(t *testing.T) {
+			acme := WithTenant(context.Background(), "acme")
+			globex := WithTenant(context.Background(), "globex")
+
+			if err := store.Save(acme, Order{ID: "order-1234", Status: OrderStatusPaid, Tenant: "acme"}, ""); err != nil {
+				t.Fatalf("couldn't save order: %s", err)
+			}
+
+			if _, _, err := store.Get(acme, "order-1234"); err != nil {
+				t.Fatalf("expected the order to be found for its tenant. Got %s.", err)
+			}
+			if _, _, err := store.Get(globex, "order-1234"); !errors.Is(err, ErrOrderNotFound) {
+				t.Fatalf("expected ErrOrderNotFound for another tenant. Got %v.", err)
+			}
+
+			list, err := store.List(globex, 10, 0)
+			if err != nil {
+				t.Fatalf("couldn't list orders: %s", err)
+			}
+			if len(list.Items) != 0 {
+				t.Fatalf("expected no order listed for another tenant. Got %v.", list.Items)
+			}
+			list, err = store.List(acme, 10, 0)
+			if err != nil {
+				t.Fatalf("couldn't list orders: %s", err)
+			}
+			if len(list.Items) != 1 || list.Items[0].ID != "order-1234" {
+				t.Fatalf("expected order-1234 to be listed for its tenant. Got %v.", list.Items)
+			}
+		})
+	}
+}
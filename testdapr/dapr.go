@@ -0,0 +1,309 @@
+// Package testdapr runs a Dapr sidecar (daprd) in a container for tests.
+package testdapr
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+const (
+	// DefaultImage is the daprd image started unless WithImage is given.
+	DefaultImage = "daprio/daprd"
+
+	// HTTPPort and GRPCPort are the ports of the Dapr APIs in the container.
+	HTTPPort nat.Port = "3500/tcp"
+	GRPCPort nat.Port = "50001/tcp"
+	// MetricsPort is the port daprd serves its Prometheus metrics on.
+	MetricsPort nat.Port = "9090/tcp"
+
+	// componentsPath is where component files are copied in the container.
+	componentsPath = "./components"
+	// configPath is where the configuration file is copied in the container.
+	configPath = "./config.yaml"
+)
+
+// settings are the daprd flags and files set by the options.
+type settings struct {
+	image       string
+	appID       string
+	appAddress  string
+	appPort     int
+	appProtocol string
+	logLevel    string
+	apiToken    string
+	components  []string
+	config      string
+	placement   string
+	scheduler   string
+
+	sentry       string
+	trustAnchors string
+}
+
+// Option configures the sidecar started by Run. Run also accepts any
+// testcontainers.ContainerCustomizer, applied to the request once it has been
+// built from the options.
+type Option func(*settings)
+
+// Customize implements testcontainers.ContainerCustomizer. Options are applied
+// by Run before the request exists, so there is nothing left to do.
+func (Option) Customize(*testcontainers.GenericContainerRequest) {}
+
+// WithImage sets the daprd image.
+func WithImage(image string) Option {
+	return func(s *settings) {
+		s.image = image
+	}
+}
+
+// WithAppID sets the ID of the app the sidecar runs for.
+func WithAppID(appID string) Option {
+	return func(s *settings) {
+		s.appID = appID
+	}
+}
+
+// WithAppChannel has the sidecar call the app at address:port, for instance to
+// deliver the events of its subscriptions. Without it, the sidecar runs
+// without an app.
+func WithAppChannel(address string, port int) Option {
+	return func(s *settings) {
+		s.appAddress = address
+		s.appPort = port
+	}
+}
+
+// WithAppProtocol sets the protocol of the app channel, http by default.
+func WithAppProtocol(protocol string) Option {
+	return func(s *settings) {
+		s.appProtocol = protocol
+	}
+}
+
+// WithComponents copies the component files at paths on the host into the
+// resources directory of the sidecar.
+func WithComponents(paths ...string) Option {
+	return func(s *settings) {
+		s.components = append(s.components, paths...)
+	}
+}
+
+// WithConfig has the sidecar load the Dapr configuration at path on the host,
+// to enable tracing for instance.
+func WithConfig(path string) Option {
+	return func(s *settings) {
+		s.config = path
+	}
+}
+
+// WithLogLevel sets the log level of daprd, info by default.
+func WithLogLevel(level string) Option {
+	return func(s *settings) {
+		s.logLevel = level
+	}
+}
+
+// WithAPIToken enables API token authentication: calls to the sidecar must
+// then carry token.
+func WithAPIToken(token string) Option {
+	return func(s *settings) {
+		s.apiToken = token
+	}
+}
+
+// WithPlacement has the sidecar register the actors of its app with the
+// placement service at address, which actors require.
+func WithPlacement(address string) Option {
+	return func(s *settings) {
+		s.placement = address
+	}
+}
+
+// WithScheduler has the sidecar schedule the jobs of its app with the
+// scheduler service at address, which the jobs API requires.
+func WithScheduler(address string) Option {
+	return func(s *settings) {
+		s.scheduler = address
+	}
+}
+
+// WithMTLS enables mTLS: the sidecar gets its certificate from the Sentry
+// service at sentryAddress, and trusts the PEM encoded trustAnchors.
+func WithMTLS(sentryAddress string, trustAnchors []byte) Option {
+	return func(s *settings) {
+		s.sentry = sentryAddress
+		s.trustAnchors = string(trustAnchors)
+	}
+}
+
+// Container is a running daprd sidecar.
+type Container struct {
+	testcontainers.Container
+
+	appID string
+	req   testcontainers.ContainerRequest
+}
+
+// AppID returns the ID of the app the sidecar runs for.
+func (c *Container) AppID() string {
+	return c.appID
+}
+
+// Request returns the request the container was started from.
+func (c *Container) Request() testcontainers.ContainerRequest {
+	return c.req
+}
+
+// HTTPEndpoint returns the base URL of the HTTP API of the sidecar, from the
+// host.
+func (c *Container) HTTPEndpoint(ctx context.Context) (string, error) {
+	addr, err := c.address(ctx, HTTPPort)
+	if err != nil {
+		return "", err
+	}
+	return "http://" + addr, nil
+}
+
+// GRPCEndpoint returns the host:port address of the gRPC API of the sidecar,
+// from the host.
+func (c *Container) GRPCEndpoint(ctx context.Context) (string, error) {
+	return c.address(ctx, GRPCPort)
+}
+
+func (c *Container) address(ctx context.Context, port nat.Port) (string, error) {
+	host, err := c.Host(ctx)
+	if err != nil {
+		return "", err
+	}
+	mappedPort, err := c.MappedPort(ctx, port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, mappedPort.Port()), nil
+}
+
+// Run starts a sidecar and waits for its health endpoint to report it
+// initialized. On failure, the container is returned if it was created, so
+// that it can be terminated.
+func Run(ctx context.Context, opts ...testcontainers.ContainerCustomizer) (*Container, error) {
+	s := settings{
+		image:       DefaultImage,
+		appProtocol: "http",
+		logLevel:    "info",
+	}
+	for _, opt := range opts {
+		if o, ok := opt.(Option); ok {
+			o(&s)
+		}
+	}
+	if s.appID == "" {
+		return nil, fmt.Errorf("testdapr: an app ID is required")
+	}
+
+	req := testcontainers.GenericContainerRequest{
+		ContainerRequest: newRequest(s),
+		Started:          true,
+	}
+	for _, opt := range opts {
+		if _, ok := opt.(Option); !ok {
+			opt.Customize(&req)
+		}
+	}
+
+	c, err := testcontainers.GenericContainer(ctx, req)
+	if c == nil {
+		return nil, err
+	}
+	return &Container{Container: c, appID: s.appID, req: req.ContainerRequest}, err
+}
+
+// healthzPath is the health endpoint of the HTTP API, which answers 204 once
+// the sidecar is initialized. Unlike the API, it doesn't require the API
+// token.
+const healthzPath = "/v1.0/healthz"
+
+// waitForHealthy waits for the health endpoint of the sidecar to report it
+// initialized, which doesn't depend on the format of the daprd logs.
+func waitForHealthy() wait.Strategy {
+	return wait.ForHTTP(healthzPath).
+		WithPort(HTTPPort).
+		WithStatusCodeMatcher(func(status int) bool {
+			return status == http.StatusNoContent
+		})
+}
+
+// newRequest builds the container request of the sidecar described by s.
+func newRequest(s settings) testcontainers.ContainerRequest {
+	cmd := []string{
+		"./daprd",
+		"-app-id", s.appID,
+		"-dapr-listen-addresses", "0.0.0.0",
+		"-dapr-http-port", HTTPPort.Port(),
+		"-dapr-grpc-port", GRPCPort.Port(),
+		"-metrics-port", MetricsPort.Port(),
+		"-resources-path", componentsPath,
+		"-log-level", s.logLevel,
+	}
+	if s.config != "" {
+		cmd = append(cmd, "-config", configPath)
+	}
+	if s.placement != "" {
+		cmd = append(cmd, "-placement-host-address", s.placement)
+	}
+	if s.scheduler != "" {
+		cmd = append(cmd, "-scheduler-host-address", s.scheduler)
+	}
+	if s.sentry != "" {
+		cmd = append(cmd, "-enable-mtls", "-sentry-address", s.sentry)
+	}
+	if s.appPort != 0 {
+		cmd = append(cmd,
+			"-app-port", strconv.Itoa(s.appPort),
+			"-app-protocol", s.appProtocol,
+		)
+		if s.appAddress != "" {
+			cmd = append(cmd, "-app-channel-address", s.appAddress)
+		}
+	}
+
+	req := testcontainers.ContainerRequest{
+		Image:        s.image,
+		ExposedPorts: []string{string(HTTPPort), string(GRPCPort)},
+		WaitingFor:   waitForHealthy(),
+		Cmd:          cmd,
+	}
+	if s.config != "" {
+		req.Files = append(req.Files, testcontainers.ContainerFile{
+			HostFilePath:      s.config,
+			ContainerFilePath: configPath,
+			FileMode:          0o644,
+		})
+	}
+	for _, path := range s.components {
+		req.Files = append(req.Files, testcontainers.ContainerFile{
+			HostFilePath:      path,
+			ContainerFilePath: componentsPath + "/" + filepath.Base(path),
+			FileMode:          0o644,
+		})
+	}
+	// daprd reads its API token and trust anchors from the environment
+	env := map[string]string{}
+	if s.apiToken != "" {
+		env["DAPR_API_TOKEN"] = s.apiToken
+	}
+	if s.trustAnchors != "" {
+		env["DAPR_TRUST_ANCHORS"] = s.trustAnchors
+	}
+	if len(env) > 0 {
+		req.Env = env
+	}
+	return req
+}
@@ -0,0 +1,73 @@
+package testdapr
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+func TestNewRequest(t *testing.T) {
+	s := settings{image: DefaultImage, appProtocol: "http", logLevel: "info"}
+	for _, opt := range []Option{
+		WithAppID("app"),
+		WithAppChannel("app", 3000),
+		WithComponents("../order-pub-sub.yaml", "../order-state.yaml"),
+		WithAPIToken("secret"),
+		WithPlacement("placement:50005"),
+		WithScheduler("scheduler:50006"),
+		WithMTLS("sentry:50001", []byte("anchors")),
+		WithConfig("../testdata/dapr-tracing.yaml"),
+	} {
+		opt(&s)
+	}
+
+	req := newRequest(s)
+
+	want := []string{
+		"./daprd",
+		"-app-id", "app",
+		"-dapr-listen-addresses", "0.0.0.0",
+		"-dapr-http-port", "3500",
+		"-dapr-grpc-port", "50001",
+		"-metrics-port", "9090",
+		"-resources-path", "./components",
+		"-log-level", "info",
+		"-config", "./config.yaml",
+		"-placement-host-address", "placement:50005",
+		"-scheduler-host-address", "scheduler:50006",
+		"-enable-mtls",
+		"-sentry-address", "sentry:50001",
+		"-app-port", "3000",
+		"-app-protocol", "http",
+		"-app-channel-address", "app",
+	}
+	if !slices.Equal(req.Cmd, want) {
+		t.Fatalf("expected command %v. Got %v.", want, req.Cmd)
+	}
+	if req.Image != DefaultImage {
+		t.Fatalf("expected image %s. Got %s.", DefaultImage, req.Image)
+	}
+	if len(req.Files) != 3 || req.Files[0].ContainerFilePath != "./config.yaml" || req.Files[2].ContainerFilePath != "./components/order-state.yaml" {
+		t.Fatalf("expected the configuration and components to be copied. Got %v.", req.Files)
+	}
+	if strategy, ok := req.WaitingFor.(*wait.HTTPStrategy); !ok || strategy.Path != "/v1.0/healthz" || strategy.Port != HTTPPort {
+		t.Fatalf("expected to wait for the health endpoint of the HTTP API. Got %v.", req.WaitingFor)
+	}
+	if req.Env["DAPR_API_TOKEN"] != "secret" || req.Env["DAPR_TRUST_ANCHORS"] != "anchors" {
+		t.Fatalf("expected the API token and trust anchors in the environment. Got %v.", req.Env)
+	}
+}
+
+func TestNewRequestWithoutApp(t *testing.T) {
+	req := newRequest(settings{image: DefaultImage, appID: "standalone", appProtocol: "http", logLevel: "info"})
+
+	for _, arg := range req.Cmd {
+		if arg == "-app-port" || arg == "-app-channel-address" || arg == "-placement-host-address" || arg == "-scheduler-host-address" || arg == "-enable-mtls" {
+			t.Fatalf("expected no app channel nor control plane service. Got %v.", req.Cmd)
+		}
+	}
+	if req.Env != nil {
+		t.Fatalf("expected no environment. Got %v.", req.Env)
+	}
+}
@@ -0,0 +1,84 @@
+// Command payments is a stub of the payments app, which the app invokes
+// through Dapr to verify the charge of the orders changing to paid and to
+// reverse the charge of the orders refunded.
+//
+// POST /verify approves the order of the request unless its ID is listed in
+// DECLINED, POST /refund unless it is listed in REFUSED_REFUNDS. GET /requests
+// returns the IDs of the orders of the requests received so far, by method.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type paymentRequest struct {
+	OrderID string `json:"orderId"`
+	Tenant  string `json:"tenant,omitempty"`
+}
+
+type paymentAnswer struct {
+	Approved bool   `json:"approved"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+func list(key string) []string {
+	if v := os.Getenv(key); v != "" {
+		return strings.Split(v, ",")
+	}
+	return nil
+}
+
+func main() {
+	var (
+		mu       sync.Mutex
+		requests = map[string][]string{"verify": {}, "refund": {}}
+	)
+
+	// handle answers the requests of method, declining the orders of
+	// declined with reason.
+	handle := func(method string, declined []string, reason string) {
+		http.HandleFunc("/"+method, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			var req paymentRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.OrderID == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			mu.Lock()
+			requests[method] = append(requests[method], req.OrderID)
+			mu.Unlock()
+
+			answer := paymentAnswer{Approved: true}
+			if slices.Contains(declined, req.OrderID) {
+				answer = paymentAnswer{Reason: reason}
+			}
+			log.Printf("%s %s: %+v", method, req.OrderID, answer)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(answer)
+		})
+	}
+	handle("verify", list("DECLINED"), "insufficient funds")
+	handle("refund", list("REFUSED_REFUNDS"), "charge settled")
+
+	http.HandleFunc("/requests", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(requests)
+	})
+
+	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+
+	log.Println("listening on :8080")
+	log.Fatal(http.ListenAndServe(":8080", nil))
+}
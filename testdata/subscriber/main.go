@@ -0,0 +1,430 @@
+// Command subscriber records the events its Dapr sidecar delivers so that
+// integration tests can inspect them.
+//
+// It subscribes to the topics TOPIC, a comma-separated list, of the pubsub
+// component PUBSUB_NAME, unless DECLARATIVE is true and a Subscription
+// resource of its sidecar does, records the events delivered on /events, and
+// GET /received returns the recorded events as a JSON array, in the order they
+// were received. The data of an event is base64 encoded, whatever its content
+// type, and its envelope is the CloudEvent as delivered.
+//
+// The jobs the scheduler triggers on /job/{name} are recorded as well, and
+// GET /jobs returns them as a JSON array.
+//
+// The programmatic subscriptions are bulk subscriptions, the sidecar
+// delivering up to BULK_MAX_MESSAGES events at once, 100 by default, after
+// waiting at most BULK_MAX_AWAIT_MS milliseconds for them, 1000 by default.
+// Every event of a bulk delivery is answered with a status of its own, and
+// GET /batches returns the number of events of every bulk delivery. Events
+// are delivered one at a time with BULK_MAX_MESSAGES set to 0, as they are
+// through the Subscription resource.
+//
+// With FAIL_FIRST set to n, the first n deliveries of every event fail, with
+// 500 Internal Server Error or the RETRY status of its entry when delivered
+// in bulk, so that tests can check the sidecar retries them. GET /attempts
+// returns the number of deliveries of every event ID.
+//
+// With PROCESSED_STORE set, the IDs of the recorded events are kept in that
+// state store of the sidecar, reached at DAPR_HTTP_ENDPOINT, for
+// PROCESSED_TTL_SECONDS, 3600 by default, so that an event redelivered once
+// recorded is answered SUCCESS without being recorded again. An event whose
+// retry extension is true is failed once recorded, to have it redelivered.
+//
+// Events whose expiration, set by the publishing sidecar from the TTL of the
+// event, has passed are dropped rather than recorded, the sidecar only
+// checking it when it receives them from the broker and not when it retries
+// their delivery. GET /expired returns the IDs of the events dropped so.
+//
+// DELETE /received, DELETE /jobs, DELETE /attempts, DELETE /batches and
+// DELETE /expired forget the recorded events, jobs, deliveries, bulk
+// deliveries and expired events, so that tests sharing the subscriber don't
+// see each other's.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cloudEvent holds the fields of the delivered CloudEvents tests look at.
+type cloudEvent struct {
+	ID              string          `json:"id"`
+	Type            string          `json:"type"`
+	Source          string          `json:"source"`
+	DataContentType string          `json:"datacontenttype"`
+	DataSchema      string          `json:"dataschema,omitempty"`
+	Topic           string          `json:"topic"`
+	PubsubName      string          `json:"pubsubname"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      string          `json:"data_base64,omitempty"`
+	// Expiration is set once the event had a TTL.
+	Expiration time.Time `json:"expiration"`
+	// Retry is the retry extension, which the tests set to "true" for the
+	// event to be failed once processed.
+	Retry string `json:"retry"`
+	// CorrelationID is the correlationid extension, set by the app to the
+	// correlation ID of the request it published the event for.
+	CorrelationID string `json:"correlationid"`
+}
+
+// bulkRequest is a bulk delivery of events, each entry holding an event.
+type bulkRequest struct {
+	Entries []struct {
+		EntryID string          `json:"entryId"`
+		Event   json.RawMessage `json:"event"`
+	} `json:"entries"`
+}
+
+// bulkStatus is the status of an entry of a bulk delivery.
+type bulkStatus struct {
+	EntryID string `json:"entryId"`
+	Status  string `json:"status"`
+}
+
+// subscription is a programmatic subscription, bulk unless BulkSubscribe is
+// nil.
+type subscription struct {
+	PubsubName    string         `json:"pubsubname"`
+	Topic         string         `json:"topic"`
+	Route         string         `json:"route"`
+	BulkSubscribe *bulkSubscribe `json:"bulkSubscribe,omitempty"`
+}
+
+type bulkSubscribe struct {
+	Enabled            bool `json:"enabled"`
+	MaxMessagesCount   int  `json:"maxMessagesCount"`
+	MaxAwaitDurationMs int  `json:"maxAwaitDurationMs"`
+}
+
+// job is a recorded job trigger.
+type job struct {
+	Name string          `json:"name"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// event is a recorded event.
+type event struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	Source          string `json:"source"`
+	DataContentType string `json:"datacontenttype"`
+	DataSchema      string `json:"dataschema,omitempty"`
+	Topic           string `json:"topic"`
+	PubsubName      string `json:"pubsubname"`
+	Data            []byte `json:"data"`
+	// Envelope is the delivered CloudEvent, untouched.
+	Envelope json.RawMessage `json:"envelope"`
+}
+
+func getenv(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
+
+// data returns the payload of e, decoding it when it was sent in binary.
+func data(e cloudEvent) ([]byte, error) {
+	if e.DataBase64 != "" {
+		return base64.StdEncoding.DecodeString(e.DataBase64)
+	}
+	// text payloads are JSON strings, others the JSON document itself
+	var s string
+	if err := json.Unmarshal(e.Data, &s); err == nil {
+		return []byte(s), nil
+	}
+	return e.Data, nil
+}
+
+// processedStore keeps the IDs of the processed events in a state store of
+// the sidecar, each for ttl seconds.
+type processedStore struct {
+	endpoint string
+	name     string
+	ttl      int
+}
+
+// key returns the key of the event id, encoded as event IDs may contain
+// slashes, which the state API doesn't take in keys.
+func (s *processedStore) key(id string) string {
+	return "processed-" + base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+// contains reports whether the event id was processed.
+func (s *processedStore) contains(id string) (bool, error) {
+	resp, err := http.Get(s.endpoint + "/v1.0/state/" + s.name + "/" + s.key(id))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	// the sidecar answers 204 No Content for missing keys
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNoContent:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+// add marks the event id as processed.
+func (s *processedStore) add(id string) error {
+	body, err := json.Marshal([]map[string]any{{
+		"key":      s.key(id),
+		"value":    true,
+		"metadata": map[string]string{"ttlInSeconds": strconv.Itoa(s.ttl)},
+	}})
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(s.endpoint+"/v1.0/state/"+s.name, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func main() {
+	pubsubName := getenv("PUBSUB_NAME", "order-pub-sub")
+	topics := strings.Split(getenv("TOPIC", "orders"), ",")
+	declarative := getenv("DECLARATIVE", "false") == "true"
+	failFirst, err := strconv.Atoi(getenv("FAIL_FIRST", "0"))
+	if err != nil {
+		log.Fatalf("invalid FAIL_FIRST: %s", err)
+	}
+	bulkMaxMessages, err := strconv.Atoi(getenv("BULK_MAX_MESSAGES", "100"))
+	if err != nil {
+		log.Fatalf("invalid BULK_MAX_MESSAGES: %s", err)
+	}
+	bulkMaxAwait, err := strconv.Atoi(getenv("BULK_MAX_AWAIT_MS", "1000"))
+	if err != nil {
+		log.Fatalf("invalid BULK_MAX_AWAIT_MS: %s", err)
+	}
+
+	var processed *processedStore
+	if name := getenv("PROCESSED_STORE", ""); name != "" {
+		ttl, err := strconv.Atoi(getenv("PROCESSED_TTL_SECONDS", "3600"))
+		if err != nil {
+			log.Fatalf("invalid PROCESSED_TTL_SECONDS: %s", err)
+		}
+		processed = &processedStore{endpoint: getenv("DAPR_HTTP_ENDPOINT", "http://localhost:3500"), name: name, ttl: ttl}
+	}
+
+	var (
+		mu       sync.Mutex
+		received = []event{}
+		jobs     = []job{}
+		attempts = map[string]int{}
+		batches  = []int{}
+		expired  = []string{}
+	)
+
+	// record records the CloudEvent envelope, and returns the status it is
+	// answered with
+	record := func(envelope []byte) string {
+		var in cloudEvent
+		err := json.Unmarshal(envelope, &in)
+		var payload []byte
+		if err == nil {
+			payload, err = data(in)
+		}
+		if err != nil {
+			// the event can't be read, retrying won't help
+			log.Printf("dropping event: %s", err)
+			return "DROP"
+		}
+
+		mu.Lock()
+		attempts[in.ID]++
+		attempt := attempts[in.ID]
+		if !in.Expiration.IsZero() && time.Now().After(in.Expiration) {
+			log.Printf("dropping event %s expired at %s", in.ID, in.Expiration)
+			expired = append(expired, in.ID)
+			mu.Unlock()
+			return "DROP"
+		}
+		mu.Unlock()
+		if attempt <= failFirst {
+			log.Printf("failing delivery %d of event %s", attempt, in.ID)
+			return "RETRY"
+		}
+
+		if processed != nil {
+			done, err := processed.contains(in.ID)
+			if err != nil {
+				log.Printf("couldn't look event %s up: %s", in.ID, err)
+				return "RETRY"
+			}
+			if done {
+				log.Printf("skipping event %s, processed already", in.ID)
+				return "SUCCESS"
+			}
+		}
+
+		log.Printf("received event %s of type %s, correlation ID %q", in.ID, in.Type, in.CorrelationID)
+		mu.Lock()
+		received = append(received, event{
+			ID:              in.ID,
+			Type:            in.Type,
+			Source:          in.Source,
+			DataContentType: in.DataContentType,
+			DataSchema:      in.DataSchema,
+			Topic:           in.Topic,
+			PubsubName:      in.PubsubName,
+			Data:            payload,
+			Envelope:        envelope,
+		})
+		mu.Unlock()
+
+		if processed != nil {
+			if err := processed.add(in.ID); err != nil {
+				// the event is recorded again when redelivered
+				log.Printf("couldn't mark event %s as processed: %s", in.ID, err)
+				return "RETRY"
+			}
+		}
+		if in.Retry == "true" && attempt == failFirst+1 {
+			log.Printf("failing processed event %s to have it redelivered", in.ID)
+			return "RETRY"
+		}
+		return "SUCCESS"
+	}
+
+	http.HandleFunc("/dapr/subscribe", func(w http.ResponseWriter, r *http.Request) {
+		subscriptions := []subscription{}
+		if !declarative {
+			for _, topic := range topics {
+				sub := subscription{PubsubName: pubsubName, Topic: topic, Route: "/events"}
+				if bulkMaxMessages > 0 {
+					sub.BulkSubscribe = &bulkSubscribe{Enabled: true, MaxMessagesCount: bulkMaxMessages, MaxAwaitDurationMs: bulkMaxAwait}
+				}
+				subscriptions = append(subscriptions, sub)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(subscriptions)
+	})
+
+	http.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			log.Printf("couldn't read delivery: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// bulk deliveries hold entries, while single events are CloudEvents
+		var bulk bulkRequest
+		if err := json.Unmarshal(body, &bulk); err == nil && bulk.Entries != nil {
+			statuses := make([]bulkStatus, 0, len(bulk.Entries))
+			for _, entry := range bulk.Entries {
+				statuses = append(statuses, bulkStatus{EntryID: entry.EntryID, Status: record(entry.Event)})
+			}
+			mu.Lock()
+			batches = append(batches, len(bulk.Entries))
+			mu.Unlock()
+			json.NewEncoder(w).Encode(map[string][]bulkStatus{"statuses": statuses})
+			return
+		}
+
+		status := record(body)
+		if status == "RETRY" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `{"status":%q}`, status)
+	})
+
+	http.HandleFunc("/batches", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodDelete {
+			batches = []int{}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(batches)
+	})
+
+	http.HandleFunc("/expired", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodDelete {
+			expired = []string{}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(expired)
+	})
+
+	http.HandleFunc("/received", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodDelete {
+			received = []event{}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(received)
+	})
+
+	http.HandleFunc("/attempts", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodDelete {
+			attempts = map[string]int{}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(attempts)
+	})
+
+	http.HandleFunc("/job/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/job/")
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !json.Valid(body) {
+			// record non JSON payloads as a JSON string
+			body, _ = json.Marshal(string(body))
+		}
+
+		log.Printf("job %s triggered", name)
+		mu.Lock()
+		jobs = append(jobs, job{Name: name, Data: body})
+		mu.Unlock()
+	})
+
+	http.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodDelete {
+			jobs = []job{}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jobs)
+	})
+
+	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+
+	log.Println("listening on :8080")
+	log.Fatal(http.ListenAndServe(":8080", nil))
+}
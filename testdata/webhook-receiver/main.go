@@ -0,0 +1,85 @@
+// Command webhook-receiver records the webhook notifications it receives so
+// that integration tests can inspect them.
+//
+// POST /hooks records the request body, GET /received returns the recorded
+// bodies as a JSON array. When FAIL_FIRST is set, the first FAIL_FIRST
+// notifications are answered with a 503 to exercise retries. When
+// WEBHOOK_SECRET is set, the notifications whose X-Signature header isn't
+// sha256= followed by the hex-encoded HMAC-SHA256 of their body with the
+// secret are answered with a 401, and not recorded.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+func main() {
+	var (
+		mu        sync.Mutex
+		received  = []json.RawMessage{}
+		failFirst int
+		secret    = os.Getenv("WEBHOOK_SECRET")
+	)
+	if v, ok := os.LookupEnv("FAIL_FIRST"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid FAIL_FIRST %q: %s", v, err)
+		}
+		failFirst = n
+	}
+
+	http.HandleFunc("/hooks", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil || !json.Valid(body) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if secret != "" {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write(body)
+			expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+			if !hmac.Equal([]byte(r.Header.Get("X-Signature")), []byte(expected)) {
+				log.Printf("rejecting notification with signature %q", r.Header.Get("X-Signature"))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if failFirst > 0 {
+			failFirst--
+			log.Printf("failing notification, %d left to fail", failFirst)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		log.Printf("received notification: %s", body)
+		received = append(received, body)
+	})
+
+	http.HandleFunc("/received", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(received)
+	})
+
+	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+
+	log.Println("listening on :8080")
+	log.Fatal(http.ListenAndServe(":8080", nil))
+}
@@ -0,0 +1,28 @@
+// Package testhelpers holds the assertions shared by the tests.
+package testhelpers
+
+import (
+	"testing"
+	"time"
+)
+
+// Eventually calls condition every interval until it returns nil, and fails t
+// with the last error of condition if it doesn't within timeout. It suits the
+// asynchronous assertions of integration tests, such as the delivery of an
+// event or the convergence of state or metrics.
+func Eventually(t testing.TB, timeout, interval time.Duration, condition func() error) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := condition()
+		if err == nil {
+			return
+		}
+		if time.Now().Add(interval).After(deadline) {
+			t.Fatalf("condition not met within %s: %s", timeout, err)
+			return
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,57 @@
+package testhelpers
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// recorder records the failure of a test instead of stopping it.
+type recorder struct {
+	testing.TB
+	failure string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Fatalf(format string, args ...any) {
+	r.failure = fmt.Sprintf(format, args...)
+}
+
+func TestEventually(t *testing.T) {
+	t.Run("met", func(t *testing.T) {
+		calls := 0
+		r := &recorder{TB: t}
+		Eventually(r, time.Second, time.Millisecond, func() error {
+			calls++
+			if calls < 3 {
+				return errors.New("not yet")
+			}
+			return nil
+		})
+		if r.failure != "" {
+			t.Fatalf("expected the condition to be met. Got %q.", r.failure)
+		}
+		if calls != 3 {
+			t.Fatalf("expected 3 calls. Got %d.", calls)
+		}
+	})
+
+	t.Run("not met", func(t *testing.T) {
+		calls := 0
+		r := &recorder{TB: t}
+		start := time.Now()
+		Eventually(r, 50*time.Millisecond, 10*time.Millisecond, func() error {
+			calls++
+			return fmt.Errorf("attempt %d", calls)
+		})
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("expected to give up after the timeout. Took %s.", elapsed)
+		}
+		expected := fmt.Sprintf("condition not met within 50ms: attempt %d", calls)
+		if r.failure != expected {
+			t.Fatalf("expected failure %q. Got %q.", expected, r.failure)
+		}
+	})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/testcontainers/testcontainers-go"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultArtifactsDir = "test-artifacts"
+
+// Topology is a machine-readable description of what a Stack started.
+type Topology struct {
+	Containers    []TopologyContainer    `json:"containers"`
+	Networks      []string               `json:"networks"`
+	Components    []TopologyComponent    `json:"components"`
+	Subscriptions []TopologySubscription `json:"subscriptions"`
+	Links         []TopologyLink         `json:"links"`
+}
+
+type TopologyContainer struct {
+	Name     string            `json:"name"`
+	Hostname string            `json:"hostname"`
+	Image    string            `json:"image"`
+	Networks []string          `json:"networks"`
+	Ports    map[string]string `json:"ports"` // container port -> host port
+}
+
+type TopologyComponent struct {
+	Container string `json:"container"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	File      string `json:"file"`
+}
+
+type TopologySubscription struct {
+	AppID      string `json:"appId"`
+	PubsubName string `json:"pubsubName"`
+	Topic      string `json:"topic"`
+	Route      string `json:"route"`
+}
+
+type TopologyLink struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Label string `json:"label"`
+}
+
+// addContainer records a started container along with the Dapr components
+// mounted into it.
+func (t *Topology) addContainer(ctx context.Context, c testcontainers.Container, req testcontainers.ContainerRequest) error {
+	networks, err := c.Networks(ctx)
+	if err != nil {
+		return err
+	}
+
+	ports := map[string]string{}
+	for _, p := range req.ExposedPorts {
+		mapped, err := c.MappedPort(ctx, nat.Port(p))
+		if err != nil {
+			return err
+		}
+		ports[p] = mapped.Port()
+	}
+
+	image := req.Image
+	if image == "" {
+		image = "built from " + req.FromDockerfile.Dockerfile
+	}
+
+	t.Containers = append(t.Containers, TopologyContainer{
+		Name:     req.Name,
+		Hostname: req.Hostname,
+		Image:    image,
+		Networks: networks,
+		Ports:    ports,
+	})
+
+	for _, network := range networks {
+		if !slices.Contains(t.Networks, network) {
+			t.Networks = append(t.Networks, network)
+		}
+	}
+
+	for _, f := range req.Files {
+		if !strings.Contains(f.ContainerFilePath, "components/") {
+			continue
+		}
+		component, err := readComponent(f.HostFilePath)
+		if err != nil {
+			return err
+		}
+		component.Container = req.Name
+		t.Components = append(t.Components, component)
+	}
+
+	return nil
+}
+
+func readComponent(path string) (TopologyComponent, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return TopologyComponent{}, err
+	}
+
+	var manifest struct {
+		Kind     string `yaml:"kind"`
+		Metadata struct {
+			Name string `yaml:"name"`
+		} `yaml:"metadata"`
+		Spec struct {
+			Type string `yaml:"type"`
+		} `yaml:"spec"`
+	}
+	if err := yaml.Unmarshal(content, &manifest); err != nil {
+		return TopologyComponent{}, fmt.Errorf("couldn't parse component %s: %w", path, err)
+	}
+
+	// resources other than components, such as resiliency policies, have
+	// no type but their kind
+	typ := manifest.Spec.Type
+	if typ == "" {
+		typ = manifest.Kind
+	}
+	return TopologyComponent{
+		Name: manifest.Metadata.Name,
+		Type: typ,
+		File: path,
+	}, nil
+}
+
+// Mermaid renders the topology as a mermaid flowchart.
+func (t *Topology) Mermaid() string {
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+
+	for _, c := range t.Containers {
+		ports := make([]string, 0, len(c.Ports))
+		for p, mapped := range c.Ports {
+			ports = append(ports, fmt.Sprintf("%s→%s", p, mapped))
+		}
+		sort.Strings(ports)
+		fmt.Fprintf(&b, "    %s[\"%s<br/>%s<br/>%s\"]\n", mermaidID(c.Name), c.Name, c.Image, strings.Join(ports, " "))
+	}
+
+	for _, c := range t.Components {
+		id := mermaidID(c.Container + "-" + c.Name)
+		fmt.Fprintf(&b, "    %s[(\"%s<br/>%s\")]\n", id, c.Name, c.Type)
+		fmt.Fprintf(&b, "    %s -.-> %s\n", mermaidID(c.Container), id)
+	}
+
+	for _, s := range t.Subscriptions {
+		fmt.Fprintf(&b, "    %s -. \"subscribes %s/%s → %s\" .-> %s\n",
+			mermaidID(s.PubsubName), s.PubsubName, s.Topic, s.Route, mermaidID(s.AppID))
+	}
+
+	for _, l := range t.Links {
+		fmt.Fprintf(&b, "    %s -- \"%s\" --> %s\n", mermaidID(l.From), l.Label, mermaidID(l.To))
+	}
+
+	return b.String()
+}
+
+var mermaidIDReplacer = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func mermaidID(name string) string {
+	return mermaidIDReplacer.ReplaceAllString(name, "_")
+}
+
+// Write stores the topology as JSON and as a mermaid diagram in dir, using
+// name and the current time to keep files from different runs apart.
+func (t *Topology) Write(dir, name string) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	base := filepath.Join(dir, fmt.Sprintf("%s-%s", mermaidID(name), time.Now().Format("20060102T150405")))
+
+	content, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(base+".topology.json", content, 0o644); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(base+".topology.mmd", []byte(t.Mermaid()), 0o644); err != nil {
+		return "", err
+	}
+
+	return base, nil
+}
+
+func TestTopologyMermaid(t *testing.T) {
+	topology := Topology{
+		Containers: []TopologyContainer{
+			{Name: "dapr-app", Image: "daprio/daprd", Ports: map[string]string{"50001/tcp": "32768"}},
+		},
+		Components: []TopologyComponent{
+			{Container: "dapr-app", Name: "order-pub-sub", Type: "pubsub.redis"},
+		},
+		Links: []TopologyLink{
+			{From: "app", To: "dapr-app", Label: "gRPC :50001"},
+		},
+	}
+
+	expected := `flowchart LR
+    dapr_app["dapr-app<br/>daprio/daprd<br/>50001/tcp→32768"]
+    dapr_app_order_pub_sub[("order-pub-sub<br/>pubsub.redis")]
+    dapr_app -.-> dapr_app_order_pub_sub
+    app -- "gRPC :50001" --> dapr_app
+`
+	if got := topology.Mermaid(); got != expected {
+		t.Fatalf("expected mermaid diagram:\n%s\nGot:\n%s", expected, got)
+	}
+}
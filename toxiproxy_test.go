@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Proxies of a stack started with WithToxiproxy.
+const (
+	// proxySidecar carries the gRPC calls of the app to its sidecar.
+	proxySidecar = "dapr-app"
+	// proxyRedis carries the pubsub traffic of the sidecar of the app to
+	// Redis.
+	proxyRedis = "redis"
+)
+
+// toxiproxyProxy is a proxy of Toxiproxy, forwarding the connections it
+// accepts on Listen to Upstream.
+type toxiproxyProxy struct {
+	Name     string `json:"name"`
+	Listen   string `json:"listen"`
+	Upstream string `json:"upstream"`
+	Enabled  bool   `json:"enabled"`
+}
+
+// toxic alters the traffic of a proxy. See
+// https://github.com/Shopify/toxiproxy#toxics for the types and their
+// attributes.
+type toxic struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Stream is upstream or downstream, the latter by default.
+	Stream string `json:"stream,omitempty"`
+	// Toxicity is the probability of the toxic applying to a connection,
+	// every connection when zero.
+	Toxicity   float64        `json:"toxicity,omitempty"`
+	Attributes map[string]int `json:"attributes,omitempty"`
+}
+
+// toxiproxyClient drives the HTTP API of Toxiproxy at uri.
+type toxiproxyClient struct {
+	uri string
+}
+
+func (c toxiproxyClient) do(ctx context.Context, method, path string, body any, expected int) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.uri+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expected {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s answered %s: %s", method, path, resp.Status, msg)
+	}
+	return nil
+}
+
+// createProxy creates and enables proxy.
+func (c toxiproxyClient) createProxy(ctx context.Context, proxy toxiproxyProxy) error {
+	proxy.Enabled = true
+	return c.do(ctx, http.MethodPost, "/proxies", proxy, http.StatusCreated)
+}
+
+// addToxic adds t to the connections of proxy, including the open ones.
+func (c toxiproxyClient) addToxic(ctx context.Context, proxy string, t toxic) error {
+	return c.do(ctx, http.MethodPost, "/proxies/"+proxy+"/toxics", t, http.StatusOK)
+}
+
+// removeToxic removes the toxic name of proxy.
+func (c toxiproxyClient) removeToxic(ctx context.Context, proxy, name string) error {
+	return c.do(ctx, http.MethodDelete, "/proxies/"+proxy+"/toxics/"+name, nil, http.StatusNoContent)
+}
+
+func TestToxiproxyClient(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/proxies/unknown/") {
+			http.Error(w, "proxy not found", http.StatusNotFound)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, strings.TrimSpace(fmt.Sprintf("%s %s %s", r.Method, r.URL.Path, body)))
+		switch r.Method {
+		case http.MethodPost:
+			if r.URL.Path == "/proxies" {
+				w.WriteHeader(http.StatusCreated)
+			}
+		case http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	c := toxiproxyClient{uri: server.URL}
+	if err := c.createProxy(ctx, toxiproxyProxy{Name: proxyRedis, Listen: "0.0.0.0:6379", Upstream: "redis:6379"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.addToxic(ctx, proxyRedis, toxic{Name: "latency", Type: "latency", Attributes: map[string]int{"latency": 1000}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.removeToxic(ctx, proxyRedis, "latency"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`POST /proxies {"name":"redis","listen":"0.0.0.0:6379","upstream":"redis:6379","enabled":true}`,
+		`POST /proxies/redis/toxics {"name":"latency","type":"latency","attributes":{"latency":1000}}`,
+		`DELETE /proxies/redis/toxics/latency`,
+	}
+	if strings.Join(requests, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected requests %q. Got %q.", expected, requests)
+	}
+
+	// unexpected answers are errors
+	if err := c.removeToxic(ctx, "unknown", "latency"); err == nil || !strings.Contains(err.Error(), "proxy not found") {
+		t.Fatalf("expected the answer of Toxiproxy as error. Got %v.", err)
+	}
+}
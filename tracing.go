@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Headers of the W3C Trace Context, which the sidecar uses to propagate
+// traces.
+const (
+	headerTraceparent = "traceparent"
+	headerTracestate  = "tracestate"
+)
+
+var traceparentPattern = regexp.MustCompile(`^[0-9a-f]{2}-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2}$`)
+
+// TraceContext is the W3C trace context of a request.
+type TraceContext struct {
+	Traceparent string
+	Tracestate  string
+}
+
+type traceContextKey struct{}
+
+// WithTraceContext returns a copy of ctx carrying tc.
+func WithTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// TraceContextFromContext returns the trace context ctx carries, if any.
+func TraceContextFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return tc, ok
+}
+
+// PropagateTraceContext stores the trace context of requests in their context,
+// so that the calls to the sidecar they lead to join their trace. Malformed
+// traceparent headers are ignored, which starts a new trace.
+func PropagateTraceContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent := r.Header.Get(headerTraceparent)
+		if !traceparentPattern.MatchString(traceparent) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tc := TraceContext{Traceparent: traceparent, Tracestate: r.Header.Get(headerTracestate)}
+		next.ServeHTTP(w, r.WithContext(WithTraceContext(r.Context(), tc)))
+	})
+}
+
+// traceContextInterceptor adds the trace context of ctx to the metadata of
+// gRPC calls to the sidecar. Unlike the trace helpers of the Dapr client, it
+// runs after the client set its own metadata, the API token, so it doesn't
+// replace it.
+func traceContextInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if tc, ok := TraceContextFromContext(ctx); ok {
+		ctx = metadata.AppendToOutgoingContext(ctx, headerTraceparent, tc.Traceparent)
+		if tc.Tracestate != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, headerTracestate, tc.Tracestate)
+		}
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
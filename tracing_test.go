@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestPropagateTraceContext(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceparent string
+		ok          bool
+	}{
+		{"valid", testTraceparent, true},
+		{"missing", "", false},
+		{"malformed", "00-not-a-trace-01", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got TraceContext
+			var ok bool
+			handler := PropagateTraceContext(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, ok = TraceContextFromContext(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodPut, "/orders/order-1234", nil)
+			if tt.traceparent != "" {
+				req.Header.Set(headerTraceparent, tt.traceparent)
+				req.Header.Set(headerTracestate, "vendor=value")
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if ok != tt.ok {
+				t.Fatalf("expected a trace context: %t. Got %t.", tt.ok, ok)
+			}
+			if ok && (got.Traceparent != tt.traceparent || got.Tracestate != "vendor=value") {
+				t.Fatalf("expected the trace context of the request. Got %+v.", got)
+			}
+		})
+	}
+}
+
+func TestTraceContextInterceptor(t *testing.T) {
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("dapr-api-token", "secret"))
+	ctx = WithTraceContext(ctx, TraceContext{Traceparent: testTraceparent})
+
+	var md metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	}
+	if err := traceContextInterceptor(ctx, "/dapr.proto.runtime.v1.Dapr/PublishEvent", nil, nil, nil, invoker); err != nil {
+		t.Fatalf("expected no error. Got %s.", err)
+	}
+
+	if got := md.Get(headerTraceparent); len(got) != 1 || got[0] != testTraceparent {
+		t.Fatalf("expected traceparent %s. Got %v.", testTraceparent, got)
+	}
+	if got := md.Get("dapr-api-token"); len(got) != 1 {
+		t.Fatalf("expected the API token to be kept. Got %v.", md)
+	}
+	if got := md.Get(headerTracestate); len(got) != 0 {
+		t.Fatalf("expected no tracestate. Got %v.", got)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/etiennetremel/testcontainers-dapr-example/orderspb"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxLineItems bounds the number of line items of an order.
+const maxLineItems = 100
+
+// ErrInvalidOrder is returned when a request body is well formed but holds
+// an order the API doesn't accept.
+var ErrInvalidOrder = errors.New("invalid order")
+
+// OrderUpdate is the change to an order requested by a PUT.
+type OrderUpdate struct {
+	Status OrderStatus
+	// LineItems replaces the line items of the order unless it is nil.
+	LineItems []LineItem
+	// Amount and Currency replace those of the order unless Amount is nil.
+	Amount   *int64
+	Currency string
+	// CustomerID sets the customer of an order which has none yet, unless it
+	// is empty.
+	CustomerID string
+	// Expedited publishes the status change to the priority topic. It isn't
+	// stored with the order.
+	Expedited bool
+}
+
+// OrderMapper converts orders from and to the payloads of a version of the
+// API, the JSON one and the protobuf one.
+type OrderMapper interface {
+	// DecodeUpdate reads the body of a PUT request.
+	DecodeUpdate(r *http.Request) (OrderUpdate, error)
+	// DecodeBatch reads the body of a batch PUT request, which is always
+	// JSON.
+	DecodeBatch(r *http.Request) ([]BatchUpdate, error)
+	// DecodeOrder reads an order from its JSON representation, as patched by
+	// a PATCH request. The fields the version doesn't expose are those of
+	// current.
+	DecodeOrder(data []byte, current Order) (Order, error)
+	Order(order Order) (any, proto.Message)
+	List(list *OrderList) (any, proto.Message)
+}
+
+// orderMapperV1 maps the original payloads, which only carry the status of
+// orders. Updates leave line items, amounts and customers untouched and
+// responses hide them.
+type orderMapperV1 struct{}
+
+// orderV1 is an order as exposed by the v1 API.
+type orderV1 struct {
+	ID     string      `json:"id"`
+	Status OrderStatus `json:"status"`
+	Tenant string      `json:"tenant,omitempty"`
+}
+
+type orderListV1 struct {
+	Items      []orderV1 `json:"items"`
+	Limit      int       `json:"limit"`
+	Offset     int       `json:"offset"`
+	NextOffset *int      `json:"nextOffset,omitempty"`
+}
+
+func (orderMapperV1) DecodeUpdate(r *http.Request) (OrderUpdate, error) {
+	var order SchemaPatchOrder
+	var msg orderspb.UpdateOrder
+	mediaType, err := decodeBody(r, &order, &msg)
+	if err != nil {
+		return OrderUpdate{}, err
+	}
+	if mediaType == contentTypeProtobuf {
+		order.Status = statusFromProto(msg.Status)
+	}
+	return OrderUpdate{Status: order.Status}, nil
+}
+
+func (orderMapperV1) DecodeBatch(r *http.Request) ([]BatchUpdate, error) {
+	var items []struct {
+		ID     string      `json:"id"`
+		Status OrderStatus `json:"status"`
+	}
+	if err := decodeBatch(r, &items); err != nil {
+		return nil, err
+	}
+	updates := make([]BatchUpdate, 0, len(items))
+	for _, item := range items {
+		updates = append(updates, BatchUpdate{ID: item.ID, OrderUpdate: OrderUpdate{Status: item.Status}})
+	}
+	return updates, nil
+}
+
+func (orderMapperV1) DecodeOrder(data []byte, current Order) (Order, error) {
+	var order orderV1
+	if err := json.Unmarshal(data, &order); err != nil {
+		return Order{}, fmt.Errorf("%w: %s", ErrInvalidOrder, err)
+	}
+	current.ID, current.Status, current.Tenant = order.ID, order.Status, order.Tenant
+	return current, nil
+}
+
+func (orderMapperV1) Order(order Order) (any, proto.Message) {
+	return toOrderV1(order), orderV1ToProto(order)
+}
+
+func (orderMapperV1) List(list *OrderList) (any, proto.Message) {
+	v1 := orderListV1{
+		Items:      make([]orderV1, 0, len(list.Items)),
+		Limit:      list.Limit,
+		Offset:     list.Offset,
+		NextOffset: list.NextOffset,
+	}
+	for _, order := range list.Items {
+		v1.Items = append(v1.Items, toOrderV1(order))
+	}
+	return v1, orderListToProto(list, orderV1ToProto)
+}
+
+func toOrderV1(order Order) orderV1 {
+	return orderV1{ID: order.ID, Status: order.Status, Tenant: order.Tenant}
+}
+
+func orderV1ToProto(order Order) *orderspb.Order {
+	msg := orderToProto(order)
+	msg.LineItems, msg.Amount, msg.Currency, msg.CustomerId = nil, 0, "", ""
+	return msg
+}
+
+// orderMapperV2 maps the payloads of the v2 API, which adds the line items,
+// amount and customer of orders. Updates without line items or amount keep the
+// current ones.
+type orderMapperV2 struct{}
+
+// orderUpdateV2 is the body of PUT /v2/orders/{id}.
+type orderUpdateV2 struct {
+	Status     OrderStatus `json:"status"`
+	LineItems  []LineItem  `json:"lineItems"`
+	Amount     *int64      `json:"amount"`
+	Currency   string      `json:"currency"`
+	CustomerID string      `json:"customerId"`
+	Expedited  bool        `json:"expedited"`
+}
+
+func (u orderUpdateV2) update() OrderUpdate {
+	return OrderUpdate{Status: u.Status, LineItems: u.LineItems, Amount: u.Amount, Currency: u.Currency, CustomerID: u.CustomerID, Expedited: u.Expedited}
+}
+
+func (orderMapperV2) DecodeUpdate(r *http.Request) (OrderUpdate, error) {
+	var order orderUpdateV2
+	var msg orderspb.UpdateOrder
+	mediaType, err := decodeBody(r, &order, &msg)
+	if err != nil {
+		return OrderUpdate{}, err
+	}
+	if mediaType == contentTypeProtobuf {
+		// an empty repeated field can't be told apart from a missing one, so
+		// protobuf clients can't clear the line items
+		order.Status = statusFromProto(msg.Status)
+		if len(msg.LineItems) > 0 {
+			order.LineItems = lineItemsFromProto(msg.LineItems)
+		}
+		order.Amount, order.Currency = msg.Amount, msg.Currency
+		order.CustomerID = msg.CustomerId
+	}
+
+	update := order.update()
+	if err := validateUpdate(update); err != nil {
+		return OrderUpdate{}, err
+	}
+	return update, nil
+}
+
+func (orderMapperV2) DecodeBatch(r *http.Request) ([]BatchUpdate, error) {
+	var items []struct {
+		ID string `json:"id"`
+		orderUpdateV2
+	}
+	if err := decodeBatch(r, &items); err != nil {
+		return nil, err
+	}
+	updates := make([]BatchUpdate, 0, len(items))
+	for _, item := range items {
+		updates = append(updates, BatchUpdate{ID: item.ID, OrderUpdate: item.update()})
+	}
+	return updates, nil
+}
+
+func (orderMapperV2) DecodeOrder(data []byte, _ Order) (Order, error) {
+	var order Order
+	if err := json.Unmarshal(data, &order); err != nil {
+		return Order{}, fmt.Errorf("%w: %s", ErrInvalidOrder, err)
+	}
+	// line items are left out of the representation when there are none, so
+	// their absence clears them
+	if order.LineItems == nil {
+		order.LineItems = []LineItem{}
+	}
+	if err := validateLineItems(order.LineItems); err != nil {
+		return Order{}, err
+	}
+	// the amount of the representation is stale once priced line items are
+	// patched
+	if total, priced := lineItemsTotal(order.LineItems); priced {
+		order.Amount = total
+	}
+	if err := validateCustomerID(order.CustomerID); err != nil {
+		return Order{}, err
+	}
+	return order, validateAmount(&order.Amount, order.Currency)
+}
+
+func (orderMapperV2) Order(order Order) (any, proto.Message) {
+	return order, orderToProto(order)
+}
+
+func (orderMapperV2) List(list *OrderList) (any, proto.Message) {
+	return list, orderListToProto(list, orderToProto)
+}
+
+// validateUpdate ensures the line items, amount and customer of update are
+// valid.
+func validateUpdate(update OrderUpdate) error {
+	if err := validateLineItems(update.LineItems); err != nil {
+		return err
+	}
+	if err := validateCustomerID(update.CustomerID); err != nil {
+		return err
+	}
+	// the amount of priced line items is their total, so they may come with
+	// a currency only
+	if _, priced := lineItemsTotal(update.LineItems); priced && update.Amount == nil {
+		return validateCurrency(update.Currency)
+	}
+	return validateAmount(update.Amount, update.Currency)
+}
+
+// validateLineItems ensures line items reference distinct products in
+// positive quantities, at prices which aren't negative and whose total fits
+// an amount.
+func validateLineItems(items []LineItem) error {
+	if len(items) > maxLineItems {
+		return fmt.Errorf("%w: more than %d line items", ErrInvalidOrder, maxLineItems)
+	}
+	seen := map[string]bool{}
+	var total int64
+	for i, item := range items {
+		if item.SKU == "" {
+			return fmt.Errorf("%w: line item %d has no SKU", ErrInvalidOrder, i)
+		}
+		if item.Quantity < 1 {
+			return fmt.Errorf("%w: line item %s must have a positive quantity", ErrInvalidOrder, item.SKU)
+		}
+		if item.UnitPrice < 0 {
+			return fmt.Errorf("%w: line item %s must not have a negative unit price", ErrInvalidOrder, item.SKU)
+		}
+		if item.UnitPrice > (math.MaxInt64-total)/int64(item.Quantity) {
+			return fmt.Errorf("%w: the total of the line items is too large", ErrInvalidOrder)
+		}
+		total += item.UnitPrice * int64(item.Quantity)
+		if seen[item.SKU] {
+			return fmt.Errorf("%w: duplicate line item %s", ErrInvalidOrder, item.SKU)
+		}
+		seen[item.SKU] = true
+	}
+	return nil
+}
+
+// validateCustomerID ensures id, if set, is one of a customer.
+func validateCustomerID(id string) error {
+	if id != "" && !customerIDPattern.MatchString(id) {
+		return fmt.Errorf("%w: invalid customer ID %q", ErrInvalidOrder, id)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/etiennetremel/testcontainers-dapr-example/orderspb"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOrdersVersions(t *testing.T) {
+	server := newOrdersServer(t)
+
+	body := []byte(`{"status":"PENDING","lineItems":[{"sku":"book","quantity":2}]}`)
+	resp, data := doRequest(t, http.MethodPut, server.URL+"/v2/orders/order-1234", contentTypeJSON, "", body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d: %s.", http.StatusOK, resp.StatusCode, data)
+	}
+
+	// v1 updates leave the line items untouched
+	resp, _ = doRequest(t, http.MethodPut, server.URL+"/v1/orders/order-1234", contentTypeJSON, "", []byte(`{"status":"PAID"}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/v2/orders/order-1234", `{"id":"order-1234","status":"PAID","lineItems":[{"sku":"book","quantity":2}]}`},
+		{"/v1/orders/order-1234", `{"id":"order-1234","status":"PAID"}`},
+		{"/orders/order-1234", `{"id":"order-1234","status":"PAID"}`},
+		{"/v2/orders?limit=1", `{"items":[{"id":"order-1234","status":"PAID","lineItems":[{"sku":"book","quantity":2}]}],"limit":1,"offset":0,"nextOffset":1}`},
+		{"/v1/orders?limit=1", `{"items":[{"id":"order-1234","status":"PAID"}],"limit":1,"offset":0,"nextOffset":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			_, data := doRequest(t, http.MethodGet, server.URL+tt.path, "", "", nil)
+			if string(data) != tt.want+"\n" {
+				t.Fatalf("expected body %s. Got %s.", tt.want, data)
+			}
+		})
+	}
+}
+
+func TestOrdersV2LineItemsOnlyUpdate(t *testing.T) {
+	server := newOrdersServer(t)
+
+	doRequest(t, http.MethodPut, server.URL+"/v2/orders/order-1234", contentTypeJSON, "", []byte(`{"status":"PENDING"}`))
+
+	msg, err := proto.Marshal(&orderspb.UpdateOrder{
+		Status:    orderspb.OrderStatus_ORDER_STATUS_PENDING,
+		LineItems: []*orderspb.LineItem{{Sku: "pen", Quantity: 3}},
+	})
+	if err != nil {
+		t.Fatalf("couldn't marshal update: %s", err)
+	}
+	resp, data := doRequest(t, http.MethodPut, server.URL+"/v2/orders/order-1234", contentTypeProtobuf, "", msg)
+	if resp.StatusCode != http.StatusOK || string(data) != "Order updated" {
+		t.Fatalf("expected the line items to be updated. Got %d: %s.", resp.StatusCode, data)
+	}
+
+	_, data = doRequest(t, http.MethodGet, server.URL+"/v2/orders/order-1234", "", contentTypeProtobuf, nil)
+	var order orderspb.Order
+	if err := proto.Unmarshal(data, &order); err != nil {
+		t.Fatalf("couldn't unmarshal order: %s", err)
+	}
+	if len(order.LineItems) != 1 || order.LineItems[0].Sku != "pen" || order.LineItems[0].Quantity != 3 {
+		t.Fatalf("expected 3 pens. Got %v.", &order)
+	}
+
+	resp, data = doRequest(t, http.MethodPut, server.URL+"/v2/orders/order-1234", contentTypeProtobuf, "", msg)
+	if resp.StatusCode != http.StatusOK || string(data) != "Order unchanged" {
+		t.Fatalf("expected the order to be unchanged. Got %d: %s.", resp.StatusCode, data)
+	}
+}
+
+func TestOrdersV2InvalidLineItems(t *testing.T) {
+	server := newOrdersServer(t)
+
+	for _, body := range []string{
+		`{"status":"PENDING","lineItems":[{"quantity":1}]}`,
+		`{"status":"PENDING","lineItems":[{"sku":"book","quantity":0}]}`,
+		`{"status":"PENDING","lineItems":[{"sku":"book","quantity":1},{"sku":"book","quantity":2}]}`,
+		`{"status":"PENDING","lineItems":[{"sku":"book","quantity":1,"unitPrice":-1}],"currency":"EUR"}`,
+		`{"status":"PENDING","lineItems":[{"sku":"book","quantity":2,"unitPrice":9223372036854775807}],"currency":"EUR"}`,
+	} {
+		resp, _ := doRequest(t, http.MethodPut, server.URL+"/v2/orders/order-1234", contentTypeJSON, "", []byte(body))
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d for %s. Got %d.", http.StatusBadRequest, body, resp.StatusCode)
+		}
+	}
+}
+
+func TestOrdersV2Amount(t *testing.T) {
+	server := newOrdersServer(t)
+
+	body := []byte(`{"status":"PENDING","amount":1999,"currency":"EUR"}`)
+	resp, data := doRequest(t, http.MethodPut, server.URL+"/v2/orders/order-1234", contentTypeJSON, "", body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d: %s.", http.StatusOK, resp.StatusCode, data)
+	}
+
+	// updates without amount keep the current one
+	resp, data = doRequest(t, http.MethodPut, server.URL+"/v2/orders/order-1234", contentTypeJSON, "", []byte(`{"status":"PAID"}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d: %s.", http.StatusOK, resp.StatusCode, data)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/v2/orders/order-1234", `{"id":"order-1234","status":"PAID","amount":1999,"currency":"EUR"}`},
+		{"/v1/orders/order-1234", `{"id":"order-1234","status":"PAID"}`},
+	}
+	for _, tt := range tests {
+		_, data := doRequest(t, http.MethodGet, server.URL+tt.path, "", "", nil)
+		if string(data) != tt.want+"\n" {
+			t.Fatalf("expected body %s. Got %s.", tt.want, data)
+		}
+	}
+}
+
+func TestOrdersV2InvalidAmount(t *testing.T) {
+	server := newOrdersServer(t)
+
+	for _, body := range []string{
+		`{"status":"PENDING","amount":-1,"currency":"EUR"}`,
+		`{"status":"PENDING","amount":1999,"currency":"XYZ"}`,
+		`{"status":"PENDING","amount":1999,"currency":"eur"}`,
+		`{"status":"PENDING","amount":1999}`,
+		`{"status":"PENDING","currency":"EUR"}`,
+	} {
+		resp, data := doRequest(t, http.MethodPut, server.URL+"/v2/orders/order-1234", contentTypeJSON, "", []byte(body))
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status code %d for %s. Got %d: %s.", http.StatusBadRequest, body, resp.StatusCode, data)
+		}
+	}
+}
+
+func TestOrdersV2PricedLineItems(t *testing.T) {
+	server := newOrdersServer(t)
+
+	body := []byte(`{"status":"PENDING","lineItems":[{"sku":"book","quantity":2,"unitPrice":999},{"sku":"pen","quantity":1,"unitPrice":150}],"currency":"EUR"}`)
+	resp, data := doRequest(t, http.MethodPut, server.URL+"/v2/orders/order-1234", contentTypeJSON, "", body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d: %s.", http.StatusOK, resp.StatusCode, data)
+	}
+	want := `{"id":"order-1234","status":"PENDING","lineItems":[{"sku":"book","quantity":2,"unitPrice":999},{"sku":"pen","quantity":1,"unitPrice":150}],"amount":2148,"currency":"EUR"}`
+	if _, data := doRequest(t, http.MethodGet, server.URL+"/v2/orders/order-1234", "", "", nil); string(data) != want+"\n" {
+		t.Fatalf("expected the amount to be the total of the line items. Got %s.", data)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{"matching amount", "/v2/orders/order-1234", `{"status":"PENDING","amount":2148,"currency":"EUR"}`, http.StatusOK},
+		{"amount other than the total", "/v2/orders/order-1234", `{"status":"PENDING","amount":100,"currency":"EUR"}`, http.StatusBadRequest},
+		{"line items other than the amount", "/v2/orders/order-1234", `{"status":"PENDING","lineItems":[{"sku":"pen","quantity":1,"unitPrice":150}],"amount":2148,"currency":"EUR"}`, http.StatusBadRequest},
+		{"new line items in the current currency", "/v2/orders/order-1234", `{"status":"PENDING","lineItems":[{"sku":"pen","quantity":2,"unitPrice":150}]}`, http.StatusOK},
+		{"no currency", "/v2/orders/order-5678", `{"status":"PENDING","lineItems":[{"sku":"pen","quantity":1,"unitPrice":150}]}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, data := doRequest(t, http.MethodPut, server.URL+tt.path, contentTypeJSON, "", []byte(tt.body))
+			if resp.StatusCode != tt.want {
+				t.Fatalf("expected status code %d. Got %d: %s.", tt.want, resp.StatusCode, data)
+			}
+		})
+	}
+}
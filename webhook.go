@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	webhookStoreName = "webhook-state"
+	webhookIndexKey  = "webhooks"
+
+	webhookEventStatusChanged = "order.status_changed"
+
+	// headerWebhookSignature carries the signature of the notifications,
+	// sha256= followed by the hex-encoded HMAC-SHA256 of the body with the
+	// secret of the webhook.
+	headerWebhookSignature = "X-Signature"
+)
+
+// ErrWebhookNotFound is returned when no webhook is registered under an ID.
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// webhookStoreRetry retries the updates of the state of the webhooks which
+// another writer modified in the meantime.
+var webhookStoreRetry = RetryPolicy{MaxAttempts: 5, BaseDelay: 10 * time.Millisecond, MaxDelay: 100 * time.Millisecond}
+
+// Webhook is an endpoint notified whenever an order changes status.
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Secret is the key the notifications are signed with, only answered
+	// as the webhook is registered. The webhooks registered before the
+	// notifications were signed have none. It isn't a Secret, which would
+	// be redacted as the webhook is stored and answered.
+	Secret   string         `json:"secret,omitempty"`
+	Delivery DeliveryStatus `json:"delivery"`
+}
+
+// DeliveryStatus reports how deliveries to a webhook went.
+type DeliveryStatus struct {
+	Delivered      int       `json:"delivered"`
+	Failed         int       `json:"failed"`
+	LastAttemptAt  time.Time `json:"lastAttemptAt,omitempty"`
+	LastStatusCode int       `json:"lastStatusCode,omitempty"`
+	LastError      string    `json:"lastError,omitempty"`
+}
+
+// WebhookEvent is the payload POSTed to webhooks.
+type WebhookEvent struct {
+	Type  string    `json:"type"`
+	Time  time.Time `json:"time"`
+	Order Order     `json:"order"`
+}
+
+// ValidateWebhookURL ensures webhooks point to an absolute HTTP(S) URL.
+func ValidateWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook URL must be an absolute http or https URL, got %q", rawURL)
+	}
+	return nil
+}
+
+// WebhookStore persists webhooks in the Dapr state store. Each webhook is
+// stored under its own key, and an index key lists the registered IDs. Keys
+// are scoped to the tenant of the context.
+type WebhookStore struct {
+	client    dapr.Client
+	storeName string
+
+	// mu serializes index updates made by this instance, ETags protect them
+	// against other instances
+	mu sync.Mutex
+}
+
+func NewWebhookStore(client dapr.Client) *WebhookStore {
+	return &WebhookStore{
+		client:    client,
+		storeName: webhookStoreName,
+	}
+}
+
+func newWebhookID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func newWebhookSecret() (Secret, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return Secret(hex.EncodeToString(b)), nil
+}
+
+func webhookKey(id string) string {
+	return "webhook-" + id
+}
+
+// Register stores a new webhook for rawURL, whose notifications are signed
+// with secret, or with a random one if empty.
+func (s *WebhookStore) Register(ctx context.Context, rawURL string, secret Secret) (*Webhook, error) {
+	if err := ValidateWebhookURL(rawURL); err != nil {
+		return nil, err
+	}
+
+	id, err := newWebhookID()
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		if secret, err = newWebhookSecret(); err != nil {
+			return nil, err
+		}
+	}
+	webhook := &Webhook{ID: id, URL: rawURL, Secret: string(secret)}
+
+	if err := s.save(ctx, webhook); err != nil {
+		return nil, err
+	}
+	if err := s.updateIndex(ctx, func(ids []string) []string {
+		return append(ids, id)
+	}); err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+// Get returns the webhook registered under id.
+func (s *WebhookStore) Get(ctx context.Context, id string) (*Webhook, error) {
+	webhook, _, err := s.get(ctx, id)
+	return webhook, err
+}
+
+// get returns the webhook registered under id, along with its version etag.
+func (s *WebhookStore) get(ctx context.Context, id string) (*Webhook, string, error) {
+	item, err := s.client.GetState(ctx, s.storeName, tenantKey(ctx, webhookKey(id)), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if item == nil || len(item.Value) == 0 {
+		return nil, "", ErrWebhookNotFound
+	}
+
+	var webhook Webhook
+	if err := json.Unmarshal(item.Value, &webhook); err != nil {
+		return nil, "", fmt.Errorf("couldn't decode webhook %s: %w", id, err)
+	}
+	return &webhook, item.Etag, nil
+}
+
+// List returns every registered webhook.
+func (s *WebhookStore) List(ctx context.Context) ([]*Webhook, error) {
+	ids, _, err := s.index(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := make([]*Webhook, 0, len(ids))
+	for _, id := range ids {
+		webhook, err := s.Get(ctx, id)
+		if errors.Is(err, ErrWebhookNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
+
+// Delete unregisters the webhook stored under id.
+func (s *WebhookStore) Delete(ctx context.Context, id string) error {
+	if _, err := s.Get(ctx, id); err != nil {
+		return err
+	}
+	if err := s.updateIndex(ctx, func(ids []string) []string {
+		return slices.DeleteFunc(ids, func(i string) bool { return i == id })
+	}); err != nil {
+		return err
+	}
+	return s.client.DeleteState(ctx, s.storeName, tenantKey(ctx, webhookKey(id)), nil)
+}
+
+// RecordDelivery updates the delivery status of the webhook stored under id.
+// The status is saved over the version it was read from, and updated again
+// if a concurrent delivery recorded its own meanwhile, so that no delivery
+// goes uncounted. ErrWebhookNotFound is returned, rather than the webhook
+// stored again, if it was deleted meanwhile.
+func (s *WebhookStore) RecordDelivery(ctx context.Context, id string, statusCode int, deliveryErr error) error {
+	return webhookStoreRetry.Do(ctx, func(ctx context.Context) error {
+		webhook, etag, err := s.get(ctx, id)
+		if err != nil {
+			return Permanent(err)
+		}
+
+		webhook.Delivery.LastAttemptAt = time.Now().UTC()
+		webhook.Delivery.LastStatusCode = statusCode
+		if deliveryErr != nil {
+			webhook.Delivery.Failed++
+			webhook.Delivery.LastError = deliveryErr.Error()
+		} else {
+			webhook.Delivery.Delivered++
+			webhook.Delivery.LastError = ""
+		}
+		data, err := json.Marshal(webhook)
+		if err != nil {
+			return Permanent(err)
+		}
+
+		err = s.client.SaveStateWithETag(ctx, s.storeName, tenantKey(ctx, webhookKey(id)), data, etag, nil,
+			dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+		if code := status.Code(err); code == codes.Aborted || code == codes.InvalidArgument {
+			return fmt.Errorf("%w: %w", ErrETagMismatch, err)
+		}
+		return Permanent(err)
+	}, nil)
+}
+
+func (s *WebhookStore) save(ctx context.Context, webhook *Webhook) error {
+	data, err := json.Marshal(webhook)
+	if err != nil {
+		return err
+	}
+	return s.client.SaveState(ctx, s.storeName, tenantKey(ctx, webhookKey(webhook.ID)), data, nil)
+}
+
+func (s *WebhookStore) index(ctx context.Context) ([]string, string, error) {
+	item, err := s.client.GetState(ctx, s.storeName, tenantKey(ctx, webhookIndexKey), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	var ids []string
+	if item != nil && len(item.Value) > 0 {
+		if err := json.Unmarshal(item.Value, &ids); err != nil {
+			return nil, "", fmt.Errorf("couldn't decode webhook index: %w", err)
+		}
+	}
+	var etag string
+	if item != nil {
+		etag = item.Etag
+	}
+	return ids, etag, nil
+}
+
+// updateIndex applies update to the list of registered IDs, retrying when
+// another writer modified the index in the meantime.
+func (s *WebhookStore) updateIndex(ctx context.Context, update func(ids []string) []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return webhookStoreRetry.Do(ctx, func(ctx context.Context) error {
+		ids, etag, err := s.index(ctx)
+		if err != nil {
+			return Permanent(err)
+		}
+		data, err := json.Marshal(update(ids))
+		if err != nil {
+			return Permanent(err)
+		}
+		return s.client.SaveStateWithETag(ctx, s.storeName, tenantKey(ctx, webhookIndexKey), data, etag, nil,
+			dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+	}, nil)
+}
+
+// WebhookConfig controls how webhook notifications are delivered.
+type WebhookConfig struct {
+	Workers   int
+	QueueSize int
+	Timeout   time.Duration
+	Retry     RetryPolicy
+}
+
+// WebhookDispatcher delivers order changes to the registered webhooks from a
+// pool of background workers.
+type WebhookDispatcher struct {
+	store   *WebhookStore
+	config  WebhookConfig
+	client  *http.Client
+	metrics *Metrics
+	queue   chan Order
+	wg      sync.WaitGroup
+}
+
+func NewWebhookDispatcher(store *WebhookStore, config WebhookConfig, metrics *Metrics) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		store:   store,
+		config:  config,
+		client:  &http.Client{Timeout: config.Timeout},
+		metrics: metrics,
+		queue:   make(chan Order, config.QueueSize),
+	}
+}
+
+// Start runs the workers until ctx is done.
+func (d *WebhookDispatcher) Start(ctx context.Context) {
+	for i := 0; i < d.config.Workers; i++ {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case order := <-d.queue:
+					d.dispatch(ctx, order)
+				}
+			}
+		}()
+	}
+}
+
+// Wait blocks until the workers stopped.
+func (d *WebhookDispatcher) Wait() {
+	d.wg.Wait()
+}
+
+// Notify queues a notification of the order change. It never blocks: the
+// notification is dropped if the queue is full.
+func (d *WebhookDispatcher) Notify(order Order) {
+	select {
+	case d.queue <- order:
+	default:
+		slog.Warn("webhook queue is full, dropping notification", "order", order.ID)
+		d.metrics.WebhookDeliveries.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (d *WebhookDispatcher) dispatch(ctx context.Context, order Order) {
+	// only the webhooks of the tenant of the order are notified
+	ctx = WithTenant(ctx, order.Tenant)
+
+	webhooks, err := d.store.List(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't list webhooks", "error", err)
+		return
+	}
+
+	payload, err := json.Marshal(WebhookEvent{
+		Type:  webhookEventStatusChanged,
+		Time:  time.Now().UTC(),
+		Order: order,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't encode webhook event", "error", err)
+		return
+	}
+
+	for _, webhook := range webhooks {
+		statusCode, err := d.deliver(ctx, webhook, payload)
+		if err != nil {
+			slog.WarnContext(ctx, "couldn't deliver webhook", "webhook", webhook.ID, "order", order.ID, "error", err)
+			d.metrics.WebhookDeliveries.WithLabelValues("failed").Inc()
+		} else {
+			d.metrics.WebhookDeliveries.WithLabelValues("delivered").Inc()
+		}
+
+		err = d.store.RecordDelivery(ctx, webhook.ID, statusCode, err)
+		if errors.Is(err, ErrWebhookNotFound) {
+			slog.InfoContext(ctx, "webhook deleted during its delivery", "webhook", webhook.ID)
+		} else if err != nil {
+			slog.ErrorContext(ctx, "couldn't record webhook delivery", "webhook", webhook.ID, "error", err)
+		}
+	}
+}
+
+// deliver POSTs payload to webhook, signed with its secret, retrying on
+// network errors and 5xx responses.
+func (d *WebhookDispatcher) deliver(ctx context.Context, webhook *Webhook, payload []byte) (int, error) {
+	var statusCode int
+
+	err := d.config.Retry.Do(ctx, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(payload))
+		if err != nil {
+			return Permanent(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if webhook.Secret != "" {
+			req.Header.Set(headerWebhookSignature, webhookSignature(Secret(webhook.Secret), payload))
+		}
+
+		resp, err := d.client.Do(req)
+		if err != nil {
+			statusCode = 0
+			return err
+		}
+		resp.Body.Close()
+		statusCode = resp.StatusCode
+
+		switch {
+		case resp.StatusCode >= 500:
+			return fmt.Errorf("webhook answered %d", resp.StatusCode)
+		case resp.StatusCode >= 300:
+			return Permanent(fmt.Errorf("webhook answered %d", resp.StatusCode))
+		}
+		return nil
+	}, func(attempt int, err error) {
+		d.metrics.WebhookDeliveries.WithLabelValues("retried").Inc()
+	})
+
+	return statusCode, err
+}
+
+// webhookSignature returns the value of the signature header of a
+// notification of payload.
+func webhookSignature(secret Secret, payload []byte) string {
+	return "sha256=" + sign(secret, payload)
+}
+
+type schemaRegisterWebhook struct {
+	URL    string `json:"url"`
+	Secret Secret `json:"secret"`
+}
+
+func (h *AppHandler) handleWebhooksCreate(w http.ResponseWriter, r *http.Request) {
+	var body schemaRegisterWebhook
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad request")
+		return
+	}
+	if err := ValidateWebhookURL(body.URL); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad request: %s", err)
+		return
+	}
+
+	webhook, err := h.webhooks.Register(r.Context(), body.URL, body.Secret)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "couldn't register webhook", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Service unavailable")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "registered webhook", "id", webhook.ID, "url", webhook.URL)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(webhook); err != nil {
+		slog.ErrorContext(r.Context(), "couldn't encode webhook", "error", err)
+	}
+}
+
+func (h *AppHandler) handleWebhooksList(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := h.webhooks.List(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "couldn't list webhooks", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Service unavailable")
+		return
+	}
+
+	// the secrets are only answered as the webhooks are registered
+	for _, webhook := range webhooks {
+		webhook.Secret = ""
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(webhooks); err != nil {
+		slog.ErrorContext(r.Context(), "couldn't encode webhooks", "error", err)
+	}
+}
+
+func (h *AppHandler) handleWebhooksGet(w http.ResponseWriter, r *http.Request) {
+	webhook, err := h.webhooks.Get(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, ErrWebhookNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Webhook not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "couldn't get webhook", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Service unavailable")
+		return
+	}
+
+	webhook.Secret = ""
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(webhook); err != nil {
+		slog.ErrorContext(r.Context(), "couldn't encode webhook", "error", err)
+	}
+}
+
+func (h *AppHandler) handleWebhooksDelete(w http.ResponseWriter, r *http.Request) {
+	err := h.webhooks.Delete(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, ErrWebhookNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Webhook not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "couldn't delete webhook", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Service unavailable")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
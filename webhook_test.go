@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+)
+
+func TestValidateWebhookURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"http://receiver:8080/hooks", false},
+		{"https://example.com/hooks", false},
+		{"ftp://example.com/hooks", true},
+		{"/hooks", true},
+		{"http://", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			err := ValidateWebhookURL(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t. Got %v.", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestWebhookStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewWebhookStore(&fakeDaprClient{})
+
+	first, err := store.Register(ctx, "http://receiver/first", "")
+	if err != nil {
+		t.Fatalf("couldn't register webhook: %s", err)
+	}
+	second, err := store.Register(ctx, "http://receiver/second", "")
+	if err != nil {
+		t.Fatalf("couldn't register webhook: %s", err)
+	}
+
+	webhooks, err := store.List(ctx)
+	if err != nil {
+		t.Fatalf("couldn't list webhooks: %s", err)
+	}
+	if len(webhooks) != 2 || webhooks[0].ID != first.ID || webhooks[1].ID != second.ID {
+		t.Fatalf("expected both webhooks to be listed. Got %v.", webhooks)
+	}
+
+	if err := store.Delete(ctx, first.ID); err != nil {
+		t.Fatalf("couldn't delete webhook: %s", err)
+	}
+	if _, err := store.Get(ctx, first.ID); !errors.Is(err, ErrWebhookNotFound) {
+		t.Fatalf("expected ErrWebhookNotFound for a deleted webhook. Got %v.", err)
+	}
+	if err := store.Delete(ctx, first.ID); !errors.Is(err, ErrWebhookNotFound) {
+		t.Fatalf("expected ErrWebhookNotFound when deleting twice. Got %v.", err)
+	}
+
+	webhooks, err = store.List(ctx)
+	if err != nil {
+		t.Fatalf("couldn't list webhooks: %s", err)
+	}
+	if len(webhooks) != 1 || webhooks[0].ID != second.ID {
+		t.Fatalf("expected only the second webhook to be listed. Got %v.", webhooks)
+	}
+}
+
+// racingStateClient runs race once the state was first read, as a concurrent
+// writer would.
+type racingStateClient struct {
+	*fakeDaprClient
+	race func()
+}
+
+func (c *racingStateClient) GetState(ctx context.Context, storeName, key string, meta map[string]string) (*dapr.StateItem, error) {
+	item, err := c.fakeDaprClient.GetState(ctx, storeName, key, meta)
+	if race := c.race; race != nil {
+		c.race = nil
+		race()
+	}
+	return item, err
+}
+
+func TestWebhookStoreRecordDelivery(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("concurrent delivery", func(t *testing.T) {
+		client := &racingStateClient{fakeDaprClient: &fakeDaprClient{}}
+		store := NewWebhookStore(client)
+		webhook, err := store.Register(ctx, "http://receiver/hook", "")
+		if err != nil {
+			t.Fatalf("couldn't register webhook: %s", err)
+		}
+
+		// the delivery recorded in the meantime is counted along
+		concurrent := NewWebhookStore(client.fakeDaprClient)
+		client.race = func() {
+			if err := concurrent.RecordDelivery(ctx, webhook.ID, http.StatusServiceUnavailable, errors.New("webhook answered 503")); err != nil {
+				t.Errorf("couldn't record concurrent delivery: %s", err)
+			}
+		}
+		if err := store.RecordDelivery(ctx, webhook.ID, http.StatusOK, nil); err != nil {
+			t.Fatalf("couldn't record delivery: %s", err)
+		}
+
+		webhook, err = store.Get(ctx, webhook.ID)
+		if err != nil {
+			t.Fatalf("couldn't get webhook: %s", err)
+		}
+		if webhook.Delivery.Delivered != 1 || webhook.Delivery.Failed != 1 || webhook.Delivery.LastStatusCode != http.StatusOK {
+			t.Fatalf("expected both deliveries to be recorded. Got %+v.", webhook.Delivery)
+		}
+	})
+
+	t.Run("deleted webhook", func(t *testing.T) {
+		client := &racingStateClient{fakeDaprClient: &fakeDaprClient{}}
+		store := NewWebhookStore(client)
+		webhook, err := store.Register(ctx, "http://receiver/hook", "")
+		if err != nil {
+			t.Fatalf("couldn't register webhook: %s", err)
+		}
+
+		// the webhook deleted in the meantime isn't stored again
+		client.race = func() {
+			if err := store.Delete(ctx, webhook.ID); err != nil {
+				t.Errorf("couldn't delete webhook: %s", err)
+			}
+		}
+		if err := store.RecordDelivery(ctx, webhook.ID, http.StatusOK, nil); !errors.Is(err, ErrWebhookNotFound) {
+			t.Fatalf("expected ErrWebhookNotFound. Got %v.", err)
+		}
+		if _, err := store.Get(ctx, webhook.ID); !errors.Is(err, ErrWebhookNotFound) {
+			t.Fatalf("expected the webhook to stay deleted. Got %v.", err)
+		}
+	})
+}
+
+// webhookSecret is the secret the webhooks of the tests are registered with.
+const webhookSecret Secret = "webhook-secret"
+
+// webhookReceiver answers the first failures requests with a 503 and records
+// the events of the following ones, rejecting those which aren't signed with
+// webhookSecret.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failures int
+	status   int
+	requests int
+	events   []WebhookEvent
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	rcv.requests++
+	if rcv.failures > 0 {
+		rcv.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if rcv.status != 0 {
+		w.WriteHeader(rcv.status)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !hmac.Equal([]byte(r.Header.Get(headerWebhookSignature)), []byte(webhookSignature(webhookSecret, body))) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var event WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rcv.events = append(rcv.events, event)
+}
+
+func dispatchOnce(t *testing.T, receiver *webhookReceiver, order Order, secret Secret) *Webhook {
+	t.Helper()
+
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	ctx := context.Background()
+	store := NewWebhookStore(&fakeDaprClient{})
+	webhook, err := store.Register(ctx, server.URL, secret)
+	if err != nil {
+		t.Fatalf("couldn't register webhook: %s", err)
+	}
+
+	dispatcher := NewWebhookDispatcher(store, WebhookConfig{
+		Workers:   1,
+		QueueSize: 1,
+		Timeout:   time.Second,
+		Retry:     RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	}, NewMetrics())
+	dispatcher.dispatch(ctx, order)
+
+	webhook, err = store.Get(ctx, webhook.ID)
+	if err != nil {
+		t.Fatalf("couldn't get webhook: %s", err)
+	}
+	return webhook
+}
+
+func TestWebhookDispatcherDelivers(t *testing.T) {
+	receiver := &webhookReceiver{failures: 2}
+	order := Order{ID: "order-1234", Status: OrderStatusPaid}
+
+	webhook := dispatchOnce(t, receiver, order, webhookSecret)
+
+	if receiver.requests != 3 {
+		t.Fatalf("expected 3 requests. Got %d.", receiver.requests)
+	}
+	if len(receiver.events) != 1 || receiver.events[0].Type != webhookEventStatusChanged || !reflect.DeepEqual(receiver.events[0].Order, order) {
+		t.Fatalf("expected a single %s event for %v. Got %v.", webhookEventStatusChanged, order, receiver.events)
+	}
+	if webhook.Delivery.Delivered != 1 || webhook.Delivery.Failed != 0 || webhook.Delivery.LastStatusCode != http.StatusOK {
+		t.Fatalf("expected a successful delivery to be recorded. Got %+v.", webhook.Delivery)
+	}
+}
+
+func TestWebhookDispatcherGivesUp(t *testing.T) {
+	receiver := &webhookReceiver{failures: 5}
+
+	webhook := dispatchOnce(t, receiver, Order{ID: "order-1234", Status: OrderStatusPaid}, webhookSecret)
+
+	if receiver.requests != 3 {
+		t.Fatalf("expected 3 requests. Got %d.", receiver.requests)
+	}
+	if webhook.Delivery.Failed != 1 || webhook.Delivery.LastStatusCode != http.StatusServiceUnavailable || webhook.Delivery.LastError == "" {
+		t.Fatalf("expected a failed delivery to be recorded. Got %+v.", webhook.Delivery)
+	}
+}
+
+func TestWebhookDispatcherDoesNotRetryClientErrors(t *testing.T) {
+	receiver := &webhookReceiver{status: http.StatusGone}
+
+	webhook := dispatchOnce(t, receiver, Order{ID: "order-1234", Status: OrderStatusPaid}, webhookSecret)
+
+	if receiver.requests != 1 {
+		t.Fatalf("expected a single request. Got %d.", receiver.requests)
+	}
+	if webhook.Delivery.Failed != 1 || webhook.Delivery.LastStatusCode != http.StatusGone {
+		t.Fatalf("expected a failed delivery to be recorded. Got %+v.", webhook.Delivery)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret Secret
+		// expected is the status code the receiver answered
+		expected int
+	}{
+		{name: "webhook secret", secret: webhookSecret, expected: http.StatusOK},
+		{name: "other secret", secret: "other-secret", expected: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := &webhookReceiver{}
+			webhook := dispatchOnce(t, receiver, Order{ID: "order-1234", Status: OrderStatusPaid}, tt.secret)
+			if webhook.Delivery.LastStatusCode != tt.expected {
+				t.Fatalf("expected status code %d. Got %+v.", tt.expected, webhook.Delivery)
+			}
+		})
+	}
+
+	// a webhook registered without a secret gets a random one
+	webhook, err := NewWebhookStore(&fakeDaprClient{}).Register(context.Background(), "http://receiver/hook", "")
+	if err != nil {
+		t.Fatalf("couldn't register webhook: %s", err)
+	}
+	if len(webhook.Secret) != 64 {
+		t.Fatalf("expected a random secret. Got %q.", string(webhook.Secret))
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsMessageOrder      = "order"
+	wsMessageSubscribed = "subscribed"
+	wsMessageError      = "error"
+
+	wsActionSubscribe   = "subscribe"
+	wsActionUnsubscribe = "unsubscribe"
+
+	wsWriteWait      = 10 * time.Second
+	wsPongWait       = 60 * time.Second
+	wsPingPeriod     = wsPongWait * 9 / 10
+	wsMaxMessageSize = 4096
+	wsSendBuffer     = 16
+)
+
+var orderIDPattern = regexp.MustCompile(`^order-[0-9]{4}$`)
+
+// WSMessage is a message pushed to WebSocket clients.
+type WSMessage struct {
+	Type   string   `json:"type"`
+	Order  *Order   `json:"order,omitempty"`
+	Orders []string `json:"orders,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// WSCommand is a message sent by WebSocket clients to change the orders they
+// receive updates for.
+type WSCommand struct {
+	Action string   `json:"action"`
+	Orders []string `json:"orders"`
+}
+
+// OrderHub fans order events out to the connected WebSocket clients.
+type OrderHub struct {
+	mu      sync.Mutex
+	clients map[*hubClient]struct{}
+}
+
+func NewOrderHub() *OrderHub {
+	return &OrderHub{clients: map[*hubClient]struct{}{}}
+}
+
+// hubClient is a connection registered on the hub. It receives the events of
+// the orders of its tenant it is subscribed to, or of every order of its
+// tenant when it isn't subscribed to any.
+type hubClient struct {
+	send   chan WSMessage
+	tenant string
+
+	mu     sync.Mutex
+	orders map[string]bool
+}
+
+func (c *hubClient) wants(order Order) bool {
+	if order.Tenant != c.tenant {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.orders) == 0 || c.orders[order.ID]
+}
+
+func (c *hubClient) subscribe(ids []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range ids {
+		c.orders[id] = true
+	}
+}
+
+func (c *hubClient) unsubscribe(ids []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range ids {
+		delete(c.orders, id)
+	}
+}
+
+func (c *hubClient) subscriptions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]string, 0, len(c.orders))
+	for id := range c.orders {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func (h *OrderHub) register(tenant string, orders []string) *hubClient {
+	c := &hubClient{
+		send:   make(chan WSMessage, wsSendBuffer),
+		tenant: tenant,
+		orders: map[string]bool{},
+	}
+	c.subscribe(orders)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[c] = struct{}{}
+	return c
+}
+
+// unregister removes c from the hub and closes its send channel. It is safe
+// to call several times.
+func (h *OrderHub) unregister(c *hubClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c.send)
+	}
+}
+
+// Broadcast pushes order to the clients subscribed to it. Clients too slow to
+// keep up are disconnected rather than holding back the others.
+func (h *OrderHub) Broadcast(order Order) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range h.clients {
+		if !c.wants(order) {
+			continue
+		}
+		select {
+		case c.send <- WSMessage{Type: wsMessageOrder, Order: &order}:
+		default:
+			slog.Warn("websocket client too slow, disconnecting", "order", order.ID)
+			delete(h.clients, c)
+			close(c.send)
+		}
+	}
+}
+
+// Len returns the number of connected clients.
+func (h *OrderHub) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// reply queues msg for c unless it was unregistered. Replies are dropped
+// rather than blocking the reader when the client is falling behind.
+func (h *OrderHub) reply(c *hubClient, msg WSMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	select {
+	case c.send <- msg:
+	default:
+	}
+}
+
+func validateOrderIDs(ids []string) error {
+	for _, id := range ids {
+		if !orderIDPattern.MatchString(id) {
+			return fmt.Errorf("invalid order ID %q", id)
+		}
+	}
+	return nil
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// handleWebSocket streams order events to the client. The orders query
+// parameter holds a comma-separated list of the order IDs to receive events
+// for; clients can change it later on with subscribe and unsubscribe
+// commands.
+func (h *AppHandler) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	var orders []string
+	if v := r.URL.Query().Get("orders"); v != "" {
+		orders = splitList(v)
+	}
+	if err := validateOrderIDs(orders); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad request: %s", err)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already answered the client
+		slog.WarnContext(r.Context(), "couldn't upgrade websocket connection", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	client := h.hub.register(TenantFromContext(r.Context()), orders)
+	defer h.hub.unregister(client)
+	slog.InfoContext(r.Context(), "websocket client connected", "remote", r.RemoteAddr, "orders", orders)
+
+	go h.readWebSocket(conn, client)
+	writeWebSocket(conn, client)
+
+	slog.InfoContext(r.Context(), "websocket client disconnected", "remote", r.RemoteAddr)
+}
+
+// readWebSocket handles the commands of the client until the connection is
+// closed, then unregisters it so that the writer returns.
+func (h *AppHandler) readWebSocket(conn *websocket.Conn, client *hubClient) {
+	defer h.hub.unregister(client)
+
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				slog.Warn("websocket connection closed unexpectedly", "error", err)
+			}
+			return
+		}
+		h.hub.reply(client, handleWSCommand(client, data))
+	}
+}
+
+// handleWSCommand applies the command in data to the subscriptions of client
+// and returns the reply to send back.
+func handleWSCommand(client *hubClient, data []byte) WSMessage {
+	var cmd WSCommand
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return WSMessage{Type: wsMessageError, Error: "invalid command"}
+	}
+	if err := validateOrderIDs(cmd.Orders); err != nil {
+		return WSMessage{Type: wsMessageError, Error: err.Error()}
+	}
+
+	switch cmd.Action {
+	case wsActionSubscribe:
+		client.subscribe(cmd.Orders)
+	case wsActionUnsubscribe:
+		client.unsubscribe(cmd.Orders)
+	default:
+		return WSMessage{Type: wsMessageError, Error: fmt.Sprintf("unknown action %q", cmd.Action)}
+	}
+	return WSMessage{Type: wsMessageSubscribed, Orders: client.subscriptions()}
+}
+
+// writeWebSocket writes the messages queued for client and keeps the
+// connection alive with pings until the client is unregistered.
+func writeWebSocket(conn *websocket.Conn, client *hubClient) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg, ok := <-client.send:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if err := conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
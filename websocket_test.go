@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newWebSocketServer(t *testing.T) (*AppHandler, *httptest.Server) {
+	t.Helper()
+
+	h := NewAppHandler(&Config{}, NewMetrics(), nil, nil)
+	h.RegisterRoutes()
+	server := httptest.NewServer(h.router)
+	t.Cleanup(server.Close)
+	return h, server
+}
+
+func dialWebSocket(t *testing.T, h *AppHandler, server *httptest.Server, query string) *websocket.Conn {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws" + query
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("couldn't dial %s: %s", url, err)
+	}
+	resp.Body.Close()
+	t.Cleanup(func() { conn.Close() })
+
+	waitForClients(t, h.hub, 1)
+	return conn
+}
+
+func waitForClients(t *testing.T, hub *OrderHub, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for hub.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d connected clients. Got %d.", n, hub.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func postOrderEvent(t *testing.T, server *httptest.Server, order Order) {
+	t.Helper()
+
+	body := fmt.Sprintf(`{"specversion":"1.0","type":"com.dapr.event.sent","data":{"id":%q,"status":%q}}`, order.ID, order.Status)
+	resp, err := http.Post(server.URL+routeOrderEvents, "application/cloudevents+json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("couldn't post event: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func postProtobufOrderEvent(t *testing.T, server *httptest.Server, order Order) {
+	t.Helper()
+
+	event, err := newCloudEvent(context.Background(), ProtobufEncoder{}, topicOrders, newOrderStatusChanged(order, "", time.Now()))
+	if err != nil {
+		t.Fatalf("couldn't create event: %s", err)
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("couldn't marshal event: %s", err)
+	}
+	resp, err := http.Post(server.URL+routeOrderEvents, contentTypeCloudEvents, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("couldn't post event: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func readWSMessage(t *testing.T, conn *websocket.Conn) WSMessage {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var msg WSMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("couldn't read message: %s", err)
+	}
+	return msg
+}
+
+func TestWebSocketFiltersOrders(t *testing.T) {
+	h, server := newWebSocketServer(t)
+	conn := dialWebSocket(t, h, server, "?orders=order-1234")
+
+	postOrderEvent(t, server, Order{ID: "order-5678", Status: OrderStatusPending})
+	postOrderEvent(t, server, Order{ID: "order-1234", Status: OrderStatusPaid})
+
+	msg := readWSMessage(t, conn)
+	expected := Order{ID: "order-1234", Status: OrderStatusPaid}
+	if msg.Type != wsMessageOrder || msg.Order == nil || !reflect.DeepEqual(*msg.Order, expected) {
+		t.Fatalf("expected an order message for %v. Got %+v.", expected, msg)
+	}
+
+	if err := conn.WriteJSON(WSCommand{Action: wsActionSubscribe, Orders: []string{"order-5678"}}); err != nil {
+		t.Fatalf("couldn't write command: %s", err)
+	}
+	msg = readWSMessage(t, conn)
+	if msg.Type != wsMessageSubscribed || !slices.Equal(msg.Orders, []string{"order-1234", "order-5678"}) {
+		t.Fatalf("expected subscriptions to order-1234 and order-5678. Got %+v.", msg)
+	}
+
+	postOrderEvent(t, server, Order{ID: "order-5678", Status: OrderStatusPaid})
+	msg = readWSMessage(t, conn)
+	if msg.Type != wsMessageOrder || msg.Order == nil || msg.Order.ID != "order-5678" {
+		t.Fatalf("expected an order message for order-5678. Got %+v.", msg)
+	}
+}
+
+func TestWebSocketAllOrders(t *testing.T) {
+	h, server := newWebSocketServer(t)
+	conn := dialWebSocket(t, h, server, "")
+
+	for _, id := range []string{"order-0001", "order-0002"} {
+		postOrderEvent(t, server, Order{ID: id, Status: OrderStatusPending})
+		if msg := readWSMessage(t, conn); msg.Order == nil || msg.Order.ID != id {
+			t.Fatalf("expected an order message for %s. Got %+v.", id, msg)
+		}
+	}
+}
+
+func TestWebSocketProtobufEvents(t *testing.T) {
+	h, server := newWebSocketServer(t)
+	conn := dialWebSocket(t, h, server, "")
+
+	order := Order{ID: "order-1234", Status: OrderStatusPaid}
+	postProtobufOrderEvent(t, server, order)
+
+	if msg := readWSMessage(t, conn); msg.Order == nil || !reflect.DeepEqual(*msg.Order, order) {
+		t.Fatalf("expected an order message for %v. Got %+v.", order, msg)
+	}
+}
+
+func TestWebSocketInvalidCommands(t *testing.T) {
+	h, server := newWebSocketServer(t)
+	conn := dialWebSocket(t, h, server, "")
+
+	for _, cmd := range []string{`not json`, `{"action":"subscribe","orders":["1234"]}`, `{"action":"wait"}`} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(cmd)); err != nil {
+			t.Fatalf("couldn't write command: %s", err)
+		}
+		if msg := readWSMessage(t, conn); msg.Type != wsMessageError {
+			t.Fatalf("expected an error message for %s. Got %+v.", cmd, msg)
+		}
+	}
+}
+
+func TestWebSocketInvalidFilter(t *testing.T) {
+	_, server := newWebSocketServer(t)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?orders=order-1"
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status code %d. Got %d.", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestWebSocketDisconnect(t *testing.T) {
+	h, server := newWebSocketServer(t)
+	conn := dialWebSocket(t, h, server, "")
+
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	conn.Close()
+
+	waitForClients(t, h.hub, 0)
+}
+
+func TestOrderHubDisconnectsSlowClients(t *testing.T) {
+	hub := NewOrderHub()
+	client := hub.register("", nil)
+
+	for i := 0; i <= wsSendBuffer; i++ {
+		hub.Broadcast(Order{ID: "order-1234", Status: OrderStatusPaid})
+	}
+
+	if hub.Len() != 0 {
+		t.Fatalf("expected the slow client to be disconnected. Got %d clients.", hub.Len())
+	}
+	for range client.send {
+	}
+}
+
+func TestOrderHubScopesTenants(t *testing.T) {
+	hub := NewOrderHub()
+	acme := hub.register("acme", nil)
+	globex := hub.register("globex", nil)
+
+	hub.Broadcast(Order{ID: "order-1234", Status: OrderStatusPaid, Tenant: "acme"})
+
+	if len(acme.send) != 1 || len(globex.send) != 0 {
+		t.Fatalf("expected only the acme client to receive the order. Got %d and %d messages.", len(acme.send), len(globex.send))
+	}
+}